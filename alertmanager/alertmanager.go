@@ -2,10 +2,13 @@ package alertmanager
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,8 +24,8 @@ import (
 	"github.com/prometheus/alertmanager/types"
 	"github.com/prometheus/alertmanager/ui"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/route"
+	"github.com/weaveworks/cortex/util/log"
 	"github.com/weaveworks/mesh"
 )
 
@@ -37,6 +40,8 @@ type Config struct {
 	MeshRouter  *mesh.Router
 	Retention   time.Duration
 	ExternalURL *url.URL
+	// Rate limits of notifications, or nil for no limits.
+	Limits NotificationLimits
 }
 
 // An Alertmanager manages the alerts for one user.
@@ -50,17 +55,22 @@ type Alertmanager struct {
 	alerts     *mem.Alerts
 	dispatcher *dispatch.Dispatcher
 	inhibitor  *inhibit.Inhibitor
+	limiter    *notificationLimiter
 	stop       chan struct{}
 	wg         sync.WaitGroup
 	router     *route.Router
+
+	activeMtx sync.Mutex
+	active    bool
 }
 
 // New creates a new Alertmanager.
 func New(cfg *Config) (*Alertmanager, error) {
 	am := &Alertmanager{
-		cfg:    cfg,
-		logger: cfg.Logger.With("user", cfg.UserID),
-		stop:   make(chan struct{}),
+		cfg:     cfg,
+		logger:  cfg.Logger.With("user", cfg.UserID),
+		limiter: newNotificationLimiter(cfg.UserID, cfg.Limits),
+		stop:    make(chan struct{}),
 	}
 
 	am.wg.Add(1)
@@ -139,19 +149,21 @@ func New(cfg *Config) (*Alertmanager, error) {
 	return am, nil
 }
 
-// ApplyConfig applies a new configuration to an Alertmanager.
-func (am *Alertmanager) ApplyConfig(conf *config.Config) error {
-	var (
-		tmpl     *template.Template
-		pipeline notify.Stage
-	)
+// ApplyConfig applies a new configuration to an Alertmanager, with the
+// notification templates the user uploaded, which map a file name to its
+// contents.  They're all loaded, so the config doesn't list them.
+func (am *Alertmanager) ApplyConfig(conf *config.Config, templates map[string]string) error {
+	var pipeline notify.Stage
 
-	// TODO(cortex): How to support template files?
 	if len(conf.Templates) != 0 {
 		return fmt.Errorf("template files are not yet supported")
 	}
 
-	tmpl, err := template.FromGlobs()
+	templatesDir, err := am.writeTemplates(templates)
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.FromGlobs(filepath.Join(templatesDir, "*"))
 	if err != nil {
 		return err
 	}
@@ -175,7 +187,7 @@ func (am *Alertmanager) ApplyConfig(conf *config.Config) error {
 		return d + waitFunc()
 	}
 
-	pipeline = notify.BuildPipeline(
+	pipeline = buildPipeline(
 		conf.Receivers,
 		tmpl,
 		waitFunc,
@@ -183,15 +195,59 @@ func (am *Alertmanager) ApplyConfig(conf *config.Config) error {
 		am.silences,
 		am.nflog,
 		am.marker,
+		am.limiter,
 	)
 	am.dispatcher = dispatch.NewDispatcher(am.alerts, dispatch.NewRoute(conf.Route, nil), pipeline, am.marker, timeoutFunc)
 
 	go am.dispatcher.Run()
 	go am.inhibitor.Run()
 
+	am.activeMtx.Lock()
+	am.active = true
+	am.activeMtx.Unlock()
 	return nil
 }
 
+// writeTemplates replaces the user's template files on disk with templates,
+// and returns the directory they're in.
+func (am *Alertmanager) writeTemplates(templates map[string]string) (string, error) {
+	dir := filepath.Join(am.cfg.DataDir, "templates", am.cfg.UserID)
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	for name, contents := range templates {
+		if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+			return "", fmt.Errorf("invalid template file name %q", name)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0666); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// Pause stops the Alertmanager sending notifications, until a config is
+// applied again.
+func (am *Alertmanager) Pause() {
+	am.activeMtx.Lock()
+	am.active = false
+	am.activeMtx.Unlock()
+
+	am.inhibitor.Stop()
+	am.dispatcher.Stop()
+}
+
+// IsActive returns whether the Alertmanager has a config applied, and isn't
+// paused.
+func (am *Alertmanager) IsActive() bool {
+	am.activeMtx.Lock()
+	defer am.activeMtx.Unlock()
+	return am.active
+}
+
 // Stop stops the Alertmanager.
 func (am *Alertmanager) Stop() {
 	am.dispatcher.Stop()
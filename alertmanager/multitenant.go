@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"reflect"
 	"strconv"
 	"sync"
 	"time"
@@ -13,12 +14,12 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 
 	"github.com/weaveworks/common/instrument"
 	"github.com/weaveworks/common/user"
 	configs "github.com/weaveworks/cortex/configs/client"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 	"github.com/weaveworks/mesh"
 )
 
@@ -61,10 +62,14 @@ type MultitenantAlertmanagerConfig struct {
 	MeshNickname   string
 	MeshPassword   string
 	MeshPeers      stringset
+
+	MeshPeerService         string
+	MeshPeerRefreshInterval time.Duration
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet.
 func (cfg *MultitenantAlertmanagerConfig) RegisterFlags(f *flag.FlagSet) {
+	cfg.MeshPeers = stringset{}
 	flag.StringVar(&cfg.DataDir, "alertmanager.storage.path", "data/", "Base path for data storage.")
 	flag.DurationVar(&cfg.Retention, "alertmanager.storage.retention", 5*24*time.Hour, "How long to keep data for.")
 
@@ -79,12 +84,15 @@ func (cfg *MultitenantAlertmanagerConfig) RegisterFlags(f *flag.FlagSet) {
 	flag.StringVar(&cfg.MeshNickname, "alertmanager.mesh.nickname", mustHostname(), "Mesh peer nickname")
 	flag.StringVar(&cfg.MeshPassword, "alertmanager.mesh.password", "", "Password to join the Mesh peer network (empty password disables encryption)")
 	flag.Var(&cfg.MeshPeers, "alertmanager.mesh.peer", "Initial Mesh peers (may be repeated)")
+	flag.StringVar(&cfg.MeshPeerService, "alertmanager.mesh.peer.service", "", "DNS name resolving to the addresses of all the Alertmanager replicas, e.g. a Kubernetes headless service, to gossip silences and notification logs with. Replicas listen for the mesh on the same port as this one.")
+	flag.DurationVar(&cfg.MeshPeerRefreshInterval, "alertmanager.mesh.peer.refresh-interval", time.Minute, "How often to resolve -alertmanager.mesh.peer.service again, to connect to replicas which have restarted.")
 }
 
 // A MultitenantAlertmanager manages Alertmanager instances for multiple
 // organizations.
 type MultitenantAlertmanager struct {
-	cfg *MultitenantAlertmanagerConfig
+	cfg    *MultitenantAlertmanagerConfig
+	limits NotificationLimits
 
 	configsAPI configs.AlertManagerConfigsAPI
 
@@ -98,13 +106,15 @@ type MultitenantAlertmanager struct {
 	latestMutex  sync.RWMutex
 
 	meshRouter *mesh.Router
+	peers      *peerRefresher
 
 	stop chan struct{}
 	done chan struct{}
 }
 
-// NewMultitenantAlertmanager creates a new MultitenantAlertmanager.
-func NewMultitenantAlertmanager(cfg *MultitenantAlertmanagerConfig) (*MultitenantAlertmanager, error) {
+// NewMultitenantAlertmanager creates a new MultitenantAlertmanager, whose
+// users' notifications are rate limited by limits.
+func NewMultitenantAlertmanager(cfg *MultitenantAlertmanagerConfig, limits NotificationLimits) (*MultitenantAlertmanager, error) {
 	err := os.MkdirAll(cfg.DataDir, 0777)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create Alertmanager data directory %q: %s", cfg.DataDir, err)
@@ -113,9 +123,7 @@ func NewMultitenantAlertmanager(cfg *MultitenantAlertmanagerConfig) (*Multitenan
 	mrouter := initMesh(cfg.MeshListenAddr, cfg.MeshHWAddr, cfg.MeshNickname, cfg.MeshPassword)
 
 	mrouter.Start()
-	defer mrouter.Stop()
-
-	mrouter.ConnectionMaker.InitiateConnections(cfg.MeshPeers.slice(), true)
+	peers := newPeerRefresher(mrouter, cfg)
 
 	configsAPI := configs.AlertManagerConfigsAPI{
 		URL:     cfg.ConfigsAPIURL.URL,
@@ -124,10 +132,12 @@ func NewMultitenantAlertmanager(cfg *MultitenantAlertmanagerConfig) (*Multitenan
 
 	return &MultitenantAlertmanager{
 		cfg:           cfg,
+		limits:        limits,
 		configsAPI:    configsAPI,
 		cfgs:          map[string]configs.CortexConfig{},
 		alertmanagers: map[string]*Alertmanager{},
 		meshRouter:    mrouter,
+		peers:         peers,
 		stop:          make(chan struct{}),
 		done:          make(chan struct{}),
 	}, nil
@@ -161,6 +171,8 @@ func (am *MultitenantAlertmanager) Stop() {
 	for _, am := range am.alertmanagers {
 		am.Stop()
 	}
+	am.peers.Stop()
+	am.meshRouter.Stop()
 	log.Debugf("MultitenantAlertmanager stopped")
 }
 
@@ -215,6 +227,18 @@ func (am *MultitenantAlertmanager) addNewConfigs(cfgs map[string]configs.CortexC
 	// TODO: instrument how many configs we have, both valid & invalid.
 	log.Debugf("Adding %d configurations", len(cfgs))
 	for userID, config := range cfgs {
+		if config.Config.AlertmanagerConfig == "" {
+			// The user's config was deleted.  Their Alertmanager can't be
+			// stopped and started again, as its gossip channels can't be
+			// removed from the mesh, so pause it until they set one again.
+			if userAM, ok := am.alertmanagers[userID]; ok && userAM.IsActive() {
+				log.Infof("MultitenantAlertmanager: pausing Alertmanager for user %v, whose config was deleted", userID)
+				userAM.Pause()
+			}
+			delete(am.cfgs, userID)
+			continue
+		}
+
 		amConfig, err := config.Config.GetAlertmanagerConfig()
 		if err != nil {
 			// XXX: This means that if a user has a working configuration and
@@ -235,13 +259,14 @@ func (am *MultitenantAlertmanager) addNewConfigs(cfgs map[string]configs.CortexC
 				MeshRouter:  am.meshRouter,
 				Retention:   am.cfg.Retention,
 				ExternalURL: am.cfg.ExternalURL.URL,
+				Limits:      am.limits,
 			})
 			if err != nil {
 				log.Warnf("MultitenantAlertmanager: unable to start Alertmanager for user %v: %v", userID, err)
 				continue
 			}
 
-			if err := newAM.ApplyConfig(amConfig); err != nil {
+			if err := newAM.ApplyConfig(amConfig, config.Config.TemplateFiles); err != nil {
 				log.Warnf("MultitenantAlertmanager: unable to apply initial config for user %v: %v", userID, err)
 				continue
 			}
@@ -249,9 +274,10 @@ func (am *MultitenantAlertmanager) addNewConfigs(cfgs map[string]configs.CortexC
 			am.alertmanagersMtx.Lock()
 			am.alertmanagers[userID] = newAM
 			am.alertmanagersMtx.Unlock()
-		} else if am.cfgs[userID].AlertmanagerConfig != config.Config.AlertmanagerConfig {
-			// If the config changed, apply the new one.
-			err := am.alertmanagers[userID].ApplyConfig(amConfig)
+		} else if am.cfgs[userID].AlertmanagerConfig != config.Config.AlertmanagerConfig ||
+			!reflect.DeepEqual(am.cfgs[userID].TemplateFiles, config.Config.TemplateFiles) {
+			// If the config or templates changed, apply the new ones.
+			err := am.alertmanagers[userID].ApplyConfig(amConfig, config.Config.TemplateFiles)
 			if err != nil {
 				log.Warnf("MultitenantAlertmanager: unable to apply Alertmanager config for user %v: %v", userID, err)
 			}
@@ -271,7 +297,7 @@ func (am *MultitenantAlertmanager) ServeHTTP(w http.ResponseWriter, req *http.Re
 	am.alertmanagersMtx.Lock()
 	userAM, ok := am.alertmanagers[userID]
 	am.alertmanagersMtx.Unlock()
-	if !ok {
+	if !ok || !userAM.IsActive() {
 		http.Error(w, fmt.Sprintf("no Alertmanager for this user ID"), http.StatusNotFound)
 		return
 	}
@@ -0,0 +1,104 @@
+package alertmanager
+
+import (
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/weaveworks/cortex/util/log"
+	"github.com/weaveworks/mesh"
+)
+
+var meshPeers = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "cortex",
+	Name:      "alertmanager_mesh_peers",
+	Help:      "Number of peers in the Alertmanager mesh, including this one, as of the last refresh of the peers.",
+})
+
+func init() {
+	prometheus.MustRegister(meshPeers)
+}
+
+// peerRefresher keeps the mesh connected to the other Alertmanager replicas.
+// The replicas of a peer service are found by resolving its name, and it's
+// resolved again periodically, so replicas which restart with new addresses
+// rejoin the mesh, and get the silences and notification log gossiped to
+// them.
+type peerRefresher struct {
+	router   *mesh.Router
+	static   []string
+	service  string
+	port     string
+	interval time.Duration
+
+	quit, done chan struct{}
+}
+
+func newPeerRefresher(router *mesh.Router, cfg *MultitenantAlertmanagerConfig) *peerRefresher {
+	_, port, err := net.SplitHostPort(cfg.MeshListenAddr)
+	if err != nil {
+		log.Fatalf("mesh address: %s: %v", cfg.MeshListenAddr, err)
+	}
+	p := &peerRefresher{
+		router:   router,
+		static:   cfg.MeshPeers.slice(),
+		service:  cfg.MeshPeerService,
+		port:     port,
+		interval: cfg.MeshPeerRefreshInterval,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	p.refresh()
+	go p.loop()
+	return p
+}
+
+func (p *peerRefresher) loop() {
+	defer close(p.done)
+	if p.service == "" || p.interval <= 0 {
+		<-p.quit
+		return
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.refresh()
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// Stop refreshing the peers.
+func (p *peerRefresher) Stop() {
+	close(p.quit)
+	<-p.done
+}
+
+func (p *peerRefresher) refresh() {
+	for _, err := range p.router.ConnectionMaker.InitiateConnections(p.peers(), true) {
+		log.Warnf("Error connecting to Alertmanager peer: %v", err)
+	}
+	meshPeers.Set(float64(len(p.router.Peers.Descriptions())))
+}
+
+// peers returns the static peers, and the address of each replica of the
+// peer service.  If the service can't be resolved, it's left out, and the
+// connections we have are kept until the next refresh.
+func (p *peerRefresher) peers() []string {
+	peers := append([]string{}, p.static...)
+	if p.service == "" {
+		return peers
+	}
+	hosts, err := net.LookupHost(p.service)
+	if err != nil {
+		log.Warnf("Error resolving Alertmanager peer service %s: %v", p.service, err)
+		return append(peers, p.router.ConnectionMaker.Targets(false)...)
+	}
+	for _, host := range hosts {
+		peers = append(peers, net.JoinHostPort(host, p.port))
+	}
+	return peers
+}
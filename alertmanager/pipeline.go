@@ -0,0 +1,156 @@
+package alertmanager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/alertmanager/config"
+	"github.com/prometheus/alertmanager/inhibit"
+	"github.com/prometheus/alertmanager/nflog"
+	"github.com/prometheus/alertmanager/nflog/nflogpb"
+	"github.com/prometheus/alertmanager/notify"
+	"github.com/prometheus/alertmanager/silence"
+	"github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/alertmanager/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+
+	"github.com/weaveworks/cortex/util/log"
+)
+
+var rateLimitedNotifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "alertmanager_notifications_rate_limited_total",
+	Help:      "Number of notifications which weren't sent because the user's rate limit for the integration was reached.",
+}, []string{"user", "integration"})
+
+func init() {
+	prometheus.MustRegister(rateLimitedNotifications)
+}
+
+// NotificationLimits gives the rate limits of users' notifications to each
+// integration.
+type NotificationLimits interface {
+	NotificationRateLimit(userID, integration string) float64
+	NotificationBurstSize(userID string) int
+}
+
+// buildPipeline is notify.BuildPipeline, with a stage limiting the rate of
+// notifications to each integration after deduplication, so one user's
+// alert storm can't exhaust a shared provider.
+func buildPipeline(
+	confs []*config.Receiver,
+	tmpl *template.Template,
+	wait func() time.Duration,
+	inhibitor *inhibit.Inhibitor,
+	silences *silence.Silences,
+	notificationLog nflog.Log,
+	marker types.Marker,
+	limiter *notificationLimiter,
+) notify.RoutingStage {
+	rs := notify.RoutingStage{}
+
+	is := notify.NewInhibitStage(inhibitor, marker)
+	ss := notify.NewSilenceStage(silences, marker)
+
+	for _, rc := range confs {
+		var fs notify.FanoutStage
+		names := integrationNames(rc)
+		for i, integration := range notify.BuildReceiverIntegrations(rc, tmpl) {
+			recv := &nflogpb.Receiver{
+				GroupName:   rc.Name,
+				Integration: names[i].Integration,
+				Idx:         names[i].Idx,
+			}
+			fs = append(fs, notify.MultiStage{
+				notify.NewWaitStage(wait),
+				notify.NewDedupStage(notificationLog, recv),
+				rateLimitStage{limiter: limiter, integration: recv.Integration},
+				notify.NewRetryStage(integration),
+				notify.NewSetNotifiesStage(notificationLog, recv),
+			})
+		}
+		rs[rc.Name] = notify.MultiStage{is, ss, fs}
+	}
+	return rs
+}
+
+// integrationNames returns the name and index of each integration of a
+// receiver, in the order notify.BuildReceiverIntegrations builds them, which
+// doesn't expose them.
+func integrationNames(rc *config.Receiver) []nflogpb.Receiver {
+	var names []nflogpb.Receiver
+	add := func(name string, n int) {
+		for i := 0; i < n; i++ {
+			names = append(names, nflogpb.Receiver{Integration: name, Idx: uint32(i)})
+		}
+	}
+	add("webhook", len(rc.WebhookConfigs))
+	add("email", len(rc.EmailConfigs))
+	add("pagerduty", len(rc.PagerdutyConfigs))
+	add("opsgenie", len(rc.OpsGenieConfigs))
+	add("slack", len(rc.SlackConfigs))
+	add("hipchat", len(rc.HipchatConfigs))
+	add("victorops", len(rc.VictorOpsConfigs))
+	add("pushover", len(rc.PushoverConfigs))
+	return names
+}
+
+// rateLimitStage drops notifications to an integration over the user's rate
+// limit.  They're not recorded in the notification log, so they're sent on
+// a later flush of their group, once the rate allows.
+type rateLimitStage struct {
+	limiter     *notificationLimiter
+	integration string
+}
+
+func (s rateLimitStage) Exec(ctx context.Context, alerts ...*types.Alert) (context.Context, []*types.Alert, error) {
+	if s.limiter.allow(s.integration) {
+		return ctx, alerts, nil
+	}
+	rateLimitedNotifications.WithLabelValues(s.limiter.userID, s.integration).Inc()
+	log.Warnf("Notification to %s for user %s rate limited", s.integration, s.limiter.userID)
+	return ctx, nil, nil
+}
+
+// notificationLimiter rate limits a user's notifications to each integration.
+type notificationLimiter struct {
+	userID string
+	limits NotificationLimits
+
+	mtx      sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func newNotificationLimiter(userID string, limits NotificationLimits) *notificationLimiter {
+	return &notificationLimiter{
+		userID:   userID,
+		limits:   limits,
+		limiters: map[string]*rate.Limiter{},
+	}
+}
+
+func (l *notificationLimiter) allow(integration string) bool {
+	if l.limits == nil {
+		return true
+	}
+	limit := l.limits.NotificationRateLimit(l.userID, integration)
+	if limit <= 0 {
+		return true
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	// The user's limits may have changed since the limiter was created, if
+	// the overrides have been reloaded.
+	burst := l.limits.NotificationBurstSize(l.userID)
+	limiter, ok := l.limiters[integration]
+	if !ok || limiter.Burst() != burst {
+		limiter = rate.NewLimiter(rate.Limit(limit), burst)
+		l.limiters[integration] = limiter
+	} else if limiter.Limit() != rate.Limit(limit) {
+		limiter.SetLimit(rate.Limit(limit))
+	}
+	return limiter.Allow()
+}
@@ -0,0 +1,76 @@
+package alertmanager
+
+import (
+	"testing"
+
+	"github.com/prometheus/alertmanager/config"
+	"github.com/prometheus/alertmanager/notify"
+	"github.com/prometheus/alertmanager/template"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeLimits struct {
+	limits map[string]float64
+	burst  int
+}
+
+func (f *fakeLimits) NotificationRateLimit(userID, integration string) float64 {
+	return f.limits[integration]
+}
+
+func (f *fakeLimits) NotificationBurstSize(userID string) int {
+	return f.burst
+}
+
+func TestNotificationLimiter(t *testing.T) {
+	limits := &fakeLimits{
+		limits: map[string]float64{"webhook": 0.001},
+		burst:  2,
+	}
+	l := newNotificationLimiter("user1", limits)
+
+	// Each integration has its own limit; 0 is unlimited.
+	assert.True(t, l.allow("webhook"))
+	assert.True(t, l.allow("webhook"))
+	assert.False(t, l.allow("webhook"))
+	for i := 0; i < 10; i++ {
+		assert.True(t, l.allow("slack"))
+	}
+
+	// Changed limits take effect.
+	limits.burst = 3
+	assert.True(t, l.allow("webhook"))
+	limits.limits["webhook"] = 0
+	assert.True(t, l.allow("webhook"))
+
+	assert.True(t, newNotificationLimiter("user1", nil).allow("webhook"))
+}
+
+func TestIntegrationNames(t *testing.T) {
+	cfg, err := config.Load(`
+route:
+  receiver: team
+receivers:
+- name: team
+  webhook_configs:
+  - url: http://example.org/1
+  - url: http://example.org/2
+  slack_configs:
+  - api_url: http://example.org/slack
+    channel: alerts
+`)
+	require.NoError(t, err)
+	tmpl, err := template.FromGlobs()
+	require.NoError(t, err)
+
+	rc := cfg.Receivers[0]
+	names := integrationNames(rc)
+	assert.Len(t, names, len(notify.BuildReceiverIntegrations(rc, tmpl)))
+	var got []string
+	for _, n := range names {
+		got = append(got, n.Integration)
+	}
+	assert.Equal(t, []string{"webhook", "webhook", "slack"}, got)
+	assert.Equal(t, uint32(1), names[1].Idx)
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/weaveworks/common/middleware"
+)
+
+// ScopesHeaderName is the header carrying the scopes a request is authorized
+// for.  Like the org ID header, it is set by the authenticating gateway in
+// front of Cortex, from the credential used.
+const ScopesHeaderName = "X-Scope-Permissions"
+
+// Scope is a class of API a credential can be authorized to use.
+type Scope string
+
+// The scopes a credential can have.
+const (
+	// Write is needed to push samples.
+	Write Scope = "write"
+	// Read is needed to query samples and metadata.
+	Read Scope = "read"
+	// RulesAdmin is needed to change a tenant's rules and alertmanager
+	// configs.
+	RulesAdmin Scope = "rules-admin"
+	// OpsAdmin is needed for operational endpoints which affect the whole
+	// cluster, such as forgetting ingesters in the ring.
+	OpsAdmin Scope = "ops-admin"
+)
+
+// ScopesConfig configures how the scopes of requests are checked.  It's part
+// of Config; services which don't authenticate tenants, but have operational
+// endpoints needing a scope, register it on its own.
+type ScopesConfig struct {
+	RequireScopes bool
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet.
+func (cfg *ScopesConfig) RegisterFlags(f *flag.FlagSet) {
+	f.BoolVar(&cfg.RequireScopes, "auth.require-scopes", false, "Reject requests without an "+ScopesHeaderName+" header from APIs needing a scope, instead of authorizing them for every scope. Set this if the gateway in front of Cortex always sends the header, or JWT bearer tokens always have a scopes claim.")
+}
+
+// InjectScopes sets the scopes a request Cortex sends to another of its
+// components is authorized for.
+func InjectScopes(r *http.Request, scopes ...Scope) {
+	names := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		names = append(names, string(scope))
+	}
+	r.Header.Set(ScopesHeaderName, strings.Join(names, ","))
+}
+
+// ParseScopes parses a comma separated list of scopes.
+func ParseScopes(s string) ([]Scope, error) {
+	var scopes []Scope
+	for _, part := range strings.Split(s, ",") {
+		switch scope := Scope(strings.TrimSpace(part)); scope {
+		case Write, Read, RulesAdmin, OpsAdmin:
+			scopes = append(scopes, scope)
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	return scopes, nil
+}
+
+// HasScope returns true if the request is authorized for the scope.
+// Requests without a scopes header are authorized for every scope, so
+// gateways which don't distinguish scopes keep working, unless
+// -auth.require-scopes is set.
+func (cfg ScopesConfig) HasScope(r *http.Request, scope Scope) (bool, error) {
+	header, ok := r.Header[ScopesHeaderName]
+	if !ok {
+		return !cfg.RequireScopes, nil
+	}
+	for _, h := range header {
+		scopes, err := ParseScopes(h)
+		if err != nil {
+			return false, err
+		}
+		for _, s := range scopes {
+			if s == scope {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Require returns middleware which rejects requests that aren't authorized
+// for the scope.
+func (cfg ScopesConfig) Require(scope Scope) middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, err := cfg.HasScope(r, scope)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !ok {
+				http.Error(w, fmt.Sprintf("credential is not authorized for the %s scope", scope), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+// RequireByMethod returns middleware which requires the read scope for GET
+// and HEAD requests, and the write scope for everything else.
+func (cfg ScopesConfig) RequireByMethod(read, write Scope) middleware.Interface {
+	readMiddleware, writeMiddleware := cfg.Require(read), cfg.Require(write)
+	return middleware.Func(func(next http.Handler) http.Handler {
+		readHandler, writeHandler := readMiddleware.Wrap(next), writeMiddleware.Wrap(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" || r.Method == "HEAD" {
+				readHandler.ServeHTTP(w, r)
+				return
+			}
+			writeHandler.ServeHTTP(w, r)
+		})
+	})
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes("read, write,,rules-admin")
+	require.NoError(t, err)
+	assert.Equal(t, []Scope{Read, Write, RulesAdmin}, scopes)
+
+	_, err = ParseScopes("read,superuser")
+	assert.Error(t, err)
+}
+
+func TestRequire(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tc := range []struct {
+		method string
+		header []string
+		code   int
+	}{
+		// No header: gateways which don't set scopes are allowed everything.
+		{"GET", nil, http.StatusOK},
+		{"POST", nil, http.StatusOK},
+		{"GET", []string{"read"}, http.StatusOK},
+		{"POST", []string{"read"}, http.StatusForbidden},
+		{"POST", []string{"read,rules-admin"}, http.StatusOK},
+		{"POST", []string{"read", "rules-admin"}, http.StatusOK},
+		{"GET", []string{"write"}, http.StatusForbidden},
+		{"GET", []string{""}, http.StatusForbidden},
+		{"GET", []string{"read,bogus"}, http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(tc.method, "/", nil)
+		if tc.header != nil {
+			req.Header[ScopesHeaderName] = tc.header
+		}
+		rec := httptest.NewRecorder()
+		ScopesConfig{}.RequireByMethod(Read, RulesAdmin).Wrap(ok).ServeHTTP(rec, req)
+		assert.Equal(t, tc.code, rec.Code, "%s %v", tc.method, tc.header)
+	}
+}
+
+func TestRequireScopes(t *testing.T) {
+	cfg := ScopesConfig{RequireScopes: true}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tc := range []struct {
+		scopes []Scope
+		code   int
+	}{
+		// No header: nothing is allowed.
+		{nil, http.StatusForbidden},
+		{[]Scope{Read}, http.StatusForbidden},
+		{[]Scope{Read, OpsAdmin}, http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.scopes != nil {
+			InjectScopes(req, tc.scopes...)
+		}
+		rec := httptest.NewRecorder()
+		cfg.Require(OpsAdmin).Wrap(ok).ServeHTTP(rec, req)
+		assert.Equal(t, tc.code, rec.Code, "%v", tc.scopes)
+	}
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+)
+
+// DefaultOrgIDHeaderName is the header carrying the tenant of a request, set
+// by the authenticating gateway in front of Cortex, and by Cortex's own
+// components when they call each other.
+const DefaultOrgIDHeaderName = "X-Scope-OrgID"
+
+// Config configures how the tenant of a request is found, and which tenants
+// are allowed.
+type Config struct {
+	OrgIDHeaderName string
+	JWT             JWTConfig
+	TenantID        TenantIDConfig
+	ScopesConfig
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet.
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.OrgIDHeaderName, "auth.org-id-header", DefaultOrgIDHeaderName, "Header carrying the tenant of requests, set by a trusted gateway. Cortex's own components send "+DefaultOrgIDHeaderName+" to each other, so those they call should keep the default.")
+	cfg.JWT.RegisterFlags(f)
+	cfg.TenantID.RegisterFlags(f)
+	cfg.ScopesConfig.RegisterFlags(f)
+}
+
+// Authenticate returns middleware which injects the tenant of each request
+// into its context, rejecting requests without one, or with one that isn't
+// allowed.  The tenant is taken from the org ID header, or, if a JWT key is
+// configured, from a claim of the request's bearer token, which must be
+// valid.
+func (cfg Config) Authenticate() (middleware.Interface, error) {
+	var authenticate middleware.Interface
+	switch {
+	case cfg.JWT.KeyFile != "":
+		verifier, err := newJWTVerifier(cfg.JWT)
+		if err != nil {
+			return nil, err
+		}
+		authenticate = authenticateJWT(verifier)
+	case cfg.OrgIDHeaderName == "" || http.CanonicalHeaderKey(cfg.OrgIDHeaderName) == DefaultOrgIDHeaderName:
+		authenticate = middleware.AuthenticateUser
+	default:
+		authenticate = authenticateHeader(cfg.OrgIDHeaderName)
+	}
+	return middleware.Merge(authenticate, validateTenantID(newTenantIDValidator(cfg.TenantID))), nil
+}
+
+// authenticateHeader is like middleware.AuthenticateUser, for a different
+// org ID header.  The default org ID header is replaced, so it can't be
+// forged, and so it's passed on by components which forward requests.
+func authenticateHeader(name string) middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID := r.Header.Get(name)
+			if userID == "" {
+				http.Error(w, user.ErrNoUserID.Error(), http.StatusUnauthorized)
+				return
+			}
+			r.Header.Set(DefaultOrgIDHeaderName, userID)
+			next.ServeHTTP(w, r.WithContext(user.Inject(r.Context(), userID)))
+		})
+	})
+}
+
+// authenticateJWT takes the tenant, and scopes, of requests from their bearer
+// tokens.  Any org ID and scopes headers are replaced, so they can't be
+// forged, and so they're passed on by components which forward requests.
+func authenticateJWT(verifier *jwtVerifier) middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if !strings.HasPrefix(header, "Bearer ") {
+				http.Error(w, "no bearer token", http.StatusUnauthorized)
+				return
+			}
+			userID, scopes, err := verifier.verify(strings.TrimPrefix(header, "Bearer "))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid bearer token: %v", err), http.StatusUnauthorized)
+				return
+			}
+
+			r.Header.Set(DefaultOrgIDHeaderName, userID)
+			r.Header.Del(ScopesHeaderName)
+			if scopes != nil {
+				InjectScopes(r, scopes...)
+			}
+			next.ServeHTTP(w, r.WithContext(user.Inject(r.Context(), userID)))
+		})
+	})
+}
@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+)
+
+// authenticated serves the tenant, and scopes header, of requests.
+var authenticated = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(userID + " " + r.Header.Get(DefaultOrgIDHeaderName) + " " + r.Header.Get(ScopesHeaderName)))
+})
+
+func writeKeyFile(t *testing.T, data []byte) string {
+	f, err := ioutil.TempFile("", "jwt-key")
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	return f.Name()
+}
+
+func signToken(t *testing.T, alg string, claims map[string]interface{}, sign func([]byte) []byte) string {
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": alg, "typ": "JWT"}) + "." + encode(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func TestAuthenticateHeader(t *testing.T) {
+	middleware, err := Config{OrgIDHeaderName: "X-Tenant"}.Authenticate()
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Tenant", "1")
+	req.Header.Set(DefaultOrgIDHeaderName, "2")
+	rec := httptest.NewRecorder()
+	middleware.Wrap(authenticated).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "1 1 ", rec.Body.String())
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(DefaultOrgIDHeaderName, "1")
+	rec = httptest.NewRecorder()
+	middleware.Wrap(authenticated).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestAuthenticateJWT(t *testing.T) {
+	secret := []byte("secret")
+	hmacKey := writeKeyFile(t, append(secret, '\n'))
+	defer os.Remove(hmacKey)
+	signHS256 := func(data []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(data)
+		return mac.Sum(nil)
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	require.NoError(t, err)
+	rsaKey := writeKeyFile(t, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	defer os.Remove(rsaKey)
+	signRS256 := func(data []byte) []byte {
+		hash := sha256.Sum256(data)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hash[:])
+		require.NoError(t, err)
+		return signature
+	}
+
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"tenant": "1", "scope": "read write", "iss": "issuer", "aud": []string{"other", "cortex"}, "exp": now + 60}
+	with := func(key string, value interface{}) map[string]interface{} {
+		claims := map[string]interface{}{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+	for _, tc := range []struct {
+		name   string
+		cfg    JWTConfig
+		header string
+		code   int
+		body   string
+	}{
+		{"hs256", JWTConfig{Algorithm: HS256, KeyFile: hmacKey}, "Bearer " + signToken(t, HS256, valid, signHS256), http.StatusOK, "1 1 read,write"},
+		{"rs256", JWTConfig{Algorithm: RS256, KeyFile: rsaKey}, "Bearer " + signToken(t, RS256, valid, signRS256), http.StatusOK, "1 1 read,write"},
+		{"scopes list", JWTConfig{Algorithm: HS256, KeyFile: hmacKey}, "Bearer " + signToken(t, HS256, with("scope", []string{"read"}), signHS256), http.StatusOK, "1 1 read"},
+		{"no scopes", JWTConfig{Algorithm: HS256, KeyFile: hmacKey}, "Bearer " + signToken(t, HS256, with("scope", nil), signHS256), http.StatusOK, "1 1 "},
+		{"scopes unconfigured", JWTConfig{Algorithm: HS256, KeyFile: hmacKey, ScopesClaim: "-"}, "Bearer " + signToken(t, HS256, valid, signHS256), http.StatusOK, "1 1 "},
+		{"no token", JWTConfig{Algorithm: HS256, KeyFile: hmacKey}, "", http.StatusUnauthorized, ""},
+		{"wrong key", JWTConfig{Algorithm: HS256, KeyFile: hmacKey}, "Bearer " + signToken(t, HS256, with("tenant", "2"), func([]byte) []byte { return []byte("forged") }), http.StatusUnauthorized, ""},
+		{"wrong algorithm", JWTConfig{Algorithm: RS256, KeyFile: rsaKey}, "Bearer " + signToken(t, HS256, valid, signHS256), http.StatusUnauthorized, ""},
+		{"none", JWTConfig{Algorithm: HS256, KeyFile: hmacKey}, "Bearer " + signToken(t, "none", valid, func([]byte) []byte { return nil }), http.StatusUnauthorized, ""},
+		{"expired", JWTConfig{Algorithm: HS256, KeyFile: hmacKey}, "Bearer " + signToken(t, HS256, with("exp", now-1), signHS256), http.StatusUnauthorized, ""},
+		{"not yet valid", JWTConfig{Algorithm: HS256, KeyFile: hmacKey}, "Bearer " + signToken(t, HS256, with("nbf", now+60), signHS256), http.StatusUnauthorized, ""},
+		{"wrong issuer", JWTConfig{Algorithm: HS256, KeyFile: hmacKey}, "Bearer " + signToken(t, HS256, with("iss", "other"), signHS256), http.StatusUnauthorized, ""},
+		{"wrong audience", JWTConfig{Algorithm: HS256, KeyFile: hmacKey}, "Bearer " + signToken(t, HS256, with("aud", "other"), signHS256), http.StatusUnauthorized, ""},
+		{"no tenant", JWTConfig{Algorithm: HS256, KeyFile: hmacKey}, "Bearer " + signToken(t, HS256, with("tenant", nil), signHS256), http.StatusUnauthorized, ""},
+		{"bad scope", JWTConfig{Algorithm: HS256, KeyFile: hmacKey}, "Bearer " + signToken(t, HS256, with("scope", "superuser"), signHS256), http.StatusUnauthorized, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			cfg.TenantClaim, cfg.Issuer, cfg.Audience = "tenant", "issuer", "cortex"
+			switch cfg.ScopesClaim {
+			case "":
+				cfg.ScopesClaim = "scope"
+			case "-":
+				cfg.ScopesClaim = ""
+			}
+			middleware, err := Config{OrgIDHeaderName: DefaultOrgIDHeaderName, JWT: cfg}.Authenticate()
+			require.NoError(t, err)
+
+			// Headers from the client are never trusted.
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(DefaultOrgIDHeaderName, "2")
+			req.Header.Set(ScopesHeaderName, "ops-admin")
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			rec := httptest.NewRecorder()
+			middleware.Wrap(authenticated).ServeHTTP(rec, req)
+			assert.Equal(t, tc.code, rec.Code, rec.Body.String())
+			if tc.code == http.StatusOK {
+				assert.Equal(t, tc.body, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestNewJWTVerifierErrors(t *testing.T) {
+	hmacKey := writeKeyFile(t, []byte("secret"))
+	defer os.Remove(hmacKey)
+	for _, cfg := range []JWTConfig{
+		{Algorithm: "none", KeyFile: hmacKey, TenantClaim: "tenant"},
+		{Algorithm: RS256, KeyFile: hmacKey, TenantClaim: "tenant"},
+		{Algorithm: HS256, KeyFile: hmacKey},
+		{Algorithm: HS256, KeyFile: hmacKey + ".missing", TenantClaim: "tenant"},
+	} {
+		_, err := newJWTVerifier(cfg)
+		assert.Error(t, err, "%+v", cfg)
+	}
+}
+
+func TestAuthenticateTenantID(t *testing.T) {
+	middleware, err := Config{
+		OrgIDHeaderName: DefaultOrgIDHeaderName,
+		TenantID:        TenantIDConfig{MaxLength: 10, AllowedCharacters: "-_.", Reserved: "., .., admin"},
+	}.Authenticate()
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		userID string
+		code   int
+	}{
+		{"team-1_a.b", http.StatusOK},
+		{"Team1", http.StatusOK},
+		{"team/1", http.StatusBadRequest},
+		{"team:1", http.StatusBadRequest},
+		{"ten-ünï", http.StatusBadRequest},
+		{"tenant-name", http.StatusBadRequest},
+		{"..", http.StatusBadRequest},
+		{"admin", http.StatusBadRequest},
+		{"", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(DefaultOrgIDHeaderName, tc.userID)
+		rec := httptest.NewRecorder()
+		middleware.Wrap(authenticated).ServeHTTP(rec, req)
+		assert.Equal(t, tc.code, rec.Code, "%q: %s", tc.userID, rec.Body.String())
+	}
+}
@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// The JWT signing algorithms supported.
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+)
+
+// JWTConfig configures taking the tenant of requests from a claim of their
+// bearer tokens.
+type JWTConfig struct {
+	KeyFile     string
+	Algorithm   string
+	TenantClaim string
+	ScopesClaim string
+	Issuer      string
+	Audience    string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet.
+func (cfg *JWTConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.KeyFile, "auth.jwt.key-file", "", "File with the key verifying JWT bearer tokens: the shared secret for HS256, or a PEM public key or certificate for RS256. If set, the tenant of requests is taken from their token instead of the org ID header.")
+	f.StringVar(&cfg.Algorithm, "auth.jwt.algorithm", RS256, "Algorithm JWT bearer tokens must be signed with: HS256 or RS256.")
+	f.StringVar(&cfg.TenantClaim, "auth.jwt.tenant-claim", "tenant", "Claim of JWT bearer tokens holding the tenant.")
+	f.StringVar(&cfg.ScopesClaim, "auth.jwt.scopes-claim", "", "Claim of JWT bearer tokens holding the scopes they're authorized for, as a list or a space or comma separated string. If unset, tokens are authorized for every scope.")
+	f.StringVar(&cfg.Issuer, "auth.jwt.issuer", "", "If set, the issuer JWT bearer tokens must have.")
+	f.StringVar(&cfg.Audience, "auth.jwt.audience", "", "If set, an audience JWT bearer tokens must have.")
+}
+
+// jwtVerifier verifies JWTs signed with a single key, and extracts their
+// tenant and scopes.
+type jwtVerifier struct {
+	cfg       JWTConfig
+	hmacKey   []byte
+	publicKey *rsa.PublicKey
+	now       func() time.Time
+}
+
+func newJWTVerifier(cfg JWTConfig) (*jwtVerifier, error) {
+	if cfg.TenantClaim == "" {
+		return nil, fmt.Errorf("no JWT tenant claim configured")
+	}
+	key, err := ioutil.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	v := &jwtVerifier{cfg: cfg, now: time.Now}
+	switch cfg.Algorithm {
+	case HS256:
+		v.hmacKey = []byte(strings.TrimSpace(string(key)))
+		if len(v.hmacKey) == 0 {
+			return nil, fmt.Errorf("empty JWT key in %s", cfg.KeyFile)
+		}
+	case RS256:
+		if v.publicKey, err = parseRSAPublicKey(key); err != nil {
+			return nil, fmt.Errorf("error parsing JWT key in %s: %v", cfg.KeyFile, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q, choose one of: %s, %s", cfg.Algorithm, HS256, RS256)
+	}
+	return v, nil
+}
+
+// parseRSAPublicKey parses a PEM encoded PKIX public key or certificate.
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data")
+	}
+	var key interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		var err error
+		if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA public key")
+	}
+	return publicKey, nil
+}
+
+// verify checks the token's signature and claims, and returns its tenant,
+// and its scopes if a scopes claim is configured.
+func (v *jwtVerifier) verify(token string) (string, []Scope, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", nil, fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", nil, err
+	}
+	// The algorithm is fixed by config, never chosen by the token.
+	if header.Algorithm != v.cfg.Algorithm {
+		return "", nil, fmt.Errorf("token signed with %q, not %s", header.Algorithm, v.cfg.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, fmt.Errorf("malformed signature: %v", err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch v.cfg.Algorithm {
+	case HS256:
+		mac := hmac.New(sha256.New, v.hmacKey)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return "", nil, fmt.Errorf("invalid signature")
+		}
+	case RS256:
+		hash := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(v.publicKey, crypto.SHA256, hash[:], signature); err != nil {
+			return "", nil, fmt.Errorf("invalid signature")
+		}
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", nil, err
+	}
+	now := float64(v.now().Unix())
+	if exp, ok := claims["exp"].(float64); ok && now >= exp {
+		return "", nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return "", nil, fmt.Errorf("token not valid yet")
+	}
+	if v.cfg.Issuer != "" && claims["iss"] != v.cfg.Issuer {
+		return "", nil, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if v.cfg.Audience != "" && !containsString(claims["aud"], v.cfg.Audience) {
+		return "", nil, fmt.Errorf("token is not for audience %s", v.cfg.Audience)
+	}
+
+	tenant, ok := claims[v.cfg.TenantClaim].(string)
+	if !ok || tenant == "" {
+		return "", nil, fmt.Errorf("no %s claim", v.cfg.TenantClaim)
+	}
+	if v.cfg.ScopesClaim == "" {
+		return tenant, nil, nil
+	}
+	scopes := []Scope{}
+	switch claim := claims[v.cfg.ScopesClaim].(type) {
+	case string:
+		parsed, err := ParseScopes(strings.Replace(claim, " ", ",", -1))
+		if err != nil {
+			return "", nil, err
+		}
+		scopes = append(scopes, parsed...)
+	case []interface{}:
+		for _, s := range claim {
+			name, _ := s.(string)
+			parsed, err := ParseScopes(name)
+			if err != nil {
+				return "", nil, err
+			}
+			scopes = append(scopes, parsed...)
+		}
+	}
+	return tenant, scopes, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("malformed token: %v", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("malformed token: %v", err)
+	}
+	return nil
+}
+
+// containsString returns whether a claim is s, or a list including s.
+func containsString(claim interface{}, s string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == s
+	case []interface{}:
+		for _, c := range claim {
+			if c == s {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+)
+
+// TenantIDConfig constrains the tenant IDs requests may have, as tenant IDs
+// become part of object keys and index rows.
+type TenantIDConfig struct {
+	MaxLength         int
+	AllowedCharacters string
+	Reserved          string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet.
+func (cfg *TenantIDConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.MaxLength, "auth.tenant-id.max-length", 150, "Maximum length of tenant IDs. 0 for no limit.")
+	f.StringVar(&cfg.AllowedCharacters, "auth.tenant-id.allowed-characters", "!-_.*'()", "Characters tenant IDs may contain besides ASCII letters and digits.")
+	f.StringVar(&cfg.Reserved, "auth.tenant-id.reserved", ".,..", "Comma-separated tenant IDs which are never allowed.")
+}
+
+// tenantIDValidator checks tenant IDs against a TenantIDConfig.
+type tenantIDValidator struct {
+	maxLength int
+	allowed   map[rune]bool
+	reserved  map[string]bool
+}
+
+func newTenantIDValidator(cfg TenantIDConfig) *tenantIDValidator {
+	v := &tenantIDValidator{
+		maxLength: cfg.MaxLength,
+		allowed:   map[rune]bool{},
+		reserved:  map[string]bool{},
+	}
+	for _, c := range cfg.AllowedCharacters {
+		v.allowed[c] = true
+	}
+	for _, name := range strings.Split(cfg.Reserved, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			v.reserved[name] = true
+		}
+	}
+	return v
+}
+
+// validate returns an error if the tenant ID isn't allowed.
+func (v *tenantIDValidator) validate(userID string) error {
+	if v.maxLength > 0 && len(userID) > v.maxLength {
+		return fmt.Errorf("tenant ID longer than %d characters", v.maxLength)
+	}
+	if v.reserved[userID] {
+		return fmt.Errorf("tenant ID %q is reserved", userID)
+	}
+	for _, c := range userID {
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || v.allowed[c] {
+			continue
+		}
+		return fmt.Errorf("tenant ID %q contains disallowed character %q", userID, c)
+	}
+	return nil
+}
+
+// validateTenantID rejects requests whose tenant isn't allowed, before they
+// reach the handler.  Requests without a tenant are left to the handler.
+func validateTenantID(v *tenantIDValidator) middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if userID, err := user.Extract(r.Context()); err == nil {
+				if err := v.validate(userID); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+}
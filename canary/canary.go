@@ -0,0 +1,333 @@
+package canary
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/remotewrite"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// The metric name of the synthetic series.
+const metricName = "cortex_canary_sample"
+
+var (
+	writesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "canary_writes_total",
+		Help:      "The total number of synthetic sample writes, by result.",
+	}, []string{"result"})
+	writeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "canary_write_duration_seconds",
+		Help:      "Time taken to write the synthetic samples.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	queriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "canary_queries_total",
+		Help:      "The total number of queries for the synthetic series over each range, by result.",
+	}, []string{"range", "result"})
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "canary_query_duration_seconds",
+		Help:      "Time taken to query the synthetic series over each range.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"range"})
+	samplesChecked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "canary_samples_checked_total",
+		Help:      "The total number of written synthetic samples checked by queries over each range, by result (correct or missing).",
+	}, []string{"range", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(writesTotal)
+	prometheus.MustRegister(writeDuration)
+	prometheus.MustRegister(queriesTotal)
+	prometheus.MustRegister(queryDuration)
+	prometheus.MustRegister(samplesChecked)
+}
+
+// Config configures the canary, which continuously writes synthetic series
+// to a reserved tenant and queries them back, to check data written to the
+// cluster can be read back.
+type Config struct {
+	Write       remotewrite.Config
+	QueryURL    util.URLValue
+	UserID      string
+	Interval    time.Duration
+	Series      int
+	QueryRanges string
+	QueryDelay  time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	cfg.Write.RegisterFlagsWithPrefix("canary.write.", f)
+	f.Var(&cfg.QueryURL, "canary.query-url", "Prefix of the Prometheus API to query the synthetic series from, e.g. http://querier/api/prom.")
+	f.StringVar(&cfg.UserID, "canary.user-id", "cortex-canary", "Tenant to write the synthetic series to. It should be reserved for the canary.")
+	f.DurationVar(&cfg.Interval, "canary.interval", 15*time.Second, "How often to write a sample to each synthetic series, and to query them.")
+	f.IntVar(&cfg.Series, "canary.series", 10, "Number of synthetic series to write.")
+	f.StringVar(&cfg.QueryRanges, "canary.query-ranges", "5m,1h,24h", "Comma separated ranges to query the synthetic series over, e.g. to cover the ingesters and the chunk store.")
+	f.DurationVar(&cfg.QueryDelay, "canary.query-delay", 30*time.Second, "Samples written more recently than this aren't expected in query results yet.")
+}
+
+// Canary writes and checks the synthetic series.  The value of each sample
+// is its timestamp in seconds, so a query result can be checked without
+// knowing what was written, and a gap isn't hidden by the query lookback
+// returning an earlier sample.
+type Canary struct {
+	cfg    Config
+	ranges []time.Duration
+	writer *remotewrite.Client
+	client *http.Client
+	quit   chan struct{}
+	done   chan struct{}
+
+	mtx     sync.Mutex
+	written []model.Time // successfully written timestamps, oldest first
+}
+
+// New makes a new Canary, and starts it.
+func New(cfg Config) (*Canary, error) {
+	if cfg.QueryURL.URL == nil {
+		return nil, fmt.Errorf("no canary query URL configured")
+	}
+	if cfg.Interval <= 0 || cfg.Series <= 0 {
+		return nil, fmt.Errorf("the canary interval and number of series must be positive")
+	}
+	ranges, err := parseRanges(cfg.QueryRanges)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := remotewrite.NewClient(cfg.Write)
+	if err != nil {
+		return nil, err
+	}
+	c := &Canary{
+		cfg:    cfg,
+		ranges: ranges,
+		writer: writer,
+		client: &http.Client{},
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go c.loop()
+	return c, nil
+}
+
+func parseRanges(s string) ([]time.Duration, error) {
+	var ranges []time.Duration
+	for _, r := range strings.Split(s, ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		d, err := model.ParseDuration(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid canary query range %q: %v", r, err)
+		}
+		ranges = append(ranges, time.Duration(d))
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no canary query ranges configured")
+	}
+	return ranges, nil
+}
+
+// Stop the canary.
+func (c *Canary) Stop() {
+	close(c.quit)
+	<-c.done
+}
+
+func (c *Canary) loop() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			ctx := user.Inject(context.Background(), c.cfg.UserID)
+			c.write(ctx, now)
+			for _, r := range c.ranges {
+				c.check(ctx, now, r)
+			}
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// align rounds a time down to the write interval.
+func (c *Canary) align(t time.Time) model.Time {
+	interval := int64(c.cfg.Interval / time.Millisecond)
+	return model.Time(int64(model.TimeFromUnixNano(t.UnixNano())) / interval * interval)
+}
+
+func (c *Canary) write(ctx context.Context, now time.Time) {
+	ts := c.align(now)
+	samples := make([]model.Sample, 0, c.cfg.Series)
+	for i := 0; i < c.cfg.Series; i++ {
+		samples = append(samples, model.Sample{
+			Metric: model.Metric{
+				model.MetricNameLabel: metricName,
+				"series":              model.LabelValue(strconv.Itoa(i)),
+			},
+			Value:     model.SampleValue(ts.Unix()),
+			Timestamp: ts,
+		})
+	}
+
+	start := time.Now()
+	err := c.writer.Store(ctx, util.ToWriteRequest(samples))
+	writeDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		log.Warnf("Error writing canary samples: %v", err)
+		writesTotal.WithLabelValues("error").Inc()
+		return
+	}
+	writesTotal.WithLabelValues("success").Inc()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.written = append(c.written, ts)
+	// Forget writes older than the longest range.
+	var longest time.Duration
+	for _, r := range c.ranges {
+		if r > longest {
+			longest = r
+		}
+	}
+	oldest := ts.Add(-longest)
+	i := 0
+	for i < len(c.written) && c.written[i].Before(oldest) {
+		i++
+	}
+	c.written = c.written[i:]
+}
+
+// expected returns the timestamps written in the range.
+func (c *Canary) expected(from, through model.Time) []model.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var result []model.Time
+	for _, ts := range c.written {
+		if !ts.Before(from) && !ts.After(through) {
+			result = append(result, ts)
+		}
+	}
+	return result
+}
+
+// check queries the series over the range ending at now, and counts how many
+// of the samples written in it were returned.
+func (c *Canary) check(ctx context.Context, now time.Time, r time.Duration) {
+	through := c.align(now.Add(-c.cfg.QueryDelay))
+	from := through.Add(-r)
+	expected := c.expected(from, through)
+	if len(expected) == 0 {
+		return
+	}
+	// Only query from the first sample we know to have been written.
+	from = expected[0]
+	rangeLabel := model.Duration(r).String()
+
+	// Don't let a slow query hold up the next round.
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Interval)
+	defer cancel()
+	start := time.Now()
+	matrix, err := c.queryRange(ctx, from, through)
+	queryDuration.WithLabelValues(rangeLabel).Observe(time.Since(start).Seconds())
+	if err != nil {
+		log.Warnf("Error querying canary samples over %s: %v", rangeLabel, err)
+		queriesTotal.WithLabelValues(rangeLabel, "error").Inc()
+		return
+	}
+	queriesTotal.WithLabelValues(rangeLabel, "success").Inc()
+
+	correct, missing := checkSamples(matrix, expected, c.cfg.Series)
+	samplesChecked.WithLabelValues(rangeLabel, "correct").Add(float64(correct))
+	samplesChecked.WithLabelValues(rangeLabel, "missing").Add(float64(missing))
+	if missing > 0 {
+		log.Warnf("%d of %d canary samples missing from query over %s", missing, correct+missing, rangeLabel)
+	}
+}
+
+// checkSamples counts the expected samples of each series in the query
+// result, which must have the value of their timestamp.
+func checkSamples(matrix model.Matrix, expected []model.Time, series int) (correct, missing int) {
+	found := map[string]map[model.Time]bool{}
+	for _, stream := range matrix {
+		values := map[model.Time]bool{}
+		for _, pair := range stream.Values {
+			if pair.Value == model.SampleValue(pair.Timestamp.Unix()) {
+				values[pair.Timestamp] = true
+			}
+		}
+		found[string(stream.Metric["series"])] = values
+	}
+	for i := 0; i < series; i++ {
+		values := found[strconv.Itoa(i)]
+		for _, ts := range expected {
+			if values[ts] {
+				correct++
+			} else {
+				missing++
+			}
+		}
+	}
+	return correct, missing
+}
+
+type queryRangeResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string       `json:"resultType"`
+		Result     model.Matrix `json:"result"`
+	} `json:"data"`
+}
+
+func (c *Canary) queryRange(ctx context.Context, from, through model.Time) (model.Matrix, error) {
+	params := url.Values{}
+	params.Set("query", metricName)
+	params.Set("start", from.String())
+	params.Set("end", through.String())
+	params.Set("step", strconv.FormatFloat(c.cfg.Interval.Seconds(), 'f', -1, 64))
+	req, err := http.NewRequest("GET", strings.TrimRight(c.cfg.QueryURL.String(), "/")+"/api/v1/query_range?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := user.InjectIntoHTTPRequest(ctx, req); err != nil {
+		return nil, err
+	}
+
+	resp, err := ctxhttp.Do(ctx, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result queryRangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding response with status %s: %v", resp.Status, err)
+	}
+	if result.Status != "success" {
+		return nil, fmt.Errorf("query failed with status %s: %s", resp.Status, result.Error)
+	}
+	return result.Data.Result, nil
+}
@@ -0,0 +1,138 @@
+package canary
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+// fakeCortex accepts pushes, and serves the pushed samples back to range
+// queries, except for those of the dropped series.
+type fakeCortex struct {
+	mtx     sync.Mutex
+	samples []model.Sample
+	users   map[string]bool
+	drop    model.LabelValue
+}
+
+func (f *fakeCortex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.users[r.Header.Get("X-Scope-OrgID")] = true
+
+	switch r.URL.Path {
+	case "/push":
+		buf, err := ioutil.ReadAll(snappy.NewReader(r.Body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req cortex.WriteRequest
+		if err := proto.Unmarshal(buf, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.samples = append(f.samples, util.FromWriteRequest(&req)...)
+	case "/api/prom/api/v1/query_range":
+		streams := map[model.Fingerprint]*model.SampleStream{}
+		for _, s := range f.samples {
+			if s.Metric["series"] == f.drop {
+				continue
+			}
+			stream, ok := streams[s.Metric.Fingerprint()]
+			if !ok {
+				stream = &model.SampleStream{Metric: s.Metric}
+				streams[s.Metric.Fingerprint()] = stream
+			}
+			stream.Values = append(stream.Values, model.SamplePair{Timestamp: s.Timestamp, Value: s.Value})
+		}
+		var resp queryRangeResponse
+		resp.Status = "success"
+		resp.Data.ResultType = "matrix"
+		for _, stream := range streams {
+			resp.Data.Result = append(resp.Data.Result, stream)
+		}
+		json.NewEncoder(w).Encode(resp)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestCanary(t *testing.T) {
+	fake := &fakeCortex{users: map[string]bool{}, drop: "1"}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	var cfg Config
+	cfg.Write.URL.URL, _ = url.Parse(server.URL + "/push")
+	cfg.Write.Timeout = time.Second
+	cfg.QueryURL.URL, _ = url.Parse(server.URL + "/api/prom")
+	cfg.UserID = "canary"
+	cfg.Interval = time.Hour // The test drives the canary itself.
+	cfg.Series = 3
+	cfg.QueryRanges = "10m"
+	c, err := New(cfg)
+	require.NoError(t, err)
+	defer c.Stop()
+	c.cfg.Interval = 15 * time.Second
+
+	ctx := user.Inject(context.Background(), cfg.UserID)
+	now := time.Now()
+	for i := 4; i > 0; i-- {
+		c.write(ctx, now.Add(-time.Duration(i)*c.cfg.Interval))
+	}
+	require.Len(t, c.expected(0, model.Latest), 4)
+	assert.Equal(t, map[string]bool{"canary": true}, fake.users)
+
+	through := c.align(now)
+	matrix, err := c.queryRange(ctx, through.Add(-10*time.Minute), through)
+	require.NoError(t, err)
+	correct, missing := checkSamples(matrix, c.expected(0, model.Latest), cfg.Series)
+	assert.Equal(t, 8, correct)
+	assert.Equal(t, 4, missing)
+}
+
+func TestCheckSamples(t *testing.T) {
+	expected := []model.Time{model.TimeFromUnix(15), model.TimeFromUnix(30)}
+	matrix := model.Matrix{
+		{
+			Metric: model.Metric{"series": "0"},
+			Values: []model.SamplePair{{Timestamp: model.TimeFromUnix(15), Value: 15}, {Timestamp: model.TimeFromUnix(30), Value: 30}},
+		},
+		{
+			// The second sample is missing, and was filled in by the lookback.
+			Metric: model.Metric{"series": "1"},
+			Values: []model.SamplePair{{Timestamp: model.TimeFromUnix(15), Value: 15}, {Timestamp: model.TimeFromUnix(30), Value: 15}},
+		},
+	}
+	correct, missing := checkSamples(matrix, expected, 3)
+	assert.Equal(t, 3, correct)
+	assert.Equal(t, 3, missing)
+}
+
+func TestParseRanges(t *testing.T) {
+	ranges, err := parseRanges("5m, 1h,,24h")
+	require.NoError(t, err)
+	assert.Equal(t, []time.Duration{5 * time.Minute, time.Hour, 24 * time.Hour}, ranges)
+
+	_, err = parseRanges("")
+	assert.Error(t, err)
+	_, err = parseRanges("5x")
+	assert.Error(t, err)
+}
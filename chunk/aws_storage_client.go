@@ -7,22 +7,27 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"net/url"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 
 	"github.com/weaveworks/common/instrument"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 const (
@@ -36,6 +41,7 @@ const (
 	otherError       = "other"
 
 	provisionedThroughputExceededException = "ProvisionedThroughputExceededException"
+	noSuchKey                              = "NoSuchKey"
 
 	// Backoff for dynamoDB requests, to match AWS lib - see:
 	// https://github.com/aws/aws-sdk-go/blob/master/service/dynamodb/customizations.go
@@ -85,18 +91,37 @@ func init() {
 // DynamoDBConfig specifies config for a DynamoDB database.
 type DynamoDBConfig struct {
 	DynamoDB util.URLValue
+
+	// Overrides the endpoint deduced from the URL, e.g. for VPC or FIPS
+	// endpoints; the region is still taken from the URL.
+	Endpoint string
+
+	// Comma-separated regions tables are replicated to, as global tables.
+	ReplicaRegions string
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *DynamoDBConfig) RegisterFlags(f *flag.FlagSet) {
 	f.Var(&cfg.DynamoDB, "dynamodb.url", "DynamoDB endpoint URL with escaped Key and Secret encoded. "+
 		"If only region is specified as a host, proper endpoint will be deduced. Use inmemory:///<table-name> to use a mock in-memory implementation.")
+	f.StringVar(&cfg.Endpoint, "dynamodb.endpoint", "", "DynamoDB endpoint to use instead of the one deduced from the URL's region, e.g. a VPC endpoint or https://dynamodb-fips.us-gov-west-1.amazonaws.com.")
+	f.StringVar(&cfg.ReplicaRegions, "dynamodb.replica-regions", "", "Comma-separated regions to replicate tables to, as DynamoDB global tables. The table manager creates tables in each of them, and queries fail over to them, in order, if the URL's region fails.")
 }
 
 // AWSStorageConfig specifies config for storing data on AWS.
 type AWSStorageConfig struct {
 	DynamoDBConfig
 	S3 util.URLValue
+
+	// Overrides the endpoint deduced from the URL, e.g. for VPC or FIPS
+	// endpoints; the region is still taken from the URL.
+	S3Endpoint       string
+	S3ForcePathStyle bool
+
+	S3MultipartThreshold int
+	S3MultipartPartSize  int
+
+	S3Retries S3RetryConfig
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -104,17 +129,34 @@ func (cfg *AWSStorageConfig) RegisterFlags(f *flag.FlagSet) {
 	cfg.DynamoDBConfig.RegisterFlags(f)
 	f.Var(&cfg.S3, "s3.url", "S3 endpoint URL with escaped Key and Secret encoded. "+
 		"If only region is specified as a host, proper endpoint will be deduced. Use inmemory:///<bucket-name> to use a mock in-memory implementation.")
+	f.StringVar(&cfg.S3Endpoint, "s3.endpoint", "", "S3 endpoint to use instead of the one deduced from the URL's region, e.g. a VPC endpoint or https://s3-fips.us-gov-west-1.amazonaws.com.")
+	f.BoolVar(&cfg.S3ForcePathStyle, "s3.force-path-style", false, "Put the bucket name in the path rather than the host name of S3 requests, as needed by some VPC endpoints and S3 compatible stores.")
+	f.IntVar(&cfg.S3MultipartThreshold, "s3.multipart-threshold", 32<<20, "Upload objects larger than this many bytes, such as large blocks or batches of chunks, to S3 in parts. 0 to always upload objects in one request.")
+	f.IntVar(&cfg.S3MultipartPartSize, "s3.multipart-part-size", 16<<20, "Size in bytes of the parts of multipart uploads to S3; at least 5MiB.")
+	cfg.S3Retries.RegisterFlags(f)
 }
 
 type awsStorageClient struct {
 	DynamoDB   dynamodbiface.DynamoDBAPI
 	S3         s3iface.S3API
 	bucketName string
+
+	multipartThreshold int
+	multipartPartSize  int
+
+	// Queries are retried in each replica region in turn if they fail in
+	// the local one; writes are only sent to the local region, as global
+	// tables replicate them.
+	replicas []dynamoReplica
 }
 
 // NewAWSStorageClient makes a new AWS-backed StorageClient.
 func NewAWSStorageClient(cfg AWSStorageConfig) (StorageClient, error) {
-	dynamoDB, err := dynamoClientFromURL(cfg.DynamoDB.URL)
+	dynamoDB, err := dynamoClientFromURL(cfg.DynamoDB.URL, cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	replicas, err := newDynamoReplicas(cfg.DynamoDBConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -122,17 +164,26 @@ func NewAWSStorageClient(cfg AWSStorageConfig) (StorageClient, error) {
 	if cfg.S3.URL == nil {
 		return nil, fmt.Errorf("no URL specified for S3")
 	}
-	s3Config, err := awsConfigFromURL(cfg.S3.URL)
+	if err := cfg.validateMultipart(); err != nil {
+		return nil, err
+	}
+	if err := cfg.S3Retries.validate(); err != nil {
+		return nil, err
+	}
+	s3Client, err := newS3Client(cfg.S3.URL, cfg.S3Endpoint, cfg.S3ForcePathStyle, cfg.S3Retries)
 	if err != nil {
 		return nil, err
 	}
-	s3Client := s3.New(session.New(s3Config))
 	bucketName := strings.TrimPrefix(cfg.S3.URL.Path, "/")
 
 	storageClient := awsStorageClient{
 		DynamoDB:   dynamoDB,
 		S3:         s3Client,
 		bucketName: bucketName,
+		replicas:   replicas,
+
+		multipartThreshold: cfg.S3MultipartThreshold,
+		multipartPartSize:  cfg.S3MultipartPartSize,
 	}
 	return storageClient, nil
 }
@@ -143,23 +194,32 @@ func (a awsStorageClient) NewWriteBatch() WriteBatch {
 
 // batchWrite writes requests to the underlying storage, handling retires and backoff.
 func (a awsStorageClient) BatchWrite(ctx context.Context, input WriteBatch) error {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "awsStorageClient.BatchWrite")
+	defer sp.Finish()
+
 	outstanding := input.(dynamoDBWriteBatch)
 	unprocessed := map[string][]*dynamodb.WriteRequest{}
-	backoff, numRetries := minBackoff, 0
+	backoff, numRetries, attempt := minBackoff, 0, 0
 	for dictLen(outstanding)+dictLen(unprocessed) > 0 && numRetries < maxRetries {
 		reqs := map[string][]*dynamodb.WriteRequest{}
 		takeReqs(unprocessed, reqs, dynamoMaxBatchSize)
 		takeReqs(outstanding, reqs, dynamoMaxBatchSize)
 		var resp *dynamodb.BatchWriteItemOutput
 
-		err := instrument.TimeRequestHistogram(ctx, "DynamoDB.BatchWriteItem", dynamoRequestDuration, func(_ context.Context) error {
-			var err error
-			resp, err = a.DynamoDB.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+		err := instrument.TimeRequestHistogram(ctx, "DynamoDB.BatchWriteItem", dynamoRequestDuration, func(ctx context.Context) error {
+			if sp := opentracing.SpanFromContext(ctx); sp != nil {
+				sp.SetTag("tables", strings.Join(tableNames(reqs), ","))
+				sp.SetTag("items", dictLen(reqs))
+				sp.SetTag("retry", attempt)
+			}
+			req, out := a.DynamoDB.BatchWriteItemRequest(&dynamodb.BatchWriteItemInput{
 				RequestItems:           reqs,
 				ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
 			})
-			return err
+			resp = out
+			return send(ctx, req)
 		})
+		attempt++
 		for _, cc := range resp.ConsumedCapacity {
 			dynamoConsumedCapacity.WithLabelValues("DynamoDB.BatchWriteItem").
 				Add(float64(*cc.CapacityUnits))
@@ -198,13 +258,40 @@ func (a awsStorageClient) BatchWrite(ctx context.Context, input WriteBatch) erro
 		numRetries = 0
 	}
 
+	if attempt > 1 {
+		sp.SetTag("retries", attempt-1)
+	}
 	if valuesLeft := dictLen(outstanding) + dictLen(unprocessed); valuesLeft > 0 {
-		return fmt.Errorf("failed to write chunk after %d retries, %d values remaining", numRetries, valuesLeft)
+		err := fmt.Errorf("failed to write chunk after %d retries, %d values remaining", numRetries, valuesLeft)
+		sp.LogFields(otlog.Error(err))
+		return err
 	}
 	return nil
 }
 
 func (a awsStorageClient) QueryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error {
+	// Once any results have been passed to the callback, the query can't be
+	// retried elsewhere without repeating them.
+	called := false
+	err := a.queryPages(ctx, a.DynamoDB, entry, func(result ReadBatch, lastPage bool) bool {
+		called = true
+		return callback(result, lastPage)
+	})
+	for _, replica := range a.replicas {
+		if err == nil || called || ctx.Err() != nil {
+			break
+		}
+		log.Warnf("Error querying %s, retrying in %s: %v", entry.TableName, replica.region, err)
+		dynamoFailovers.WithLabelValues(replica.region).Inc()
+		err = a.queryPages(ctx, replica.DynamoDB, entry, func(result ReadBatch, lastPage bool) bool {
+			called = true
+			return callback(result, lastPage)
+		})
+	}
+	return err
+}
+
+func (a awsStorageClient) queryPages(ctx context.Context, dynamoDB dynamodbiface.DynamoDBAPI, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error {
 	input := &dynamodb.QueryInput{
 		TableName: aws.String(entry.TableName),
 		KeyConditions: map[string]*dynamodb.Condition{
@@ -234,11 +321,25 @@ func (a awsStorageClient) QueryPages(ctx context.Context, entry IndexEntry, call
 		}
 	}
 
-	request, _ := a.DynamoDB.QueryRequest(input)
-	backoff := minBackoff
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "awsStorageClient.QueryPages")
+	defer sp.Finish()
+	sp.SetTag("table", entry.TableName)
+
+	request, _ := dynamoDB.QueryRequest(input)
+	backoff, pageNum, retries := minBackoff, 0, 0
+	defer func() {
+		sp.SetTag("pages", pageNum)
+		sp.SetTag("retries", retries)
+	}()
 	for page := request; page != nil; page = page.NextPage() {
-		err := instrument.TimeRequestHistogram(ctx, "DynamoDB.QueryPages", dynamoRequestDuration, func(_ context.Context) error {
-			return page.Send()
+		pageNum++
+		err := instrument.TimeRequestHistogram(ctx, "DynamoDB.QueryPages", dynamoRequestDuration, func(ctx context.Context) error {
+			if sp := opentracing.SpanFromContext(ctx); sp != nil {
+				sp.SetTag("table", entry.TableName)
+				sp.SetTag("page", pageNum)
+				sp.SetTag("retries", retries)
+			}
+			return send(ctx, page)
 		})
 
 		if cc := page.Data.(*dynamodb.QueryOutput).ConsumedCapacity; cc != nil {
@@ -252,6 +353,7 @@ func (a awsStorageClient) QueryPages(ctx context.Context, entry IndexEntry, call
 			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == provisionedThroughputExceededException {
 				time.Sleep(backoff)
 				backoff = nextBackoff(backoff)
+				retries++
 				continue
 			}
 
@@ -270,16 +372,30 @@ func (a awsStorageClient) QueryPages(ctx context.Context, entry IndexEntry, call
 }
 
 func (a awsStorageClient) GetChunk(ctx context.Context, key string) ([]byte, error) {
+	return a.getObject(ctx, key, nil)
+}
+
+func (a awsStorageClient) GetChunkRange(ctx context.Context, key string, offset, length int) ([]byte, error) {
+	return a.getObject(ctx, key, aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)))
+}
+
+func (a awsStorageClient) getObject(ctx context.Context, key string, byteRange *string) ([]byte, error) {
 	var resp *s3.GetObjectOutput
-	err := instrument.TimeRequestHistogram(ctx, "S3.GetObject", s3RequestDuration, func(_ context.Context) error {
-		var err error
-		resp, err = a.S3.GetObject(&s3.GetObjectInput{
+	err := instrument.TimeRequestHistogram(ctx, "S3.GetObject", s3RequestDuration, func(ctx context.Context) error {
+		if sp := opentracing.SpanFromContext(ctx); sp != nil {
+			sp.SetTag("key", key)
+		}
+		req, out := a.S3.GetObjectRequest(&s3.GetObjectInput{
 			Bucket: aws.String(a.bucketName),
 			Key:    aws.String(key),
+			Range:  byteRange,
 		})
-		return err
+		resp = out
+		return send(ctx, req)
 	})
-	if err != nil {
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == noSuchKey {
+		return nil, ErrChunkNotFound
+	} else if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -291,14 +407,140 @@ func (a awsStorageClient) GetChunk(ctx context.Context, key string) ([]byte, err
 }
 
 func (a awsStorageClient) PutChunk(ctx context.Context, key string, buf []byte) error {
-	return instrument.TimeRequestHistogram(ctx, "S3.PutObject", s3RequestDuration, func(_ context.Context) error {
-		_, err := a.S3.PutObject(&s3.PutObjectInput{
+	if a.multipart(len(buf)) {
+		return a.putChunkMultipart(ctx, key, buf)
+	}
+	return instrument.TimeRequestHistogram(ctx, "S3.PutObject", s3RequestDuration, func(ctx context.Context) error {
+		if sp := opentracing.SpanFromContext(ctx); sp != nil {
+			sp.SetTag("key", key)
+			sp.SetTag("size", len(buf))
+		}
+		req, _ := a.S3.PutObjectRequest(&s3.PutObjectInput{
 			Body:   bytes.NewReader(buf),
 			Bucket: aws.String(a.bucketName),
 			Key:    aws.String(key),
 		})
-		return err
+		return send(ctx, req)
+	})
+}
+
+func (a awsStorageClient) ScanTable(ctx context.Context, tableName string, callback func(hashValue string, rangeValue []byte, value []byte) (shouldContinue bool)) error {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "awsStorageClient.ScanTable")
+	defer sp.Finish()
+	sp.SetTag("table", tableName)
+
+	request, _ := a.DynamoDB.ScanRequest(&dynamodb.ScanInput{
+		TableName:              aws.String(tableName),
+		ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	})
+	backoff, pageNum, retries := minBackoff, 0, 0
+	defer func() {
+		sp.SetTag("pages", pageNum)
+		sp.SetTag("retries", retries)
+	}()
+	for page := request; page != nil; page = page.NextPage() {
+		pageNum++
+		err := instrument.TimeRequestHistogram(ctx, "DynamoDB.ScanPages", dynamoRequestDuration, func(ctx context.Context) error {
+			return send(ctx, page)
+		})
+
+		if cc := page.Data.(*dynamodb.ScanOutput).ConsumedCapacity; cc != nil {
+			dynamoConsumedCapacity.WithLabelValues("DynamoDB.ScanPages").
+				Add(float64(*cc.CapacityUnits))
+		}
+
+		if err != nil {
+			recordDynamoError(tableName, err)
+
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == provisionedThroughputExceededException {
+				time.Sleep(backoff)
+				backoff = nextBackoff(backoff)
+				retries++
+				continue
+			}
+
+			return page.Error
+		}
+
+		batch := dynamoDBReadBatch(page.Data.(*dynamodb.ScanOutput).Items)
+		for i := range batch {
+			hashValue, ok := batch[i][hashKey]
+			if !ok || hashValue.S == nil {
+				continue
+			}
+			if !callback(*hashValue.S, batch.RangeValue(i), batch.Value(i)) {
+				return nil
+			}
+		}
+
+		backoff = minBackoff
+	}
+
+	return nil
+}
+
+func (a awsStorageClient) ListChunks(ctx context.Context, prefix string, callback func(key string, lastModified time.Time) (shouldContinue bool)) error {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "awsStorageClient.ListChunks")
+	defer sp.Finish()
+
+	request, _ := a.S3.ListObjectsV2Request(&s3.ListObjectsV2Input{
+		Bucket: aws.String(a.bucketName),
+		Prefix: aws.String(prefix),
 	})
+	pageNum := 0
+	defer func() {
+		sp.SetTag("pages", pageNum)
+	}()
+	for page := request; page != nil; page = page.NextPage() {
+		pageNum++
+		if err := instrument.TimeRequestHistogram(ctx, "S3.ListObjectsV2", s3RequestDuration, func(ctx context.Context) error {
+			return send(ctx, page)
+		}); err != nil {
+			return err
+		}
+
+		for _, object := range page.Data.(*s3.ListObjectsV2Output).Contents {
+			if object.Key == nil || object.LastModified == nil {
+				continue
+			}
+			if !callback(*object.Key, *object.LastModified) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (a awsStorageClient) DeleteChunk(ctx context.Context, key string) error {
+	return instrument.TimeRequestHistogram(ctx, "S3.DeleteObject", s3RequestDuration, func(ctx context.Context) error {
+		if sp := opentracing.SpanFromContext(ctx); sp != nil {
+			sp.SetTag("key", key)
+		}
+		req, _ := a.S3.DeleteObjectRequest(&s3.DeleteObjectInput{
+			Bucket: aws.String(a.bucketName),
+			Key:    aws.String(key),
+		})
+		return send(ctx, req)
+	})
+}
+
+// send sends an AWS request as part of ctx, so it's cancelled along with the
+// request that needs it, as are any retries.
+func send(ctx context.Context, req *request.Request) error {
+	req.HTTPRequest = req.HTTPRequest.WithContext(ctx)
+	// Retries copy the HTTP request without its context, so it's set again
+	// once they're signed.  Pages of results inherit the handler, so it's
+	// replaced rather than added to.
+	withContext := request.NamedHandler{
+		Name: "cortex.WithContext",
+		Fn: func(r *request.Request) {
+			r.HTTPRequest = r.HTTPRequest.WithContext(ctx)
+		},
+	}
+	req.Handlers.Sign.Remove(withContext)
+	req.Handlers.Sign.PushBackNamed(withContext)
+	req.Config.SleepDelay = sleepWithContext(ctx)
+	return req.Send()
 }
 
 type dynamoDBWriteBatch map[string][]*dynamodb.WriteRequest
@@ -320,6 +562,17 @@ func (b dynamoDBWriteBatch) Add(tableName, hashValue string, rangeValue []byte,
 	})
 }
 
+func (b dynamoDBWriteBatch) Delete(tableName, hashValue string, rangeValue []byte) {
+	b[tableName] = append(b[tableName], &dynamodb.WriteRequest{
+		DeleteRequest: &dynamodb.DeleteRequest{
+			Key: map[string]*dynamodb.AttributeValue{
+				hashKey:  {S: aws.String(hashValue)},
+				rangeKey: {B: rangeValue},
+			},
+		},
+	})
+}
+
 type dynamoDBReadBatch []map[string]*dynamodb.AttributeValue
 
 func (b dynamoDBReadBatch) Len() int {
@@ -340,16 +593,29 @@ func (b dynamoDBReadBatch) Value(i int) []byte {
 
 type dynamoTableClient struct {
 	DynamoDB dynamodbiface.DynamoDBAPI
+
+	// If there are replicas, tables are created in every region and linked
+	// into global tables.
+	region            string
+	replicas          []dynamoReplica
+	createGlobalTable func(dynamoDB dynamodbiface.DynamoDBAPI, name string, regions []string) error
 }
 
 // newDynamoTableClient makes a new DynamoTableClient.
 func newDynamoTableClient(cfg DynamoDBConfig) (DynamoTableClient, error) {
-	dynamoDB, err := dynamoClientFromURL(cfg.DynamoDB.URL)
+	dynamoDB, err := dynamoClientFromURL(cfg.DynamoDB.URL, cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	replicas, err := newDynamoReplicas(cfg)
 	if err != nil {
 		return nil, err
 	}
 	return dynamoTableClient{
-		DynamoDB: dynamoDB,
+		DynamoDB:          dynamoDB,
+		region:            cfg.DynamoDB.URL.Host,
+		replicas:          replicas,
+		createGlobalTable: createGlobalTable,
 	}, nil
 }
 
@@ -394,8 +660,40 @@ func (d dynamoTableClient) CreateTable(name string, readCapacity, writeCapacity
 			WriteCapacityUnits: aws.Int64(writeCapacity),
 		},
 	}
-	_, err := d.DynamoDB.CreateTable(input)
-	return err
+	if len(d.replicas) == 0 {
+		_, err := d.DynamoDB.CreateTable(input)
+		return err
+	}
+
+	// Global tables must have streams of new and old images.  The replicas
+	// are created first, so if any fail, the local table is still missing,
+	// and the table manager will try again.  If the tables are created but
+	// not linked, deleting the local table retries the whole thing.
+	input.StreamSpecification = &dynamodb.StreamSpecification{
+		StreamEnabled:  aws.Bool(true),
+		StreamViewType: aws.String(dynamodb.StreamViewTypeNewAndOldImages),
+	}
+	regions := []string{d.region}
+	for _, replica := range d.replicas {
+		if _, err := replica.DynamoDB.CreateTable(input); err != nil && !isAWSErrorCode(err, resourceInUseException) {
+			return fmt.Errorf("error creating %s in %s: %v", name, replica.region, err)
+		}
+		regions = append(regions, replica.region)
+	}
+	if _, err := d.DynamoDB.CreateTable(input); err != nil {
+		return err
+	}
+
+	// Tables can only be linked once they're all active.
+	if err := waitForTableActive(d.DynamoDB, name); err != nil {
+		return err
+	}
+	for _, replica := range d.replicas {
+		if err := waitForTableActive(replica.DynamoDB, name); err != nil {
+			return fmt.Errorf("error waiting for %s in %s: %v", name, replica.region, err)
+		}
+	}
+	return d.createGlobalTable(d.DynamoDB, name, regions)
 }
 
 func (d dynamoTableClient) DescribeTable(name string) (readCapacity, writeCapacity int64, status string, err error) {
@@ -409,14 +707,36 @@ func (d dynamoTableClient) DescribeTable(name string) (readCapacity, writeCapaci
 	return *out.Table.ProvisionedThroughput.ReadCapacityUnits, *out.Table.ProvisionedThroughput.WriteCapacityUnits, *out.Table.TableStatus, nil
 }
 
+// UpdateTable updates the table's capacity in every region, as global tables'
+// replicas need the same write capacity.
 func (d dynamoTableClient) UpdateTable(name string, readCapacity, writeCapacity int64) error {
-	_, err := d.DynamoDB.UpdateTable(&dynamodb.UpdateTableInput{
+	input := &dynamodb.UpdateTableInput{
 		TableName: aws.String(name),
 		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
 			ReadCapacityUnits:  aws.Int64(readCapacity),
 			WriteCapacityUnits: aws.Int64(writeCapacity),
 		},
-	})
+	}
+	for _, replica := range d.replicas {
+		if _, err := replica.DynamoDB.UpdateTable(input); err != nil {
+			return fmt.Errorf("error updating %s in %s: %v", name, replica.region, err)
+		}
+	}
+	_, err := d.DynamoDB.UpdateTable(input)
+	return err
+}
+
+// DeleteTable deletes the table in every region.
+func (d dynamoTableClient) DeleteTable(name string) error {
+	input := &dynamodb.DeleteTableInput{
+		TableName: aws.String(name),
+	}
+	for _, replica := range d.replicas {
+		if _, err := replica.DynamoDB.DeleteTable(input); err != nil && !isAWSErrorCode(err, resourceNotFoundException) {
+			return fmt.Errorf("error deleting %s in %s: %v", name, replica.region, err)
+		}
+	}
+	_, err := d.DynamoDB.DeleteTable(input)
 	return err
 }
 
@@ -438,6 +758,15 @@ func recordDynamoError(tableName string, err error) {
 	}
 }
 
+func tableNames(b map[string][]*dynamodb.WriteRequest) []string {
+	names := make([]string, 0, len(b))
+	for name := range b {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func dictLen(b map[string][]*dynamodb.WriteRequest) int {
 	result := 0
 	for _, reqs := range b {
@@ -465,22 +794,51 @@ func takeReqs(from, to map[string][]*dynamodb.WriteRequest, max int) {
 	}
 }
 
-// dynamoClientFromURL creates a new DynamoDB client from a URL.
-func dynamoClientFromURL(awsURL *url.URL) (dynamodbiface.DynamoDBAPI, error) {
+// dynamoClientFromURL creates a new DynamoDB client from a URL, and optional
+// endpoint override.
+func dynamoClientFromURL(awsURL *url.URL, endpoint string) (dynamodbiface.DynamoDBAPI, error) {
 	if awsURL == nil {
 		return nil, fmt.Errorf("no URL specified for DynamoDB")
 	}
-	config, err := awsConfigFromURL(awsURL)
+	config, err := awsConfigFromURL(awsURL, endpoint)
 	if err != nil {
 		return nil, err
 	}
 	return dynamodb.New(session.New(config)), nil
 }
 
+// S3ClientFromURL makes an S3 client from a URL with the escaped Key and
+// Secret encoded, like -s3.url.  A non-empty endpoint overrides the one
+// deduced from the URL.
+func S3ClientFromURL(s3URL *url.URL, endpoint string, forcePathStyle bool) (s3iface.S3API, error) {
+	client, err := newS3Client(s3URL, endpoint, forcePathStyle, S3RetryConfig{})
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// newS3Client makes an S3 client like S3ClientFromURL, whose requests are
+// retried as configured, and instrumented with instrumentS3Retry.
+func newS3Client(s3URL *url.URL, endpoint string, forcePathStyle bool, retries S3RetryConfig) (*s3.S3, error) {
+	s3Config, err := awsConfigFromURL(s3URL, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	s3Config = s3Config.WithS3ForcePathStyle(forcePathStyle)
+	if retries.MaxRetries > 0 {
+		s3Config = request.WithRetryer(s3Config, newS3Retryer(retries))
+	}
+	client := s3.New(session.New(s3Config))
+	client.Handlers.AfterRetry.PushBack(instrumentS3Retry)
+	return client, nil
+}
+
 // awsConfigFromURL returns AWS config from given URL. It expects escaped AWS Access key ID & Secret Access Key to be
 // encoded in the URL. It also expects region specified as a host (letting AWS generate full endpoint) or fully valid
-// endpoint with dummy region assumed (e.g for URLs to emulated services).
-func awsConfigFromURL(awsURL *url.URL) (*aws.Config, error) {
+// endpoint with dummy region assumed (e.g for URLs to emulated services).  If endpoint is set, it is used instead
+// of the endpoint from the URL, but the region is still taken from the URL.
+func awsConfigFromURL(awsURL *url.URL, endpoint string) (*aws.Config, error) {
 	if awsURL.User == nil {
 		return nil, fmt.Errorf("must specify escaped Access Key & Secret Access in URL")
 	}
@@ -491,7 +849,13 @@ func awsConfigFromURL(awsURL *url.URL) (*aws.Config, error) {
 		WithCredentials(creds).
 		WithMaxRetries(0) // We do our own retries, so we can monitor them
 	if strings.Contains(awsURL.Host, ".") {
-		return config.WithEndpoint(fmt.Sprintf("http://%s", awsURL.Host)).WithRegion("dummy"), nil
+		if endpoint == "" {
+			endpoint = fmt.Sprintf("http://%s", awsURL.Host)
+		}
+		return config.WithEndpoint(endpoint).WithRegion("dummy"), nil
+	}
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint)
 	}
 
 	// Let AWS generate default endpoint based on region passed as a host in URL.
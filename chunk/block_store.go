@@ -0,0 +1,529 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+// Blocks' keys in the object store all start with this, so they're never
+// mistaken for chunks.
+const blocksPrefix = "blocks/"
+
+var (
+	blocksWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "block_store_blocks_written_total",
+		Help:      "Total number of blocks written.",
+	})
+	blockSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "block_store_block_size_bytes",
+		Help:      "Size of blocks written.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+	blocksQueried = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "block_store_blocks_per_query",
+		Help:      "Number of blocks fetched per query.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+	blocksListed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "block_store_lists_total",
+		Help:      "Total number of times a user's blocks were listed from the object store, rather than the cache.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(blocksWritten)
+	prometheus.MustRegister(blockSize)
+	prometheus.MustRegister(blocksQueried)
+	prometheus.MustRegister(blocksListed)
+}
+
+// blockStore is the experimental blocks storage: each batch of chunks put is
+// written as a single object, a block, with an index of the series in it,
+// rather than writing index entries per series and label for every chunk.
+// Queries find the user's blocks from a cached listing, and fetch those
+// which overlap the query.
+//
+// Blocks are never compacted, so queries get slower the more blocks they
+// span.  Deleting series rewrites the blocks holding them.
+type blockStore struct {
+	storage     StorageClient
+	quarantine  *quarantine
+	concurrency int
+	listTTL     time.Duration
+
+	mtx   sync.Mutex
+	lists map[string]blockList // by user ID
+}
+
+// blockList is a cached listing of a user's blocks.  Its blocks are never
+// modified, only replaced, so they can be read without holding the lock.
+type blockList struct {
+	blocks   []blockMeta
+	listedAt time.Time
+}
+
+func newBlockStore(storage StorageClient, quarantine *quarantine, concurrency int, listTTL time.Duration) *blockStore {
+	return &blockStore{
+		storage:     storage,
+		quarantine:  quarantine,
+		concurrency: concurrency,
+		listTTL:     listTTL,
+		lists:       map[string]blockList{},
+	}
+}
+
+// blockIndex is the first part of a block, listing the chunks in the rest of
+// it by series.
+type blockIndex struct {
+	Series []blockSeries `json:"series"`
+}
+
+type blockSeries struct {
+	Metric model.Metric `json:"metric"`
+	Chunks []blockChunk `json:"chunks"`
+}
+
+// blockChunk is a chunk, encoded as in the object store, at Offset in the
+// block after the index.
+type blockChunk struct {
+	Key    string `json:"key"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+}
+
+type blockMeta struct {
+	key           string
+	from, through model.Time
+}
+
+// blockKey is `blocks/<user id>/<from>:<through>:<checksum>`, with numbers
+// hex encoded like chunks' keys, so a block's range is known without
+// fetching it.
+func (b blockMeta) blockKey(userID string, checksum uint32) string {
+	return fmt.Sprintf("%s%s/%x:%x:%x", blocksPrefix, userID, int64(b.from), int64(b.through), checksum)
+}
+
+func parseBlockKey(userID, key string) (blockMeta, error) {
+	prefix := blocksPrefix + userID + "/"
+	if !strings.HasPrefix(key, prefix) {
+		return blockMeta{}, fmt.Errorf("invalid block key: %s", key)
+	}
+	parts := strings.Split(key[len(prefix):], ":")
+	if len(parts) != 3 {
+		return blockMeta{}, fmt.Errorf("invalid block key: %s", key)
+	}
+	from, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil {
+		return blockMeta{}, err
+	}
+	through, err := strconv.ParseInt(parts[1], 16, 64)
+	if err != nil {
+		return blockMeta{}, err
+	}
+	return blockMeta{key: key, from: model.Time(from), through: model.Time(through)}, nil
+}
+
+// Put writes the chunks as one block.
+func (s *blockStore) Put(ctx context.Context, chunks []Chunk) error {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = s.putBlock(ctx, userID, chunks)
+	return err
+}
+
+// putBlock writes the chunks as one block, and returns its key, if there
+// were any chunks.
+func (s *blockStore) putBlock(ctx context.Context, userID string, chunks []Chunk) (string, error) {
+	if len(chunks) == 0 {
+		return "", nil
+	}
+
+	data := util.GetBuffer()
+	defer util.PutBuffer(data)
+	var (
+		index  blockIndex
+		series = map[model.Fingerprint]int{}
+		meta   = blockMeta{from: model.Latest, through: model.Earliest}
+	)
+	for i := range chunks {
+		encoded, err := chunks[i].encode()
+		if err != nil {
+			return "", err
+		}
+		fp := chunks[i].Metric.Fingerprint()
+		j, ok := series[fp]
+		if !ok {
+			j = len(index.Series)
+			series[fp] = j
+			index.Series = append(index.Series, blockSeries{Metric: chunks[i].Metric})
+		}
+		index.Series[j].Chunks = append(index.Series[j].Chunks, blockChunk{
+			Key:    chunks[i].externalKey(),
+			Offset: data.Len(),
+			Length: len(encoded),
+		})
+		data.Write(encoded)
+		if chunks[i].From.Before(meta.from) {
+			meta.from = chunks[i].From
+		}
+		if chunks[i].Through.After(meta.through) {
+			meta.through = chunks[i].Through
+		}
+	}
+
+	buf, err := encodeBlock(index, data.Bytes())
+	if err != nil {
+		return "", err
+	}
+	// The key includes the checksum, so retrying a Put overwrites the block
+	// rather than duplicating it.
+	meta.key = meta.blockKey(userID, crc32.Checksum(buf, castagnoliTable))
+	if err := s.storage.PutChunk(ctx, meta.key, buf); err != nil {
+		return "", err
+	}
+	blocksWritten.Inc()
+	blockSize.Observe(float64(len(buf)))
+	s.updateList(userID, []blockMeta{meta}, nil)
+	return meta.key, nil
+}
+
+// encodeBlock writes the length of the snappy-compressed index, the index,
+// then the chunks.
+func encodeBlock(index blockIndex, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	indexLenBytes := [4]byte{}
+	buf.Write(indexLenBytes[:])
+	w := util.GetSnappyWriter(&buf)
+	defer util.PutSnappyWriter(w)
+	if err := json.NewEncoder(w).Encode(index); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(indexLenBytes[:], uint32(buf.Len()-len(indexLenBytes)))
+	copy(buf.Bytes(), indexLenBytes[:])
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+func decodeBlock(buf []byte) (blockIndex, []byte, error) {
+	var index blockIndex
+	if len(buf) < 4 {
+		return index, nil, fmt.Errorf("block too short")
+	}
+	indexLen := int(binary.BigEndian.Uint32(buf))
+	if len(buf) < 4+indexLen {
+		return index, nil, fmt.Errorf("block too short")
+	}
+	r := util.GetSnappyReader(bytes.NewReader(buf[4 : 4+indexLen]))
+	defer util.PutSnappyReader(r)
+	if err := json.NewDecoder(r).Decode(&index); err != nil && err != io.EOF {
+		return index, nil, err
+	}
+	return index, buf[4+indexLen:], nil
+}
+
+// Get returns the chunks of the series matching all of matchers which
+// overlap from to through.
+func (s *blockStore) Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]Chunk, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := s.blocksOverlapping(ctx, userID, from, through)
+	if err != nil {
+		return nil, err
+	}
+	blocksQueried.Observe(float64(len(blocks)))
+
+	chunks, err := s.fetchBlocks(ctx, userID, blocks, func(c Chunk) bool {
+		if c.Through.Before(from) || c.From.After(through) {
+			return false
+		}
+		for _, matcher := range matchers {
+			if !matcher.Match(c.Metric[matcher.Name]) {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.quarantine != nil {
+		chunks = s.quarantine.filterChunks(chunks)
+	}
+	if err := util.CheckSeriesLimit(ctx, countSeries(chunks)); err != nil {
+		return nil, err
+	}
+	// Blocks are fetched whole, so this only stops the chunks being returned.
+	if err := util.CheckChunkLimit(ctx, len(chunks)); err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+// DeleteSeries deletes the samples of the series matching the matchers
+// between from and through, inclusive, by writing each block holding any of
+// them again without them, and then deleting the old block.
+func (s *blockStore) DeleteSeries(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) error {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return err
+	}
+	blocks, err := s.blocksOverlapping(ctx, userID, from, through)
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		chunks, err := s.fetchBlocks(ctx, userID, []blockMeta{block}, func(Chunk) bool { return true })
+		if err != nil {
+			return err
+		}
+		kept := make([]Chunk, 0, len(chunks))
+		deleted := false
+	outer:
+		for _, c := range chunks {
+			if c.Through.Before(from) || c.From.After(through) {
+				kept = append(kept, c)
+				continue
+			}
+			for _, matcher := range matchers {
+				if !matcher.Match(c.Metric[matcher.Name]) {
+					kept = append(kept, c)
+					continue outer
+				}
+			}
+			deleted = true
+			if c.From.Before(from) || c.Through.After(through) {
+				replacements, err := c.without(from, through)
+				if err != nil {
+					return err
+				}
+				kept = append(kept, replacements...)
+			}
+		}
+		if !deleted {
+			continue
+		}
+		if _, err := s.putBlock(ctx, userID, kept); err != nil {
+			return err
+		}
+		if err := s.storage.DeleteChunk(ctx, block.key); err != nil {
+			return err
+		}
+		s.updateList(userID, nil, []blockMeta{block})
+	}
+	return nil
+}
+
+// blocksOverlapping returns the user's blocks which overlap from to
+// through, and aren't quarantined.
+func (s *blockStore) blocksOverlapping(ctx context.Context, userID string, from, through model.Time) ([]blockMeta, error) {
+	all, err := s.listBlocks(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []blockMeta
+	for _, meta := range all {
+		if !meta.through.Before(from) && !meta.from.After(through) {
+			blocks = append(blocks, meta)
+		}
+	}
+	if s.quarantine != nil {
+		blocks = s.quarantine.filterBlocks(blocks)
+	}
+	return blocks, nil
+}
+
+// listBlocks returns the user's blocks, listing them from the object store
+// if they weren't listed within the list TTL.
+func (s *blockStore) listBlocks(ctx context.Context, userID string) ([]blockMeta, error) {
+	s.mtx.Lock()
+	list, ok := s.lists[userID]
+	s.mtx.Unlock()
+	if ok && time.Since(list.listedAt) < s.listTTL {
+		return list.blocks, nil
+	}
+
+	listedAt := time.Now()
+	var blocks []blockMeta
+	if err := s.storage.ListChunks(ctx, blocksPrefix+userID+"/", func(key string, _ time.Time) bool {
+		if meta, err := parseBlockKey(userID, key); err == nil {
+			blocks = append(blocks, meta)
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	blocksListed.Inc()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.listTTL > 0 {
+		s.lists[userID] = blockList{blocks: blocks, listedAt: listedAt}
+	}
+	return blocks, nil
+}
+
+// updateList adds and removes blocks from the user's cached listing, if
+// there is one, as this process writes and deletes them.
+func (s *blockStore) updateList(userID string, added, removed []blockMeta) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	list, ok := s.lists[userID]
+	if !ok {
+		return
+	}
+	blocks := make([]blockMeta, 0, len(list.blocks)+len(added))
+outer:
+	for _, meta := range list.blocks {
+		for _, r := range removed {
+			if meta.key == r.key {
+				continue outer
+			}
+		}
+		blocks = append(blocks, meta)
+	}
+	s.lists[userID] = blockList{blocks: append(blocks, added...), listedAt: list.listedAt}
+}
+
+// fetchBlocks fetches the blocks, at most concurrency at once, and returns
+// their chunks for which keep returns true.  Blocks deleted since they were
+// listed are skipped, and the user's listing is dropped.
+func (s *blockStore) fetchBlocks(ctx context.Context, userID string, blocks []blockMeta, keep func(Chunk) bool) ([]Chunk, error) {
+	workers := s.concurrency
+	if workers <= 0 || workers > len(blocks) {
+		workers = len(blocks)
+	}
+	type result struct {
+		chunks []Chunk
+		err    error
+	}
+	indexes := make(chan int)
+	results := make(chan result)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range indexes {
+				chunks, err := s.getBlockChunks(ctx, userID, blocks[i], keep)
+				results <- result{chunks, err}
+			}
+		}()
+	}
+	go func() {
+		for i := range blocks {
+			indexes <- i
+		}
+		close(indexes)
+	}()
+
+	chunks := []Chunk{}
+	var lastErr error
+	for range blocks {
+		r := <-results
+		switch r.err {
+		case nil:
+			chunks = append(chunks, r.chunks...)
+		case ErrChunkNotFound:
+			s.mtx.Lock()
+			delete(s.lists, userID)
+			s.mtx.Unlock()
+		default:
+			lastErr = r.err
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return chunks, nil
+}
+
+func (s *blockStore) getBlockChunks(ctx context.Context, userID string, block blockMeta, keep func(Chunk) bool) ([]Chunk, error) {
+	buf, err := s.storage.GetChunk(ctx, block.key)
+	if err != nil {
+		return nil, err
+	}
+	index, data, err := decodeBlock(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding block %s: %v", block.key, err)
+	}
+
+	var chunks []Chunk
+	for _, series := range index.Series {
+		for _, c := range series.Chunks {
+			chunk, err := parseExternalKey(userID, c.Key)
+			if err != nil {
+				return nil, err
+			}
+			chunk.Metric = series.Metric
+			if !keep(chunk) {
+				continue
+			}
+			if c.Offset < 0 || c.Offset+c.Length > len(data) {
+				return nil, fmt.Errorf("chunk %s out of bounds of block %s", c.Key, block.key)
+			}
+			if err := chunk.decode(data[c.Offset : c.Offset+c.Length]); err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks, nil
+}
+
+// deleteBlocks deletes the blocks under prefix for which shouldDelete
+// returns true, returning how many it deleted of each user.  It doesn't
+// need the blocks storage to be enabled, so tenants' blocks are deleted
+// whatever the store's mode.
+func deleteBlocks(ctx context.Context, storage StorageClient, prefix string, shouldDelete func(userID string, meta blockMeta) bool) (map[string]int, error) {
+	deleted := map[string]int{}
+	var keys []string
+	var users []string
+	if err := storage.ListChunks(ctx, prefix, func(key string, _ time.Time) bool {
+		rest := strings.TrimPrefix(key, blocksPrefix)
+		i := strings.IndexByte(rest, '/')
+		if !strings.HasPrefix(key, blocksPrefix) || i < 0 {
+			return true
+		}
+		userID := rest[:i]
+		meta, err := parseBlockKey(userID, key)
+		if err != nil || !shouldDelete(userID, meta) {
+			return true
+		}
+		keys = append(keys, key)
+		users = append(users, userID)
+		return true
+	}); err != nil {
+		return deleted, err
+	}
+	for i, key := range keys {
+		if err := storage.DeleteChunk(ctx, key); err != nil {
+			return deleted, err
+		}
+		deleted[users[i]]++
+	}
+	return deleted, nil
+}
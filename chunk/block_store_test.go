@@ -0,0 +1,158 @@
+package chunk
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+func TestBlockStore(t *testing.T) {
+	// No tables exist, so any index writes would fail.
+	storage := NewMockStorage()
+	store, err := NewStore(StoreConfig{schemaFactory: v6Schema, BlocksStorage: true}, storage)
+	require.NoError(t, err)
+	ctx := user.Inject(context.Background(), "user1")
+
+	now := model.Now()
+	other := model.Metric{model.MetricNameLabel: "foo", "bar": "qux"}
+	otherChunks, err := newChunks("user1", other.Fingerprint(), other, []model.SamplePair{{Timestamp: now.Add(-3 * time.Hour), Value: 1}})
+	require.NoError(t, err)
+	require.NoError(t, store.Put(ctx, append([]Chunk{
+		chunkOf(t, "user1", now.Add(-4*time.Hour), now.Add(-3*time.Hour)),
+	}, otherChunks...)))
+	require.NoError(t, store.Put(ctx, []Chunk{chunkOf(t, "user1", now.Add(-time.Hour), now)}))
+	require.NoError(t, store.Put(user.Inject(context.Background(), "user2"), []Chunk{chunkOf(t, "user2", now.Add(-time.Hour), now)}))
+
+	var keys []string
+	require.NoError(t, storage.ListChunks(context.Background(), "", func(key string, _ time.Time) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	require.Len(t, keys, 3)
+	for _, key := range keys {
+		assert.True(t, strings.HasPrefix(key, "blocks/"), key)
+		_, err := ParseKey(key)
+		assert.Error(t, err, "blocks mustn't be mistaken for chunks")
+	}
+
+	get := func(from, through model.Time, matchers ...*metric.LabelMatcher) model.Matrix {
+		chunks, err := store.Get(ctx, from, through, matchers...)
+		require.NoError(t, err)
+		matrix, err := ChunksToMatrix(chunks)
+		require.NoError(t, err)
+		sort.Sort(matrix)
+		return matrix
+	}
+	foo := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+
+	matrix := get(now.Add(-5*time.Hour), now, foo)
+	require.Len(t, matrix, 2)
+	assert.Len(t, matrix[0].Values, 61+61)
+	assert.Len(t, matrix[1].Values, 1)
+
+	matrix = get(now.Add(-5*time.Hour), now, foo, mustNewLabelMatcher(metric.Equal, "bar", "qux"))
+	require.Len(t, matrix, 1)
+	assert.Equal(t, other, matrix[0].Metric)
+
+	// Only the last block overlaps.
+	matrix = get(now.Add(-30*time.Minute), now, foo)
+	require.Len(t, matrix, 1)
+	assert.Len(t, matrix[0].Values, 61)
+
+	assert.Empty(t, get(now.Add(-5*time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "bar")))
+}
+
+func TestBlockStoreDeleteSeries(t *testing.T) {
+	storage := NewMockStorage()
+	store, err := NewStore(StoreConfig{schemaFactory: v6Schema, BlocksStorage: true}, storage)
+	require.NoError(t, err)
+	ctx := user.Inject(context.Background(), "user1")
+
+	now := model.Now()
+	other := model.Metric{model.MetricNameLabel: "foo", "bar": "qux"}
+	otherChunks, err := newChunks("user1", other.Fingerprint(), other, []model.SamplePair{{Timestamp: now.Add(-3 * time.Hour), Value: 1}})
+	require.NoError(t, err)
+	require.NoError(t, store.Put(ctx, append([]Chunk{chunkOf(t, "user1", now.Add(-4*time.Hour), now.Add(-3*time.Hour))}, otherChunks...)))
+	require.NoError(t, store.Put(ctx, []Chunk{chunkOf(t, "user1", now.Add(-time.Hour), now)}))
+
+	foo := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	baz := mustNewLabelMatcher(metric.Equal, "bar", "baz")
+	require.NoError(t, store.DeleteSeries(ctx, now.Add(-3*time.Hour-30*time.Minute), now.Add(-2*time.Hour), foo, baz))
+
+	chunks, err := store.Get(ctx, now.Add(-5*time.Hour), now, foo)
+	require.NoError(t, err)
+	matrix, err := ChunksToMatrix(chunks)
+	require.NoError(t, err)
+	sort.Sort(matrix)
+	require.Len(t, matrix, 2)
+	assert.Len(t, matrix[0].Values, 30+61)
+	assert.Equal(t, other, matrix[1].Metric)
+
+	// The first block was replaced, and the second left alone.
+	var keys []string
+	require.NoError(t, storage.ListChunks(context.Background(), "", func(key string, _ time.Time) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	assert.Len(t, keys, 2)
+}
+
+func TestBlockStoreListCacheAndQuarantine(t *testing.T) {
+	storage := NewMockStorage()
+	store, err := NewStore(StoreConfig{
+		schemaFactory: v6Schema,
+		BlocksStorage: true,
+		BlocksListTTL: time.Hour,
+		Quarantine:    QuarantineConfig{Store: inMemoryQuarantineStore},
+	}, storage)
+	require.NoError(t, err)
+	writer, err := NewStore(StoreConfig{schemaFactory: v6Schema, BlocksStorage: true}, storage)
+	require.NoError(t, err)
+	ctx := user.Inject(context.Background(), "user1")
+
+	now := model.Now()
+	foo := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	get := func() []Chunk {
+		chunks, err := store.Get(ctx, now.Add(-5*time.Hour), now, foo)
+		require.NoError(t, err)
+		return chunks
+	}
+	first := chunkOf(t, "user1", now.Add(-4*time.Hour), now.Add(-3*time.Hour))
+	require.NoError(t, store.Put(ctx, []Chunk{first}))
+	assert.Len(t, get(), 1)
+
+	// Blocks written by other stores are only seen once the list expires,
+	// but this store's own are seen straight away.
+	require.NoError(t, writer.Put(ctx, []Chunk{chunkOf(t, "user1", now.Add(-2*time.Hour), now.Add(-time.Hour))}))
+	assert.Len(t, get(), 1)
+	second := chunkOf(t, "user1", now.Add(-time.Hour), now)
+	require.NoError(t, store.Put(ctx, []Chunk{second}))
+	assert.Len(t, get(), 2)
+	store.blocks.listTTL = 0
+	assert.Len(t, get(), 3)
+
+	for _, c := range get() {
+		if c.From == first.From {
+			require.NoError(t, store.quarantine.add(QuarantineEntry{ChunkKey: c.externalKey()}))
+		}
+	}
+	blocks, err := store.blocks.listBlocks(ctx, "user1")
+	require.NoError(t, err)
+	for _, block := range blocks {
+		if block.from == second.From {
+			require.NoError(t, store.quarantine.add(QuarantineEntry{ChunkKey: block.key}))
+		}
+	}
+	chunks := get()
+	require.Len(t, chunks, 1)
+	assert.Equal(t, now.Add(-2*time.Hour), chunks[0].From)
+}
@@ -10,7 +10,6 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/golang/snappy"
 	"github.com/prometheus/common/model"
 	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
 
@@ -45,6 +44,10 @@ type Chunk struct {
 	ChecksumSet bool   `json:"-"`
 	Checksum    uint32 `json:"-"`
 
+	// The size of the chunk in external storage, once it's been encoded or
+	// decoded.
+	EncodedSize int `json:"-"`
+
 	// We never use Delta encoding (the zero value), so if this entry is
 	// missing, we default to DoubleDelta.
 	Encoding prom_chunk.Encoding `json:"encoding"`
@@ -53,6 +56,9 @@ type Chunk struct {
 	// This flag is used for very old chunks, where the metadata is read out
 	// of the index.
 	metadataInIndex bool
+
+	// Where the chunk is in its batch's object, if it was written in one.
+	batch batchRef
 }
 
 // NewChunk creates a new chunk
@@ -81,8 +87,17 @@ func NewChunk(userID string, fp model.Fingerprint, metric model.Metric, c prom_c
 // Post-checksums, externals keys become the same across DynamoDB, Memcache
 // and S3.  Numbers become hex encoded.  Keys look like:
 // `<user id>/<fingerprint>:<start time>:<end time>:<checksum>`.
+//
+// From the v7 schema, DynamoDB keys leave out the `<user id>/`, as the user
+// ID is in the hash key.
+//
+// Chunks written in a batch have `@<batch>:<offset>:<length>` appended, the
+// batch's ID and where the chunk is in its object, hex encoded.
 func parseExternalKey(userID, externalKey string) (Chunk, error) {
 	if !strings.Contains(externalKey, "/") {
+		if id := strings.SplitN(externalKey, "@", 2)[0]; strings.Count(id, ":") == 3 {
+			return parseNewExternalKey(userID + "/" + externalKey)
+		}
 		return parseLegacyChunkID(userID, externalKey)
 	}
 	chunk, err := parseNewExternalKey(externalKey)
@@ -95,6 +110,19 @@ func parseExternalKey(userID, externalKey string) (Chunk, error) {
 	return chunk, nil
 }
 
+// ParseKey parses the external key of a chunk, as used in the object store
+// and the cache, where legacy chunks' keys are prefixed with the user ID too.
+func ParseKey(key string) (Chunk, error) {
+	if chunk, err := parseNewExternalKey(key); err == nil {
+		return chunk, nil
+	}
+	i := strings.IndexByte(key, '/')
+	if i < 0 {
+		return Chunk{}, ErrInvalidChunkID
+	}
+	return parseLegacyChunkID(key[:i], key[i+1:])
+}
+
 func parseLegacyChunkID(userID, key string) (Chunk, error) {
 	parts := strings.Split(key, ":")
 	if len(parts) != 3 {
@@ -121,6 +149,14 @@ func parseLegacyChunkID(userID, key string) (Chunk, error) {
 }
 
 func parseNewExternalKey(key string) (Chunk, error) {
+	var batch batchRef
+	if i := strings.IndexByte(key, '@'); i >= 0 {
+		var err error
+		if batch, err = parseBatchRef(key[i+1:]); err != nil {
+			return Chunk{}, err
+		}
+		key = key[:i]
+	}
 	parts := strings.Split(key, "/")
 	if len(parts) != 2 {
 		return Chunk{}, ErrInvalidChunkID
@@ -153,17 +189,23 @@ func parseNewExternalKey(key string) (Chunk, error) {
 		Through:     model.Time(through),
 		Checksum:    uint32(checksum),
 		ChecksumSet: true,
+		batch:       batch,
 	}, nil
 }
 
 // externalKey returns the key you can use to fetch this chunk from external
-// storage. For newer chunks, this key includes a checksum.
+// storage. For newer chunks, this key includes a checksum.  Chunks in a batch
+// are stored in their batch's object, under objectKey.
 func (c *Chunk) externalKey() string {
 	// Some chunks have a checksum stored in dynamodb, some do not.  We must
 	// generate keys appropriately.
 	if c.ChecksumSet {
 		// This is the inverse of parseNewExternalKey.
-		return fmt.Sprintf("%s/%x:%x:%x:%x", c.UserID, uint64(c.Fingerprint), int64(c.From), int64(c.Through), c.Checksum)
+		key := fmt.Sprintf("%s/%x:%x:%x:%x", c.UserID, uint64(c.Fingerprint), int64(c.From), int64(c.Through), c.Checksum)
+		if c.batch.id != "" {
+			key += "@" + c.batch.String()
+		}
+		return key
 	}
 	// This is the inverse of parseLegacyExternalKey, with "<user id>/" prepended.
 	// Legacy chunks had the user ID prefix on s3/memcache, but not in DynamoDB.
@@ -173,7 +215,8 @@ func (c *Chunk) externalKey() string {
 
 // encode writes the chunk out to a big write buffer, then calculates the checksum.
 func (c *Chunk) encode() ([]byte, error) {
-	var buf bytes.Buffer
+	buf := util.GetBuffer()
+	defer util.PutBuffer(buf)
 
 	// Write 4 empty bytes first - we will come back and put the len in here.
 	metadataLenBytes := [4]byte{}
@@ -182,7 +225,10 @@ func (c *Chunk) encode() ([]byte, error) {
 	}
 
 	// Encode chunk metadata into snappy-compressed buffer
-	if err := json.NewEncoder(snappy.NewWriter(&buf)).Encode(c); err != nil {
+	sw := util.GetSnappyWriter(buf)
+	err := json.NewEncoder(sw).Encode(c)
+	util.PutSnappyWriter(sw)
+	if err != nil {
 		return nil, err
 	}
 
@@ -198,14 +244,16 @@ func (c *Chunk) encode() ([]byte, error) {
 	}
 
 	// And now the chunk data
-	if err := c.Data.Marshal(&buf); err != nil {
+	if err := c.Data.Marshal(buf); err != nil {
 		return nil, err
 	}
 
-	// Now work out the checksum
-	output := buf.Bytes()
+	// Copy the output out of the pooled buffer, and work out the checksum
+	output := make([]byte, buf.Len())
+	copy(output, buf.Bytes())
 	c.ChecksumSet = true
 	c.Checksum = crc32.Checksum(output, castagnoliTable)
+	c.EncodedSize = len(output)
 	return output, nil
 }
 
@@ -219,6 +267,7 @@ func (c *Chunk) decode(input []byte) error {
 		if err != nil {
 			return err
 		}
+		c.EncodedSize = len(input)
 		return c.Data.UnmarshalFromBuf(input)
 	}
 
@@ -235,17 +284,20 @@ func (c *Chunk) decode(input []byte) error {
 		return err
 	}
 	var tempMetadata Chunk
-	err := json.NewDecoder(snappy.NewReader(&io.LimitedReader{
+	sr := util.GetSnappyReader(&io.LimitedReader{
 		N: int64(metadataLen),
 		R: r,
-	})).Decode(&tempMetadata)
+	})
+	err := json.NewDecoder(sr).Decode(&tempMetadata)
+	util.PutSnappyReader(sr)
 	if err != nil {
 		return err
 	}
 
 	// Next, confirm the chunks matches what we expected.  Easiest way to do this
 	// is to compare what the decoded data thinks its external ID would be, but
-	// we don't write the checksum to s3, so we have to copy the checksum in.
+	// we don't write the checksum or batch to s3, so we have to copy them in.
+	tempMetadata.batch = c.batch
 	if c.ChecksumSet {
 		tempMetadata.Checksum, tempMetadata.ChecksumSet = c.Checksum, c.ChecksumSet
 		if c.externalKey() != tempMetadata.externalKey() {
@@ -253,6 +305,7 @@ func (c *Chunk) decode(input []byte) error {
 		}
 	}
 	*c = tempMetadata
+	c.EncodedSize = len(input)
 
 	// Flag indicates if metadata was written to index, and if false implies
 	// we should read a header of the chunk containing the metadata.  Exists
@@ -318,3 +371,63 @@ func (c *Chunk) samples() ([]model.SamplePair, error) {
 	}
 	return samples, nil
 }
+
+// without returns chunks of the samples of the chunk outside from and
+// through, inclusive.
+func (c *Chunk) without(from, through model.Time) ([]Chunk, error) {
+	samples, err := c.samples()
+	if err != nil {
+		return nil, err
+	}
+	var before, after []model.SamplePair
+	for _, s := range samples {
+		if s.Timestamp.Before(from) {
+			before = append(before, s)
+		} else if s.Timestamp.After(through) {
+			after = append(after, s)
+		}
+	}
+
+	var result []Chunk
+	for _, run := range [][]model.SamplePair{before, after} {
+		chunks, err := newChunks(c.UserID, c.Fingerprint, c.Metric, run)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, chunks...)
+	}
+	return result, nil
+}
+
+// newChunks encodes the samples, in order, in as many chunks as they need.
+func newChunks(userID string, fp model.Fingerprint, metric model.Metric, samples []model.SamplePair) ([]Chunk, error) {
+	if len(samples) == 0 {
+		return nil, nil
+	}
+	encoded := []prom_chunk.Chunk{prom_chunk.New()}
+	for _, s := range samples {
+		last := len(encoded) - 1
+		cs, err := encoded[last].Add(s)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded[:last], cs...)
+	}
+
+	chunks := make([]Chunk, 0, len(encoded))
+	for _, c := range encoded {
+		it := c.NewIterator()
+		var from, through model.Time
+		for n := 0; it.Scan(); n++ {
+			if n == 0 {
+				from = it.Value().Timestamp
+			}
+			through = it.Value().Timestamp
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, NewChunk(userID, fp, metric, c, from, through))
+	}
+	return chunks, nil
+}
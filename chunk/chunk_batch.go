@@ -0,0 +1,209 @@
+package chunk
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// Batches' keys in the object store all start with this, so they're never
+// mistaken for chunks.
+const batchesPrefix = "batches/"
+
+var (
+	batchesWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_batches_written_total",
+		Help:      "Total number of batches of chunks written as one object.",
+	})
+	chunksPerBatch = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_chunks_per_batch",
+		Help:      "Number of chunks in each batch written as one object.",
+		Buckets:   prometheus.ExponentialBuckets(2, 4, 8),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(batchesWritten)
+	prometheus.MustRegister(chunksPerBatch)
+}
+
+// batchRef is where a chunk is in the object of the batch it was written in:
+// length bytes from offset.  The batch's ID is `<from>:<through>:<checksum>`,
+// hex encoded like a block's key, so its range is known without fetching it.
+type batchRef struct {
+	id             string
+	offset, length int
+}
+
+func (b batchRef) String() string {
+	return fmt.Sprintf("%s:%x:%x", b.id, b.offset, b.length)
+}
+
+func parseBatchRef(s string) (batchRef, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 5 {
+		return batchRef{}, ErrInvalidChunkID
+	}
+	id := strings.Join(parts[:3], ":")
+	if _, err := parseBatchID(id); err != nil {
+		return batchRef{}, err
+	}
+	offset, err := strconv.ParseInt(parts[3], 16, 64)
+	if err != nil {
+		return batchRef{}, err
+	}
+	length, err := strconv.ParseInt(parts[4], 16, 64)
+	if err != nil {
+		return batchRef{}, err
+	}
+	return batchRef{id: id, offset: int(offset), length: int(length)}, nil
+}
+
+func batchID(from, through model.Time, checksum uint32) string {
+	return fmt.Sprintf("%x:%x:%x", int64(from), int64(through), checksum)
+}
+
+// parseBatchID returns the range of the batch with the given ID.
+func parseBatchID(id string) (blockMeta, error) {
+	parts := strings.Split(id, ":")
+	if len(parts) != 3 {
+		return blockMeta{}, ErrInvalidChunkID
+	}
+	from, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil {
+		return blockMeta{}, err
+	}
+	through, err := strconv.ParseInt(parts[1], 16, 64)
+	if err != nil {
+		return blockMeta{}, err
+	}
+	if _, err := strconv.ParseUint(parts[2], 16, 32); err != nil {
+		return blockMeta{}, err
+	}
+	return blockMeta{from: model.Time(from), through: model.Time(through)}, nil
+}
+
+// parseBatchKey returns the user and range of the batch with the given key
+// in the object store.
+func parseBatchKey(key string) (string, blockMeta, error) {
+	parts := strings.Split(strings.TrimPrefix(key, batchesPrefix), "/")
+	if !strings.HasPrefix(key, batchesPrefix) || len(parts) != 2 {
+		return "", blockMeta{}, fmt.Errorf("invalid batch key: %s", key)
+	}
+	meta, err := parseBatchID(parts[1])
+	if err != nil {
+		return "", blockMeta{}, err
+	}
+	meta.key = key
+	return parts[0], meta, nil
+}
+
+// objectKey returns the key of the object holding the chunk: its own, or
+// its batch's.
+func (c *Chunk) objectKey() string {
+	if c.batch.id == "" {
+		return c.externalKey()
+	}
+	return batchesPrefix + c.UserID + "/" + c.batch.id
+}
+
+// batchThrough returns the end of the chunk's batch, or of the chunk if it
+// isn't in one: its object can be deleted once that's past retention.
+func (c *Chunk) batchThrough() model.Time {
+	if c.batch.id == "" {
+		return c.Through
+	}
+	meta, err := parseBatchID(c.batch.id)
+	if err != nil {
+		return model.Latest
+	}
+	return meta.through
+}
+
+// getChunk reads the encoded chunk from the object store.
+func getChunk(ctx context.Context, storage StorageClient, chunk Chunk) ([]byte, error) {
+	if chunk.batch.id == "" {
+		return storage.GetChunk(ctx, chunk.externalKey())
+	}
+	return storage.GetChunkRange(ctx, chunk.objectKey(), chunk.batch.offset, chunk.batch.length)
+}
+
+// putBatch writes the chunks as one object, in the same format as a block,
+// with each chunk's index entries pointing at where it is in the object, so
+// a flush takes one PUT rather than one per chunk.  Large batches are
+// uploaded in parts, as set by -s3.multipart-threshold.
+func (c *Store) putBatch(ctx context.Context, userID string, chunks []Chunk) error {
+	data := util.GetBuffer()
+	defer util.PutBuffer(data)
+	var (
+		index   blockIndex
+		series  = map[model.Fingerprint]int{}
+		meta    = blockMeta{from: model.Latest, through: model.Earliest}
+		offsets = make([]int, len(chunks))
+		bufs    = make([][]byte, len(chunks))
+	)
+	for i := range chunks {
+		encoded, err := chunks[i].encode()
+		if err != nil {
+			return err
+		}
+		fp := chunks[i].Metric.Fingerprint()
+		j, ok := series[fp]
+		if !ok {
+			j = len(index.Series)
+			series[fp] = j
+			index.Series = append(index.Series, blockSeries{Metric: chunks[i].Metric})
+		}
+		index.Series[j].Chunks = append(index.Series[j].Chunks, blockChunk{
+			Key:    chunks[i].externalKey(),
+			Offset: data.Len(),
+			Length: len(encoded),
+		})
+		offsets[i], bufs[i] = data.Len(), encoded
+		data.Write(encoded)
+		if chunks[i].From.Before(meta.from) {
+			meta.from = chunks[i].From
+		}
+		if chunks[i].Through.After(meta.through) {
+			meta.through = chunks[i].Through
+		}
+	}
+
+	buf, err := encodeBlock(index, data.Bytes())
+	if err != nil {
+		return err
+	}
+	// The ID includes the checksum, so retrying a Put overwrites the batch
+	// rather than duplicating it.
+	id := batchID(meta.from, meta.through, crc32.Checksum(buf, castagnoliTable))
+	dataStart := len(buf) - data.Len()
+	for i := range chunks {
+		chunks[i].batch = batchRef{id: id, offset: dataStart + offsets[i], length: len(bufs[i])}
+	}
+	// The batch isn't cached whole, only its chunks.
+	key := batchesPrefix + userID + "/" + id
+	if err := c.withRetries(ctx, key, func() error {
+		return c.storage.PutChunk(ctx, key, buf)
+	}); err != nil {
+		return err
+	}
+	batchesWritten.Inc()
+	chunksPerBatch.Observe(float64(len(chunks)))
+
+	for i := range chunks {
+		if err := c.cache.StoreChunk(ctx, chunks[i].externalKey(), bufs[i]); err != nil {
+			util.WithContext(ctx, log.Base()).Warnf("Could not store %v in chunk cache: %v", chunks[i].externalKey(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package chunk
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/common/user"
+)
+
+func newBatchTestStore(t *testing.T, schemaFactory func(SchemaConfig) Schema) (*MockStorage, *Store) {
+	storage, _ := newDeletesTestStore(t)
+	store, err := NewStore(StoreConfig{
+		schemaFactory:  schemaFactory,
+		DeleteRequests: DeleteRequestsConfig{TableName: deletesTable},
+		BatchChunks:    true,
+	}, storage)
+	require.NoError(t, err)
+	return storage, store
+}
+
+func listObjects(t *testing.T, storage StorageClient) []string {
+	var keys []string
+	require.NoError(t, storage.ListChunks(context.Background(), "", func(key string, _ time.Time) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	return keys
+}
+
+func TestBatchChunks(t *testing.T) {
+	for _, schema := range []struct {
+		name    string
+		factory func(SchemaConfig) Schema
+	}{
+		{"v6", v6Schema},
+		{"v7", v7Schema},
+		{"v8", v8Schema},
+	} {
+		t.Run(schema.name, func(t *testing.T) {
+			storage, store := newBatchTestStore(t, schema.factory)
+			ctx := user.Inject(context.Background(), "user1")
+
+			now := model.Now()
+			foo := chunkOf(t, "user1", now.Add(-2*time.Hour), now.Add(-time.Hour))
+			foo2 := chunkOf(t, "user1", now.Add(-time.Hour+time.Minute), now)
+			bar := foo
+			bar.Metric = model.Metric{model.MetricNameLabel: "foo", "bar": "qux"}
+			bar.Fingerprint = bar.Metric.Fingerprint()
+			require.NoError(t, store.Put(ctx, []Chunk{foo, foo2, bar}))
+
+			keys := listObjects(t, storage)
+			require.Len(t, keys, 1)
+			assert.True(t, strings.HasPrefix(keys[0], batchesPrefix+"user1/"), keys[0])
+
+			// Chunks are read from the batch, not the cache.
+			store.cache = NewCache(CacheConfig{})
+			chunks, err := store.Get(ctx, now.Add(-3*time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+			require.NoError(t, err)
+			require.Len(t, chunks, 3)
+			matrix, err := ChunksToMatrix(chunks)
+			require.NoError(t, err)
+			require.Len(t, matrix, 2)
+			for _, series := range matrix {
+				switch series.Metric["bar"] {
+				case "baz":
+					assert.Len(t, series.Values, 61+60)
+				case "qux":
+					assert.Len(t, series.Values, 61)
+				}
+			}
+			for _, c := range chunks {
+				assert.Equal(t, keys[0], c.objectKey())
+				parsed, err := ParseKey(c.externalKey())
+				require.NoError(t, err)
+				assert.Equal(t, c.externalKey(), parsed.externalKey())
+			}
+		})
+	}
+}
+
+func TestBatchChunksPurged(t *testing.T) {
+	storage, store := newBatchTestStore(t, v6Schema)
+	ctx := user.Inject(context.Background(), "user1")
+
+	now := time.Now()
+	through := model.TimeFromUnixNano(now.UnixNano())
+	baz := chunkOf(t, "user1", through.Add(-2*time.Hour), through.Add(-time.Hour))
+	qux := baz
+	qux.Metric = model.Metric{model.MetricNameLabel: "foo", "bar": "qux"}
+	qux.Fingerprint = qux.Metric.Fingerprint()
+	mtime.NowForce(now.Add(-48 * time.Hour))
+	require.NoError(t, store.Put(ctx, []Chunk{baz, qux}))
+	mtime.NowReset()
+	keys := listObjects(t, storage)
+	require.Len(t, keys, 1)
+
+	// The batch is kept while any of its chunks are indexed.
+	purger := NewPurger(PurgerConfig{ChunkCleanupGracePeriod: 24 * time.Hour}, TableManagerConfig{}, store, storage, fakeRetentionLimits{})
+	matchers := func(value model.LabelValue) []*metric.LabelMatcher {
+		return []*metric.LabelMatcher{
+			mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"),
+			mustNewLabelMatcher(metric.Equal, "bar", value),
+		}
+	}
+	require.NoError(t, store.DeleteSeries(ctx, through.Add(-3*time.Hour), through, matchers("baz")...))
+	require.NoError(t, purger.cleanupChunks(context.Background()))
+	assert.Equal(t, keys, listObjects(t, storage))
+	chunks, err := store.Get(ctx, through.Add(-3*time.Hour), through, matchers("qux")...)
+	require.NoError(t, err)
+	assert.Len(t, chunks, 1)
+
+	require.NoError(t, store.DeleteSeries(ctx, through.Add(-3*time.Hour), through, matchers("qux")...))
+	require.NoError(t, purger.cleanupChunks(context.Background()))
+	assert.Empty(t, listObjects(t, storage))
+}
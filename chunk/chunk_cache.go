@@ -7,8 +7,8 @@ import (
 
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 	"github.com/weaveworks/common/instrument"
+	"github.com/weaveworks/cortex/util/log"
 	"golang.org/x/net/context"
 )
 
@@ -4,16 +4,20 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/metric"
 	"golang.org/x/net/context"
 
 	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/usage"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 var (
@@ -44,6 +48,22 @@ type StoreConfig struct {
 	SchemaConfig
 	CacheConfig
 
+	LabelValuesCacheGracePeriod time.Duration
+	LabelValuesCacheSize        int
+	MaxLookBackPeriod           time.Duration
+	IndexSharding               IndexShardingConfig
+	Quarantine                  QuarantineConfig
+	DeleteRequests              DeleteRequestsConfig
+	BlocksStorage               bool
+	BlocksQueryConcurrency      int
+	BlocksListTTL               time.Duration
+	BatchChunks                 bool
+
+	// How many chunks are written to the object store at once per Put, and
+	// how many times each is retried.
+	PutChunksConcurrency int
+	PutChunkRetries      int
+
 	// For injecting different schemas in tests.
 	schemaFactory func(cfg SchemaConfig) Schema
 }
@@ -52,19 +72,44 @@ type StoreConfig struct {
 func (cfg *StoreConfig) RegisterFlags(f *flag.FlagSet) {
 	cfg.SchemaConfig.RegisterFlags(f)
 	cfg.CacheConfig.RegisterFlags(f)
+	cfg.IndexSharding.RegisterFlags(f)
+	cfg.Quarantine.RegisterFlags(f)
+	cfg.DeleteRequests.RegisterFlags(f)
+	f.DurationVar(&cfg.LabelValuesCacheGracePeriod, "store.label-values-cache-grace-period", 12*time.Hour, "How long after a table period ends before the label values in it are cached. Should be at least the ingesters' max chunk age.")
+	f.IntVar(&cfg.LabelValuesCacheSize, "store.label-values-cache-size", 100000, "Maximum number of sets of label values of a metric's label in a table period to cache. 0 for no limit.")
+	f.DurationVar(&cfg.MaxLookBackPeriod, "store.max-look-back-period", 0, "Queries only read data from within this long ago. Set to the table manager's -table-manager.retention-period, as older tables may have been deleted. 0 for no limit.")
+	f.IntVar(&cfg.PutChunksConcurrency, "store.put-chunks-concurrency", 16, "Maximum number of chunks written to the object store at once when storing a batch, e.g. on flush. 0 for no limit.")
+	f.IntVar(&cfg.PutChunkRetries, "store.put-chunk-retries", 2, "Number of times writing a chunk to the object store is retried, with backoff, before the batch fails.")
+	f.BoolVar(&cfg.BatchChunks, "store.batch-chunks", false, "Write the chunks of each batch stored, e.g. each user's chunks flushed together with -ingester.block-range, as one object with an index of their offsets, rather than an object per chunk. Chunks are still indexed one by one, and read with ranged GETs.")
+	f.BoolVar(&cfg.BlocksStorage, "store.blocks-storage", false, "Experimental: write each batch of chunks as a block with its own series index, rather than indexing every chunk, and query those blocks. Set -ingester.block-range so ingesters batch chunks by user. Blocks aren't queried for label values.")
+	f.IntVar(&cfg.BlocksQueryConcurrency, "store.blocks-query-concurrency", 16, "Maximum number of blocks fetched at once by a query, with -store.blocks-storage. 0 for no limit.")
+	f.DurationVar(&cfg.BlocksListTTL, "store.blocks-list-ttl", time.Minute, "How long each user's list of blocks is cached, with -store.blocks-storage. Blocks written by other processes aren't queried for up to this long, so keep it below the ingesters' -ingester.flushed-chunk-retention. 0 lists blocks for every query.")
 }
 
 // Store implements Store
 type Store struct {
 	cfg StoreConfig
 
-	storage StorageClient
-	cache   *Cache
-	schema  Schema
+	storage     StorageClient
+	cache       *Cache
+	schema      Schema
+	labelValues *labelValuesCache
+
+	// Only set if the index sharding report is enabled.
+	indexSharding *indexShardingReporter
+	// Only set if the quarantine is enabled.
+	quarantine *quarantine
+	deletes    *deleteRequests
+	// Only set with the blocks storage.
+	blocks *blockStore
 }
 
 // NewStore makes a new ChunkStore
 func NewStore(cfg StoreConfig, storage StorageClient) (*Store, error) {
+	if err := cfg.IndexSharding.Validate(); err != nil {
+		return nil, err
+	}
+
 	var schema Schema
 	var err error
 	if cfg.schemaFactory == nil {
@@ -76,17 +121,240 @@ func NewStore(cfg StoreConfig, storage StorageClient) (*Store, error) {
 		return nil, err
 	}
 
-	return &Store{
+	period := 24 * time.Hour
+	if cfg.UsePeriodicTables && cfg.TablePeriod > 0 {
+		period = cfg.TablePeriod
+	}
+
+	store := &Store{
 		cfg:     cfg,
 		storage: storage,
 		schema:  schema,
 		cache:   NewCache(cfg.CacheConfig),
-	}, nil
+		deletes: newDeleteRequests(cfg.DeleteRequests, storage),
+	}
+	store.labelValues = newLabelValuesCache(period, cfg.LabelValuesCacheGracePeriod, cfg.LabelValuesCacheSize, store.readLabelValues)
+	if cfg.IndexSharding.SampleRate > 0 {
+		store.indexSharding, err = newIndexShardingReporter(cfg.IndexSharding)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Quarantine.Store != "" {
+		store.quarantine, err = newQuarantine(cfg.Quarantine)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.BlocksStorage {
+		store.blocks = newBlockStore(storage, store.quarantine, cfg.BlocksQueryConcurrency, cfg.BlocksListTTL)
+	}
+	return store, nil
 }
 
 // Stop any background goroutines (ie in the cache.)
 func (c *Store) Stop() {
 	c.cache.Stop()
+	if c.indexSharding != nil {
+		c.indexSharding.stop()
+	}
+	if c.quarantine != nil {
+		c.quarantine.stop()
+	}
+}
+
+// CheckReady returns an error if the index can't be read.  It looks up a
+// metric no user has in the current index table, so it's one cheap read.
+func (c *Store) CheckReady(ctx context.Context) error {
+	now := model.Now()
+	entries, err := c.schema.GetReadEntriesForMetric(now, now, "cortex-readiness", "cortex_readiness")
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := c.storage.QueryPages(ctx, entries[0], func(ReadBatch, bool) bool { return false }); err != nil {
+		return fmt.Errorf("error reading the index: %v", err)
+	}
+	return nil
+}
+
+// IndexShardingReport serves the index sharding report as JSON.
+func (c *Store) IndexShardingReport(w http.ResponseWriter, r *http.Request) {
+	if c.indexSharding == nil {
+		http.Error(w, "index sharding report is disabled", http.StatusNotFound)
+		return
+	}
+	c.indexSharding.ServeHTTP(w, r)
+}
+
+// Quarantine serves the quarantine list as JSON, and adds or removes entries
+// from it.
+func (c *Store) Quarantine(w http.ResponseWriter, r *http.Request) {
+	if c.quarantine == nil {
+		http.Error(w, "quarantine is disabled", http.StatusNotFound)
+		return
+	}
+	c.quarantine.ServeHTTP(w, r)
+}
+
+// AddDeleteRequest records a request to delete the samples of the series
+// matching the selectors between start and end.  Until the purger deletes
+// them from the store, they're filtered from query results.
+func (c *Store) AddDeleteRequest(ctx context.Context, start, end model.Time, selectors []string) (DeleteRequest, error) {
+	return c.deletes.add(ctx, start, end, selectors)
+}
+
+// DeleteRequests returns the delete requests of the user in ctx.
+func (c *Store) DeleteRequests(ctx context.Context) ([]DeleteRequest, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.deletes.forUser(ctx, userID)
+}
+
+// GetDeleteRequest returns the delete request of the user in ctx with the
+// given ID, bypassing the cache.
+func (c *Store) GetDeleteRequest(ctx context.Context, requestID string) (DeleteRequest, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return DeleteRequest{}, err
+	}
+	return c.deletes.get(ctx, userID, requestID)
+}
+
+// CancelDeleteRequest cancels the delete request of the user in ctx with the
+// given ID, if it's still within its cancellation period.
+func (c *Store) CancelDeleteRequest(ctx context.Context, requestID string) error {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return err
+	}
+	return c.deletes.cancel(ctx, userID, requestID)
+}
+
+// DeleteSeries deletes the samples of the series matching the matchers
+// between from and through, inclusive.  Chunks wholly within the range are
+// deleted, and chunks partly within it are replaced by chunks of the
+// samples outside it.  The chunks are found through the index, without the
+// look-back period or the per-query limits, and only those partly within the
+// range are fetched, or one of each series for its labels if there are none.
+func (c *Store) DeleteSeries(ctx context.Context, from, through model.Time, allMatchers ...*metric.LabelMatcher) error {
+	if c.blocks != nil {
+		return c.blocks.DeleteSeries(ctx, from, through, allMatchers...)
+	}
+	if through < from {
+		return fmt.Errorf("invalid delete, through < from (%d < %d)", through, from)
+	}
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Matchers of the empty string match chunks without the label, so can
+	// only be checked against the series' labels, once they're fetched.
+	filters, matchers := util.SplitFiltersAndMatchers(allMatchers)
+	chunks, err := c.lookupMatchers(ctx, from, through, matchers)
+	if err != nil {
+		return err
+	}
+	series := map[model.Fingerprint][]Chunk{}
+	for _, chunk := range chunks {
+		if chunk.Through < from || through < chunk.From {
+			continue
+		}
+		series[chunk.Fingerprint] = append(series[chunk.Fingerprint], chunk)
+	}
+	for _, chunks := range series {
+		if err := c.deleteSeriesChunks(ctx, userID, from, through, filters, chunks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSeriesChunks deletes the samples between from and through of one
+// series' chunks, if its labels match the filters.
+func (c *Store) deleteSeriesChunks(ctx context.Context, userID string, from, through model.Time, filters []*metric.LabelMatcher, chunks []Chunk) error {
+	var partial, whole []Chunk
+	for _, chunk := range chunks {
+		if chunk.From.Before(from) || chunk.Through.After(through) {
+			partial = append(partial, chunk)
+		} else {
+			whole = append(whole, chunk)
+		}
+	}
+	// The index entries to delete are made from the series' labels, which
+	// are in the chunks' data, unless they're legacy chunks with it in the index.
+	if len(partial) == 0 && whole[0].Metric == nil {
+		partial, whole = whole[:1], whole[1:]
+	}
+	fetched, err := c.fetchChunks(ctx, partial)
+	if err != nil {
+		return err
+	}
+
+	var labels model.Metric
+	if len(fetched) > 0 {
+		labels = fetched[0].Metric
+	} else {
+		labels = whole[0].Metric
+	}
+	for _, filter := range filters {
+		if !filter.Match(labels[filter.Name]) {
+			return nil
+		}
+	}
+
+	for _, chunk := range fetched {
+		if chunk.From.Before(from) || chunk.Through.After(through) {
+			replacements, err := chunk.without(from, through)
+			if err != nil {
+				return err
+			}
+			if err := c.Put(ctx, replacements); err != nil {
+				return err
+			}
+		}
+		if err := c.deleteChunk(ctx, userID, chunk); err != nil {
+			return err
+		}
+	}
+	for _, chunk := range whole {
+		chunk.Metric = labels
+		if err := c.deleteChunk(ctx, userID, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteChunk deletes the chunk's index entries, and then the chunk, so no
+// index entry is left pointing at a deleted chunk.
+func (c *Store) deleteChunk(ctx context.Context, userID string, chunk Chunk) error {
+	metricName, err := util.ExtractMetricNameFromMetric(chunk.Metric)
+	if err != nil {
+		return err
+	}
+	entries, err := c.schema.GetWriteEntries(chunk.From, chunk.Through, userID, metricName, chunk.Metric, chunk.externalKey())
+	if err != nil {
+		return err
+	}
+	batch := c.storage.NewWriteBatch()
+	for _, entry := range entries {
+		batch.Delete(entry.TableName, entry.HashValue, entry.RangeValue)
+	}
+	if err := c.storage.BatchWrite(ctx, batch); err != nil {
+		return err
+	}
+	// A batch's object may hold other chunks; the purger deletes it once
+	// none of them are indexed.
+	if chunk.batch.id != "" {
+		return nil
+	}
+	return c.storage.DeleteChunk(ctx, chunk.externalKey())
 }
 
 // Put implements ChunkStore
@@ -95,6 +363,24 @@ func (c *Store) Put(ctx context.Context, chunks []Chunk) error {
 	if err != nil {
 		return err
 	}
+	if c.blocks != nil {
+		if err := c.blocks.Put(ctx, chunks); err != nil {
+			return err
+		}
+		usage.Add(userID, usage.ChunksStored, float64(len(chunks)))
+		return nil
+	}
+
+	if c.cfg.BatchChunks && len(chunks) > 1 {
+		if err := c.putBatch(ctx, userID, chunks); err != nil {
+			return err
+		}
+		if err := c.updateIndex(ctx, userID, chunks); err != nil {
+			return err
+		}
+		usage.Add(userID, usage.ChunksStored, float64(len(chunks)))
+		return nil
+	}
 
 	// Encode the chunk first - checksum is calculated as a side effect.
 	bufs := [][]byte{}
@@ -113,26 +399,95 @@ func (c *Store) Put(ctx context.Context, chunks []Chunk) error {
 		return err
 	}
 
-	return c.updateIndex(ctx, userID, chunks)
+	if err := c.updateIndex(ctx, userID, chunks); err != nil {
+		return err
+	}
+	usage.Add(userID, usage.ChunksStored, float64(len(chunks)))
+	return nil
 }
 
-// putChunks writes a collection of chunks to S3 in parallel.
+// PutChunksError is returned when some chunks of a batch couldn't be
+// written, with the last error writing each, by key.
+type PutChunksError map[string]error
+
+func (e PutChunksError) Error() string {
+	keys := make([]string, 0, len(e))
+	for key := range e {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	failed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		failed = append(failed, fmt.Sprintf("%s: %v", key, e[key]))
+	}
+	return fmt.Sprintf("failed to put %d chunks: %s", len(e), strings.Join(failed, "; "))
+}
+
+// putChunks writes a collection of chunks to S3 in parallel, at most
+// PutChunksConcurrency at once.
 func (c *Store) putChunks(ctx context.Context, keys []string, bufs [][]byte) error {
-	incomingErrors := make(chan error)
-	for i := range bufs {
-		go func(i int) {
-			incomingErrors <- c.putChunk(ctx, keys[i], bufs[i])
-		}(i)
+	workers := c.cfg.PutChunksConcurrency
+	if workers <= 0 || workers > len(keys) {
+		workers = len(keys)
 	}
 
-	var lastErr error
+	type result struct {
+		key string
+		err error
+	}
+	indexes := make(chan int)
+	results := make(chan result)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range indexes {
+				results <- result{keys[i], c.putChunkWithRetries(ctx, keys[i], bufs[i])}
+			}
+		}()
+	}
+	go func() {
+		for i := range keys {
+			indexes <- i
+		}
+		close(indexes)
+	}()
+
+	failed := PutChunksError{}
 	for range keys {
-		err := <-incomingErrors
-		if err != nil {
-			lastErr = err
+		if r := <-results; r.err != nil {
+			failed[r.key] = r.err
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// putChunkWithRetries puts a chunk, retrying with backoff up to
+// PutChunkRetries times.
+func (c *Store) putChunkWithRetries(ctx context.Context, key string, buf []byte) error {
+	return c.withRetries(ctx, key, func() error {
+		return c.putChunk(ctx, key, buf)
+	})
+}
+
+// withRetries calls put until it succeeds, retrying with backoff up to
+// PutChunkRetries times.
+func (c *Store) withRetries(ctx context.Context, key string, put func() error) error {
+	backoff := minBackoff
+	for retries := 0; ; retries++ {
+		err := put()
+		if err == nil || retries >= c.cfg.PutChunkRetries || ctx.Err() != nil {
+			return err
+		}
+		util.WithContext(ctx, log.Base()).Warnf("Error putting chunk %v, retrying: %v", key, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
 		}
+		backoff = nextBackoff(backoff)
 	}
-	return lastErr
 }
 
 // putChunk puts a chunk into S3.
@@ -143,7 +498,7 @@ func (c *Store) putChunk(ctx context.Context, key string, buf []byte) error {
 	}
 
 	if err := c.cache.StoreChunk(ctx, key, buf); err != nil {
-		log.Warnf("Could not store %v in chunk cache: %v", key, err)
+		util.WithContext(ctx, log.Base()).Warnf("Could not store %v in chunk cache: %v", key, err)
 	}
 	return nil
 }
@@ -175,6 +530,9 @@ func (c *Store) calculateDynamoWrites(userID string, chunks []Chunk) (WriteBatch
 
 		for _, entry := range entries {
 			rowWrites.Observe(entry.HashValue, 1)
+			if c.indexSharding != nil {
+				c.indexSharding.observeWrite(userID, entry.TableName, entry.HashValue, len(entry.HashValue)+len(entry.RangeValue)+len(entry.Value))
+			}
 			writeReqs.Add(entry.TableName, entry.HashValue, entry.RangeValue, entry.Value)
 		}
 	}
@@ -186,6 +544,13 @@ func (c *Store) Get(ctx context.Context, from, through model.Time, allMatchers .
 	if through < from {
 		return nil, fmt.Errorf("invalid query, through < from (%d < %d)", through, from)
 	}
+	from, ok := c.clampToLookBack(from, through)
+	if !ok {
+		return nil, nil
+	}
+	if c.blocks != nil {
+		return c.blocks.Get(ctx, from, through, allMatchers...)
+	}
 
 	filters, matchers := util.SplitFiltersAndMatchers(allMatchers)
 
@@ -206,25 +571,29 @@ func (c *Store) Get(ctx context.Context, from, through model.Time, allMatchers .
 		}
 		filtered = append(filtered, chunk)
 	}
-
-	// Now fetch the actual chunk data from Memcache / S3
-	fromCache, missing, err := c.cache.FetchChunkData(ctx, filtered)
-	if err != nil {
-		log.Warnf("Error fetching from cache: %v", err)
+	if c.quarantine != nil {
+		filtered = c.quarantine.filterChunks(filtered)
 	}
 
-	fromS3, err := c.fetchChunkData(ctx, missing)
-	if err != nil {
+	// Chunk IDs include their series' fingerprints, so the query's series
+	// can be limited before fetching any chunks.
+	if err := util.CheckSeriesLimit(ctx, countSeries(filtered)); err != nil {
+		return nil, err
+	}
+	// Chunks found in the cache count towards the limit too, so whether a
+	// query is allowed doesn't depend on what happens to be cached.
+	if err := util.CheckChunkLimit(ctx, len(filtered)); err != nil {
 		return nil, err
 	}
 
-	if err = c.writeBackCache(ctx, fromS3); err != nil {
-		log.Warnf("Could not store chunks in chunk cache: %v", err)
+	// Now fetch the actual chunk data from Memcache / S3
+	allChunks, err := c.fetchChunks(ctx, filtered)
+	if err != nil {
+		return nil, err
 	}
 
 	// TODO instead of doing this sort, propagate an index and assign chunks
 	// into the result based on that index.
-	allChunks := append(fromCache, fromS3...)
 	sort.Sort(ByKey(allChunks))
 
 	// Filter out chunks
@@ -243,6 +612,119 @@ outer:
 	return filteredChunks, nil
 }
 
+// countSeries returns the number of series the chunks are of.
+func countSeries(chunks []Chunk) int {
+	series := map[model.Fingerprint]struct{}{}
+	for _, chunk := range chunks {
+		series[chunk.Fingerprint] = struct{}{}
+	}
+	return len(series)
+}
+
+// clampToLookBack moves from forward to the start of the max look-back
+// period, and returns false if the whole range is before it.
+func (c *Store) clampToLookBack(from, through model.Time) (model.Time, bool) {
+	if c.cfg.MaxLookBackPeriod <= 0 {
+		return from, true
+	}
+	if cutoff := model.Now().Add(-c.cfg.MaxLookBackPeriod); from.Before(cutoff) {
+		from = cutoff
+	}
+	return from, !through.Before(from)
+}
+
+// IndexLookups returns the number of index queries Get would make for the
+// given matchers, without making them.
+func (c *Store) IndexLookups(ctx context.Context, from, through model.Time, allMatchers ...*metric.LabelMatcher) (int, error) {
+	from, ok := c.clampToLookBack(from, through)
+	if !ok {
+		return 0, nil
+	}
+	_, matchers := util.SplitFiltersAndMatchers(allMatchers)
+	metricName, matchers, err := util.ExtractMetricNameFromMatchers(matchers)
+	if err != nil {
+		return 0, err
+	}
+
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(matchers) == 0 {
+		entries, err := c.schema.GetReadEntriesForMetric(from, through, userID, metricName)
+		return len(entries), err
+	}
+
+	lookups := 0
+	for _, matcher := range matchers {
+		var entries []IndexEntry
+		if matcher.Type != metric.Equal {
+			entries, err = c.schema.GetReadEntriesForMetricLabel(from, through, userID, metricName, matcher.Name)
+		} else {
+			entries, err = c.schema.GetReadEntriesForMetricLabelValue(from, through, userID, metricName, matcher.Name, matcher.Value)
+		}
+		if err != nil {
+			return 0, err
+		}
+		lookups += len(entries)
+	}
+	return lookups, nil
+}
+
+// LabelValuesForMetricName returns the values of labelName for series of the
+// metric which had chunks between from and through.  Values are read for
+// whole table periods, so may include values from series up to a period
+// either side of the range.
+func (c *Store) LabelValuesForMetricName(ctx context.Context, from, through model.Time, metricName model.LabelValue, labelName model.LabelName) (model.LabelValues, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	from, ok := c.clampToLookBack(from, through)
+	if !ok {
+		return nil, nil
+	}
+	return c.labelValues.get(ctx, from, through, userID, metricName, labelName)
+}
+
+func (c *Store) readLabelValues(ctx context.Context, from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName) (model.LabelValues, error) {
+	entries, err := c.schema.GetReadEntriesForMetricLabel(from, through, userID, metricName, labelName)
+	if err != nil {
+		return nil, err
+	}
+	if c.quarantine != nil {
+		entries = c.quarantine.filterEntries(entries)
+	}
+
+	var values model.LabelValues
+	for _, entry := range entries {
+		var processingError error
+		if err := c.storage.QueryPages(ctx, entry, func(resp ReadBatch, lastPage bool) (shouldContinue bool) {
+			for i := 0; i < resp.Len(); i++ {
+				_, labelValue, _, err := parseRangeValue(entry.HashValue, resp.RangeValue(i), resp.Value(i))
+				if err != nil {
+					processingError = err
+					return false
+				}
+				// Some schemas write range keys without the label value,
+				// alongside ones with it.
+				if labelValue != "" {
+					values = append(values, labelValue)
+				}
+			}
+			return !lastPage
+		}); err != nil {
+			util.WithContext(ctx, log.Base()).Errorf("Error querying storage: %v", err)
+			return nil, err
+		} else if processingError != nil {
+			util.WithContext(ctx, log.Base()).Errorf("Error processing storage response: %v", processingError)
+			return nil, processingError
+		}
+	}
+	return uniqueLabelValues(values), nil
+}
+
 func (c *Store) lookupMatchers(ctx context.Context, from, through model.Time, matchers []*metric.LabelMatcher) ([]Chunk, error) {
 	metricName, matchers, err := util.ExtractMetricNameFromMatchers(matchers)
 	if err != nil {
@@ -301,6 +783,10 @@ func (c *Store) lookupMatchers(ctx context.Context, from, through model.Time, ma
 }
 
 func (c *Store) lookupEntries(ctx context.Context, entries []IndexEntry, matcher *metric.LabelMatcher) (ByKey, error) {
+	if c.quarantine != nil {
+		entries = c.quarantine.filterEntries(entries)
+	}
+
 	incomingChunkSets := make(chan ByKey)
 	incomingErrors := make(chan error)
 	for _, entry := range entries {
@@ -332,13 +818,16 @@ func (c *Store) lookupEntry(ctx context.Context, entry IndexEntry, matcher *metr
 	var chunkSet ByKey
 	var processingError error
 	if err := c.storage.QueryPages(ctx, entry, func(resp ReadBatch, lastPage bool) (shouldContinue bool) {
-		processingError = processResponse(ctx, resp, &chunkSet, matcher)
+		if c.indexSharding != nil {
+			c.observeRead(ctx, entry, resp)
+		}
+		processingError = processResponse(ctx, entry.HashValue, resp, &chunkSet, matcher)
 		return processingError == nil && !lastPage
 	}); err != nil {
-		log.Errorf("Error querying storage: %v", err)
+		util.WithContext(ctx, log.Base()).Errorf("Error querying storage: %v", err)
 		return nil, err
 	} else if processingError != nil {
-		log.Errorf("Error processing storage response: %v", processingError)
+		util.WithContext(ctx, log.Base()).Errorf("Error processing storage response: %v", processingError)
 		return nil, processingError
 	}
 	sort.Sort(ByKey(chunkSet))
@@ -346,14 +835,27 @@ func (c *Store) lookupEntry(ctx context.Context, entry IndexEntry, matcher *metr
 	return chunkSet, nil
 }
 
-func processResponse(ctx context.Context, resp ReadBatch, chunkSet *ByKey, matcher *metric.LabelMatcher) error {
+// observeRead samples a page of query results for the index sharding report.
+func (c *Store) observeRead(ctx context.Context, entry IndexEntry, resp ReadBatch) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return
+	}
+	size := 0
+	for i := 0; i < resp.Len(); i++ {
+		size += len(entry.HashValue) + len(resp.RangeValue(i)) + len(resp.Value(i))
+	}
+	c.indexSharding.observeRead(userID, entry.TableName, entry.HashValue, size)
+}
+
+func processResponse(ctx context.Context, hashValue string, resp ReadBatch, chunkSet *ByKey, matcher *metric.LabelMatcher) error {
 	userID, err := user.Extract(ctx)
 	if err != nil {
 		return err
 	}
 
 	for i := 0; i < resp.Len(); i++ {
-		chunkKey, labelValue, metadataInIndex, err := parseRangeValue(resp.RangeValue(i), resp.Value(i))
+		chunkKey, labelValue, metadataInIndex, err := parseRangeValue(hashValue, resp.RangeValue(i), resp.Value(i))
 		if err != nil {
 			return err
 		}
@@ -373,7 +875,7 @@ func processResponse(ctx context.Context, resp ReadBatch, chunkSet *ByKey, match
 		}
 
 		if matcher != nil && !matcher.Match(labelValue) {
-			log.Debug("Dropping chunk for non-matching metric ", chunk.Metric)
+			util.WithContext(ctx, log.Base()).Debug("Dropping chunk for non-matching metric ", chunk.Metric)
 			continue
 		}
 		*chunkSet = append(*chunkSet, chunk)
@@ -381,12 +883,31 @@ func processResponse(ctx context.Context, resp ReadBatch, chunkSet *ByKey, match
 	return nil
 }
 
+// fetchChunks fetches the chunks' data from the cache, or the object store
+// if they're not cached.
+func (c *Store) fetchChunks(ctx context.Context, chunks []Chunk) ([]Chunk, error) {
+	fromCache, missing, err := c.cache.FetchChunkData(ctx, chunks)
+	if err != nil {
+		util.WithContext(ctx, log.Base()).Warnf("Error fetching from cache: %v", err)
+	}
+
+	fromS3, err := c.fetchChunkData(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.writeBackCache(ctx, fromS3); err != nil {
+		util.WithContext(ctx, log.Base()).Warnf("Could not store chunks in chunk cache: %v", err)
+	}
+	return append(fromCache, fromS3...), nil
+}
+
 func (c *Store) fetchChunkData(ctx context.Context, chunkSet []Chunk) ([]Chunk, error) {
 	incomingChunks := make(chan Chunk)
 	incomingErrors := make(chan error)
 	for _, chunk := range chunkSet {
 		go func(chunk Chunk) {
-			buf, err := c.storage.GetChunk(ctx, chunk.externalKey())
+			buf, err := getChunk(ctx, c.storage, chunk)
 			if err != nil {
 				incomingErrors <- err
 				return
@@ -4,10 +4,10 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/local/chunk"
 	"github.com/prometheus/prometheus/storage/metric"
@@ -17,6 +17,8 @@ import (
 
 	"github.com/weaveworks/common/test"
 	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 // newTestStore creates a new Store for testing.
@@ -56,6 +58,8 @@ func TestChunkStore(t *testing.T) {
 		{"v4 schema", v4Schema},
 		{"v5 schema", v5Schema},
 		{"v6 schema", v6Schema},
+		{"v7 schema", v7Schema},
+		{"v8 schema", v8Schema},
 	}
 
 	nameMatcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
@@ -124,10 +128,11 @@ func TestChunkStore(t *testing.T) {
 				chunks, err := store.Get(ctx, now.Add(-time.Hour), now, tc.matchers...)
 				require.NoError(t, err)
 
-				// Zero out the checksums, as the inputs above didn't have the checksums calculated
+				// Zero out the checksums and sizes, as the inputs above didn't have them calculated
 				for i := range chunks {
 					chunks[i].Checksum = 0
 					chunks[i].ChecksumSet = false
+					chunks[i].EncodedSize = 0
 				}
 
 				if !reflect.DeepEqual(tc.expect, chunks) {
@@ -159,6 +164,8 @@ func TestChunkStoreRandom(t *testing.T) {
 		{name: "v4 schema", fn: v4Schema},
 		{name: "v5 schema", fn: v5Schema},
 		{name: "v6 schema", fn: v6Schema},
+		{name: "v7 schema", fn: v7Schema},
+		{name: "v8 schema", fn: v8Schema},
 	}
 
 	for i := range schemas {
@@ -287,3 +294,192 @@ func TestChunkStoreLeastRead(t *testing.T) {
 		assert.Equal(t, int(numChunks), len(chunks))
 	}
 }
+
+func TestChunkStoreMaxLookBack(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	store := newTestChunkStore(t, StoreConfig{
+		schemaFactory:     v6Schema,
+		MaxLookBackPeriod: 24 * time.Hour,
+	})
+
+	now := model.Now()
+	m := model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}
+	var chunks []Chunk
+	for _, from := range []model.Time{now.Add(-48 * time.Hour), now.Add(-time.Hour)} {
+		cs, err := chunk.New().Add(model.SamplePair{Timestamp: from, Value: 1})
+		require.NoError(t, err)
+		chunks = append(chunks, NewChunk(userID, model.Fingerprint(1), m, cs[0], from, from.Add(time.Minute)))
+	}
+	require.NoError(t, store.Put(ctx, chunks))
+
+	name := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	got, err := store.Get(ctx, now.Add(-72*time.Hour), now, name)
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, chunks[1].From, got[0].From)
+
+	// Queries wholly before the look-back period read nothing.
+	got, err = store.Get(ctx, now.Add(-72*time.Hour), now.Add(-25*time.Hour), name)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+	lookups, err := store.IndexLookups(ctx, now.Add(-72*time.Hour), now.Add(-25*time.Hour), name)
+	require.NoError(t, err)
+	assert.Equal(t, 0, lookups)
+}
+
+func TestChunkStoreIndexLookups(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	store := newTestChunkStore(t, StoreConfig{
+		schemaFactory: v6Schema,
+	})
+
+	day := model.TimeFromUnix(24 * 60 * 60)
+	lookups := func(through model.Time, matchers ...*metric.LabelMatcher) int {
+		n, err := store.IndexLookups(ctx, 0, through-1, matchers...)
+		require.NoError(t, err)
+		return n
+	}
+
+	name := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	oneDay := lookups(day, name)
+	assert.True(t, oneDay > 0)
+	assert.Equal(t, 3*oneDay, lookups(3*day, name))
+
+	// Each matcher is looked up separately, but filters aren't looked up.
+	matchers := []*metric.LabelMatcher{
+		name,
+		mustNewLabelMatcher(metric.Equal, "bar", "baz"),
+		mustNewLabelMatcher(metric.RegexMatch, "toms", "c.*"),
+		mustNewLabelMatcher(metric.NotEqual, "toms", "code"),
+	}
+	assert.Equal(t, 3*2*oneDay, lookups(3*day, matchers...))
+}
+
+func TestChunkStoreLabelValues(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	now := model.Now()
+	chunks := []Chunk{
+		dummyChunkFor(model.Metric{model.MetricNameLabel: "foo", "bar": "baz", "toms": "code"}),
+		dummyChunkFor(model.Metric{model.MetricNameLabel: "foo", "bar": "beep"}),
+		dummyChunkFor(model.Metric{model.MetricNameLabel: "foo", "bar": "baz", "flip": "flop"}),
+		dummyChunkFor(model.Metric{model.MetricNameLabel: "other", "bar": "bop"}),
+	}
+
+	for _, schema := range []func(cfg SchemaConfig) Schema{v5Schema, v6Schema, v7Schema, v8Schema} {
+		store := newTestChunkStore(t, StoreConfig{
+			schemaFactory: schema,
+		})
+		require.NoError(t, store.Put(ctx, chunks))
+
+		values, err := store.LabelValuesForMetricName(ctx, now.Add(-time.Hour), now, "foo", "bar")
+		require.NoError(t, err)
+		assert.Equal(t, model.LabelValues{"baz", "beep"}, values)
+
+		values, err = store.LabelValuesForMetricName(ctx, now.Add(-time.Hour), now, "foo", "toms")
+		require.NoError(t, err)
+		assert.Equal(t, model.LabelValues{"code"}, values)
+	}
+}
+
+// flakyStorage fails writing chunks a number of times per key, and records
+// how many chunks are written at once.
+type flakyStorage struct {
+	StorageClient
+
+	mtx         sync.Mutex
+	failures    map[string]int
+	inFlight    int
+	maxInFlight int
+}
+
+func (s *flakyStorage) PutChunk(ctx context.Context, key string, buf []byte) error {
+	s.mtx.Lock()
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	fail := s.failures[key] > 0
+	if fail {
+		s.failures[key]--
+	}
+	s.mtx.Unlock()
+
+	time.Sleep(time.Millisecond)
+	s.mtx.Lock()
+	s.inFlight--
+	s.mtx.Unlock()
+	if fail {
+		return fmt.Errorf("failed to put %s", key)
+	}
+	return s.StorageClient.PutChunk(ctx, key, buf)
+}
+
+func TestChunkStorePutChunks(t *testing.T) {
+	storage := &flakyStorage{
+		StorageClient: NewMockStorage(),
+		failures:      map[string]int{"b": 1, "c": 2},
+	}
+	store, err := NewStore(StoreConfig{PutChunksConcurrency: 2, PutChunkRetries: 1}, storage)
+	require.NoError(t, err)
+
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	bufs := make([][]byte, len(keys))
+	for i := range keys {
+		bufs[i] = []byte(keys[i])
+	}
+	err = store.putChunks(context.Background(), keys, bufs)
+
+	// b succeeds on its retry, but c fails twice.
+	require.IsType(t, PutChunksError{}, err)
+	assert.Len(t, err, 1)
+	assert.Contains(t, err, "c")
+	assert.Contains(t, err.Error(), "c: failed to put c")
+	assert.True(t, storage.maxInFlight <= 2, "%d chunks put at once", storage.maxInFlight)
+	for _, key := range []string{"a", "b", "d", "e", "f"} {
+		buf, err := storage.GetChunk(context.Background(), key)
+		require.NoError(t, err)
+		assert.Equal(t, []byte(key), buf)
+	}
+}
+
+func TestChunkStoreSeriesLimit(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	now := model.Now()
+	chunks := []Chunk{
+		dummyChunkFor(model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}),
+		dummyChunkFor(model.Metric{model.MetricNameLabel: "foo", "bar": "beep"}),
+		dummyChunkFor(model.Metric{model.MetricNameLabel: "foo", "bar": "bop"}),
+	}
+	store := newTestChunkStore(t, StoreConfig{schemaFactory: v6Schema})
+	require.NoError(t, store.Put(ctx, chunks))
+
+	nameMatcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	have, err := store.Get(util.WithSeriesLimit(ctx, 3), now.Add(-time.Hour), now, nameMatcher)
+	require.NoError(t, err)
+	assert.Len(t, have, 3)
+
+	_, err = store.Get(util.WithSeriesLimit(ctx, 2), now.Add(-time.Hour), now, nameMatcher)
+	assert.Equal(t, util.SeriesLimitError{Limit: 2}, err)
+}
+
+func TestChunkStoreChunkLimit(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	now := model.Now()
+	series := model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}
+	chunks := []Chunk{}
+	for i := 0; i < 3; i++ {
+		from := now.Add(-time.Duration(i+1) * time.Minute)
+		cs, _ := chunk.New().Add(model.SamplePair{Timestamp: from, Value: 0})
+		chunks = append(chunks, NewChunk(userID, series.Fingerprint(), series, cs[0], from, from.Add(time.Minute)))
+	}
+	store := newTestChunkStore(t, StoreConfig{schemaFactory: v6Schema})
+	require.NoError(t, store.Put(ctx, chunks))
+
+	nameMatcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	have, err := store.Get(util.WithChunkLimit(ctx, 3), now.Add(-time.Hour), now, nameMatcher)
+	require.NoError(t, err)
+	assert.Len(t, have, 3)
+
+	_, err = store.Get(util.WithChunkLimit(ctx, 2), now.Add(-time.Hour), now, nameMatcher)
+	assert.Equal(t, util.ChunkLimitError{Chunks: 3, Limit: 2}, err)
+}
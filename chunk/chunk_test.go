@@ -92,6 +92,40 @@ func TestChunkCodec(t *testing.T) {
 	}
 }
 
+func TestChunkEncodeReusesBuffers(t *testing.T) {
+	// Encoding reuses pooled buffers, which mustn't be shared with the
+	// returned bytes.
+	first := dummyChunkFor(model.Metric{model.MetricNameLabel: "foo"})
+	buf, err := first.encode()
+	require.NoError(t, err)
+	expected := append([]byte(nil), buf...)
+
+	second := dummyChunkFor(model.Metric{model.MetricNameLabel: "bar"})
+	_, err = second.encode()
+	require.NoError(t, err)
+	require.Equal(t, expected, buf)
+
+	have, err := parseExternalKey(userID, first.externalKey())
+	require.NoError(t, err)
+	require.NoError(t, have.decode(buf))
+	require.Equal(t, first, have)
+}
+
+func BenchmarkChunkEncodeDecode(b *testing.B) {
+	c := dummyChunk()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf, err := c.encode()
+		if err != nil {
+			b.Fatal(err)
+		}
+		var have Chunk
+		if err := have.decode(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestParseExternalKey(t *testing.T) {
 	for _, c := range []struct {
 		key   string
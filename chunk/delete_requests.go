@@ -0,0 +1,376 @@
+package chunk
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+// Statuses of a delete request.
+const (
+	// DeleteRequestReceived requests have been recorded, and their samples
+	// are filtered from query results.  They can be cancelled until their
+	// cancellation period is over.
+	DeleteRequestReceived = "received"
+	// DeleteRequestProcessing requests are having their samples purged from
+	// the store.
+	DeleteRequestProcessing = "processing"
+	// DeleteRequestProcessed requests have had their samples purged from
+	// the store.
+	DeleteRequestProcessed = "processed"
+	// DeleteRequestCancelled requests were cancelled before being processed,
+	// and their samples are no longer filtered.
+	DeleteRequestCancelled = "cancelled"
+)
+
+var (
+	// ErrDeletesDisabled is returned when recording a delete request without
+	// a table configured to hold them.
+	ErrDeletesDisabled = fmt.Errorf("series deletion is disabled")
+	// ErrDeleteRequestNotFound is returned for unknown delete request IDs.
+	ErrDeleteRequestNotFound = fmt.Errorf("delete request not found")
+	// ErrDeleteRequestNotCancellable is returned when cancelling a delete
+	// request which is being or has been processed, or whose cancellation
+	// period is over.
+	ErrDeleteRequestNotCancellable = fmt.Errorf("delete request can no longer be cancelled")
+)
+
+// DeleteRequestsConfig configures where delete requests are recorded.
+type DeleteRequestsConfig struct {
+	TableName    string
+	CacheTTL     time.Duration
+	CancelPeriod time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *DeleteRequestsConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.TableName, "deletes.table-name", "", "Name of the DynamoDB table recording series delete requests. Empty disables series deletion.")
+	f.DurationVar(&cfg.CacheTTL, "deletes.cache-ttl", time.Minute, "How long queriers cache each user's delete requests for.")
+	f.DurationVar(&cfg.CancelPeriod, "deletes.cancel-period", 24*time.Hour, "How long delete requests can be cancelled for after being made.  They aren't processed until it's over.")
+}
+
+// DeleteRequest deletes the samples of the series matching any of its
+// selectors, between its start and end times inclusive.
+type DeleteRequest struct {
+	RequestID string     `json:"request_id"`
+	UserID    string     `json:"user_id"`
+	StartTime model.Time `json:"start_time"`
+	EndTime   model.Time `json:"end_time"`
+	Selectors []string   `json:"selectors"`
+	Status    string     `json:"status"`
+	CreatedAt model.Time `json:"created_at"`
+	// CancellableUntil is when the request's cancellation period ends.
+	CancellableUntil model.Time `json:"cancellable_until"`
+
+	matchers []metric.LabelMatchers
+}
+
+// ParseDeleteSelectors parses the selectors of a delete request.  As the
+// store looks up series by name, each must select a metric name.
+func ParseDeleteSelectors(selectors []string) ([]metric.LabelMatchers, error) {
+	result := make([]metric.LabelMatchers, 0, len(selectors))
+	for _, selector := range selectors {
+		matchers, err := promql.ParseMetricSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+		if _, _, err := util.ExtractMetricNameFromMatchers(matchers); err != nil {
+			return nil, fmt.Errorf("selector %s: %v", selector, err)
+		}
+		result = append(result, matchers)
+	}
+	return result, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler, parsing the request's selectors.
+func (r *DeleteRequest) UnmarshalJSON(buf []byte) error {
+	type plain DeleteRequest
+	if err := json.Unmarshal(buf, (*plain)(r)); err != nil {
+		return err
+	}
+	matchers, err := ParseDeleteSelectors(r.Selectors)
+	if err != nil {
+		return err
+	}
+	r.matchers = matchers
+	return nil
+}
+
+// Matchers returns the label matchers of each of the request's selectors.
+func (r *DeleteRequest) Matchers() []metric.LabelMatchers {
+	return r.matchers
+}
+
+// Cancellable returns whether the request can still be cancelled.
+func (r *DeleteRequest) Cancellable(now model.Time) bool {
+	return r.Status == DeleteRequestReceived && now.Before(r.CancellableUntil)
+}
+
+// Filtered returns whether the request's samples are filtered from query
+// results.
+func (r *DeleteRequest) Filtered() bool {
+	return r.Status != DeleteRequestCancelled
+}
+
+// Matches returns whether the series matches any of the request's selectors.
+func (r *DeleteRequest) Matches(m model.Metric) bool {
+outer:
+	for _, matchers := range r.matchers {
+		for _, matcher := range matchers {
+			if !matcher.Match(m[matcher.Name]) {
+				continue outer
+			}
+		}
+		return true
+	}
+	return false
+}
+
+type cachedDeleteRequests struct {
+	requests []DeleteRequest
+	fetched  time.Time
+}
+
+// deleteRequests records delete requests in a table of their own, keyed by
+// user ID and request ID.
+type deleteRequests struct {
+	cfg     DeleteRequestsConfig
+	storage StorageClient
+
+	mtx   sync.Mutex
+	cache map[string]cachedDeleteRequests
+}
+
+func newDeleteRequests(cfg DeleteRequestsConfig, storage StorageClient) *deleteRequests {
+	return &deleteRequests{
+		cfg:     cfg,
+		storage: storage,
+		cache:   map[string]cachedDeleteRequests{},
+	}
+}
+
+// add records a delete request of the user in ctx.  Its end time is capped
+// at now, as samples which haven't been written can't be deleted.
+func (d *deleteRequests) add(ctx context.Context, start, end model.Time, selectors []string) (DeleteRequest, error) {
+	if d.cfg.TableName == "" {
+		return DeleteRequest{}, ErrDeletesDisabled
+	}
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return DeleteRequest{}, err
+	}
+	matchers, err := ParseDeleteSelectors(selectors)
+	if err != nil {
+		return DeleteRequest{}, err
+	}
+	now := mtime.Now()
+	createdAt := model.TimeFromUnixNano(now.UnixNano())
+	if end.After(createdAt) {
+		end = createdAt
+	}
+	if end.Before(start) {
+		return DeleteRequest{}, fmt.Errorf("end time %v is before start time %v", end, start)
+	}
+
+	req := DeleteRequest{
+		RequestID:        fmt.Sprintf("%016x", now.UnixNano()),
+		UserID:           userID,
+		StartTime:        start,
+		EndTime:          end,
+		Selectors:        selectors,
+		Status:           DeleteRequestReceived,
+		CreatedAt:        createdAt,
+		CancellableUntil: createdAt.Add(d.cfg.CancelPeriod),
+		matchers:         matchers,
+	}
+	if err := d.write(ctx, req); err != nil {
+		return DeleteRequest{}, err
+	}
+
+	d.mtx.Lock()
+	delete(d.cache, userID)
+	d.mtx.Unlock()
+	return req, nil
+}
+
+// forUser returns the user's delete requests, oldest first.  They're cached,
+// as they're needed by every query.
+func (d *deleteRequests) forUser(ctx context.Context, userID string) ([]DeleteRequest, error) {
+	if d.cfg.TableName == "" {
+		return nil, nil
+	}
+
+	d.mtx.Lock()
+	cached, ok := d.cache[userID]
+	d.mtx.Unlock()
+	if ok && time.Since(cached.fetched) < d.cfg.CacheTTL {
+		return cached.requests, nil
+	}
+
+	requests, err := d.query(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	d.mtx.Lock()
+	d.cache[userID] = cachedDeleteRequests{requests: requests, fetched: time.Now()}
+	d.mtx.Unlock()
+	return requests, nil
+}
+
+// get returns the user's delete request with the given ID, uncached.
+func (d *deleteRequests) get(ctx context.Context, userID, requestID string) (DeleteRequest, error) {
+	if d.cfg.TableName == "" {
+		return DeleteRequest{}, ErrDeletesDisabled
+	}
+	requests, err := d.query(ctx, userID)
+	if err != nil {
+		return DeleteRequest{}, err
+	}
+	for _, req := range requests {
+		if req.RequestID == requestID {
+			return req, nil
+		}
+	}
+	return DeleteRequest{}, ErrDeleteRequestNotFound
+}
+
+// cancel cancels the user's delete request with the given ID, if it's still
+// within its cancellation period.  The purger doesn't process requests
+// until their cancellation period is over.
+func (d *deleteRequests) cancel(ctx context.Context, userID, requestID string) error {
+	req, err := d.get(ctx, userID, requestID)
+	if err != nil {
+		return err
+	}
+	if !req.Cancellable(model.TimeFromUnixNano(mtime.Now().UnixNano())) {
+		return ErrDeleteRequestNotCancellable
+	}
+	if err := d.setStatus(ctx, req, DeleteRequestCancelled); err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	delete(d.cache, userID)
+	d.mtx.Unlock()
+	return nil
+}
+
+// query returns the user's delete requests, oldest first.
+func (d *deleteRequests) query(ctx context.Context, userID string) ([]DeleteRequest, error) {
+	var requests []DeleteRequest
+	var processingErr error
+	if err := d.storage.QueryPages(ctx, IndexEntry{
+		TableName: d.cfg.TableName,
+		HashValue: userID,
+	}, func(resp ReadBatch, lastPage bool) bool {
+		for i := 0; i < resp.Len(); i++ {
+			req, err := parseDeleteRequest(resp.Value(i))
+			if err != nil {
+				processingErr = err
+				return false
+			}
+			requests = append(requests, req)
+		}
+		return !lastPage
+	}); err != nil {
+		return nil, err
+	} else if processingErr != nil {
+		return nil, processingErr
+	}
+	return requests, nil
+}
+
+// pending returns every user's delete requests which haven't been
+// processed or cancelled, oldest first.
+func (d *deleteRequests) pending(ctx context.Context) ([]DeleteRequest, error) {
+	if d.cfg.TableName == "" {
+		return nil, nil
+	}
+	var requests []DeleteRequest
+	var processingErr error
+	if err := d.storage.ScanTable(ctx, d.cfg.TableName, func(_ string, _ []byte, value []byte) bool {
+		req, err := parseDeleteRequest(value)
+		if err != nil {
+			processingErr = err
+			return false
+		}
+		if req.Status == DeleteRequestReceived || req.Status == DeleteRequestProcessing {
+			requests = append(requests, req)
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	} else if processingErr != nil {
+		return nil, processingErr
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].RequestID < requests[j].RequestID
+	})
+	return requests, nil
+}
+
+// setStatus records the request's new status.
+func (d *deleteRequests) setStatus(ctx context.Context, req DeleteRequest, status string) error {
+	req.Status = status
+	return d.write(ctx, req)
+}
+
+// removeUser deletes all the user's delete requests, returning how many
+// there were.
+func (d *deleteRequests) removeUser(ctx context.Context, userID string) (int, error) {
+	if d.cfg.TableName == "" {
+		return 0, nil
+	}
+	batch := d.storage.NewWriteBatch()
+	n := 0
+	if err := d.storage.QueryPages(ctx, IndexEntry{
+		TableName: d.cfg.TableName,
+		HashValue: userID,
+	}, func(resp ReadBatch, lastPage bool) bool {
+		for i := 0; i < resp.Len(); i++ {
+			batch.Delete(d.cfg.TableName, userID, resp.RangeValue(i))
+			n++
+		}
+		return !lastPage
+	}); err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		if err := d.storage.BatchWrite(ctx, batch); err != nil {
+			return 0, err
+		}
+	}
+
+	d.mtx.Lock()
+	delete(d.cache, userID)
+	d.mtx.Unlock()
+	return n, nil
+}
+
+func (d *deleteRequests) write(ctx context.Context, req DeleteRequest) error {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	batch := d.storage.NewWriteBatch()
+	batch.Add(d.cfg.TableName, req.UserID, []byte(req.RequestID), buf)
+	return d.storage.BatchWrite(ctx, batch)
+}
+
+func parseDeleteRequest(buf []byte) (DeleteRequest, error) {
+	var req DeleteRequest
+	err := json.Unmarshal(buf, &req)
+	return req, err
+}
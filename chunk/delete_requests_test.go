@@ -0,0 +1,281 @@
+package chunk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+const deletesTable = "deletes"
+
+func newDeletesTestStore(t *testing.T) (*MockStorage, *Store) {
+	storage := NewMockStorage()
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{
+		DeleteRequests: DeleteRequestsConfig{TableName: deletesTable},
+	}, storage)
+	require.NoError(t, err)
+	require.NoError(t, tableManager.syncTables(context.Background()))
+	store, err := NewStore(StoreConfig{
+		schemaFactory:  v6Schema,
+		DeleteRequests: DeleteRequestsConfig{TableName: deletesTable},
+	}, storage)
+	require.NoError(t, err)
+	return storage, store
+}
+
+// chunkOf makes a chunk of a sample a minute between from and through.
+func chunkOf(t *testing.T, userID string, from, through model.Time) Chunk {
+	metric := model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}
+	var samples []model.SamplePair
+	for ts := from; !ts.After(through); ts = ts.Add(time.Minute) {
+		samples = append(samples, model.SamplePair{Timestamp: ts, Value: model.SampleValue(ts)})
+	}
+	chunks, err := newChunks(userID, metric.Fingerprint(), metric, samples)
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+	return chunks[0]
+}
+
+func TestDeleteRequests(t *testing.T) {
+	_, store := newDeletesTestStore(t)
+	ctx := user.Inject(context.Background(), "user1")
+
+	now := time.Unix(0, 0).Add(24 * time.Hour)
+	mtime.NowForce(now)
+	defer mtime.NowReset()
+
+	// Selectors must name a metric.
+	_, err := store.AddDeleteRequest(ctx, 0, model.Latest, []string{`{bar="baz"}`})
+	assert.Error(t, err)
+
+	req, err := store.AddDeleteRequest(ctx, 0, model.Latest, []string{`foo{bar="baz"}`})
+	require.NoError(t, err)
+	assert.Equal(t, DeleteRequestReceived, req.Status)
+	assert.Equal(t, model.TimeFromUnixNano(now.UnixNano()), req.EndTime, "end time is capped at now")
+	assert.True(t, req.Matches(model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}))
+	assert.False(t, req.Matches(model.Metric{model.MetricNameLabel: "foo", "bar": "qux"}))
+
+	mtime.NowForce(now.Add(time.Second))
+	_, err = store.AddDeleteRequest(user.Inject(context.Background(), "user2"), 0, 1000, []string{"foo"})
+	require.NoError(t, err)
+
+	requests, err := store.DeleteRequests(ctx)
+	require.NoError(t, err)
+	require.Len(t, requests, 1)
+	assert.Equal(t, req.RequestID, requests[0].RequestID)
+	assert.True(t, requests[0].Matches(model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}))
+
+	pending, err := store.deletes.pending(context.Background())
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, "user1", pending[0].UserID)
+	assert.Equal(t, "user2", pending[1].UserID)
+
+	require.NoError(t, store.deletes.setStatus(context.Background(), pending[0], DeleteRequestProcessed))
+	pending, err = store.deletes.pending(context.Background())
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, "user2", pending[0].UserID)
+
+	// Queriers see processed requests once their cache expires.
+	store.deletes.cache = map[string]cachedDeleteRequests{}
+	requests, err = store.DeleteRequests(ctx)
+	require.NoError(t, err)
+	require.Len(t, requests, 1)
+	assert.Equal(t, DeleteRequestProcessed, requests[0].Status)
+}
+
+func TestDeleteRequestsDisabled(t *testing.T) {
+	store, err := NewStore(StoreConfig{schemaFactory: v6Schema}, NewMockStorage())
+	require.NoError(t, err)
+	ctx := user.Inject(context.Background(), "user1")
+
+	_, err = store.AddDeleteRequest(ctx, 0, model.Latest, []string{"foo"})
+	assert.Equal(t, ErrDeletesDisabled, err)
+	requests, err := store.DeleteRequests(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, requests)
+}
+
+func TestDeleteSeries(t *testing.T) {
+	storage, store := newDeletesTestStore(t)
+	ctx := user.Inject(context.Background(), "user1")
+
+	now := model.Now()
+	inside := chunkOf(t, "user1", now.Add(-2*time.Hour), now.Add(-90*time.Minute))
+	partial := chunkOf(t, "user1", now.Add(-80*time.Minute), now.Add(-40*time.Minute))
+	outside := chunkOf(t, "user1", now.Add(-30*time.Minute), now)
+	chunks := []Chunk{inside, partial, outside}
+	require.NoError(t, store.Put(ctx, chunks))
+
+	// Deletes aren't subject to the look-back period or per-query limits,
+	// and only fetch the chunks they rewrite.
+	store.cfg.MaxLookBackPeriod = time.Hour
+	limitedCtx := util.WithChunkLimit(util.WithSeriesLimit(ctx, 1), 1)
+	require.NoError(t, storage.DeleteChunk(ctx, chunks[0].externalKey()))
+
+	from, through := now.Add(-3*time.Hour), now.Add(-60*time.Minute)
+	require.NoError(t, store.DeleteSeries(limitedCtx, from, through, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")))
+
+	store.cfg.MaxLookBackPeriod = 0
+	result, err := store.Get(ctx, now.Add(-4*time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	require.NoError(t, err)
+	matrix, err := ChunksToMatrix(result)
+	require.NoError(t, err)
+	require.Len(t, matrix, 1)
+	for _, s := range matrix[0].Values {
+		assert.True(t, s.Timestamp.After(through), "sample at %v not deleted", s.Timestamp)
+	}
+	assert.Len(t, matrix[0].Values, 20+31)
+
+	for _, c := range chunks[:2] {
+		_, err := storage.GetChunk(ctx, c.externalKey())
+		assert.Equal(t, ErrChunkNotFound, err)
+	}
+}
+
+func TestDeleteSeriesFilters(t *testing.T) {
+	_, store := newDeletesTestStore(t)
+	ctx := user.Inject(context.Background(), "user1")
+
+	now := model.Now()
+	baz := chunkOf(t, "user1", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	qux := baz
+	qux.Metric = model.Metric{model.MetricNameLabel: "foo", "bar": "qux"}
+	qux.Fingerprint = qux.Metric.Fingerprint()
+	require.NoError(t, store.Put(ctx, []Chunk{baz, qux}))
+
+	// Only the series without bar="baz" is deleted.
+	require.NoError(t, store.DeleteSeries(ctx, now.Add(-3*time.Hour), now,
+		mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"),
+		mustNewLabelMatcher(metric.NotEqual, "bar", "baz")))
+
+	result, err := store.Get(ctx, now.Add(-4*time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	require.NoError(t, err)
+	require.Len(t, result, 1)
+	assert.Equal(t, baz.Metric, result[0].Metric)
+}
+
+func TestPurgerDeleteRequests(t *testing.T) {
+	storage, store := newDeletesTestStore(t)
+	ctx := user.Inject(context.Background(), "user1")
+
+	now := model.Now()
+	c := chunkOf(t, "user1", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	require.NoError(t, store.Put(ctx, []Chunk{c}))
+	_, err := store.AddDeleteRequest(ctx, now.Add(-3*time.Hour), now, []string{"foo"})
+	require.NoError(t, err)
+
+	tableCfg := TableManagerConfig{MaxChunkAge: time.Hour, CreationGracePeriod: 10 * time.Minute}
+	purger := NewPurger(PurgerConfig{}, tableCfg, store, storage, fakeRetentionLimits{})
+	get := func() []Chunk {
+		chunks, err := store.Get(ctx, now.Add(-4*time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+		require.NoError(t, err)
+		return chunks
+	}
+
+	// Requests aren't processed until the ingesters have flushed every chunk
+	// they may have samples in.
+	require.NoError(t, purger.processDeleteRequests(context.Background()))
+	assert.Len(t, get(), 1)
+
+	mtime.NowForce(time.Now().Add(tableCfg.MaxChunkAge + tableCfg.CreationGracePeriod))
+	defer mtime.NowReset()
+	require.NoError(t, purger.processDeleteRequests(context.Background()))
+	assert.Empty(t, get())
+
+	pending, err := store.deletes.pending(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestPurgerDeleteRequestFailure(t *testing.T) {
+	storage, store := newDeletesTestStore(t)
+	ctx1 := user.Inject(context.Background(), "user1")
+	ctx2 := user.Inject(context.Background(), "user2")
+
+	// The first request fails, as its partly deleted chunk is missing, which
+	// mustn't hold up the second.
+	now := model.Now()
+	missing := []Chunk{chunkOf(t, "user1", now.Add(-2*time.Hour), now.Add(-time.Hour))}
+	require.NoError(t, store.Put(ctx1, missing))
+	require.NoError(t, storage.DeleteChunk(ctx1, missing[0].externalKey()))
+	failed, err := store.AddDeleteRequest(ctx1, now.Add(-3*time.Hour), now.Add(-90*time.Minute), []string{"foo"})
+	require.NoError(t, err)
+	c := chunkOf(t, "user2", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	require.NoError(t, store.Put(ctx2, []Chunk{c}))
+	processed, err := store.AddDeleteRequest(ctx2, now.Add(-3*time.Hour), now, []string{"foo"})
+	require.NoError(t, err)
+
+	tableCfg := TableManagerConfig{MaxChunkAge: time.Hour, CreationGracePeriod: 10 * time.Minute}
+	purger := NewPurger(PurgerConfig{}, tableCfg, store, storage, fakeRetentionLimits{})
+	mtime.NowForce(time.Now().Add(tableCfg.MaxChunkAge + tableCfg.CreationGracePeriod))
+	defer mtime.NowReset()
+	require.NoError(t, purger.processDeleteRequests(context.Background()))
+
+	req, err := store.GetDeleteRequest(ctx1, failed.RequestID)
+	require.NoError(t, err)
+	assert.Equal(t, DeleteRequestProcessing, req.Status)
+	req, err = store.GetDeleteRequest(ctx2, processed.RequestID)
+	require.NoError(t, err)
+	assert.Equal(t, DeleteRequestProcessed, req.Status)
+}
+
+func TestCancelDeleteRequest(t *testing.T) {
+	storage, store := newDeletesTestStore(t)
+	store.deletes.cfg.CancelPeriod = 2 * time.Hour
+	ctx := user.Inject(context.Background(), "user1")
+
+	now := time.Now()
+	mtime.NowForce(now)
+	defer mtime.NowReset()
+
+	c := chunkOf(t, "user1", model.TimeFromUnixNano(now.Add(-2*time.Hour).UnixNano()), model.TimeFromUnixNano(now.Add(-time.Hour).UnixNano()))
+	require.NoError(t, store.Put(ctx, []Chunk{c}))
+	cancelled, err := store.AddDeleteRequest(ctx, 0, model.Latest, []string{"foo"})
+	require.NoError(t, err)
+	mtime.NowForce(now.Add(time.Second))
+	processed, err := store.AddDeleteRequest(ctx, 0, model.Latest, []string{"foo"})
+	require.NoError(t, err)
+
+	_, err = store.GetDeleteRequest(ctx, "missing")
+	assert.Equal(t, ErrDeleteRequestNotFound, err)
+	assert.Equal(t, ErrDeleteRequestNotFound, store.CancelDeleteRequest(ctx, "missing"))
+	assert.Equal(t, ErrDeleteRequestNotFound, store.CancelDeleteRequest(user.Inject(context.Background(), "user2"), cancelled.RequestID))
+
+	// Requests aren't processed during their cancellation period, even once
+	// the ingesters have flushed their samples.
+	tableCfg := TableManagerConfig{MaxChunkAge: time.Hour, CreationGracePeriod: 10 * time.Minute}
+	purger := NewPurger(PurgerConfig{}, tableCfg, store, storage, fakeRetentionLimits{})
+	mtime.NowForce(now.Add(90 * time.Minute))
+	require.NoError(t, purger.processDeleteRequests(context.Background()))
+	req, err := store.GetDeleteRequest(ctx, processed.RequestID)
+	require.NoError(t, err)
+	assert.Equal(t, DeleteRequestReceived, req.Status)
+
+	require.NoError(t, store.CancelDeleteRequest(ctx, cancelled.RequestID))
+	req, err = store.GetDeleteRequest(ctx, cancelled.RequestID)
+	require.NoError(t, err)
+	assert.Equal(t, DeleteRequestCancelled, req.Status)
+	assert.False(t, req.Filtered())
+	assert.Equal(t, ErrDeleteRequestNotCancellable, store.CancelDeleteRequest(ctx, cancelled.RequestID))
+
+	mtime.NowForce(now.Add(3 * time.Hour))
+	assert.Equal(t, ErrDeleteRequestNotCancellable, store.CancelDeleteRequest(ctx, processed.RequestID))
+	require.NoError(t, purger.processDeleteRequests(context.Background()))
+	req, err = store.GetDeleteRequest(ctx, processed.RequestID)
+	require.NoError(t, err)
+	assert.Equal(t, DeleteRequestProcessed, req.Status)
+	req, err = store.GetDeleteRequest(ctx, cancelled.RequestID)
+	require.NoError(t, err)
+	assert.Equal(t, DeleteRequestCancelled, req.Status)
+}
@@ -0,0 +1,233 @@
+package chunk
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/cortex/events"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+var (
+	tableLastBackup = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "dynamo_table_last_backup_timestamp_seconds",
+		Help:      "Time of the last successful on-demand backup of each active DynamoDB table.",
+	}, []string{"table"})
+	tableBackupFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "dynamo_table_backup_failures_total",
+		Help:      "Total number of failures enabling point-in-time recovery on, or backing up, DynamoDB tables.",
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(tableLastBackup)
+	prometheus.MustRegister(tableBackupFailures)
+}
+
+// BackupConfig configures the table manager's DynamoDB backups.
+type BackupConfig struct {
+	PointInTimeRecovery bool
+	Interval            time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet.
+func (cfg *BackupConfig) RegisterFlags(f *flag.FlagSet) {
+	f.BoolVar(&cfg.PointInTimeRecovery, "table-manager.point-in-time-recovery", false, "Enable point-in-time recovery on the tables the table manager manages.")
+	f.DurationVar(&cfg.Interval, "table-manager.backup-interval", 0, "How often to take on-demand backups of actively written tables. 0 disables backups.")
+}
+
+// A DynamoBackupClient can enable point-in-time recovery on tables, and back
+// them up.
+type DynamoBackupClient interface {
+	EnablePointInTimeRecovery(name string) error
+	CreateBackup(name, backupName string) error
+	// ListBackups returns the creation times of the table's backups since
+	// the given time.
+	ListBackups(name string, since time.Time) ([]time.Time, error)
+}
+
+// The vendored AWS SDK predates DynamoDB backups, so their requests are sent
+// raw, like CreateGlobalTable's.
+type updateContinuousBackupsInput struct {
+	_ struct{} `type:"structure"`
+
+	TableName                        *string                           `type:"string" required:"true"`
+	PointInTimeRecoverySpecification *pointInTimeRecoverySpecification `type:"structure" required:"true"`
+}
+
+type pointInTimeRecoverySpecification struct {
+	_ struct{} `type:"structure"`
+
+	PointInTimeRecoveryEnabled *bool `type:"boolean" required:"true"`
+}
+
+type updateContinuousBackupsOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+type createBackupInput struct {
+	_ struct{} `type:"structure"`
+
+	TableName  *string `type:"string" required:"true"`
+	BackupName *string `type:"string" required:"true"`
+}
+
+type createBackupOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+type listBackupsInput struct {
+	_ struct{} `type:"structure"`
+
+	TableName               *string    `type:"string"`
+	TimeRangeLowerBound     *time.Time `type:"timestamp" timestampFormat:"unix"`
+	ExclusiveStartBackupArn *string    `type:"string"`
+}
+
+type listBackupsOutput struct {
+	_ struct{} `type:"structure"`
+
+	BackupSummaries        []*backupSummary `type:"list"`
+	LastEvaluatedBackupArn *string          `type:"string"`
+}
+
+type backupSummary struct {
+	_ struct{} `type:"structure"`
+
+	BackupCreationDateTime *time.Time `type:"timestamp" timestampFormat:"unix"`
+}
+
+func (d dynamoTableClient) send(name string, input, output interface{}) error {
+	client, ok := d.DynamoDB.(*dynamodb.DynamoDB)
+	if !ok {
+		return fmt.Errorf("%s needs an AWS DynamoDB client", name)
+	}
+	return client.NewRequest(&request.Operation{
+		Name:       name,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}, input, output).Send()
+}
+
+// EnablePointInTimeRecovery implements DynamoBackupClient.
+func (d dynamoTableClient) EnablePointInTimeRecovery(name string) error {
+	return d.send("UpdateContinuousBackups", &updateContinuousBackupsInput{
+		TableName: aws.String(name),
+		PointInTimeRecoverySpecification: &pointInTimeRecoverySpecification{
+			PointInTimeRecoveryEnabled: aws.Bool(true),
+		},
+	}, &updateContinuousBackupsOutput{})
+}
+
+// CreateBackup implements DynamoBackupClient.
+func (d dynamoTableClient) CreateBackup(name, backupName string) error {
+	return d.send("CreateBackup", &createBackupInput{
+		TableName:  aws.String(name),
+		BackupName: aws.String(backupName),
+	}, &createBackupOutput{})
+}
+
+// ListBackups implements DynamoBackupClient.
+func (d dynamoTableClient) ListBackups(name string, since time.Time) ([]time.Time, error) {
+	var (
+		result []time.Time
+		input  = &listBackupsInput{TableName: aws.String(name), TimeRangeLowerBound: aws.Time(since)}
+	)
+	for {
+		output := &listBackupsOutput{}
+		if err := d.send("ListBackups", input, output); err != nil {
+			return nil, err
+		}
+		for _, summary := range output.BackupSummaries {
+			if summary.BackupCreationDateTime != nil {
+				result = append(result, *summary.BackupCreationDateTime)
+			}
+		}
+		if output.LastEvaluatedBackupArn == nil {
+			return result, nil
+		}
+		input.ExclusiveStartBackupArn = output.LastEvaluatedBackupArn
+	}
+}
+
+// backupTables enables point-in-time recovery on the tables, if configured,
+// and backs up active tables which haven't been backed up within the backup
+// interval.  Failures are logged and counted, but don't stop the tables
+// being synced.
+func (m *DynamoTableManager) backupTables(ctx context.Context, descriptions []tableDescription) {
+	if !m.cfg.Backups.PointInTimeRecovery && m.cfg.Backups.Interval <= 0 {
+		return
+	}
+	client, ok := m.dynamoDB.(DynamoBackupClient)
+	if !ok {
+		log.Warnf("DynamoDB table client doesn't support backups")
+		return
+	}
+
+	for _, desc := range descriptions {
+		if m.cfg.Backups.PointInTimeRecovery && !m.pitrEnabled[desc.name] {
+			if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.UpdateContinuousBackups", dynamoRequestDuration, func(_ context.Context) error {
+				return client.EnablePointInTimeRecovery(desc.name)
+			}); err != nil {
+				log.Errorf("Error enabling point-in-time recovery on table %s: %v", desc.name, err)
+				tableBackupFailures.WithLabelValues("point_in_time_recovery").Inc()
+			} else {
+				m.pitrEnabled[desc.name] = true
+			}
+		}
+
+		if m.cfg.Backups.Interval > 0 && desc.active {
+			if err := m.backupTable(ctx, client, desc.name); err != nil {
+				log.Errorf("Error backing up table %s: %v", desc.name, err)
+				tableBackupFailures.WithLabelValues("backup").Inc()
+			}
+		}
+	}
+}
+
+// backupTable backs up the table, unless it's been backed up within the
+// backup interval.  Backups are listed, rather than remembered, so restarts
+// don't cause extra backups.
+func (m *DynamoTableManager) backupTable(ctx context.Context, client DynamoBackupClient, name string) error {
+	now := mtime.Now()
+	var backups []time.Time
+	if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.ListBackups", dynamoRequestDuration, func(_ context.Context) error {
+		var err error
+		backups, err = client.ListBackups(name, now.Add(-m.cfg.Backups.Interval))
+		return err
+	}); err != nil {
+		return err
+	}
+	if len(backups) > 0 {
+		latest := backups[0]
+		for _, t := range backups[1:] {
+			if t.After(latest) {
+				latest = t
+			}
+		}
+		tableLastBackup.WithLabelValues(name).Set(float64(latest.Unix()))
+		return nil
+	}
+
+	backupName := fmt.Sprintf("%s-%d", name, now.Unix())
+	log.Infof("Backing up table %s to %s", name, backupName)
+	if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.CreateBackup", dynamoRequestDuration, func(_ context.Context) error {
+		return client.CreateBackup(name, backupName)
+	}); err != nil {
+		return err
+	}
+	tableLastBackup.WithLabelValues(name).Set(float64(now.Unix()))
+	events.Record("table-manager", "table_backed_up", "Backed up table %s to %s", name, backupName)
+	return nil
+}
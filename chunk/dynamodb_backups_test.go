@@ -0,0 +1,89 @@
+package chunk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+type mockBackupClient struct {
+	*MockStorage
+	pitr    map[string]int
+	backups map[string][]time.Time
+}
+
+func (m *mockBackupClient) EnablePointInTimeRecovery(name string) error {
+	m.pitr[name]++
+	return nil
+}
+
+func (m *mockBackupClient) CreateBackup(name, backupName string) error {
+	m.backups[name] = append(m.backups[name], mtime.Now())
+	return nil
+}
+
+func (m *mockBackupClient) ListBackups(name string, since time.Time) ([]time.Time, error) {
+	var result []time.Time
+	for _, t := range m.backups[name] {
+		if !t.Before(since) {
+			result = append(result, t)
+		}
+	}
+	return result, nil
+}
+
+func TestDynamoTableManagerBackups(t *testing.T) {
+	defer mtime.NowReset()
+	client := &mockBackupClient{
+		MockStorage: NewMockStorage(),
+		pitr:        map[string]int{},
+		backups:     map[string][]time.Time{},
+	}
+	cfg := TableManagerConfig{
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables:    true,
+			TablePrefix:          tablePrefix,
+			TablePeriod:          tablePeriod,
+			PeriodicTableStartAt: util.DayValue{Time: model.TimeFromUnix(0)},
+		},
+		OriginalTableName:          "legacy",
+		CreationGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		InactiveWriteThroughput:    inactiveWrite,
+		InactiveReadThroughput:     inactiveRead,
+		Backups: BackupConfig{
+			PointInTimeRecovery: true,
+			Interval:            24 * time.Hour,
+		},
+	}
+	tableManager, err := NewDynamoTableManager(cfg, client)
+	require.NoError(t, err)
+
+	sync := func(tm time.Time) {
+		mtime.NowForce(tm)
+		require.NoError(t, tableManager.syncTables(context.Background()))
+	}
+
+	// Tables are backed up once they exist, and point-in-time recovery is
+	// only enabled once.
+	start := time.Unix(0, 0).Add(tablePeriod).Add(maxChunkAge).Add(gracePeriod)
+	sync(start)
+	assert.Empty(t, client.backups)
+	sync(start)
+	sync(start.Add(time.Hour))
+	assert.Equal(t, map[string]int{"legacy": 1, tablePrefix + "0": 1, tablePrefix + "1": 1}, client.pitr)
+
+	// Only the active table is backed up, once per interval.
+	assert.Equal(t, map[string][]time.Time{tablePrefix + "1": {start}}, client.backups)
+	sync(start.Add(25 * time.Hour))
+	assert.Equal(t, map[string][]time.Time{tablePrefix + "1": {start, start.Add(25 * time.Hour)}}, client.backups)
+}
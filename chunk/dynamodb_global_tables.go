@@ -0,0 +1,139 @@
+package chunk
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	globalTableAlreadyExistsException = "GlobalTableAlreadyExistsException"
+	resourceInUseException            = "ResourceInUseException"
+	resourceNotFoundException         = "ResourceNotFoundException"
+
+	tableActivePollInterval = 5 * time.Second
+	tableActiveTimeout      = 10 * time.Minute
+)
+
+var dynamoFailovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "dynamo_failovers_total",
+	Help:      "Total number of DynamoDB queries retried in a replica region after failing in the local one.",
+}, []string{"region"})
+
+func init() {
+	prometheus.MustRegister(dynamoFailovers)
+}
+
+// dynamoReplica is a DynamoDB client for one of the regions tables are
+// replicated to as global tables.
+type dynamoReplica struct {
+	region   string
+	DynamoDB dynamodbiface.DynamoDBAPI
+}
+
+// replicaRegions returns the configured replica regions.
+func (cfg DynamoDBConfig) replicaRegions() []string {
+	var regions []string
+	for _, region := range strings.Split(cfg.ReplicaRegions, ",") {
+		if region = strings.TrimSpace(region); region != "" {
+			regions = append(regions, region)
+		}
+	}
+	return regions
+}
+
+// newDynamoReplicas makes a client for each replica region, with the same
+// credentials as the DynamoDB URL, whose host must be a region.
+func newDynamoReplicas(cfg DynamoDBConfig) ([]dynamoReplica, error) {
+	regions := cfg.replicaRegions()
+	if len(regions) == 0 {
+		return nil, nil
+	}
+	if cfg.DynamoDB.URL == nil || strings.Contains(cfg.DynamoDB.URL.Host, ".") {
+		return nil, fmt.Errorf("DynamoDB replica regions need the DynamoDB URL's host to be a region")
+	}
+
+	replicas := make([]dynamoReplica, 0, len(regions))
+	for _, region := range regions {
+		u := *cfg.DynamoDB.URL
+		u.Host = region
+		client, err := dynamoClientFromURL(&u, "")
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, dynamoReplica{region: region, DynamoDB: client})
+	}
+	return replicas, nil
+}
+
+// The vendored AWS SDK predates global tables, so CreateGlobalTable is sent
+// as a raw request, with its input modelled here.
+type createGlobalTableInput struct {
+	_ struct{} `type:"structure"`
+
+	GlobalTableName  *string              `type:"string" required:"true"`
+	ReplicationGroup []*globalTableRegion `type:"list" required:"true"`
+}
+
+type globalTableRegion struct {
+	_ struct{} `type:"structure"`
+
+	RegionName *string `type:"string"`
+}
+
+type createGlobalTableOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+// createGlobalTable links the tables with the given name in each region into
+// a global table.  It's not an error if they already are.
+func createGlobalTable(dynamoDB dynamodbiface.DynamoDBAPI, name string, regions []string) error {
+	client, ok := dynamoDB.(*dynamodb.DynamoDB)
+	if !ok {
+		return fmt.Errorf("global tables need an AWS DynamoDB client")
+	}
+	input := &createGlobalTableInput{GlobalTableName: aws.String(name)}
+	for _, region := range regions {
+		input.ReplicationGroup = append(input.ReplicationGroup, &globalTableRegion{RegionName: aws.String(region)})
+	}
+	req := client.NewRequest(&request.Operation{
+		Name:       "CreateGlobalTable",
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}, input, &createGlobalTableOutput{})
+	if err := req.Send(); err != nil && !isAWSErrorCode(err, globalTableAlreadyExistsException) {
+		return err
+	}
+	return nil
+}
+
+// waitForTableActive polls until the table is active.
+func waitForTableActive(dynamoDB dynamodbiface.DynamoDBAPI, name string) error {
+	deadline := time.Now().Add(tableActiveTimeout)
+	for {
+		out, err := dynamoDB.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(name)})
+		if err != nil {
+			return err
+		}
+		if *out.Table.TableStatus == dynamodb.TableStatusActive {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for table %s to be active", name)
+		}
+		time.Sleep(tableActivePollInterval)
+	}
+}
+
+func isAWSErrorCode(err error, code string) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == code
+}
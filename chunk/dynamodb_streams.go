@@ -0,0 +1,588 @@
+package chunk
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+const expiredIteratorException = "ExpiredIteratorException"
+
+var (
+	indexMirrorRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "index_mirror_records_total",
+		Help:      "Total number of DynamoDB stream records mirrored to the destination store, by event.",
+	}, []string{"event"})
+	indexMirrorFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "index_mirror_failures_total",
+		Help:      "Total number of failures mirroring a table's stream; they're retried on the next poll.",
+	})
+	indexMirrorLastRecord = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "index_mirror_last_record_timestamp_seconds",
+		Help:      "Approximate time the latest mirrored stream record was written to DynamoDB.",
+	})
+	dynamoStreamsRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "dynamo_streams_request_duration_seconds",
+		Help:      "Time spent doing DynamoDB Streams requests.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 6),
+	}, []string{"operation", "status_code"})
+)
+
+func init() {
+	prometheus.MustRegister(indexMirrorRecords)
+	prometheus.MustRegister(indexMirrorFailures)
+	prometheus.MustRegister(indexMirrorLastRecord)
+	prometheus.MustRegister(dynamoStreamsRequestDuration)
+}
+
+// A DynamoStreamClient can enable streams on tables.
+type DynamoStreamClient interface {
+	// EnableStream enables a stream of new and old images on the table,
+	// if it doesn't have a stream, and returns whether it has one; tables
+	// which aren't active yet can't be updated.
+	EnableStream(name string) (bool, error)
+}
+
+// EnableStream implements DynamoStreamClient.
+func (d dynamoTableClient) EnableStream(name string) (bool, error) {
+	out, err := d.DynamoDB.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(name)})
+	if err != nil {
+		return false, err
+	}
+	if spec := out.Table.StreamSpecification; spec != nil && aws.BoolValue(spec.StreamEnabled) {
+		return true, nil
+	}
+	if aws.StringValue(out.Table.TableStatus) != dynamodb.TableStatusActive {
+		return false, nil
+	}
+	_, err = d.DynamoDB.UpdateTable(&dynamodb.UpdateTableInput{
+		TableName: aws.String(name),
+		StreamSpecification: &dynamodb.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: aws.String(dynamodb.StreamViewTypeNewAndOldImages),
+		},
+	})
+	return err == nil, err
+}
+
+// enableStreams enables streams on the index tables, once each, if
+// configured.  Failures are logged, and retried on the next sync.
+func (m *DynamoTableManager) enableStreams(ctx context.Context, descriptions []tableDescription) {
+	if !m.cfg.IndexStreams {
+		return
+	}
+	client, ok := m.dynamoDB.(DynamoStreamClient)
+	if !ok {
+		log.Warnf("DynamoDB table client doesn't support streams")
+		return
+	}
+	for _, desc := range descriptions {
+		if m.streamEnabled[desc.name] || desc.name == m.cfg.DeleteRequests.TableName {
+			continue
+		}
+		var enabled bool
+		if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.UpdateTable", dynamoRequestDuration, func(_ context.Context) error {
+			var err error
+			enabled, err = client.EnableStream(desc.name)
+			return err
+		}); err != nil {
+			log.Errorf("Error enabling stream on table %s: %v", desc.name, err)
+			continue
+		}
+		m.streamEnabled[desc.name] = enabled
+	}
+}
+
+// IndexMirrorConfig configures an IndexMirror.
+type IndexMirrorConfig struct {
+	TablePrefix     string
+	PollInterval    time.Duration
+	FromOldest      bool
+	CheckpointTable string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet.
+func (cfg *IndexMirrorConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.TablePrefix, "index-mirror.table-prefix", "cortex_", "Prefix of the DynamoDB index tables whose streams are mirrored.")
+	f.DurationVar(&cfg.PollInterval, "index-mirror.poll-interval", 10*time.Second, "How often to poll the tables' streams for new records.")
+	f.BoolVar(&cfg.FromOldest, "index-mirror.from-oldest", false, "Start mirroring each stream from its oldest record, up to 24 hours old, rather than its latest, to backfill the destination.")
+	f.StringVar(&cfg.CheckpointTable, "index-mirror.checkpoint-table", "", "Table of the destination, which must exist, to record where the mirror has got to in each stream in, so a restarted mirror resumes there. If empty, it's only kept in memory.")
+}
+
+// Validate returns an error if the config can't be used.
+func (cfg *IndexMirrorConfig) Validate() error {
+	if cfg.PollInterval <= 0 {
+		return fmt.Errorf("-index-mirror.poll-interval must be positive, got %v", cfg.PollInterval)
+	}
+	return nil
+}
+
+// An IndexMirror mirrors the index entries written to, and deleted from,
+// DynamoDB index tables to another store, by consuming the tables' streams.
+// Entries are written to the destination's tables of the same names, which
+// must exist.
+//
+// Where it's got to in each shard is checkpointed to the CheckpointTable of
+// the destination, if set, so a restarted mirror resumes there; otherwise it
+// starts again from the streams' latest records, or oldest with FromOldest.
+// Records are mirrored at least once, and in order within each shard, but
+// shards are read independently.
+type IndexMirror struct {
+	cfg         IndexMirrorConfig
+	dynamoDB    dynamodbiface.DynamoDBAPI
+	streams     dynamodbstreamsiface.DynamoDBStreamsAPI
+	destination StorageClient
+
+	// The shards being read of each stream, by ARN.
+	shards map[string]map[string]*shardReader
+	polled bool
+
+	quit chan struct{}
+	wait sync.WaitGroup
+}
+
+// shardReader is where a mirror has got to in a shard.
+type shardReader struct {
+	iterator     *string
+	lastSequence *string
+	// Whether the shard is closed, and all its records are mirrored.
+	done bool
+	// The checkpoint last stored for the shard.
+	saved shardCheckpoint
+}
+
+// shardCheckpoint is where a mirror has got to in a shard, as stored in the
+// checkpoint table: in a row per stream ARN, with a column per shard ID.
+type shardCheckpoint struct {
+	LastSequence string `json:"last_sequence,omitempty"`
+	Done         bool   `json:"done,omitempty"`
+}
+
+func (r *shardReader) checkpoint() shardCheckpoint {
+	return shardCheckpoint{LastSequence: aws.StringValue(r.lastSequence), Done: r.done}
+}
+
+// NewIndexMirror makes a new IndexMirror, mirroring the index tables of the
+// DynamoDB URL to the destination.
+func NewIndexMirror(cfg IndexMirrorConfig, dynamoDBConfig DynamoDBConfig, destination StorageClient) (*IndexMirror, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if dynamoDBConfig.DynamoDB.URL == nil {
+		return nil, fmt.Errorf("no URL specified for DynamoDB")
+	}
+	dynamoDB, err := dynamoClientFromURL(dynamoDBConfig.DynamoDB.URL, dynamoDBConfig.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	// Streams have their own endpoint, so only the URL's is used.
+	streamsConfig, err := awsConfigFromURL(dynamoDBConfig.DynamoDB.URL, "")
+	if err != nil {
+		return nil, err
+	}
+	streams := dynamodbstreams.New(session.New(streamsConfig))
+	return newIndexMirror(cfg, dynamoDB, streams, destination), nil
+}
+
+func newIndexMirror(cfg IndexMirrorConfig, dynamoDB dynamodbiface.DynamoDBAPI, streams dynamodbstreamsiface.DynamoDBStreamsAPI, destination StorageClient) *IndexMirror {
+	return &IndexMirror{
+		cfg:         cfg,
+		dynamoDB:    dynamoDB,
+		streams:     streams,
+		destination: destination,
+		shards:      map[string]map[string]*shardReader{},
+		quit:        make(chan struct{}),
+	}
+}
+
+// Start the IndexMirror.
+func (m *IndexMirror) Start() {
+	m.wait.Add(1)
+	go m.loop()
+}
+
+// Stop the IndexMirror.
+func (m *IndexMirror) Stop() {
+	close(m.quit)
+	m.wait.Wait()
+}
+
+func (m *IndexMirror) loop() {
+	defer m.wait.Done()
+
+	ticker := time.NewTicker(m.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.poll(context.Background()); err != nil {
+			log.Errorf("Error polling DynamoDB streams: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// poll mirrors the new records in the streams of the index tables.
+func (m *IndexMirror) poll(ctx context.Context) error {
+	var tables []string
+	if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.ListTablesPages", dynamoRequestDuration, func(_ context.Context) error {
+		return m.dynamoDB.ListTablesPages(&dynamodb.ListTablesInput{}, func(resp *dynamodb.ListTablesOutput, _ bool) bool {
+			for _, name := range resp.TableNames {
+				if strings.HasPrefix(*name, m.cfg.TablePrefix) {
+					tables = append(tables, *name)
+				}
+			}
+			return true
+		})
+	}); err != nil {
+		return err
+	}
+
+	streams := map[string]struct{}{}
+	for _, table := range tables {
+		arn, err := m.mirrorTable(ctx, table)
+		if err != nil {
+			log.Errorf("Error mirroring table %s: %v", table, err)
+			indexMirrorFailures.Inc()
+		}
+		if arn != "" {
+			streams[arn] = struct{}{}
+		}
+	}
+	// Forget the streams of deleted tables, and old streams of tables.
+	for arn, readers := range m.shards {
+		if _, ok := streams[arn]; !ok {
+			if err := m.deleteCheckpoints(ctx, arn, readers); err != nil {
+				log.Warnf("Error deleting checkpoints of stream %s: %v", arn, err)
+			}
+			delete(m.shards, arn)
+		}
+	}
+	m.polled = true
+	return nil
+}
+
+// mirrorTable mirrors the new records in the table's latest stream, if it
+// has one, and returns the stream's ARN.
+func (m *IndexMirror) mirrorTable(ctx context.Context, table string) (string, error) {
+	var out *dynamodb.DescribeTableOutput
+	if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.DescribeTable", dynamoRequestDuration, func(_ context.Context) error {
+		var err error
+		out, err = m.dynamoDB.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(table)})
+		return err
+	}); err != nil {
+		return "", err
+	}
+	if out.Table.LatestStreamArn == nil {
+		return "", nil
+	}
+	arn := *out.Table.LatestStreamArn
+
+	shards, err := m.describeShards(ctx, arn)
+	if err != nil {
+		return arn, err
+	}
+
+	// Checkpointed shards are resumed after their last mirrored records.
+	// Otherwise the shards there are when the mirror starts are read from
+	// their latest records, unless backfilling; later ones, including those
+	// of new tables' streams, are new, so are read from the start.
+	readers, ok := m.shards[arn]
+	if !ok {
+		if readers, err = m.loadCheckpoints(ctx, arn); err != nil {
+			return arn, err
+		}
+		m.shards[arn] = readers
+	}
+	iteratorType := dynamodbstreams.ShardIteratorTypeTrimHorizon
+	if !m.polled && !m.cfg.FromOldest && len(readers) == 0 {
+		iteratorType = dynamodbstreams.ShardIteratorTypeLatest
+	}
+
+	current := map[string]struct{}{}
+	for _, shard := range shards {
+		id := *shard.ShardId
+		current[id] = struct{}{}
+		reader, ok := readers[id]
+		if !ok {
+			reader = &shardReader{}
+			if err := m.getShardIterator(ctx, arn, id, iteratorType, reader); err != nil {
+				return arn, err
+			}
+			readers[id] = reader
+		} else if reader.iterator == nil && !reader.done {
+			resumeType := dynamodbstreams.ShardIteratorTypeAfterSequenceNumber
+			if reader.lastSequence == nil {
+				resumeType = dynamodbstreams.ShardIteratorTypeTrimHorizon
+			}
+			if err := m.getShardIterator(ctx, arn, id, resumeType, reader); err != nil {
+				return arn, err
+			}
+		}
+		err := m.readShard(ctx, table, arn, id, reader)
+		if err := m.saveCheckpoint(ctx, arn, id, reader); err != nil {
+			return arn, err
+		}
+		if err != nil {
+			return arn, err
+		}
+	}
+	// Shards are trimmed from streams after 24 hours.
+	trimmed := map[string]*shardReader{}
+	for id, reader := range readers {
+		if _, ok := current[id]; !ok {
+			trimmed[id] = reader
+			delete(readers, id)
+		}
+	}
+	return arn, m.deleteCheckpoints(ctx, arn, trimmed)
+}
+
+// loadCheckpoints returns readers for the stream's checkpointed shards,
+// which need iterators to resume them.
+func (m *IndexMirror) loadCheckpoints(ctx context.Context, arn string) (map[string]*shardReader, error) {
+	readers := map[string]*shardReader{}
+	if m.cfg.CheckpointTable == "" {
+		return readers, nil
+	}
+	var decodeErr error
+	err := m.destination.QueryPages(ctx, IndexEntry{TableName: m.cfg.CheckpointTable, HashValue: arn}, func(batch ReadBatch, _ bool) bool {
+		for i := 0; i < batch.Len(); i++ {
+			var checkpoint shardCheckpoint
+			if decodeErr = json.Unmarshal(batch.Value(i), &checkpoint); decodeErr != nil {
+				return false
+			}
+			reader := &shardReader{done: checkpoint.Done, saved: checkpoint}
+			if checkpoint.LastSequence != "" {
+				reader.lastSequence = aws.String(checkpoint.LastSequence)
+			}
+			readers[string(batch.RangeValue(i))] = reader
+		}
+		return true
+	})
+	if err == nil {
+		err = decodeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading checkpoints: %v", err)
+	}
+	return readers, nil
+}
+
+// saveCheckpoint stores where the mirror has got to in the shard, if it's
+// moved on.
+func (m *IndexMirror) saveCheckpoint(ctx context.Context, arn, shardID string, reader *shardReader) error {
+	checkpoint := reader.checkpoint()
+	if m.cfg.CheckpointTable == "" || checkpoint == reader.saved {
+		return nil
+	}
+	buf, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	batch := m.destination.NewWriteBatch()
+	batch.Add(m.cfg.CheckpointTable, arn, []byte(shardID), buf)
+	if err := m.destination.BatchWrite(ctx, batch); err != nil {
+		return fmt.Errorf("error saving checkpoint: %v", err)
+	}
+	reader.saved = checkpoint
+	return nil
+}
+
+// deleteCheckpoints deletes the checkpoints of shards which are no longer
+// read.
+func (m *IndexMirror) deleteCheckpoints(ctx context.Context, arn string, readers map[string]*shardReader) error {
+	if m.cfg.CheckpointTable == "" || len(readers) == 0 {
+		return nil
+	}
+	batch := m.destination.NewWriteBatch()
+	for id := range readers {
+		batch.Delete(m.cfg.CheckpointTable, arn, []byte(id))
+	}
+	return m.destination.BatchWrite(ctx, batch)
+}
+
+// describeShards returns the stream's shards, parents before children.
+func (m *IndexMirror) describeShards(ctx context.Context, arn string) ([]*dynamodbstreams.Shard, error) {
+	var (
+		shards []*dynamodbstreams.Shard
+		input  = &dynamodbstreams.DescribeStreamInput{StreamArn: aws.String(arn)}
+	)
+	for {
+		var out *dynamodbstreams.DescribeStreamOutput
+		if err := instrument.TimeRequestHistogram(ctx, "DynamoDBStreams.DescribeStream", dynamoStreamsRequestDuration, func(_ context.Context) error {
+			var err error
+			out, err = m.streams.DescribeStream(input)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		shards = append(shards, out.StreamDescription.Shards...)
+		if out.StreamDescription.LastEvaluatedShardId == nil {
+			return shards, nil
+		}
+		input.ExclusiveStartShardId = out.StreamDescription.LastEvaluatedShardId
+	}
+}
+
+func (m *IndexMirror) getShardIterator(ctx context.Context, arn, shardID, iteratorType string, reader *shardReader) error {
+	input := &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(arn),
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: aws.String(iteratorType),
+	}
+	if iteratorType == dynamodbstreams.ShardIteratorTypeAfterSequenceNumber {
+		input.SequenceNumber = reader.lastSequence
+	}
+	return instrument.TimeRequestHistogram(ctx, "DynamoDBStreams.GetShardIterator", dynamoStreamsRequestDuration, func(_ context.Context) error {
+		out, err := m.streams.GetShardIterator(input)
+		if err != nil {
+			return err
+		}
+		reader.iterator = out.ShardIterator
+		return nil
+	})
+}
+
+// readShard mirrors the shard's records until it's caught up.  A closed
+// shard is done once all its records are mirrored.
+func (m *IndexMirror) readShard(ctx context.Context, table, arn, shardID string, reader *shardReader) error {
+	for !reader.done {
+		if reader.iterator == nil {
+			reader.done = true
+			return nil
+		}
+		var out *dynamodbstreams.GetRecordsOutput
+		err := instrument.TimeRequestHistogram(ctx, "DynamoDBStreams.GetRecords", dynamoStreamsRequestDuration, func(_ context.Context) error {
+			var err error
+			out, err = m.streams.GetRecords(&dynamodbstreams.GetRecordsInput{ShardIterator: reader.iterator})
+			return err
+		})
+		// Iterators expire after 15 minutes, so if mirroring's been failing,
+		// pick up after the last mirrored record.
+		if isAWSErrorCode(err, expiredIteratorException) {
+			iteratorType := dynamodbstreams.ShardIteratorTypeAfterSequenceNumber
+			if reader.lastSequence == nil {
+				iteratorType = dynamodbstreams.ShardIteratorTypeTrimHorizon
+			}
+			if err := m.getShardIterator(ctx, arn, shardID, iteratorType, reader); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := m.mirrorRecords(ctx, table, out.Records); err != nil {
+			return err
+		}
+		if len(out.Records) > 0 {
+			reader.lastSequence = out.Records[len(out.Records)-1].Dynamodb.SequenceNumber
+		}
+		reader.iterator = out.NextShardIterator
+		// An open shard with no new records is caught up.
+		if len(out.Records) == 0 && reader.iterator != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// mirroredChange is the last change of an entry in a page of records.
+type mirroredChange struct {
+	remove            bool
+	hashValue         string
+	rangeValue, value []byte
+}
+
+// mirrorRecords writes the records' changes to the destination.  Only the
+// last change of each entry is written, as a batch can't have several.
+func (m *IndexMirror) mirrorRecords(ctx context.Context, table string, records []*dynamodbstreams.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	var (
+		changes []mirroredChange
+		index   = map[string]int{}
+		events  = map[string]int{}
+		latest  time.Time
+	)
+	for _, record := range records {
+		change := record.Dynamodb
+		if change == nil {
+			continue
+		}
+		event := aws.StringValue(record.EventName)
+		item := change.NewImage
+		if event == dynamodbstreams.OperationTypeRemove || item == nil {
+			item = change.Keys
+		}
+		hashValue, ok := item[hashKey]
+		if !ok || hashValue.S == nil {
+			continue
+		}
+		rangeValue, ok := item[rangeKey]
+		if !ok {
+			continue
+		}
+		mirrored := mirroredChange{
+			remove:     event == dynamodbstreams.OperationTypeRemove,
+			hashValue:  *hashValue.S,
+			rangeValue: rangeValue.B,
+		}
+		if v, ok := item[valueKey]; ok && !mirrored.remove {
+			mirrored.value = v.B
+		}
+		key := mirrored.hashValue + "\x00" + string(mirrored.rangeValue)
+		if i, ok := index[key]; ok {
+			changes[i] = mirrored
+		} else {
+			index[key] = len(changes)
+			changes = append(changes, mirrored)
+		}
+		events[strings.ToLower(event)]++
+		if t := change.ApproximateCreationDateTime; t != nil && t.After(latest) {
+			latest = *t
+		}
+	}
+	batch := m.destination.NewWriteBatch()
+	for _, change := range changes {
+		if change.remove {
+			batch.Delete(table, change.hashValue, change.rangeValue)
+		} else {
+			batch.Add(table, change.hashValue, change.rangeValue, change.value)
+		}
+	}
+	if err := m.destination.BatchWrite(ctx, batch); err != nil {
+		return err
+	}
+	for event, n := range events {
+		indexMirrorRecords.WithLabelValues(event).Add(float64(n))
+	}
+	if !latest.IsZero() {
+		indexMirrorLastRecord.Set(float64(latest.Unix()))
+	}
+	return nil
+}
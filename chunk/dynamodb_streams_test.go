@@ -0,0 +1,250 @@
+package chunk
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+const testStreamARN = "arn:aws:dynamodb:us-east-1:123456789012:table/cortex_1/stream/1"
+
+type mockStreamTables struct {
+	dynamodbiface.DynamoDBAPI
+	tables map[string]string
+}
+
+func (m mockStreamTables) ListTablesPages(_ *dynamodb.ListTablesInput, fn func(*dynamodb.ListTablesOutput, bool) bool) error {
+	out := &dynamodb.ListTablesOutput{}
+	for name := range m.tables {
+		out.TableNames = append(out.TableNames, aws.String(name))
+	}
+	fn(out, true)
+	return nil
+}
+
+func (m mockStreamTables) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	desc := &dynamodb.TableDescription{TableName: input.TableName}
+	if arn := m.tables[*input.TableName]; arn != "" {
+		desc.LatestStreamArn = aws.String(arn)
+	}
+	return &dynamodb.DescribeTableOutput{Table: desc}, nil
+}
+
+type mockShard struct {
+	id      string
+	records []*dynamodbstreams.Record
+	closed  bool
+}
+
+// mockStreams is a single stream, whose iterators are a shard ID and the
+// index of the next record.
+type mockStreams struct {
+	dynamodbstreamsiface.DynamoDBStreamsAPI
+	shards      []*mockShard
+	sequence    int
+	expireNext  bool
+	recordsPage int
+}
+
+func (m *mockStreams) shard(id string) *mockShard {
+	for _, s := range m.shards {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func (m *mockStreams) add(shardID, event, hashValue, rangeValue string) {
+	m.sequence++
+	item := map[string]*dynamodb.AttributeValue{
+		hashKey:  {S: aws.String(hashValue)},
+		rangeKey: {B: []byte(rangeValue)},
+	}
+	record := &dynamodbstreams.Record{
+		EventName: aws.String(event),
+		Dynamodb: &dynamodbstreams.StreamRecord{
+			Keys:           item,
+			SequenceNumber: aws.String(fmt.Sprintf("%021d", m.sequence)),
+		},
+	}
+	if event != dynamodbstreams.OperationTypeRemove {
+		record.Dynamodb.NewImage = map[string]*dynamodb.AttributeValue{
+			hashKey:  item[hashKey],
+			rangeKey: item[rangeKey],
+			valueKey: {B: []byte("value")},
+		}
+	}
+	s := m.shard(shardID)
+	s.records = append(s.records, record)
+}
+
+func (m *mockStreams) DescribeStream(input *dynamodbstreams.DescribeStreamInput) (*dynamodbstreams.DescribeStreamOutput, error) {
+	desc := &dynamodbstreams.StreamDescription{StreamArn: input.StreamArn}
+	for _, s := range m.shards {
+		desc.Shards = append(desc.Shards, &dynamodbstreams.Shard{ShardId: aws.String(s.id)})
+	}
+	return &dynamodbstreams.DescribeStreamOutput{StreamDescription: desc}, nil
+}
+
+func (m *mockStreams) GetShardIterator(input *dynamodbstreams.GetShardIteratorInput) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	s := m.shard(*input.ShardId)
+	var i int
+	switch *input.ShardIteratorType {
+	case dynamodbstreams.ShardIteratorTypeLatest:
+		i = len(s.records)
+	case dynamodbstreams.ShardIteratorTypeAfterSequenceNumber:
+		for i < len(s.records) && *s.records[i].Dynamodb.SequenceNumber <= *input.SequenceNumber {
+			i++
+		}
+	}
+	return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: aws.String(fmt.Sprintf("%s:%d", s.id, i))}, nil
+}
+
+func (m *mockStreams) GetRecords(input *dynamodbstreams.GetRecordsInput) (*dynamodbstreams.GetRecordsOutput, error) {
+	if m.expireNext {
+		m.expireNext = false
+		return nil, awserr.New(expiredIteratorException, "expired", nil)
+	}
+	parts := strings.SplitN(*input.ShardIterator, ":", 2)
+	s := m.shard(parts[0])
+	i, _ := strconv.Atoi(parts[1])
+	j := i + m.recordsPage
+	if j > len(s.records) {
+		j = len(s.records)
+	}
+	out := &dynamodbstreams.GetRecordsOutput{Records: s.records[i:j]}
+	if !s.closed || j < len(s.records) {
+		out.NextShardIterator = aws.String(fmt.Sprintf("%s:%d", s.id, j))
+	}
+	return out, nil
+}
+
+func mirroredEntries(t *testing.T, storage *MockStorage, hashValue string) []string {
+	var result []string
+	require.NoError(t, storage.QueryPages(context.Background(), IndexEntry{TableName: "cortex_1", HashValue: hashValue}, func(batch ReadBatch, _ bool) bool {
+		for i := 0; i < batch.Len(); i++ {
+			result = append(result, string(batch.RangeValue(i)))
+		}
+		return true
+	}))
+	return result
+}
+
+func TestIndexMirror(t *testing.T) {
+	ctx := context.Background()
+	tables := mockStreamTables{tables: map[string]string{"cortex_1": testStreamARN, "cortex_0": "", "other": testStreamARN}}
+	streams := &mockStreams{shards: []*mockShard{{id: "shard-a"}}, recordsPage: 2}
+	destination := NewMockStorage()
+	require.NoError(t, destination.CreateTable("cortex_1", 1, 1))
+	mirror := newIndexMirror(IndexMirrorConfig{TablePrefix: "cortex_"}, tables, streams, destination)
+
+	// Records from before the mirror started aren't mirrored.
+	streams.add("shard-a", dynamodbstreams.OperationTypeInsert, "hash", "before")
+	require.NoError(t, mirror.poll(ctx))
+	assert.Empty(t, mirroredEntries(t, destination, "hash"))
+
+	// Later ones are, over several pages.
+	for _, rangeValue := range []string{"a", "b", "c"} {
+		streams.add("shard-a", dynamodbstreams.OperationTypeInsert, "hash", rangeValue)
+	}
+	require.NoError(t, mirror.poll(ctx))
+	assert.Equal(t, []string{"a", "b", "c"}, mirroredEntries(t, destination, "hash"))
+
+	// Expired iterators pick up after the last mirrored record, and new
+	// shards are read from the start once their parents are closed.
+	streams.add("shard-a", dynamodbstreams.OperationTypeInsert, "hash", "d")
+	streams.shard("shard-a").closed = true
+	streams.shards = append(streams.shards, &mockShard{id: "shard-b"})
+	streams.add("shard-b", dynamodbstreams.OperationTypeRemove, "hash", "a")
+	streams.expireNext = true
+	require.NoError(t, mirror.poll(ctx))
+	assert.Equal(t, []string{"b", "c", "d"}, mirroredEntries(t, destination, "hash"))
+	assert.True(t, mirror.shards[testStreamARN]["shard-a"].done)
+
+	// Trimmed shards are forgotten.
+	streams.shards = streams.shards[1:]
+	require.NoError(t, mirror.poll(ctx))
+	assert.Len(t, mirror.shards[testStreamARN], 1)
+}
+
+func TestIndexMirrorResumesFromCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	tables := mockStreamTables{tables: map[string]string{"cortex_1": testStreamARN}}
+	streams := &mockStreams{shards: []*mockShard{{id: "shard-a"}}, recordsPage: 2}
+	destination := NewMockStorage()
+	require.NoError(t, destination.CreateTable("cortex_1", 1, 1))
+	require.NoError(t, destination.CreateTable("checkpoints", 1, 1))
+	cfg := IndexMirrorConfig{TablePrefix: "cortex_", CheckpointTable: "checkpoints"}
+
+	mirror := newIndexMirror(cfg, tables, streams, destination)
+	require.NoError(t, mirror.poll(ctx))
+	streams.add("shard-a", dynamodbstreams.OperationTypeInsert, "hash", "a")
+	require.NoError(t, mirror.poll(ctx))
+
+	// Records written while the mirror was down are mirrored after a
+	// restart, and those mirrored before aren't mirrored again.
+	streams.add("shard-a", dynamodbstreams.OperationTypeInsert, "hash", "b")
+	streams.add("shard-a", dynamodbstreams.OperationTypeRemove, "hash", "a")
+	streams.add("shard-a", dynamodbstreams.OperationTypeInsert, "hash", "a")
+	streams.recordsPage = 3
+	restarted := newIndexMirror(cfg, tables, streams, &uniqueBatchStorage{t: t, MockStorage: destination})
+	require.NoError(t, restarted.poll(ctx))
+	assert.Equal(t, []string{"a", "b"}, mirroredEntries(t, destination, "hash"))
+}
+
+// uniqueBatchStorage fails tests writing batches with several changes of an
+// entry, which DynamoDB rejects.
+type uniqueBatchStorage struct {
+	t *testing.T
+	*MockStorage
+}
+
+func (s *uniqueBatchStorage) BatchWrite(ctx context.Context, batch WriteBatch) error {
+	seen := map[string]bool{}
+	for _, req := range *batch.(*mockWriteBatch) {
+		key := req.tableName + "/" + req.hashValue + "/" + string(req.rangeValue)
+		require.False(s.t, seen[key], "several changes of %s in a batch", key)
+		seen[key] = true
+	}
+	return s.MockStorage.BatchWrite(ctx, batch)
+}
+
+type mockStreamClient struct {
+	*MockStorage
+	calls map[string]int
+}
+
+func (m *mockStreamClient) EnableStream(name string) (bool, error) {
+	m.calls[name]++
+	// Tables are only active the second time they're described.
+	return m.calls[name] > 1, nil
+}
+
+func TestDynamoTableManagerStreams(t *testing.T) {
+	client := &mockStreamClient{MockStorage: NewMockStorage(), calls: map[string]int{}}
+	cfg := TableManagerConfig{
+		OriginalTableName:          "index",
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		DeleteRequests:             DeleteRequestsConfig{TableName: "deletes"},
+		IndexStreams:               true,
+	}
+	tableManager, err := NewDynamoTableManager(cfg, client)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, tableManager.syncTables(context.Background()))
+	}
+	assert.Equal(t, map[string]int{"index": 2}, client.calls)
+}
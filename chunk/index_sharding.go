@@ -0,0 +1,402 @@
+package chunk
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// DynamoDB charges one write capacity unit per KB written, and one read
+// capacity unit per 4KB read by a query.
+const (
+	writeCapacityUnitBytes = 1024
+	readCapacityUnitBytes  = 4096
+)
+
+var recommendedIndexShardFactor = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "cortex",
+	Name:      "chunk_store_recommended_index_shard_factor",
+	Help:      "The number of rows the hottest index row of each user should be spread over, from the last index sharding report.",
+}, []string{"user"})
+
+func init() {
+	prometheus.MustRegister(recommendedIndexShardFactor)
+}
+
+// IndexShardingConfig configures the index sharding report, which samples
+// index writes and queries to find each user's hottest rows and recommends
+// how many rows they should be spread over.  Each row's share of its table's
+// sampled capacity is scaled by the capacity the table consumed, from
+// CloudWatch, if a CloudWatch URL is given.  The report only recommends: the
+// schemas have no per-user row sharding to apply it to.
+type IndexShardingConfig struct {
+	SampleRate      float64
+	ReportPeriod    time.Duration
+	MaxRowWriteRate float64
+	MaxRowReadRate  float64
+	MaxShardFactor  int
+	CloudWatch      util.URLValue
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *IndexShardingConfig) RegisterFlags(f *flag.FlagSet) {
+	f.Float64Var(&cfg.SampleRate, "store.index-sharding.sample-rate", 0, "Fraction of index writes and queries to sample for the index sharding report. 0 disables the report.")
+	f.DurationVar(&cfg.ReportPeriod, "store.index-sharding.report-period", time.Hour, "Period over which index writes and queries are sampled for each index sharding report.")
+	f.Float64Var(&cfg.MaxRowWriteRate, "store.index-sharding.max-row-write-rate", 300, "Write capacity units per second a single index row should take before it's recommended to shard it.")
+	f.Float64Var(&cfg.MaxRowReadRate, "store.index-sharding.max-row-read-rate", 900, "Read capacity units per second a single index row should take before it's recommended to shard it.")
+	f.IntVar(&cfg.MaxShardFactor, "store.index-sharding.max-shard-factor", 64, "Maximum shard factor to recommend.")
+	f.Var(&cfg.CloudWatch, "store.index-sharding.cloudwatch.url", "CloudWatch URL with escaped Key and Secret encoded, in the tables' region, to scale the report's rates by the ConsumedWriteCapacityUnits and ConsumedReadCapacityUnits of each table. If unset, rates are estimated from the sample rate.")
+}
+
+// Validate returns an error if the config can't be used.
+func (cfg *IndexShardingConfig) Validate() error {
+	if cfg.SampleRate > 0 && cfg.ReportPeriod <= 0 {
+		return fmt.Errorf("-store.index-sharding.report-period must be positive when sampling, got %v", cfg.ReportPeriod)
+	}
+	return nil
+}
+
+// IndexShardingRecommendation is the result of an index sharding report for
+// a single user.
+type IndexShardingRecommendation struct {
+	UserID string `json:"user_id"`
+	// The row taking the most capacity, relative to the max row rates, and
+	// its write and read capacity units per second.
+	HottestRow          string  `json:"hottest_row"`
+	HottestRowWriteRate float64 `json:"hottest_row_write_rate"`
+	HottestRowReadRate  float64 `json:"hottest_row_read_rate"`
+	SampledRows         int     `json:"sampled_rows"`
+	// The number of rows the hottest row should be spread over to bring it
+	// under the max row rates.
+	ShardFactor int `json:"shard_factor"`
+}
+
+// IndexShardingReport holds the recommendations for the users whose index
+// writes and queries were sampled in a period, hottest first.
+// ConsumedCapacity is whether rates were scaled by the tables' consumed
+// capacity from CloudWatch, rather than estimated from the sample rate.
+type IndexShardingReport struct {
+	From             time.Time                     `json:"from"`
+	Through          time.Time                     `json:"through"`
+	ConsumedCapacity bool                          `json:"consumed_capacity"`
+	Recommendations  []IndexShardingRecommendation `json:"recommendations"`
+}
+
+// capacityUnits are sampled capacity units, or units per second.
+type capacityUnits struct {
+	write, read float64
+}
+
+type rowSample struct {
+	table string
+	capacityUnits
+}
+
+// indexSample is the capacity units sampled in a period, by user and row,
+// and in total by table.
+type indexSample struct {
+	start  time.Time
+	rows   map[string]map[string]*rowSample
+	tables map[string]*capacityUnits
+}
+
+func newIndexSample(start time.Time) *indexSample {
+	return &indexSample{
+		start:  start,
+		rows:   map[string]map[string]*rowSample{},
+		tables: map[string]*capacityUnits{},
+	}
+}
+
+// capacityMetrics returns the capacity units per second tables consumed.
+type capacityMetrics interface {
+	consumedCapacity(ctx context.Context, table string, from, through time.Time) (capacityUnits, error)
+}
+
+type indexShardingReporter struct {
+	cfg      IndexShardingConfig
+	consumed capacityMetrics
+	quit     chan struct{}
+	done     chan struct{}
+
+	mtx    sync.Mutex
+	rand   *rand.Rand
+	sample *indexSample
+	report *IndexShardingReport
+}
+
+func newIndexShardingReporter(cfg IndexShardingConfig) (*indexShardingReporter, error) {
+	var consumed capacityMetrics
+	if cfg.CloudWatch.URL != nil {
+		config, err := awsConfigFromURL(cfg.CloudWatch.URL, "")
+		if err != nil {
+			return nil, err
+		}
+		consumed = cloudWatchCapacity{cloudwatch.New(session.New(config))}
+	}
+	r := &indexShardingReporter{
+		cfg:      cfg,
+		consumed: consumed,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		sample:   newIndexSample(time.Now()),
+	}
+	go r.loop()
+	return r, nil
+}
+
+func (r *indexShardingReporter) stop() {
+	close(r.quit)
+	<-r.done
+}
+
+func (r *indexShardingReporter) loop() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.cfg.ReportPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			r.rotate(now)
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// observeWrite samples a write of an index entry of the given size.
+func (r *indexShardingReporter) observeWrite(userID, table, hashValue string, size int) {
+	r.observe(userID, table, hashValue, capacityUnits{write: math.Ceil(float64(size) / writeCapacityUnitBytes)})
+}
+
+// observeRead samples a page of query results of the given size.
+func (r *indexShardingReporter) observeRead(userID, table, hashValue string, size int) {
+	r.observe(userID, table, hashValue, capacityUnits{read: math.Max(1, math.Ceil(float64(size)/readCapacityUnitBytes))})
+}
+
+func (r *indexShardingReporter) observe(userID, table, hashValue string, units capacityUnits) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.rand.Float64() >= r.cfg.SampleRate {
+		return
+	}
+	rows, ok := r.sample.rows[userID]
+	if !ok {
+		rows = map[string]*rowSample{}
+		r.sample.rows[userID] = rows
+	}
+	row, ok := rows[hashValue]
+	if !ok {
+		row = &rowSample{table: table}
+		rows[hashValue] = row
+	}
+	row.write += units.write
+	row.read += units.read
+
+	total, ok := r.sample.tables[table]
+	if !ok {
+		total = &capacityUnits{}
+		r.sample.tables[table] = total
+	}
+	total.write += units.write
+	total.read += units.read
+}
+
+// rotate finishes the report for the current period and starts a new one.
+func (r *indexShardingReporter) rotate(now time.Time) {
+	r.mtx.Lock()
+	sample := r.sample
+	r.sample = newIndexSample(now)
+	r.mtx.Unlock()
+
+	// The sample is no longer written to, so CloudWatch is queried without
+	// the lock held.
+	report := r.build(sample, now, r.consumed)
+	r.mtx.Lock()
+	r.report = &report
+	r.mtx.Unlock()
+
+	recommendedIndexShardFactor.Reset()
+	for _, rec := range report.Recommendations {
+		recommendedIndexShardFactor.WithLabelValues(rec.UserID).Set(float64(rec.ShardFactor))
+		if rec.ShardFactor > 1 {
+			log.Infof("Index row %q of user %s takes %.1f writes/s and %.1f reads/s; recommend a shard factor of %d", rec.HottestRow, rec.UserID, rec.HottestRowWriteRate, rec.HottestRowReadRate, rec.ShardFactor)
+		}
+	}
+}
+
+// scales returns the capacity units per second each sampled unit of each
+// table stands for: its share of the capacity the table consumed if
+// consumed is set, or else 1/(sample rate * seconds).
+func (r *indexShardingReporter) scales(sample *indexSample, now time.Time, consumed capacityMetrics) (map[string]capacityUnits, bool) {
+	seconds := now.Sub(sample.start).Seconds()
+	estimate := capacityUnits{write: 1 / r.cfg.SampleRate / seconds, read: 1 / r.cfg.SampleRate / seconds}
+	scales := make(map[string]capacityUnits, len(sample.tables))
+	scaled := consumed != nil
+	for table, total := range sample.tables {
+		scales[table] = estimate
+		if consumed == nil {
+			continue
+		}
+		rates, err := consumed.consumedCapacity(context.Background(), table, sample.start, now)
+		if err != nil {
+			log.Warnf("Error getting consumed capacity of table %s, estimating the index sharding report from the sample rate: %v", table, err)
+			scaled = false
+			continue
+		}
+		var scale capacityUnits
+		if total.write > 0 {
+			scale.write = rates.write / total.write
+		}
+		if total.read > 0 {
+			scale.read = rates.read / total.read
+		}
+		scales[table] = scale
+	}
+	return scales, scaled
+}
+
+// build reports on the sample up to now.  It must be called with the lock
+// held if the sample is still being written to.
+func (r *indexShardingReporter) build(sample *indexSample, now time.Time, consumed capacityMetrics) IndexShardingReport {
+	report := IndexShardingReport{
+		From:            sample.start,
+		Through:         now,
+		Recommendations: []IndexShardingRecommendation{},
+	}
+	if now.Sub(sample.start) <= 0 || r.cfg.SampleRate <= 0 {
+		return report
+	}
+
+	scales, scaled := r.scales(sample, now, consumed)
+	report.ConsumedCapacity = scaled
+	load := func(rate capacityUnits) float64 {
+		return math.Max(ratio(rate.write, r.cfg.MaxRowWriteRate), ratio(rate.read, r.cfg.MaxRowReadRate))
+	}
+	for userID, rows := range sample.rows {
+		rec := IndexShardingRecommendation{
+			UserID:      userID,
+			SampledRows: len(rows),
+		}
+		var hottest capacityUnits
+		for hashValue, row := range rows {
+			scale := scales[row.table]
+			rate := capacityUnits{write: row.write * scale.write, read: row.read * scale.read}
+			if l, h := load(rate), load(hottest); rec.HottestRow == "" || l > h || (l == h && hashValue < rec.HottestRow) {
+				hottest, rec.HottestRow = rate, hashValue
+			}
+		}
+		rec.HottestRowWriteRate, rec.HottestRowReadRate = hottest.write, hottest.read
+		rec.ShardFactor = shardFactor(load(hottest), 1, r.cfg.MaxShardFactor)
+		report.Recommendations = append(report.Recommendations, rec)
+	}
+	sort.Slice(report.Recommendations, func(i, j int) bool {
+		a, b := report.Recommendations[i], report.Recommendations[j]
+		la := load(capacityUnits{write: a.HottestRowWriteRate, read: a.HottestRowReadRate})
+		lb := load(capacityUnits{write: b.HottestRowWriteRate, read: b.HottestRowReadRate})
+		if la != lb {
+			return la > lb
+		}
+		return a.UserID < b.UserID
+	})
+	return report
+}
+
+// ratio is rate as a fraction of max, or 0 if there's no max.
+func ratio(rate, max float64) float64 {
+	if max <= 0 {
+		return 0
+	}
+	return rate / max
+}
+
+// shardFactor is the smallest power of two number of rows which brings the
+// write rate of each under the max.  Powers of two let a future shard factor
+// be raised without moving every series of a row.
+func shardFactor(rate, maxRate float64, maxFactor int) int {
+	factor := 1
+	for maxRate > 0 && rate/float64(factor) > maxRate && factor < maxFactor {
+		factor *= 2
+	}
+	if maxFactor > 0 && factor > maxFactor {
+		factor = maxFactor
+	}
+	return factor
+}
+
+// ServeHTTP serves the last complete report, or the report so far, estimated
+// from the sample rate, if there isn't one yet.
+func (r *indexShardingReporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mtx.Lock()
+	var report IndexShardingReport
+	if r.report != nil {
+		report = *r.report
+	} else {
+		report = r.build(r.sample, time.Now(), nil)
+	}
+	r.mtx.Unlock()
+	util.WriteJSONResponse(w, report)
+}
+
+// cloudWatchCapacity gets the capacity DynamoDB tables consumed from their
+// CloudWatch metrics.
+type cloudWatchCapacity struct {
+	cloudwatchiface.CloudWatchAPI
+}
+
+func (c cloudWatchCapacity) consumedCapacity(ctx context.Context, table string, from, through time.Time) (capacityUnits, error) {
+	write, err := c.rate(ctx, table, "ConsumedWriteCapacityUnits", from, through)
+	if err != nil {
+		return capacityUnits{}, err
+	}
+	read, err := c.rate(ctx, table, "ConsumedReadCapacityUnits", from, through)
+	if err != nil {
+		return capacityUnits{}, err
+	}
+	return capacityUnits{write: write, read: read}, nil
+}
+
+// rate returns the metric's sum over the range, per second.  CloudWatch
+// returns at most 1440 datapoints, so long ranges take longer periods.
+func (c cloudWatchCapacity) rate(ctx context.Context, table, metricName string, from, through time.Time) (float64, error) {
+	seconds := through.Sub(from).Seconds()
+	period := 60 * int64(math.Ceil(seconds/60/1440))
+	if period < 60 {
+		period = 60
+	}
+	req, resp := c.GetMetricStatisticsRequest(&cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/DynamoDB"),
+		MetricName: aws.String(metricName),
+		Dimensions: []*cloudwatch.Dimension{{Name: aws.String("TableName"), Value: aws.String(table)}},
+		StartTime:  aws.Time(from),
+		EndTime:    aws.Time(through),
+		Period:     aws.Int64(period),
+		Statistics: []*string{aws.String(cloudwatch.StatisticSum)},
+	})
+	if err := send(ctx, req); err != nil {
+		return 0, err
+	}
+	var sum float64
+	for _, datapoint := range resp.Datapoints {
+		if datapoint.Sum != nil {
+			sum += *datapoint.Sum
+		}
+	}
+	return sum / seconds, nil
+}
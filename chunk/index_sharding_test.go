@@ -0,0 +1,149 @@
+package chunk
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestShardFactor(t *testing.T) {
+	for _, tc := range []struct {
+		rate, maxRate float64
+		maxFactor     int
+		expected      int
+	}{
+		{rate: 0, maxRate: 300, maxFactor: 64, expected: 1},
+		{rate: 300, maxRate: 300, maxFactor: 64, expected: 1},
+		{rate: 301, maxRate: 300, maxFactor: 64, expected: 2},
+		{rate: 1000, maxRate: 300, maxFactor: 64, expected: 4},
+		{rate: 1e9, maxRate: 300, maxFactor: 64, expected: 64},
+		{rate: 1e9, maxRate: 300, maxFactor: 48, expected: 48},
+	} {
+		assert.Equal(t, tc.expected, shardFactor(tc.rate, tc.maxRate, tc.maxFactor), "%+v", tc)
+	}
+}
+
+func TestIndexShardingReport(t *testing.T) {
+	r, err := newIndexShardingReporter(IndexShardingConfig{
+		SampleRate:      1,
+		ReportPeriod:    time.Hour,
+		MaxRowWriteRate: 10,
+		MaxRowReadRate:  30,
+		MaxShardFactor:  64,
+	})
+	require.NoError(t, err)
+	defer r.stop()
+
+	start := time.Unix(0, 0)
+	r.sample = newIndexSample(start)
+	for i := 0; i < 1000; i++ {
+		r.observeWrite("hot", "index_1", "hot:d1:foo", 100)
+		r.observeWrite("hot", "index_1", "hot:d1:bar", 100)
+	}
+	for i := 0; i < 10; i++ {
+		// Entries over 1KB count as more than one write.
+		r.observeWrite("cold", "index_1", "cold:d1:foo", 1500)
+	}
+	for i := 0; i < 60; i++ {
+		// Pages of query results count a read per 4KB.
+		r.observeRead("reader", "index_1", "reader:d1:foo", 5000)
+	}
+	r.rotate(start.Add(10 * time.Second))
+
+	report := r.report
+	require.NotNil(t, report)
+	assert.False(t, report.ConsumedCapacity)
+	require.Len(t, report.Recommendations, 3)
+
+	hot := report.Recommendations[0]
+	assert.Equal(t, "hot", hot.UserID)
+	assert.Equal(t, "hot:d1:bar", hot.HottestRow)
+	assert.Equal(t, 2, hot.SampledRows)
+	assert.Equal(t, 100.0, hot.HottestRowWriteRate)
+	assert.Equal(t, 16, hot.ShardFactor)
+
+	reader := report.Recommendations[1]
+	assert.Equal(t, "reader", reader.UserID)
+	assert.Equal(t, 0.0, reader.HottestRowWriteRate)
+	assert.Equal(t, 12.0, reader.HottestRowReadRate)
+	assert.Equal(t, 1, reader.ShardFactor)
+
+	cold := report.Recommendations[2]
+	assert.Equal(t, "cold", cold.UserID)
+	assert.Equal(t, 2.0, cold.HottestRowWriteRate)
+	assert.Equal(t, 1, cold.ShardFactor)
+
+	// The next period starts empty.
+	assert.Empty(t, r.build(r.sample, start.Add(20*time.Second), nil).Recommendations)
+}
+
+type fakeCapacityMetrics map[string]capacityUnits
+
+func (f fakeCapacityMetrics) consumedCapacity(_ context.Context, table string, _, _ time.Time) (capacityUnits, error) {
+	rates, ok := f[table]
+	if !ok {
+		return capacityUnits{}, fmt.Errorf("no metrics for table %s", table)
+	}
+	return rates, nil
+}
+
+func TestIndexShardingReportConsumedCapacity(t *testing.T) {
+	r, err := newIndexShardingReporter(IndexShardingConfig{
+		SampleRate:      0.5,
+		ReportPeriod:    time.Hour,
+		MaxRowWriteRate: 100,
+		MaxRowReadRate:  300,
+		MaxShardFactor:  64,
+	})
+	require.NoError(t, err)
+	defer r.stop()
+
+	// Rows' shares of their table's sampled capacity are scaled by what the
+	// table consumed, across every process writing to it, so the sample
+	// rate doesn't matter.
+	start := time.Unix(0, 0)
+	sample := newIndexSample(start)
+	// Sample every write and read, then report as if half were sampled.
+	r.sample, r.cfg.SampleRate = sample, 1
+	for i := 0; i < 30; i++ {
+		r.observeWrite("user1", "index_1", "user1:d1:foo", 100)
+	}
+	for i := 0; i < 10; i++ {
+		r.observeWrite("user1", "index_1", "user1:d1:bar", 100)
+		r.observeRead("user1", "index_1", "user1:d1:bar", 100)
+		r.observeWrite("user2", "index_2", "user2:d1:foo", 100)
+	}
+	r.cfg.SampleRate = 0.5
+	report := r.build(sample, start.Add(10*time.Second), fakeCapacityMetrics{
+		"index_1": {write: 1000, read: 500},
+		"index_2": {write: 50},
+	})
+	assert.True(t, report.ConsumedCapacity)
+	require.Len(t, report.Recommendations, 2)
+
+	user1 := report.Recommendations[0]
+	assert.Equal(t, "user1", user1.UserID)
+	assert.Equal(t, "user1:d1:foo", user1.HottestRow)
+	assert.Equal(t, 750.0, user1.HottestRowWriteRate)
+	assert.Equal(t, 8, user1.ShardFactor)
+
+	user2 := report.Recommendations[1]
+	assert.Equal(t, "user2", user2.UserID)
+	assert.Equal(t, 50.0, user2.HottestRowWriteRate)
+	assert.Equal(t, 1, user2.ShardFactor)
+
+	// Tables without metrics fall back to the sample rate.
+	report = r.build(sample, start.Add(10*time.Second), fakeCapacityMetrics{})
+	assert.False(t, report.ConsumedCapacity)
+	assert.Equal(t, 6.0, report.Recommendations[0].HottestRowWriteRate)
+}
+
+func TestIndexShardingConfigValidate(t *testing.T) {
+	assert.NoError(t, (&IndexShardingConfig{}).Validate())
+	assert.NoError(t, (&IndexShardingConfig{SampleRate: 0.1, ReportPeriod: time.Hour}).Validate())
+	assert.Error(t, (&IndexShardingConfig{SampleRate: 0.1}).Validate())
+}
@@ -4,18 +4,27 @@ import (
 	"bytes"
 	"fmt"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/prometheus/common/log"
 	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 // MockStorage is a fake in-memory StorageClient.
 type MockStorage struct {
 	mtx     sync.RWMutex
 	tables  map[string]*mockTable
-	objects map[string][]byte
+	objects map[string]mockObject
+}
+
+type mockObject struct {
+	buf          []byte
+	lastModified time.Time
 }
 
 type mockTable struct {
@@ -32,7 +41,7 @@ type mockItem struct {
 func NewMockStorage() *MockStorage {
 	return &MockStorage{
 		tables:  map[string]*mockTable{},
-		objects: map[string][]byte{},
+		objects: map[string]mockObject{},
 	}
 }
 
@@ -97,6 +106,19 @@ func (m *MockStorage) UpdateTable(name string, readCapacity, writeCapacity int64
 	return nil
 }
 
+// DeleteTable implements StorageClient.
+func (m *MockStorage) DeleteTable(name string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if _, ok := m.tables[name]; !ok {
+		return fmt.Errorf("not found")
+	}
+	delete(m.tables, name)
+
+	return nil
+}
+
 // NewWriteBatch implements StorageClient.
 func (m *MockStorage) NewWriteBatch() WriteBatch {
 	return &mockWriteBatch{}
@@ -113,30 +135,77 @@ func (m *MockStorage) BatchWrite(ctx context.Context, batch WriteBatch) error {
 			return fmt.Errorf("table not found")
 		}
 
-		log.Debugf("Write %s/%x", req.hashValue, req.rangeValue)
-
 		items := table.items[req.hashValue]
 
 		// insert in order
 		i := sort.Search(len(items), func(i int) bool {
 			return bytes.Compare(items[i].rangeValue, req.rangeValue) >= 0
 		})
-		if i >= len(items) || !bytes.Equal(items[i].rangeValue, req.rangeValue) {
-			items = append(items, mockItem{})
-			copy(items[i+1:], items[i:])
-		} else {
-			return fmt.Errorf("Dupe write")
+		exists := i < len(items) && bytes.Equal(items[i].rangeValue, req.rangeValue)
+
+		if req.delete {
+			log.Debugf("Delete %s/%x", req.hashValue, req.rangeValue)
+			if exists {
+				items = append(items[:i], items[i+1:]...)
+			}
+			if len(items) == 0 {
+				delete(table.items, req.hashValue)
+			} else {
+				table.items[req.hashValue] = items
+			}
+			continue
 		}
-		items[i] = mockItem{
+
+		// Like DynamoDB, writing an existing item replaces it.
+		log.Debugf("Write %s/%x", req.hashValue, req.rangeValue)
+		item := mockItem{
 			rangeValue: req.rangeValue,
 			value:      req.value,
 		}
+		if exists {
+			items[i] = item
+			continue
+		}
+		items = append(items, mockItem{})
+		copy(items[i+1:], items[i:])
+		items[i] = item
 
 		table.items[req.hashValue] = items
 	}
 	return nil
 }
 
+// ScanTable implements StorageClient.
+func (m *MockStorage) ScanTable(ctx context.Context, tableName string, callback func(hashValue string, rangeValue []byte, value []byte) (shouldContinue bool)) error {
+	// Copy the items, so the callback can write to the table, as it can
+	// with DynamoDB.
+	type scanItem struct {
+		hashValue string
+		mockItem
+	}
+	var items []scanItem
+	m.mtx.RLock()
+	table, ok := m.tables[tableName]
+	if ok {
+		for hashValue, hashItems := range table.items {
+			for _, item := range hashItems {
+				items = append(items, scanItem{hashValue, item})
+			}
+		}
+	}
+	m.mtx.RUnlock()
+	if !ok {
+		return fmt.Errorf("table not found")
+	}
+
+	for _, item := range items {
+		if !callback(item.hashValue, item.rangeValue, item.value) {
+			return nil
+		}
+	}
+	return nil
+}
+
 // QueryPages implements StorageClient.
 func (m *MockStorage) QueryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error {
 	m.mtx.RLock()
@@ -207,7 +276,7 @@ func (m *MockStorage) PutChunk(_ context.Context, key string, buf []byte) error
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	m.objects[key] = buf
+	m.objects[key] = mockObject{buf: buf, lastModified: mtime.Now()}
 	return nil
 }
 
@@ -216,26 +285,74 @@ func (m *MockStorage) GetChunk(_ context.Context, key string) ([]byte, error) {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
 
-	buf, ok := m.objects[key]
+	object, ok := m.objects[key]
 	if !ok {
-		return nil, fmt.Errorf("%v not found", key)
+		return nil, ErrChunkNotFound
 	}
 
-	return buf, nil
+	return object.buf, nil
 }
 
-type mockWriteBatch []struct {
+// GetChunkRange implements StorageClient.
+func (m *MockStorage) GetChunkRange(ctx context.Context, key string, offset, length int) ([]byte, error) {
+	buf, err := m.GetChunk(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset+length > len(buf) {
+		return nil, fmt.Errorf("range %d+%d out of bounds of %s", offset, length, key)
+	}
+	return buf[offset : offset+length], nil
+}
+
+// ListChunks implements StorageClient.
+func (m *MockStorage) ListChunks(_ context.Context, prefix string, callback func(key string, lastModified time.Time) (shouldContinue bool)) error {
+	// Copy the keys, so the callback can delete chunks, as it can with S3.
+	m.mtx.RLock()
+	keys := make([]string, 0, len(m.objects))
+	lastModified := make(map[string]time.Time, len(m.objects))
+	for key, object := range m.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		keys = append(keys, key)
+		lastModified[key] = object.lastModified
+	}
+	m.mtx.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !callback(key, lastModified[key]) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// DeleteChunk implements S3Client.
+func (m *MockStorage) DeleteChunk(_ context.Context, key string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	delete(m.objects, key)
+	return nil
+}
+
+type mockWriteBatch []mockWrite
+
+type mockWrite struct {
 	tableName, hashValue string
 	rangeValue           []byte
 	value                []byte
+	delete               bool
 }
 
 func (b *mockWriteBatch) Add(tableName, hashValue string, rangeValue []byte, value []byte) {
-	*b = append(*b, struct {
-		tableName, hashValue string
-		rangeValue           []byte
-		value                []byte
-	}{tableName, hashValue, rangeValue, value})
+	*b = append(*b, mockWrite{tableName, hashValue, rangeValue, value, false})
+}
+
+func (b *mockWriteBatch) Delete(tableName, hashValue string, rangeValue []byte) {
+	*b = append(*b, mockWrite{tableName: tableName, hashValue: hashValue, rangeValue: rangeValue, delete: true})
 }
 
 type mockReadBatch []mockItem
@@ -0,0 +1,120 @@
+package chunk
+
+import (
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+// IndexRow is an index entry as stored, for inspecting the index.
+type IndexRow struct {
+	TableName  string
+	HashValue  string
+	RangeValue []byte
+	LabelValue model.LabelValue
+	// ChunkKey is the external key of the chunk the entry points at.
+	ChunkKey string
+}
+
+// IndexRows returns the index entries which Get reads for the matchers
+// between from and through, without fetching the chunks they point at.
+// Entries whose label value doesn't match are left out, as Get ignores them.
+func (c *Store) IndexRows(ctx context.Context, from, through model.Time, allMatchers ...*metric.LabelMatcher) ([]IndexRow, error) {
+	_, matchers := util.SplitFiltersAndMatchers(allMatchers)
+	metricName, matchers, err := util.ExtractMetricNameFromMatchers(matchers)
+	if err != nil {
+		return nil, err
+	}
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []IndexRow
+	lookup := func(entries []IndexEntry, matcher *metric.LabelMatcher) error {
+		for _, entry := range entries {
+			var processingError error
+			if err := c.storage.QueryPages(ctx, entry, func(resp ReadBatch, lastPage bool) bool {
+				for i := 0; i < resp.Len(); i++ {
+					chunkID, labelValue, _, err := parseRangeValue(entry.HashValue, resp.RangeValue(i), resp.Value(i))
+					if err != nil {
+						processingError = err
+						return false
+					}
+					if matcher != nil && !matcher.Match(labelValue) {
+						continue
+					}
+					chunk, err := parseExternalKey(userID, chunkID)
+					if err != nil {
+						processingError = err
+						return false
+					}
+					rows = append(rows, IndexRow{
+						TableName:  entry.TableName,
+						HashValue:  entry.HashValue,
+						RangeValue: resp.RangeValue(i),
+						LabelValue: labelValue,
+						ChunkKey:   chunk.externalKey(),
+					})
+				}
+				return !lastPage
+			}); err != nil {
+				return err
+			} else if processingError != nil {
+				return processingError
+			}
+		}
+		return nil
+	}
+
+	if len(matchers) == 0 {
+		entries, err := c.schema.GetReadEntriesForMetric(from, through, userID, metricName)
+		if err != nil {
+			return nil, err
+		}
+		return rows, lookup(entries, nil)
+	}
+	for _, matcher := range matchers {
+		var entries []IndexEntry
+		if matcher.Type != metric.Equal {
+			entries, err = c.schema.GetReadEntriesForMetricLabel(from, through, userID, metricName, matcher.Name)
+		} else {
+			entries, err = c.schema.GetReadEntriesForMetricLabelValue(from, through, userID, metricName, matcher.Name, matcher.Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := lookup(entries, matcher); err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// FetchChunk fetches and decodes the chunk with the given external key from
+// the object store, bypassing the cache.
+func (c *Store) FetchChunk(ctx context.Context, key string) (Chunk, error) {
+	chunk, err := ParseKey(key)
+	if err != nil {
+		return Chunk{}, err
+	}
+	chunks, err := c.fetchChunkData(ctx, []Chunk{chunk})
+	if err != nil {
+		return Chunk{}, err
+	}
+	return chunks[0], nil
+}
+
+// DeleteChunk deletes the chunk with the given external key, and its index
+// entries.  The chunk is fetched to find its index entries, so it must
+// decode; the cache may keep serving it until it's evicted.
+func (c *Store) DeleteChunk(ctx context.Context, key string) error {
+	chunk, err := c.FetchChunk(ctx, key)
+	if err != nil {
+		return err
+	}
+	return c.deleteChunk(ctx, chunk.UserID, chunk)
+}
@@ -0,0 +1,69 @@
+package chunk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+func TestParseKey(t *testing.T) {
+	for key, expected := range map[string]Chunk{
+		"user1/1f:2a:3b:4c": {UserID: "user1", Fingerprint: 0x1f, From: 0x2a, Through: 0x3b, Checksum: 0x4c, ChecksumSet: true},
+		"user1/31:42:59":    {UserID: "user1", Fingerprint: 31, From: 42, Through: 59},
+	} {
+		c, err := ParseKey(key)
+		require.NoError(t, err, key)
+		assert.Equal(t, expected, c, key)
+		assert.Equal(t, key, c.externalKey())
+	}
+	for _, key := range []string{"", "user1", "user1/1:2", "rules/1/recording.rules"} {
+		_, err := ParseKey(key)
+		assert.Error(t, err, key)
+	}
+}
+
+func TestInspectStore(t *testing.T) {
+	_, store := newDeletesTestStore(t)
+	ctx := user.Inject(context.Background(), "user1")
+
+	now := model.Now()
+	chunks := []Chunk{chunkOf(t, "user1", now.Add(-time.Hour), now)}
+	require.NoError(t, store.Put(ctx, chunks))
+	key := chunks[0].externalKey()
+
+	rows, err := store.IndexRows(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	require.NoError(t, err)
+	require.NotEmpty(t, rows)
+	for _, row := range rows {
+		assert.Equal(t, key, row.ChunkKey)
+	}
+	rows, err = store.IndexRows(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), mustNewLabelMatcher(metric.Equal, "bar", "baz"))
+	require.NoError(t, err)
+	require.NotEmpty(t, rows)
+	assert.Equal(t, model.LabelValue("baz"), rows[0].LabelValue)
+	rows, err = store.IndexRows(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), mustNewLabelMatcher(metric.RegexMatch, "bar", "q.*"))
+	require.NoError(t, err)
+	assert.Empty(t, rows)
+
+	c, err := store.FetchChunk(context.Background(), key)
+	require.NoError(t, err)
+	assert.Equal(t, chunks[0].Metric, c.Metric)
+	matrix, err := ChunksToMatrix([]Chunk{c})
+	require.NoError(t, err)
+	require.Len(t, matrix, 1)
+	assert.Len(t, matrix[0].Values, 61)
+
+	require.NoError(t, store.DeleteChunk(context.Background(), key))
+	_, err = store.FetchChunk(context.Background(), key)
+	assert.Error(t, err)
+	rows, err = store.IndexRows(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	require.NoError(t, err)
+	assert.Empty(t, rows)
+}
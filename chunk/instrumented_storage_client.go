@@ -0,0 +1,110 @@
+package chunk
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+)
+
+var storageRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "cortex",
+	Name:      "storage_request_duration_seconds",
+	Help:      "Time spent in chunk storage operations, including retries and, for queries, every page.",
+	Buckets:   prometheus.ExponentialBuckets(0.000128, 4, 8),
+}, []string{"backend", "operation", "status_code"})
+
+func init() {
+	prometheus.MustRegister(storageRequestDuration)
+}
+
+// instrumentedStorageClient records the duration of every operation on a
+// StorageClient, so all backends report the same metrics.
+type instrumentedStorageClient struct {
+	StorageClient
+	backend string
+}
+
+func newInstrumentedStorageClient(backend string, client StorageClient) StorageClient {
+	return instrumentedStorageClient{
+		StorageClient: client,
+		backend:       backend,
+	}
+}
+
+func (c instrumentedStorageClient) BatchWrite(ctx context.Context, batch WriteBatch) error {
+	return c.observe("BatchWrite", func() error {
+		return c.StorageClient.BatchWrite(ctx, batch)
+	})
+}
+
+func (c instrumentedStorageClient) QueryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error {
+	return c.observe("QueryPages", func() error {
+		return c.StorageClient.QueryPages(ctx, entry, callback)
+	})
+}
+
+func (c instrumentedStorageClient) PutChunk(ctx context.Context, key string, data []byte) error {
+	return c.observe("PutChunk", func() error {
+		return c.StorageClient.PutChunk(ctx, key, data)
+	})
+}
+
+func (c instrumentedStorageClient) GetChunk(ctx context.Context, key string) ([]byte, error) {
+	var buf []byte
+	err := c.observe("GetChunk", func() error {
+		var err error
+		buf, err = c.StorageClient.GetChunk(ctx, key)
+		return err
+	})
+	return buf, err
+}
+
+func (c instrumentedStorageClient) GetChunkRange(ctx context.Context, key string, offset, length int) ([]byte, error) {
+	var buf []byte
+	err := c.observe("GetChunkRange", func() error {
+		var err error
+		buf, err = c.StorageClient.GetChunkRange(ctx, key, offset, length)
+		return err
+	})
+	return buf, err
+}
+
+func (c instrumentedStorageClient) ScanTable(ctx context.Context, tableName string, callback func(hashValue string, rangeValue []byte, value []byte) (shouldContinue bool)) error {
+	return c.observe("ScanTable", func() error {
+		return c.StorageClient.ScanTable(ctx, tableName, callback)
+	})
+}
+
+func (c instrumentedStorageClient) ListChunks(ctx context.Context, prefix string, callback func(key string, lastModified time.Time) (shouldContinue bool)) error {
+	return c.observe("ListChunks", func() error {
+		return c.StorageClient.ListChunks(ctx, prefix, callback)
+	})
+}
+
+func (c instrumentedStorageClient) DeleteChunk(ctx context.Context, key string) error {
+	return c.observe("DeleteChunk", func() error {
+		return c.StorageClient.DeleteChunk(ctx, key)
+	})
+}
+
+func (c instrumentedStorageClient) observe(operation string, f func() error) error {
+	start := time.Now()
+	err := f()
+	storageRequestDuration.WithLabelValues(c.backend, operation, statusCode(err)).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// statusCode returns the HTTP status code of err if the backend gave one,
+// e.g. for throttling, and 200 or 500 otherwise.
+func statusCode(err error) string {
+	if e, ok := err.(interface {
+		StatusCode() int
+	}); ok {
+		return strconv.Itoa(e.StatusCode())
+	}
+	return instrument.ErrorCode(err)
+}
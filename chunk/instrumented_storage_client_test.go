@@ -0,0 +1,41 @@
+package chunk
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func requestCount(t *testing.T, labels ...string) uint64 {
+	m := &dto.Metric{}
+	require.NoError(t, storageRequestDuration.WithLabelValues(labels...).(prometheus.Histogram).Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestInstrumentedStorageClient(t *testing.T) {
+	storage := NewMockStorage()
+	client := newInstrumentedStorageClient("test", storage)
+	ctx := context.Background()
+
+	require.NoError(t, client.PutChunk(ctx, "chunk", []byte("data")))
+	buf, err := client.GetChunk(ctx, "chunk")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), buf)
+	assert.Error(t, client.QueryPages(ctx, IndexEntry{TableName: "missing"}, func(ReadBatch, bool) bool { return true }))
+
+	assert.Equal(t, uint64(1), requestCount(t, "test", "PutChunk", "200"))
+	assert.Equal(t, uint64(1), requestCount(t, "test", "GetChunk", "200"))
+	assert.Equal(t, uint64(1), requestCount(t, "test", "QueryPages", "500"))
+}
+
+func TestStatusCode(t *testing.T) {
+	assert.Equal(t, "200", statusCode(nil))
+	assert.Equal(t, "500", statusCode(fmt.Errorf("failed")))
+	assert.Equal(t, "400", statusCode(awserr.NewRequestFailure(awserr.New(provisionedThroughputExceededException, "", nil), 400, "")))
+}
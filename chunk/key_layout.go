@@ -0,0 +1,153 @@
+package chunk
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+// Layouts of chunks' keys in the object store.
+const (
+	// FlatKeyLayout stores chunks under their external key,
+	// <user id>/<chunk>, so all of a user's chunks share a prefix.
+	FlatKeyLayout = "flat"
+
+	// HashedKeyLayout prefixes the external key with a hash of it, so
+	// chunks are spread over many prefixes, which object stores like S3
+	// and GCS rate limit separately.
+	HashedKeyLayout = "hashed"
+)
+
+var legacyKeyReads = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "chunk_store_legacy_key_reads_total",
+	Help:      "Total number of chunks only found under their flat key, after not being found under their hashed key.",
+})
+
+func init() {
+	prometheus.MustRegister(legacyKeyReads)
+}
+
+// KeyLayoutConfig configures the layout of chunks' keys in the object store.
+type KeyLayoutConfig struct {
+	Layout     string
+	HashLength int
+	Delimiter  string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *KeyLayoutConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Layout, "chunk.key-layout", FlatKeyLayout, "Layout of chunks' keys in the object store: flat (<user>/<chunk>) or hashed (<hash><delimiter><user>/<chunk>), which avoids per-prefix rate limits. Chunks are read from either layout, so the layout can be changed without migrating existing chunks.")
+	f.IntVar(&cfg.HashLength, "chunk.key-hash-length", 4, "Number of hex digits of the hash prefixed to chunks' keys with the hashed layout.")
+	f.StringVar(&cfg.Delimiter, "chunk.key-delimiter", "/", "Delimiter between the hash and the rest of chunks' keys with the hashed layout.")
+}
+
+// keyLayoutStorageClient stores chunks under hashed keys, while still
+// reading, listing and deleting chunks stored under their flat keys.
+// Blocks are always stored under their flat keys, so they can be listed by
+// user.
+type keyLayoutStorageClient struct {
+	StorageClient
+	cfg KeyLayoutConfig
+}
+
+func newKeyLayoutStorageClient(cfg KeyLayoutConfig, client StorageClient) (StorageClient, error) {
+	switch cfg.Layout {
+	case "", FlatKeyLayout:
+		return client, nil
+	case HashedKeyLayout:
+		if cfg.HashLength < 1 || cfg.HashLength > 8 {
+			return nil, fmt.Errorf("chunk key hash length must be between 1 and 8, not %d", cfg.HashLength)
+		}
+		if cfg.Delimiter == "" {
+			return nil, fmt.Errorf("chunk key delimiter must not be empty")
+		}
+		return keyLayoutStorageClient{StorageClient: client, cfg: cfg}, nil
+	default:
+		return nil, fmt.Errorf("unknown chunk key layout %q, choose one of: %s, %s", cfg.Layout, FlatKeyLayout, HashedKeyLayout)
+	}
+}
+
+func (c keyLayoutStorageClient) hash(key string) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%08x", h.Sum32())[:c.cfg.HashLength]
+}
+
+// objectKey returns the key a chunk is stored under.
+func (c keyLayoutStorageClient) objectKey(key string) string {
+	if strings.HasPrefix(key, blocksPrefix) {
+		return key
+	}
+	return c.hash(key) + c.cfg.Delimiter + key
+}
+
+// externalKey is the inverse of objectKey, for both hashed and flat keys.
+func (c keyLayoutStorageClient) externalKey(objectKey string) string {
+	prefixLen := c.cfg.HashLength + len(c.cfg.Delimiter)
+	if len(objectKey) <= prefixLen || objectKey[c.cfg.HashLength:prefixLen] != c.cfg.Delimiter {
+		return objectKey
+	}
+	key := objectKey[prefixLen:]
+	if objectKey[:c.cfg.HashLength] != c.hash(key) {
+		return objectKey
+	}
+	return key
+}
+
+func (c keyLayoutStorageClient) PutChunk(ctx context.Context, key string, data []byte) error {
+	return c.StorageClient.PutChunk(ctx, c.objectKey(key), data)
+}
+
+// GetChunk looks for the chunk under its hashed key, then its flat key, in
+// case it was written before the layout changed.
+func (c keyLayoutStorageClient) GetChunk(ctx context.Context, key string) ([]byte, error) {
+	objectKey := c.objectKey(key)
+	buf, err := c.StorageClient.GetChunk(ctx, objectKey)
+	if err != ErrChunkNotFound || objectKey == key {
+		return buf, err
+	}
+	buf, err = c.StorageClient.GetChunk(ctx, key)
+	if err == nil {
+		legacyKeyReads.Inc()
+	}
+	return buf, err
+}
+
+// GetChunkRange reads from the object under its hashed key, then its flat
+// key, like GetChunk.
+func (c keyLayoutStorageClient) GetChunkRange(ctx context.Context, key string, offset, length int) ([]byte, error) {
+	objectKey := c.objectKey(key)
+	buf, err := c.StorageClient.GetChunkRange(ctx, objectKey, offset, length)
+	if err != ErrChunkNotFound || objectKey == key {
+		return buf, err
+	}
+	buf, err = c.StorageClient.GetChunkRange(ctx, key, offset, length)
+	if err == nil {
+		legacyKeyReads.Inc()
+	}
+	return buf, err
+}
+
+// ListChunks lists chunks by their external keys.  Chunks stored under
+// hashed keys are only listed with an empty prefix.
+func (c keyLayoutStorageClient) ListChunks(ctx context.Context, prefix string, callback func(key string, lastModified time.Time) (shouldContinue bool)) error {
+	return c.StorageClient.ListChunks(ctx, prefix, func(objectKey string, lastModified time.Time) bool {
+		return callback(c.externalKey(objectKey), lastModified)
+	})
+}
+
+// DeleteChunk deletes the chunk under both its hashed and flat keys.
+func (c keyLayoutStorageClient) DeleteChunk(ctx context.Context, key string) error {
+	if objectKey := c.objectKey(key); objectKey != key {
+		if err := c.StorageClient.DeleteChunk(ctx, objectKey); err != nil {
+			return err
+		}
+	}
+	return c.StorageClient.DeleteChunk(ctx, key)
+}
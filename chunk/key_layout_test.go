@@ -0,0 +1,80 @@
+package chunk
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestKeyLayoutStorageClient(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMockStorage()
+	client, err := newKeyLayoutStorageClient(KeyLayoutConfig{Layout: HashedKeyLayout, HashLength: 4, Delimiter: "-"}, storage)
+	require.NoError(t, err)
+
+	// A chunk written before the layout changed, and one after.
+	require.NoError(t, storage.PutChunk(ctx, "user/old", []byte("old")))
+	require.NoError(t, client.PutChunk(ctx, "user/new", []byte("new")))
+	require.NoError(t, client.PutChunk(ctx, blocksPrefix+"user/block", []byte("block")))
+
+	var objectKeys []string
+	require.NoError(t, storage.ListChunks(ctx, "", func(key string, _ time.Time) bool {
+		objectKeys = append(objectKeys, key)
+		return true
+	}))
+	require.Len(t, objectKeys, 3)
+	assert.Contains(t, objectKeys, "user/old")
+	assert.Contains(t, objectKeys, blocksPrefix+"user/block", "blocks aren't hashed")
+	assert.NotContains(t, objectKeys, "user/new")
+
+	for key, expected := range map[string]string{"user/old": "old", "user/new": "new", blocksPrefix + "user/block": "block"} {
+		buf, err := client.GetChunk(ctx, key)
+		require.NoError(t, err, key)
+		assert.Equal(t, expected, string(buf))
+	}
+	_, err = client.GetChunk(ctx, "user/missing")
+	assert.Equal(t, ErrChunkNotFound, err)
+
+	var keys []string
+	require.NoError(t, client.ListChunks(ctx, "", func(key string, _ time.Time) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	sort.Strings(keys)
+	assert.Equal(t, []string{blocksPrefix + "user/block", "user/new", "user/old"}, keys)
+
+	require.NoError(t, client.DeleteChunk(ctx, "user/old"))
+	require.NoError(t, client.DeleteChunk(ctx, "user/new"))
+	objectKeys = nil
+	require.NoError(t, storage.ListChunks(ctx, "", func(key string, _ time.Time) bool {
+		objectKeys = append(objectKeys, key)
+		return true
+	}))
+	assert.Equal(t, []string{blocksPrefix + "user/block"}, objectKeys)
+}
+
+func TestKeyLayoutExternalKey(t *testing.T) {
+	c := keyLayoutStorageClient{cfg: KeyLayoutConfig{Layout: HashedKeyLayout, HashLength: 2, Delimiter: "/"}}
+	key := "user/1:2:3:4"
+	objectKey := c.objectKey(key)
+	assert.True(t, strings.HasSuffix(objectKey, "/"+key))
+	assert.Equal(t, key, c.externalKey(objectKey))
+
+	// Flat keys whose first part happens to be the length of a hash are left
+	// alone, unless it is their hash.
+	assert.Equal(t, "ab/1:2:3:4", c.externalKey("ab/1:2:3:4"))
+
+	for _, cfg := range []KeyLayoutConfig{
+		{Layout: "bad"},
+		{Layout: HashedKeyLayout, HashLength: 0, Delimiter: "/"},
+		{Layout: HashedKeyLayout, HashLength: 4},
+	} {
+		_, err := newKeyLayoutStorageClient(cfg, NewMockStorage())
+		assert.Error(t, err, "%+v", cfg)
+	}
+}
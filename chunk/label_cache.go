@@ -0,0 +1,165 @@
+package chunk
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+)
+
+var (
+	labelValuesCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_label_values_cache_requests_total",
+		Help:      "The total number of table periods label values were requested for, by whether they were cached.",
+	}, []string{"result"})
+	labelValuesCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_label_values_cache_evictions_total",
+		Help:      "The total number of label values of a table period evicted from the cache to keep it under its max size.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(labelValuesCacheRequests)
+	prometheus.MustRegister(labelValuesCacheEvictions)
+}
+
+type labelValuesKey struct {
+	userID     string
+	metricName model.LabelValue
+	labelName  model.LabelName
+	period     int64
+}
+
+// labelValuesCache caches the values of a metric's label, per table period.
+// Once a period is old enough that no more chunks will be written to it, the
+// set of values in it can't change, so it is read from the index at most
+// once; only the active periods are read on each request, and merged with
+// the cached sets.  When full, the least recently used sets are evicted.
+type labelValuesCache struct {
+	period      time.Duration
+	gracePeriod time.Duration
+	maxEntries  int
+	read        func(ctx context.Context, from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName) (model.LabelValues, error)
+
+	mtx     sync.Mutex
+	order   *list.List // of *labelValuesEntry, most recently used first
+	entries map[labelValuesKey]*list.Element
+}
+
+type labelValuesEntry struct {
+	key    labelValuesKey
+	values model.LabelValues
+}
+
+func newLabelValuesCache(period, gracePeriod time.Duration, maxEntries int, read func(ctx context.Context, from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName) (model.LabelValues, error)) *labelValuesCache {
+	return &labelValuesCache{
+		period:      period,
+		gracePeriod: gracePeriod,
+		maxEntries:  maxEntries,
+		read:        read,
+		order:       list.New(),
+		entries:     map[labelValuesKey]*list.Element{},
+	}
+}
+
+func (c *labelValuesCache) lookup(key labelValuesKey) (model.LabelValues, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*labelValuesEntry).values, true
+}
+
+func (c *labelValuesCache) store(key labelValuesKey, values model.LabelValues) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*labelValuesEntry).values = values
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&labelValuesEntry{key: key, values: values})
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*labelValuesEntry).key)
+		labelValuesCacheEvictions.Inc()
+	}
+}
+
+func (c *labelValuesCache) get(ctx context.Context, from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName) (model.LabelValues, error) {
+	var (
+		periodMs = int64(c.period / time.Millisecond)
+		complete = model.Now().Add(-c.gracePeriod)
+		result   model.LabelValues
+	)
+	for period := int64(from) / periodMs; period <= int64(through)/periodMs; period++ {
+		start, end := model.Time(period*periodMs), model.Time((period+1)*periodMs-1)
+		key := labelValuesKey{userID, metricName, labelName, period}
+
+		values, ok := c.lookup(key)
+		if ok {
+			labelValuesCacheRequests.WithLabelValues("hit").Inc()
+			result = mergeLabelValues(result, values)
+			continue
+		}
+
+		// Always read whole periods, so the result can be cached.
+		values, err := c.read(ctx, start, end, userID, metricName, labelName)
+		if err != nil {
+			return nil, err
+		}
+		if end.Before(complete) {
+			labelValuesCacheRequests.WithLabelValues("miss").Inc()
+			c.store(key, values)
+		} else {
+			labelValuesCacheRequests.WithLabelValues("active").Inc()
+		}
+		result = mergeLabelValues(result, values)
+	}
+	return result, nil
+}
+
+// mergeLabelValues merges two sorted, deduplicated sets of label values.
+func mergeLabelValues(a, b model.LabelValues) model.LabelValues {
+	result := make(model.LabelValues, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			result = append(result, a[i])
+			i++
+		case a[i] > b[j]:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	result = append(result, b[j:]...)
+	return result
+}
+
+func uniqueLabelValues(values model.LabelValues) model.LabelValues {
+	sort.Sort(values)
+	result := values[:0]
+	for _, v := range values {
+		if len(result) > 0 && v == result[len(result)-1] {
+			continue
+		}
+		result = append(result, v)
+	}
+	return result
+}
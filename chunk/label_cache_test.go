@@ -0,0 +1,57 @@
+package chunk
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestLabelValuesCache(t *testing.T) {
+	const period = 24 * time.Hour
+	var reads []model.Time
+	cache := newLabelValuesCache(period, time.Hour, 4, func(_ context.Context, from, _ model.Time, _ string, _ model.LabelValue, _ model.LabelName) (model.LabelValues, error) {
+		reads = append(reads, from)
+		day := int64(from) / int64(period/time.Millisecond)
+		return model.LabelValues{"common", model.LabelValue(fmt.Sprintf("day-%d", day))}, nil
+	})
+
+	now := model.Now()
+	from := now.Add(-3 * period)
+	values, err := cache.get(context.Background(), from, now, userID, "foo", "bar")
+	require.NoError(t, err)
+	assert.Len(t, values, 5)
+	assert.Len(t, reads, 4)
+	assert.Equal(t, model.LabelValue("common"), values[0])
+
+	// Only the active period should be read again.
+	reads = nil
+	again, err := cache.get(context.Background(), from, now, userID, "foo", "bar")
+	require.NoError(t, err)
+	assert.Equal(t, values, again)
+	require.Len(t, reads, 1)
+	assert.Equal(t, int64(now)/int64(period/time.Millisecond), int64(reads[0])/int64(period/time.Millisecond))
+
+	// Different tenants are cached separately.
+	reads = nil
+	_, err = cache.get(context.Background(), from, now, "other", "foo", "bar")
+	require.NoError(t, err)
+	assert.Len(t, reads, 4)
+
+	// Which evicted the least recently used periods of the first tenant.
+	assert.Len(t, cache.entries, 4)
+	reads = nil
+	_, err = cache.get(context.Background(), from, now, userID, "foo", "bar")
+	require.NoError(t, err)
+	assert.Len(t, reads, 4)
+}
+
+func TestMergeLabelValues(t *testing.T) {
+	assert.Equal(t, model.LabelValues{"a", "b", "c", "d"}, mergeLabelValues(model.LabelValues{"a", "c"}, model.LabelValues{"b", "c", "d"}))
+	assert.Equal(t, model.LabelValues{"a"}, mergeLabelValues(nil, model.LabelValues{"a"}))
+	assert.Equal(t, model.LabelValues{"a", "b"}, uniqueLabelValues(model.LabelValues{"b", "a", "b", "a"}))
+}
@@ -9,16 +9,29 @@ import (
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
-	"github.com/prometheus/common/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/weaveworks/cortex/util/log"
 )
 
+var memcacheCrossZonePicks = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "memcache_cross_zone_picks_total",
+	Help:      "Total count of memcache requests sent to another zone as no local servers were found.",
+})
+
+func init() {
+	prometheus.MustRegister(memcacheCrossZonePicks)
+}
+
 // MemcacheClient is a memcache client that gets its server list from SRV
 // records, and periodically updates that ServerList.
 type MemcacheClient struct {
 	*memcache.Client
-	serverList *memcache.ServerList
-	hostname   string
-	service    string
+	serverList    *zoneAwareServerList
+	hostname      string
+	localHostname string
+	service       string
 
 	quit chan struct{}
 	wait sync.WaitGroup
@@ -27,6 +40,7 @@ type MemcacheClient struct {
 // MemcacheConfig defines how a MemcacheClient should be constructed.
 type MemcacheConfig struct {
 	Host           string
+	LocalHost      string
 	Service        string
 	Timeout        time.Duration
 	UpdateInterval time.Duration
@@ -35,6 +49,7 @@ type MemcacheConfig struct {
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *MemcacheConfig) RegisterFlags(f *flag.FlagSet) {
 	f.StringVar(&cfg.Host, "memcached.hostname", "", "Hostname for memcached service to use when caching chunks. If empty, no memcached will be used.")
+	f.StringVar(&cfg.LocalHost, "memcached.local-hostname", "", "Hostname for memcached servers in the same availability zone. If set, these are preferred, falling back to -memcached.hostname if none are found.")
 	f.StringVar(&cfg.Service, "memcached.service", "memcached", "SRV service used to discover memcache servers.")
 	f.DurationVar(&cfg.Timeout, "memcached.timeout", 100*time.Millisecond, "Maximum time to wait before giving up on memcached requests.")
 	f.DurationVar(&cfg.UpdateInterval, "memcached.update-interval", 1*time.Minute, "Period with which to poll DNS for memcache servers.")
@@ -43,16 +58,19 @@ func (cfg *MemcacheConfig) RegisterFlags(f *flag.FlagSet) {
 // NewMemcacheClient creates a new MemcacheClient that gets its server list
 // from SRV and updates the server list on a regular basis.
 func NewMemcacheClient(cfg MemcacheConfig) *MemcacheClient {
-	var servers memcache.ServerList
+	servers := zoneAwareServerList{
+		zoned: cfg.LocalHost != "",
+	}
 	client := memcache.NewFromSelector(&servers)
 	client.Timeout = cfg.Timeout
 
 	newClient := &MemcacheClient{
-		Client:     client,
-		serverList: &servers,
-		hostname:   cfg.Host,
-		service:    cfg.Service,
-		quit:       make(chan struct{}),
+		Client:        client,
+		serverList:    &servers,
+		hostname:      cfg.Host,
+		localHostname: cfg.LocalHost,
+		service:       cfg.Service,
+		quit:          make(chan struct{}),
 	}
 	err := newClient.updateMemcacheServers()
 	if err != nil {
@@ -83,6 +101,7 @@ func (c *MemcacheClient) updateLoop(updateInterval time.Duration) error {
 			}
 		case <-c.quit:
 			ticker.Stop()
+			return nil
 		}
 	}
 }
@@ -90,10 +109,30 @@ func (c *MemcacheClient) updateLoop(updateInterval time.Duration) error {
 // updateMemcacheServers sets a memcache server list from SRV records. SRV
 // priority & weight are ignored.
 func (c *MemcacheClient) updateMemcacheServers() error {
-	_, addrs, err := net.LookupSRV(c.service, "tcp", c.hostname)
+	servers, err := c.lookupServers(c.hostname)
 	if err != nil {
 		return err
 	}
+	if err := c.serverList.all.SetServers(servers...); err != nil {
+		return err
+	}
+
+	var localServers []string
+	if c.localHostname != "" {
+		// If the local zone has no servers we can still use the others.
+		localServers, err = c.lookupServers(c.localHostname)
+		if err != nil {
+			log.Warnf("Error looking up local memcache servers: %v", err)
+		}
+	}
+	return c.serverList.local.SetServers(localServers...)
+}
+
+func (c *MemcacheClient) lookupServers(hostname string) ([]string, error) {
+	_, addrs, err := net.LookupSRV(c.service, "tcp", hostname)
+	if err != nil {
+		return nil, err
+	}
 	var servers []string
 	for _, srv := range addrs {
 		servers = append(servers, fmt.Sprintf("%s:%d", srv.Target, srv.Port))
@@ -102,5 +141,42 @@ func (c *MemcacheClient) updateMemcacheServers() error {
 	// Since DNS returns records in different order each time, we sort to
 	// guarantee best possible match between nodes.
 	sort.Strings(servers)
-	return c.serverList.SetServers(servers...)
+	return servers, nil
+}
+
+// zoneAwareServerList is a memcache.ServerSelector which picks servers in
+// the local availability zone when there are any, and otherwise falls back
+// to servers in any zone.
+type zoneAwareServerList struct {
+	zoned bool // Whether local servers have been configured at all.
+	local memcache.ServerList
+	all   memcache.ServerList
+}
+
+// PickServer implements memcache.ServerSelector
+func (z *zoneAwareServerList) PickServer(key string) (net.Addr, error) {
+	addr, err := z.local.PickServer(key)
+	if err == memcache.ErrNoServers {
+		addr, err = z.all.PickServer(key)
+		if err == nil && z.zoned {
+			memcacheCrossZonePicks.Inc()
+		}
+	}
+	return addr, err
+}
+
+// Each implements memcache.ServerSelector
+func (z *zoneAwareServerList) Each(f func(net.Addr) error) error {
+	seen := map[string]struct{}{}
+	each := func(addr net.Addr) error {
+		if _, ok := seen[addr.String()]; ok {
+			return nil
+		}
+		seen[addr.String()] = struct{}{}
+		return f(addr)
+	}
+	if err := z.local.Each(each); err != nil {
+		return err
+	}
+	return z.all.Each(each)
 }
@@ -0,0 +1,38 @@
+package chunk
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZoneAwareServerList(t *testing.T) {
+	servers := zoneAwareServerList{zoned: true}
+	require.NoError(t, servers.all.SetServers("10.0.0.1:11211", "10.0.1.1:11211"))
+
+	// With no local servers, we fall back to any zone.
+	addr, err := servers.PickServer("foo")
+	require.NoError(t, err)
+	require.Contains(t, []string{"10.0.0.1:11211", "10.0.1.1:11211"}, addr.String())
+
+	// Once there are local servers, they are always preferred.
+	require.NoError(t, servers.local.SetServers("10.0.1.1:11211"))
+	for _, key := range []string{"foo", "bar", "baz"} {
+		addr, err := servers.PickServer(key)
+		require.NoError(t, err)
+		require.Equal(t, "10.0.1.1:11211", addr.String())
+	}
+
+	var all []string
+	require.NoError(t, servers.Each(func(addr net.Addr) error {
+		all = append(all, addr.String())
+		return nil
+	}))
+	require.Equal(t, []string{"10.0.1.1:11211", "10.0.0.1:11211"}, all)
+
+	var empty zoneAwareServerList
+	_, err = empty.PickServer("foo")
+	require.Equal(t, memcache.ErrNoServers, err)
+}
@@ -0,0 +1,214 @@
+package chunk
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// MigratorConfig configures a Migrator.
+type MigratorConfig struct {
+	SchemaConfig
+	Parallelism    int
+	CheckpointFile string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *MigratorConfig) RegisterFlags(f *flag.FlagSet) {
+	cfg.SchemaConfig.RegisterFlags(f)
+	f.IntVar(&cfg.Parallelism, "migrate.parallelism", 10, "How many chunks to copy at once.")
+	f.StringVar(&cfg.CheckpointFile, "migrate.checkpoint-file", "", "File recording the tables which have been migrated, so an interrupted migration resumes from the table it was in. Use a new file for each tenant and time range. Empty disables checkpoints.")
+}
+
+// Migrator copies a user's index entries and chunks between two storage
+// backends.  Index entries are copied as they are, so the destination must
+// use the same schema and table names, and its tables must exist.
+type Migrator struct {
+	cfg         MigratorConfig
+	source      StorageClient
+	destination StorageClient
+}
+
+// NewMigrator makes a new Migrator.
+func NewMigrator(cfg MigratorConfig, source, destination StorageClient) *Migrator {
+	return &Migrator{
+		cfg:         cfg,
+		source:      source,
+		destination: destination,
+	}
+}
+
+// Migrate copies the index entries of the user's chunks which overlap from
+// and through, and the chunks themselves, table by table.  Each batch of
+// chunks is copied before its index entries, so the destination never has
+// an entry pointing at a missing chunk.  Copying is idempotent, so a table
+// interrupted part way through is copied again from its start.
+func (m *Migrator) Migrate(ctx context.Context, userID string, from, through model.Time) error {
+	done, err := m.readCheckpoint()
+	if err != nil {
+		return err
+	}
+	for _, table := range m.cfg.tablesForRange(from, through) {
+		if done[table] {
+			log.Infof("Skipping table %s, which has been migrated", table)
+			continue
+		}
+		log.Infof("Migrating index entries and chunks of user %s from table %s", userID, table)
+		t := &tableMigrator{Migrator: m, table: table, batch: m.destination.NewWriteBatch()}
+		if scanErr := m.source.ScanTable(ctx, table, func(hashValue string, rangeValue []byte, value []byte) bool {
+			if hashUserID(hashValue) != userID {
+				return true
+			}
+			chunkID, _, _, err := parseRangeValue(hashValue, rangeValue, value)
+			if err != nil {
+				log.Warnf("Error parsing index entry %s/%x in table %s: %v", hashValue, rangeValue, table, err)
+				return true
+			}
+			chunk, err := parseExternalKey(userID, chunkID)
+			if err != nil {
+				log.Warnf("Error parsing chunk ID %s in table %s: %v", chunkID, table, err)
+				return true
+			}
+			if chunk.Through.Before(from) || chunk.From.After(through) {
+				return true
+			}
+			return t.add(ctx, hashValue, rangeValue, value, chunk.objectKey())
+		}); scanErr != nil {
+			return scanErr
+		}
+		if err := t.flush(ctx); err != nil {
+			return err
+		}
+		if err := m.writeCheckpoint(table); err != nil {
+			return err
+		}
+		log.Infof("Migrated %d index entries and %d chunks of user %s from table %s", t.numEntries, len(t.copied), userID, table)
+	}
+	return nil
+}
+
+func (m *Migrator) readCheckpoint() (map[string]bool, error) {
+	done := map[string]bool{}
+	if m.cfg.CheckpointFile == "" {
+		return done, nil
+	}
+	f, err := os.Open(m.cfg.CheckpointFile)
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		done[scanner.Text()] = true
+	}
+	return done, scanner.Err()
+}
+
+func (m *Migrator) writeCheckpoint(table string) error {
+	if m.cfg.CheckpointFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(m.cfg.CheckpointFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, table); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// tableMigrator copies a table's index entries in batches, copying the
+// chunks of each batch first.
+type tableMigrator struct {
+	*Migrator
+	table string
+
+	batch     WriteBatch
+	batchSize int
+	chunkKeys []string
+	copied    map[string]struct{}
+	err       error
+
+	numEntries int
+}
+
+// add queues the index entry, and its chunk if it hasn't been copied, for
+// copying.  It returns false after failing to copy a batch.
+func (t *tableMigrator) add(ctx context.Context, hashValue string, rangeValue []byte, value []byte, chunkKey string) bool {
+	t.batch.Add(t.table, hashValue, rangeValue, value)
+	t.batchSize++
+	if _, ok := t.copied[chunkKey]; !ok {
+		if t.copied == nil {
+			t.copied = map[string]struct{}{}
+		}
+		t.copied[chunkKey] = struct{}{}
+		t.chunkKeys = append(t.chunkKeys, chunkKey)
+	}
+	if t.batchSize >= purgeBatchSize {
+		t.err = t.flush(ctx)
+	}
+	return t.err == nil
+}
+
+func (t *tableMigrator) flush(ctx context.Context) error {
+	if t.err != nil {
+		return t.err
+	}
+	if err := t.copyChunks(ctx); err != nil {
+		return err
+	}
+	if t.batchSize == 0 {
+		return nil
+	}
+	if err := t.destination.BatchWrite(ctx, t.batch); err != nil {
+		return err
+	}
+	t.numEntries += t.batchSize
+	t.batch, t.batchSize = t.destination.NewWriteBatch(), 0
+	return nil
+}
+
+// copyChunks copies the queued chunks, Parallelism at a time.
+func (t *tableMigrator) copyChunks(ctx context.Context) error {
+	keys := make(chan string)
+	errs := make(chan error, len(t.chunkKeys))
+	parallelism := t.cfg.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				buf, err := t.source.GetChunk(ctx, key)
+				if err == nil {
+					err = t.destination.PutChunk(ctx, key, buf)
+				}
+				if err != nil {
+					errs <- fmt.Errorf("error copying chunk %s: %v", key, err)
+				}
+			}
+		}()
+	}
+	for _, key := range t.chunkKeys {
+		keys <- key
+	}
+	close(keys)
+	wg.Wait()
+	close(errs)
+	t.chunkKeys = t.chunkKeys[:0]
+	return <-errs
+}
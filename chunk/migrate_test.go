@@ -0,0 +1,80 @@
+package chunk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestMigrator(t *testing.T) {
+	source, sourceStore := newDeletesTestStore(t)
+	destination, destinationStore := newDeletesTestStore(t)
+
+	now := model.Now()
+	from, through := now.Add(-48*time.Hour), now.Add(-24*time.Hour)
+	inside := chunkOf(t, "user1", from.Add(-30*time.Minute), from.Add(30*time.Minute))
+	outside := chunkOf(t, "user1", through.Add(time.Hour), through.Add(2*time.Hour))
+	other := chunkOf(t, "user2", from, from.Add(time.Hour))
+	require.NoError(t, sourceStore.Put(user.Inject(context.Background(), "user1"), []Chunk{inside, outside}))
+	require.NoError(t, sourceStore.Put(user.Inject(context.Background(), "user2"), []Chunk{other}))
+
+	dir, err := ioutil.TempDir("", "migrate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	checkpoint := filepath.Join(dir, "checkpoint")
+
+	migrator := NewMigrator(MigratorConfig{Parallelism: 2, CheckpointFile: checkpoint}, source, destination)
+	require.NoError(t, migrator.Migrate(context.Background(), "user1", from, through))
+
+	get := func(userID string) []Chunk {
+		chunks, err := destinationStore.Get(user.Inject(context.Background(), userID), now.Add(-72*time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+		require.NoError(t, err)
+		return chunks
+	}
+	chunks := get("user1")
+	require.Len(t, chunks, 1)
+	assert.Equal(t, inside.From, chunks[0].From)
+	assert.Equal(t, inside.Through, chunks[0].Through)
+	assert.Empty(t, get("user2"))
+
+	buf, err := ioutil.ReadFile(checkpoint)
+	require.NoError(t, err)
+	assert.Equal(t, "\n", string(buf), "the unnamed original table has been migrated")
+
+	// Migrating again with the checkpoint skips the migrated table.
+	migrator = NewMigrator(MigratorConfig{Parallelism: 2, CheckpointFile: checkpoint}, source, destination)
+	require.NoError(t, migrator.Migrate(context.Background(), "user2", from, through))
+	assert.Empty(t, get("user2"))
+}
+
+func TestTablesForRange(t *testing.T) {
+	cfg := SchemaConfig{
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables:    true,
+			TablePrefix:          tablePrefix,
+			TablePeriod:          tablePeriod,
+			PeriodicTableStartAt: util.NewDayValue(model.TimeFromUnix(int64(2 * tablePeriod / time.Second))),
+		},
+		OriginalTableName: "legacy",
+	}
+	period := func(i int64) model.Time {
+		return model.TimeFromUnix(i * int64(tablePeriod/time.Second))
+	}
+	assert.Equal(t, []string{"legacy"}, cfg.tablesForRange(period(0), period(1)))
+	assert.Equal(t, []string{"legacy", tablePrefix + "2", tablePrefix + "3"}, cfg.tablesForRange(period(1), period(3).Add(time.Hour)))
+	assert.Equal(t, []string{tablePrefix + "4"}, cfg.tablesForRange(period(4), period(4).Add(time.Hour)))
+
+	cfg.UsePeriodicTables = false
+	assert.Equal(t, []string{"legacy"}, cfg.tablesForRange(period(4), period(5)))
+}
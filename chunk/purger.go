@@ -0,0 +1,517 @@
+package chunk
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// purgeBatchSize is how many index entries are deleted in each batch.
+const purgeBatchSize = 100
+
+var (
+	purgeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "purger_purge_seconds",
+		Help:      "Time spent purging expired chunks from each table.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"operation", "status_code"})
+	purgedIndexEntries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "purger_index_entries_deleted_total",
+		Help:      "Number of index entries deleted because they were past the user's retention period, or the user was deleted.",
+	}, []string{"user"})
+	purgedChunks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "purger_chunks_deleted_total",
+		Help:      "Number of chunks deleted because they were past the user's retention period, weren't referenced by any index entry, or the user was deleted.",
+	}, []string{"user"})
+	purgedBlocks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "purger_blocks_deleted_total",
+		Help:      "Number of blocks deleted because they were past the user's retention period, or the user was deleted.",
+	}, []string{"user"})
+	processedDeleteRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "purger_delete_requests_processed_total",
+		Help:      "Number of series delete requests whose samples have been purged.",
+	}, []string{"user"})
+	failedDeleteRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "purger_delete_requests_failed_total",
+		Help:      "Number of times purging the samples of a series delete request failed; it's retried on the next run.",
+	}, []string{"user"})
+)
+
+func init() {
+	prometheus.MustRegister(purgeDuration)
+	prometheus.MustRegister(purgedIndexEntries)
+	prometheus.MustRegister(purgedChunks)
+	prometheus.MustRegister(purgedBlocks)
+	prometheus.MustRegister(processedDeleteRequests)
+	prometheus.MustRegister(failedDeleteRequests)
+}
+
+// RetentionLimits gives the retention period of each user's chunks.
+type RetentionLimits interface {
+	RetentionPeriod(userID string) time.Duration
+	MinRetentionPeriod() time.Duration
+}
+
+// PurgerConfig configures the Purger.
+type PurgerConfig struct {
+	Interval time.Duration
+
+	ChunkCleanupInterval    time.Duration
+	ChunkCleanupGracePeriod time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *PurgerConfig) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.Interval, "purger.interval", 0, "How often to purge chunks past their user's retention period, and the samples of series delete requests, from the chunk store. 0 disables purging.")
+	f.DurationVar(&cfg.ChunkCleanupInterval, "purger.chunk-cleanup-interval", 0, "How often to delete chunks from the object store which aren't referenced by any index entry, e.g. those of deleted tables. Each run scans every table and lists every object in the bucket. 0 disables it.")
+	f.DurationVar(&cfg.ChunkCleanupGracePeriod, "purger.chunk-cleanup-grace-period", 24*time.Hour, "How old an unreferenced chunk must be before it's deleted, unless it's past its user's retention period. Chunks are written before their index entries, so this must be longer than a flush takes.")
+}
+
+// Enabled returns whether the Purger has anything to do.
+func (cfg *PurgerConfig) Enabled() bool {
+	return cfg.Interval > 0 || cfg.ChunkCleanupInterval > 0
+}
+
+// Purger deletes the index entries and chunks of each user which are older
+// than the user's retention period, from tables shared with other users.
+// Whole tables past everyone's retention are deleted by the table manager.
+// It also deletes the samples of users' series delete requests, chunks left
+// unreferenced by the index, and whole users on demand.
+type Purger struct {
+	cfg         PurgerConfig
+	tableCfg    TableManagerConfig
+	store       *Store
+	tableClient DynamoTableClient
+	limits      RetentionLimits
+
+	done chan struct{}
+	wait sync.WaitGroup
+}
+
+// NewPurger makes a new Purger.  The tables it purges are those managed by
+// the table manager with the given config.
+func NewPurger(cfg PurgerConfig, tableCfg TableManagerConfig, store *Store, tableClient DynamoTableClient, limits RetentionLimits) *Purger {
+	return &Purger{
+		cfg:         cfg,
+		tableCfg:    tableCfg,
+		store:       store,
+		tableClient: tableClient,
+		limits:      limits,
+		done:        make(chan struct{}),
+	}
+}
+
+// Start the Purger.
+func (p *Purger) Start() {
+	if p.cfg.Interval > 0 {
+		p.wait.Add(1)
+		go p.loop()
+	}
+	if p.cfg.ChunkCleanupInterval > 0 {
+		p.wait.Add(1)
+		go p.cleanupLoop()
+	}
+}
+
+// Stop the Purger.
+func (p *Purger) Stop() {
+	close(p.done)
+	p.wait.Wait()
+}
+
+func (p *Purger) loop() {
+	defer p.wait.Done()
+
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.purge(context.Background()); err != nil {
+			log.Errorf("Error purging expired chunks: %v", err)
+		}
+		if err := p.processDeleteRequests(context.Background()); err != nil {
+			log.Errorf("Error processing delete requests: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *Purger) cleanupLoop() {
+	defer p.wait.Done()
+
+	ticker := time.NewTicker(p.cfg.ChunkCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := instrument.TimeRequestHistogram(context.Background(), "Purger.cleanupChunks", purgeDuration, p.cleanupChunks); err != nil {
+			log.Errorf("Error cleaning up chunks: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// purge scans every table which may hold chunks past a user's retention
+// period, and deletes them, and then deletes the blocks past it.
+func (p *Purger) purge(ctx context.Context) error {
+	minRetention := p.limits.MinRetentionPeriod()
+	if minRetention <= 0 {
+		return nil
+	}
+	now := model.TimeFromUnixNano(mtime.Now().UnixNano())
+
+	tables, err := p.tableClient.ListTables()
+	if err != nil {
+		return err
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		if !p.tableCfg.mayHoldChunksBefore(table, now.Add(-minRetention)) {
+			continue
+		}
+		if err := instrument.TimeRequestHistogram(ctx, "Purger.purgeTable", purgeDuration, func(ctx context.Context) error {
+			return p.purgeTable(ctx, table, now)
+		}); err != nil {
+			return err
+		}
+	}
+	return instrument.TimeRequestHistogram(ctx, "Purger.purgeBlocks", purgeDuration, func(ctx context.Context) error {
+		return p.purgeBlocks(ctx, now)
+	})
+}
+
+// purgeBlocks deletes the blocks which ended before their user's retention
+// period.  Blocks aren't in any table, so are found by listing them.
+func (p *Purger) purgeBlocks(ctx context.Context, now model.Time) error {
+	deleted, err := deleteBlocks(ctx, p.store.storage, blocksPrefix, func(userID string, meta blockMeta) bool {
+		retention := p.limits.RetentionPeriod(userID)
+		return retention > 0 && meta.through.Before(now.Add(-retention))
+	})
+	total := 0
+	for userID, n := range deleted {
+		purgedBlocks.WithLabelValues(userID).Add(float64(n))
+		total += n
+	}
+	log.Infof("Purged %d blocks", total)
+	return err
+}
+
+// purgeTable deletes the index entries of chunks in the table which ended
+// before their user's retention period, and then the chunks themselves.
+func (p *Purger) purgeTable(ctx context.Context, table string, now model.Time) error {
+	log.Infof("Purging expired chunks from table %s", table)
+
+	d := newTableDeleter(p.store.storage, purgedIndexEntries, purgedChunks)
+	if scanErr := p.store.storage.ScanTable(ctx, table, func(hashValue string, rangeValue []byte, value []byte) bool {
+		userID := hashUserID(hashValue)
+		retention := p.limits.RetentionPeriod(userID)
+		if retention <= 0 {
+			return true
+		}
+
+		chunkKey, _, _, parseErr := parseRangeValue(hashValue, rangeValue, value)
+		if parseErr != nil {
+			log.Warnf("Error parsing index entry %s/%x in table %s: %v", hashValue, rangeValue, table, parseErr)
+			return true
+		}
+		chunk, parseErr := parseExternalKey(userID, chunkKey)
+		if parseErr != nil {
+			log.Warnf("Error parsing chunk ID %s in table %s: %v", chunkKey, table, parseErr)
+			return true
+		}
+		if !chunk.Through.Before(now.Add(-retention)) {
+			return true
+		}
+		// A batch's object is only deleted once all its chunks have expired.
+		var objectKey string
+		if chunk.batchThrough().Before(now.Add(-retention)) {
+			objectKey = chunk.objectKey()
+		}
+		return d.delete(ctx, table, userID, hashValue, rangeValue, objectKey)
+	}); scanErr != nil {
+		return scanErr
+	}
+	if err := d.finish(ctx); err != nil {
+		return err
+	}
+	log.Infof("Purged %d chunks from table %s", d.numChunks, table)
+	return nil
+}
+
+// cleanupChunks deletes the chunks, and batches of chunks, in the object
+// store which aren't referenced by any index entry in the tables managed by the table manager,
+// such as those of tables it has deleted, once they're older than the grace
+// period or past their user's retention period.  It holds the key of every
+// referenced chunk in memory while it runs.  Objects which aren't chunks,
+// e.g. rules in a bucket shared with the ruler, are left alone.
+func (p *Purger) cleanupChunks(ctx context.Context) error {
+	tables, err := p.tableClient.ListTables()
+	if err != nil {
+		return err
+	}
+	referenced := map[string]struct{}{}
+	numTables := 0
+	for _, table := range tables {
+		if !p.tableCfg.mayHoldChunksBefore(table, model.Latest) {
+			continue
+		}
+		numTables++
+		if err := p.store.storage.ScanTable(ctx, table, func(hashValue string, rangeValue []byte, value []byte) bool {
+			chunkKey, _, _, err := parseRangeValue(hashValue, rangeValue, value)
+			if err != nil {
+				return true
+			}
+			chunk, err := parseExternalKey(hashUserID(hashValue), chunkKey)
+			if err != nil {
+				return true
+			}
+			referenced[chunk.objectKey()] = struct{}{}
+			return true
+		}); err != nil {
+			return err
+		}
+	}
+	// Otherwise a misconfigured table prefix would delete every chunk.
+	if numTables == 0 {
+		return fmt.Errorf("no index tables found")
+	}
+	log.Infof("Found %d chunks referenced by %d tables", len(referenced), numTables)
+
+	now := mtime.Now()
+	numChunks := 0
+	var deleteErr error
+	if err := p.store.storage.ListChunks(ctx, "", func(key string, lastModified time.Time) bool {
+		if _, ok := referenced[key]; ok {
+			return true
+		}
+		var chunk Chunk
+		if userID, meta, err := parseBatchKey(key); err == nil {
+			chunk = Chunk{UserID: userID, Through: meta.through}
+		} else if chunk, err = ParseKey(key); err != nil {
+			return true
+		}
+		retention := p.limits.RetentionPeriod(chunk.UserID)
+		expired := retention > 0 && chunk.Through.Before(model.TimeFromUnixNano(now.Add(-retention).UnixNano()))
+		if !expired && now.Sub(lastModified) < p.cfg.ChunkCleanupGracePeriod {
+			return true
+		}
+		if deleteErr = p.store.storage.DeleteChunk(ctx, key); deleteErr != nil {
+			return false
+		}
+		purgedChunks.WithLabelValues(chunk.UserID).Inc()
+		numChunks++
+		return true
+	}); err != nil {
+		return err
+	}
+	if deleteErr != nil {
+		return deleteErr
+	}
+	log.Infof("Deleted %d unreferenced chunks", numChunks)
+	return nil
+}
+
+// hashUserID returns the user ID of an index entry's hash value.
+func hashUserID(hashValue string) string {
+	if i := strings.IndexByte(hashValue, ':'); i >= 0 {
+		return hashValue[:i]
+	}
+	return hashValue
+}
+
+// DeleteUser deletes every index entry and chunk of the user from the tables
+// managed by the table manager, the user's blocks, and the user's delete
+// requests, logging its progress through each table.  Chunks flushed while it runs may be missed.
+func (p *Purger) DeleteUser(ctx context.Context, userID string) error {
+	tables, err := p.tableClient.ListTables()
+	if err != nil {
+		return err
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		if !p.tableCfg.mayHoldChunksBefore(table, model.Latest) {
+			continue
+		}
+		log.Infof("Deleting index entries and chunks of user %s from table %s", userID, table)
+		d := newTableDeleter(p.store.storage, purgedIndexEntries, purgedChunks)
+		if scanErr := p.store.storage.ScanTable(ctx, table, func(hashValue string, rangeValue []byte, value []byte) bool {
+			if hashValue != userID && !strings.HasPrefix(hashValue, userID+":") {
+				return true
+			}
+			// Entries which don't parse are deleted too, leaving their
+			// chunks, if any, unreachable.
+			var chunkKey string
+			if key, _, _, err := parseRangeValue(hashValue, rangeValue, value); err == nil {
+				if chunk, err := parseExternalKey(userID, key); err == nil {
+					chunkKey = chunk.objectKey()
+				}
+			}
+			return d.delete(ctx, table, userID, hashValue, rangeValue, chunkKey)
+		}); scanErr != nil {
+			return scanErr
+		}
+		if err := d.finish(ctx); err != nil {
+			return err
+		}
+		log.Infof("Deleted %d index entries and %d chunks of user %s from table %s", d.numEntries, d.numChunks, userID, table)
+	}
+
+	log.Infof("Deleting blocks of user %s", userID)
+	deleted, err := deleteBlocks(ctx, p.store.storage, blocksPrefix+userID+"/", func(string, blockMeta) bool { return true })
+	purgedBlocks.WithLabelValues(userID).Add(float64(deleted[userID]))
+	if err != nil {
+		return err
+	}
+	log.Infof("Deleted %d blocks of user %s", deleted[userID], userID)
+
+	n, err := p.store.deletes.removeUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	log.Infof("Deleted %d delete requests of user %s", n, userID)
+	return nil
+}
+
+// tableDeleter deletes index entries in batches, and then the chunks they
+// point at, so no index entry is left pointing at a deleted chunk.  It counts
+// what it deletes of each user with the given counters.
+type tableDeleter struct {
+	storage        StorageClient
+	deletedEntries *prometheus.CounterVec
+	deletedChunks  *prometheus.CounterVec
+	batch          WriteBatch
+	batchSize      int
+	chunks         map[string]string // external key -> user ID
+	entries        map[string]int    // user ID -> number of entries deleted
+	err            error
+
+	numEntries, numChunks int
+}
+
+func newTableDeleter(storage StorageClient, deletedEntries, deletedChunks *prometheus.CounterVec) *tableDeleter {
+	return &tableDeleter{
+		storage:        storage,
+		deletedEntries: deletedEntries,
+		deletedChunks:  deletedChunks,
+		batch:          storage.NewWriteBatch(),
+		chunks:         map[string]string{},
+		entries:        map[string]int{},
+	}
+}
+
+// delete queues the index entry, and the chunk with the given key if there
+// is one, for deletion.  It returns false after failing to delete a batch.
+func (d *tableDeleter) delete(ctx context.Context, table, userID, hashValue string, rangeValue []byte, chunkKey string) bool {
+	d.batch.Delete(table, hashValue, rangeValue)
+	d.batchSize++
+	d.entries[userID]++
+	if chunkKey != "" {
+		d.chunks[chunkKey] = userID
+	}
+	if d.batchSize >= purgeBatchSize {
+		d.err = d.flush(ctx)
+	}
+	return d.err == nil
+}
+
+func (d *tableDeleter) flush(ctx context.Context) error {
+	if d.batchSize == 0 {
+		return nil
+	}
+	if err := d.storage.BatchWrite(ctx, d.batch); err != nil {
+		return err
+	}
+	d.batch, d.batchSize = d.storage.NewWriteBatch(), 0
+	return nil
+}
+
+// finish deletes the remaining index entries, and then the chunks.
+func (d *tableDeleter) finish(ctx context.Context) error {
+	err := d.err
+	if err == nil {
+		err = d.flush(ctx)
+	}
+	for userID, n := range d.entries {
+		d.deletedEntries.WithLabelValues(userID).Add(float64(n))
+		d.numEntries += n
+	}
+	if err != nil {
+		return err
+	}
+
+	for key, userID := range d.chunks {
+		if err := d.storage.DeleteChunk(ctx, key); err != nil {
+			return err
+		}
+		d.deletedChunks.WithLabelValues(userID).Inc()
+		d.numChunks++
+	}
+	return nil
+}
+
+// processDeleteRequests deletes the samples of pending delete requests from
+// the store.  A request is processed once the ingesters have flushed every
+// chunk holding its samples, so none are written back after it, and its
+// cancellation period is over.  A request which fails is logged and left
+// pending, to be retried on the next run, so it doesn't hold up the others.
+func (p *Purger) processDeleteRequests(ctx context.Context) error {
+	requests, err := p.store.deletes.pending(ctx)
+	if err != nil {
+		return err
+	}
+	delay := p.tableCfg.MaxChunkAge + p.tableCfg.CreationGracePeriod
+	now := model.TimeFromUnixNano(mtime.Now().UnixNano())
+	for _, req := range requests {
+		if now.Before(req.CreatedAt.Add(delay)) || now.Before(req.CancellableUntil) {
+			continue
+		}
+		log.Infof("Processing delete request %s of user %s", req.RequestID, req.UserID)
+		if err := p.processDeleteRequest(ctx, req); err != nil {
+			log.Errorf("Error processing delete request %s of user %s: %v", req.RequestID, req.UserID, err)
+			failedDeleteRequests.WithLabelValues(req.UserID).Inc()
+			continue
+		}
+		processedDeleteRequests.WithLabelValues(req.UserID).Inc()
+	}
+	return nil
+}
+
+func (p *Purger) processDeleteRequest(ctx context.Context, req DeleteRequest) error {
+	if req.Status != DeleteRequestProcessing {
+		if err := p.store.deletes.setStatus(ctx, req, DeleteRequestProcessing); err != nil {
+			return err
+		}
+	}
+	userCtx := user.Inject(ctx, req.UserID)
+	for _, matchers := range req.Matchers() {
+		if err := p.store.DeleteSeries(userCtx, req.StartTime, req.EndTime, matchers...); err != nil {
+			return err
+		}
+	}
+	return p.store.deletes.setStatus(ctx, req, DeleteRequestProcessed)
+}
@@ -0,0 +1,222 @@
+package chunk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/common/user"
+)
+
+type fakeRetentionLimits map[string]time.Duration
+
+func (l fakeRetentionLimits) RetentionPeriod(userID string) time.Duration {
+	return l[userID]
+}
+
+func (l fakeRetentionLimits) MinRetentionPeriod() time.Duration {
+	var min time.Duration
+	for _, retention := range l {
+		if retention > 0 && (min == 0 || retention < min) {
+			min = retention
+		}
+	}
+	return min
+}
+
+func chunkAt(userID string, through model.Time) Chunk {
+	metric := model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}
+	cs, _ := chunk.New().Add(model.SamplePair{Timestamp: through, Value: 0})
+	return NewChunk(userID, metric.Fingerprint(), metric, cs[0], through.Add(-time.Hour), through)
+}
+
+func TestPurger(t *testing.T) {
+	storage := NewMockStorage()
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{}, storage)
+	require.NoError(t, err)
+	require.NoError(t, tableManager.syncTables(context.Background()))
+	store, err := NewStore(StoreConfig{schemaFactory: v6Schema}, storage)
+	require.NoError(t, err)
+
+	now := model.Now()
+	old, recent := now.Add(-10*24*time.Hour), now.Add(-time.Hour)
+	chunks := map[string][]Chunk{
+		"user1": {chunkAt("user1", old), chunkAt("user1", recent)},
+		"user2": {chunkAt("user2", old), chunkAt("user2", recent)},
+	}
+	for userID, userChunks := range chunks {
+		require.NoError(t, store.Put(user.Inject(context.Background(), userID), userChunks))
+	}
+
+	// Only user1 has a retention period.
+	limits := fakeRetentionLimits{"user1": 7 * 24 * time.Hour}
+	purger := NewPurger(PurgerConfig{}, TableManagerConfig{}, store, storage, limits)
+	require.NoError(t, purger.purge(context.Background()))
+
+	get := func(userID string) []Chunk {
+		ctx := user.Inject(context.Background(), userID)
+		got, err := store.Get(ctx, now.Add(-30*24*time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+		require.NoError(t, err)
+		return got
+	}
+	got := get("user1")
+	require.Len(t, got, 1)
+	assert.Equal(t, recent, got[0].Through)
+	assert.Len(t, get("user2"), 2)
+
+	_, err = storage.GetChunk(context.Background(), chunks["user1"][0].externalKey())
+	assert.Error(t, err)
+	for _, c := range append(chunks["user2"], chunks["user1"][1]) {
+		_, err = storage.GetChunk(context.Background(), c.externalKey())
+		assert.NoError(t, err)
+	}
+
+	// Purging again finds nothing more to delete.
+	require.NoError(t, purger.purge(context.Background()))
+	assert.Len(t, get("user1"), 1)
+}
+
+func TestPurgerTables(t *testing.T) {
+	purger := NewPurger(PurgerConfig{}, TableManagerConfig{
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       tablePrefix,
+			TablePeriod:       tablePeriod,
+		},
+		OriginalTableName: "legacy",
+	}, nil, nil, nil)
+
+	cutoff := model.TimeFromUnix(int64(2 * tablePeriod / time.Second)).Add(time.Hour)
+	for table, expected := range map[string]bool{
+		"legacy":            true,
+		tablePrefix + "0":   true,
+		tablePrefix + "2":   true,
+		tablePrefix + "3":   false,
+		tablePrefix + "foo": false,
+		"other":             false,
+	} {
+		assert.Equal(t, expected, purger.tableCfg.mayHoldChunksBefore(table, cutoff), table)
+	}
+}
+
+func TestPurgerDeleteUser(t *testing.T) {
+	storage, store := newDeletesTestStore(t)
+	now := model.Now()
+	chunks := map[string][]Chunk{
+		"user1":  {chunkAt("user1", now.Add(-48*time.Hour)), chunkAt("user1", now)},
+		"user10": {chunkAt("user10", now)},
+	}
+	for userID, userChunks := range chunks {
+		ctx := user.Inject(context.Background(), userID)
+		require.NoError(t, store.Put(ctx, userChunks))
+		_, err := store.AddDeleteRequest(ctx, now.Add(-time.Hour), now, []string{"foo"})
+		require.NoError(t, err)
+	}
+
+	purger := NewPurger(PurgerConfig{}, TableManagerConfig{}, store, storage, nil)
+	require.NoError(t, purger.DeleteUser(context.Background(), "user1"))
+
+	get := func(userID string) []Chunk {
+		ctx := user.Inject(context.Background(), userID)
+		got, err := store.Get(ctx, now.Add(-72*time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+		require.NoError(t, err)
+		return got
+	}
+	assert.Empty(t, get("user1"))
+	assert.Len(t, get("user10"), 1)
+	for _, c := range chunks["user1"] {
+		_, err := storage.GetChunk(context.Background(), c.externalKey())
+		assert.Error(t, err)
+	}
+
+	pending, err := store.deletes.pending(context.Background())
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, "user10", pending[0].UserID)
+}
+
+func TestPurgerCleanupChunks(t *testing.T) {
+	storage := NewMockStorage()
+	purger := NewPurger(PurgerConfig{ChunkCleanupGracePeriod: 24 * time.Hour}, TableManagerConfig{}, &Store{storage: storage}, storage, nil)
+	assert.Error(t, purger.cleanupChunks(context.Background()), "no tables, so every chunk would be deleted")
+
+	_, store := newDeletesTestStore(t)
+	storage = store.storage.(*MockStorage)
+	limits := fakeRetentionLimits{"user2": 7 * 24 * time.Hour}
+	purger = NewPurger(PurgerConfig{ChunkCleanupGracePeriod: 24 * time.Hour}, TableManagerConfig{}, store, storage, limits)
+
+	now := time.Now()
+	through := model.TimeFromUnixNano(now.UnixNano())
+	ctx := context.Background()
+	put := func(modified time.Time, keys ...string) {
+		mtime.NowForce(modified)
+		defer mtime.NowReset()
+		for _, key := range keys {
+			require.NoError(t, storage.PutChunk(ctx, key, []byte("chunk")))
+		}
+	}
+
+	// Putting the chunk sets its checksum, and so its key.
+	stored := []Chunk{chunkAt("user1", through.Add(-72*time.Hour))}
+	mtime.NowForce(now.Add(-72 * time.Hour))
+	require.NoError(t, store.Put(user.Inject(ctx, "user1"), stored))
+	mtime.NowReset()
+	referenced := stored[0]
+	orphan, recentOrphan := chunkAt("user1", through.Add(-48*time.Hour)), chunkAt("user1", through)
+	expired, legacy := chunkAt("user2", through.Add(-8*24*time.Hour)), "user1/1:2:3"
+	put(now.Add(-48*time.Hour), orphan.externalKey(), legacy, "rules/1/recording.rules")
+	put(now, recentOrphan.externalKey(), expired.externalKey())
+
+	require.NoError(t, purger.cleanupChunks(ctx))
+	for key, exists := range map[string]bool{
+		referenced.externalKey():   true,
+		orphan.externalKey():       false,
+		recentOrphan.externalKey(): true,
+		expired.externalKey():      false,
+		legacy:                     false,
+		"rules/1/recording.rules":  true,
+	} {
+		_, err := storage.GetChunk(ctx, key)
+		assert.Equal(t, exists, err == nil, key)
+	}
+}
+
+func TestPurgerBlocks(t *testing.T) {
+	storage := NewMockStorage()
+	store, err := NewStore(StoreConfig{schemaFactory: v6Schema, BlocksStorage: true}, storage)
+	require.NoError(t, err)
+
+	now := model.Now()
+	old, recent := now.Add(-10*24*time.Hour), now.Add(-time.Hour)
+	for _, userID := range []string{"user1", "user10", "user2"} {
+		ctx := user.Inject(context.Background(), userID)
+		require.NoError(t, store.Put(ctx, []Chunk{chunkAt(userID, old)}))
+		require.NoError(t, store.Put(ctx, []Chunk{chunkAt(userID, recent)}))
+	}
+	get := func(userID string) []Chunk {
+		ctx := user.Inject(context.Background(), userID)
+		got, err := store.Get(ctx, now.Add(-30*24*time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+		require.NoError(t, err)
+		return got
+	}
+
+	// Only user1 has a retention period.
+	limits := fakeRetentionLimits{"user1": 7 * 24 * time.Hour}
+	purger := NewPurger(PurgerConfig{}, TableManagerConfig{}, store, storage, limits)
+	require.NoError(t, purger.purge(context.Background()))
+	got := get("user1")
+	require.Len(t, got, 1)
+	assert.Equal(t, recent, got[0].Through)
+	assert.Len(t, get("user2"), 2)
+
+	require.NoError(t, purger.DeleteUser(context.Background(), "user1"))
+	assert.Empty(t, get("user1"))
+	assert.Len(t, get("user10"), 2)
+}
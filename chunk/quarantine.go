@@ -0,0 +1,332 @@
+package chunk
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+const (
+	// Key in the KV store under which the quarantine list is stored.
+	quarantineKey = "chunk-quarantine"
+
+	consulQuarantineStore   = "consul"
+	inMemoryQuarantineStore = "inmemory"
+)
+
+var quarantineSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "chunk_store_quarantine_skipped_total",
+	Help:      "The total number of quarantined chunks, blocks and index rows skipped by queries.",
+}, []string{"kind"})
+
+func init() {
+	prometheus.MustRegister(quarantineSkipped)
+}
+
+// QuarantineConfig configures the quarantine list, which operators use to
+// make queries skip chunks or index rows known to be corrupt.  The list is
+// kept in a KV store so it applies to every process reading from the store.
+type QuarantineConfig struct {
+	Store string
+
+	// Set by the main of each process, as the ring's.
+	ConsulConfig *ring.ConsulConfig
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *QuarantineConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Store, "store.quarantine.store", "", "Backend storing the list of quarantined chunks and index rows: consul or inmemory. Empty disables the quarantine.")
+}
+
+// QuarantineEntry quarantines either a chunk, by its external key, or a
+// block, by its key, or an index row, by its table and hash value.
+type QuarantineEntry struct {
+	ChunkKey  string    `json:"chunk_key,omitempty"`
+	TableName string    `json:"table_name,omitempty"`
+	HashValue string    `json:"hash_value,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (e QuarantineEntry) validate() error {
+	isChunk, isRow := e.ChunkKey != "", e.TableName != "" || e.HashValue != ""
+	switch {
+	case isChunk && isRow:
+		return fmt.Errorf("a quarantine entry must have either a chunk key or a table name and hash value, not both")
+	case !isChunk && e.HashValue == "":
+		return fmt.Errorf("a quarantine entry must have either a chunk key or a table name and hash value")
+	}
+	return nil
+}
+
+func (e QuarantineEntry) same(other QuarantineEntry) bool {
+	return e.ChunkKey == other.ChunkKey && e.TableName == other.TableName && e.HashValue == other.HashValue
+}
+
+// QuarantineList is the value stored in the KV store.
+type QuarantineList struct {
+	Entries []QuarantineEntry `json:"entries"`
+}
+
+type quarantineCodec struct{}
+
+// Decode implements ring.Codec
+func (quarantineCodec) Decode(buf []byte) (interface{}, error) {
+	var list QuarantineList
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// Encode implements ring.Codec
+func (quarantineCodec) Encode(msg interface{}) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+type rowKey struct {
+	tableName, hashValue string
+}
+
+// quarantine caches the quarantine list from the KV store, by watching it.
+type quarantine struct {
+	client   ring.ConsulClient
+	done     chan struct{}
+	finished chan struct{}
+
+	mtx     sync.RWMutex
+	entries []QuarantineEntry
+	chunks  map[string]struct{}
+	rows    map[rowKey]struct{}
+}
+
+func newQuarantine(cfg QuarantineConfig) (*quarantine, error) {
+	var client ring.ConsulClient
+	switch cfg.Store {
+	case consulQuarantineStore:
+		if cfg.ConsulConfig == nil {
+			return nil, fmt.Errorf("the %s quarantine store requires consul to be configured", consulQuarantineStore)
+		}
+		var err error
+		client, err = ring.NewConsulClient(*cfg.ConsulConfig, quarantineCodec{})
+		if err != nil {
+			return nil, err
+		}
+	case inMemoryQuarantineStore:
+		client = ring.NewInMemoryConsulClient(quarantineCodec{})
+	default:
+		return nil, fmt.Errorf("unknown quarantine store: %q", cfg.Store)
+	}
+
+	q := &quarantine{
+		client:   client,
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+		entries:  []QuarantineEntry{},
+		chunks:   map[string]struct{}{},
+		rows:     map[rowKey]struct{}{},
+	}
+	go q.loop()
+	return q, nil
+}
+
+func (q *quarantine) loop() {
+	defer close(q.finished)
+	q.client.WatchKey(quarantineKey, q.done, func(value interface{}) bool {
+		list, _ := value.(*QuarantineList)
+		q.update(list)
+		return true
+	})
+}
+
+func (q *quarantine) stop() {
+	close(q.done)
+	<-q.finished
+}
+
+func (q *quarantine) update(list *QuarantineList) {
+	entries := []QuarantineEntry{}
+	chunks := map[string]struct{}{}
+	rows := map[rowKey]struct{}{}
+	if list != nil {
+		entries = list.Entries
+		for _, e := range entries {
+			if e.ChunkKey != "" {
+				chunks[e.ChunkKey] = struct{}{}
+			} else {
+				rows[rowKey{e.TableName, e.HashValue}] = struct{}{}
+			}
+		}
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.entries = entries
+	q.chunks = chunks
+	q.rows = rows
+}
+
+func (q *quarantine) list() QuarantineList {
+	q.mtx.RLock()
+	defer q.mtx.RUnlock()
+	return QuarantineList{Entries: q.entries}
+}
+
+// add quarantines an entry, replacing any existing entry for the same chunk
+// or row.
+func (q *quarantine) add(entry QuarantineEntry) error {
+	if err := entry.validate(); err != nil {
+		return err
+	}
+	return q.modify(func(list *QuarantineList) {
+		list.Entries = removeQuarantineEntry(list.Entries, entry)
+		list.Entries = append(list.Entries, entry)
+		sort.Slice(list.Entries, func(i, j int) bool {
+			return list.Entries[i].CreatedAt.Before(list.Entries[j].CreatedAt)
+		})
+	})
+}
+
+// remove releases an entry from quarantine.
+func (q *quarantine) remove(entry QuarantineEntry) error {
+	return q.modify(func(list *QuarantineList) {
+		list.Entries = removeQuarantineEntry(list.Entries, entry)
+	})
+}
+
+func (q *quarantine) modify(f func(*QuarantineList)) error {
+	var list *QuarantineList
+	err := q.client.CAS(quarantineKey, func(in interface{}) (out interface{}, retry bool, err error) {
+		list = &QuarantineList{}
+		if in != nil {
+			list.Entries = append(list.Entries, in.(*QuarantineList).Entries...)
+		}
+		f(list)
+		return list, true, nil
+	})
+	if err != nil {
+		return err
+	}
+	// Don't wait for the watch, so the change applies to this process as
+	// soon as the request returns.
+	q.update(list)
+	return nil
+}
+
+func removeQuarantineEntry(entries []QuarantineEntry, entry QuarantineEntry) []QuarantineEntry {
+	result := entries[:0]
+	for _, e := range entries {
+		if !e.same(entry) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// filterChunks removes quarantined chunks.
+func (q *quarantine) filterChunks(chunks []Chunk) []Chunk {
+	q.mtx.RLock()
+	defer q.mtx.RUnlock()
+	if len(q.chunks) == 0 {
+		return chunks
+	}
+
+	result := make([]Chunk, 0, len(chunks))
+	for _, chunk := range chunks {
+		key := chunk.externalKey()
+		if _, ok := q.chunks[key]; ok {
+			log.Warnf("Skipping quarantined chunk %s", key)
+			quarantineSkipped.WithLabelValues("chunk").Inc()
+			continue
+		}
+		result = append(result, chunk)
+	}
+	return result
+}
+
+// filterBlocks removes quarantined blocks, which are quarantined by key like
+// chunks.
+func (q *quarantine) filterBlocks(blocks []blockMeta) []blockMeta {
+	q.mtx.RLock()
+	defer q.mtx.RUnlock()
+	if len(q.chunks) == 0 {
+		return blocks
+	}
+
+	result := make([]blockMeta, 0, len(blocks))
+	for _, block := range blocks {
+		if _, ok := q.chunks[block.key]; ok {
+			log.Warnf("Skipping quarantined block %s", block.key)
+			quarantineSkipped.WithLabelValues("block").Inc()
+			continue
+		}
+		result = append(result, block)
+	}
+	return result
+}
+
+// filterEntries removes index entries reading quarantined rows.
+func (q *quarantine) filterEntries(entries []IndexEntry) []IndexEntry {
+	q.mtx.RLock()
+	defer q.mtx.RUnlock()
+	if len(q.rows) == 0 {
+		return entries
+	}
+
+	result := make([]IndexEntry, 0, len(entries))
+	for _, entry := range entries {
+		if _, ok := q.rows[rowKey{entry.TableName, entry.HashValue}]; ok {
+			log.Warnf("Skipping quarantined index row %s in %s", entry.HashValue, entry.TableName)
+			quarantineSkipped.WithLabelValues("index_row").Inc()
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// ServeHTTP lists the quarantine on GET, adds the posted entry on POST, and
+// removes the entry in the body on DELETE.
+func (q *quarantine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST", "DELETE":
+		var entry QuarantineEntry
+		if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if r.Method == "POST" {
+			entry.CreatedAt = time.Now()
+			if err = entry.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = q.add(entry)
+		} else {
+			err = q.remove(entry)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("%s quarantine entry %+v", r.Method, entry)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	util.WriteJSONResponse(w, q.list())
+}
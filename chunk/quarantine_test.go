@@ -0,0 +1,100 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+func quarantineRequest(t *testing.T, store *Store, method string, entry QuarantineEntry) (int, QuarantineList) {
+	buf, err := json.Marshal(entry)
+	require.NoError(t, err)
+	req := httptest.NewRequest(method, "/quarantine", bytes.NewReader(buf))
+	rec := httptest.NewRecorder()
+	store.Quarantine(rec, req)
+
+	var list QuarantineList
+	if rec.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	}
+	return rec.Code, list
+}
+
+func TestQuarantine(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	now := model.Now()
+	chunk1 := dummyChunkFor(model.Metric{
+		model.MetricNameLabel: "foo",
+		"bar":                 "baz",
+	})
+	chunk2 := dummyChunkFor(model.Metric{
+		model.MetricNameLabel: "foo",
+		"bar":                 "beep",
+	})
+	store := newTestChunkStore(t, StoreConfig{
+		schemaFactory: v6Schema,
+		Quarantine:    QuarantineConfig{Store: inMemoryQuarantineStore},
+	})
+	require.NoError(t, store.Put(ctx, []Chunk{chunk1, chunk2}))
+
+	nameMatcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	get := func(matchers ...*metric.LabelMatcher) []model.Metric {
+		chunks, err := store.Get(ctx, now.Add(-time.Hour), now, matchers...)
+		require.NoError(t, err)
+		var metrics []model.Metric
+		for _, c := range chunks {
+			metrics = append(metrics, c.Metric)
+		}
+		return metrics
+	}
+	chunks, err := store.Get(ctx, now.Add(-time.Hour), now, nameMatcher)
+	require.NoError(t, err)
+	require.Len(t, chunks, 2)
+
+	// Quarantining a chunk skips it.
+	code, list := quarantineRequest(t, store, "POST", QuarantineEntry{ChunkKey: chunks[0].externalKey(), Reason: "corrupt"})
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, list.Entries, 1)
+	assert.Equal(t, "corrupt", list.Entries[0].Reason)
+	assert.Equal(t, []model.Metric{chunks[1].Metric}, get(nameMatcher))
+
+	// Quarantining an index row skips the chunks only found through it.
+	barMatcher := mustNewLabelMatcher(metric.Equal, "bar", "beep")
+	entries, err := store.schema.GetReadEntriesForMetricLabelValue(now.Add(-time.Hour), now, userID, "foo", "bar", "beep")
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+	for _, entry := range entries {
+		code, _ = quarantineRequest(t, store, "POST", QuarantineEntry{TableName: entry.TableName, HashValue: entry.HashValue})
+		require.Equal(t, http.StatusOK, code)
+	}
+	assert.Empty(t, get(nameMatcher, barMatcher))
+
+	// Releasing entries makes their data queryable again.
+	code, list = quarantineRequest(t, store, "DELETE", QuarantineEntry{ChunkKey: chunks[0].externalKey()})
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, list.Entries, len(entries))
+	assert.Len(t, get(nameMatcher), 2)
+
+	// Entries must be either a chunk or a row.
+	code, _ = quarantineRequest(t, store, "POST", QuarantineEntry{TableName: "table"})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = quarantineRequest(t, store, "POST", QuarantineEntry{ChunkKey: "key", TableName: "table", HashValue: "hash"})
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestQuarantineDisabled(t *testing.T) {
+	store := newTestChunkStore(t, StoreConfig{schemaFactory: v6Schema})
+	code, _ := quarantineRequest(t, store, "GET", QuarantineEntry{})
+	assert.Equal(t, http.StatusNotFound, code)
+}
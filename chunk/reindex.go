@@ -0,0 +1,132 @@
+package chunk
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// schemaVersions are the schemas index entries can be rewritten under.
+var schemaVersions = map[string]func(cfg SchemaConfig) Schema{
+	"v1": v1Schema,
+	"v2": v2Schema,
+	"v3": v3Schema,
+	"v4": v4Schema,
+	"v5": v5Schema,
+	"v6": v6Schema,
+	"v7": v7Schema,
+	"v8": v8Schema,
+}
+
+// Reindex writes index entries under the given schema version, e.g. "v6",
+// for the chunks between from and through of the user, or of every user if
+// userID is empty, alongside their existing entries.  Once every period up
+// to the version's start date has been reindexed, the start date can be
+// moved back to from, so those periods are read with the new schema too.
+// The chunks are fetched to find their labels, which the entries of some
+// schemas don't hold.  Rerunning it over the same period is safe.
+func (c *Store) Reindex(ctx context.Context, version, userID string, from, through model.Time) error {
+	newSchema, ok := schemaVersions[version]
+	if !ok {
+		return fmt.Errorf("unknown schema version %q", version)
+	}
+
+	for _, table := range c.cfg.tablesForRange(from, through) {
+		log.Infof("Reindexing chunks in table %s under schema %s", table, version)
+		r := &reindexer{store: c, schema: newSchema(c.cfg.SchemaConfig), seen: map[string]struct{}{}}
+		if scanErr := c.storage.ScanTable(ctx, table, func(hashValue string, rangeValue []byte, value []byte) bool {
+			chunkUserID := hashUserID(hashValue)
+			if userID != "" && chunkUserID != userID {
+				return true
+			}
+			chunkID, _, _, err := parseRangeValue(hashValue, rangeValue, value)
+			if err != nil {
+				log.Warnf("Error parsing index entry %s/%x in table %s: %v", hashValue, rangeValue, table, err)
+				return true
+			}
+			chunk, err := parseExternalKey(chunkUserID, chunkID)
+			if err != nil {
+				log.Warnf("Error parsing chunk ID %s in table %s: %v", chunkID, table, err)
+				return true
+			}
+			if chunk.Through.Before(from) || chunk.From.After(through) {
+				return true
+			}
+			return r.add(ctx, chunk)
+		}); scanErr != nil {
+			return scanErr
+		}
+		if err := r.flush(ctx); err != nil {
+			return err
+		}
+		log.Infof("Reindexed %d chunks in table %s, writing %d index entries", len(r.seen), table, r.numEntries)
+	}
+	return nil
+}
+
+// reindexer fetches chunks in batches, and writes their index entries under
+// a schema.  The entries it writes may show up in the scan it's part of, so
+// it remembers the chunks it has seen.
+type reindexer struct {
+	store   *Store
+	schema  Schema
+	seen    map[string]struct{}
+	pending []Chunk
+	err     error
+
+	numEntries int
+}
+
+// add queues the chunk for reindexing, if it hasn't been seen.  It returns
+// false after failing to reindex a batch.
+func (r *reindexer) add(ctx context.Context, chunk Chunk) bool {
+	key := chunk.externalKey()
+	if _, ok := r.seen[key]; ok {
+		return true
+	}
+	r.seen[key] = struct{}{}
+	r.pending = append(r.pending, chunk)
+	if len(r.pending) >= purgeBatchSize {
+		r.err = r.flush(ctx)
+	}
+	return r.err == nil
+}
+
+func (r *reindexer) flush(ctx context.Context) error {
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.pending) == 0 {
+		return nil
+	}
+	chunks, err := r.store.fetchChunkData(ctx, r.pending)
+	if err != nil {
+		return err
+	}
+	batch := r.store.storage.NewWriteBatch()
+	numEntries := 0
+	for _, chunk := range chunks {
+		metricName, err := util.ExtractMetricNameFromMetric(chunk.Metric)
+		if err != nil {
+			return err
+		}
+		entries, err := r.schema.GetWriteEntries(chunk.From, chunk.Through, chunk.UserID, metricName, chunk.Metric, chunk.externalKey())
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			batch.Add(entry.TableName, entry.HashValue, entry.RangeValue, entry.Value)
+		}
+		numEntries += len(entries)
+	}
+	if err := r.store.storage.BatchWrite(ctx, batch); err != nil {
+		return err
+	}
+	r.numEntries += numEntries
+	r.pending = r.pending[:0]
+	return nil
+}
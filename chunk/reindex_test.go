@@ -0,0 +1,62 @@
+package chunk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+func TestReindex(t *testing.T) {
+	storage, _ := newDeletesTestStore(t)
+	oldStore, err := NewStore(StoreConfig{schemaFactory: v1Schema}, storage)
+	require.NoError(t, err)
+	newStore, err := NewStore(StoreConfig{schemaFactory: v6Schema}, storage)
+	require.NoError(t, err)
+
+	now := model.Now()
+	chunks := map[string]Chunk{
+		"user1": chunkOf(t, "user1", now.Add(-2*time.Hour), now.Add(-time.Hour)),
+		"user2": chunkOf(t, "user2", now.Add(-2*time.Hour), now.Add(-time.Hour)),
+	}
+	for userID, c := range chunks {
+		require.NoError(t, oldStore.Put(user.Inject(context.Background(), userID), []Chunk{c}))
+	}
+	get := func(userID string) []Chunk {
+		got, err := newStore.Get(user.Inject(context.Background(), userID), now.Add(-3*time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+		require.NoError(t, err)
+		return got
+	}
+	require.Empty(t, get("user1"), "the v6 schema can't read v1 entries")
+
+	assert.Error(t, oldStore.Reindex(context.Background(), "v9", "", now.Add(-3*time.Hour), now))
+	require.NoError(t, oldStore.Reindex(context.Background(), "v6", "user1", now.Add(-3*time.Hour), now))
+	got := get("user1")
+	require.Len(t, got, 1)
+	assert.Equal(t, chunks["user1"].Metric, got[0].Metric)
+	assert.Empty(t, get("user2"))
+
+	require.NoError(t, oldStore.Reindex(context.Background(), "v6", "user2", now.Add(-3*time.Hour), now))
+	assert.Len(t, get("user1"), 1)
+	assert.Len(t, get("user2"), 1)
+
+	// Entries can be rewritten under the v7 schema, without their chunk
+	// IDs' user ID, and the v8 schema, with their chunk IDs packed.
+	for _, version := range []string{"v7", "v8"} {
+		newStore, err := NewStore(StoreConfig{schemaFactory: schemaVersions[version]}, storage)
+		require.NoError(t, err)
+		require.NoError(t, oldStore.Reindex(context.Background(), version, "", now.Add(-3*time.Hour), now))
+		for userID, c := range chunks {
+			got, err := newStore.Get(user.Inject(context.Background(), userID), now.Add(-3*time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+			require.NoError(t, err)
+			require.Len(t, got, 1, version)
+			assert.Equal(t, c.Metric, got[0].Metric)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package chunk
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/opentracing/opentracing-go"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// S3 rejects parts, other than the last, smaller than this.
+const minS3PartSize = 5 << 20
+
+// multipart returns whether an object of the given size is uploaded in
+// parts.
+func (a awsStorageClient) multipart(size int) bool {
+	return a.multipartThreshold > 0 && size > a.multipartThreshold
+}
+
+// putChunkMultipart uploads the object in parts of multipartPartSize, so
+// large objects, such as blocks or batches of many chunks, aren't lost to a
+// single failed request.  A failed upload is aborted, so its parts aren't
+// billed.
+func (a awsStorageClient) putChunkMultipart(ctx context.Context, key string, buf []byte) error {
+	if sp := opentracing.SpanFromContext(ctx); sp != nil {
+		sp.SetTag("key", key)
+		sp.SetTag("size", len(buf))
+	}
+
+	var uploadID *string
+	err := instrument.TimeRequestHistogram(ctx, "S3.CreateMultipartUpload", s3RequestDuration, func(ctx context.Context) error {
+		req, out := a.S3.CreateMultipartUploadRequest(&s3.CreateMultipartUploadInput{
+			Bucket: aws.String(a.bucketName),
+			Key:    aws.String(key),
+		})
+		if err := send(ctx, req); err != nil {
+			return err
+		}
+		uploadID = out.UploadId
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	parts, err := a.uploadParts(ctx, key, uploadID, buf)
+	if err == nil {
+		err = instrument.TimeRequestHistogram(ctx, "S3.CompleteMultipartUpload", s3RequestDuration, func(ctx context.Context) error {
+			req, _ := a.S3.CompleteMultipartUploadRequest(&s3.CompleteMultipartUploadInput{
+				Bucket:          aws.String(a.bucketName),
+				Key:             aws.String(key),
+				UploadId:        uploadID,
+				MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+			})
+			return send(ctx, req)
+		})
+	}
+	if err != nil {
+		abortErr := instrument.TimeRequestHistogram(ctx, "S3.AbortMultipartUpload", s3RequestDuration, func(ctx context.Context) error {
+			req, _ := a.S3.AbortMultipartUploadRequest(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(a.bucketName),
+				Key:      aws.String(key),
+				UploadId: uploadID,
+			})
+			return send(ctx, req)
+		})
+		if abortErr != nil {
+			log.Warnf("Error aborting multipart upload of %s: %v", key, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (a awsStorageClient) uploadParts(ctx context.Context, key string, uploadID *string, buf []byte) ([]*s3.CompletedPart, error) {
+	var parts []*s3.CompletedPart
+	for offset, partNumber := 0, int64(1); offset < len(buf); offset, partNumber = offset+a.multipartPartSize, partNumber+1 {
+		end := offset + a.multipartPartSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		err := instrument.TimeRequestHistogram(ctx, "S3.UploadPart", s3RequestDuration, func(ctx context.Context) error {
+			req, out := a.S3.UploadPartRequest(&s3.UploadPartInput{
+				Body:       bytes.NewReader(buf[offset:end]),
+				Bucket:     aws.String(a.bucketName),
+				Key:        aws.String(key),
+				PartNumber: aws.Int64(partNumber),
+				UploadId:   uploadID,
+			})
+			if err := send(ctx, req); err != nil {
+				return err
+			}
+			parts = append(parts, &s3.CompletedPart{ETag: out.ETag, PartNumber: aws.Int64(partNumber)})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+// validateMultipart checks the multipart upload config against S3's limits.
+func (cfg AWSStorageConfig) validateMultipart() error {
+	if cfg.S3MultipartThreshold > 0 && cfg.S3MultipartPartSize < minS3PartSize {
+		return fmt.Errorf("S3 multipart part size must be at least %d bytes, not %d", minS3PartSize, cfg.S3MultipartPartSize)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package chunk
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// mockS3Multipart records single and multipart uploads.
+type mockS3Multipart struct {
+	s3iface.S3API
+
+	failPart  int64
+	puts      int
+	parts     map[int64][]byte
+	completed []byte
+	aborted   bool
+}
+
+func (m *mockS3Multipart) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	return mockRequest(input, &s3.PutObjectOutput{}, func() error {
+		m.puts++
+		return nil
+	}), &s3.PutObjectOutput{}
+}
+
+func (m *mockS3Multipart) CreateMultipartUploadRequest(input *s3.CreateMultipartUploadInput) (*request.Request, *s3.CreateMultipartUploadOutput) {
+	output := &s3.CreateMultipartUploadOutput{}
+	return mockRequest(input, output, func() error {
+		m.parts = map[int64][]byte{}
+		output.UploadId = aws.String("upload")
+		return nil
+	}), output
+}
+
+func (m *mockS3Multipart) UploadPartRequest(input *s3.UploadPartInput) (*request.Request, *s3.UploadPartOutput) {
+	output := &s3.UploadPartOutput{}
+	return mockRequest(input, output, func() error {
+		if *input.PartNumber == m.failPart {
+			return fmt.Errorf("part %d failed", m.failPart)
+		}
+		buf, err := ioutil.ReadAll(input.Body)
+		if err != nil {
+			return err
+		}
+		m.parts[*input.PartNumber] = buf
+		output.ETag = aws.String(fmt.Sprintf("etag%d", *input.PartNumber))
+		return nil
+	}), output
+}
+
+func (m *mockS3Multipart) CompleteMultipartUploadRequest(input *s3.CompleteMultipartUploadInput) (*request.Request, *s3.CompleteMultipartUploadOutput) {
+	return mockRequest(input, &s3.CompleteMultipartUploadOutput{}, func() error {
+		m.completed = nil
+		for i, part := range input.MultipartUpload.Parts {
+			if *part.PartNumber != int64(i+1) || *part.ETag != fmt.Sprintf("etag%d", i+1) {
+				return fmt.Errorf("unexpected part %d", *part.PartNumber)
+			}
+			m.completed = append(m.completed, m.parts[*part.PartNumber]...)
+		}
+		return nil
+	}), &s3.CompleteMultipartUploadOutput{}
+}
+
+func (m *mockS3Multipart) AbortMultipartUploadRequest(input *s3.AbortMultipartUploadInput) (*request.Request, *s3.AbortMultipartUploadOutput) {
+	return mockRequest(input, &s3.AbortMultipartUploadOutput{}, func() error {
+		m.aborted = true
+		return nil
+	}), &s3.AbortMultipartUploadOutput{}
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	mock := &mockS3Multipart{}
+	client := awsStorageClient{
+		S3:                 mock,
+		bucketName:         "bucket",
+		multipartThreshold: 10,
+		multipartPartSize:  4,
+	}
+
+	require.NoError(t, client.PutChunk(context.Background(), "small", []byte("0123456789")))
+	assert.Equal(t, 1, mock.puts)
+	assert.Nil(t, mock.parts)
+
+	large := []byte("0123456789ab")
+	require.NoError(t, client.PutChunk(context.Background(), "large", large))
+	assert.Equal(t, 1, mock.puts)
+	assert.Len(t, mock.parts, 3)
+	assert.True(t, bytes.Equal(large, mock.completed))
+	assert.False(t, mock.aborted)
+
+	mock.failPart = 2
+	assert.Error(t, client.PutChunk(context.Background(), "large", large))
+	assert.True(t, mock.aborted)
+}
+
+func TestS3MultipartConfig(t *testing.T) {
+	cfg := AWSStorageConfig{S3MultipartThreshold: 32 << 20, S3MultipartPartSize: 1 << 20}
+	assert.Error(t, cfg.validateMultipart())
+	cfg.S3MultipartThreshold = 0
+	assert.NoError(t, cfg.validateMultipart())
+}
@@ -0,0 +1,115 @@
+package chunk
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+var (
+	s3Retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "s3_request_retries_total",
+		Help:      "Total number of S3 requests retried, by whether S3 throttled them.",
+	}, []string{"operation", "reason"})
+	s3Failures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "s3_request_failures_total",
+		Help:      "Total number of S3 requests which still failed with retryable errors after their last retry, by whether S3 throttled them.",
+	}, []string{"operation", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(s3Retries)
+	prometheus.MustRegister(s3Failures)
+}
+
+const (
+	reasonThrottled = "throttled"
+	reasonError     = "error"
+)
+
+// S3RetryConfig configures how S3 requests are retried.
+type S3RetryConfig struct {
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet.
+func (cfg *S3RetryConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.MaxRetries, "s3.max-retries", 3, "Maximum number of times to retry S3 requests which fail with retryable errors, such as SlowDown responses. 0 to never retry.")
+	f.DurationVar(&cfg.MinBackoff, "s3.min-backoff", 100*time.Millisecond, "Backoff before the first retry of an S3 request; it doubles with each retry.")
+	f.DurationVar(&cfg.MaxBackoff, "s3.max-backoff", 3*time.Second, "Maximum backoff between retries of an S3 request.")
+}
+
+func (cfg S3RetryConfig) validate() error {
+	if cfg.MaxRetries > 0 && (cfg.MinBackoff <= 0 || cfg.MaxBackoff < cfg.MinBackoff) {
+		return fmt.Errorf("S3 backoff must be positive, with the maximum at least the minimum (%v, %v)", cfg.MinBackoff, cfg.MaxBackoff)
+	}
+	return nil
+}
+
+// s3Retryer retries the requests the SDK considers retryable, with jittered
+// exponential backoff between cfg's bounds rather than the SDK's.
+type s3Retryer struct {
+	client.DefaultRetryer
+	cfg S3RetryConfig
+}
+
+func newS3Retryer(cfg S3RetryConfig) s3Retryer {
+	return s3Retryer{
+		DefaultRetryer: client.DefaultRetryer{NumMaxRetries: cfg.MaxRetries},
+		cfg:            cfg,
+	}
+}
+
+// RetryRules implements request.Retryer.
+func (r s3Retryer) RetryRules(req *request.Request) time.Duration {
+	backoff := r.cfg.MaxBackoff
+	if req.RetryCount < 32 {
+		if b := r.cfg.MinBackoff << uint(req.RetryCount); b > 0 && b < backoff {
+			backoff = b
+		}
+	}
+	// Between half and all of the backoff, so throttled clients spread out.
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// instrumentS3Retry is an AfterRetry handler counting the S3 requests which
+// are retried, and those which run out of retries.  Requests failing with
+// errors which aren't retried, e.g. NoSuchKey, aren't counted.
+func instrumentS3Retry(req *request.Request) {
+	reason := reasonError
+	if resp := req.HTTPResponse; resp != nil &&
+		(resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests) {
+		reason = reasonThrottled
+	}
+	switch {
+	case req.Error == nil:
+		s3Retries.WithLabelValues(req.Operation.Name, reason).Inc()
+	case aws.BoolValue(req.Retryable):
+		s3Failures.WithLabelValues(req.Operation.Name, reason).Inc()
+	}
+}
+
+// sleepWithContext returns a request's SleepDelay which stops sleeping if
+// ctx is done, so requests aren't held up backing off to retry.
+func sleepWithContext(ctx context.Context) func(time.Duration) {
+	return func(d time.Duration) {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+	}
+}
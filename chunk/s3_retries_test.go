@@ -0,0 +1,83 @@
+package chunk
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func counterValue(t *testing.T, vec *prometheus.CounterVec, labels ...string) float64 {
+	m := &dto.Metric{}
+	require.NoError(t, vec.WithLabelValues(labels...).(prometheus.Counter).Write(m))
+	return m.GetCounter().GetValue()
+}
+
+func TestS3Retries(t *testing.T) {
+	// S3 slows down the first slowDowns requests.
+	var requests, slowDowns int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+			return
+		}
+		if atomic.AddInt32(&requests, 1) <= atomic.LoadInt32(&slowDowns) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`))
+			return
+		}
+	}))
+	defer server.Close()
+
+	u, err := url.Parse("s3://key:secret@" + server.Listener.Addr().String() + "/bucket")
+	require.NoError(t, err)
+	cfg := S3RetryConfig{MaxRetries: 2, MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+	s3Client, err := newS3Client(u, "", true, cfg)
+	require.NoError(t, err)
+	client := awsStorageClient{S3: s3Client, bucketName: "bucket"}
+
+	var (
+		retries  = counterValue(t, s3Retries, "PutObject", reasonThrottled)
+		failures = counterValue(t, s3Failures, "PutObject", reasonThrottled)
+	)
+	atomic.StoreInt32(&slowDowns, 2)
+	require.NoError(t, client.PutChunk(context.Background(), "chunk", []byte("data")))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	assert.Equal(t, retries+2, counterValue(t, s3Retries, "PutObject", reasonThrottled))
+	assert.Equal(t, failures, counterValue(t, s3Failures, "PutObject", reasonThrottled))
+
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&slowDowns, 3)
+	require.Error(t, client.PutChunk(context.Background(), "chunk", []byte("data")))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	assert.Equal(t, retries+4, counterValue(t, s3Retries, "PutObject", reasonThrottled))
+	assert.Equal(t, failures+1, counterValue(t, s3Failures, "PutObject", reasonThrottled))
+
+	// Missing chunks aren't retried, nor counted as failures.
+	failures = counterValue(t, s3Failures, "GetObject", reasonError)
+	_, err = client.GetChunk(context.Background(), "missing")
+	assert.Equal(t, ErrChunkNotFound, err)
+	assert.Equal(t, failures, counterValue(t, s3Failures, "GetObject", reasonError))
+}
+
+func TestS3RetryBackoff(t *testing.T) {
+	r := newS3Retryer(S3RetryConfig{MaxRetries: 10, MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second})
+	for retry, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		for i := 0; i < 10; i++ {
+			backoff := r.RetryRules(&request.Request{RetryCount: retry})
+			assert.True(t, backoff >= max/2 && backoff <= max, "retry %d: %v", retry, backoff)
+		}
+	}
+	assert.True(t, r.RetryRules(&request.Request{RetryCount: 100}) <= time.Second)
+}
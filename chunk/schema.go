@@ -7,6 +7,7 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
@@ -30,6 +31,8 @@ var (
 	rangeKeyV3 = []byte{'3'}
 	rangeKeyV4 = []byte{'4'}
 	rangeKeyV5 = []byte{'5'}
+	rangeKeyV6 = []byte{'6'}
+	rangeKeyV7 = []byte{'7'}
 )
 
 // Schema interface defines methods to calculate the hash and range keys needed
@@ -83,18 +86,33 @@ type SchemaConfig struct {
 
 	// After this time, we will read and write v6 schemas.
 	V6SchemaFrom util.DayValue
+
+	// After this time, we will read and write v7 schemas.
+	V7SchemaFrom util.DayValue
+
+	// After this time, we will read and write v8 schemas.
+	V8SchemaFrom util.DayValue
+
+	// After this time, the canary tenants read and write the latest schema,
+	// ahead of everyone else.
+	CanarySchemaFrom util.DayValue
+	CanaryTenants    string
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *SchemaConfig) RegisterFlags(f *flag.FlagSet) {
 	cfg.PeriodicTableConfig.RegisterFlags(f)
 
-	flag.StringVar(&cfg.OriginalTableName, "dynamodb.original-table-name", "", "The name of the DynamoDB table used before versioned schemas were introduced.")
+	f.StringVar(&cfg.OriginalTableName, "dynamodb.original-table-name", "", "The name of the DynamoDB table used before versioned schemas were introduced.")
 	f.Var(&cfg.DailyBucketsFrom, "dynamodb.daily-buckets-from", "The date (in the format YYYY-MM-DD) of the first day for which DynamoDB index buckets should be day-sized vs. hour-sized.")
 	f.Var(&cfg.Base64ValuesFrom, "dynamodb.base64-buckets-from", "The date (in the format YYYY-MM-DD) after which we will stop querying to non-base64 encoded values.")
 	f.Var(&cfg.V4SchemaFrom, "dynamodb.v4-schema-from", "The date (in the format YYYY-MM-DD) after which we enable v4 schema.")
 	f.Var(&cfg.V5SchemaFrom, "dynamodb.v5-schema-from", "The date (in the format YYYY-MM-DD) after which we enable v5 schema.")
 	f.Var(&cfg.V6SchemaFrom, "dynamodb.v6-schema-from", "The date (in the format YYYY-MM-DD) after which we enable v6 schema.")
+	f.Var(&cfg.V7SchemaFrom, "dynamodb.v7-schema-from", "The date (in the format YYYY-MM-DD) after which we enable v7 schema, which leaves the user ID, already in the hash key, out of chunk IDs in range keys.")
+	f.Var(&cfg.V8SchemaFrom, "dynamodb.v8-schema-from", "The date (in the format YYYY-MM-DD) after which we enable v8 schema, which packs chunk IDs in range keys, relative to the day in the hash key.")
+	f.Var(&cfg.CanarySchemaFrom, "dynamodb.canary-schema-from", "The date (in the format YYYY-MM-DD) after which the canary tenants use the latest enabled schema, which must start later.")
+	f.StringVar(&cfg.CanaryTenants, "dynamodb.canary-tenants", "", "Comma separated IDs of tenants to use the latest schema from the canary date. Tenants must stay in the list until data from before the latest schema's date has expired, or their data from between the dates can't be read.")
 }
 
 func (cfg *SchemaConfig) tableForBucket(bucketStart int64) string {
@@ -105,6 +123,27 @@ func (cfg *SchemaConfig) tableForBucket(bucketStart int64) string {
 	return cfg.TablePrefix + strconv.Itoa(int(bucketStart/int64(cfg.TablePeriod/time.Second)))
 }
 
+// tablesForRange returns the names of the tables which may hold index entries
+// of chunks between from and through.
+func (cfg *SchemaConfig) tablesForRange(from, through model.Time) []string {
+	if !cfg.UsePeriodicTables {
+		return []string{cfg.OriginalTableName}
+	}
+	var tables []string
+	if from.Unix() < cfg.PeriodicTableStartAt.Unix() {
+		tables = append(tables, cfg.OriginalTableName)
+	}
+	period := int64(cfg.TablePeriod / time.Second)
+	first := from.Unix() / period
+	if start := cfg.PeriodicTableStartAt.Unix() / period; first < start {
+		first = start
+	}
+	for i := first; i <= through.Unix()/period; i++ {
+		tables = append(tables, cfg.TablePrefix+strconv.Itoa(int(i)))
+	}
+	return tables
+}
+
 type bucketCallback func(from, through uint32, tableName, hashKey string) ([]IndexEntry, error)
 
 func (cfg SchemaConfig) hourlyBuckets(from, through model.Time, userID string, metricName model.LabelValue, callback bucketCallback) ([]IndexEntry, error) {
@@ -197,13 +236,79 @@ func newCompositeSchema(cfg SchemaConfig) (Schema, error) {
 		schemas = append(schemas, compositeSchemaEntry{cfg.V6SchemaFrom.Time, v6Schema(cfg)})
 	}
 
+	if cfg.V7SchemaFrom.IsSet() {
+		schemas = append(schemas, compositeSchemaEntry{cfg.V7SchemaFrom.Time, v7Schema(cfg)})
+	}
+
+	if cfg.V8SchemaFrom.IsSet() {
+		schemas = append(schemas, compositeSchemaEntry{cfg.V8SchemaFrom.Time, v8Schema(cfg)})
+	}
+
 	if !sort.IsSorted(byStart(schemas)) {
 		return nil, fmt.Errorf("schemas not in time-sorted order")
 	}
 
+	if cfg.CanarySchemaFrom.IsSet() && cfg.CanaryTenants != "" {
+		return newCanarySchema(cfg, schemas)
+	}
 	return compositeSchema{schemas}, nil
 }
 
+// canarySchema is a Schema which moves some tenants to the latest schema
+// before everyone else, so problems with it affect them first.
+type canarySchema struct {
+	tenants map[string]struct{}
+	canary  Schema
+	Schema
+}
+
+func newCanarySchema(cfg SchemaConfig, schemas []compositeSchemaEntry) (Schema, error) {
+	latest := schemas[len(schemas)-1]
+	if cfg.CanarySchemaFrom.Time >= latest.start {
+		return nil, fmt.Errorf("canary schema must start before the latest schema, at %v", latest.start.Time())
+	}
+	canary := append([]compositeSchemaEntry{}, schemas...)
+	canary[len(canary)-1].start = cfg.CanarySchemaFrom.Time
+	if !sort.IsSorted(byStart(canary)) {
+		return nil, fmt.Errorf("canary schema must start after the previous schema")
+	}
+
+	tenants := map[string]struct{}{}
+	for _, userID := range strings.Split(cfg.CanaryTenants, ",") {
+		if userID = strings.TrimSpace(userID); userID != "" {
+			tenants[userID] = struct{}{}
+		}
+	}
+	return canarySchema{
+		tenants: tenants,
+		canary:  compositeSchema{canary},
+		Schema:  compositeSchema{schemas},
+	}, nil
+}
+
+func (c canarySchema) forUser(userID string) Schema {
+	if _, ok := c.tenants[userID]; ok {
+		return c.canary
+	}
+	return c.Schema
+}
+
+func (c canarySchema) GetWriteEntries(from, through model.Time, userID string, metricName model.LabelValue, labels model.Metric, chunkID string) ([]IndexEntry, error) {
+	return c.forUser(userID).GetWriteEntries(from, through, userID, metricName, labels, chunkID)
+}
+
+func (c canarySchema) GetReadEntriesForMetric(from, through model.Time, userID string, metricName model.LabelValue) ([]IndexEntry, error) {
+	return c.forUser(userID).GetReadEntriesForMetric(from, through, userID, metricName)
+}
+
+func (c canarySchema) GetReadEntriesForMetricLabel(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName) ([]IndexEntry, error) {
+	return c.forUser(userID).GetReadEntriesForMetricLabel(from, through, userID, metricName, labelName)
+}
+
+func (c canarySchema) GetReadEntriesForMetricLabelValue(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName, labelValue model.LabelValue) ([]IndexEntry, error) {
+	return c.forUser(userID).GetReadEntriesForMetricLabelValue(from, through, userID, metricName, labelName, labelValue)
+}
+
 func (c compositeSchema) forSchemas(from, through model.Time, callback func(from, through model.Time, schema Schema) ([]IndexEntry, error)) ([]IndexEntry, error) {
 	if len(c.schemas) == 0 {
 		return nil, nil
@@ -343,6 +448,26 @@ func v6Schema(cfg SchemaConfig) Schema {
 	}
 }
 
+// v7 schema is v6 with the `<user id>/` prefix of chunk IDs, which every
+// range key in a hash key shares, left out of the range keys.
+func v7Schema(cfg SchemaConfig) Schema {
+	return schema{
+		cfg.dailyBuckets,
+		v7Entries{},
+	}
+}
+
+// v8 schema is v7 with the chunk IDs in range keys packed: the chunk's times
+// are deltas from the start of the day in the hash key, which the range keys
+// in a bucket all share, rather than hex encoded from the epoch.  This
+// roughly halves the size of range keys, and so of items.
+func v8Schema(cfg SchemaConfig) Schema {
+	return schema{
+		cfg.dailyBuckets,
+		v8Entries{},
+	}
+}
+
 // schema implements Schema given a bucketing function and and set of range key callbacks
 type schema struct {
 	buckets func(from, through model.Time, userID string, metricName model.LabelValue, callback bucketCallback) ([]IndexEntry, error)
@@ -660,6 +785,178 @@ func (v6Entries) GetReadMetricLabelValueEntries(from, _ uint32, tableName, hashK
 	}, nil
 }
 
+// v7Entries are v6Entries with chunk IDs relative to the user in the hash
+// key, with version 6 range keys.
+type v7Entries struct {
+	v6Entries
+}
+
+func (v7Entries) GetWriteEntries(_, through uint32, tableName, hashKey string, labels model.Metric, chunkID string) ([]IndexEntry, error) {
+	chunkIDBytes := []byte(chunkID[strings.IndexByte(chunkID, '/')+1:])
+	return chunkIDEntries(through, tableName, hashKey, labels, chunkIDBytes, rangeKeyV6), nil
+}
+
+// v8Entries are v7Entries with chunk IDs packed by packChunkID, with version
+// 7 range keys.  Chunk IDs which can't be packed, like legacy ones without a
+// checksum, are written as v7Entries do.
+type v8Entries struct {
+	v6Entries
+}
+
+func (v8Entries) GetWriteEntries(from, through uint32, tableName, hashKey string, labels model.Metric, chunkID string) ([]IndexEntry, error) {
+	packed, ok := packChunkID(hashKey, chunkID)
+	if !ok {
+		return v7Entries{}.GetWriteEntries(from, through, tableName, hashKey, labels, chunkID)
+	}
+	return chunkIDEntries(through, tableName, hashKey, labels, packed, rangeKeyV7), nil
+}
+
+// chunkIDEntries returns the metric and label rows of v7 schemas onwards,
+// whose range keys are [chunk end time, <empty>, chunk ID, version], with the
+// label values in the label rows' values.
+func chunkIDEntries(through uint32, tableName, hashKey string, labels model.Metric, chunkIDBytes, version []byte) []IndexEntry {
+	encodedThroughBytes := encodeTime(through)
+
+	entries := []IndexEntry{
+		{
+			TableName:  tableName,
+			HashValue:  hashKey,
+			RangeValue: buildRangeKey(encodedThroughBytes, nil, chunkIDBytes, version),
+		},
+	}
+
+	for key, value := range labels {
+		if key == model.MetricNameLabel {
+			continue
+		}
+		entries = append(entries, IndexEntry{
+			TableName:  tableName,
+			HashValue:  hashKey + ":" + string(key),
+			RangeValue: buildRangeKey(encodedThroughBytes, nil, chunkIDBytes, version),
+			Value:      []byte(value),
+		})
+	}
+
+	return entries
+}
+
+// Packed chunk IDs are, big endian: the fingerprint (8 bytes), the chunk's
+// start as a signed delta from the start of its bucket's day (4), its length
+// (4) and its checksum (4).  Chunks in a batch are followed by the batch's
+// start, as a delta like the chunk's, and length, its checksum, and the
+// chunk's offset and length in it (4 each).  They're base64 encoded, so
+// don't contain null bytes: 27 bytes rather than the ~49 of a hex chunk ID.
+const (
+	packedChunkIDLen = 20
+	packedBatchLen   = 20
+)
+
+// packChunkID packs the chunk ID, whose index entries go in the bucket of
+// the hash key, or returns false if it can't be packed.
+func packChunkID(hashKey, chunkID string) ([]byte, bool) {
+	day, ok := hashBucketDay(hashKey)
+	if !ok {
+		return nil, false
+	}
+	chunk, err := parseNewExternalKey(chunkID)
+	if err != nil {
+		return nil, false
+	}
+	bucketStart := day * millisecondsInDay
+
+	buf := make([]byte, packedChunkIDLen, packedChunkIDLen+packedBatchLen)
+	binary.BigEndian.PutUint64(buf[0:], uint64(chunk.Fingerprint))
+	if !putRange(buf[8:], bucketStart, chunk.From, chunk.Through) {
+		return nil, false
+	}
+	binary.BigEndian.PutUint32(buf[16:], chunk.Checksum)
+
+	if chunk.batch.id != "" {
+		meta, err := parseBatchID(chunk.batch.id)
+		if err != nil {
+			return nil, false
+		}
+		checksum, err := strconv.ParseUint(chunk.batch.id[strings.LastIndexByte(chunk.batch.id, ':')+1:], 16, 32)
+		if err != nil || uint64(chunk.batch.offset) > math.MaxUint32 || uint64(chunk.batch.length) > math.MaxUint32 {
+			return nil, false
+		}
+		batch := make([]byte, packedBatchLen)
+		if !putRange(batch, bucketStart, meta.from, meta.through) {
+			return nil, false
+		}
+		binary.BigEndian.PutUint32(batch[8:], uint32(checksum))
+		binary.BigEndian.PutUint32(batch[12:], uint32(chunk.batch.offset))
+		binary.BigEndian.PutUint32(batch[16:], uint32(chunk.batch.length))
+		buf = append(buf, batch...)
+	}
+
+	encoded := make([]byte, base64.RawURLEncoding.EncodedLen(len(buf)))
+	base64.RawURLEncoding.Encode(encoded, buf)
+	return encoded, true
+}
+
+// putRange puts from, as a delta from bucketStart, and the length of the
+// range into the first 8 bytes of buf, or returns false if they don't fit.
+func putRange(buf []byte, bucketStart int64, from, through model.Time) bool {
+	delta, length := int64(from)-bucketStart, int64(through-from)
+	if delta < math.MinInt32 || delta > math.MaxInt32 || length < 0 || length > math.MaxUint32 {
+		return false
+	}
+	binary.BigEndian.PutUint32(buf[0:], uint32(int32(delta)))
+	binary.BigEndian.PutUint32(buf[4:], uint32(length))
+	return true
+}
+
+func getRange(buf []byte, bucketStart int64) (model.Time, model.Time) {
+	from := model.Time(bucketStart + int64(int32(binary.BigEndian.Uint32(buf[0:]))))
+	return from, from + model.Time(binary.BigEndian.Uint32(buf[4:]))
+}
+
+// unpackChunkID returns the external key of the packed chunk ID from an index
+// entry with the given hash value.
+func unpackChunkID(hashValue string, packed []byte) (string, error) {
+	day, ok := hashBucketDay(hashValue)
+	if !ok {
+		return "", fmt.Errorf("invalid hash value for packed chunk ID: %s", hashValue)
+	}
+	buf := make([]byte, base64.RawURLEncoding.DecodedLen(len(packed)))
+	if _, err := base64.RawURLEncoding.Decode(buf, packed); err != nil {
+		return "", err
+	}
+	if len(buf) != packedChunkIDLen && len(buf) != packedChunkIDLen+packedBatchLen {
+		return "", ErrInvalidChunkID
+	}
+	bucketStart := day * millisecondsInDay
+
+	chunk := Chunk{
+		UserID:      hashUserID(hashValue),
+		Fingerprint: model.Fingerprint(binary.BigEndian.Uint64(buf[0:])),
+		Checksum:    binary.BigEndian.Uint32(buf[16:]),
+		ChecksumSet: true,
+	}
+	chunk.From, chunk.Through = getRange(buf[8:], bucketStart)
+	if batch := buf[packedChunkIDLen:]; len(batch) > 0 {
+		from, through := getRange(batch, bucketStart)
+		chunk.batch = batchRef{
+			id:     batchID(from, through, binary.BigEndian.Uint32(batch[8:])),
+			offset: int(binary.BigEndian.Uint32(batch[12:])),
+			length: int(binary.BigEndian.Uint32(batch[16:])),
+		}
+	}
+	return chunk.externalKey(), nil
+}
+
+// hashBucketDay returns the day of a daily bucket's hash key,
+// `<user id>:d<day>:<metric name>...`.
+func hashBucketDay(hashKey string) (int64, bool) {
+	parts := strings.SplitN(hashKey, ":", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[1], "d") {
+		return 0, false
+	}
+	day, err := strconv.ParseInt(parts[1][1:], 10, 64)
+	return day, err == nil
+}
+
 func buildRangeKey(ss ...[]byte) []byte {
 	length := 0
 	for _, s := range ss {
@@ -689,7 +986,7 @@ func decodeBase64Value(bs []byte) (model.LabelValue, error) {
 	return model.LabelValue(decoded), nil
 }
 
-func parseRangeValue(rangeValue []byte, value []byte) (string, model.LabelValue, bool, error) {
+func parseRangeValue(hashValue string, rangeValue []byte, value []byte) (string, model.LabelValue, bool, error) {
 	components := make([][]byte, 0, 5)
 	i, j := 0, 0
 	for j < len(rangeValue) {
@@ -738,6 +1035,18 @@ func parseRangeValue(rangeValue []byte, value []byte) (string, model.LabelValue,
 		labelValue := model.LabelValue(value)
 		return string(components[2]), labelValue, false, nil
 
+	// v7 schema version 6 range keys are version 5 range keys, for both the
+	// metric and label rows, with the chunk ID's user ID prefix left out.
+	// parseExternalKey takes the user ID from the hash key.
+	case bytes.Equal(components[3], rangeKeyV6):
+		return string(components[2]), model.LabelValue(value), false, nil
+
+	// v8 schema version 7 range keys are version 6 range keys with the chunk
+	// ID packed relative to the day in the hash key.
+	case bytes.Equal(components[3], rangeKeyV7):
+		chunkID, err := unpackChunkID(hashValue, components[2])
+		return chunkID, model.LabelValue(value), false, err
+
 	default:
 		return "", model.LabelValue(""), false, fmt.Errorf("unrecognised version: '%v'", string(components[3]))
 	}
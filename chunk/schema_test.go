@@ -375,6 +375,56 @@ func TestSchemaHashKeys(t *testing.T) {
 	}
 }
 
+func TestSchemaCanary(t *testing.T) {
+	day := func(d int64) util.DayValue {
+		return util.NewDayValue(model.TimeFromUnix(d * secondsInDay))
+	}
+	cfg := SchemaConfig{
+		OriginalTableName: "table",
+		DailyBucketsFrom:  day(1),
+		V5SchemaFrom:      day(10),
+		CanarySchemaFrom:  day(5),
+		CanaryTenants:     "canary, other-canary",
+	}
+	schema, err := newCompositeSchema(cfg)
+	require.NoError(t, err)
+
+	metric := model.Metric{
+		model.MetricNameLabel: "foo",
+		"bar":                 "baz",
+	}
+	entries := func(schema Schema, userID string, d int64) []IndexEntry {
+		from := model.TimeFromUnix(d * secondsInDay)
+		result, err := schema.GetWriteEntries(from, from.Add(time.Hour), userID, "foo", metric, "chunk")
+		require.NoError(t, err)
+		return result
+	}
+
+	// Canary tenants use the v5 schema from the canary date, others from
+	// the v5 date.
+	for _, tc := range []struct {
+		userID string
+		day    int64
+		want   Schema
+	}{
+		{"canary", 2, v2Schema(cfg)},
+		{"canary", 6, v5Schema(cfg)},
+		{"other-canary", 6, v5Schema(cfg)},
+		{"user", 6, v2Schema(cfg)},
+		{"user", 11, v5Schema(cfg)},
+	} {
+		assert.Equal(t, entries(tc.want, tc.userID, tc.day), entries(schema, tc.userID, tc.day), "%s on day %d", tc.userID, tc.day)
+	}
+
+	// The canary must start between the latest schema and the one before.
+	for _, canaryFrom := range []int64{0, 10, 11} {
+		cfgCp := cfg
+		cfgCp.CanarySchemaFrom = day(canaryFrom)
+		_, err := newCompositeSchema(cfgCp)
+		assert.Error(t, err, "canary from day %d", canaryFrom)
+	}
+}
+
 func TestSchemaRangeKey(t *testing.T) {
 	const (
 		userID     = "userid"
@@ -393,6 +443,7 @@ func TestSchemaRangeKey(t *testing.T) {
 		labelBuckets  = v4Schema(cfg)
 		tsRangeKeys   = v5Schema(cfg)
 		v6RangeKeys   = v6Schema(cfg)
+		v7RangeKeys   = v7Schema(cfg)
 		metric        = model.Metric{
 			model.MetricNameLabel: metricName,
 			"bar": "bary",
@@ -503,6 +554,28 @@ func TestSchemaRangeKey(t *testing.T) {
 				},
 			},
 		},
+		{
+			v7RangeKeys,
+			[]IndexEntry{
+				{
+					TableName:  table,
+					HashValue:  "userid:d0:foo",
+					RangeValue: []byte("0036ee7f\x00\x00chunkID\x006\x00"),
+				},
+				{
+					TableName:  table,
+					HashValue:  "userid:d0:foo:bar",
+					RangeValue: []byte("0036ee7f\x00\x00chunkID\x006\x00"),
+					Value:      []byte("bary"),
+				},
+				{
+					TableName:  table,
+					HashValue:  "userid:d0:foo:baz",
+					RangeValue: []byte("0036ee7f\x00\x00chunkID\x006\x00"),
+					Value:      []byte("bazy"),
+				},
+			},
+		},
 	} {
 		t.Run(fmt.Sprintf("TestSchameRangeKey[%d]", i), func(t *testing.T) {
 			have, err := tc.Schema.GetWriteEntries(
@@ -521,7 +594,7 @@ func TestSchemaRangeKey(t *testing.T) {
 
 			// Test we can parse the resulting range keys
 			for _, entry := range have {
-				_, _, _, err := parseRangeValue(entry.RangeValue, entry.Value)
+				_, _, _, err := parseRangeValue(entry.HashValue, entry.RangeValue, entry.Value)
 				require.NoError(t, err)
 			}
 		})
@@ -556,14 +629,90 @@ func TestParseRangeValue(t *testing.T) {
 		// base64 value in second
 		{[]byte("a1b2c3d4\x00Y29kZQ\x002:1484661279394:1484664879394\x004\x00"),
 			"code", "2:1484661279394:1484664879394"},
+
+		// version 6 range keys (v7 Schema) are version 5 range keys with the
+		// user ID left out of the chunk ID
+		{[]byte("a1b2c3d4\x00\x002:159b2a0f3a2:159b2a8ec22:a1b2c3d4\x006\x00"),
+			"", "2:159b2a0f3a2:159b2a8ec22:a1b2c3d4"},
 	} {
-		chunkID, labelValue, _, err := parseRangeValue(c.encoded, nil)
+		chunkID, labelValue, _, err := parseRangeValue("", c.encoded, nil)
 		require.NoError(t, err)
 		assert.Equal(t, model.LabelValue(c.value), labelValue)
 		assert.Equal(t, c.chunkID, chunkID)
 	}
 }
 
+func TestV7SchemaChunkIDs(t *testing.T) {
+	c := dummyChunk()
+	entries, err := v7Schema(SchemaConfig{}).GetWriteEntries(c.From, c.Through, c.UserID, "foo", c.Metric, c.externalKey())
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+
+	v6Entries, err := v6Schema(SchemaConfig{}).GetWriteEntries(c.From, c.Through, c.UserID, "foo", c.Metric, c.externalKey())
+	require.NoError(t, err)
+	require.Len(t, v6Entries, len(entries))
+
+	for i, entry := range entries {
+		assert.Len(t, entry.RangeValue, len(v6Entries[i].RangeValue)-len(c.UserID+"/"))
+		chunkID, _, _, err := parseRangeValue(entry.HashValue, entry.RangeValue, entry.Value)
+		require.NoError(t, err)
+		have, err := parseExternalKey(c.UserID, chunkID)
+		require.NoError(t, err)
+		assert.Equal(t, c.externalKey(), have.externalKey())
+	}
+}
+
+func TestV8SchemaChunkIDs(t *testing.T) {
+	checksummed := dummyChunk()
+	_, err := checksummed.encode()
+	require.NoError(t, err)
+
+	// Chunks over midnight have negative deltas in the later bucket.
+	midnight := model.TimeFromUnix(17000 * secondsInDay)
+	overMidnight := checksummed
+	overMidnight.From, overMidnight.Through = midnight.Add(-time.Hour), midnight.Add(time.Hour)
+
+	batched := checksummed
+	batched.batch = batchRef{id: batchID(batched.From.Add(-time.Minute), batched.Through, 0xdeadbeef), offset: 1234, length: 567}
+
+	for _, tc := range []struct {
+		name    string
+		chunk   Chunk
+		version []byte
+	}{
+		{"checksummed", checksummed, rangeKeyV7},
+		{"over midnight", overMidnight, rangeKeyV7},
+		{"batched", batched, rangeKeyV7},
+		{"legacy", dummyChunk(), rangeKeyV6},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := tc.chunk
+			entries, err := v8Schema(SchemaConfig{}).GetWriteEntries(c.From, c.Through, c.UserID, "foo", c.Metric, c.externalKey())
+			require.NoError(t, err)
+			v7Entries, err := v7Schema(SchemaConfig{}).GetWriteEntries(c.From, c.Through, c.UserID, "foo", c.Metric, c.externalKey())
+			require.NoError(t, err)
+			require.NotEmpty(t, entries)
+			require.Len(t, v7Entries, len(entries))
+			sort.Sort(ByHashRangeKey(entries))
+			sort.Sort(ByHashRangeKey(v7Entries))
+
+			for i, entry := range entries {
+				assert.Equal(t, v7Entries[i].HashValue, entry.HashValue)
+				assert.Equal(t, tc.version, entry.RangeValue[len(entry.RangeValue)-2:len(entry.RangeValue)-1])
+				if bytes.Equal(tc.version, rangeKeyV7) {
+					assert.True(t, len(entry.RangeValue) < len(v7Entries[i].RangeValue)*2/3, "%q is not much shorter than %q", entry.RangeValue, v7Entries[i].RangeValue)
+				}
+				chunkID, labelValue, _, err := parseRangeValue(entry.HashValue, entry.RangeValue, entry.Value)
+				require.NoError(t, err)
+				assert.Equal(t, model.LabelValue(entry.Value), labelValue)
+				have, err := parseExternalKey(c.UserID, chunkID)
+				require.NoError(t, err)
+				assert.Equal(t, c.externalKey(), have.externalKey())
+			}
+		})
+	}
+}
+
 func TestSchemaTimeEncoding(t *testing.T) {
 	assert.Equal(t, uint32(0), decodeTime(encodeTime(0)), "0")
 	assert.Equal(t, uint32(math.MaxUint32), decodeTime(encodeTime(math.MaxUint32)), "MaxUint32")
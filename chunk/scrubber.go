@@ -0,0 +1,292 @@
+package chunk
+
+import (
+	"flag"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// Statuses of the index entries the scrubber checks.
+const (
+	scrubOK      = "ok"
+	scrubMissing = "missing"
+	scrubCorrupt = "corrupt"
+	scrubInvalid = "invalid"
+)
+
+var (
+	scrubDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "scrubber_scrub_seconds",
+		Help:      "Time spent scrubbing each table.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"operation", "status_code"})
+	scrubbedIndexEntries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "scrubber_index_entries_total",
+		Help:      "Number of index entries checked by the scrubber, by whether the chunk they point at is ok, missing or corrupt, or they're invalid.",
+	}, []string{"table", "status"})
+	scrubberDeletedIndexEntries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "scrubber_index_entries_deleted_total",
+		Help:      "Number of index entries deleted by the scrubber because the chunk they point at is missing or corrupt.",
+	}, []string{"user"})
+	scrubberDeletedChunks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "scrubber_chunks_deleted_total",
+		Help:      "Number of corrupt chunks deleted by the scrubber.",
+	}, []string{"user"})
+)
+
+func init() {
+	prometheus.MustRegister(scrubDuration)
+	prometheus.MustRegister(scrubbedIndexEntries)
+	prometheus.MustRegister(scrubberDeletedIndexEntries)
+	prometheus.MustRegister(scrubberDeletedChunks)
+}
+
+// ScrubberConfig configures the Scrubber.
+type ScrubberConfig struct {
+	Interval time.Duration
+	Repair   bool
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *ScrubberConfig) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.Interval, "scrubber.interval", 0, "How often to check every index entry points at a chunk which exists and decodes. Each run scans every table and fetches every chunk. 0 disables scrubbing.")
+	f.BoolVar(&cfg.Repair, "scrubber.repair", false, "Delete index entries pointing at missing chunks, and corrupt chunks along with the index entries pointing at them.")
+}
+
+// Scrubber checks that the index entries in the tables managed by the table
+// manager point at chunks which exist and decode, and optionally deletes
+// those that don't, so queries don't fail on them.
+type Scrubber struct {
+	cfg         ScrubberConfig
+	tableCfg    TableManagerConfig
+	store       *Store
+	tableClient DynamoTableClient
+
+	done chan struct{}
+	wait sync.WaitGroup
+}
+
+// NewScrubber makes a new Scrubber.
+func NewScrubber(cfg ScrubberConfig, tableCfg TableManagerConfig, store *Store, tableClient DynamoTableClient) *Scrubber {
+	return &Scrubber{
+		cfg:         cfg,
+		tableCfg:    tableCfg,
+		store:       store,
+		tableClient: tableClient,
+		done:        make(chan struct{}),
+	}
+}
+
+// Start the Scrubber.
+func (s *Scrubber) Start() {
+	if s.cfg.Interval <= 0 {
+		return
+	}
+	s.wait.Add(1)
+	go s.loop()
+}
+
+// Stop the Scrubber.
+func (s *Scrubber) Stop() {
+	close(s.done)
+	s.wait.Wait()
+}
+
+func (s *Scrubber) loop() {
+	defer s.wait.Done()
+
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.scrub(context.Background()); err != nil {
+			log.Errorf("Error scrubbing chunk store: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Scrubber) scrub(ctx context.Context) error {
+	tables, err := s.tableClient.ListTables()
+	if err != nil {
+		return err
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		if !s.tableCfg.mayHoldChunksBefore(table, model.Latest) {
+			continue
+		}
+		if err := instrument.TimeRequestHistogram(ctx, "Scrubber.scrubTable", scrubDuration, func(ctx context.Context) error {
+			_, err := s.scrubTable(ctx, table)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scrubTable checks the table's index entries, returning how many have each
+// status.  Entries which don't parse are counted as invalid, but never
+// deleted.  It holds the status of every chunk in the table in memory.
+func (s *Scrubber) scrubTable(ctx context.Context, table string) (map[string]int, error) {
+	log.Infof("Scrubbing table %s", table)
+	t := &tableScrubber{
+		Scrubber: s,
+		table:    table,
+		statuses: map[string]string{},
+		counts:   map[string]int{},
+	}
+	if s.cfg.Repair {
+		t.deleter = newTableDeleter(s.store.storage, scrubberDeletedIndexEntries, scrubberDeletedChunks)
+	}
+	if scanErr := s.store.storage.ScanTable(ctx, table, func(hashValue string, rangeValue []byte, value []byte) bool {
+		userID := hashUserID(hashValue)
+		chunkID, _, _, err := parseRangeValue(hashValue, rangeValue, value)
+		if err != nil {
+			log.Warnf("Error parsing index entry %s/%x in table %s: %v", hashValue, rangeValue, table, err)
+			t.count(scrubInvalid)
+			return true
+		}
+		chunk, err := parseExternalKey(userID, chunkID)
+		if err != nil {
+			log.Warnf("Error parsing chunk ID %s in table %s: %v", chunkID, table, err)
+			t.count(scrubInvalid)
+			return true
+		}
+		t.pending = append(t.pending, scrubEntry{userID, hashValue, rangeValue, chunk})
+		if len(t.pending) >= purgeBatchSize {
+			t.err = t.flush(ctx)
+		}
+		return t.err == nil
+	}); scanErr != nil {
+		return nil, scanErr
+	}
+	if err := t.flush(ctx); err != nil {
+		return nil, err
+	}
+	if t.deleter != nil {
+		if err := t.deleter.finish(ctx); err != nil {
+			return nil, err
+		}
+	}
+	log.Infof("Scrubbed table %s: %d index entries ok, %d pointing at missing chunks, %d at corrupt chunks, %d invalid",
+		table, t.counts[scrubOK], t.counts[scrubMissing], t.counts[scrubCorrupt], t.counts[scrubInvalid])
+	return t.counts, nil
+}
+
+type scrubEntry struct {
+	userID     string
+	hashValue  string
+	rangeValue []byte
+	chunk      Chunk
+}
+
+// tableScrubber checks the chunks of index entries in batches, and then
+// deletes the entries, and corrupt chunks, if it's repairing.
+type tableScrubber struct {
+	*Scrubber
+	table    string
+	pending  []scrubEntry
+	statuses map[string]string // external key -> status
+	counts   map[string]int    // status -> number of index entries
+	deleter  *tableDeleter
+	err      error
+}
+
+func (t *tableScrubber) count(status string) {
+	t.counts[status]++
+	scrubbedIndexEntries.WithLabelValues(t.table, status).Inc()
+}
+
+func (t *tableScrubber) flush(ctx context.Context) error {
+	if t.err != nil {
+		return t.err
+	}
+	if err := t.check(ctx); err != nil {
+		return err
+	}
+	for _, entry := range t.pending {
+		key := entry.chunk.externalKey()
+		status := t.statuses[key]
+		t.count(status)
+		if t.deleter == nil || status == scrubOK {
+			continue
+		}
+		// The index entries of a missing chunk are deleted, and a corrupt
+		// chunk is deleted after its index entries.
+		if status == scrubCorrupt {
+			t.deleter.delete(ctx, t.table, entry.userID, entry.hashValue, entry.rangeValue, key)
+		} else {
+			t.deleter.delete(ctx, t.table, entry.userID, entry.hashValue, entry.rangeValue, "")
+		}
+		if t.deleter.err != nil {
+			return t.deleter.err
+		}
+	}
+	t.pending = t.pending[:0]
+	return nil
+}
+
+// check fetches the pending entries' chunks which haven't been checked, in
+// parallel, and records their statuses.
+func (t *tableScrubber) check(ctx context.Context) error {
+	type result struct {
+		key, status string
+		err         error
+	}
+	results := make(chan result)
+	n := 0
+	for _, entry := range t.pending {
+		key := entry.chunk.externalKey()
+		if _, ok := t.statuses[key]; ok {
+			continue
+		}
+		t.statuses[key] = ""
+		n++
+		go func(chunk Chunk) {
+			status, err := t.checkChunk(ctx, chunk)
+			results <- result{chunk.externalKey(), status, err}
+		}(entry.chunk)
+	}
+
+	var lastErr error
+	for i := 0; i < n; i++ {
+		r := <-results
+		t.statuses[r.key] = r.status
+		if r.err != nil {
+			lastErr = r.err
+		}
+	}
+	return lastErr
+}
+
+func (t *tableScrubber) checkChunk(ctx context.Context, chunk Chunk) (string, error) {
+	buf, err := getChunk(ctx, t.store.storage, chunk)
+	if err == ErrChunkNotFound {
+		return scrubMissing, nil
+	} else if err != nil {
+		return "", err
+	}
+	if err := chunk.decode(buf); err != nil {
+		log.Warnf("Error decoding chunk %s in table %s: %v", chunk.externalKey(), t.table, err)
+		return scrubCorrupt, nil
+	}
+	return scrubOK, nil
+}
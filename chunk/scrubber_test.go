@@ -0,0 +1,61 @@
+package chunk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+func TestScrubber(t *testing.T) {
+	storage, store := newDeletesTestStore(t)
+	ctx := user.Inject(context.Background(), "user1")
+
+	now := model.Now()
+	chunks := []Chunk{
+		chunkOf(t, "user1", now.Add(-3*time.Hour), now.Add(-150*time.Minute)),
+		chunkOf(t, "user1", now.Add(-2*time.Hour), now.Add(-90*time.Minute)),
+		chunkOf(t, "user1", now.Add(-time.Hour), now.Add(-30*time.Minute)),
+	}
+	require.NoError(t, store.Put(ctx, chunks))
+	ok, missing, corrupt := chunks[0].externalKey(), chunks[1].externalKey(), chunks[2].externalKey()
+	require.NoError(t, storage.DeleteChunk(ctx, missing))
+	require.NoError(t, storage.PutChunk(ctx, corrupt, []byte("corrupt")))
+
+	rows := func() map[string]int {
+		rows, err := store.IndexRows(ctx, now.Add(-4*time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+		require.NoError(t, err)
+		result := map[string]int{}
+		for _, row := range rows {
+			result[row.ChunkKey]++
+		}
+		return result
+	}
+	before := rows()
+	require.Len(t, before, 3)
+
+	scrubber := NewScrubber(ScrubberConfig{}, TableManagerConfig{}, store, storage)
+	counts, err := scrubber.scrubTable(context.Background(), "")
+	require.NoError(t, err)
+	// Each chunk has an entry for its metric name, and one for its label.
+	entriesPerChunk := 2
+	assert.Equal(t, map[string]int{scrubOK: entriesPerChunk, scrubMissing: entriesPerChunk, scrubCorrupt: entriesPerChunk}, counts)
+	assert.Equal(t, before, rows(), "nothing is deleted without repairing")
+
+	scrubber = NewScrubber(ScrubberConfig{Repair: true}, TableManagerConfig{}, store, storage)
+	_, err = scrubber.scrubTable(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{ok: before[ok]}, rows())
+	_, err = storage.GetChunk(ctx, corrupt)
+	assert.Equal(t, ErrChunkNotFound, err)
+
+	counts, err = scrubber.scrubTable(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{scrubOK: entriesPerChunk}, counts)
+}
@@ -4,11 +4,17 @@ import (
 	"flag"
 	"fmt"
 	"strings"
+	"time"
 
-	"github.com/prometheus/common/log"
 	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/errors"
+	"github.com/weaveworks/cortex/util/log"
 )
 
+// ErrChunkNotFound is returned by GetChunk for chunks which don't exist.
+const ErrChunkNotFound = errors.Error("chunk not found")
+
 // StorageClient is a client for the persistent storage for Cortex. (e.g. DynamoDB + S3).
 type StorageClient interface {
 	// For the write path.
@@ -18,14 +24,24 @@ type StorageClient interface {
 	// For the read path.
 	QueryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error
 
-	// For storing and retrieving chunks.
+	// For storing and retrieving chunks.  GetChunkRange reads length bytes
+	// from offset in the object, for chunks in batches.
 	PutChunk(ctx context.Context, key string, data []byte) error
 	GetChunk(ctx context.Context, key string) ([]byte, error)
+	GetChunkRange(ctx context.Context, key string, offset, length int) ([]byte, error)
+
+	// For purging expired index entries and chunks, and unreferenced chunks,
+	// and for finding blocks.  ListChunks lists the objects whose keys start
+	// with prefix.
+	ScanTable(ctx context.Context, tableName string, callback func(hashValue string, rangeValue []byte, value []byte) (shouldContinue bool)) error
+	ListChunks(ctx context.Context, prefix string, callback func(key string, lastModified time.Time) (shouldContinue bool)) error
+	DeleteChunk(ctx context.Context, key string) error
 }
 
 // WriteBatch represents a batch of writes.
 type WriteBatch interface {
 	Add(tableName, hashValue string, rangeValue []byte, value []byte)
+	Delete(tableName, hashValue string, rangeValue []byte)
 }
 
 // ReadBatch represents the results of a QueryPages.
@@ -39,26 +55,35 @@ type ReadBatch interface {
 type StorageClientConfig struct {
 	StorageClient string
 	AWSStorageConfig
+	KeyLayout KeyLayoutConfig
 }
 
 // RegisterFlags adds the flags required to configure this flag set.
 func (cfg *StorageClientConfig) RegisterFlags(f *flag.FlagSet) {
-	flag.StringVar(&cfg.StorageClient, "chunk.storage-client", "aws", "Which storage client to use (aws, inmemory).")
+	f.StringVar(&cfg.StorageClient, "chunk.storage-client", "aws", "Which storage client to use (aws, inmemory).")
 	cfg.AWSStorageConfig.RegisterFlags(f)
+	cfg.KeyLayout.RegisterFlags(f)
 }
 
-// NewStorageClient makes a storage client based on the configuration.
+// NewStorageClient makes a storage client based on the configuration,
+// instrumented with cortex_storage_request_duration_seconds, storing chunks
+// with the configured key layout.
 func NewStorageClient(cfg StorageClientConfig) (StorageClient, error) {
+	var client StorageClient
 	switch cfg.StorageClient {
 	case "inmemory":
-		return NewMockStorage(), nil
+		client = NewMockStorage()
 	case "aws":
 		path := strings.TrimPrefix(cfg.DynamoDB.URL.Path, "/")
 		if len(path) > 0 {
 			log.Warnf("Ignoring DynamoDB URL path: %v.", path)
 		}
-		return NewAWSStorageClient(cfg.AWSStorageConfig)
+		var err error
+		if client, err = NewAWSStorageClient(cfg.AWSStorageConfig); err != nil {
+			return nil, err
+		}
 	default:
 		return nil, fmt.Errorf("Unrecognized storage client %v, choose one of: aws, inmemory", cfg.StorageClient)
 	}
+	return newKeyLayoutStorageClient(cfg.KeyLayout, newInstrumentedStorageClient(cfg.StorageClient, client))
 }
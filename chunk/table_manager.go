@@ -1,8 +1,10 @@
 package chunk
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
 	"sort"
 	"strconv"
 	"strings"
@@ -11,12 +13,14 @@ import (
 
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
 	"golang.org/x/net/context"
 
 	"github.com/weaveworks/common/instrument"
 	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/cortex/events"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 const (
@@ -48,6 +52,7 @@ type DynamoTableClient interface {
 	CreateTable(name string, readCapacity, writeCapacity int64) error
 	DescribeTable(name string) (readCapacity, writeCapacity int64, status string, err error)
 	UpdateTable(name string, readCapacity, writeCapacity int64) error
+	DeleteTable(name string) error
 }
 
 // DynamoTableClientConfig configures the DynamoDB table client.
@@ -58,7 +63,7 @@ type DynamoTableClientConfig struct {
 
 // RegisterFlags adds the flags required to configure this flag set.
 func (cfg *DynamoTableClientConfig) RegisterFlags(f *flag.FlagSet) {
-	flag.StringVar(&cfg.DynamoClient, "table-manager.dynamo-client", "aws", "Which DynamoDB table client to use (aws, inmemory).")
+	f.StringVar(&cfg.DynamoClient, "table-manager.dynamo-client", "aws", "Which DynamoDB table client to use (aws, inmemory).")
 	cfg.DynamoDBConfig.RegisterFlags(f)
 }
 
@@ -92,6 +97,21 @@ type TableManagerConfig struct {
 	ProvisionedReadThroughput  int64
 	InactiveWriteThroughput    int64
 	InactiveReadThroughput     int64
+
+	// Periodic tables whose data is all older than this are deleted; zero
+	// keeps them forever.
+	RetentionPeriod time.Duration
+
+	// The table of series delete requests is created if it's configured.
+	DeleteRequests DeleteRequestsConfig
+
+	Backups BackupConfig
+
+	// Enable streams on index tables, e.g. for an IndexMirror.
+	IndexStreams bool
+
+	// Only log the changes syncing tables would make.
+	DryRun bool
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -103,10 +123,32 @@ func (cfg *TableManagerConfig) RegisterFlags(f *flag.FlagSet) {
 	f.Int64Var(&cfg.ProvisionedReadThroughput, "dynamodb.periodic-table.read-throughput", 300, "DynamoDB periodic tables read throughput")
 	f.Int64Var(&cfg.InactiveWriteThroughput, "dynamodb.periodic-table.inactive-write-throughput", 1, "DynamoDB periodic tables write throughput for inactive tables.")
 	f.Int64Var(&cfg.InactiveReadThroughput, "dynamodb.periodic-table.inactive-read-throughput", 300, "DynamoDB periodic tables read throughput for inactive tables")
+	f.DurationVar(&cfg.RetentionPeriod, "table-manager.retention-period", 0, "Periodic tables whose data is all older than this are deleted. 0 disables deletion. Queriers' -store.max-look-back-period should be no longer.")
 
 	cfg.PeriodicTableConfig.RegisterFlags(f)
+	cfg.DeleteRequests.RegisterFlags(f)
+	cfg.Backups.RegisterFlags(f)
+	f.BoolVar(&cfg.IndexStreams, "table-manager.index-streams", false, "Enable DynamoDB streams on index tables, so their writes can be mirrored to another store.")
+	f.BoolVar(&cfg.DryRun, "table-manager.dry-run", false, "Log the tables that would be created, updated and deleted, as JSON, without changing any. Backups and streams are skipped too.")
 	// XXX: Should this be in PeriodicTableConfig?
-	flag.StringVar(&cfg.OriginalTableName, "dynamodb.original-table-name", "", "The name of the DynamoDB table used before versioned schemas were introduced.")
+	f.StringVar(&cfg.OriginalTableName, "dynamodb.original-table-name", "", "The name of the DynamoDB table used before versioned schemas were introduced.")
+}
+
+// mayHoldChunksBefore returns whether the table is managed by the table
+// manager, and starts before the cutoff.
+func (cfg *TableManagerConfig) mayHoldChunksBefore(table string, cutoff model.Time) bool {
+	if table == cfg.OriginalTableName {
+		return true
+	}
+	if !cfg.UsePeriodicTables || !strings.HasPrefix(table, cfg.TablePrefix) {
+		return false
+	}
+	i, err := strconv.ParseInt(strings.TrimPrefix(table, cfg.TablePrefix), 10, 64)
+	if err != nil || i < 0 {
+		return false
+	}
+	start := model.TimeFromUnix(i * int64(cfg.TablePeriod/time.Second))
+	return start.Before(cutoff)
 }
 
 // PeriodicTableConfig for the use of periodic tables (ie, weekly tables).  Can
@@ -133,14 +175,32 @@ type DynamoTableManager struct {
 	cfg      TableManagerConfig
 	done     chan struct{}
 	wait     sync.WaitGroup
+
+	// Tables point-in-time recovery has been enabled on, so it's only
+	// enabled once per table.
+	pitrEnabled map[string]bool
+	// Likewise tables streams have been enabled on.
+	streamEnabled map[string]bool
 }
 
 // NewDynamoTableManager makes a new DynamoTableManager
 func NewDynamoTableManager(cfg TableManagerConfig, dynamoDBClient DynamoTableClient) (*DynamoTableManager, error) {
+	if cfg.RetentionPeriod > 0 {
+		if !cfg.UsePeriodicTables {
+			return nil, fmt.Errorf("retention period requires periodic tables")
+		}
+		// A table mustn't be deleted while it may still be written to.
+		if cfg.RetentionPeriod < cfg.CreationGracePeriod+cfg.MaxChunkAge {
+			return nil, fmt.Errorf("retention period %v must be at least the grace period plus the max chunk age (%v)",
+				cfg.RetentionPeriod, cfg.CreationGracePeriod+cfg.MaxChunkAge)
+		}
+	}
 	return &DynamoTableManager{
-		cfg:      cfg,
-		dynamoDB: dynamoDBClient,
-		done:     make(chan struct{}),
+		cfg:           cfg,
+		dynamoDB:      dynamoDBClient,
+		done:          make(chan struct{}),
+		pitrEnabled:   map[string]bool{},
+		streamEnabled: map[string]bool{},
 	}, nil
 }
 
@@ -183,25 +243,153 @@ func (m *DynamoTableManager) loop() {
 }
 
 func (m *DynamoTableManager) syncTables(ctx context.Context) error {
+	plan, err := m.plan(ctx)
+	if err != nil {
+		return err
+	}
+
+	if m.cfg.DryRun {
+		for _, table := range plan.Tables {
+			if table.Action == TableActionNone {
+				continue
+			}
+			change, err := json.Marshal(table)
+			if err != nil {
+				return err
+			}
+			log.Infof("Dry run, not changing table: %s", change)
+		}
+		return nil
+	}
+
+	if err := m.createTables(ctx, plan.toCreate); err != nil {
+		return err
+	}
+
+	if err := m.updateTables(ctx, plan.toUpdate); err != nil {
+		return err
+	}
+	m.backupTables(ctx, plan.existing)
+	m.enableStreams(ctx, plan.existing)
+
+	return m.deleteTables(ctx, plan.toDelete)
+}
+
+// The actions syncing tables takes on a table.
+const (
+	TableActionNone   = "none"
+	TableActionCreate = "create"
+	TableActionUpdate = "update"
+	TableActionDelete = "delete"
+)
+
+// TableState is the desired and actual provisioned throughput of a table, and
+// the action syncing tables takes on it.  The actual throughput and status are
+// only known for tables which exist and are expected.
+type TableState struct {
+	Name         string `json:"name"`
+	Action       string `json:"action"`
+	Status       string `json:"status,omitempty"`
+	DesiredRead  int64  `json:"desired_read"`
+	DesiredWrite int64  `json:"desired_write"`
+	ActualRead   int64  `json:"actual_read"`
+	ActualWrite  int64  `json:"actual_write"`
+}
+
+// TablePlan is what syncing tables would do, as of when it was made.
+type TablePlan struct {
+	Tables []TableState `json:"tables"`
+
+	toCreate []tableDescription
+	toUpdate []TableState
+	existing []tableDescription
+	toDelete []string
+}
+
+// plan works out the changes syncing tables makes, by comparing the expected
+// tables with the ones that exist.
+func (m *DynamoTableManager) plan(ctx context.Context) (TablePlan, error) {
 	expected := m.calculateExpectedTables()
 	log.Infof("Expecting %d tables", len(expected))
 
-	toCreate, toCheckThroughput, err := m.partitionTables(ctx, expected)
+	toCreate, toCheckThroughput, toDelete, err := m.partitionTables(ctx, expected)
 	if err != nil {
-		return err
+		return TablePlan{}, err
 	}
 
-	if err := m.createTables(ctx, toCreate); err != nil {
-		return err
+	plan := TablePlan{
+		Tables:   []TableState{},
+		toCreate: toCreate,
+		existing: toCheckThroughput,
+		toDelete: toDelete,
+	}
+	for _, desc := range toCreate {
+		plan.Tables = append(plan.Tables, TableState{
+			Name:         desc.name,
+			Action:       TableActionCreate,
+			DesiredRead:  desc.provisionedRead,
+			DesiredWrite: desc.provisionedWrite,
+		})
+	}
+	for _, desc := range toCheckThroughput {
+		log.Infof("Checking provisioned throughput on table %s", desc.name)
+		state := TableState{
+			Name:         desc.name,
+			Action:       TableActionNone,
+			DesiredRead:  desc.provisionedRead,
+			DesiredWrite: desc.provisionedWrite,
+		}
+		if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.DescribeTable", dynamoRequestDuration, func(_ context.Context) error {
+			var err error
+			state.ActualRead, state.ActualWrite, state.Status, err = m.dynamoDB.DescribeTable(desc.name)
+			return err
+		}); err != nil {
+			return TablePlan{}, err
+		}
+
+		if state.Status != dynamodb.TableStatusActive {
+			log.Infof("Skipping update on  table %s, not yet ACTIVE (%s)", desc.name, state.Status)
+		} else {
+			tableCapacity.WithLabelValues(readLabel, desc.name).Set(float64(state.ActualRead))
+			tableCapacity.WithLabelValues(writeLabel, desc.name).Set(float64(state.ActualWrite))
+
+			if state.ActualRead == state.DesiredRead && state.ActualWrite == state.DesiredWrite {
+				log.Infof("  Provisioned throughput: read = %d, write = %d, skipping.", state.ActualRead, state.ActualWrite)
+			} else {
+				state.Action = TableActionUpdate
+				plan.toUpdate = append(plan.toUpdate, state)
+			}
+		}
+		plan.Tables = append(plan.Tables, state)
 	}
+	for _, name := range toDelete {
+		plan.Tables = append(plan.Tables, TableState{
+			Name:   name,
+			Action: TableActionDelete,
+		})
+	}
+	sort.Slice(plan.Tables, func(i, j int) bool { return plan.Tables[i].Name < plan.Tables[j].Name })
+	return plan, nil
+}
 
-	return m.updateTables(ctx, toCheckThroughput)
+// ServeHTTP serves the current plan: the desired and actual state of each
+// table, and what syncing tables would change.
+func (m *DynamoTableManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	plan, err := m.plan(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	util.WriteJSONResponse(w, plan)
 }
 
 type tableDescription struct {
 	name             string
 	provisionedRead  int64
 	provisionedWrite int64
+
+	// Whether the table is being written to.
+	active bool
 }
 
 type byName []tableDescription
@@ -211,17 +399,27 @@ func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a byName) Less(i, j int) bool { return a[i].name < a[j].name }
 
 func (m *DynamoTableManager) calculateExpectedTables() []tableDescription {
-	if !m.cfg.UsePeriodicTables {
-		return []tableDescription{
-			{
-				name:             m.cfg.OriginalTableName,
-				provisionedRead:  m.cfg.ProvisionedReadThroughput,
-				provisionedWrite: m.cfg.ProvisionedWriteThroughput,
-			},
-		}
+	result := []tableDescription{}
+
+	// Delete requests are read by every query, but rarely written.
+	if m.cfg.DeleteRequests.TableName != "" {
+		result = append(result, tableDescription{
+			name:             m.cfg.DeleteRequests.TableName,
+			provisionedRead:  m.cfg.ProvisionedReadThroughput,
+			provisionedWrite: m.cfg.InactiveWriteThroughput,
+		})
 	}
 
-	result := []tableDescription{}
+	if !m.cfg.UsePeriodicTables {
+		result = append(result, tableDescription{
+			name:             m.cfg.OriginalTableName,
+			provisionedRead:  m.cfg.ProvisionedReadThroughput,
+			provisionedWrite: m.cfg.ProvisionedWriteThroughput,
+			active:           true,
+		})
+		sort.Sort(byName(result))
+		return result
+	}
 
 	var (
 		tablePeriodSecs = int64(m.cfg.TablePeriod / time.Second)
@@ -230,7 +428,11 @@ func (m *DynamoTableManager) calculateExpectedTables() []tableDescription {
 		firstTable      = m.cfg.PeriodicTableStartAt.Unix() / tablePeriodSecs
 		lastTable       = (mtime.Now().Unix() + gracePeriodSecs) / tablePeriodSecs
 		now             = mtime.Now().Unix()
+		firstRetained   = firstTable
 	)
+	if retained, ok := m.firstRetainedTable(); ok && retained > firstRetained {
+		firstRetained = retained
+	}
 
 	// Add the legacy table
 	{
@@ -244,11 +446,12 @@ func (m *DynamoTableManager) calculateExpectedTables() []tableDescription {
 		if now < (firstTable*tablePeriodSecs)+gracePeriodSecs+maxChunkAgeSecs {
 			legacyTable.provisionedRead = m.cfg.ProvisionedReadThroughput
 			legacyTable.provisionedWrite = m.cfg.ProvisionedWriteThroughput
+			legacyTable.active = true
 		}
 		result = append(result, legacyTable)
 	}
 
-	for i := firstTable; i <= lastTable; i++ {
+	for i := firstRetained; i <= lastTable; i++ {
 		table := tableDescription{
 			// Name construction needs to be consistent with chunk_store.bigBuckets
 			name:             m.cfg.TablePrefix + strconv.Itoa(int(i)),
@@ -260,6 +463,7 @@ func (m *DynamoTableManager) calculateExpectedTables() []tableDescription {
 		if (i*tablePeriodSecs)-gracePeriodSecs <= now && now < (i*tablePeriodSecs)+tablePeriodSecs+gracePeriodSecs+maxChunkAgeSecs {
 			table.provisionedRead = m.cfg.ProvisionedReadThroughput
 			table.provisionedWrite = m.cfg.ProvisionedWriteThroughput
+			table.active = true
 		}
 		result = append(result, table)
 	}
@@ -268,19 +472,60 @@ func (m *DynamoTableManager) calculateExpectedTables() []tableDescription {
 	return result
 }
 
-// partitionTables works out tables that need to be created vs tables that need to be updated
-func (m *DynamoTableManager) partitionTables(ctx context.Context, descriptions []tableDescription) ([]tableDescription, []tableDescription, error) {
+// firstRetainedTable returns the number of the first periodic table holding
+// data within the retention period, if there is one; earlier tables are
+// deleted.
+func (m *DynamoTableManager) firstRetainedTable() (int64, bool) {
+	if m.cfg.RetentionPeriod <= 0 {
+		return 0, false
+	}
+	var (
+		tablePeriodSecs = int64(m.cfg.TablePeriod / time.Second)
+		retentionSecs   = int64(m.cfg.RetentionPeriod / time.Second)
+		cutoff          = mtime.Now().Unix() - retentionSecs
+	)
+	if cutoff <= 0 {
+		return 0, false
+	}
+	// Table i holds data from [i*period, (i+1)*period), so it's expired once
+	// (i+1)*period <= cutoff.
+	return cutoff / tablePeriodSecs, true
+}
+
+// expiredTable returns whether an existing table is a periodic table which is
+// past the retention period.  The legacy table, and any other tables, are
+// never deleted.
+func (m *DynamoTableManager) expiredTable(name string, firstRetained int64) bool {
+	if !strings.HasPrefix(name, m.cfg.TablePrefix) {
+		return false
+	}
+	i, err := strconv.ParseInt(strings.TrimPrefix(name, m.cfg.TablePrefix), 10, 64)
+	if err != nil || i < 0 {
+		return false
+	}
+	return i < firstRetained
+}
+
+// partitionTables works out tables that need to be created vs tables that need to be updated,
+// and which existing tables have expired and need to be deleted.
+func (m *DynamoTableManager) partitionTables(ctx context.Context, descriptions []tableDescription) ([]tableDescription, []tableDescription, []string, error) {
 	var existingTables []string
 	if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.ListTablesPages", dynamoRequestDuration, func(_ context.Context) error {
 		var err error
 		existingTables, err = m.dynamoDB.ListTables()
 		return err
 	}); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	sort.Strings(existingTables)
 
-	toCreate, toCheckThroughput := []tableDescription{}, []tableDescription{}
+	firstRetained, expiring := m.firstRetainedTable()
+	toCreate, toCheckThroughput, toDelete := []tableDescription{}, []tableDescription{}, []string{}
+	unexpected := func(name string) {
+		if expiring && m.expiredTable(name, firstRetained) {
+			toDelete = append(toDelete, name)
+		}
+	}
 	i, j := 0, 0
 	for i < len(descriptions) && j < len(existingTables) {
 		if descriptions[i].name < existingTables[j] {
@@ -288,7 +533,8 @@ func (m *DynamoTableManager) partitionTables(ctx context.Context, descriptions [
 			toCreate = append(toCreate, descriptions[i])
 			i++
 		} else if descriptions[i].name > existingTables[j] {
-			// existingTables[j].name isn't in descriptions, can ignore
+			// existingTables[j].name isn't in descriptions, can ignore unless it's expired
+			unexpected(existingTables[j])
 			j++
 		} else {
 			// Table exists, need to check it has correct throughput
@@ -300,8 +546,11 @@ func (m *DynamoTableManager) partitionTables(ctx context.Context, descriptions [
 	for ; i < len(descriptions); i++ {
 		toCreate = append(toCreate, descriptions[i])
 	}
+	for ; j < len(existingTables); j++ {
+		unexpected(existingTables[j])
+	}
 
-	return toCreate, toCheckThroughput, nil
+	return toCreate, toCheckThroughput, toDelete, nil
 }
 
 func (m *DynamoTableManager) createTables(ctx context.Context, descriptions []tableDescription) error {
@@ -312,42 +561,37 @@ func (m *DynamoTableManager) createTables(ctx context.Context, descriptions []ta
 		}); err != nil {
 			return err
 		}
+		events.Record("table-manager", "table_created", "Created table %s with read = %d, write = %d", desc.name, desc.provisionedRead, desc.provisionedWrite)
 	}
 	return nil
 }
 
-func (m *DynamoTableManager) updateTables(ctx context.Context, descriptions []tableDescription) error {
-	for _, desc := range descriptions {
-		log.Infof("Checking provisioned throughput on table %s", desc.name)
-		var readCapacity, writeCapacity int64
-		var status string
+func (m *DynamoTableManager) updateTables(ctx context.Context, states []TableState) error {
+	for _, state := range states {
+		log.Infof("  Updating provisioned throughput on table %s to read = %d, write = %d", state.Name, state.DesiredRead, state.DesiredWrite)
 		if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.DescribeTable", dynamoRequestDuration, func(_ context.Context) error {
-			var err error
-			readCapacity, writeCapacity, status, err = m.dynamoDB.DescribeTable(desc.name)
-			return err
+			return m.dynamoDB.UpdateTable(state.Name, state.DesiredRead, state.DesiredWrite)
 		}); err != nil {
 			return err
 		}
+		events.Record("table-manager", "table_updated", "Updated provisioned throughput on table %s from read = %d, write = %d to read = %d, write = %d",
+			state.Name, state.ActualRead, state.ActualWrite, state.DesiredRead, state.DesiredWrite)
+	}
+	return nil
+}
 
-		if status != dynamodb.TableStatusActive {
-			log.Infof("Skipping update on  table %s, not yet ACTIVE (%s)", desc.name, status)
-			continue
-		}
-
-		tableCapacity.WithLabelValues(readLabel, desc.name).Set(float64(readCapacity))
-		tableCapacity.WithLabelValues(writeLabel, desc.name).Set(float64(writeCapacity))
-
-		if readCapacity == desc.provisionedRead && writeCapacity == desc.provisionedWrite {
-			log.Infof("  Provisioned throughput: read = %d, write = %d, skipping.", readCapacity, writeCapacity)
-			continue
-		}
-
-		log.Infof("  Updating provisioned throughput on table %s to read = %d, write = %d", desc.name, desc.provisionedRead, desc.provisionedWrite)
-		if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.DescribeTable", dynamoRequestDuration, func(_ context.Context) error {
-			return m.dynamoDB.UpdateTable(desc.name, desc.provisionedRead, desc.provisionedWrite)
+func (m *DynamoTableManager) deleteTables(ctx context.Context, names []string) error {
+	for _, name := range names {
+		log.Infof("Deleting expired table %s", name)
+		if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.DeleteTable", dynamoRequestDuration, func(_ context.Context) error {
+			return m.dynamoDB.DeleteTable(name)
 		}); err != nil {
 			return err
 		}
+		tableCapacity.DeleteLabelValues(readLabel, name)
+		tableCapacity.DeleteLabelValues(writeLabel, name)
+		tableLastBackup.DeleteLabelValues(name)
+		events.Record("table-manager", "table_deleted", "Deleted table %s, past the retention period of %v", name, m.cfg.RetentionPeriod)
 	}
 	return nil
 }
@@ -1,11 +1,17 @@
 package chunk
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"sort"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/weaveworks/common/mtime"
 	"golang.org/x/net/context"
 
@@ -143,6 +149,168 @@ func TestDynamoTableManager(t *testing.T) {
 	)
 }
 
+func TestDynamoTableManagerRetention(t *testing.T) {
+	dynamoDB := NewMockStorage()
+
+	cfg := TableManagerConfig{
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       tablePrefix,
+			TablePeriod:       tablePeriod,
+			PeriodicTableStartAt: util.DayValue{
+				Time: model.TimeFromUnix(0),
+			},
+		},
+
+		CreationGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		InactiveWriteThroughput:    inactiveWrite,
+		InactiveReadThroughput:     inactiveRead,
+		RetentionPeriod:            2 * tablePeriod,
+	}
+	tableManager, err := NewDynamoTableManager(cfg, dynamoDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tables which aren't periodic tables are never deleted.
+	for _, name := range []string{"other", tablePrefix + "foo"} {
+		if err := dynamoDB.CreateTable(name, read, write); err != nil {
+			t.Fatal(err)
+		}
+	}
+	others := []tableDescription{
+		{name: "other", provisionedRead: read, provisionedWrite: write},
+		{name: tablePrefix + "foo", provisionedRead: read, provisionedWrite: write},
+	}
+
+	test := func(name string, tm time.Time, expected []tableDescription) {
+		t.Run(name, func(t *testing.T) {
+			mtime.NowForce(tm)
+			if err := tableManager.syncTables(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			expectTables(t, dynamoDB, append(expected, others...))
+		})
+	}
+
+	test(
+		"Initial test",
+		time.Unix(0, 0),
+		[]tableDescription{
+			{name: "", provisionedRead: read, provisionedWrite: write},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write},
+		},
+	)
+
+	// After three periods, the first table's data is all older than the
+	// retention period, so it's deleted, and not recreated.
+	test(
+		"Move forward by three table periods",
+		time.Unix(0, 0).Add(3*tablePeriod),
+		[]tableDescription{
+			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "1", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "2", provisionedRead: read, provisionedWrite: write},
+			{name: tablePrefix + "3", provisionedRead: read, provisionedWrite: write},
+		},
+	)
+
+	// Just before the end of the retention period of the second table, it's kept.
+	test(
+		"Move forward to four table periods - grace period",
+		time.Unix(0, 0).Add(4*tablePeriod).Add(-gracePeriod),
+		[]tableDescription{
+			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "1", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "2", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "3", provisionedRead: read, provisionedWrite: write},
+			{name: tablePrefix + "4", provisionedRead: read, provisionedWrite: write},
+		},
+	)
+
+	test(
+		"Move forward to four table periods",
+		time.Unix(0, 0).Add(4*tablePeriod),
+		[]tableDescription{
+			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "2", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "3", provisionedRead: read, provisionedWrite: write},
+			{name: tablePrefix + "4", provisionedRead: read, provisionedWrite: write},
+		},
+	)
+
+	// A retention period shorter than tables are written to is rejected.
+	cfg.RetentionPeriod = maxChunkAge
+	if _, err := NewDynamoTableManager(cfg, dynamoDB); err == nil {
+		t.Fatal("Expected an error for a retention period shorter than the max chunk age")
+	}
+}
+
+func TestDynamoTableManagerDryRun(t *testing.T) {
+	dynamoDB := NewMockStorage()
+
+	cfg := TableManagerConfig{
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       tablePrefix,
+			TablePeriod:       tablePeriod,
+			PeriodicTableStartAt: util.DayValue{
+				Time: model.TimeFromUnix(0),
+			},
+		},
+
+		CreationGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		InactiveWriteThroughput:    inactiveWrite,
+		InactiveReadThroughput:     inactiveRead,
+		RetentionPeriod:            2 * tablePeriod,
+	}
+	tableManager, err := NewDynamoTableManager(cfg, dynamoDB)
+	require.NoError(t, err)
+	mtime.NowForce(time.Unix(0, 0))
+	require.NoError(t, tableManager.syncTables(context.Background()))
+	initial := []tableDescription{
+		{name: "", provisionedRead: read, provisionedWrite: write},
+		{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write},
+	}
+	expectTables(t, dynamoDB, initial)
+
+	// Three periods later, tables need creating, updating and deleting, but a
+	// dry run changes nothing.
+	cfg.DryRun = true
+	dryRun, err := NewDynamoTableManager(cfg, dynamoDB)
+	require.NoError(t, err)
+	mtime.NowForce(time.Unix(0, 0).Add(3 * tablePeriod))
+	require.NoError(t, dryRun.syncTables(context.Background()))
+	expectTables(t, dynamoDB, initial)
+
+	rec := httptest.NewRecorder()
+	dryRun.ServeHTTP(rec, httptest.NewRequest("GET", "/tables", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var plan TablePlan
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&plan))
+	assert.Equal(t, []TableState{
+		{Name: "", Action: TableActionUpdate, Status: dynamodb.TableStatusActive, DesiredRead: inactiveRead, DesiredWrite: inactiveWrite, ActualRead: read, ActualWrite: write},
+		{Name: tablePrefix + "0", Action: TableActionDelete},
+		{Name: tablePrefix + "1", Action: TableActionCreate, DesiredRead: inactiveRead, DesiredWrite: inactiveWrite},
+		{Name: tablePrefix + "2", Action: TableActionCreate, DesiredRead: read, DesiredWrite: write},
+		{Name: tablePrefix + "3", Action: TableActionCreate, DesiredRead: read, DesiredWrite: write},
+	}, plan.Tables)
+
+	// Applying the plan leaves nothing to do.
+	require.NoError(t, tableManager.syncTables(context.Background()))
+	plan, err = dryRun.plan(context.Background())
+	require.NoError(t, err)
+	for _, table := range plan.Tables {
+		assert.Equal(t, TableActionNone, table.Action, table.Name)
+	}
+}
+
 func expectTables(t *testing.T, dynamo DynamoTableClient, expected []tableDescription) {
 	tables, err := dynamo.ListTables()
 	if err != nil {
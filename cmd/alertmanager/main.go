@@ -14,14 +14,17 @@
 package main
 
 import (
-	"flag"
 	"log"
+	"net/http"
+	"strings"
 
 	"google.golang.org/grpc"
 
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/server"
 	"github.com/weaveworks/cortex/alertmanager"
+	"github.com/weaveworks/cortex/auth"
+	"github.com/weaveworks/cortex/limits"
 	"github.com/weaveworks/cortex/util"
 )
 
@@ -33,24 +36,59 @@ func main() {
 				middleware.ServerUserHeaderInterceptor,
 			},
 		}
+		prefixConfig       util.PathPrefixConfig
+		authConfig         auth.Config
+		debugConfig        util.DebugConfig
+		tracingConfig      util.TracingConfig
 		alertmanagerConfig alertmanager.MultitenantAlertmanagerConfig
+		limitsConfig       limits.Limits
 	)
-	util.RegisterFlags(&serverConfig, &alertmanagerConfig)
-	flag.Parse()
+	util.RegisterFlags(&serverConfig, &prefixConfig, &authConfig, &debugConfig, &tracingConfig, &alertmanagerConfig, &limitsConfig)
+	util.ParseFlags()
 
-	multiAM, err := alertmanager.NewMultitenantAlertmanager(&alertmanagerConfig)
+	tracing, err := tracingConfig.InitTracing("alertmanager")
+	if err != nil {
+		log.Fatalf("Error initializing tracing: %v", err)
+	}
+	defer tracing.Close()
+
+	authenticateUser, err := authConfig.Authenticate()
+	if err != nil {
+		log.Fatalf("Error initializing authentication: %v", err)
+	}
+	// The Alertmanagers serve their endpoints under the path of their
+	// external URL, so it has to be under the prefix we serve them on.
+	if prefix := prefixConfig.Path(); prefix != "" {
+		if u := alertmanagerConfig.ExternalURL.URL; u == nil || !strings.HasPrefix(u.Path, prefix+"/") {
+			log.Fatalf("-alertmanager.web.external-url must be under -http.prefix %s", prefix)
+		}
+	}
+
+	overrides, err := limits.NewOverrides(limitsConfig)
+	if err != nil {
+		log.Fatalf("Error initializing overrides: %v", err)
+	}
+	defer overrides.Stop()
+
+	multiAM, err := alertmanager.NewMultitenantAlertmanager(&alertmanagerConfig, overrides)
 	if err != nil {
 		log.Fatalf("Error initializing MultitenantAlertmanager: %v", err)
 	}
 	go multiAM.Run()
 	defer multiAM.Stop()
 
+	debugConfig.Register(&serverConfig, authConfig.Require(auth.OpsAdmin))
 	server, err := server.New(serverConfig)
 	if err != nil {
 		log.Fatalf("Error initializing server: %v", err)
 	}
 	defer server.Shutdown()
 
-	server.HTTP.PathPrefix("/api/prom").Handler(middleware.AuthenticateUser.Wrap(multiAM))
+	router := prefixConfig.Router(server.HTTP)
+	router.PathPrefix("/api/prom").Handler(middleware.Merge(authenticateUser, authConfig.RequireByMethod(auth.Read, auth.RulesAdmin)).Wrap(multiAM))
+	util.NewReadiness().Register(server.HTTP)
+	router.Handle("/runtime_config", overrides)
+	router.Handle("/limits", authConfig.Require(auth.OpsAdmin).Wrap(http.HandlerFunc(overrides.LimitsHandler)))
+	util.RegisterLogLevel(router, authConfig.Require(auth.OpsAdmin))
 	server.Run()
 }
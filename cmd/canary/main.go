@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/auth"
+	"github.com/weaveworks/cortex/canary"
+	"github.com/weaveworks/cortex/events"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+func main() {
+	var (
+		serverConfig = server.Config{
+			MetricsNamespace: "cortex",
+		}
+		prefixConfig  util.PathPrefixConfig
+		debugConfig   util.DebugConfig
+		scopesConfig  auth.ScopesConfig
+		tracingConfig util.TracingConfig
+		canaryConfig  canary.Config
+		eventsConfig  events.Config
+	)
+	util.RegisterFlags(&serverConfig, &prefixConfig, &debugConfig, &scopesConfig, &tracingConfig, &canaryConfig, &eventsConfig)
+	util.ParseFlags()
+
+	tracing, err := tracingConfig.InitTracing("canary")
+	if err != nil {
+		log.Fatalf("Error initializing tracing: %v", err)
+	}
+	defer tracing.Close()
+
+	events.Init(eventsConfig)
+	defer events.Stop()
+
+	c, err := canary.New(canaryConfig)
+	if err != nil {
+		log.Fatalf("Error initializing canary: %v", err)
+	}
+	defer c.Stop()
+
+	debugConfig.Register(&serverConfig, scopesConfig.Require(auth.OpsAdmin))
+	server, err := server.New(serverConfig)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	router := prefixConfig.Router(server.HTTP)
+	router.Handle("/events", events.Handler())
+	util.NewReadiness().Register(server.HTTP)
+	util.RegisterLogLevel(router, scopesConfig.Require(auth.OpsAdmin))
+	server.Run()
+}
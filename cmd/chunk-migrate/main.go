@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// chunk-migrate copies a tenant's index entries and chunks over a time range
+// from one storage backend to another, configured by the usual storage flags
+// prefixed with -source. and -destination.  The destination's tables must
+// have been created, e.g. by a table manager, with the same names.
+func main() {
+	var (
+		sourceConfig      chunk.StorageClientConfig
+		destinationConfig chunk.StorageClientConfig
+		migratorConfig    chunk.MigratorConfig
+		userID            string
+		from, through     string
+	)
+	flag.StringVar(&userID, "tenant", "", "ID of the tenant to migrate.")
+	flag.StringVar(&from, "from", "", "Start of the range to migrate chunks in, as a Unix timestamp or RFC3339 time.")
+	flag.StringVar(&through, "through", "", "End of the range to migrate chunks in, as a Unix timestamp or RFC3339 time. Defaults to now.")
+	util.RegisterFlags(util.PrefixedRegisterer{Prefix: "source.", Registerer: &sourceConfig},
+		util.PrefixedRegisterer{Prefix: "destination.", Registerer: &destinationConfig}, &migratorConfig)
+	util.ParseFlags()
+
+	if userID == "" {
+		log.Fatalf("No tenant given; set -tenant")
+	}
+	if from == "" {
+		log.Fatalf("No start given; set -from")
+	}
+	start, err := util.ParseTime(from)
+	if err != nil {
+		log.Fatalf("Error parsing -from: %v", err)
+	}
+	end := model.Now()
+	if through != "" {
+		if end, err = util.ParseTime(through); err != nil {
+			log.Fatalf("Error parsing -through: %v", err)
+		}
+	}
+
+	source, err := chunk.NewStorageClient(sourceConfig)
+	if err != nil {
+		log.Fatalf("Error initializing source storage client: %v", err)
+	}
+	destination, err := chunk.NewStorageClient(destinationConfig)
+	if err != nil {
+		log.Fatalf("Error initializing destination storage client: %v", err)
+	}
+	migrator := chunk.NewMigrator(migratorConfig, source, destination)
+	if err := migrator.Migrate(context.Background(), userID, start, end); err != nil {
+		log.Fatalf("Error migrating: %v", err)
+	}
+	log.Infof("Migrated tenant %s", userID)
+}
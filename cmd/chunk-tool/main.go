@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+const usage = `Usage: chunk-tool [flags] <command> <args>...
+
+Commands:
+  decode <key>...               Print what a chunk's external key encodes.
+  dump <key>...                 Fetch chunks and print their samples.
+  index <selector>              List the index entries of -tenant's series
+                                matching the selector, between -from and
+                                -through.
+  delete <key>...               Delete chunks and their index entries.
+  reindex <schema>              Write index entries under the schema version,
+                                e.g. v8, for the chunks between -from and
+                                -through of -tenant, or of every tenant if
+                                it's empty, so the version's start date can
+                                be moved back to -from.
+
+Flags:
+`
+
+// chunk-tool inspects the chunk store, for debugging: it decodes chunk keys,
+// dumps chunks, lists index entries and deletes chunks, and reindexes
+// historical periods under a new schema.
+func main() {
+	var (
+		storageConfig    chunk.StorageClientConfig
+		chunkStoreConfig chunk.StoreConfig
+		userID           string
+		from, through    string
+	)
+	flag.StringVar(&userID, "tenant", "", "ID of the tenant whose index entries to list or reindex.")
+	flag.StringVar(&from, "from", "", "Start of the range to list or reindex index entries in, as a Unix timestamp or RFC3339 time. Defaults to an hour before -through when listing.")
+	flag.StringVar(&through, "through", "", "End of the range to list or reindex index entries in, as a Unix timestamp or RFC3339 time. Defaults to now.")
+	util.RegisterFlags(&storageConfig, &chunkStoreConfig)
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	util.ParseFlags()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	command, args := args[0], args[1:]
+
+	// Decoding keys doesn't need the store.
+	if command == "decode" {
+		for _, key := range args {
+			c, err := chunk.ParseKey(key)
+			if err != nil {
+				log.Fatalf("Error parsing chunk key %s: %v", key, err)
+			}
+			fmt.Printf("%s\n  user: %s\n  fingerprint: %s\n  from: %s\n  through: %s\n", key, c.UserID, c.Fingerprint, formatTime(c.From), formatTime(c.Through))
+			if c.ChecksumSet {
+				fmt.Printf("  checksum: %08x\n", c.Checksum)
+			}
+		}
+		return
+	}
+
+	storageClient, err := chunk.NewStorageClient(storageConfig)
+	if err != nil {
+		log.Fatalf("Error initializing storage client: %v", err)
+	}
+	chunkStore, err := chunk.NewStore(chunkStoreConfig, storageClient)
+	if err != nil {
+		log.Fatalf("Error initializing chunk store: %v", err)
+	}
+	defer chunkStore.Stop()
+	ctx := context.Background()
+
+	switch command {
+	case "dump":
+		for _, key := range args {
+			c, err := chunkStore.FetchChunk(ctx, key)
+			if err != nil {
+				log.Fatalf("Error fetching chunk %s: %v", key, err)
+			}
+			matrix, err := chunk.ChunksToMatrix([]chunk.Chunk{c})
+			if err != nil {
+				log.Fatalf("Error decoding chunk %s: %v", key, err)
+			}
+			fmt.Printf("%s\n  metric: %s\n  encoding: %s\n", key, c.Metric, c.Encoding)
+			for _, ss := range matrix {
+				for _, v := range ss.Values {
+					fmt.Printf("  %s %s\n", formatTime(v.Timestamp), v.Value)
+				}
+			}
+		}
+
+	case "index":
+		if userID == "" {
+			log.Fatalf("No tenant given; set -tenant")
+		}
+		if len(args) != 1 {
+			log.Fatalf("index takes one selector")
+		}
+		matchers, err := promql.ParseMetricSelector(args[0])
+		if err != nil {
+			log.Fatalf("Error parsing selector: %v", err)
+		}
+		start, end := parseRange(from, through)
+		rows, err := chunkStore.IndexRows(user.Inject(ctx, userID), start, end, matchers...)
+		if err != nil {
+			log.Fatalf("Error listing index entries: %v", err)
+		}
+		for _, row := range rows {
+			fmt.Printf("%s\t%s\t%x\t%q\t%s\n", row.TableName, row.HashValue, row.RangeValue, row.LabelValue, row.ChunkKey)
+		}
+
+	case "delete":
+		for _, key := range args {
+			if err := chunkStore.DeleteChunk(ctx, key); err != nil {
+				log.Fatalf("Error deleting chunk %s: %v", key, err)
+			}
+			log.Infof("Deleted chunk %s", key)
+		}
+
+	case "reindex":
+		if len(args) != 1 {
+			log.Fatalf("reindex takes one schema version")
+		}
+		if from == "" {
+			log.Fatalf("No start given; set -from")
+		}
+		start, end := parseRange(from, through)
+		if err := chunkStore.Reindex(ctx, args[0], userID, start, end); err != nil {
+			log.Fatalf("Error reindexing: %v", err)
+		}
+		log.Infof("Reindexed chunks under schema %s", args[0])
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// parseRange parses -from and -through, which default to an hour ago and now.
+func parseRange(from, through string) (model.Time, model.Time) {
+	end := model.Now()
+	if through != "" {
+		var err error
+		if end, err = util.ParseTime(through); err != nil {
+			log.Fatalf("Error parsing -through: %v", err)
+		}
+	}
+	start := end.Add(-time.Hour)
+	if from != "" {
+		var err error
+		if start, err = util.ParseTime(from); err != nil {
+			log.Fatalf("Error parsing -from: %v", err)
+		}
+	}
+	return start, end
+}
+
+func formatTime(t model.Time) string {
+	return fmt.Sprintf("%s (%s)", t, t.Time().UTC().Format(time.RFC3339Nano))
+}
@@ -1,16 +1,15 @@
 package main
 
 import (
-	"flag"
-
-	"github.com/prometheus/common/log"
 	"google.golang.org/grpc"
 
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/auth"
 	"github.com/weaveworks/cortex/configs/api"
 	"github.com/weaveworks/cortex/configs/db"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 func main() {
@@ -23,10 +22,25 @@ func main() {
 				middleware.ServerUserHeaderInterceptor,
 			},
 		}
-		dbConfig db.Config
+		prefixConfig  util.PathPrefixConfig
+		authConfig    auth.Config
+		debugConfig   util.DebugConfig
+		tracingConfig util.TracingConfig
+		dbConfig      db.Config
 	)
-	util.RegisterFlags(&serverConfig, &dbConfig)
-	flag.Parse()
+	util.RegisterFlags(&serverConfig, &prefixConfig, &authConfig, &debugConfig, &tracingConfig, &dbConfig)
+	util.ParseFlags()
+
+	tracing, err := tracingConfig.InitTracing("configs")
+	if err != nil {
+		log.Fatalf("Error initializing tracing: %v", err)
+	}
+	defer tracing.Close()
+
+	authenticateUser, err := authConfig.Authenticate()
+	if err != nil {
+		log.Fatalf("Error initializing authentication: %v", err)
+	}
 
 	db, err := db.New(dbConfig)
 	if err != nil {
@@ -34,14 +48,17 @@ func main() {
 	}
 	defer db.Close()
 
-	a := api.New(db)
+	a := api.New(db, authenticateUser, authConfig.ScopesConfig)
 
+	debugConfig.Register(&serverConfig, authConfig.Require(auth.OpsAdmin))
 	server, err := server.New(serverConfig)
 	if err != nil {
 		log.Fatalf("Error initializing server: %v", err)
 	}
 	defer server.Shutdown()
 
-	a.RegisterRoutes(server.HTTP)
+	a.RegisterRoutes(prefixConfig.Router(server.HTTP))
+	util.NewReadiness().Register(server.HTTP)
+	util.RegisterLogLevel(prefixConfig.Router(server.HTTP), authConfig.Require(auth.OpsAdmin))
 	server.Run()
 }
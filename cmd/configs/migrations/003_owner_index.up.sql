@@ -0,0 +1,4 @@
+-- Finding a user's latest config, and every user's latest config, orders
+-- their configs by ID, which the primary key can't help with as it starts
+-- with the ID.
+CREATE INDEX IF NOT EXISTS configs_owner_id_idx ON configs (owner_id, id DESC);
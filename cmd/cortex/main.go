@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/weaveworks/cortex/modules"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// Cortex runs any combination of modules, given by -target, in a single
+// process.  By default it runs all of them, for demos, development and small
+// installations.
+func main() {
+	var cfg modules.Config
+	util.RegisterFlags(&cfg)
+	util.ParseFlags()
+	if err := modules.SetSingleProcessDefaults(&cfg); err != nil {
+		log.Fatalf("Error setting defaults: %v", err)
+	}
+
+	c, err := modules.New(cfg)
+	if err != nil {
+		log.Fatalf("Error initializing Cortex: %v", err)
+	}
+	defer c.Stop()
+	c.Run()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/configs/db"
+	"github.com/weaveworks/cortex/distributor"
+	"github.com/weaveworks/cortex/limits"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/ruler"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// delete-tenant removes every trace of a tenant from Cortex: their rules and
+// Alertmanager config, their rules in object storage, their in-memory series in the ingesters, and their
+// index entries, chunks and blocks in the store.  Revoke the tenant's access
+// first, so nothing is written for them while it runs; running it again is
+// safe.
+func main() {
+	var (
+		ringConfig              ring.Config
+		distributorConfig       distributor.Config
+		limitsConfig            limits.Limits
+		storageConfig           chunk.StorageClientConfig
+		chunkStoreConfig        chunk.StoreConfig
+		dynamoTableClientConfig chunk.DynamoTableClientConfig
+		tableManagerConfig      chunk.TableManagerConfig
+		dbConfig                db.Config
+		rulerStorageConfig      ruler.ObjectStoreConfig
+		userID                  string
+	)
+	flag.StringVar(&userID, "tenant", "", "ID of the tenant to delete.")
+	// The table client shares the storage client's DynamoDB flags, and the
+	// table manager the store's delete request flags.
+	util.RegisterSharedFlags(&ringConfig, &distributorConfig, &limitsConfig, &storageConfig, &chunkStoreConfig,
+		&dynamoTableClientConfig, &tableManagerConfig, &dbConfig, &rulerStorageConfig)
+	util.ParseFlags()
+
+	if userID == "" {
+		log.Fatalf("No tenant given; set -tenant")
+	}
+	ctx := user.Inject(context.Background(), userID)
+
+	// Configs go first, so the ruler stops writing samples for the tenant.
+	log.Infof("Deleting configs of tenant %s", userID)
+	configsDB, err := db.New(dbConfig)
+	if err != nil {
+		log.Fatalf("Error initializing database: %v", err)
+	}
+	defer configsDB.Close()
+	if err := configsDB.DeleteConfig(userID); err != nil {
+		log.Fatalf("Error deleting configs: %v", err)
+	}
+	if rulerStorageConfig.S3.URL != nil {
+		log.Infof("Deleting rules of tenant %s from object storage", userID)
+		numRules, err := ruler.DeleteRules(rulerStorageConfig, userID)
+		if err != nil {
+			log.Fatalf("Error deleting rules from object storage: %v", err)
+		}
+		log.Infof("Deleted %d rules files of tenant %s", numRules, userID)
+	}
+
+	// Then the ingesters, so they don't flush chunks after the store has
+	// been cleared.
+	log.Infof("Deleting in-memory series of tenant %s", userID)
+	overrides, err := limits.NewOverrides(limitsConfig)
+	if err != nil {
+		log.Fatalf("Error initializing overrides: %v", err)
+	}
+	defer overrides.Stop()
+	r, err := ring.New(ringConfig)
+	if err != nil {
+		log.Fatalf("Error initializing ring: %v", err)
+	}
+	defer r.Stop()
+	dist, err := distributor.New(distributorConfig, r, overrides)
+	if err != nil {
+		log.Fatalf("Error initializing distributor: %v", err)
+	}
+	defer dist.Stop()
+	numSeries, err := dist.DeleteUser(ctx)
+	if err != nil {
+		log.Fatalf("Error deleting in-memory series: %v", err)
+	}
+	log.Infof("Deleted %d in-memory series, including replicas, of tenant %s", numSeries, userID)
+
+	log.Infof("Deleting index entries and chunks of tenant %s", userID)
+	storageClient, err := chunk.NewStorageClient(storageConfig)
+	if err != nil {
+		log.Fatalf("Error initializing storage client: %v", err)
+	}
+	chunkStore, err := chunk.NewStore(chunkStoreConfig, storageClient)
+	if err != nil {
+		log.Fatalf("Error initializing chunk store: %v", err)
+	}
+	defer chunkStore.Stop()
+	dynamoClient, err := chunk.NewDynamoTableClient(dynamoTableClientConfig)
+	if err != nil {
+		log.Fatalf("Error initializing DynamoDB client: %v", err)
+	}
+	purger := chunk.NewPurger(chunk.PurgerConfig{}, tableManagerConfig, chunkStore, dynamoClient, nil)
+	if err := purger.DeleteUser(ctx, userID); err != nil {
+		log.Fatalf("Error deleting index entries and chunks: %v", err)
+	}
+
+	log.Infof("Deleted tenant %s", userID)
+}
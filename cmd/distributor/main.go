@@ -1,18 +1,21 @@
 package main
 
 import (
-	"flag"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 	"google.golang.org/grpc"
 
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/auth"
 	"github.com/weaveworks/cortex/distributor"
+	"github.com/weaveworks/cortex/events"
+	"github.com/weaveworks/cortex/limits"
 	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/usage"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 func main() {
@@ -40,11 +43,44 @@ func main() {
 				middleware.ServerUserHeaderInterceptor,
 			},
 		}
+		prefixConfig      util.PathPrefixConfig
+		authConfig        auth.Config
+		debugConfig       util.DebugConfig
+		tracingConfig     util.TracingConfig
 		ringConfig        ring.Config
 		distributorConfig distributor.Config
+		eventsConfig      events.Config
+		usageConfig       usage.Config
+		limitsConfig      limits.Limits
 	)
-	util.RegisterFlags(&serverConfig, &ringConfig, &distributorConfig)
-	flag.Parse()
+	// Distributors share the ring's consul config for the global ingestion rate strategy.
+	distributorConfig.ConsulConfig = &ringConfig.ConsulConfig
+	util.RegisterFlags(&serverConfig, &prefixConfig, &authConfig, &debugConfig, &tracingConfig, &ringConfig, &distributorConfig, &eventsConfig, &usageConfig, &limitsConfig)
+	util.ParseFlags()
+
+	tracing, err := tracingConfig.InitTracing("distributor")
+	if err != nil {
+		log.Fatalf("Error initializing tracing: %v", err)
+	}
+	defer tracing.Close()
+
+	authenticateUser, err := authConfig.Authenticate()
+	if err != nil {
+		log.Fatalf("Error initializing authentication: %v", err)
+	}
+
+	events.Init(eventsConfig)
+	defer events.Stop()
+	if err := usage.Init(usageConfig); err != nil {
+		log.Fatalf("Error initializing usage reporting: %v", err)
+	}
+	defer usage.Stop()
+
+	overrides, err := limits.NewOverrides(limitsConfig)
+	if err != nil {
+		log.Fatalf("Error initializing overrides: %v", err)
+	}
+	defer overrides.Stop()
 
 	r, err := ring.New(ringConfig)
 	if err != nil {
@@ -52,20 +88,33 @@ func main() {
 	}
 	defer r.Stop()
 
-	dist, err := distributor.New(distributorConfig, r)
+	dist, err := distributor.New(distributorConfig, r, overrides)
 	if err != nil {
 		log.Fatalf("Error initializing distributor: %v", err)
 	}
 	defer dist.Stop()
 	prometheus.MustRegister(dist)
 
+	debugConfig.Register(&serverConfig, authConfig.Require(auth.OpsAdmin))
 	server, err := server.New(serverConfig)
 	if err != nil {
 		log.Fatalf("Error initializing server: %v", err)
 	}
 	defer server.Shutdown()
 
-	server.HTTP.Handle("/ring", r)
-	server.HTTP.Handle("/api/prom/push", middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.PushHandler)))
+	router := prefixConfig.Router(server.HTTP)
+	router.Handle("/ring", authConfig.Require(auth.OpsAdmin).Wrap(r))
+	router.Handle("/multikv", authConfig.Require(auth.OpsAdmin).Wrap(ring.MultiKVHandler()))
+	router.Handle("/api/prom/push", middleware.Merge(authenticateUser, authConfig.Require(auth.Write)).Wrap(http.HandlerFunc(dist.PushHandler)))
+	router.Handle("/api/prom/influx/write", middleware.Merge(authenticateUser, authConfig.Require(auth.Write)).Wrap(http.HandlerFunc(dist.InfluxPushHandler)))
+	router.Handle("/api/prom/push/json", middleware.Merge(authenticateUser, authConfig.Require(auth.Write)).Wrap(http.HandlerFunc(dist.JSONPushHandler)))
+	router.Handle("/api/prom/discarded_samples", middleware.Merge(authenticateUser, authConfig.Require(auth.Read)).Wrap(http.HandlerFunc(dist.DiscardsHandler)))
+	router.Handle("/events", events.Handler())
+	router.Handle("/runtime_config", overrides)
+	router.Handle("/limits", authConfig.Require(auth.OpsAdmin).Wrap(http.HandlerFunc(overrides.LimitsHandler)))
+	readiness := util.NewReadiness()
+	readiness.Add("ring", r.CheckReady)
+	readiness.Register(server.HTTP)
+	util.RegisterLogLevel(router, authConfig.Require(auth.OpsAdmin))
 	server.Run()
 }
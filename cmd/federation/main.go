@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/auth"
+	"github.com/weaveworks/cortex/federation"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+func main() {
+	var (
+		serverConfig = server.Config{
+			MetricsNamespace: "cortex",
+			GRPCMiddleware: []grpc.UnaryServerInterceptor{
+				middleware.ServerUserHeaderInterceptor,
+			},
+		}
+		prefixConfig     util.PathPrefixConfig
+		authConfig       auth.Config
+		debugConfig      util.DebugConfig
+		tracingConfig    util.TracingConfig
+		federationConfig federation.Config
+	)
+	util.RegisterFlags(&serverConfig, &prefixConfig, &authConfig, &debugConfig, &tracingConfig, &federationConfig)
+	util.ParseFlags()
+
+	tracing, err := tracingConfig.InitTracing("federation")
+	if err != nil {
+		log.Fatalf("Error initializing tracing: %v", err)
+	}
+	defer tracing.Close()
+
+	authenticateUser, err := authConfig.Authenticate()
+	if err != nil {
+		log.Fatalf("Error initializing authentication: %v", err)
+	}
+
+	proxy, err := federation.New(federationConfig)
+	if err != nil {
+		log.Fatalf("Error initializing federation proxy: %v", err)
+	}
+
+	debugConfig.Register(&serverConfig, authConfig.Require(auth.OpsAdmin))
+	server, err := server.New(serverConfig)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	// The clusters are queried without our prefix; their URLs carry their own.
+	prefix := prefixConfig.Path()
+	subrouter := server.HTTP.PathPrefix(prefix + "/api/prom/api/v1").Subrouter()
+	authenticate := middleware.Merge(authenticateUser, authConfig.Require(auth.Read))
+	subrouter.Path("/query").Handler(authenticate.Wrap(http.StripPrefix(prefix, proxy)))
+	subrouter.Path("/query_range").Handler(authenticate.Wrap(http.StripPrefix(prefix, proxy)))
+	util.NewReadiness().Register(server.HTTP)
+	util.RegisterLogLevel(prefixConfig.Router(server.HTTP), authConfig.Require(auth.OpsAdmin))
+	server.Run()
+}
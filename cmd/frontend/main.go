@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/auth"
+	"github.com/weaveworks/cortex/frontend"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+func main() {
+	var (
+		serverConfig = server.Config{
+			MetricsNamespace: "cortex",
+			GRPCMiddleware: []grpc.UnaryServerInterceptor{
+				middleware.ServerUserHeaderInterceptor,
+			},
+		}
+		prefixConfig   util.PathPrefixConfig
+		authConfig     auth.Config
+		debugConfig    util.DebugConfig
+		tracingConfig  util.TracingConfig
+		frontendConfig frontend.Config
+	)
+	util.RegisterFlags(&serverConfig, &prefixConfig, &authConfig, &debugConfig, &tracingConfig, &frontendConfig)
+	util.ParseFlags()
+
+	tracing, err := tracingConfig.InitTracing("frontend")
+	if err != nil {
+		log.Fatalf("Error initializing tracing: %v", err)
+	}
+	defer tracing.Close()
+
+	authenticateUser, err := authConfig.Authenticate()
+	if err != nil {
+		log.Fatalf("Error initializing authentication: %v", err)
+	}
+
+	f, err := frontend.New(frontendConfig)
+	if err != nil {
+		log.Fatalf("Error initializing frontend: %v", err)
+	}
+	defer f.Stop()
+
+	debugConfig.Register(&serverConfig, authConfig.Require(auth.OpsAdmin))
+	server, err := server.New(serverConfig)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	// Queries are forwarded without our prefix; the downstream URL carries its own.
+	prefix := prefixConfig.Path()
+	server.HTTP.PathPrefix(prefix + "/api/prom").Handler(middleware.Merge(authenticateUser, authConfig.Require(auth.Read)).Wrap(http.StripPrefix(prefix, f)))
+	util.NewReadiness().Register(server.HTTP)
+	util.RegisterLogLevel(prefixConfig.Router(server.HTTP), authConfig.Require(auth.OpsAdmin))
+	server.Run()
+}
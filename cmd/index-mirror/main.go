@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/auth"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// index-mirror mirrors the index entries written to DynamoDB index tables,
+// configured by the DynamoDB flags prefixed with -source., to another storage
+// backend, configured by the usual storage flags prefixed with
+// -destination., by consuming the tables' streams.  Streams are enabled by
+// the table manager's -table-manager.index-streams, and the destination's
+// tables must have been created with the same names.
+func main() {
+	var (
+		serverConfig      = server.Config{MetricsNamespace: "cortex"}
+		debugConfig       util.DebugConfig
+		scopesConfig      auth.ScopesConfig
+		tracingConfig     util.TracingConfig
+		sourceConfig      chunk.DynamoDBConfig
+		destinationConfig chunk.StorageClientConfig
+		mirrorConfig      chunk.IndexMirrorConfig
+	)
+	util.RegisterFlags(&serverConfig, &debugConfig, &scopesConfig, &tracingConfig, util.PrefixedRegisterer{Prefix: "source.", Registerer: &sourceConfig},
+		util.PrefixedRegisterer{Prefix: "destination.", Registerer: &destinationConfig}, &mirrorConfig)
+	util.ParseFlags()
+
+	tracing, err := tracingConfig.InitTracing("index-mirror")
+	if err != nil {
+		log.Fatalf("Error initializing tracing: %v", err)
+	}
+	defer tracing.Close()
+
+	destination, err := chunk.NewStorageClient(destinationConfig)
+	if err != nil {
+		log.Fatalf("Error initializing destination storage client: %v", err)
+	}
+	mirror, err := chunk.NewIndexMirror(mirrorConfig, sourceConfig, destination)
+	if err != nil {
+		log.Fatalf("Error initializing index mirror: %v", err)
+	}
+	mirror.Start()
+	defer mirror.Stop()
+
+	debugConfig.Register(&serverConfig, scopesConfig.Require(auth.OpsAdmin))
+	server, err := server.New(serverConfig)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	util.NewReadiness().Register(server.HTTP)
+	util.RegisterLogLevel(server.HTTP, scopesConfig.Require(auth.OpsAdmin))
+	server.Run()
+}
@@ -1,19 +1,23 @@
 package main
 
 import (
-	"flag"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 	"google.golang.org/grpc"
 
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/server"
 	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/auth"
 	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/events"
 	"github.com/weaveworks/cortex/ingester"
+	"github.com/weaveworks/cortex/limits"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/usage"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 func main() {
@@ -24,16 +28,47 @@ func main() {
 				middleware.ServerUserHeaderInterceptor,
 			},
 		}
+		prefixConfig     util.PathPrefixConfig
+		debugConfig      util.DebugConfig
+		scopesConfig     auth.ScopesConfig
+		tracingConfig    util.TracingConfig
 		chunkStoreConfig chunk.StoreConfig
 		storageConfig    chunk.StorageClientConfig
 		ingesterConfig   ingester.Config
+		eventsConfig     events.Config
+		usageConfig      usage.Config
+		limitsConfig     limits.Limits
 	)
 	// Ingester needs to know our gRPC listen port.
 	ingesterConfig.ListenPort = &serverConfig.GRPCListenPort
-	util.RegisterFlags(&serverConfig, &chunkStoreConfig, &storageConfig, &ingesterConfig)
-	flag.Parse()
+	util.RegisterFlags(&serverConfig, &prefixConfig, &debugConfig, &scopesConfig, &tracingConfig, &chunkStoreConfig, &storageConfig, &ingesterConfig, &eventsConfig, &usageConfig, &limitsConfig)
+	util.ParseFlags()
 
-	server, err := server.New(serverConfig)
+	tracing, err := tracingConfig.InitTracing("ingester")
+	if err != nil {
+		log.Fatalf("Error initializing tracing: %v", err)
+	}
+	defer tracing.Close()
+
+	events.Init(eventsConfig)
+	defer events.Stop()
+	if err := usage.Init(usageConfig); err != nil {
+		log.Fatalf("Error initializing usage reporting: %v", err)
+	}
+	defer usage.Stop()
+
+	overrides, err := limits.NewOverrides(limitsConfig)
+	if err != nil {
+		log.Fatalf("Error initializing overrides: %v", err)
+	}
+	defer overrides.Stop()
+
+	grpcOptions, err := ingesterConfig.GRPCServerOptions()
+	if err != nil {
+		log.Fatalf("Error configuring gRPC server: %v", err)
+	}
+	debugConfig.Register(&serverConfig, scopesConfig.Require(auth.OpsAdmin))
+	server, err := util.NewServer(serverConfig, grpcOptions...)
 	if err != nil {
 		log.Fatalf("Error initializing server: %v", err)
 	}
@@ -50,14 +85,32 @@ func main() {
 	}
 	defer chunkStore.Stop()
 
-	ingester, err := ingester.New(ingesterConfig, chunkStore)
+	ingester, err := ingester.New(ingesterConfig, chunkStore, overrides)
 	if err != nil {
 		log.Fatal(err)
 	}
 	prometheus.MustRegister(ingester)
 	defer ingester.Shutdown()
 
+	// The ingester doesn't read the ring itself, but serves its status page.
+	r, err := ring.New(ingesterConfig.RingConfig())
+	if err != nil {
+		log.Fatalf("Error initializing ring: %v", err)
+	}
+	defer r.Stop()
+
 	cortex.RegisterIngesterServer(server.GRPC, ingester)
-	server.HTTP.Path("/ready").Handler(http.HandlerFunc(ingester.ReadinessHandler))
+	router := prefixConfig.Router(server.HTTP)
+	router.Handle("/ring", scopesConfig.Require(auth.OpsAdmin).Wrap(r))
+	router.Handle("/events", events.Handler())
+	router.Handle("/multikv", scopesConfig.Require(auth.OpsAdmin).Wrap(ring.MultiKVHandler()))
+	router.Handle("/runtime_config", overrides)
+	router.Handle("/limits", scopesConfig.Require(auth.OpsAdmin).Wrap(http.HandlerFunc(overrides.LimitsHandler)))
+	router.Path("/index_sharding").Handler(http.HandlerFunc(chunkStore.IndexShardingReport))
+	readiness := util.NewReadiness()
+	readiness.Add("ingester", ingester.CheckReady)
+	readiness.Add("store", chunkStore.CheckReady)
+	readiness.Register(server.HTTP)
+	util.RegisterLogLevel(router, scopesConfig.Require(auth.OpsAdmin))
 	server.Run()
 }
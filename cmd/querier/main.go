@@ -1,14 +1,12 @@
 package main
 
 import (
-	"flag"
 	"net/http"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/route"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/retrieval"
@@ -16,11 +14,16 @@ import (
 
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/auth"
 	"github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/distributor"
+	"github.com/weaveworks/cortex/events"
+	"github.com/weaveworks/cortex/limits"
 	"github.com/weaveworks/cortex/querier"
 	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/usage"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 type dummyTargetRetriever struct{}
@@ -39,13 +42,48 @@ func main() {
 				middleware.ServerUserHeaderInterceptor,
 			},
 		}
+		prefixConfig      util.PathPrefixConfig
+		authConfig        auth.Config
+		debugConfig       util.DebugConfig
+		tracingConfig     util.TracingConfig
 		ringConfig        ring.Config
 		distributorConfig distributor.Config
 		chunkStoreConfig  chunk.StoreConfig
 		storageConfig     chunk.StorageClientConfig
+		admissionConfig   querier.AdmissionConfig
+		estimatorConfig   querier.EstimatorConfig
+		eventsConfig      events.Config
+		usageConfig       usage.Config
+		limitsConfig      limits.Limits
 	)
-	util.RegisterFlags(&serverConfig, &ringConfig, &distributorConfig, &chunkStoreConfig, &storageConfig)
-	flag.Parse()
+	// The quarantine list is kept alongside the ring.
+	chunkStoreConfig.Quarantine.ConsulConfig = &ringConfig.ConsulConfig
+	util.RegisterFlags(&serverConfig, &prefixConfig, &authConfig, &debugConfig, &tracingConfig, &ringConfig, &distributorConfig, &chunkStoreConfig, &storageConfig, &admissionConfig, &estimatorConfig, &eventsConfig, &usageConfig, &limitsConfig)
+	util.ParseFlags()
+
+	tracing, err := tracingConfig.InitTracing("querier")
+	if err != nil {
+		log.Fatalf("Error initializing tracing: %v", err)
+	}
+	defer tracing.Close()
+
+	authenticateUser, err := authConfig.Authenticate()
+	if err != nil {
+		log.Fatalf("Error initializing authentication: %v", err)
+	}
+
+	events.Init(eventsConfig)
+	defer events.Stop()
+	if err := usage.Init(usageConfig); err != nil {
+		log.Fatalf("Error initializing usage reporting: %v", err)
+	}
+	defer usage.Stop()
+
+	overrides, err := limits.NewOverrides(limitsConfig)
+	if err != nil {
+		log.Fatalf("Error initializing overrides: %v", err)
+	}
+	defer overrides.Stop()
 
 	r, err := ring.New(ringConfig)
 	if err != nil {
@@ -53,19 +91,22 @@ func main() {
 	}
 	defer r.Stop()
 
-	dist, err := distributor.New(distributorConfig, r)
+	dist, err := distributor.New(distributorConfig, r, overrides)
 	if err != nil {
 		log.Fatalf("Error initializing distributor: %v", err)
 	}
 	defer dist.Stop()
 	prometheus.MustRegister(dist)
 
+	debugConfig.Register(&serverConfig, authConfig.Require(auth.OpsAdmin))
 	server, err := server.New(serverConfig)
 	if err != nil {
 		log.Fatalf("Error initializing server: %v", err)
 	}
 	defer server.Shutdown()
-	server.HTTP.Handle("/ring", r)
+	router := prefixConfig.Router(server.HTTP)
+	router.Handle("/ring", authConfig.Require(auth.OpsAdmin).Wrap(r))
+	router.Handle("/multikv", authConfig.Require(auth.OpsAdmin).Wrap(ring.MultiKVHandler()))
 
 	storageClient, err := chunk.NewStorageClient(storageConfig)
 	if err != nil {
@@ -78,18 +119,43 @@ func main() {
 	}
 	defer chunkStore.Stop()
 
-	queryable := querier.NewQueryable(dist, chunkStore)
+	estimator, err := querier.NewEstimator(estimatorConfig, dist, chunkStore)
+	if err != nil {
+		log.Fatalf("Error initializing estimator: %v", err)
+	}
+
+	queryable := querier.NewQueryable(dist, chunkStore, overrides)
 	engine := promql.NewEngine(queryable, nil)
 	api := v1.NewAPI(engine, querier.DummyStorage{Queryable: queryable}, dummyTargetRetriever{}, dummyAlertmanagerRetriever{})
 	promRouter := route.New(func(r *http.Request) (context.Context, error) {
 		return r.Context(), nil
-	}).WithPrefix("/api/prom/api/v1")
+	}).WithPrefix(prefixConfig.Path() + "/api/prom/api/v1")
 	api.Register(promRouter)
 
-	subrouter := server.HTTP.PathPrefix("/api/prom").Subrouter()
-	subrouter.PathPrefix("/api/v1").Handler(middleware.AuthenticateUser.Wrap(promRouter))
-	subrouter.Path("/validate_expr").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.ValidateExprHandler)))
-	subrouter.Path("/user_stats").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.UserStatsHandler)))
-
+	subrouter := router.PathPrefix("/api/prom").Subrouter()
+	authenticate := middleware.Merge(authenticateUser, authConfig.Require(auth.Read))
+	admission := querier.NewAdmissionController(admissionConfig)
+	// Deleting series, and cancelling deletion, needs write access; listing
+	// delete requests only read.
+	deleteSeries := querier.NewDeleteSeriesHandler(chunkStore)
+	deletesAuth := middleware.Merge(authenticateUser, authConfig.RequireByMethod(auth.Read, auth.Write))
+	subrouter.Path("/api/v1/admin/tsdb/delete_series").Handler(deletesAuth.Wrap(deleteSeries))
+	subrouter.Path("/api/v1/admin/tsdb/cancel_delete_request").Handler(deletesAuth.Wrap(http.HandlerFunc(deleteSeries.Cancel)))
+	subrouter.PathPrefix("/api/v1").Handler(authenticate.Wrap(admission.Wrap(querier.ClientClosedRequest.Wrap(promRouter))))
+	subrouter.Path("/estimate").Handler(authenticate.Wrap(estimator))
+	subrouter.Path("/label_values").Handler(authenticate.Wrap(querier.NewLabelValuesHandler(dist, chunkStore)))
+	subrouter.Path("/validate_expr").Handler(authenticate.Wrap(http.HandlerFunc(dist.ValidateExprHandler)))
+	subrouter.Path("/user_stats").Handler(authenticate.Wrap(http.HandlerFunc(dist.UserStatsHandler)))
+
+	router.Handle("/events", events.Handler())
+	router.Handle("/runtime_config", overrides)
+	router.Handle("/limits", authConfig.Require(auth.OpsAdmin).Wrap(http.HandlerFunc(overrides.LimitsHandler)))
+	router.Handle("/quarantine", authConfig.Require(auth.OpsAdmin).Wrap(http.HandlerFunc(chunkStore.Quarantine)))
+	router.Path("/index_sharding").Handler(http.HandlerFunc(chunkStore.IndexShardingReport))
+	readiness := util.NewReadiness()
+	readiness.Add("ring", r.CheckReady)
+	readiness.Add("store", chunkStore.CheckReady)
+	readiness.Register(server.HTTP)
+	util.RegisterLogLevel(router, authConfig.Require(auth.OpsAdmin))
 	server.Run()
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/auth"
+	"github.com/weaveworks/cortex/querytee"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// query-tee sends queries to two Cortex clusters, returning the responses of
+// the primary and comparing them to the secondary's, to try out a new release
+// or schema against real traffic before switching to it.
+func main() {
+	var (
+		serverConfig = server.Config{
+			MetricsNamespace: "cortex",
+			GRPCMiddleware: []grpc.UnaryServerInterceptor{
+				middleware.ServerUserHeaderInterceptor,
+			},
+		}
+		prefixConfig   util.PathPrefixConfig
+		authConfig     auth.Config
+		debugConfig    util.DebugConfig
+		tracingConfig  util.TracingConfig
+		queryTeeConfig querytee.Config
+	)
+	util.RegisterFlags(&serverConfig, &prefixConfig, &authConfig, &debugConfig, &tracingConfig, &queryTeeConfig)
+	util.ParseFlags()
+
+	tracing, err := tracingConfig.InitTracing("query-tee")
+	if err != nil {
+		log.Fatalf("Error initializing tracing: %v", err)
+	}
+	defer tracing.Close()
+
+	authenticateUser, err := authConfig.Authenticate()
+	if err != nil {
+		log.Fatalf("Error initializing authentication: %v", err)
+	}
+
+	proxy, err := querytee.New(queryTeeConfig)
+	if err != nil {
+		log.Fatalf("Error initializing query-tee: %v", err)
+	}
+	defer proxy.Stop()
+
+	debugConfig.Register(&serverConfig, authConfig.Require(auth.OpsAdmin))
+	server, err := server.New(serverConfig)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	// The backends are queried without our prefix; their URLs carry their own.
+	// Only read APIs are sent on, as writes would be duplicated.
+	prefix := prefixConfig.Path()
+	subrouter := server.HTTP.PathPrefix(prefix + "/api/prom").Subrouter()
+	authenticate := middleware.Merge(authenticateUser, authConfig.Require(auth.Read))
+	for _, path := range []string{"/api/v1/query", "/api/v1/query_range", "/api/v1/series", "/api/v1/label/{name}/values", "/label_values"} {
+		subrouter.Path(path).Methods("GET", "POST").Handler(authenticate.Wrap(http.StripPrefix(prefix, proxy)))
+	}
+	util.NewReadiness().Register(server.HTTP)
+	util.RegisterLogLevel(prefixConfig.Router(server.HTTP), authConfig.Require(auth.OpsAdmin))
+	server.Run()
+}
@@ -1,19 +1,23 @@
 package main
 
 import (
-	"flag"
+	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 	"google.golang.org/grpc"
 
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/auth"
 	"github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/distributor"
+	"github.com/weaveworks/cortex/events"
+	"github.com/weaveworks/cortex/limits"
 	"github.com/weaveworks/cortex/ring"
 	"github.com/weaveworks/cortex/ruler"
+	"github.com/weaveworks/cortex/usage"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 func main() {
@@ -24,14 +28,43 @@ func main() {
 				middleware.ServerUserHeaderInterceptor,
 			},
 		}
+		prefixConfig      util.PathPrefixConfig
+		debugConfig       util.DebugConfig
+		scopesConfig      auth.ScopesConfig
+		tracingConfig     util.TracingConfig
 		ringConfig        ring.Config
 		distributorConfig distributor.Config
 		rulerConfig       ruler.Config
 		chunkStoreConfig  chunk.StoreConfig
 		storageConfig     chunk.StorageClientConfig
+		eventsConfig      events.Config
+		usageConfig       usage.Config
+		limitsConfig      limits.Limits
 	)
-	util.RegisterFlags(&serverConfig, &ringConfig, &distributorConfig, &rulerConfig, &chunkStoreConfig, &storageConfig)
-	flag.Parse()
+	// The quarantine list is kept alongside the ring.
+	chunkStoreConfig.Quarantine.ConsulConfig = &ringConfig.ConsulConfig
+	rulerConfig.ConsulConfig = &ringConfig.ConsulConfig
+	util.RegisterFlags(&serverConfig, &prefixConfig, &debugConfig, &scopesConfig, &tracingConfig, &ringConfig, &distributorConfig, &rulerConfig, &chunkStoreConfig, &storageConfig, &eventsConfig, &usageConfig, &limitsConfig)
+	util.ParseFlags()
+
+	tracing, err := tracingConfig.InitTracing("ruler")
+	if err != nil {
+		log.Fatalf("Error initializing tracing: %v", err)
+	}
+	defer tracing.Close()
+
+	events.Init(eventsConfig)
+	defer events.Stop()
+	if err := usage.Init(usageConfig); err != nil {
+		log.Fatalf("Error initializing usage reporting: %v", err)
+	}
+	defer usage.Stop()
+
+	overrides, err := limits.NewOverrides(limitsConfig)
+	if err != nil {
+		log.Fatalf("Error initializing overrides: %v", err)
+	}
+	defer overrides.Stop()
 
 	storageClient, err := chunk.NewStorageClient(storageConfig)
 	if err != nil {
@@ -50,14 +83,14 @@ func main() {
 	}
 	defer r.Stop()
 
-	dist, err := distributor.New(distributorConfig, r)
+	dist, err := distributor.New(distributorConfig, r, overrides)
 	if err != nil {
 		log.Fatalf("Error initializing distributor: %v", err)
 	}
 	defer dist.Stop()
 	prometheus.MustRegister(dist)
 
-	rlr, err := ruler.NewRuler(rulerConfig, dist, chunkStore)
+	rlr, err := ruler.NewRuler(rulerConfig, dist, chunkStore, overrides)
 	if err != nil {
 		log.Fatalf("Error initializing ruler: %v", err)
 	}
@@ -69,12 +102,23 @@ func main() {
 	}
 	defer rulerServer.Stop()
 
+	debugConfig.Register(&serverConfig, scopesConfig.Require(auth.OpsAdmin))
 	server, err := server.New(serverConfig)
 	if err != nil {
 		log.Fatalf("Error initializing server: %v", err)
 	}
 	defer server.Shutdown()
 
-	server.HTTP.Handle("/ring", r)
+	router := prefixConfig.Router(server.HTTP)
+	router.Handle("/ring", scopesConfig.Require(auth.OpsAdmin).Wrap(r))
+	router.Handle("/multikv", scopesConfig.Require(auth.OpsAdmin).Wrap(ring.MultiKVHandler()))
+	router.Handle("/events", events.Handler())
+	router.Handle("/runtime_config", overrides)
+	router.Handle("/limits", scopesConfig.Require(auth.OpsAdmin).Wrap(http.HandlerFunc(overrides.LimitsHandler)))
+	readiness := util.NewReadiness()
+	readiness.Add("ring", r.CheckReady)
+	readiness.Add("store", chunkStore.CheckReady)
+	readiness.Register(server.HTTP)
+	util.RegisterLogLevel(router, scopesConfig.Require(auth.OpsAdmin))
 	server.Run()
 }
@@ -1,15 +1,18 @@
 package main
 
 import (
-	"flag"
+	"net/http"
 
-	"github.com/prometheus/common/log"
 	"google.golang.org/grpc"
 
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/auth"
 	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/events"
+	"github.com/weaveworks/cortex/limits"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 func main() {
@@ -20,11 +23,34 @@ func main() {
 				middleware.ServerUserHeaderInterceptor,
 			},
 		}
+		prefixConfig            util.PathPrefixConfig
+		debugConfig             util.DebugConfig
+		scopesConfig            auth.ScopesConfig
+		tracingConfig           util.TracingConfig
 		dynamoTableClientConfig = chunk.DynamoTableClientConfig{}
 		tableManagerConfig      = chunk.TableManagerConfig{}
+		purgerConfig            = chunk.PurgerConfig{}
+		scrubberConfig          = chunk.ScrubberConfig{}
+		storageConfig           = chunk.StorageClientConfig{}
+		chunkStoreConfig        = chunk.StoreConfig{}
+		limitsConfig            = limits.Limits{}
+		eventsConfig            = events.Config{}
 	)
-	util.RegisterFlags(&serverConfig, &dynamoTableClientConfig, &tableManagerConfig)
-	flag.Parse()
+	// The purger's and scrubber's storage client shares the table client's
+	// DynamoDB flags, and their store shares the table manager's delete
+	// request flags.
+	util.RegisterSharedFlags(&serverConfig, &prefixConfig, &debugConfig, &scopesConfig, &tracingConfig, &dynamoTableClientConfig, &tableManagerConfig,
+		&purgerConfig, &scrubberConfig, &storageConfig, &chunkStoreConfig, &limitsConfig, &eventsConfig)
+	util.ParseFlags()
+
+	tracing, err := tracingConfig.InitTracing("table-manager")
+	if err != nil {
+		log.Fatalf("Error initializing tracing: %v", err)
+	}
+	defer tracing.Close()
+
+	events.Init(eventsConfig)
+	defer events.Stop()
 
 	dynamoClient, err := chunk.NewDynamoTableClient(dynamoTableClientConfig)
 	if err != nil {
@@ -38,11 +64,43 @@ func main() {
 	tableManager.Start()
 	defer tableManager.Stop()
 
+	overrides, err := limits.NewOverrides(limitsConfig)
+	if err != nil {
+		log.Fatalf("Error initializing overrides: %v", err)
+	}
+	defer overrides.Stop()
+
+	if purgerConfig.Enabled() || scrubberConfig.Interval > 0 {
+		storageClient, err := chunk.NewStorageClient(storageConfig)
+		if err != nil {
+			log.Fatalf("Error initializing storage client: %v", err)
+		}
+		chunkStore, err := chunk.NewStore(chunkStoreConfig, storageClient)
+		if err != nil {
+			log.Fatalf("Error initializing chunk store: %v", err)
+		}
+		defer chunkStore.Stop()
+		purger := chunk.NewPurger(purgerConfig, tableManagerConfig, chunkStore, dynamoClient, overrides)
+		purger.Start()
+		defer purger.Stop()
+		scrubber := chunk.NewScrubber(scrubberConfig, tableManagerConfig, chunkStore, dynamoClient)
+		scrubber.Start()
+		defer scrubber.Stop()
+	}
+
+	debugConfig.Register(&serverConfig, scopesConfig.Require(auth.OpsAdmin))
 	server, err := server.New(serverConfig)
 	if err != nil {
 		log.Fatalf("Error initializing server: %v", err)
 	}
 	defer server.Shutdown()
 
+	router := prefixConfig.Router(server.HTTP)
+	router.Handle("/runtime_config", overrides)
+	router.Handle("/limits", scopesConfig.Require(auth.OpsAdmin).Wrap(http.HandlerFunc(overrides.LimitsHandler)))
+	router.Handle("/events", events.Handler())
+	router.Handle("/tables", scopesConfig.Require(auth.OpsAdmin).Wrap(tableManager))
+	util.NewReadiness().Register(server.HTTP)
+	util.RegisterLogLevel(router, scopesConfig.Require(auth.OpsAdmin))
 	server.Run()
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/auth"
+	"github.com/weaveworks/cortex/usage"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// usage aggregates the per-tenant usage reported by distributors, ingesters,
+// queriers and rulers run with -usage.url, and exports it per period for
+// chargeback.
+func main() {
+	var (
+		serverConfig = server.Config{
+			MetricsNamespace: "cortex",
+		}
+		prefixConfig     util.PathPrefixConfig
+		debugConfig      util.DebugConfig
+		scopesConfig     auth.ScopesConfig
+		tracingConfig    util.TracingConfig
+		aggregatorConfig usage.AggregatorConfig
+	)
+	util.RegisterFlags(&serverConfig, &prefixConfig, &debugConfig, &scopesConfig, &tracingConfig, &aggregatorConfig)
+	util.ParseFlags()
+
+	tracing, err := tracingConfig.InitTracing("usage")
+	if err != nil {
+		log.Fatalf("Error initializing tracing: %v", err)
+	}
+	defer tracing.Close()
+
+	aggregator, err := usage.NewAggregator(aggregatorConfig)
+	if err != nil {
+		log.Fatalf("Error initializing usage aggregator: %v", err)
+	}
+	defer aggregator.Stop()
+
+	debugConfig.Register(&serverConfig, scopesConfig.Require(auth.OpsAdmin))
+	server, err := server.New(serverConfig)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	// Reports come from other Cortex components, so are authenticated with
+	// the usage token rather than a tenant; the export covers every tenant,
+	// so is for operators.
+	router := prefixConfig.Router(server.HTTP)
+	router.Path("/api/usage/report").Handler(http.HandlerFunc(aggregator.ServeReport))
+	router.Path("/api/usage/export").Handler(scopesConfig.Require(auth.OpsAdmin).Wrap(http.HandlerFunc(aggregator.ServeExport)))
+	util.NewReadiness().Register(server.HTTP)
+	util.RegisterLogLevel(router, scopesConfig.Require(auth.OpsAdmin))
+	server.Run()
+}
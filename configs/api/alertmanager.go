@@ -0,0 +1,270 @@
+package api
+
+import (
+	"fmt"
+	tmplhtml "html/template"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	tmpltext "text/template"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/alertmanager/template"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/configs"
+	"github.com/weaveworks/cortex/util"
+)
+
+const (
+	// alertmanagerConfigKey is the field of a config holding its
+	// Alertmanager config file.
+	alertmanagerConfigKey = "alertmanager_config"
+	// templateFilesKey is the field of a config holding its notification
+	// template files, which map a file name to its contents.
+	templateFilesKey = "template_files"
+)
+
+// TemplatesView is the response to listing a user's notification templates,
+// mapping each template file's name to its contents.
+type TemplatesView struct {
+	Templates map[string]string `json:"templates"`
+}
+
+func (a *API) getAlertmanagerConfigFile(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	cfg, err := a.getUserConfig(userID)
+	if err != nil {
+		log.Errorf("Error getting config: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	amConfig, _ := cfg[alertmanagerConfigKey].(string)
+	if amConfig == "" {
+		http.Error(w, "No alertmanager config", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, amConfig)
+}
+
+// setAlertmanagerConfigFile creates or replaces the user's Alertmanager
+// config with the request body, once its routes and receivers are validated.
+func (a *API) setAlertmanagerConfigFile(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("Error reading request body: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := validateAlertmanagerConfig(string(body)); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		util.WriteJSONResponse(w, map[string]string{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	a.configMtx.Lock()
+	defer a.configMtx.Unlock()
+	cfg, err := a.getUserConfig(userID)
+	if err != nil {
+		log.Errorf("Error getting config: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	existing, _ := cfg[alertmanagerConfigKey].(string)
+	if err := a.setConfigField(userID, cfg, alertmanagerConfigKey, string(body)); err != nil {
+		log.Errorf("Error storing config: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if existing != "" {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// deleteAlertmanagerConfigFile removes the user's Alertmanager config, which
+// stops their Alertmanager.
+func (a *API) deleteAlertmanagerConfigFile(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	a.configMtx.Lock()
+	defer a.configMtx.Unlock()
+	cfg, err := a.getUserConfig(userID)
+	if err != nil {
+		log.Errorf("Error getting config: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if amConfig, _ := cfg[alertmanagerConfigKey].(string); amConfig == "" {
+		http.Error(w, "No alertmanager config", http.StatusNotFound)
+		return
+	}
+	if err := a.setConfigField(userID, cfg, alertmanagerConfigKey, nil); err != nil {
+		log.Errorf("Error storing config: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) listTemplates(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	_, templates, err := a.getTemplates(userID)
+	if err != nil {
+		log.Errorf("Error getting templates: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	util.WriteJSONResponse(w, TemplatesView{Templates: templates})
+}
+
+func (a *API) getTemplate(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	_, templates, err := a.getTemplates(userID)
+	if err != nil {
+		log.Errorf("Error getting templates: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl, ok := templates[mux.Vars(r)["name"]]
+	if !ok {
+		http.Error(w, "No such template", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, tmpl)
+}
+
+// setTemplate creates or replaces a notification template file with the
+// request body, once it parses.
+func (a *API) setTemplate(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("Error reading request body: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if err := validateTemplate(name, string(body)); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		util.WriteJSONResponse(w, map[string]string{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	a.configMtx.Lock()
+	defer a.configMtx.Unlock()
+	cfg, templates, err := a.getTemplates(userID)
+	if err != nil {
+		log.Errorf("Error getting templates: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, exists := templates[name]
+	templates[name] = string(body)
+	if err := a.setConfigField(userID, cfg, templateFilesKey, templates); err != nil {
+		log.Errorf("Error storing config: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (a *API) deleteTemplate(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	name := mux.Vars(r)["name"]
+
+	a.configMtx.Lock()
+	defer a.configMtx.Unlock()
+	cfg, templates, err := a.getTemplates(userID)
+	if err != nil {
+		log.Errorf("Error getting templates: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, ok := templates[name]; !ok {
+		http.Error(w, "No such template", http.StatusNotFound)
+		return
+	}
+	delete(templates, name)
+	if err := a.setConfigField(userID, cfg, templateFilesKey, templates); err != nil {
+		log.Errorf("Error storing config: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getTemplates returns the user's config, and the template files in it.
+func (a *API) getTemplates(userID string) (configs.Config, map[string]string, error) {
+	cfg, err := a.getUserConfig(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	templates, err := filesField(cfg, templateFilesKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, templates, nil
+}
+
+// validateTemplate checks that a template file's name can be written to
+// disk by the Alertmanager, and that it parses as both a text and an HTML
+// template, as the Alertmanager parses it as both.
+func validateTemplate(name, tmpl string) error {
+	if name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid template file name %q", name)
+	}
+	if _, err := tmpltext.New(name).Funcs(tmpltext.FuncMap(template.DefaultFuncs)).Parse(tmpl); err != nil {
+		return fmt.Errorf("error parsing template: %v", err)
+	}
+	if _, err := tmplhtml.New(name).Funcs(tmplhtml.FuncMap(template.DefaultFuncs)).Parse(tmpl); err != nil {
+		return fmt.Errorf("error parsing template: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex/configs/api"
+)
+
+func Test_AlertmanagerConfigFile(t *testing.T) {
+	setup(t)
+	defer cleanup(t)
+
+	userID := makeUserID()
+	const path = "/api/prom/configs/alertmanager/config"
+	setConfig := func(cfg string) int {
+		return requestAsUser(t, userID, "PUT", path, strings.NewReader(cfg)).Code
+	}
+
+	assert.Equal(t, http.StatusNotFound, requestAsUser(t, userID, "GET", path, nil).Code)
+	assert.Equal(t, http.StatusNotFound, requestAsUser(t, userID, "DELETE", path, nil).Code)
+
+	amConfig := "route:\n  receiver: noop\nreceivers:\n- name: noop\n"
+	assert.Equal(t, http.StatusCreated, setConfig(amConfig))
+	w := requestAsUser(t, userID, "GET", path, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, amConfig, w.Body.String())
+
+	// It's stored in the user's config, alongside their rules.
+	w = requestAsUser(t, userID, "GET", "/api/prom/configs/alertmanager", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, amConfig, parseConfigView(t, w.Body.Bytes()).Config["alertmanager_config"])
+
+	// Routes to undefined receivers, and unsupported receivers, are rejected
+	// and leave the config alone.
+	w = requestAsUser(t, userID, "PUT", path, strings.NewReader("route:\n  receiver: missing\nreceivers:\n- name: noop\n"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, parseJSON(t, w.Body.Bytes())["error"], `Undefined receiver "missing"`)
+	assert.Equal(t, http.StatusBadRequest, setConfig("route:\n  receiver: noop\nreceivers:\n- name: noop\n  email_configs:\n  - to: team@example.org\n"))
+	assert.Equal(t, http.StatusBadRequest, setConfig(""))
+	assert.Equal(t, amConfig, requestAsUser(t, userID, "GET", path, nil).Body.String())
+
+	updated := "route:\n  receiver: noop\n  group_by: [alertname]\nreceivers:\n- name: noop\n"
+	assert.Equal(t, http.StatusNoContent, setConfig(updated))
+	assert.Equal(t, updated, requestAsUser(t, userID, "GET", path, nil).Body.String())
+
+	// Other users' configs are separate.
+	assert.Equal(t, http.StatusNotFound, requestAsUser(t, makeUserID(), "GET", path, nil).Code)
+
+	assert.Equal(t, http.StatusNoContent, requestAsUser(t, userID, "DELETE", path, nil).Code)
+	assert.Equal(t, http.StatusNotFound, requestAsUser(t, userID, "GET", path, nil).Code)
+}
+
+func Test_AlertmanagerTemplates(t *testing.T) {
+	setup(t)
+	defer cleanup(t)
+
+	userID := makeUserID()
+	const path = "/api/prom/configs/alertmanager/templates"
+	listTemplates := func() map[string]string {
+		w := requestAsUser(t, userID, "GET", path, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		var view api.TemplatesView
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &view))
+		return view.Templates
+	}
+	setTemplate := func(name, tmpl string) int {
+		return requestAsUser(t, userID, "PUT", path+"/"+name, strings.NewReader(tmpl)).Code
+	}
+
+	assert.Empty(t, listTemplates())
+	assert.Equal(t, http.StatusNotFound, requestAsUser(t, userID, "GET", path+"/slack.tmpl", nil).Code)
+
+	slack := `{{ define "slack.title" }}{{ .CommonLabels.alertname | toUpper }}{{ end }}`
+	assert.Equal(t, http.StatusCreated, setTemplate("slack.tmpl", slack))
+	w := requestAsUser(t, userID, "GET", path+"/slack.tmpl", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, slack, w.Body.String())
+
+	// Templates are stored alongside the alertmanager config.
+	w = requestAsUser(t, userID, "GET", "/api/prom/configs/alertmanager", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	files := parseConfigView(t, w.Body.Bytes()).Config["template_files"].(map[string]interface{})
+	assert.Equal(t, slack, files["slack.tmpl"])
+
+	// Templates which don't parse, or use unknown functions, are rejected.
+	assert.Equal(t, http.StatusBadRequest, setTemplate("bad.tmpl", `{{ define "bad" }}`))
+	assert.Equal(t, http.StatusBadRequest, setTemplate("bad.tmpl", `{{ .Foo | nosuchfunc }}`))
+	assert.Equal(t, http.StatusBadRequest, setTemplate(".hidden", slack))
+
+	assert.Equal(t, http.StatusNoContent, setTemplate("slack.tmpl", `{{ define "slack.title" }}{{ .Status }}{{ end }}`))
+	assert.Equal(t, []string{"slack.tmpl"}, keys(listTemplates()))
+
+	assert.Equal(t, http.StatusNoContent, requestAsUser(t, userID, "DELETE", path+"/slack.tmpl", nil).Code)
+	assert.Equal(t, http.StatusNotFound, requestAsUser(t, userID, "DELETE", path+"/slack.tmpl", nil).Code)
+	assert.Empty(t, listTemplates())
+}
@@ -7,12 +7,15 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	amconfig "github.com/prometheus/alertmanager/config"
 
+	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/auth"
 	"github.com/weaveworks/cortex/configs"
 	"github.com/weaveworks/cortex/configs/db"
 	"github.com/weaveworks/cortex/util"
@@ -20,13 +23,21 @@ import (
 
 // API implements the configs api.
 type API struct {
-	db db.DB
+	db           db.DB
+	authenticate middleware.Interface
+	scopes       auth.ScopesConfig
 	http.Handler
+
+	// Serialises changes to rule groups and the alertmanager config, which
+	// read, modify and write the whole config.
+	configMtx sync.Mutex
 }
 
-// New creates a new API
-func New(database db.DB) *API {
-	a := &API{db: database}
+// New creates a new API.  Requests to tenants' configs are authenticated by
+// the given middleware, which injects their tenant into their context, and
+// their scopes checked as configured.
+func New(database db.DB, authenticate middleware.Interface, scopes auth.ScopesConfig) *API {
+	a := &API{db: database, authenticate: authenticate, scopes: scopes}
 	r := mux.NewRouter()
 	a.RegisterRoutes(r)
 	a.Handler = r
@@ -51,26 +62,42 @@ func (a *API) RegisterRoutes(r *mux.Router) {
 	for _, route := range []struct {
 		name, method, path string
 		handler            http.HandlerFunc
+		scope              auth.Scope
 	}{
-		{"root", "GET", "/", a.admin},
+		{"root", "GET", "/", a.admin, ""},
 		// Dedicated APIs for updating rules config. In the future, these *must*
 		// be used.
-		{"get_rules", "GET", "/api/prom/configs/rules", a.getConfig},
-		{"set_rules", "POST", "/api/prom/configs/rules", a.setConfig},
-		{"get_alertmanager_config", "GET", "/api/prom/configs/alertmanager", a.getConfig},
-		{"set_alertmanager_config", "POST", "/api/prom/configs/alertmanager", a.setConfig},
-		{"validate_alertmanager_config", "POST", "/api/prom/configs/alertmanager/validate", a.validateAlertmanagerConfig},
+		{"get_rules", "GET", "/api/prom/configs/rules", a.getConfig, auth.Read},
+		{"set_rules", "POST", "/api/prom/configs/rules", a.setConfig, auth.RulesAdmin},
+		{"list_rule_groups", "GET", "/api/prom/configs/rules/groups", a.listRuleGroups, auth.Read},
+		{"get_rule_group", "GET", "/api/prom/configs/rules/groups/{name}", a.getRuleGroup, auth.Read},
+		{"set_rule_group", "PUT", "/api/prom/configs/rules/groups/{name}", a.setRuleGroup, auth.RulesAdmin},
+		{"delete_rule_group", "DELETE", "/api/prom/configs/rules/groups/{name}", a.deleteRuleGroup, auth.RulesAdmin},
+		{"get_alertmanager_config", "GET", "/api/prom/configs/alertmanager", a.getConfig, auth.Read},
+		{"set_alertmanager_config", "POST", "/api/prom/configs/alertmanager", a.setConfig, auth.RulesAdmin},
+		{"validate_alertmanager_config", "POST", "/api/prom/configs/alertmanager/validate", a.validateAlertmanagerConfig, auth.Read},
+		{"get_alertmanager_config_file", "GET", "/api/prom/configs/alertmanager/config", a.getAlertmanagerConfigFile, auth.Read},
+		{"set_alertmanager_config_file", "PUT", "/api/prom/configs/alertmanager/config", a.setAlertmanagerConfigFile, auth.RulesAdmin},
+		{"delete_alertmanager_config_file", "DELETE", "/api/prom/configs/alertmanager/config", a.deleteAlertmanagerConfigFile, auth.RulesAdmin},
+		{"list_alertmanager_templates", "GET", "/api/prom/configs/alertmanager/templates", a.listTemplates, auth.Read},
+		{"get_alertmanager_template", "GET", "/api/prom/configs/alertmanager/templates/{name}", a.getTemplate, auth.Read},
+		{"set_alertmanager_template", "PUT", "/api/prom/configs/alertmanager/templates/{name}", a.setTemplate, auth.RulesAdmin},
+		{"delete_alertmanager_template", "DELETE", "/api/prom/configs/alertmanager/templates/{name}", a.deleteTemplate, auth.RulesAdmin},
 		// Internal APIs.
-		{"private_get_rules", "GET", "/private/api/prom/configs/rules", a.getConfigs},
-		{"private_get_alertmanager_config", "GET", "/private/api/prom/configs/alertmanager", a.getConfigs},
+		{"private_get_rules", "GET", "/private/api/prom/configs/rules", a.getConfigs, ""},
+		{"private_get_alertmanager_config", "GET", "/private/api/prom/configs/alertmanager", a.getConfigs, ""},
 	} {
-		r.Handle(route.path, route.handler).Methods(route.method).Name(route.name)
+		var handler http.Handler = route.handler
+		if route.scope != "" {
+			handler = middleware.Merge(a.authenticate, a.scopes.Require(route.scope)).Wrap(handler)
+		}
+		r.Handle(route.path, handler).Methods(route.method).Name(route.name)
 	}
 }
 
 // getConfig returns the request configuration.
 func (a *API) getConfig(w http.ResponseWriter, r *http.Request) {
-	userID, _, err := user.ExtractFromHTTPRequest(r)
+	userID, err := user.Extract(r.Context())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -97,7 +124,7 @@ func (a *API) getConfig(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *API) setConfig(w http.ResponseWriter, r *http.Request) {
-	userID, _, err := user.ExtractFromHTTPRequest(r)
+	userID, err := user.Extract(r.Context())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
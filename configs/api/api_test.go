@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/weaveworks/cortex/auth"
 	"github.com/weaveworks/cortex/configs"
 	"github.com/weaveworks/cortex/configs/api"
 )
@@ -67,6 +69,43 @@ func Test_GetConfig_Anonymous(t *testing.T) {
 	}
 }
 
+// configs returns 400 to requests from tenants which aren't allowed.
+func Test_GetConfig_InvalidTenant(t *testing.T) {
+	setup(t)
+	defer cleanup(t)
+
+	for _, c := range allClients {
+		for _, userID := range []string{"reserved", "user/1"} {
+			w := requestAsUser(t, userID, "GET", c.Endpoint, nil)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+// configs takes the tenant from the configured org ID header only.
+func Test_GetConfig_OrgIDHeader(t *testing.T) {
+	setup(t)
+	defer cleanup(t)
+
+	authenticate, err := auth.Config{OrgIDHeaderName: "X-Tenant"}.Authenticate()
+	require.NoError(t, err)
+	app := api.New(database, authenticate, auth.ScopesConfig{})
+
+	for _, c := range allClients {
+		for header, code := range map[string]int{
+			auth.DefaultOrgIDHeaderName: http.StatusUnauthorized,
+			"X-Tenant":                  http.StatusNotFound,
+		} {
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("GET", c.Endpoint, nil)
+			require.NoError(t, err)
+			r.Header.Set(header, makeUserID())
+			app.ServeHTTP(w, r)
+			assert.Equal(t, code, w.Code, header)
+		}
+	}
+}
+
 // configs returns 404 if no config has been created yet.
 func Test_GetConfig_NotFound(t *testing.T) {
 	setup(t)
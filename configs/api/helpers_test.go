@@ -12,6 +12,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/auth"
 	"github.com/weaveworks/cortex/configs"
 	"github.com/weaveworks/cortex/configs/api"
 	"github.com/weaveworks/cortex/configs/db"
@@ -27,7 +28,11 @@ var (
 // setup sets up the environment for the tests.
 func setup(t *testing.T) {
 	database = dbtest.Setup(t)
-	app = api.New(database)
+	authenticate, err := auth.Config{
+		TenantID: auth.TenantIDConfig{AllowedCharacters: "-_", Reserved: "reserved"},
+	}.Authenticate()
+	require.NoError(t, err)
+	app = api.New(database, authenticate, auth.ScopesConfig{})
 	counter = 0
 }
 
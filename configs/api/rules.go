@@ -0,0 +1,269 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/configs"
+	"github.com/weaveworks/cortex/util"
+)
+
+// rulesFilesKey is the field of a config holding its rules files, which
+// map a file name to its contents.  Each file is a rule group.
+const rulesFilesKey = "rules_files"
+
+// RuleGroupsView is the response to listing a user's rule groups, mapping
+// each group's name to its rules, in the Prometheus rule file format.
+type RuleGroupsView struct {
+	Groups map[string]string `json:"groups"`
+}
+
+func (a *API) listRuleGroups(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	_, groups, err := a.getRuleGroups(userID)
+	if err != nil {
+		log.Errorf("Error getting rule groups: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	util.WriteJSONResponse(w, RuleGroupsView{Groups: groups})
+}
+
+func (a *API) getRuleGroup(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	_, groups, err := a.getRuleGroups(userID)
+	if err != nil {
+		log.Errorf("Error getting rule groups: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	group, ok := groups[mux.Vars(r)["name"]]
+	if !ok {
+		http.Error(w, "No such rule group", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, group)
+}
+
+// setRuleGroup creates or replaces a rule group with the request body, once
+// it's validated.
+func (a *API) setRuleGroup(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("Error reading request body: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := mux.Vars(r)["name"]
+
+	a.configMtx.Lock()
+	defer a.configMtx.Unlock()
+	cfg, groups, err := a.getRuleGroups(userID)
+	if err != nil {
+		log.Errorf("Error getting rule groups: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := validateRuleGroup(name, string(body), groups); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		util.WriteJSONResponse(w, map[string]string{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	_, exists := groups[name]
+	groups[name] = string(body)
+	if err := a.setRuleGroups(userID, cfg, groups); err != nil {
+		log.Errorf("Error storing config: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (a *API) deleteRuleGroup(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	name := mux.Vars(r)["name"]
+
+	a.configMtx.Lock()
+	defer a.configMtx.Unlock()
+	cfg, groups, err := a.getRuleGroups(userID)
+	if err != nil {
+		log.Errorf("Error getting rule groups: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, ok := groups[name]; !ok {
+		http.Error(w, "No such rule group", http.StatusNotFound)
+		return
+	}
+	delete(groups, name)
+	if err := a.setRuleGroups(userID, cfg, groups); err != nil {
+		log.Errorf("Error storing config: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getRuleGroups returns the user's config, and the rule groups in it.
+func (a *API) getRuleGroups(userID string) (configs.Config, map[string]string, error) {
+	cfg, err := a.getUserConfig(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	groups, err := filesField(cfg, rulesFilesKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, groups, nil
+}
+
+// setRuleGroups stores the user's config with the given rule groups,
+// leaving its other fields alone.
+func (a *API) setRuleGroups(userID string, cfg configs.Config, groups map[string]string) error {
+	return a.setConfigField(userID, cfg, rulesFilesKey, groups)
+}
+
+// filesField returns a field of a config mapping file names to contents.
+func filesField(cfg configs.Config, key string) (map[string]string, error) {
+	files := map[string]string{}
+	if field, ok := cfg[key]; ok {
+		// The files are a map[string]interface{} when the config comes
+		// from JSON, so convert them the same way.
+		buf, err := json.Marshal(field)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(buf, &files); err != nil {
+			return nil, fmt.Errorf("invalid %s in config: %v", key, err)
+		}
+	}
+	return files, nil
+}
+
+// getUserConfig returns the user's config, which is empty if they have none.
+func (a *API) getUserConfig(userID string) (configs.Config, error) {
+	view, err := a.db.GetConfig(userID)
+	if err == sql.ErrNoRows {
+		return configs.Config{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return view.Config, nil
+}
+
+// setConfigField stores the user's config with one field set to value, or
+// removed if value is nil, leaving its other fields alone.
+func (a *API) setConfigField(userID string, cfg configs.Config, key string, value interface{}) error {
+	updated := make(configs.Config, len(cfg)+1)
+	for k, v := range cfg {
+		updated[k] = v
+	}
+	if value == nil {
+		delete(updated, key)
+	} else {
+		updated[key] = value
+	}
+	return a.db.SetConfig(userID, updated)
+}
+
+// validateRuleGroup checks that rules parse, and that none of their names
+// are used more than once, in the group or in the user's other groups.
+func validateRuleGroup(name, rules string, groups map[string]string) error {
+	names, err := ruleNames(rules)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("rule group has no rules")
+	}
+	for i := 1; i < len(names); i++ {
+		if names[i] == names[i-1] {
+			return fmt.Errorf("rule %q is defined more than once", names[i])
+		}
+	}
+
+	others := make([]string, 0, len(groups))
+	for other := range groups {
+		if other != name {
+			others = append(others, other)
+		}
+	}
+	sort.Strings(others)
+	seen := map[string]string{}
+	for _, other := range others {
+		otherNames, err := ruleNames(groups[other])
+		if err != nil {
+			// It'd have been rejected now; it can't clash with anything.
+			continue
+		}
+		for _, n := range otherNames {
+			seen[n] = other
+		}
+	}
+	for _, n := range names {
+		if other, ok := seen[n]; ok {
+			return fmt.Errorf("rule %q is already defined in rule group %q", n, other)
+		}
+	}
+	return nil
+}
+
+// ruleNames parses rules in the Prometheus rule file format, and returns
+// the sorted names of the alerting and recording rules.
+func ruleNames(rules string) ([]string, error) {
+	stmts, err := promql.ParseStmts(rules)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing rules: %v", err)
+	}
+	names := make([]string, 0, len(stmts))
+	for _, stmt := range stmts {
+		switch r := stmt.(type) {
+		case *promql.AlertStmt:
+			names = append(names, r.Name)
+		case *promql.RecordStmt:
+			names = append(names, r.Name)
+		default:
+			return nil, fmt.Errorf("unknown statement type %T", stmt)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,72 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex/configs/api"
+)
+
+func Test_RuleGroups(t *testing.T) {
+	setup(t)
+	defer cleanup(t)
+
+	userID := makeUserID()
+	listGroups := func() map[string]string {
+		w := requestAsUser(t, userID, "GET", "/api/prom/configs/rules/groups", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		var view api.RuleGroupsView
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &view))
+		return view.Groups
+	}
+	setGroup := func(name, rules string) int {
+		return requestAsUser(t, userID, "PUT", "/api/prom/configs/rules/groups/"+name, strings.NewReader(rules)).Code
+	}
+
+	assert.Empty(t, listGroups())
+	assert.Equal(t, http.StatusNotFound, requestAsUser(t, userID, "GET", "/api/prom/configs/rules/groups/jobs", nil).Code)
+
+	jobs := "job:up:sum = sum(up) by (job)\n"
+	assert.Equal(t, http.StatusCreated, setGroup("jobs", jobs))
+	assert.Equal(t, http.StatusCreated, setGroup("alerts", "ALERT Down IF up == 0\n"))
+	assert.Equal(t, map[string]string{"jobs": jobs, "alerts": "ALERT Down IF up == 0\n"}, listGroups())
+
+	w := requestAsUser(t, userID, "GET", "/api/prom/configs/rules/groups/jobs", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, jobs, w.Body.String())
+
+	// Groups are stored as the config's rules files.
+	w = requestAsUser(t, userID, "GET", "/api/prom/configs/rules", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	files := parseConfigView(t, w.Body.Bytes()).Config["rules_files"].(map[string]interface{})
+	assert.Equal(t, jobs, files["jobs"])
+
+	// Invalid PromQL and reused rule names are rejected.
+	assert.Equal(t, http.StatusBadRequest, setGroup("bad", "job:up:sum = sum(up"))
+	assert.Equal(t, http.StatusBadRequest, setGroup("jobs2", jobs))
+	assert.Equal(t, http.StatusBadRequest, setGroup("twice", "a = up\na = up\n"))
+	// But a group can be replaced with rules of the same names.
+	assert.Equal(t, http.StatusNoContent, setGroup("jobs", "job:up:sum = sum(up) by (job, instance)\n"))
+
+	assert.Equal(t, http.StatusNoContent, requestAsUser(t, userID, "DELETE", "/api/prom/configs/rules/groups/alerts", nil).Code)
+	assert.Equal(t, http.StatusNotFound, requestAsUser(t, userID, "DELETE", "/api/prom/configs/rules/groups/alerts", nil).Code)
+	assert.Equal(t, []string{"jobs"}, keys(listGroups()))
+
+	// Other users' groups are separate.
+	other := makeUserID()
+	w = requestAsUser(t, other, "GET", "/api/prom/configs/rules/groups", nil)
+	assert.Equal(t, `{"groups":{}}`, strings.TrimSpace(w.Body.String()))
+}
+
+func keys(m map[string]string) []string {
+	ks := []string{}
+	for k := range m {
+		ks = append(ks, k)
+	}
+	return ks
+}
@@ -9,9 +9,10 @@ import (
 	"time"
 
 	"github.com/prometheus/alertmanager/config"
-	"github.com/prometheus/common/log"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/rules"
+
+	"github.com/weaveworks/cortex/util/log"
 )
 
 // TODO: Extract configs client logic into go client library (ala users)
@@ -24,6 +25,9 @@ type CortexConfig struct {
 	// RulesFiles maps from a rules filename to file contents.
 	RulesFiles         map[string]string `json:"rules_files"`
 	AlertmanagerConfig string            `json:"alertmanager_config"`
+	// TemplateFiles maps from a notification template filename to file
+	// contents.
+	TemplateFiles map[string]string `json:"template_files,omitempty"`
 }
 
 // CortexConfigView is what's returned from the Weave Cloud configs service
@@ -68,6 +72,12 @@ func (c CortexConfigsResponse) GetLatestConfigID() ConfigID {
 //
 // Strongly inspired by `loadGroups` in Prometheus.
 func (c CortexConfig) GetRules() ([]rules.Rule, error) {
+	return c.GetMappedRules(nil)
+}
+
+// GetMappedRules gets the rules from the Cortex configuration, with each
+// rule's expression replaced by mapExpr's result, if mapExpr isn't nil.
+func (c CortexConfig) GetMappedRules(mapExpr func(promql.Expr) promql.Expr) ([]rules.Rule, error) {
 	result := []rules.Rule{}
 	for fn, content := range c.RulesFiles {
 		stmts, err := promql.ParseStmts(content)
@@ -80,9 +90,15 @@ func (c CortexConfig) GetRules() ([]rules.Rule, error) {
 
 			switch r := stmt.(type) {
 			case *promql.AlertStmt:
+				if mapExpr != nil {
+					r.Expr = mapExpr(r.Expr)
+				}
 				rule = rules.NewAlertingRule(r.Name, r.Expr, r.Duration, r.Labels, r.Annotations)
 
 			case *promql.RecordStmt:
+				if mapExpr != nil {
+					r.Expr = mapExpr(r.Expr)
+				}
 				rule = rules.NewRecordingRule(r.Name, r.Expr, r.Labels)
 
 			default:
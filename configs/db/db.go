@@ -18,14 +18,17 @@ type Config struct {
 
 // RegisterFlags adds the flags required to configure this to the given FlagSet.
 func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
-	flag.StringVar(&cfg.URI, "database.uri", "postgres://postgres@configs-db.weave.local/configs?sslmode=disable", "URI where the database can be found (for dev you can use memory://)")
-	flag.StringVar(&cfg.MigrationsDir, "database.migrations", "", "Path where the database migration files can be found")
+	f.StringVar(&cfg.URI, "database.uri", "postgres://postgres@configs-db.weave.local/configs?sslmode=disable", "URI where the database can be found (for dev you can use memory://)")
+	f.StringVar(&cfg.MigrationsDir, "database.migrations", "", "Path where the database migration files can be found")
 }
 
 // DB is the interface for the database.
 type DB interface {
 	GetConfig(userID string) (configs.ConfigView, error)
 	SetConfig(userID string, cfg configs.Config) error
+	// DeleteConfig deletes every version of the user's config, leaving an
+	// empty one, so those polling for changes see the deletion.
+	DeleteConfig(userID string) error
 
 	GetAllConfigs() (map[string]configs.ConfigView, error)
 	GetConfigs(since configs.ID) (map[string]configs.ConfigView, error)
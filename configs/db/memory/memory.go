@@ -2,6 +2,7 @@ package memory
 
 import (
 	"database/sql"
+	"sync"
 
 	"github.com/weaveworks/cortex/configs"
 )
@@ -20,6 +21,7 @@ func (c config) toView() configs.ConfigView {
 
 // DB is an in-memory database for testing, and local development
 type DB struct {
+	mtx  sync.RWMutex
 	cfgs map[string]config
 	id   uint
 }
@@ -34,6 +36,8 @@ func New(_, _ string) (*DB, error) {
 
 // GetConfig gets the user's configuration.
 func (d *DB) GetConfig(userID string) (configs.ConfigView, error) {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
 	c, ok := d.cfgs[userID]
 	if !ok {
 		return configs.ConfigView{}, sql.ErrNoRows
@@ -41,15 +45,26 @@ func (d *DB) GetConfig(userID string) (configs.ConfigView, error) {
 	return c.toView(), nil
 }
 
-// SetConfig sets configuration for a user.
+// SetConfig sets configuration for a user.  Like postgres, IDs start at 1,
+// so polling for configs since 0 returns them all.
 func (d *DB) SetConfig(userID string, cfg configs.Config) error {
-	d.cfgs[userID] = config{cfg: cfg, id: configs.ID(d.id)}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
 	d.id++
+	d.cfgs[userID] = config{cfg: cfg, id: configs.ID(d.id)}
 	return nil
 }
 
+// DeleteConfig replaces the user's config with an empty one, as only the
+// latest version is kept.
+func (d *DB) DeleteConfig(userID string) error {
+	return d.SetConfig(userID, configs.Config{})
+}
+
 // GetAllConfigs gets all of the configs.
 func (d *DB) GetAllConfigs() (map[string]configs.ConfigView, error) {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
 	cfgs := map[string]configs.ConfigView{}
 	for user, c := range d.cfgs {
 		cfgs[user] = c.toView()
@@ -59,6 +74,8 @@ func (d *DB) GetAllConfigs() (map[string]configs.ConfigView, error) {
 
 // GetConfigs gets all of the configs that have changed recently.
 func (d *DB) GetConfigs(since configs.ID) (map[string]configs.ConfigView, error) {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
 	cfgs := map[string]configs.ConfigView{}
 	for user, c := range d.cfgs {
 		if c.id > since {
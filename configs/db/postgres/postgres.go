@@ -120,6 +120,23 @@ func (d DB) SetConfig(userID string, cfg configs.Config) error {
 	return err
 }
 
+// DeleteConfig deletes every version of the user's config, rather than
+// marking them deleted, and then sets an empty config.
+func (d DB) DeleteConfig(userID string) error {
+	return d.Transaction(func(tx DB) error {
+		if _, err := tx.Delete("configs").
+			Where(squirrel.Eq{
+				"owner_id":   userID,
+				"owner_type": entityType,
+				"subsystem":  subsystem,
+			}).
+			Exec(); err != nil {
+			return err
+		}
+		return tx.SetConfig(userID, configs.Config{})
+	})
+}
+
 // GetAllConfigs gets all of the configs.
 func (d DB) GetAllConfigs() (map[string]configs.ConfigView, error) {
 	return d.findConfigs(activeConfig)
@@ -152,7 +169,7 @@ func (d DB) Transaction(f func(DB) error) error {
 	if err != nil {
 		// Rollback error is ignored as we already have one in progress
 		if err2 := tx.Rollback(); err2 != nil {
-			logrus.Warn("transaction rollback: %v (ignored)", err2)
+			logrus.Warnf("transaction rollback: %v (ignored)", err2)
 		}
 		return err
 	}
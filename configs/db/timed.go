@@ -52,6 +52,12 @@ func (t timed) SetConfig(userID string, cfg configs.Config) (err error) {
 	})
 }
 
+func (t timed) DeleteConfig(userID string) (err error) {
+	return t.timeRequest("DeleteConfig", func(_ context.Context) error {
+		return t.d.DeleteConfig(userID)
+	})
+}
+
 func (t timed) GetAllConfigs() (cfgs map[string]configs.ConfigView, err error) {
 	t.timeRequest("GetAllConfigs", func(_ context.Context) error {
 		cfgs, err = t.d.GetAllConfigs()
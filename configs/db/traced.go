@@ -24,6 +24,11 @@ func (t traced) SetConfig(userID string, cfg configs.Config) (err error) {
 	return t.d.SetConfig(userID, cfg)
 }
 
+func (t traced) DeleteConfig(userID string) (err error) {
+	defer func() { t.trace("DeleteConfig", userID, err) }()
+	return t.d.DeleteConfig(userID)
+}
+
 func (t traced) GetAllConfigs() (cfgs map[string]configs.ConfigView, err error) {
 	defer func() { t.trace("GetAllConfigs", cfgs, err) }()
 	return t.d.GetAllConfigs()
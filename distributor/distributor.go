@@ -1,11 +1,13 @@
 package distributor
 
 import (
-	"errors"
+	"bytes"
 	"flag"
 	"fmt"
 	"hash/fnv"
 	"io"
+	"os"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,7 +16,6 @@ import (
 	"golang.org/x/time/rate"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/metric"
 
@@ -22,11 +23,48 @@ import (
 	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex"
 	ingester_client "github.com/weaveworks/cortex/ingester/client"
+	"github.com/weaveworks/cortex/limits"
+	"github.com/weaveworks/cortex/remotewrite"
 	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/usage"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
-var errIngestionRateLimitExceeded = errors.New("ingestion rate limit exceeded")
+// ingestionRateLimitError is returned when a push would take a user over
+// their ingestion rate limit.  It carries the limits that were applied so
+// they can be reported back to the client.
+type ingestionRateLimitError struct {
+	Limit   float64
+	Burst   int
+	Samples int
+}
+
+func (e ingestionRateLimitError) Error() string {
+	return fmt.Sprintf("ingestion rate limit (%v samples/s, burst %d) exceeded while adding %d samples", e.Limit, e.Burst, e.Samples)
+}
+
+// tooManySamplesError is returned when a push has more samples than the
+// user's limit for a single request.
+type tooManySamplesError struct {
+	Limit   int
+	Samples int
+}
+
+func (e tooManySamplesError) Error() string {
+	return fmt.Sprintf("push of %d samples exceeds the limit of %d samples per request", e.Samples, e.Limit)
+}
+
+// validationError is returned when samples of a push fail validation.  It
+// carries the first failure; the push's valid samples are still ingested.
+type validationError struct {
+	err    error
+	metric model.Metric
+}
+
+func (e validationError) Error() string {
+	return fmt.Sprintf("%v for series %s", e.err, e.metric)
+}
 
 var (
 	numClientsDesc = prometheus.NewDesc(
@@ -42,17 +80,24 @@ var (
 type Distributor struct {
 	cfg        Config
 	ring       ReadRing
+	consul     ring.ConsulClient  // Only set for the global ingestion rate strategy.
+	haTracker  *haTracker         // Only set if the HA tracker is enabled.
+	mirror     *remotewrite.Queue // Only set if writes are mirrored.
+	limits     *limits.Overrides
 	clientsMtx sync.RWMutex
 	clients    map[string]cortex.IngesterClient
 	quit       chan struct{}
 	done       chan struct{}
 
-	// Per-user rate limiters.
-	ingestLimitersMtx sync.Mutex
-	ingestLimiters    map[string]*rate.Limiter
+	// Per-user rate limiters, and the number of distributors sharing them.
+	ingestLimitersMtx   sync.Mutex
+	ingestLimiters      map[string]*rate.Limiter
+	healthyDistributors int
 
 	queryDuration          *prometheus.HistogramVec
 	receivedSamples        prometheus.Counter
+	rateLimitedSamples     *prometheus.CounterVec
+	oversizedRequests      *prometheus.CounterVec
 	sendDuration           *prometheus.HistogramVec
 	ingesterAppends        *prometheus.CounterVec
 	ingesterAppendFailures *prometheus.CounterVec
@@ -67,6 +112,8 @@ type ReadRing interface {
 	Get(key uint32, n int, op ring.Operation) ([]*ring.IngesterDesc, error)
 	BatchGet(keys []uint32, n int, op ring.Operation) ([][]*ring.IngesterDesc, error)
 	GetAll() []*ring.IngesterDesc
+	ShuffleShard(identifier string, size int) ring.ReadRing
+	ShuffleShardWithLookback(identifier string, size int, lookback time.Duration) (ring.ReadRing, bool)
 }
 
 // Config contains the configuration require to
@@ -76,8 +123,34 @@ type Config struct {
 	HeartbeatTimeout    time.Duration
 	RemoteTimeout       time.Duration
 	ClientCleanupPeriod time.Duration
-	IngestionRateLimit  float64
-	IngestionBurstSize  int
+
+	// Config for the global ingestion rate strategy; distributors heartbeat
+	// into consul so they can share the rate limit between them.
+	IngestionRateStrategy string
+	HeartbeatPeriod       time.Duration
+	ConsulConfig          *ring.ConsulConfig
+	ID                    string // Defaults to the hostname.
+
+	HATrackerConfig HATrackerConfig
+
+	// Shard series by all their labels rather than just the metric name, so
+	// a single large metric is spread over many ingesters.  Queries then
+	// have to be sent to all ingesters.
+	ShardByAllLabels bool
+
+	// How long after a user's shuffle shard changes queries also go to the
+	// ingesters which were in it, which may still have its series in memory.
+	ShuffleShardingLookback time.Duration
+
+	// The maximum size of a push request's body, after decompression.
+	MaxRecvMsgSize int
+
+	// If its URL is set, accepted writes are also sent to this remote write
+	// endpoint, e.g. another Cortex cluster's, for migrations and disaster
+	// recovery.  Series are dropped if it falls behind.
+	Mirror remotewrite.Config
+
+	IngesterClientConfig ingester_client.Config
 
 	// for testing
 	ingesterClientFactory func(addr string, timeout time.Duration) (cortex.IngesterClient, error)
@@ -85,30 +158,91 @@ type Config struct {
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
-	flag.IntVar(&cfg.ReplicationFactor, "distributor.replication-factor", 3, "The number of ingesters to write to and read from.")
-	flag.DurationVar(&cfg.HeartbeatTimeout, "distributor.heartbeat-timeout", time.Minute, "The heartbeat timeout after which ingesters are skipped for reads/writes.")
-	flag.DurationVar(&cfg.RemoteTimeout, "distributor.remote-timeout", 2*time.Second, "Timeout for downstream ingesters.")
-	flag.DurationVar(&cfg.ClientCleanupPeriod, "distributor.client-cleanup-period", 15*time.Second, "How frequently to clean up clients for ingesters that have gone away.")
-	flag.Float64Var(&cfg.IngestionRateLimit, "distributor.ingestion-rate-limit", 25000, "Per-user ingestion rate limit in samples per second.")
-	flag.IntVar(&cfg.IngestionBurstSize, "distributor.ingestion-burst-size", 50000, "Per-user allowed ingestion burst size (in number of samples).")
+	f.IntVar(&cfg.ReplicationFactor, "distributor.replication-factor", 3, "The number of ingesters to write to and read from.")
+	f.DurationVar(&cfg.HeartbeatTimeout, "distributor.heartbeat-timeout", time.Minute, "The heartbeat timeout after which ingesters are skipped for reads/writes.")
+	f.DurationVar(&cfg.RemoteTimeout, "distributor.remote-timeout", 2*time.Second, "Timeout for downstream ingesters.")
+	f.DurationVar(&cfg.ClientCleanupPeriod, "distributor.client-cleanup-period", 15*time.Second, "How frequently to clean up clients for ingesters that have gone away.")
+	f.StringVar(&cfg.IngestionRateStrategy, "distributor.ingestion-rate-strategy", localIngestionRateStrategy, "Whether the ingestion rate limit applies to each distributor (local), or is shared between all healthy distributors (global).")
+	f.DurationVar(&cfg.HeartbeatPeriod, "distributor.heartbeat-period", 5*time.Second, "Period at which to heartbeat to consul when using the global ingestion rate strategy.")
+	f.BoolVar(&cfg.ShardByAllLabels, "distributor.shard-by-all-labels", false, "Distribute samples based on all labels, as opposed to solely by user and metric name.")
+	f.DurationVar(&cfg.ShuffleShardingLookback, "distributor.shuffle-sharding-lookback", 12*time.Hour, "How long after the ingesters of a user's shuffle shard change to also query those which were in it. Should be at least -ingester.max-chunk-age.")
+	f.IntVar(&cfg.MaxRecvMsgSize, "distributor.max-recv-msg-size", 100<<20, "Maximum size in bytes of a push request's body, after decompression. 0 to disable.")
+	cfg.HATrackerConfig.RegisterFlags(f)
+	cfg.IngesterClientConfig.RegisterFlags(f)
+	cfg.Mirror.RegisterFlagsWithPrefix("distributor.mirror.", f)
+	f.StringVar(&cfg.ID, "distributor.id", "", "ID to register into consul when using the global ingestion rate strategy. Defaults to the hostname.")
 }
 
 // New constructs a new Distributor
-func New(cfg Config, ring ReadRing) (*Distributor, error) {
+func New(cfg Config, r ReadRing, overrides *limits.Overrides) (*Distributor, error) {
+	if cfg.IngestionRateStrategy == "" {
+		cfg.IngestionRateStrategy = localIngestionRateStrategy
+	}
+	if cfg.HeartbeatPeriod == 0 {
+		cfg.HeartbeatPeriod = 5 * time.Second
+	}
+	var consul ring.ConsulClient
+	switch cfg.IngestionRateStrategy {
+	case localIngestionRateStrategy:
+	case globalIngestionRateStrategy:
+		if cfg.ConsulConfig == nil {
+			return nil, fmt.Errorf("the %s ingestion rate strategy requires consul", globalIngestionRateStrategy)
+		}
+		var err error
+		if cfg.ID == "" {
+			if cfg.ID, err = os.Hostname(); err != nil {
+				return nil, fmt.Errorf("failed to get hostname: %v", err)
+			}
+		}
+		consul, err = ring.NewConsulClient(*cfg.ConsulConfig, ring.ProtoCodec{Factory: distributorsDescFactory})
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown ingestion rate strategy: %q", cfg.IngestionRateStrategy)
+	}
 	if 0 > cfg.ReplicationFactor {
 		return nil, fmt.Errorf("ReplicationFactor must be greater than zero: %d", cfg.ReplicationFactor)
 	}
 	if cfg.ingesterClientFactory == nil {
-		cfg.ingesterClientFactory = ingester_client.MakeIngesterClient
+		clientConfig := cfg.IngesterClientConfig
+		if _, err := clientConfig.DialOptions(); err != nil {
+			return nil, err
+		}
+		cfg.ingesterClientFactory = func(addr string, timeout time.Duration) (cortex.IngesterClient, error) {
+			return ingester_client.MakeIngesterClient(addr, timeout, clientConfig)
+		}
+	}
+	var tracker *haTracker
+	if cfg.HATrackerConfig.EnableHATracker {
+		var err error
+		tracker, err = newHATracker(cfg.HATrackerConfig, cfg.ConsulConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var mirror *remotewrite.Queue
+	if cfg.Mirror.URL.URL != nil {
+		var err error
+		mirror, err = remotewrite.NewQueue("mirror", cfg.Mirror)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	d := &Distributor{
-		cfg:            cfg,
-		ring:           ring,
-		clients:        map[string]cortex.IngesterClient{},
-		quit:           make(chan struct{}),
-		done:           make(chan struct{}),
-		ingestLimiters: map[string]*rate.Limiter{},
+		cfg:                 cfg,
+		ring:                r,
+		limits:              overrides,
+		consul:              consul,
+		haTracker:           tracker,
+		mirror:              mirror,
+		clients:             map[string]cortex.IngesterClient{},
+		quit:                make(chan struct{}),
+		done:                make(chan struct{}),
+		ingestLimiters:      map[string]*rate.Limiter{},
+		healthyDistributors: 1,
 		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: "cortex",
 			Name:      "distributor_query_duration_seconds",
@@ -120,6 +254,16 @@ func New(cfg Config, ring ReadRing) (*Distributor, error) {
 			Name:      "distributor_received_samples_total",
 			Help:      "The total number of received samples.",
 		}),
+		rateLimitedSamples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_rate_limited_samples_total",
+			Help:      "The total number of samples rejected by the per-user ingestion rate limit.",
+		}, []string{"user"}),
+		oversizedRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_oversized_requests_total",
+			Help:      "The total number of push requests rejected for having too large a body or too many samples.",
+		}, []string{"user", "reason"}),
 		sendDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: "cortex",
 			Name:      "distributor_send_duration_seconds",
@@ -154,11 +298,26 @@ func New(cfg Config, ring ReadRing) (*Distributor, error) {
 // Run starts the distributor's maintenance loop.
 func (d *Distributor) Run() {
 	cleanupClients := time.NewTicker(d.cfg.ClientCleanupPeriod)
+	defer cleanupClients.Stop()
+
+	var heartbeat <-chan time.Time
+	if d.consul != nil {
+		heartbeatTicker := time.NewTicker(d.cfg.HeartbeatPeriod)
+		defer heartbeatTicker.Stop()
+		heartbeat = heartbeatTicker.C
+		d.heartbeat()
+	}
+
 	for {
 		select {
 		case <-cleanupClients.C:
 			d.removeStaleIngesterClients()
+		case <-heartbeat:
+			d.heartbeat()
 		case <-d.quit:
+			if d.consul != nil {
+				d.unregister()
+			}
 			close(d.done)
 			return
 		}
@@ -169,6 +328,12 @@ func (d *Distributor) Run() {
 func (d *Distributor) Stop() {
 	close(d.quit)
 	<-d.done
+	if d.haTracker != nil {
+		d.haTracker.stop()
+	}
+	if d.mirror != nil {
+		d.mirror.Stop()
+	}
 }
 
 func (d *Distributor) removeStaleIngesterClients() {
@@ -220,7 +385,46 @@ func (d *Distributor) getClientFor(ingester *ring.IngesterDesc) (cortex.Ingester
 	return client, nil
 }
 
-func tokenForLabels(userID string, labels []cortex.LabelPair) (uint32, error) {
+// ringFor returns the user's shuffle shard of the ring.
+func (d *Distributor) ringFor(userID string) ring.ReadRing {
+	size := d.shardSize(userID)
+	if size <= 0 {
+		return d.ring
+	}
+	return d.ring.ShuffleShard(userID, size)
+}
+
+// queryRingFor returns the ingesters which may have the user's series, and
+// whether it's more than their current shuffle shard, in which case all of
+// them have to be queried.
+func (d *Distributor) queryRingFor(userID string) (ring.ReadRing, bool) {
+	size := d.shardSize(userID)
+	if size <= 0 {
+		return d.ring, false
+	}
+	return d.ring.ShuffleShardWithLookback(userID, size, d.cfg.ShuffleShardingLookback)
+}
+
+// shardSize returns the number of ingesters the user's series are spread
+// over, 0 for all of them: the smaller of their shard size and maximum
+// ingesters, but never smaller than the replication factor.  As shards are
+// picked by rendezvous hashing, capping the size keeps the user's series on
+// a subset of their uncapped shard.
+func (d *Distributor) shardSize(userID string) int {
+	size := d.limits.IngestionTenantShardSize(userID)
+	if max := d.limits.MaxIngestersPerUser(userID); max > 0 && (size <= 0 || max < size) {
+		size = max
+	}
+	if size > 0 && size < d.cfg.ReplicationFactor {
+		size = d.cfg.ReplicationFactor
+	}
+	return size
+}
+
+func (d *Distributor) tokenForLabels(userID string, labels []cortex.LabelPair) (uint32, error) {
+	if d.cfg.ShardByAllLabels {
+		return shardByAllLabels(userID, labels)
+	}
 	for _, label := range labels {
 		if label.Name.Equal(labelNameBytes) {
 			return tokenFor(userID, label.Value), nil
@@ -229,6 +433,33 @@ func tokenForLabels(userID string, labels []cortex.LabelPair) (uint32, error) {
 	return 0, fmt.Errorf("No metric name label")
 }
 
+// shardByAllLabels hashes the user and all the label pairs, in name order so
+// the token doesn't depend on the order the client sent them in.
+func shardByAllLabels(userID string, labels []cortex.LabelPair) (uint32, error) {
+	sorted := make([]cortex.LabelPair, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Name, sorted[j].Name) < 0
+	})
+
+	h := fnv.New32()
+	h.Write([]byte(userID))
+	hasName := false
+	for _, label := range sorted {
+		if label.Name.Equal(labelNameBytes) {
+			hasName = true
+		}
+		h.Write(label.Name)
+		h.Write([]byte{0})
+		h.Write(label.Value)
+		h.Write([]byte{0})
+	}
+	if !hasName {
+		return 0, fmt.Errorf("No metric name label")
+	}
+	return h.Sum32(), nil
+}
+
 func tokenFor(userID string, name []byte) uint32 {
 	h := fnv.New32()
 	h.Write([]byte(userID))
@@ -259,39 +490,109 @@ func (d *Distributor) Push(ctx context.Context, req *cortex.WriteRequest) (*cort
 		return nil, err
 	}
 
-	// First we flatten out the request into a list of samples.
-	// We use the heuristic of 1 sample per TS to size the array.
-	// We also work out the hash value at the same time.
+	if d.haTracker != nil && len(req.Timeseries) > 0 {
+		// Prometheus sends the same external labels on every series, so
+		// the first one identifies the sender.
+		cluster, replica := findHALabels(d.cfg.HATrackerConfig, req.Timeseries[0].Labels)
+		if cluster != "" && replica != "" {
+			if err := d.haTracker.checkReplica(ctx, userID, cluster, replica, time.Now()); err != nil {
+				if _, ok := err.(replicasNotMatchError); !ok {
+					return nil, err
+				}
+				numSamples := 0
+				for _, ts := range req.Timeseries {
+					numSamples += len(ts.Samples)
+				}
+				dedupedSamples.WithLabelValues(userID, cluster).Add(float64(numSamples))
+				return &cortex.WriteResponse{}, nil
+			}
+			removeReplicaLabel(d.cfg.HATrackerConfig, req.Timeseries)
+		}
+	}
+
+	if names := d.limits.DropLabels(userID); len(names) > 0 {
+		dropLabels(req.Timeseries, names)
+	}
+	if cfgs := d.limits.MetricRelabelConfigs(userID); len(cfgs) > 0 {
+		req.Timeseries = relabelTimeseries(userID, req.Timeseries, cfgs)
+	}
+	req.Timeseries = filterMetrics(userID, req.Timeseries, d.limits)
+
+	// First we flatten out the request into a list of samples, dropping
+	// invalid ones, and remembering the first failure to return once the
+	// valid ones are pushed.  We use the heuristic of 1 sample per TS to
+	// size the array.  We also work out the hash value at the same time.
 	samples := make([]sampleTracker, 0, len(req.Timeseries))
 	keys := make([]uint32, 0, len(req.Timeseries))
+	received := 0
+	validated := req.Timeseries[:0]
+	var validationErr error
 	for _, ts := range req.Timeseries {
-		key, err := tokenForLabels(userID, ts.Labels)
+		received += len(ts.Samples)
+		metric := util.FromLabelPairs(ts.Labels)
+		if err := d.limits.ValidateLabels(userID, metric, len(ts.Samples)); err != nil {
+			if validationErr == nil {
+				validationErr = validationError{err: err, metric: metric}
+			}
+			continue
+		}
+		key, err := d.tokenForLabels(userID, ts.Labels)
 		if err != nil {
 			return nil, err
 		}
+		valid := ts.Samples[:0]
 		for _, s := range ts.Samples {
+			if err := d.limits.ValidateTimestamp(userID, model.Time(s.TimestampMs), 1); err != nil {
+				if validationErr == nil {
+					validationErr = validationError{err: err, metric: metric}
+				}
+				continue
+			}
+			valid = append(valid, s)
 			keys = append(keys, key)
 			samples = append(samples, sampleTracker{
 				labels: ts.Labels,
 				sample: s,
 			})
 		}
+		if len(valid) > 0 {
+			ts.Samples = valid
+			validated = append(validated, ts)
+		}
 	}
-	d.receivedSamples.Add(float64(len(samples)))
+	req.Timeseries = validated
+	d.receivedSamples.Add(float64(received))
 
 	if len(samples) == 0 {
+		if validationErr != nil {
+			return nil, validationErr
+		}
 		return &cortex.WriteResponse{}, nil
 	}
 
+	if limit := d.limits.MaxSamplesPerPush(userID); limit > 0 && len(samples) > limit {
+		d.oversizedRequests.WithLabelValues(userID, "too_many_samples").Inc()
+		err := tooManySamplesError{Limit: limit, Samples: len(samples)}
+		util.Discard(userID, util.DiscardTooManySamples, len(samples), err)
+		return nil, err
+	}
+
 	limiter := d.getOrCreateIngestLimiter(userID)
 	if !limiter.AllowN(time.Now(), len(samples)) {
-		return nil, errIngestionRateLimitExceeded
+		d.rateLimitedSamples.WithLabelValues(userID).Add(float64(len(samples)))
+		err := ingestionRateLimitError{
+			Limit:   float64(limiter.Limit()),
+			Burst:   limiter.Burst(),
+			Samples: len(samples),
+		}
+		util.Discard(userID, util.DiscardRateLimited, len(samples), err)
+		return nil, err
 	}
 
 	var ingesters [][]*ring.IngesterDesc
 	if err := instrument.TimeRequestHistogram(ctx, "Distributor.Push[ring-lookup]", nil, func(ctx context.Context) error {
 		var err error
-		ingesters, err = d.ring.BatchGet(keys, d.cfg.ReplicationFactor, ring.Write)
+		ingesters, err = d.ringFor(userID).BatchGet(keys, d.cfg.ReplicationFactor, ring.Write)
 		if err != nil {
 			return err
 		}
@@ -342,8 +643,20 @@ func (d *Distributor) Push(ctx context.Context, req *cortex.WriteRequest) (*cort
 	}
 	select {
 	case err := <-pushTracker.err:
+		// The ingesters count the samples they discard; remember why the
+		// push failed, too, for the user's recent discards.
+		if reason := ingesterDiscardReason(err); reason != "" {
+			util.RecentDiscards.Record(userID, reason, len(samples), err)
+		}
 		return nil, err
 	case <-pushTracker.done:
+		usage.Add(userID, usage.SamplesIngested, float64(len(samples)))
+		if d.mirror != nil {
+			d.mirror.Append(userID, req.Timeseries)
+		}
+		if validationErr != nil {
+			return nil, validationErr
+		}
 		return &cortex.WriteResponse{}, nil
 	}
 }
@@ -352,15 +665,27 @@ func (d *Distributor) getOrCreateIngestLimiter(userID string) *rate.Limiter {
 	d.ingestLimitersMtx.Lock()
 	defer d.ingestLimitersMtx.Unlock()
 
-	if limiter, ok := d.ingestLimiters[userID]; ok {
+	// The user's limits may have changed since the limiter was created, if
+	// the overrides have been reloaded.
+	limit, burst := d.ingestionRateLimit(userID), d.limits.IngestionBurstSize(userID)
+	if limiter, ok := d.ingestLimiters[userID]; ok && limiter.Burst() == burst {
+		if limiter.Limit() != limit {
+			limiter.SetLimit(limit)
+		}
 		return limiter
 	}
 
-	limiter := rate.NewLimiter(rate.Limit(d.cfg.IngestionRateLimit), d.cfg.IngestionBurstSize)
+	limiter := rate.NewLimiter(limit, burst)
 	d.ingestLimiters[userID] = limiter
 	return limiter
 }
 
+// ingestionRateLimit returns this distributor's share of the user's
+// ingestion rate limit.  NB must be called with ingestLimitersMtx held.
+func (d *Distributor) ingestionRateLimit(userID string) rate.Limit {
+	return rate.Limit(d.limits.IngestionRate(userID) / float64(d.healthyDistributors))
+}
+
 func (d *Distributor) sendSamples(ctx context.Context, ingester *ring.IngesterDesc, sampleTrackers []*sampleTracker, pushTracker *pushTracker) {
 	err := d.sendSamplesErr(ctx, ingester, sampleTrackers)
 
@@ -438,29 +763,59 @@ func (d *Distributor) Query(ctx context.Context, from, to model.Time, matchers .
 			return err
 		}
 
-		ingesters, err := d.ring.Get(tokenFor(userID, []byte(metricName)), d.cfg.ReplicationFactor, ring.Read)
+		// When sharding by all labels the series of a metric may be on any
+		// ingester, as may they be on any in a shuffle shard which changed, so
+		// ask them all; each series is still on a quorum of the ingesters
+		// which reply as long as fewer than a quorum fail.
+		r, changed := d.queryRingFor(userID)
+		if d.cfg.ShardByAllLabels || changed {
+			ingesters := r.GetAll()
+			maxErrs := d.cfg.ReplicationFactor - (d.cfg.ReplicationFactor/2 + 1)
+			result, err = d.queryIngesters(ctx, ingesters, len(ingesters)-maxErrs, req)
+			return err
+		}
+
+		ingesters, err := r.Get(tokenFor(userID, []byte(metricName)), d.cfg.ReplicationFactor, ring.Read)
 		if err != nil {
 			return err
 		}
 
-		result, err = d.queryIngesters(ctx, ingesters, req)
+		// We need a response from a quorum of ingesters, which is n/2 + 1.
+		result, err = d.queryIngesters(ctx, ingesters, (len(ingesters)/2)+1, req)
 		return err
 	})
 	return result, err
 }
 
-// Query implements Querier.
-func (d *Distributor) queryIngesters(ctx context.Context, ingesters []*ring.IngesterDesc, req *cortex.QueryRequest) (model.Matrix, error) {
-	// We need a response from a quorum of ingesters, which is n/2 + 1.
-	minSuccess := (len(ingesters) / 2) + 1
-	maxErrs := len(ingesters) - minSuccess
+// queryIngesters queries the ingesters, merging the results of the first
+// minSuccess to reply.
+func (d *Distributor) queryIngesters(ctx context.Context, ingesters []*ring.IngesterDesc, minSuccess int, req *cortex.QueryRequest) (model.Matrix, error) {
+	if minSuccess < 1 {
+		minSuccess = 1
+	}
 	if len(ingesters) < minSuccess {
 		return nil, fmt.Errorf("could only find %d ingesters for query. Need at least %d", len(ingesters), minSuccess)
 	}
 
-	// Fetch samples from multiple ingesters
+	// Skip those that have not heartbeated in a while; as for writes, they
+	// still count towards the quorum, so if too many are dead don't bother
+	// waiting for the rest to time out.
+	liveIngesters := make([]*ring.IngesterDesc, 0, len(ingesters))
+	for _, ingester := range ingesters {
+		if time.Now().Sub(time.Unix(ingester.Timestamp, 0)) <= d.cfg.HeartbeatTimeout {
+			liveIngesters = append(liveIngesters, ingester)
+		}
+	}
+	if len(liveIngesters) < minSuccess {
+		return nil, fmt.Errorf("wanted at least %d live ingesters to process query, had %d", minSuccess, len(liveIngesters))
+	}
+	ingesters = liveIngesters
+	maxErrs := len(ingesters) - minSuccess
+
+	// Fetch samples from multiple ingesters.  The error channel is buffered
+	// so the goroutine reporting the failed quorum never blocks.
 	var numErrs int32
-	errReceived := make(chan error)
+	errReceived := make(chan error, 1)
 	results := make(chan model.Matrix, len(ingesters))
 
 	for _, ing := range ingesters {
@@ -496,6 +851,9 @@ func (d *Distributor) queryIngesters(ctx context.Context, ingesters []*ring.Inge
 				}
 				mss.Values = util.MergeSamples(mss.Values, ss.Values)
 			}
+			if err := util.CheckSeriesLimit(ctx, len(fpToSampleStream)); err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -638,10 +996,52 @@ func (d *Distributor) UserStats(ctx context.Context) (*UserStats, error) {
 	return totalStats, nil
 }
 
+// DeleteUser drops all the in-memory series of the current user from every
+// ingester, returning how many series were dropped in total, replicas
+// included.  Unlike reads, it fails if any ingester does.
+func (d *Distributor) DeleteUser(ctx context.Context) (uint64, error) {
+	req := &cortex.DeleteUserRequest{}
+	ingesters := d.ring.GetAll()
+	type result struct {
+		numSeries uint64
+		err       error
+	}
+	results := make(chan result, len(ingesters))
+	for _, ingester := range ingesters {
+		go func(ingester *ring.IngesterDesc) {
+			client, err := d.getClientFor(ingester)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			resp, err := client.DeleteUser(ctx, req)
+			if err != nil {
+				results <- result{err: fmt.Errorf("ingester %s: %v", ingester.Addr, err)}
+				return
+			}
+			results <- result{numSeries: resp.NumSeries}
+		}(ingester)
+	}
+
+	var numSeries uint64
+	var lastErr error
+	for range ingesters {
+		r := <-results
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		numSeries += r.numSeries
+	}
+	return numSeries, lastErr
+}
+
 // Describe implements prometheus.Collector.
 func (d *Distributor) Describe(ch chan<- *prometheus.Desc) {
 	d.queryDuration.Describe(ch)
 	ch <- d.receivedSamples.Desc()
+	d.rateLimitedSamples.Describe(ch)
+	d.oversizedRequests.Describe(ch)
 	d.sendDuration.Describe(ch)
 	d.ring.Describe(ch)
 	ch <- numClientsDesc
@@ -655,6 +1055,8 @@ func (d *Distributor) Describe(ch chan<- *prometheus.Desc) {
 func (d *Distributor) Collect(ch chan<- prometheus.Metric) {
 	d.queryDuration.Collect(ch)
 	ch <- d.receivedSamples
+	d.rateLimitedSamples.Collect(ch)
+	d.oversizedRequests.Collect(ch)
 	d.sendDuration.Collect(ch)
 	d.ring.Collect(ch)
 	d.ingesterAppends.Collect(ch)
@@ -1,20 +1,32 @@
 package distributor
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/metric"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 
 	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/limits"
 	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
 )
 
 // mockRing doesn't do any consistent hashing, just returns same ingesters for every query.
@@ -39,12 +51,24 @@ func (r mockRing) GetAll() []*ring.IngesterDesc {
 	return r.ingesters
 }
 
+func (r mockRing) ShuffleShard(identifier string, size int) ring.ReadRing {
+	return r
+}
+
+func (r mockRing) ShuffleShardWithLookback(identifier string, size int, lookback time.Duration) (ring.ReadRing, bool) {
+	return r, false
+}
+
 type mockIngester struct {
 	cortex.IngesterClient
-	happy bool
+	happy   bool
+	pushErr error
 }
 
 func (i mockIngester) Push(ctx context.Context, in *cortex.WriteRequest, opts ...grpc.CallOption) (*cortex.WriteResponse, error) {
+	if i.pushErr != nil {
+		return nil, i.pushErr
+	}
 	if !i.happy {
 		return nil, fmt.Errorf("Fail")
 	}
@@ -79,6 +103,13 @@ func (i mockIngester) Query(ctx context.Context, in *cortex.QueryRequest, opts .
 	}, nil
 }
 
+func (i mockIngester) DeleteUser(ctx context.Context, in *cortex.DeleteUserRequest, opts ...grpc.CallOption) (*cortex.DeleteUserResponse, error) {
+	if !i.happy {
+		return nil, fmt.Errorf("Fail")
+	}
+	return &cortex.DeleteUserResponse{NumSeries: 2}, nil
+}
+
 func TestDistributorPush(t *testing.T) {
 	ctx := user.Inject(context.Background(), "user")
 	for i, tc := range []struct {
@@ -157,35 +188,17 @@ func TestDistributorPush(t *testing.T) {
 				HeartbeatTimeout:    1 * time.Minute,
 				RemoteTimeout:       1 * time.Minute,
 				ClientCleanupPeriod: 1 * time.Minute,
-				IngestionRateLimit:  10000,
-				IngestionBurstSize:  10000,
 
 				ingesterClientFactory: func(addr string, _ time.Duration) (cortex.IngesterClient, error) {
 					return ingesters[addr], nil
 				},
-			}, ring)
+			}, ring, newTestOverrides(t, 10000, 10000))
 			if err != nil {
 				t.Fatal(err)
 			}
 			defer d.Stop()
 
-			request := &cortex.WriteRequest{}
-			for i := 0; i < tc.samples; i++ {
-				ts := cortex.TimeSeries{
-					Labels: []cortex.LabelPair{
-						{[]byte("__name__"), []byte("foo")},
-						{[]byte("bar"), []byte("baz")},
-						{[]byte("sample"), []byte(fmt.Sprintf("%d", i))},
-					},
-				}
-				ts.Samples = []cortex.Sample{
-					{
-						Value:       float64(i),
-						TimestampMs: int64(i),
-					},
-				}
-				request.Timeseries = append(request.Timeseries, ts)
-			}
+			request := makeWriteRequest(tc.samples)
 			response, err := d.Push(ctx, request)
 			assert.Equal(t, tc.expectedResponse, response, "Wrong response")
 			assert.Equal(t, tc.expectedError, err, "Wrong error")
@@ -193,6 +206,302 @@ func TestDistributorPush(t *testing.T) {
 	}
 }
 
+func TestDistributorPushRateLimit(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+	ingesterDescs := []*ring.IngesterDesc{}
+	for i := 0; i < 3; i++ {
+		ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+			Addr:      fmt.Sprintf("%d", i),
+			Timestamp: time.Now().Unix(),
+		})
+	}
+	ring := mockRing{
+		Counter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "foo",
+		}),
+		ingesters: ingesterDescs,
+	}
+
+	d, err := New(Config{
+		ReplicationFactor:   3,
+		HeartbeatTimeout:    1 * time.Minute,
+		RemoteTimeout:       1 * time.Minute,
+		ClientCleanupPeriod: 1 * time.Minute,
+
+		ingesterClientFactory: func(addr string, _ time.Duration) (cortex.IngesterClient, error) {
+			return mockIngester{happy: true}, nil
+		},
+	}, ring, newTestOverrides(t, 1, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	// The first push fits within the burst, the second exceeds it.
+	response, err := d.Push(ctx, makeWriteRequest(10))
+	assert.Equal(t, &cortex.WriteResponse{}, response, "Wrong response")
+	assert.NoError(t, err)
+
+	response, err = d.Push(ctx, makeWriteRequest(10))
+	assert.Nil(t, response, "Wrong response")
+	assert.Equal(t, ingestionRateLimitError{Limit: 1, Burst: 10, Samples: 10}, err, "Wrong error")
+
+	// Other users have their own limiter.
+	response, err = d.Push(user.Inject(context.Background(), "other"), makeWriteRequest(10))
+	assert.Equal(t, &cortex.WriteResponse{}, response, "Wrong response")
+	assert.NoError(t, err)
+}
+
+func TestDistributorGlobalIngestionRateStrategy(t *testing.T) {
+	consul := ring.NewInMemoryConsulClient(ring.ProtoCodec{Factory: distributorsDescFactory})
+	newDistributor := func(id string) *Distributor {
+		d, err := New(Config{
+			ReplicationFactor:     3,
+			HeartbeatTimeout:      1 * time.Minute,
+			RemoteTimeout:         1 * time.Minute,
+			ClientCleanupPeriod:   1 * time.Minute,
+			IngestionRateStrategy: globalIngestionRateStrategy,
+			HeartbeatPeriod:       1 * time.Minute,
+			ConsulConfig:          &ring.ConsulConfig{Mock: consul},
+			ID:                    id,
+		}, mockRing{}, newTestOverrides(t, 10, 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	d1 := newDistributor("d1")
+	defer d1.Stop()
+	d1.heartbeat()
+	assert.Equal(t, rate.Limit(10), d1.getOrCreateIngestLimiter("user").Limit())
+
+	d2 := newDistributor("d2")
+	d2.heartbeat()
+	d1.heartbeat()
+	assert.Equal(t, rate.Limit(5), d1.getOrCreateIngestLimiter("user").Limit())
+	assert.Equal(t, rate.Limit(5), d2.getOrCreateIngestLimiter("user").Limit())
+
+	// Once d2 has gone, d1 gets the whole limit back.
+	d2.Stop()
+	d1.heartbeat()
+	assert.Equal(t, rate.Limit(10), d1.getOrCreateIngestLimiter("user").Limit())
+}
+
+func TestDistributorPushHandler(t *testing.T) {
+	for i, tc := range []struct {
+		ingester     mockIngester
+		samples      int
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			ingester:     mockIngester{happy: true},
+			samples:      10,
+			expectedCode: http.StatusOK,
+		},
+		{
+			ingester:     mockIngester{happy: true},
+			samples:      20,
+			expectedCode: http.StatusTooManyRequests,
+			expectedBody: `{"burst":10,"error":"ingestion rate limit (10 samples/s, burst 10) exceeded while adding 20 samples","errorType":"rate_limited","limit":10,"samples":20,"status":"error"}`,
+		},
+		{
+			ingester:     mockIngester{pushErr: grpc.Errorf(codes.ResourceExhausted, "per-user series limit exceeded (limit: 1)")},
+			samples:      10,
+			expectedCode: http.StatusTooManyRequests,
+			expectedBody: "per-user series limit exceeded (limit: 1)\n",
+		},
+		{
+			ingester:     mockIngester{},
+			samples:      10,
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: "Fail\n",
+		},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			ingesterDescs := []*ring.IngesterDesc{}
+			for i := 0; i < 3; i++ {
+				ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+					Addr:      fmt.Sprintf("%d", i),
+					Timestamp: time.Now().Unix(),
+				})
+			}
+			d, err := New(Config{
+				ReplicationFactor:   3,
+				HeartbeatTimeout:    1 * time.Minute,
+				RemoteTimeout:       1 * time.Minute,
+				ClientCleanupPeriod: 1 * time.Minute,
+
+				ingesterClientFactory: func(addr string, _ time.Duration) (cortex.IngesterClient, error) {
+					return tc.ingester, nil
+				},
+			}, mockRing{ingesters: ingesterDescs}, newTestOverrides(t, 10, 10))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Stop()
+
+			buf, err := proto.Marshal(makeWriteRequest(tc.samples))
+			require.NoError(t, err)
+			var body bytes.Buffer
+			writer := snappy.NewWriter(&body)
+			_, err = writer.Write(buf)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest("POST", "/api/prom/push", &body)
+			req = req.WithContext(user.Inject(req.Context(), "user"))
+			w := httptest.NewRecorder()
+			d.PushHandler(w, req)
+			assert.Equal(t, tc.expectedCode, w.Code)
+			assert.Equal(t, tc.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestDistributorPushSizeLimits(t *testing.T) {
+	ingesterDescs := []*ring.IngesterDesc{}
+	for i := 0; i < 3; i++ {
+		ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+			Addr:      fmt.Sprintf("%d", i),
+			Timestamp: time.Now().Unix(),
+		})
+	}
+	overrides, err := limits.NewOverrides(limits.Limits{
+		IngestionRate:      100,
+		IngestionBurstSize: 100,
+		MaxSamplesPerPush:  5,
+	})
+	require.NoError(t, err)
+	d, err := New(Config{
+		ReplicationFactor:   3,
+		HeartbeatTimeout:    1 * time.Minute,
+		RemoteTimeout:       1 * time.Minute,
+		ClientCleanupPeriod: 1 * time.Minute,
+		MaxRecvMsgSize:      1024,
+
+		ingesterClientFactory: func(addr string, _ time.Duration) (cortex.IngesterClient, error) {
+			return mockIngester{happy: true}, nil
+		},
+	}, mockRing{ingesters: ingesterDescs}, overrides)
+	require.NoError(t, err)
+	defer d.Stop()
+
+	push := func(req *cortex.WriteRequest) *httptest.ResponseRecorder {
+		buf, err := proto.Marshal(req)
+		require.NoError(t, err)
+		var body bytes.Buffer
+		writer := snappy.NewWriter(&body)
+		_, err = writer.Write(buf)
+		require.NoError(t, err)
+
+		r := httptest.NewRequest("POST", "/api/prom/push", &body)
+		r = r.WithContext(user.Inject(r.Context(), "user"))
+		w := httptest.NewRecorder()
+		d.PushHandler(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, push(makeWriteRequest(5)).Code)
+
+	w := push(makeWriteRequest(6))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, "push of 6 samples exceeds the limit of 5 samples per request\n", w.Body.String())
+
+	// One series with a large label is small enough before decompression, but
+	// not after.
+	req := makeWriteRequest(1)
+	req.Timeseries[0].Labels[1].Value = bytes.Repeat([]byte("a"), 2048)
+	w = push(req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, "request body too large: exceeds limit of 1024 bytes\n", w.Body.String())
+}
+
+func TestDistributorMirror(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		users   []string
+		samples int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _, err := user.ExtractFromHTTPRequest(r)
+		require.NoError(t, err)
+		var req cortex.WriteRequest
+		require.NoError(t, ParseProtoRequest(r.Context(), w, r, &req, true, 0))
+		mtx.Lock()
+		defer mtx.Unlock()
+		users = append(users, userID)
+		for _, ts := range req.Timeseries {
+			samples += len(ts.Samples)
+		}
+	}))
+	defer server.Close()
+
+	ingesterDescs := []*ring.IngesterDesc{}
+	for i := 0; i < 3; i++ {
+		ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+			Addr:      fmt.Sprintf("%d", i),
+			Timestamp: time.Now().Unix(),
+		})
+	}
+	cfg := Config{
+		ReplicationFactor:   3,
+		HeartbeatTimeout:    1 * time.Minute,
+		RemoteTimeout:       1 * time.Minute,
+		ClientCleanupPeriod: 1 * time.Minute,
+	}
+	require.NoError(t, cfg.Mirror.URL.Set(server.URL))
+	cfg.Mirror.Timeout = time.Second
+	cfg.Mirror.QueueCapacity = 100
+	cfg.Mirror.MaxShards = 1
+	cfg.Mirror.MaxSamplesPerSend = 100
+	cfg.Mirror.BatchSendDeadline = time.Hour
+
+	cfg.ingesterClientFactory = func(addr string, _ time.Duration) (cortex.IngesterClient, error) {
+		return mockIngester{happy: true}, nil
+	}
+	d, err := New(cfg, mockRing{ingesters: ingesterDescs}, newTestOverrides(t, 100, 100))
+	require.NoError(t, err)
+
+	ctx := user.Inject(context.Background(), "user")
+	_, err = d.Push(ctx, makeWriteRequest(10))
+	require.NoError(t, err)
+
+	// Invalid series aren't mirrored, though the rest of their push is.
+	req := makeWriteRequest(5)
+	req.Timeseries[0].Labels = req.Timeseries[0].Labels[1:]
+	_, err = d.Push(ctx, req)
+	require.Error(t, err)
+
+	// Stopping the distributor sends the mirror's queued series.
+	d.Stop()
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, []string{"user"}, users)
+	assert.Equal(t, 14, samples)
+}
+
+func makeWriteRequest(samples int) *cortex.WriteRequest {
+	request := &cortex.WriteRequest{}
+	for i := 0; i < samples; i++ {
+		ts := cortex.TimeSeries{
+			Labels: []cortex.LabelPair{
+				{[]byte("__name__"), []byte("foo")},
+				{[]byte("bar"), []byte("baz")},
+				{[]byte("sample"), []byte(fmt.Sprintf("%d", i))},
+			},
+		}
+		ts.Samples = []cortex.Sample{
+			{
+				Value:       float64(i),
+				TimestampMs: int64(i),
+			},
+		}
+		request.Timeseries = append(request.Timeseries, ts)
+	}
+	return request
+}
+
 func TestDistributorQuery(t *testing.T) {
 	ctx := user.Inject(context.Background(), "user")
 
@@ -282,13 +591,11 @@ func TestDistributorQuery(t *testing.T) {
 				HeartbeatTimeout:    1 * time.Minute,
 				RemoteTimeout:       1 * time.Minute,
 				ClientCleanupPeriod: 1 * time.Minute,
-				IngestionRateLimit:  10000,
-				IngestionBurstSize:  10000,
 
 				ingesterClientFactory: func(addr string, _ time.Duration) (cortex.IngesterClient, error) {
 					return ingesters[addr], nil
 				},
-			}, ring)
+			}, ring, newTestOverrides(t, 10000, 10000))
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -304,3 +611,340 @@ func TestDistributorQuery(t *testing.T) {
 		})
 	}
 }
+
+func newTestOverrides(t *testing.T, ingestionRate float64, ingestionBurstSize int) *limits.Overrides {
+	overrides, err := limits.NewOverrides(limits.Limits{
+		IngestionRate:      ingestionRate,
+		IngestionBurstSize: ingestionBurstSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return overrides
+}
+
+func TestDistributorShardSize(t *testing.T) {
+	for i, tc := range []struct {
+		shardSize, maxIngesters, expected int
+	}{
+		{0, 0, 0},
+		{10, 0, 10},
+		{0, 5, 5},
+		{10, 5, 5},
+		{5, 10, 5},
+		{0, 1, 3},
+		{2, 0, 3},
+	} {
+		overrides, err := limits.NewOverrides(limits.Limits{
+			IngestionTenantShardSize: tc.shardSize,
+			MaxIngestersPerUser:      tc.maxIngesters,
+		})
+		require.NoError(t, err)
+		d := &Distributor{cfg: Config{ReplicationFactor: 3}, limits: overrides}
+		assert.Equal(t, tc.expected, d.shardSize("user"), "case %d", i)
+	}
+}
+
+func TestShardByAllLabels(t *testing.T) {
+	labels := func(pairs ...string) []cortex.LabelPair {
+		result := []cortex.LabelPair{}
+		for i := 0; i < len(pairs); i += 2 {
+			result = append(result, cortex.LabelPair{Name: []byte(pairs[i]), Value: []byte(pairs[i+1])})
+		}
+		return result
+	}
+
+	a, err := shardByAllLabels("user", labels("__name__", "foo", "instance", "a"))
+	require.NoError(t, err)
+	b, err := shardByAllLabels("user", labels("instance", "a", "__name__", "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, a, b, "token must not depend on label order")
+
+	c, err := shardByAllLabels("user", labels("__name__", "foo", "instance", "b"))
+	require.NoError(t, err)
+	assert.NotEqual(t, a, c)
+
+	d, err := shardByAllLabels("other", labels("__name__", "foo", "instance", "a"))
+	require.NoError(t, err)
+	assert.NotEqual(t, a, d)
+
+	_, err = shardByAllLabels("user", labels("instance", "a"))
+	assert.Error(t, err)
+}
+
+func TestDistributorQueryShardByAllLabels(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+
+	for i, tc := range []struct {
+		unhappy     int
+		expectError bool
+	}{
+		{unhappy: 0},
+		// With a replication factor of 3 a single failure still leaves a
+		// quorum for every series.
+		{unhappy: 1},
+		{unhappy: 2, expectError: true},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			ingesterDescs := []*ring.IngesterDesc{}
+			ingesters := map[string]mockIngester{}
+			for j := 0; j < 5; j++ {
+				addr := fmt.Sprintf("%d", j)
+				ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+					Addr:      addr,
+					Timestamp: time.Now().Unix(),
+				})
+				ingesters[addr] = mockIngester{happy: j >= tc.unhappy}
+			}
+
+			d, err := New(Config{
+				ReplicationFactor:   3,
+				HeartbeatTimeout:    1 * time.Minute,
+				RemoteTimeout:       1 * time.Minute,
+				ClientCleanupPeriod: 1 * time.Minute,
+				ShardByAllLabels:    true,
+
+				ingesterClientFactory: func(addr string, _ time.Duration) (cortex.IngesterClient, error) {
+					return ingesters[addr], nil
+				},
+			}, mockRing{
+				Counter: prometheus.NewCounter(prometheus.CounterOpts{
+					Name: "foo",
+				}),
+				ingesters: ingesterDescs,
+			}, newTestOverrides(t, 10000, 10000))
+			require.NoError(t, err)
+			defer d.Stop()
+
+			matcher, err := metric.NewLabelMatcher(metric.Equal, model.LabelName("__name__"), model.LabelValue("foo"))
+			require.NoError(t, err)
+			response, err := d.Query(ctx, 0, 10, matcher)
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, response, 1)
+		})
+	}
+}
+
+func TestDistributorQueryQuorum(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+	stale := time.Now().Add(-time.Hour).Unix()
+
+	for i, tc := range []struct {
+		timestamps    []int64
+		happy         []bool
+		expectedError string
+	}{
+		// A single dead ingester leaves a quorum.
+		{
+			timestamps: []int64{stale, 0, 0},
+			happy:      []bool{true, true, true},
+		},
+		// A dead and a failing ingester don't.
+		{
+			timestamps:    []int64{stale, 0, 0},
+			happy:         []bool{true, false, true},
+			expectedError: "Fail",
+		},
+		// Two dead ingesters fail the query without querying the others.
+		{
+			timestamps:    []int64{stale, stale, 0},
+			happy:         []bool{true, true, true},
+			expectedError: "wanted at least 2 live ingesters to process query, had 1",
+		},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			ingesterDescs := []*ring.IngesterDesc{}
+			ingesters := map[string]mockIngester{}
+			for j := range tc.timestamps {
+				addr := fmt.Sprintf("%d", j)
+				timestamp := tc.timestamps[j]
+				if timestamp == 0 {
+					timestamp = time.Now().Unix()
+				}
+				ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+					Addr:      addr,
+					Timestamp: timestamp,
+				})
+				ingesters[addr] = mockIngester{happy: tc.happy[j]}
+			}
+
+			d, err := New(Config{
+				ReplicationFactor:   3,
+				HeartbeatTimeout:    1 * time.Minute,
+				RemoteTimeout:       1 * time.Minute,
+				ClientCleanupPeriod: 1 * time.Minute,
+
+				ingesterClientFactory: func(addr string, _ time.Duration) (cortex.IngesterClient, error) {
+					return ingesters[addr], nil
+				},
+			}, mockRing{
+				Counter: prometheus.NewCounter(prometheus.CounterOpts{
+					Name: "foo",
+				}),
+				ingesters: ingesterDescs,
+			}, newTestOverrides(t, 10000, 10000))
+			require.NoError(t, err)
+			defer d.Stop()
+
+			matcher, err := metric.NewLabelMatcher(metric.Equal, model.LabelName("__name__"), model.LabelValue("foo"))
+			require.NoError(t, err)
+			response, err := d.Query(ctx, 0, 10, matcher)
+			if tc.expectedError != "" {
+				require.Error(t, err)
+				assert.Equal(t, tc.expectedError, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, response, 1)
+		})
+	}
+}
+
+func TestDistributorDeleteUser(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+	for i, tc := range []struct {
+		ingesters         []mockIngester
+		expectedNumSeries uint64
+		expectError       bool
+	}{
+		{
+			ingesters:         []mockIngester{{happy: true}, {happy: true}, {happy: true}},
+			expectedNumSeries: 6,
+		},
+		// Unlike reads, a single failure fails the deletion.
+		{
+			ingesters:         []mockIngester{{happy: true}, {happy: true}, {}},
+			expectedNumSeries: 4,
+			expectError:       true,
+		},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			ingesterDescs := []*ring.IngesterDesc{}
+			ingesters := map[string]mockIngester{}
+			for i, ingester := range tc.ingesters {
+				addr := fmt.Sprintf("%d", i)
+				ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+					Addr:      addr,
+					Timestamp: time.Now().Unix(),
+				})
+				ingesters[addr] = ingester
+			}
+
+			d, err := New(Config{
+				ReplicationFactor:   3,
+				HeartbeatTimeout:    1 * time.Minute,
+				RemoteTimeout:       1 * time.Minute,
+				ClientCleanupPeriod: 1 * time.Minute,
+
+				ingesterClientFactory: func(addr string, _ time.Duration) (cortex.IngesterClient, error) {
+					return ingesters[addr], nil
+				},
+			}, mockRing{ingesters: ingesterDescs}, newTestOverrides(t, 10000, 10000))
+			require.NoError(t, err)
+			defer d.Stop()
+
+			numSeries, err := d.DeleteUser(ctx)
+			assert.Equal(t, tc.expectedNumSeries, numSeries)
+			if tc.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDistributorDiscards(t *testing.T) {
+	ingesterDescs := []*ring.IngesterDesc{}
+	for i := 0; i < 3; i++ {
+		ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+			Addr:      fmt.Sprintf("%d", i),
+			Timestamp: time.Now().Unix(),
+		})
+	}
+	overrides, err := limits.NewOverrides(limits.Limits{
+		IngestionRate:      5,
+		IngestionBurstSize: 5,
+		ValidationConfig: util.ValidationConfig{
+			RejectOldSamples:       true,
+			RejectOldSamplesMaxAge: time.Hour,
+		},
+	})
+	require.NoError(t, err)
+	newDistributor := func(ingester mockIngester) *Distributor {
+		d, err := New(Config{
+			ReplicationFactor:   3,
+			HeartbeatTimeout:    1 * time.Minute,
+			RemoteTimeout:       1 * time.Minute,
+			ClientCleanupPeriod: 1 * time.Minute,
+
+			ingesterClientFactory: func(addr string, _ time.Duration) (cortex.IngesterClient, error) {
+				return ingester, nil
+			},
+		}, mockRing{ingesters: ingesterDescs}, overrides)
+		require.NoError(t, err)
+		return d
+	}
+	makeRequest := func(samples int) *cortex.WriteRequest {
+		req := makeWriteRequest(samples)
+		for _, ts := range req.Timeseries {
+			ts.Samples[0].TimestampMs = int64(model.Now())
+		}
+		return req
+	}
+
+	d := newDistributor(mockIngester{happy: true})
+	defer d.Stop()
+	ctx := user.Inject(context.Background(), "discards")
+
+	// Invalid samples are dropped, the rest accepted, and the first failure
+	// returned.
+	req := makeRequest(3)
+	req.Timeseries[0].Samples[0].TimestampMs = int64(model.Now().Add(-2 * time.Hour))
+	req.Timeseries[1].Labels[1].Name = []byte("bar baz")
+	_, err = d.Push(ctx, req)
+	require.IsType(t, validationError{}, err)
+	assert.Equal(t, util.ErrSampleTooOld, err.(validationError).err)
+	assert.Len(t, req.Timeseries, 1)
+
+	// A push with only invalid samples fails, with a 400.
+	req = makeRequest(1)
+	req.Timeseries[0].Labels[1].Name = []byte("bar baz")
+	_, err = d.Push(ctx, req)
+	require.IsType(t, validationError{}, err)
+	assert.Equal(t, util.ErrInvalidLabel, err.(validationError).err)
+	w := httptest.NewRecorder()
+	writePushError(w, httptest.NewRequest("POST", "/api/prom/push", nil), err)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	_, err = d.Push(ctx, makeRequest(6))
+	require.Error(t, err)
+
+	// Pushes rejected by ingesters are remembered too.
+	rejecting := newDistributor(mockIngester{pushErr: grpc.Errorf(codes.ResourceExhausted, "%v (limit: 1)", util.ErrUserSeriesLimitExceeded)})
+	defer rejecting.Stop()
+	_, err = rejecting.Push(ctx, makeRequest(2))
+	require.Error(t, err)
+
+	r := httptest.NewRequest("GET", "/api/prom/discarded_samples", nil)
+	w = httptest.NewRecorder()
+	d.DiscardsHandler(w, r.WithContext(ctx))
+	require.Equal(t, http.StatusOK, w.Code)
+	var discards []util.DiscardSummary
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &discards))
+	samples := map[string]int{}
+	for _, discard := range discards {
+		samples[discard.Reason] = discard.Samples
+		assert.NotEmpty(t, discard.LastError, discard.Reason)
+	}
+	assert.Equal(t, map[string]int{
+		"greater_than_max_sample_age":  1,
+		"label_invalid":                2,
+		util.DiscardRateLimited:        6,
+		util.DiscardPerUserSeriesLimit: 2,
+	}, samples)
+}
@@ -0,0 +1,220 @@
+package distributor
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+const (
+	// Key prefix in the KV store under which elected replicas are stored,
+	// one key per user and cluster.
+	haTrackerPrefix = "ha-tracker/"
+
+	consulKVStore   = "consul"
+	inMemoryKVStore = "inmemory"
+)
+
+var (
+	electedReplicaChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "ha_tracker_elected_replica_changes_total",
+		Help:      "The total number of times the elected replica has changed for a user and cluster.",
+	}, []string{"user", "cluster"})
+	dedupedSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "distributor_deduped_samples_total",
+		Help:      "The total number of samples dropped because they were sent by a replica which isn't the elected one.",
+	}, []string{"user", "cluster"})
+)
+
+func init() {
+	prometheus.MustRegister(electedReplicaChanges)
+	prometheus.MustRegister(dedupedSamples)
+}
+
+// HATrackerConfig configures deduplication of samples sent by pairs (or more)
+// of HA Prometheus replicas.  Only samples from one elected replica per user
+// and cluster are accepted; the election is kept in a KV store shared by all
+// distributors.
+type HATrackerConfig struct {
+	EnableHATracker bool
+	ClusterLabel    string
+	ReplicaLabel    string
+	KVStore         string
+
+	// The timestamp of the elected replica is only written to the KV store
+	// once it is this old, to limit the rate of writes.
+	UpdateTimeout time.Duration
+	// A new replica is elected once samples from the elected one haven't
+	// been seen for this long.
+	FailoverTimeout time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *HATrackerConfig) RegisterFlags(f *flag.FlagSet) {
+	f.BoolVar(&cfg.EnableHATracker, "distributor.ha-tracker.enable", false, "Only accept samples from one elected replica of each HA pair of Prometheus servers.")
+	f.StringVar(&cfg.ClusterLabel, "distributor.ha-tracker.cluster", "cluster", "Prometheus external label identifying the HA cluster samples were sent from.")
+	f.StringVar(&cfg.ReplicaLabel, "distributor.ha-tracker.replica", "__replica__", "Prometheus external label identifying the replica within an HA cluster. It is removed from accepted samples.")
+	f.StringVar(&cfg.KVStore, "distributor.ha-tracker.store", consulKVStore, "Backend storing the elected replicas, shared between distributors: consul or inmemory.")
+	f.DurationVar(&cfg.UpdateTimeout, "distributor.ha-tracker.update-timeout", 15*time.Second, "How often to update the time the elected replica was last seen in the KV store.")
+	f.DurationVar(&cfg.FailoverTimeout, "distributor.ha-tracker.failover-timeout", 30*time.Second, "How long since the elected replica was last seen before another replica is elected. Must be greater than the update timeout.")
+}
+
+// haTracker tracks the elected replica of each user's HA clusters.  Elections
+// are made with CAS on the KV store, and cached locally by watching it.
+type haTracker struct {
+	cfg    HATrackerConfig
+	client ring.ConsulClient
+
+	mtx      sync.Mutex
+	elected  map[string]ReplicaDesc
+	done     chan struct{}
+	finished chan struct{}
+}
+
+func replicaDescFactory() proto.Message {
+	return &ReplicaDesc{}
+}
+
+func newHATracker(cfg HATrackerConfig, consulConfig *ring.ConsulConfig) (*haTracker, error) {
+	if cfg.FailoverTimeout <= cfg.UpdateTimeout {
+		return nil, fmt.Errorf("HA tracker failover timeout (%v) must be greater than update timeout (%v)", cfg.FailoverTimeout, cfg.UpdateTimeout)
+	}
+
+	codec := ring.ProtoCodec{Factory: replicaDescFactory}
+	var client ring.ConsulClient
+	switch cfg.KVStore {
+	case consulKVStore:
+		if consulConfig == nil {
+			return nil, fmt.Errorf("the %s HA tracker store requires consul to be configured", consulKVStore)
+		}
+		var err error
+		client, err = ring.NewConsulClient(*consulConfig, codec)
+		if err != nil {
+			return nil, err
+		}
+	case inMemoryKVStore:
+		client = ring.NewInMemoryConsulClient(codec)
+	default:
+		return nil, fmt.Errorf("unknown HA tracker store: %q", cfg.KVStore)
+	}
+
+	t := &haTracker{
+		cfg:      cfg,
+		client:   ring.PrefixClient(client, haTrackerPrefix),
+		elected:  map[string]ReplicaDesc{},
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go t.loop()
+	return t, nil
+}
+
+// loop keeps the local cache up to date with elections made by other
+// distributors, including those made before we started.
+func (t *haTracker) loop() {
+	defer close(t.finished)
+	t.client.WatchPrefix("", t.done, func(key string, value interface{}) bool {
+		replica := value.(*ReplicaDesc)
+		// Keys include any prefix of the underlying client.
+		if i := strings.Index(key, haTrackerPrefix); i >= 0 {
+			key = key[i+len(haTrackerPrefix):]
+		}
+		t.mtx.Lock()
+		t.elected[key] = *replica
+		t.mtx.Unlock()
+		return true
+	})
+}
+
+func (t *haTracker) stop() {
+	close(t.done)
+	<-t.finished
+}
+
+type replicasNotMatchError struct {
+	replica, elected string
+}
+
+func (e replicasNotMatchError) Error() string {
+	return fmt.Sprintf("replica %q is not the elected replica %q", e.replica, e.elected)
+}
+
+// checkReplica returns nil if samples from the given replica should be
+// accepted, electing it if the current elected replica has failed.
+func (t *haTracker) checkReplica(ctx context.Context, userID, cluster, replica string, now time.Time) error {
+	key := fmt.Sprintf("%s/%s", userID, cluster)
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+
+	t.mtx.Lock()
+	entry, ok := t.elected[key]
+	t.mtx.Unlock()
+	if ok {
+		age := time.Duration(nowMs-entry.ReceivedAt) * time.Millisecond
+		if entry.Replica == replica && age < t.cfg.UpdateTimeout {
+			return nil
+		}
+		if entry.Replica != replica && age < t.cfg.FailoverTimeout {
+			return replicasNotMatchError{replica: replica, elected: entry.Replica}
+		}
+	}
+
+	var result error
+	err := t.client.CAS(key, func(in interface{}) (out interface{}, retry bool, err error) {
+		if desc, ok := in.(*ReplicaDesc); ok && desc.Replica != replica {
+			if time.Duration(nowMs-desc.ReceivedAt)*time.Millisecond < t.cfg.FailoverTimeout {
+				// Another distributor has seen the elected replica recently;
+				// leave the election alone.
+				result = replicasNotMatchError{replica: replica, elected: desc.Replica}
+				t.cache(key, *desc)
+				return desc, false, nil
+			}
+			util.WithContext(ctx, log.Base()).Infof("Electing replica %s for cluster %s, as %s was last seen %v ago", replica, cluster, desc.Replica, time.Duration(nowMs-desc.ReceivedAt)*time.Millisecond)
+			electedReplicaChanges.WithLabelValues(userID, cluster).Inc()
+		}
+		desc := &ReplicaDesc{Replica: replica, ReceivedAt: nowMs}
+		t.cache(key, *desc)
+		return desc, true, nil
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+func (t *haTracker) cache(key string, desc ReplicaDesc) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.elected[key] = desc
+}
+
+// findHALabels returns the cluster and replica of a series, if it has both.
+func findHALabels(cfg HATrackerConfig, labels []cortex.LabelPair) (cluster, replica string) {
+	for _, pair := range labels {
+		switch string(pair.Name) {
+		case cfg.ClusterLabel:
+			cluster = string(pair.Value)
+		case cfg.ReplicaLabel:
+			replica = string(pair.Value)
+		}
+	}
+	return cluster, replica
+}
+
+// removeReplicaLabel removes the replica label from each series, so series
+// from different replicas are the same series.
+func removeReplicaLabel(cfg HATrackerConfig, timeseries []cortex.TimeSeries) {
+	dropLabels(timeseries, []string{cfg.ReplicaLabel})
+}
@@ -0,0 +1,103 @@
+package distributor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/ring"
+)
+
+func newTestHATracker(t *testing.T, kv ring.ConsulClient) *haTracker {
+	tracker, err := newHATracker(HATrackerConfig{
+		EnableHATracker: true,
+		ClusterLabel:    "cluster",
+		ReplicaLabel:    "__replica__",
+		KVStore:         consulKVStore,
+		UpdateTimeout:   time.Second,
+		FailoverTimeout: 2 * time.Second,
+	}, &ring.ConsulConfig{Mock: kv})
+	require.NoError(t, err)
+	return tracker
+}
+
+func TestHATrackerFailover(t *testing.T) {
+	kv := ring.NewInMemoryConsulClient(ring.ProtoCodec{Factory: replicaDescFactory})
+	tracker := newTestHATracker(t, kv)
+	defer tracker.stop()
+
+	now := time.Now()
+	require.NoError(t, tracker.checkReplica(context.Background(), "user", "c1", "a", now))
+	assert.IsType(t, replicasNotMatchError{}, tracker.checkReplica(context.Background(), "user", "c1", "b", now))
+
+	// Other clusters and users have their own elections.
+	assert.NoError(t, tracker.checkReplica(context.Background(), "user", "c2", "b", now))
+	assert.NoError(t, tracker.checkReplica(context.Background(), "user2", "c1", "b", now))
+
+	// Once a is seen again, after the update timeout, it stays elected.
+	now = now.Add(1500 * time.Millisecond)
+	require.NoError(t, tracker.checkReplica(context.Background(), "user", "c1", "a", now))
+	now = now.Add(1500 * time.Millisecond)
+	assert.IsType(t, replicasNotMatchError{}, tracker.checkReplica(context.Background(), "user", "c1", "b", now))
+
+	// If a isn't seen for the failover timeout, b takes over.
+	now = now.Add(3 * time.Second)
+	require.NoError(t, tracker.checkReplica(context.Background(), "user", "c1", "b", now))
+	assert.IsType(t, replicasNotMatchError{}, tracker.checkReplica(context.Background(), "user", "c1", "a", now))
+}
+
+func TestHATrackerSharedAcrossDistributors(t *testing.T) {
+	kv := ring.NewInMemoryConsulClient(ring.ProtoCodec{Factory: replicaDescFactory})
+	tracker1 := newTestHATracker(t, kv)
+	defer tracker1.stop()
+
+	now := time.Now()
+	require.NoError(t, tracker1.checkReplica(context.Background(), "user", "c1", "a", now))
+
+	// A distributor started later sees the existing election.
+	tracker2 := newTestHATracker(t, kv)
+	defer tracker2.stop()
+	assert.IsType(t, replicasNotMatchError{}, tracker2.checkReplica(context.Background(), "user", "c1", "b", now))
+	assert.NoError(t, tracker2.checkReplica(context.Background(), "user", "c1", "a", now))
+}
+
+func TestHATrackerConfigValidation(t *testing.T) {
+	_, err := newHATracker(HATrackerConfig{
+		KVStore:         inMemoryKVStore,
+		UpdateTimeout:   time.Minute,
+		FailoverTimeout: time.Second,
+	}, nil)
+	assert.Error(t, err)
+
+	_, err = newHATracker(HATrackerConfig{
+		KVStore:         "etcd",
+		UpdateTimeout:   time.Second,
+		FailoverTimeout: time.Minute,
+	}, nil)
+	assert.Error(t, err)
+}
+
+func TestRemoveReplicaLabel(t *testing.T) {
+	cfg := HATrackerConfig{ClusterLabel: "cluster", ReplicaLabel: "__replica__"}
+	timeseries := []cortex.TimeSeries{{
+		Labels: []cortex.LabelPair{
+			{Name: []byte("__name__"), Value: []byte("foo")},
+			{Name: []byte("__replica__"), Value: []byte("a")},
+			{Name: []byte("cluster"), Value: []byte("c1")},
+		},
+	}}
+
+	cluster, replica := findHALabels(cfg, timeseries[0].Labels)
+	assert.Equal(t, "c1", cluster)
+	assert.Equal(t, "a", replica)
+
+	removeReplicaLabel(cfg, timeseries)
+	assert.Equal(t, []cortex.LabelPair{
+		{Name: []byte("__name__"), Value: []byte("foo")},
+		{Name: []byte("cluster"), Value: []byte("c1")},
+	}, timeseries[0].Labels)
+}
@@ -2,53 +2,80 @@ package distributor
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/golang/protobuf/proto"
-	"github.com/golang/snappy"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 
-	"github.com/prometheus/common/log"
 	"github.com/prometheus/prometheus/promql"
 
 	"github.com/weaveworks/common/instrument"
+	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 // PushHandler is a http.Handler which accepts WriteRequests.
 func (d *Distributor) PushHandler(w http.ResponseWriter, r *http.Request) {
 	var req cortex.WriteRequest
-	if err := ParseProtoRequest(r.Context(), w, r, &req, true); err != nil {
-		log.Errorf(err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := ParseProtoRequest(r.Context(), w, r, &req, true, d.cfg.MaxRecvMsgSize); err != nil {
+		d.writeReadError(w, r, err)
 		return
 	}
 
 	if _, err := d.Push(r.Context(), &req); err != nil {
-		if grpc.Code(err) == codes.ResourceExhausted {
-			switch grpc.ErrorDesc(err) {
-			case util.ErrUserSeriesLimitExceeded.Error():
-				err = util.ErrUserSeriesLimitExceeded
-			case util.ErrMetricSeriesLimitExceeded.Error():
-				err = util.ErrMetricSeriesLimitExceeded
-			}
-		}
+		writePushError(w, r, err)
+	}
+}
 
-		var code int
-		switch err {
-		case errIngestionRateLimitExceeded, util.ErrUserSeriesLimitExceeded, util.ErrMetricSeriesLimitExceeded:
-			code = http.StatusTooManyRequests
-		default:
-			code = http.StatusInternalServerError
-		}
-		http.Error(w, err.Error(), code)
-		log.Errorf("append err: %v", err)
+// writePushError writes the response for an error pushing samples.
+func writePushError(w http.ResponseWriter, r *http.Request, err error) {
+	if _, ok := err.(validationError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		util.WithContext(r.Context(), log.Base()).Warnf("append err: %v", err)
+		return
+	}
+
+	if _, ok := err.(tooManySamplesError); ok {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		util.WithContext(r.Context(), log.Base()).Warnf("append err: %v", err)
+		return
 	}
+
+	if limitErr, ok := err.(ingestionRateLimitError); ok {
+		// Rate limited clients get a structured error, in the same style
+		// as Prometheus's API, so they can see which limits applied.
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		util.WriteJSONResponse(w, map[string]interface{}{
+			"status":    "error",
+			"errorType": "rate_limited",
+			"error":     limitErr.Error(),
+			"limit":     limitErr.Limit,
+			"burst":     limitErr.Burst,
+			"samples":   limitErr.Samples,
+		})
+		util.WithContext(r.Context(), log.Base()).Warnf("append err: %v", err)
+		return
+	}
+
+	// Ingesters return ResourceExhausted when a user's series limits are
+	// exceeded; the description says which limit was hit.
+	if grpc.Code(err) == codes.ResourceExhausted {
+		http.Error(w, grpc.ErrorDesc(err), http.StatusTooManyRequests)
+		util.WithContext(r.Context(), log.Base()).Warnf("append err: %v", err)
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+	util.WithContext(r.Context(), log.Base()).Errorf("append err: %v", err)
 }
 
 // UserStats models ingestion statistics for one user.
@@ -68,6 +95,36 @@ func (d *Distributor) UserStatsHandler(w http.ResponseWriter, r *http.Request) {
 	util.WriteJSONResponse(w, stats)
 }
 
+// DiscardsHandler serves why the user's samples were discarded in the last
+// hour, by this distributor and the ingesters it sent them to, so users can
+// find out why data is missing.  Distributors each have their own view, but
+// usually see the same reasons.
+func (d *Distributor) DiscardsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	util.WriteJSONResponse(w, util.RecentDiscards.Recent(userID))
+}
+
+// ingesterDiscardReason returns why ingesters rejected samples, from the
+// error they returned, or "" if they didn't reject them.
+func ingesterDiscardReason(err error) string {
+	desc := grpc.ErrorDesc(err)
+	switch {
+	case strings.Contains(desc, util.ErrUserSeriesLimitExceeded.Error()):
+		return util.DiscardPerUserSeriesLimit
+	case strings.Contains(desc, util.ErrMetricSeriesLimitExceeded.Error()):
+		return util.DiscardPerMetricSeriesLimit
+	case strings.Contains(desc, util.ErrOutOfOrderSample.Error()):
+		return util.DiscardOutOfOrder
+	case strings.Contains(desc, util.ErrDuplicateSampleTimestamp.Error()):
+		return util.DiscardDuplicateTimestamp
+	}
+	return ""
+}
+
 // ValidateExprHandler validates a PromQL expression.
 func (d *Distributor) ValidateExprHandler(w http.ResponseWriter, r *http.Request) {
 	_, err := promql.ParseExpr(r.FormValue("expr"))
@@ -108,23 +165,81 @@ func (d *Distributor) ValidateExprHandler(w http.ResponseWriter, r *http.Request
 	})
 }
 
-// ParseProtoRequest parses a proto from the body of a http request.
-func ParseProtoRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, req proto.Message, compressed bool) error {
+// requestTooLargeError is returned when a request's body, after
+// decompression, is larger than allowed.
+type requestTooLargeError struct {
+	Limit int
+}
+
+func (e requestTooLargeError) Error() string {
+	return fmt.Sprintf("request body too large: exceeds limit of %d bytes", e.Limit)
+}
+
+// readAll reads all of reader, failing with a requestTooLargeError if it's
+// more than maxSize bytes; 0 for no limit.
+func readAll(reader io.Reader, maxSize int) ([]byte, error) {
+	if maxSize > 0 {
+		reader = io.LimitReader(reader, int64(maxSize)+1)
+	}
+	buf := bytes.Buffer{}
+	if _, err := buf.ReadFrom(reader); err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && buf.Len() > maxSize {
+		return nil, requestTooLargeError{Limit: maxSize}
+	}
+	return buf.Bytes(), nil
+}
+
+// readBody reads the body of a http request, gunzipping it if its
+// Content-Encoding is gzip, up to maxSize bytes.
+func readBody(r *http.Request, maxSize int) ([]byte, error) {
+	var reader io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	return readAll(reader, maxSize)
+}
+
+// writeReadError writes the response for an error reading a push request.
+func (d *Distributor) writeReadError(w http.ResponseWriter, r *http.Request, err error) {
+	util.WithContext(r.Context(), log.Base()).Error(err)
+	if _, ok := err.(requestTooLargeError); ok {
+		userID, _ := user.Extract(r.Context())
+		d.oversizedRequests.WithLabelValues(userID, "request_too_large").Inc()
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// ParseProtoRequest parses a proto from the body of a http request, of up to
+// maxSize bytes after decompression; 0 for no limit.  The body isn't read
+// into a pooled buffer, as labels are unmarshalled without copying them.
+func ParseProtoRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, req proto.Message, compressed bool, maxSize int) error {
 	var reader io.Reader = r.Body
 	if compressed {
-		reader = snappy.NewReader(r.Body)
+		sr := util.GetSnappyReader(r.Body)
+		defer util.PutSnappyReader(sr)
+		reader = sr
 	}
 
-	buf := bytes.Buffer{}
+	var buf []byte
 	if err := instrument.TimeRequestHistogram(ctx, "Distributor.PushHandler[decompress]", nil, func(_ context.Context) error {
-		_, err := buf.ReadFrom(reader)
+		var err error
+		buf, err = readAll(reader, maxSize)
 		return err
 	}); err != nil {
 		return err
 	}
 
 	if err := instrument.TimeRequestHistogram(ctx, "Distributor.PushHandler[unmarshall]", nil, func(_ context.Context) error {
-		return proto.Unmarshal(buf.Bytes(), req)
+		return proto.Unmarshal(buf, req)
 	}); err != nil {
 		return err
 	}
@@ -0,0 +1,113 @@
+package distributor
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+var skippedInfluxFields = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "distributor_influx_skipped_fields_total",
+	Help:      "The total number of Influx line protocol fields dropped because they aren't numeric or boolean.",
+})
+
+func init() {
+	prometheus.MustRegister(skippedInfluxFields)
+}
+
+// InfluxPushHandler is a http.Handler which accepts samples in Influx line
+// protocol, as written by Telegraf's influxdb output, and pushes them like
+// PushHandler.  Each numeric or boolean field of a point becomes a series
+// named <measurement>_<field>, or just <measurement> if the field is called
+// "value", labelled with the point's tags.  String fields are dropped.  The
+// `precision` parameter sets the unit of the points' timestamps, which
+// default to nanoseconds.
+func (d *Distributor) InfluxPushHandler(w http.ResponseWriter, r *http.Request) {
+	buf, err := readBody(r, d.cfg.MaxRecvMsgSize)
+	if err != nil {
+		d.writeReadError(w, r, err)
+		return
+	}
+
+	// Points which do parse are still pushed when some lines don't, as
+	// InfluxDB does, but the client is told about those which didn't.
+	points, parseErr := models.ParsePointsWithPrecision(buf, time.Now(), r.FormValue("precision"))
+	req := influxToWriteRequest(points)
+	if len(req.Timeseries) > 0 {
+		if _, err := d.Push(r.Context(), req); err != nil {
+			writePushError(w, r, err)
+			return
+		}
+	}
+	if parseErr != nil {
+		util.WithContext(r.Context(), log.Base()).Warnf("influx parse err: %v", parseErr)
+		http.Error(w, parseErr.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func influxToWriteRequest(points []models.Point) *cortex.WriteRequest {
+	samples := make([]model.Sample, 0, len(points))
+	for _, point := range points {
+		measurement := sanitizeInfluxName(point.Name())
+		timestamp := model.TimeFromUnixNano(point.Time().UnixNano())
+		tags := point.Tags().Map()
+		for field, value := range point.Fields() {
+			var v float64
+			switch value := value.(type) {
+			case float64:
+				v = value
+			case int64:
+				v = float64(value)
+			case bool:
+				if value {
+					v = 1
+				}
+			default:
+				skippedInfluxFields.Inc()
+				continue
+			}
+
+			metric := make(model.Metric, len(tags)+1)
+			for name, value := range tags {
+				metric[model.LabelName(sanitizeInfluxName(name))] = model.LabelValue(value)
+			}
+			name := measurement
+			if field != "value" {
+				name = fmt.Sprintf("%s_%s", measurement, sanitizeInfluxName(field))
+			}
+			metric[model.MetricNameLabel] = model.LabelValue(name)
+			samples = append(samples, model.Sample{
+				Metric:    metric,
+				Value:     model.SampleValue(v),
+				Timestamp: timestamp,
+			})
+		}
+	}
+	return util.ToWriteRequest(samples)
+}
+
+// sanitizeInfluxName replaces the characters in an Influx measurement, tag
+// or field name which aren't allowed in Prometheus names with underscores.
+func sanitizeInfluxName(name string) string {
+	result := []byte(name)
+	for i, b := range result {
+		if !(b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b == '_' || i > 0 && b >= '0' && b <= '9') {
+			result[i] = '_'
+		}
+	}
+	if len(result) == 0 {
+		return "_"
+	}
+	return string(result)
+}
@@ -0,0 +1,139 @@
+package distributor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestInfluxToWriteRequest(t *testing.T) {
+	points, err := models.ParsePointsWithPrecision([]byte(
+		"cpu,host=a,cpu-total=yes usage_idle=90.5,usage_user=3i,up=true,state=\"ok\" 1500000000\n"+
+			"disk.io value=7 1500000000\n",
+	), time.Now(), "s")
+	require.NoError(t, err)
+
+	var samples []string
+	for _, ts := range influxToWriteRequest(points).Timeseries {
+		metric := util.FromLabelPairs(ts.Labels)
+		require.Len(t, ts.Samples, 1)
+		assert.Equal(t, int64(1500000000000), ts.Samples[0].TimestampMs)
+		samples = append(samples, fmt.Sprintf("%s %v", metric, ts.Samples[0].Value))
+	}
+	sort.Strings(samples)
+	assert.Equal(t, []string{
+		`cpu_up{cpu_total="yes", host="a"} 1`,
+		`cpu_usage_idle{cpu_total="yes", host="a"} 90.5`,
+		`cpu_usage_user{cpu_total="yes", host="a"} 3`,
+		`disk_io 7`,
+	}, samples)
+}
+
+func TestSanitizeInfluxName(t *testing.T) {
+	for in, out := range map[string]string{
+		"foo_bar": "foo_bar",
+		"foo.bar": "foo_bar",
+		"1foo":    "_foo",
+		"foo1":    "foo1",
+		"":        "_",
+	} {
+		assert.Equal(t, out, sanitizeInfluxName(in), in)
+	}
+}
+
+func TestInfluxPushHandler(t *testing.T) {
+	for i, tc := range []struct {
+		ingester     mockIngester
+		body         string
+		gzip         bool
+		expectedCode int
+	}{
+		{
+			ingester:     mockIngester{happy: true},
+			body:         "cpu,host=a usage=1 1500000000000000000\n",
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			ingester:     mockIngester{happy: true},
+			body:         "cpu,host=a usage=1 1500000000000000000\n",
+			gzip:         true,
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			ingester:     mockIngester{happy: true},
+			body:         "cpu,host=a usage=1\nnot a point\n",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			ingester:     mockIngester{},
+			body:         "cpu,host=a usage=1\n",
+			expectedCode: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			d := newHTTPTestDistributor(t, tc.ingester)
+			defer d.Stop()
+
+			var body bytes.Buffer
+			if tc.gzip {
+				gz := gzip.NewWriter(&body)
+				_, err := gz.Write([]byte(tc.body))
+				require.NoError(t, err)
+				require.NoError(t, gz.Close())
+			} else {
+				body.WriteString(tc.body)
+			}
+
+			req := httptest.NewRequest("POST", "/api/prom/influx/write", &body)
+			if tc.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			req = req.WithContext(user.Inject(req.Context(), "user"))
+			w := httptest.NewRecorder()
+			d.InfluxPushHandler(w, req)
+			assert.Equal(t, tc.expectedCode, w.Code, w.Body.String())
+			if tc.expectedCode == http.StatusBadRequest {
+				assert.True(t, strings.Contains(w.Body.String(), "not a point"), w.Body.String())
+			}
+		})
+	}
+}
+
+// newHTTPTestDistributor makes a Distributor replicating to three of the
+// ingester, with a rate limit of 10 samples/s.
+func newHTTPTestDistributor(t *testing.T, ingester mockIngester) *Distributor {
+	ingesterDescs := []*ring.IngesterDesc{}
+	for i := 0; i < 3; i++ {
+		ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+			Addr:      fmt.Sprintf("%d", i),
+			Timestamp: time.Now().Unix(),
+		})
+	}
+	d, err := New(Config{
+		ReplicationFactor:   3,
+		HeartbeatTimeout:    1 * time.Minute,
+		RemoteTimeout:       1 * time.Minute,
+		ClientCleanupPeriod: 1 * time.Minute,
+
+		ingesterClientFactory: func(addr string, _ time.Duration) (cortex.IngesterClient, error) {
+			return ingester, nil
+		},
+	}, mockRing{ingesters: ingesterDescs}, newTestOverrides(t, 10, 10))
+	require.NoError(t, err)
+	return d
+}
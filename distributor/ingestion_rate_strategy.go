@@ -0,0 +1,92 @@
+package distributor
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/weaveworks/cortex/util/log"
+)
+
+const (
+	// With the local strategy, each distributor enforces the full per-user
+	// ingestion rate limit.
+	localIngestionRateStrategy = "local"
+
+	// With the global strategy, the per-user ingestion rate limit is divided
+	// between all the healthy distributors, which find each other in consul.
+	globalIngestionRateStrategy = "global"
+
+	// distributorsConsulKey is the key under which distributors heartbeat.
+	distributorsConsulKey = "distributors"
+)
+
+func distributorsDescFactory() proto.Message {
+	return &DistributorsDesc{}
+}
+
+// heartbeat updates our entry in consul, and adjusts the ingestion rate
+// limiters to match the number of healthy distributors.
+func (d *Distributor) heartbeat() {
+	var healthy int
+	err := d.consul.CAS(distributorsConsulKey, func(in interface{}) (out interface{}, retry bool, err error) {
+		desc, ok := in.(*DistributorsDesc)
+		if !ok || desc == nil {
+			desc = &DistributorsDesc{}
+		}
+		if desc.Distributors == nil {
+			desc.Distributors = map[string]*DistributorDesc{}
+		}
+		now := time.Now()
+		desc.Distributors[d.cfg.ID] = &DistributorDesc{Timestamp: now.Unix()}
+
+		// Distributors which haven't heartbeated recently are removed, so
+		// entries for ones which didn't exit cleanly don't accumulate.
+		healthy = 0
+		for id, distributor := range desc.Distributors {
+			if now.Sub(time.Unix(distributor.Timestamp, 0)) > d.cfg.HeartbeatTimeout {
+				delete(desc.Distributors, id)
+				continue
+			}
+			healthy++
+		}
+		return desc, true, nil
+	})
+	if err != nil {
+		log.Errorf("Failed to heartbeat to consul: %v", err)
+		return
+	}
+	d.setHealthyDistributors(healthy)
+}
+
+// unregister removes our entry from consul.
+func (d *Distributor) unregister() {
+	if err := d.consul.CAS(distributorsConsulKey, func(in interface{}) (out interface{}, retry bool, err error) {
+		desc, ok := in.(*DistributorsDesc)
+		if !ok || desc == nil {
+			return &DistributorsDesc{}, false, nil
+		}
+		delete(desc.Distributors, d.cfg.ID)
+		return desc, true, nil
+	}); err != nil {
+		log.Errorf("Failed to unregister from consul: %v", err)
+	}
+}
+
+func (d *Distributor) setHealthyDistributors(healthy int) {
+	if healthy < 1 {
+		healthy = 1
+	}
+
+	d.ingestLimitersMtx.Lock()
+	defer d.ingestLimitersMtx.Unlock()
+	if healthy == d.healthyDistributors {
+		return
+	}
+
+	log.Infof("Found %d healthy distributors, adjusting ingestion rate limits", healthy)
+	d.healthyDistributors = healthy
+	for userID, limiter := range d.ingestLimiters {
+		limiter.SetLimit(d.ingestionRateLimit(userID))
+	}
+}
@@ -0,0 +1,96 @@
+package distributor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// jsonSample is a sample as pushed to JSONPushHandler.
+type jsonSample struct {
+	Metric    model.Metric `json:"metric"`
+	Timestamp *model.Time  `json:"timestamp"`
+	Value     jsonValue    `json:"value"`
+}
+
+// jsonValue is a sample value, which may be given as a number or, as in the
+// Prometheus API, as a string, which can also be NaN or ±Inf.
+type jsonValue float64
+
+func (v *jsonValue) UnmarshalJSON(b []byte) error {
+	var s string
+	if len(b) > 0 && b[0] == '"' {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	} else {
+		s = string(b)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sample value %s", b)
+	}
+	*v = jsonValue(f)
+	return nil
+}
+
+// JSONPushHandler is a http.Handler which accepts a JSON array of samples,
+// each with a `metric` of labels including __name__, a `value`, and
+// optionally a `timestamp` in seconds since the epoch, defaulting to now, for
+// clients which can't easily send remote write protobufs.  The body may be
+// gzipped.
+func (d *Distributor) JSONPushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	buf, err := readBody(r, d.cfg.MaxRecvMsgSize)
+	if err != nil {
+		d.writeReadError(w, r, err)
+		return
+	}
+	var samples []jsonSample
+	if err := json.Unmarshal(buf, &samples); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(samples) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	now := model.Now()
+	result := make([]model.Sample, 0, len(samples))
+	for i, s := range samples {
+		if s.Metric[model.MetricNameLabel] == "" {
+			http.Error(w, fmt.Sprintf("sample %d has no metric name", i), http.StatusBadRequest)
+			return
+		}
+		for name := range s.Metric {
+			if !name.IsValid() {
+				http.Error(w, fmt.Sprintf("sample %d has invalid label name %q", i, name), http.StatusBadRequest)
+				return
+			}
+		}
+		timestamp := now
+		if s.Timestamp != nil {
+			timestamp = *s.Timestamp
+		}
+		result = append(result, model.Sample{
+			Metric:    s.Metric,
+			Value:     model.SampleValue(s.Value),
+			Timestamp: timestamp,
+		})
+	}
+
+	if _, err := d.Push(r.Context(), util.ToWriteRequest(result)); err != nil {
+		writePushError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
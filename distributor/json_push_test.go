@@ -0,0 +1,101 @@
+package distributor
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/common/user"
+)
+
+func TestJSONSampleUnmarshal(t *testing.T) {
+	var samples []jsonSample
+	require.NoError(t, json.Unmarshal([]byte(`[
+		{"metric": {"__name__": "foo", "bar": "baz"}, "timestamp": 1500000000.5, "value": 1.5},
+		{"metric": {"__name__": "foo"}, "value": "NaN"},
+		{"metric": {"__name__": "foo"}, "value": "+Inf"}
+	]`), &samples))
+	require.Len(t, samples, 3)
+	assert.Equal(t, model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}, samples[0].Metric)
+	require.NotNil(t, samples[0].Timestamp)
+	assert.Equal(t, model.Time(1500000000500), *samples[0].Timestamp)
+	assert.Equal(t, jsonValue(1.5), samples[0].Value)
+	assert.Nil(t, samples[1].Timestamp)
+	assert.True(t, math.IsNaN(float64(samples[1].Value)))
+	assert.True(t, math.IsInf(float64(samples[2].Value), 1))
+
+	assert.Error(t, json.Unmarshal([]byte(`[{"metric": {"__name__": "foo"}, "value": "bad"}]`), &samples))
+}
+
+func TestJSONPushHandler(t *testing.T) {
+	for i, tc := range []struct {
+		ingester     mockIngester
+		method       string
+		body         string
+		expectedCode int
+	}{
+		{
+			ingester:     mockIngester{happy: true},
+			body:         `[{"metric": {"__name__": "foo", "bar": "baz"}, "value": 1}]`,
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			ingester:     mockIngester{happy: true},
+			body:         `[]`,
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			ingester:     mockIngester{happy: true},
+			method:       "GET",
+			expectedCode: http.StatusMethodNotAllowed,
+		},
+		{
+			ingester:     mockIngester{happy: true},
+			body:         `{"metric": {"__name__": "foo"}, "value": 1}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			ingester:     mockIngester{happy: true},
+			body:         `[{"metric": {"bar": "baz"}, "value": 1}]`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			ingester:     mockIngester{happy: true},
+			body:         `[{"metric": {"__name__": "foo", "0bad": "baz"}, "value": 1}]`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			ingester:     mockIngester{happy: true},
+			body:         "[" + strings.Repeat(`{"metric": {"__name__": "foo"}, "value": 1},`, 20) + `{"metric": {"__name__": "foo"}, "value": 1}]`,
+			expectedCode: http.StatusTooManyRequests,
+		},
+		{
+			ingester:     mockIngester{},
+			body:         `[{"metric": {"__name__": "foo"}, "value": 1}]`,
+			expectedCode: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			d := newHTTPTestDistributor(t, tc.ingester)
+			defer d.Stop()
+
+			method := tc.method
+			if method == "" {
+				method = "POST"
+			}
+			req := httptest.NewRequest(method, "/api/prom/push/json", strings.NewReader(tc.body))
+			req = req.WithContext(user.Inject(req.Context(), "user"))
+			w := httptest.NewRecorder()
+			d.JSONPushHandler(w, req)
+			assert.Equal(t, tc.expectedCode, w.Code, w.Body.String())
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package distributor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/limits"
+	"github.com/weaveworks/cortex/util"
+)
+
+var deniedSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "distributor_denied_samples_total",
+	Help:      "The total number of samples dropped by per-user metric allow and deny lists.",
+}, []string{"user"})
+
+func init() {
+	prometheus.MustRegister(deniedSamples)
+}
+
+// filterMetrics removes the series whose metric names aren't allowed by the
+// user's allow and deny lists.
+func filterMetrics(userID string, timeseries []cortex.TimeSeries, overrides *limits.Overrides) []cortex.TimeSeries {
+	result := timeseries[:0]
+	dropped := 0
+	for _, ts := range timeseries {
+		var name model.LabelValue
+		for _, pair := range ts.Labels {
+			if pair.Name.Equal(labelNameBytes) {
+				name = model.LabelValue(pair.Value)
+				break
+			}
+		}
+		if !overrides.AllowsMetric(userID, name) {
+			dropped += len(ts.Samples)
+			continue
+		}
+		result = append(result, ts)
+	}
+	if dropped > 0 {
+		deniedSamples.WithLabelValues(userID).Add(float64(dropped))
+		util.Discard(userID, util.DiscardMetricNotAllowed, dropped, nil)
+	}
+	return result
+}
@@ -0,0 +1,44 @@
+package distributor
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/limits"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestFilterMetrics(t *testing.T) {
+	series := func(name model.LabelValue) cortex.TimeSeries {
+		return cortex.TimeSeries{
+			Labels:  util.ToLabelPairs(model.Metric{model.MetricNameLabel: name}),
+			Samples: []cortex.Sample{{Value: 1, TimestampMs: 1}},
+		}
+	}
+	names := func(timeseries []cortex.TimeSeries) []model.LabelValue {
+		var result []model.LabelValue
+		for _, ts := range timeseries {
+			result = append(result, util.FromLabelPairs(ts.Labels)[model.MetricNameLabel])
+		}
+		return result
+	}
+
+	for i, tc := range []struct {
+		allow, deny []string
+		expected    []model.LabelValue
+	}{
+		{nil, nil, []model.LabelValue{"up", "go_goroutines", "requests"}},
+		{nil, []string{"go_goroutines"}, []model.LabelValue{"up", "requests"}},
+		{[]string{"up", "go_goroutines"}, nil, []model.LabelValue{"up", "go_goroutines"}},
+		{[]string{"up", "go_goroutines"}, []string{"go_goroutines"}, []model.LabelValue{"up"}},
+	} {
+		overrides, err := limits.NewOverrides(limits.Limits{MetricAllowlist: tc.allow, MetricDenylist: tc.deny})
+		require.NoError(t, err)
+		result := filterMetrics("user", []cortex.TimeSeries{series("up"), series("go_goroutines"), series("requests")}, overrides)
+		assert.Equal(t, tc.expected, names(result), "case %d", i)
+	}
+}
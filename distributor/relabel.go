@@ -0,0 +1,59 @@
+package distributor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/relabel"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+var relabelDroppedSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "distributor_relabel_dropped_samples_total",
+	Help:      "The total number of samples dropped by per-user relabelling.",
+}, []string{"user"})
+
+func init() {
+	prometheus.MustRegister(relabelDroppedSamples)
+}
+
+// dropLabels removes the labels with the given names from each series.
+func dropLabels(timeseries []cortex.TimeSeries, names []string) {
+	for i := range timeseries {
+		labels := timeseries[i].Labels[:0]
+	outer:
+		for _, pair := range timeseries[i].Labels {
+			for _, name := range names {
+				if string(pair.Name) == name {
+					continue outer
+				}
+			}
+			labels = append(labels, pair)
+		}
+		timeseries[i].Labels = labels
+	}
+}
+
+// relabelTimeseries applies the relabel configs to each series, removing the
+// series which are dropped.
+func relabelTimeseries(userID string, timeseries []cortex.TimeSeries, cfgs []*config.RelabelConfig) []cortex.TimeSeries {
+	result := timeseries[:0]
+	dropped := 0
+	for _, ts := range timeseries {
+		labels := relabel.Process(model.LabelSet(util.FromLabelPairs(ts.Labels)), cfgs...)
+		if labels == nil {
+			dropped += len(ts.Samples)
+			continue
+		}
+		ts.Labels = util.ToLabelPairs(model.Metric(labels))
+		result = append(result, ts)
+	}
+	if dropped > 0 {
+		relabelDroppedSamples.WithLabelValues(userID).Add(float64(dropped))
+		util.Discard(userID, util.DiscardRelabelled, dropped, nil)
+	}
+	return result
+}
@@ -0,0 +1,55 @@
+package distributor
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestRelabelTimeseries(t *testing.T) {
+	var cfgs []*config.RelabelConfig
+	require.NoError(t, yaml.Unmarshal([]byte(`
+- source_labels: [__name__]
+  regex: go_.*
+  action: drop
+- source_labels: [instance]
+  regex: (.*):.*
+  target_label: host
+`), &cfgs))
+
+	series := func(metric model.Metric) cortex.TimeSeries {
+		return cortex.TimeSeries{
+			Labels:  util.ToLabelPairs(metric),
+			Samples: []cortex.Sample{{Value: 1, TimestampMs: 1}},
+		}
+	}
+	result := relabelTimeseries("user", []cortex.TimeSeries{
+		series(model.Metric{model.MetricNameLabel: "go_goroutines", "instance": "a:80"}),
+		series(model.Metric{model.MetricNameLabel: "up", "instance": "a:80"}),
+		series(model.Metric{model.MetricNameLabel: "go_threads"}),
+	}, cfgs)
+
+	require.Len(t, result, 1)
+	assert.Equal(t, model.Metric{
+		model.MetricNameLabel: "up",
+		"instance":            "a:80",
+		"host":                "a",
+	}, util.FromLabelPairs(result[0].Labels))
+}
+
+func TestDropLabels(t *testing.T) {
+	timeseries := []cortex.TimeSeries{
+		{Labels: util.ToLabelPairs(model.Metric{model.MetricNameLabel: "up", "env": "prod", "prometheus_replica": "a"})},
+		{Labels: util.ToLabelPairs(model.Metric{model.MetricNameLabel: "up", "job": "node"})},
+	}
+	dropLabels(timeseries, []string{"prometheus_replica", "env"})
+	assert.Equal(t, model.Metric{model.MetricNameLabel: "up"}, util.FromLabelPairs(timeseries[0].Labels))
+	assert.Equal(t, model.Metric{model.MetricNameLabel: "up", "job": "node"}, util.FromLabelPairs(timeseries[1].Labels))
+}
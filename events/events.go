@@ -0,0 +1,245 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+var (
+	eventsRecorded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "events_recorded_total",
+		Help:      "The total number of state transition events recorded.",
+	}, []string{"component", "type"})
+	webhookFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "events_webhook_failures_total",
+		Help:      "The total number of events that failed to be sent to the webhook.",
+	})
+	webhookDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "events_webhook_dropped_total",
+		Help:      "The total number of events dropped because the webhook queue was full.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(eventsRecorded)
+	prometheus.MustRegister(webhookFailures)
+	prometheus.MustRegister(webhookDropped)
+}
+
+// Event is a significant state transition in a Cortex component.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Component string    `json:"component"`
+	Type      string    `json:"type"`
+	Message   string    `json:"message"`
+}
+
+// Config configures the event recorder.
+type Config struct {
+	BufferSize       int
+	WebhookURL       util.URLValue
+	WebhookTimeout   time.Duration
+	WebhookQueueSize int
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.BufferSize, "events.buffer-size", 1024, "Number of recent events to keep in memory.")
+	f.Var(&cfg.WebhookURL, "events.webhook-url", "If set, POST each event as JSON to this URL.")
+	f.DurationVar(&cfg.WebhookTimeout, "events.webhook-timeout", 5*time.Second, "Timeout for requests to the events webhook.")
+	f.IntVar(&cfg.WebhookQueueSize, "events.webhook-queue-size", 1024, "Number of events to queue for the webhook before dropping them.")
+}
+
+// Recorder keeps a bounded history of recent events, and optionally
+// forwards them to a webhook.
+type Recorder struct {
+	cfg Config
+
+	mtx    sync.RWMutex
+	events []Event
+	next   int
+	full   bool
+
+	webhook chan Event // nil if there is no webhook, or once stopped.
+	done    chan struct{}
+}
+
+// NewRecorder makes a new Recorder.
+func NewRecorder(cfg Config) *Recorder {
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 1
+	}
+	r := &Recorder{
+		cfg:    cfg,
+		events: make([]Event, cfg.BufferSize),
+	}
+	if cfg.WebhookURL.URL != nil {
+		r.webhook = make(chan Event, cfg.WebhookQueueSize)
+		r.done = make(chan struct{})
+		go r.webhookLoop(r.webhook)
+	}
+	return r
+}
+
+// Stop the Recorder, flushing any events queued for the webhook.
+func (r *Recorder) Stop() {
+	r.mtx.Lock()
+	webhook := r.webhook
+	r.webhook = nil
+	r.mtx.Unlock()
+
+	if webhook != nil {
+		close(webhook)
+		<-r.done
+	}
+}
+
+// Record an event.
+func (r *Recorder) Record(component, typ, format string, args ...interface{}) {
+	event := Event{
+		Time:      time.Now(),
+		Component: component,
+		Type:      typ,
+		Message:   fmt.Sprintf(format, args...),
+	}
+	eventsRecorded.WithLabelValues(component, typ).Inc()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.events[r.next] = event
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+
+	if r.webhook != nil {
+		select {
+		case r.webhook <- event:
+		default:
+			webhookDropped.Inc()
+		}
+	}
+}
+
+// Events returns the recorded events, oldest first.
+func (r *Recorder) Events() []Event {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	if !r.full {
+		return append([]Event{}, r.events[:r.next]...)
+	}
+	result := make([]Event, 0, len(r.events))
+	result = append(result, r.events[r.next:]...)
+	return append(result, r.events[:r.next]...)
+}
+
+// ServeHTTP returns the recorded events as JSON.  Events can be filtered
+// with the `component` and `since` (RFC3339) query parameters.
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var since time.Time
+	if s := req.FormValue("since"); s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	component := req.FormValue("component")
+
+	result := []Event{}
+	for _, event := range r.Events() {
+		if component != "" && event.Component != component {
+			continue
+		}
+		if event.Time.Before(since) {
+			continue
+		}
+		result = append(result, event)
+	}
+	util.WriteJSONResponse(w, result)
+}
+
+func (r *Recorder) webhookLoop(webhook <-chan Event) {
+	defer close(r.done)
+	for event := range webhook {
+		if err := r.send(event); err != nil {
+			webhookFailures.Inc()
+			log.Warnf("Error sending event to webhook: %v", err)
+		}
+	}
+}
+
+func (r *Recorder) send(event Event) error {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.WebhookTimeout)
+	defer cancel()
+	resp, err := ctxhttp.Post(ctx, http.DefaultClient, r.cfg.WebhookURL.String(), "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+var (
+	defaultMtx      sync.RWMutex
+	defaultRecorder = NewRecorder(Config{BufferSize: 1024})
+)
+
+// Init replaces the process-wide Recorder with one built from cfg.
+func Init(cfg Config) {
+	recorder := NewRecorder(cfg)
+	defaultMtx.Lock()
+	old := defaultRecorder
+	defaultRecorder = recorder
+	defaultMtx.Unlock()
+	old.Stop()
+}
+
+// Stop the process-wide Recorder.
+func Stop() {
+	defaultMtx.RLock()
+	defer defaultMtx.RUnlock()
+	defaultRecorder.Stop()
+}
+
+// Record an event on the process-wide Recorder.
+func Record(component, typ, format string, args ...interface{}) {
+	defaultMtx.RLock()
+	defer defaultMtx.RUnlock()
+	defaultRecorder.Record(component, typ, format, args...)
+}
+
+// Handler returns a http.Handler serving events from the process-wide Recorder.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defaultMtx.RLock()
+		recorder := defaultRecorder
+		defaultMtx.RUnlock()
+		recorder.ServeHTTP(w, req)
+	})
+}
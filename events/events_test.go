@@ -0,0 +1,87 @@
+package events
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+func messages(events []Event) []string {
+	result := []string{}
+	for _, event := range events {
+		result = append(result, event.Message)
+	}
+	return result
+}
+
+func TestRecorderWrapsAround(t *testing.T) {
+	r := NewRecorder(Config{BufferSize: 3})
+	defer r.Stop()
+
+	assert.Equal(t, []string{}, messages(r.Events()))
+	for i := 0; i < 2; i++ {
+		r.Record("test", "test", "event %d", i)
+	}
+	assert.Equal(t, []string{"event 0", "event 1"}, messages(r.Events()))
+	for i := 2; i < 5; i++ {
+		r.Record("test", "test", "event %d", i)
+	}
+	assert.Equal(t, []string{"event 2", "event 3", "event 4"}, messages(r.Events()))
+}
+
+func TestRecorderServeHTTP(t *testing.T) {
+	r := NewRecorder(Config{BufferSize: 10})
+	defer r.Stop()
+	r.Record("ingester", "state_change", "foo")
+	r.Record("ring", "ingester_added", "bar")
+
+	req := httptest.NewRequest("GET", "/events?component=ring", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var events []Event
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &events))
+	assert.Equal(t, []string{"bar"}, messages(events))
+}
+
+func TestRecorderWebhook(t *testing.T) {
+	received := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var event Event
+		if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	r := NewRecorder(Config{
+		BufferSize:       10,
+		WebhookURL:       util.URLValue{URL: u},
+		WebhookTimeout:   time.Second,
+		WebhookQueueSize: 10,
+	})
+	r.Record("table-manager", "table_created", "Created table %s", "foo")
+	r.Stop()
+
+	select {
+	case event := <-received:
+		assert.Equal(t, "table-manager", event.Component)
+		assert.Equal(t, "table_created", event.Type)
+		assert.Equal(t, "Created table foo", event.Message)
+	default:
+		t.Fatal("webhook not called")
+	}
+}
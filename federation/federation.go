@@ -0,0 +1,201 @@
+package federation
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+var clusterRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "federation_cluster_requests_total",
+	Help:      "The total number of queries sent to each federated cluster, by status.",
+}, []string{"cluster", "status"})
+
+func init() {
+	prometheus.MustRegister(clusterRequests)
+}
+
+// Cluster is a Cortex cluster queries are federated to.
+type Cluster struct {
+	Name string
+	URL  *url.URL
+}
+
+// ClusterList is a list of Clusters that can be used as a flag, with values
+// of the form name=url.
+type ClusterList []Cluster
+
+// String implements flag.Value
+func (l ClusterList) String() string {
+	clusters := make([]string, 0, len(l))
+	for _, c := range l {
+		clusters = append(clusters, fmt.Sprintf("%s=%s", c.Name, c.URL))
+	}
+	return strings.Join(clusters, ",")
+}
+
+// Set implements flag.Value
+func (l *ClusterList) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("cluster must be of the form name=url: %q", s)
+	}
+	u, err := url.Parse(parts[1])
+	if err != nil {
+		return err
+	}
+	*l = append(*l, Cluster{Name: parts[0], URL: u})
+	return nil
+}
+
+// Config for a Proxy.
+type Config struct {
+	Clusters       ClusterList
+	DedupLabels    util.StringListValue
+	RequestTimeout time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.Var(&cfg.Clusters, "federation.cluster", "Cluster to federate queries to, as name=url. May be given multiple times.")
+	f.Var(&cfg.DedupLabels, "federation.dedup-label", "External label distinguishing otherwise identical series from different clusters; series are deduplicated ignoring these labels. May be given multiple times.")
+	f.DurationVar(&cfg.RequestTimeout, "federation.request-timeout", 1*time.Minute, "Timeout for queries to each cluster.")
+}
+
+// Proxy fans queries out to multiple independent Cortex clusters, and merges
+// their results.  Queries succeed as long as one cluster responds; the
+// clusters which failed are returned as warnings.
+type Proxy struct {
+	cfg    Config
+	client *http.Client
+}
+
+// New makes a new Proxy.
+func New(cfg Config) (*Proxy, error) {
+	if len(cfg.Clusters) == 0 {
+		return nil, fmt.Errorf("no clusters configured")
+	}
+	return &Proxy{
+		cfg:    cfg,
+		client: &http.Client{Transport: util.TracedTransport{}},
+	}, nil
+}
+
+type clusterResponse struct {
+	index   int
+	cluster Cluster
+	status  int
+	body    []byte
+	err     error
+}
+
+// ServeHTTP implements http.Handler.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	responses := make(chan clusterResponse, len(p.cfg.Clusters))
+	for i, cluster := range p.cfg.Clusters {
+		go func(i int, cluster Cluster) {
+			resp := p.query(r, cluster)
+			resp.index = i
+			responses <- resp
+		}(i, cluster)
+	}
+
+	var (
+		results  []queryResponse
+		warnings []string
+	)
+	for range p.cfg.Clusters {
+		resp := <-responses
+		switch {
+		case resp.err != nil:
+			clusterRequests.WithLabelValues(resp.cluster.Name, "error").Inc()
+			log.Warnf("Error querying cluster %s: %v", resp.cluster.Name, resp.err)
+			warnings = append(warnings, fmt.Sprintf("cluster %s: %v", resp.cluster.Name, resp.err))
+			continue
+
+		// An invalid query is invalid in every cluster, so there's no
+		// point waiting for the others.
+		case resp.status/100 == 4:
+			clusterRequests.WithLabelValues(resp.cluster.Name, fmt.Sprintf("%d", resp.status)).Inc()
+			w.WriteHeader(resp.status)
+			w.Write(resp.body)
+			return
+
+		case resp.status/100 != 2:
+			clusterRequests.WithLabelValues(resp.cluster.Name, fmt.Sprintf("%d", resp.status)).Inc()
+			warnings = append(warnings, fmt.Sprintf("cluster %s: HTTP status %d", resp.cluster.Name, resp.status))
+			continue
+		}
+
+		var qr queryResponse
+		if err := json.Unmarshal(resp.body, &qr); err != nil {
+			clusterRequests.WithLabelValues(resp.cluster.Name, "error").Inc()
+			warnings = append(warnings, fmt.Sprintf("cluster %s: %v", resp.cluster.Name, err))
+			continue
+		}
+		clusterRequests.WithLabelValues(resp.cluster.Name, fmt.Sprintf("%d", resp.status)).Inc()
+		qr.cluster = resp.index
+		results = append(results, qr)
+	}
+	sort.Strings(warnings)
+
+	if len(results) == 0 {
+		http.Error(w, fmt.Sprintf("all clusters failed: %s", strings.Join(warnings, "; ")), http.StatusBadGateway)
+		return
+	}
+
+	result, err := merge(results, p.cfg.DedupLabels)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result.Warnings = warnings
+	util.WriteJSONResponse(w, result)
+}
+
+func (p *Proxy) query(r *http.Request, cluster Cluster) clusterResponse {
+	u := *cluster.URL
+	u.Path = strings.TrimRight(u.Path, "/") + r.URL.Path
+	u.RawQuery = r.Form.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return clusterResponse{cluster: cluster, err: err}
+	}
+	for k, vs := range r.Header {
+		req.Header[k] = vs
+	}
+	req.Header.Del("Content-Type")
+	req.Header.Del("Content-Length")
+
+	ctx, cancel := context.WithTimeout(r.Context(), p.cfg.RequestTimeout)
+	defer cancel()
+	resp, err := ctxhttp.Do(ctx, p.client, req)
+	if err != nil {
+		return clusterResponse{cluster: cluster, err: err}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return clusterResponse{cluster: cluster, err: err}
+	}
+	return clusterResponse{cluster: cluster, status: resp.StatusCode, body: body}
+}
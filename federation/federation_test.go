@@ -0,0 +1,122 @@
+package federation
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+type result struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string       `json:"resultType"`
+		Result     model.Matrix `json:"result"`
+	} `json:"data"`
+	Warnings []string `json:"warnings"`
+}
+
+func newCluster(t *testing.T, region string, values ...model.SamplePair) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("query") == "invalid" {
+			http.Error(w, "parse error", http.StatusBadRequest)
+			return
+		}
+		matrix := model.Matrix{
+			{
+				Metric: model.Metric{model.MetricNameLabel: "up", "region": model.LabelValue(region)},
+				Values: values,
+			},
+			{
+				Metric: model.Metric{model.MetricNameLabel: "only_in", "cluster": model.LabelValue(region)},
+				Values: values,
+			},
+		}
+		buf, err := json.Marshal(matrix)
+		require.NoError(t, err)
+		util.WriteJSONResponse(w, queryResponse{
+			Status: "success",
+			Data: queryData{
+				ResultType: model.ValMatrix.String(),
+				Result:     buf,
+			},
+		})
+	}))
+}
+
+func newProxy(t *testing.T, servers ...*httptest.Server) *Proxy {
+	var cfg Config
+	for i, s := range servers {
+		require.NoError(t, cfg.Clusters.Set(string('a'+rune(i))+"="+s.URL))
+	}
+	require.NoError(t, cfg.DedupLabels.Set("region"))
+	cfg.RequestTimeout = time.Minute
+	p, err := New(cfg)
+	require.NoError(t, err)
+	return p
+}
+
+func doQuery(p *Proxy, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/prom/api/v1/query_range?query="+query+"&start=0&end=3&step=1", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	return w
+}
+
+func TestProxyMergesAndDedupes(t *testing.T) {
+	a := newCluster(t, "eu", model.SamplePair{Timestamp: 1000, Value: 1}, model.SamplePair{Timestamp: 3000, Value: 3})
+	defer a.Close()
+	b := newCluster(t, "us", model.SamplePair{Timestamp: 2000, Value: 2}, model.SamplePair{Timestamp: 3000, Value: 4})
+	defer b.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	w := doQuery(newProxy(t, a, b, down), "up")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp result
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, []string{"cluster c: HTTP status 503"}, resp.Warnings)
+
+	expected := model.Matrix{
+		{
+			Metric: model.Metric{model.MetricNameLabel: "up"},
+			Values: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}, {Timestamp: 3000, Value: 3}},
+		},
+		{
+			Metric: model.Metric{model.MetricNameLabel: "only_in", "cluster": "eu"},
+			Values: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 3000, Value: 3}},
+		},
+		{
+			Metric: model.Metric{model.MetricNameLabel: "only_in", "cluster": "us"},
+			Values: []model.SamplePair{{Timestamp: 2000, Value: 2}, {Timestamp: 3000, Value: 4}},
+		},
+	}
+	assert.Equal(t, expected, resp.Data.Result)
+}
+
+func TestProxyErrors(t *testing.T) {
+	a := newCluster(t, "eu")
+	defer a.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	// Invalid queries are passed straight back.
+	w := doQuery(newProxy(t, a, down), "invalid")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// The query fails if every cluster is down.
+	w = doQuery(newProxy(t, down, down), "up")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+}
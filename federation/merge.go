@@ -0,0 +1,120 @@
+package federation
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+type queryResponse struct {
+	Status   string    `json:"status"`
+	Data     queryData `json:"data"`
+	Warnings []string  `json:"warnings,omitempty"`
+
+	// Position of the cluster in the config, clusters listed first take
+	// precedence when deduplicating.
+	cluster int
+}
+
+type queryData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// merge the results of the same query from multiple clusters.  Series which
+// only differ by the dedup labels are considered the same series, and are
+// returned without those labels.
+func merge(results []queryResponse, dedupLabels []string) (queryResponse, error) {
+	sort.Slice(results, func(i, j int) bool { return results[i].cluster < results[j].cluster })
+
+	resultType := results[0].Data.ResultType
+	for _, r := range results[1:] {
+		if r.Data.ResultType != resultType {
+			return queryResponse{}, fmt.Errorf("clusters returned different result types: %s and %s", resultType, r.Data.ResultType)
+		}
+	}
+
+	var (
+		merged interface{}
+		err    error
+	)
+	switch resultType {
+	case model.ValMatrix.String():
+		merged, err = mergeMatrices(results, dedupLabels)
+	case model.ValVector.String():
+		merged, err = mergeVectors(results, dedupLabels)
+	default:
+		// Scalars and strings don't depend on the data in the cluster.
+		return queryResponse{Status: "success", Data: results[0].Data}, nil
+	}
+	if err != nil {
+		return queryResponse{}, err
+	}
+
+	buf, err := json.Marshal(merged)
+	if err != nil {
+		return queryResponse{}, err
+	}
+	return queryResponse{
+		Status: "success",
+		Data: queryData{
+			ResultType: resultType,
+			Result:     buf,
+		},
+	}, nil
+}
+
+func mergeMatrices(results []queryResponse, dedupLabels []string) (model.Matrix, error) {
+	merged := model.Matrix{}
+	streams := map[model.Fingerprint]*model.SampleStream{}
+	for _, r := range results {
+		var matrix model.Matrix
+		if err := json.Unmarshal(r.Data.Result, &matrix); err != nil {
+			return nil, err
+		}
+		for _, ss := range matrix {
+			removeLabels(ss.Metric, dedupLabels)
+			fp := ss.Metric.Fingerprint()
+			existing, ok := streams[fp]
+			if !ok {
+				streams[fp] = ss
+				merged = append(merged, ss)
+				continue
+			}
+			// Fill in any gaps from the other clusters.
+			existing.Values = util.MergeSamples(existing.Values, ss.Values)
+		}
+	}
+	return merged, nil
+}
+
+func mergeVectors(results []queryResponse, dedupLabels []string) (model.Vector, error) {
+	merged := model.Vector{}
+	seen := map[model.Fingerprint]struct{}{}
+	for _, r := range results {
+		var vector model.Vector
+		if err := json.Unmarshal(r.Data.Result, &vector); err != nil {
+			return nil, err
+		}
+		for _, s := range vector {
+			removeLabels(s.Metric, dedupLabels)
+			fp := s.Metric.Fingerprint()
+			if _, ok := seen[fp]; ok {
+				continue
+			}
+			seen[fp] = struct{}{}
+			merged = append(merged, s)
+		}
+	}
+	return merged, nil
+}
+
+func removeLabels(metric model.Metric, labels []string) {
+	for _, l := range labels {
+		delete(metric, model.LabelName(l))
+	}
+}
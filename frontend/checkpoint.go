@@ -0,0 +1,61 @@
+package frontend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// checkpointKey identifies the result of one interval of a range query.
+// Memcache keys are limited in length and can't contain whitespace, so we
+// hash the query.
+func checkpointKey(userID, path string, query rangeQuery, interval interval) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%d\x00%d\x00%d", userID, path, query.query, query.step, interval.start, interval.end)
+	return "frontend:" + hex.EncodeToString(h.Sum(nil))
+}
+
+func (f *Frontend) fetchCheckpoint(key string) (model.Matrix, bool) {
+	if f.checkpoints == nil {
+		return nil, false
+	}
+	items, err := f.checkpoints.GetMulti([]string{key})
+	if err != nil {
+		log.Warnf("Error fetching checkpoint from memcache: %v", err)
+		return nil, false
+	}
+	item, ok := items[key]
+	if !ok {
+		return nil, false
+	}
+	var matrix model.Matrix
+	if err := json.Unmarshal(item.Value, &matrix); err != nil {
+		log.Warnf("Error decoding checkpoint from memcache: %v", err)
+		return nil, false
+	}
+	return matrix, true
+}
+
+func (f *Frontend) storeCheckpoint(key string, matrix model.Matrix) {
+	if f.checkpoints == nil {
+		return
+	}
+	buf, err := json.Marshal(matrix)
+	if err != nil {
+		log.Warnf("Error encoding checkpoint: %v", err)
+		return
+	}
+	if err := f.checkpoints.Set(&memcache.Item{
+		Key:        key,
+		Value:      buf,
+		Expiration: int32(f.cfg.CheckpointExpiration.Seconds()),
+	}); err != nil {
+		log.Warnf("Error storing checkpoint in memcache: %v", err)
+	}
+}
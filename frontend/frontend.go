@@ -0,0 +1,354 @@
+package frontend
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+var (
+	subQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "frontend_sub_queries_total",
+		Help:      "The total number of sub-queries split range queries were broken into, by where their result came from.",
+	}, []string{"source"})
+	subQueryRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "frontend_sub_query_retries_total",
+		Help:      "The total number of sub-queries retried after a downstream failure.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(subQueries)
+	prometheus.MustRegister(subQueryRetries)
+}
+
+// Config for a Frontend.
+type Config struct {
+	DownstreamURL        util.URLValue
+	DownstreamTLS        util.TLSConfig
+	SplitQueriesBy       time.Duration
+	AlignQueriesWithStep bool
+	MaxRetries           int
+	CheckpointMinAge     time.Duration
+	CheckpointExpiration time.Duration
+
+	memcacheConfig chunk.MemcacheConfig
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.Var(&cfg.DownstreamURL, "frontend.downstream-url", "URL of the queriers to send queries to, including their -http.prefix, if any. Use an https:// URL for TLS.")
+	cfg.DownstreamTLS.RegisterFlagsWithPrefix("frontend.downstream-", "the queriers", f)
+	f.DurationVar(&cfg.SplitQueriesBy, "frontend.split-queries-by", 24*time.Hour, "Split range queries into sub-queries aligned to intervals of this length. 0 to disable.")
+	f.BoolVar(&cfg.AlignQueriesWithStep, "frontend.align-queries-with-step", false, "Round range queries' start and end down to multiples of their step, so repeated queries, e.g. from refreshing dashboards, are identical and their sub-queries' results can be reused. Results are then evaluated at slightly different times than requested.")
+	f.IntVar(&cfg.MaxRetries, "frontend.max-retries", 5, "Maximum number of times to retry a sub-query which failed downstream.")
+	f.DurationVar(&cfg.CheckpointMinAge, "frontend.checkpoint-min-age", 10*time.Minute, "Only checkpoint the results of sub-queries which ended at least this long ago, as newer results may still change.")
+	f.DurationVar(&cfg.CheckpointExpiration, "frontend.checkpoint-expiration", 24*time.Hour, "How long checkpointed sub-query results are kept in memcache.")
+	cfg.memcacheConfig.RegisterFlags(f)
+}
+
+// Frontend sits in front of the queriers, splitting long range queries into
+// sub-queries by interval and executing them in turn.  Completed sub-query
+// results are checkpointed to memcache, so a restart or downstream failure
+// part way through a long query resumes from the last completed interval.
+type Frontend struct {
+	cfg         Config
+	proxy       http.Handler
+	client      *http.Client
+	checkpoints chunk.Memcache
+	memcache    *chunk.MemcacheClient
+}
+
+// New makes a new Frontend.
+func New(cfg Config) (*Frontend, error) {
+	if cfg.DownstreamURL.URL == nil {
+		return nil, fmt.Errorf("no downstream URL configured")
+	}
+	var transport http.RoundTripper
+	if cfg.DownstreamURL.URL.Scheme == "https" {
+		tlsConfig, err := cfg.DownstreamTLS.GetTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}
+	}
+	// Queries, and sub-queries, continue the trace of the request they're for.
+	proxy := httputil.NewSingleHostReverseProxy(cfg.DownstreamURL.URL)
+	proxy.Transport = util.TracedTransport{RoundTripper: transport}
+	f := &Frontend{
+		cfg:    cfg,
+		proxy:  proxy,
+		client: &http.Client{Transport: util.TracedTransport{RoundTripper: transport}},
+	}
+	if cfg.memcacheConfig.Host != "" {
+		f.memcache = chunk.NewMemcacheClient(cfg.memcacheConfig)
+		f.checkpoints = f.memcache
+	}
+	return f, nil
+}
+
+// Stop the Frontend.
+func (f *Frontend) Stop() {
+	if f.memcache != nil {
+		f.memcache.Stop()
+	}
+}
+
+// ServeHTTP splits, aligns and executes range queries, and proxies
+// everything else to the queriers.  It must be wrapped by middleware which
+// authenticates the user.
+func (f *Frontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (f.cfg.SplitQueriesBy <= 0 && !f.cfg.AlignQueriesWithStep) || !strings.HasSuffix(r.URL.Path, "/query_range") {
+		f.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	query, err := parseRangeQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.cfg.AlignQueriesWithStep {
+		query = query.alignToStep()
+	}
+	intervals := []interval{{start: query.start, end: query.end}}
+	if f.cfg.SplitQueriesBy > 0 {
+		intervals = query.split(f.cfg.SplitQueriesBy)
+	}
+
+	result := model.Matrix{}
+	streams := map[model.Fingerprint]*model.SampleStream{}
+	for _, interval := range intervals {
+		matrix, err := f.subQuery(r, userID, query, interval)
+		if err != nil {
+			if herr, ok := err.(httpError); ok {
+				w.WriteHeader(herr.status)
+				w.Write(herr.body)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		for _, stream := range matrix {
+			fp := stream.Metric.Fingerprint()
+			existing, ok := streams[fp]
+			if !ok {
+				streams[fp] = stream
+				result = append(result, stream)
+				continue
+			}
+			existing.Values = append(existing.Values, stream.Values...)
+		}
+	}
+
+	util.WriteJSONResponse(w, queryResponse{
+		Status: "success",
+		Data: queryData{
+			ResultType: model.ValMatrix.String(),
+			Result:     result,
+		},
+	})
+}
+
+// subQuery returns the result for one interval of a range query, either from
+// a checkpoint or by querying downstream.
+func (f *Frontend) subQuery(r *http.Request, userID string, query rangeQuery, interval interval) (model.Matrix, error) {
+	key := checkpointKey(userID, r.URL.Path, query, interval)
+	if matrix, ok := f.fetchCheckpoint(key); ok {
+		subQueries.WithLabelValues("checkpoint").Inc()
+		return matrix, nil
+	}
+
+	var (
+		matrix model.Matrix
+		err    error
+	)
+	for tries := 0; tries <= f.cfg.MaxRetries; tries++ {
+		if tries > 0 {
+			subQueryRetries.Inc()
+		}
+		matrix, err = f.doSubQuery(r, interval)
+		if err == nil {
+			break
+		}
+		// Don't retry requests which were rejected as invalid.
+		if herr, ok := err.(httpError); ok && herr.status/100 == 4 {
+			return nil, err
+		}
+		if r.Context().Err() != nil {
+			return nil, err
+		}
+		log.Warnf("Error executing sub-query for %s: %v", userID, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	subQueries.WithLabelValues("downstream").Inc()
+
+	if interval.end.Time().Before(time.Now().Add(-f.cfg.CheckpointMinAge)) {
+		f.storeCheckpoint(key, matrix)
+	}
+	return matrix, nil
+}
+
+func (f *Frontend) doSubQuery(r *http.Request, interval interval) (model.Matrix, error) {
+	values := url.Values{}
+	for k, vs := range r.Form {
+		values[k] = vs
+	}
+	values.Set("start", interval.start.String())
+	values.Set("end", interval.end.String())
+
+	u := *f.cfg.DownstreamURL.URL
+	u.Path = strings.TrimRight(u.Path, "/") + r.URL.Path
+	u.RawQuery = values.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range r.Header {
+		req.Header[k] = vs
+	}
+	req.Header.Del("Content-Type")
+	req.Header.Del("Content-Length")
+
+	resp, err := ctxhttp.Do(r.Context(), f.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, httpError{status: resp.StatusCode, body: body}
+	}
+
+	var qr queryResponse
+	if err := json.Unmarshal(body, &qr); err != nil {
+		return nil, err
+	}
+	if qr.Data.ResultType != model.ValMatrix.String() {
+		return nil, fmt.Errorf("unexpected result type %q", qr.Data.ResultType)
+	}
+	return qr.Data.Result, nil
+}
+
+type httpError struct {
+	status int
+	body   []byte
+}
+
+func (e httpError) Error() string {
+	return fmt.Sprintf("downstream returned HTTP status %d: %s", e.status, e.body)
+}
+
+type queryResponse struct {
+	Status string    `json:"status"`
+	Data   queryData `json:"data"`
+}
+
+type queryData struct {
+	ResultType string       `json:"resultType"`
+	Result     model.Matrix `json:"result"`
+}
+
+type rangeQuery struct {
+	query      string
+	start, end model.Time
+	step       time.Duration
+}
+
+type interval struct {
+	start, end model.Time
+}
+
+func parseRangeQuery(r *http.Request) (rangeQuery, error) {
+	if err := r.ParseForm(); err != nil {
+		return rangeQuery{}, err
+	}
+	start, err := util.ParseTime(r.FormValue("start"))
+	if err != nil {
+		return rangeQuery{}, fmt.Errorf("invalid start: %v", err)
+	}
+	end, err := util.ParseTime(r.FormValue("end"))
+	if err != nil {
+		return rangeQuery{}, fmt.Errorf("invalid end: %v", err)
+	}
+	if end.Before(start) {
+		return rangeQuery{}, fmt.Errorf("end timestamp must not be before start time")
+	}
+	step, err := util.ParseDuration(r.FormValue("step"))
+	if err != nil {
+		return rangeQuery{}, fmt.Errorf("invalid step: %v", err)
+	}
+	if step <= 0 {
+		return rangeQuery{}, fmt.Errorf("zero or negative query resolution step widths are not accepted")
+	}
+	// Queries are aligned and split in whole milliseconds.
+	if step < time.Millisecond {
+		return rangeQuery{}, fmt.Errorf("query resolution step widths under 1ms are not accepted")
+	}
+	return rangeQuery{
+		query: r.FormValue("query"),
+		start: start,
+		end:   end,
+		step:  step,
+	}, nil
+}
+
+// alignToStep rounds the query's start and end down to multiples of its step.
+func (q rangeQuery) alignToStep() rangeQuery {
+	step := int64(q.step / time.Millisecond)
+	q.start = model.Time(int64(q.start) / step * step)
+	q.end = model.Time(int64(q.end) / step * step)
+	return q
+}
+
+// split the query into intervals aligned to multiples of interval.  Each
+// interval only contains evaluation timestamps of the original query, so the
+// results can be concatenated without duplicates.
+func (q rangeQuery) split(by time.Duration) []interval {
+	var (
+		result []interval
+		step   = int64(q.step / time.Millisecond)
+		split  = int64(by / time.Millisecond)
+	)
+	for cur := int64(q.start); cur <= int64(q.end); {
+		boundary := (cur/split + 1) * split
+		end := cur + ((boundary-1-cur)/step)*step
+		if end > int64(q.end) {
+			end = int64(q.end)
+		}
+		result = append(result, interval{start: model.Time(cur), end: model.Time(end)})
+		cur = end + step
+	}
+	return result
+}
@@ -0,0 +1,317 @@
+package frontend
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/auth"
+	"github.com/weaveworks/cortex/util"
+)
+
+type mockMemcache struct {
+	sync.Mutex
+	contents map[string][]byte
+}
+
+func (m *mockMemcache) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	m.Lock()
+	defer m.Unlock()
+	result := map[string]*memcache.Item{}
+	for _, k := range keys {
+		if v, ok := m.contents[k]; ok {
+			result[k] = &memcache.Item{Key: k, Value: v}
+		}
+	}
+	return result, nil
+}
+
+func (m *mockMemcache) Set(item *memcache.Item) error {
+	m.Lock()
+	defer m.Unlock()
+	m.contents[item.Key] = item.Value
+	return nil
+}
+
+// mockQuerier returns a single series with a sample at every step, and
+// fails any query whose start is in failing.
+type mockQuerier struct {
+	sync.Mutex
+	requests []url.Values
+	failing  map[string]int
+}
+
+func (m *mockQuerier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	m.requests = append(m.requests, r.URL.Query())
+	start := r.FormValue("start")
+	if m.failing[start] > 0 {
+		m.failing[start]--
+		m.Unlock()
+		http.Error(w, "downstream unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	m.Unlock()
+
+	if userID, _, err := user.ExtractFromHTTPRequest(r); err != nil || userID != "1" {
+		http.Error(w, "no org id", http.StatusUnauthorized)
+		return
+	}
+	startT, _ := util.ParseTime(start)
+	endT, _ := util.ParseTime(r.FormValue("end"))
+	step, _ := util.ParseDuration(r.FormValue("step"))
+	stream := &model.SampleStream{Metric: model.Metric{model.MetricNameLabel: "foo"}}
+	for t := startT; !t.After(endT); t = t.Add(step) {
+		stream.Values = append(stream.Values, model.SamplePair{Timestamp: t, Value: model.SampleValue(t)})
+	}
+	util.WriteJSONResponse(w, queryResponse{
+		Status: "success",
+		Data: queryData{
+			ResultType: model.ValMatrix.String(),
+			Result:     model.Matrix{stream},
+		},
+	})
+}
+
+func newTestFrontend(t *testing.T, querier *mockQuerier, maxRetries int) (*Frontend, *httptest.Server) {
+	server := httptest.NewServer(querier)
+	var cfg Config
+	require.NoError(t, cfg.DownstreamURL.Set(server.URL))
+	cfg.SplitQueriesBy = 24 * time.Hour
+	cfg.MaxRetries = maxRetries
+	cfg.CheckpointMinAge = time.Hour
+	f, err := New(cfg)
+	require.NoError(t, err)
+	f.checkpoints = &mockMemcache{contents: map[string][]byte{}}
+	return f, server
+}
+
+func doQuery(f *Frontend, start, end model.Time, step time.Duration) *httptest.ResponseRecorder {
+	values := url.Values{}
+	values.Set("query", "foo")
+	values.Set("start", start.String())
+	values.Set("end", end.String())
+	values.Set("step", model.Duration(step).String())
+	req := httptest.NewRequest("GET", "/api/prom/api/v1/query_range?"+values.Encode(), nil)
+	ctx := user.Inject(context.Background(), "1")
+	user.InjectIntoHTTPRequest(ctx, req)
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	return w
+}
+
+func TestSplit(t *testing.T) {
+	day := model.Time(24 * time.Hour / time.Millisecond)
+	for i, tc := range []struct {
+		start, end model.Time
+		step       time.Duration
+		expected   []interval
+	}{
+		{0, day - 1000, time.Second, []interval{{0, day - 1000}}},
+		{0, day, time.Second, []interval{{0, day - 1000}, {day, day}}},
+		{day / 2, 2 * day, time.Hour, []interval{{day / 2, day - model.Time(time.Hour/time.Millisecond)}, {day, 2*day - model.Time(time.Hour/time.Millisecond)}, {2 * day, 2 * day}}},
+		{1000, 2*day + 1000, 7 * time.Hour, []interval{
+			{1000, 1000 + 3*model.Time(7*time.Hour/time.Millisecond)},
+			{1000 + 4*model.Time(7*time.Hour/time.Millisecond), 1000 + 6*model.Time(7*time.Hour/time.Millisecond)},
+		}},
+	} {
+		q := rangeQuery{start: tc.start, end: tc.end, step: tc.step}
+		assert.Equal(t, tc.expected, q.split(24*time.Hour), "case %d", i)
+	}
+}
+
+func TestFrontendSplitsAndMerges(t *testing.T) {
+	querier := &mockQuerier{}
+	f, server := newTestFrontend(t, querier, 0)
+	defer server.Close()
+
+	start := model.Now().Add(-90 * 24 * time.Hour)
+	end := model.Now().Add(-2 * time.Hour)
+	w := doQuery(f, start, end, time.Hour)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.True(t, len(querier.requests) >= 90)
+
+	var resp queryResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Data.Result, 1)
+	values := resp.Data.Result[0].Values
+	for i, v := range values {
+		assert.Equal(t, start.Add(time.Duration(i)*time.Hour), v.Timestamp)
+	}
+	assert.Equal(t, end, values[len(values)-1].Timestamp)
+}
+
+func TestFrontendDownstreamTLS(t *testing.T) {
+	querier := &mockQuerier{}
+	server := httptest.NewTLSServer(querier)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "frontend-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caPath := filepath.Join(dir, "ca.crt")
+	require.NoError(t, ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+
+	for _, tc := range []struct {
+		name string
+		tls  util.TLSConfig
+		ok   bool
+	}{
+		{"verified", util.TLSConfig{CAPath: caPath}, true},
+		{"unknown CA", util.TLSConfig{}, false},
+	} {
+		var cfg Config
+		require.NoError(t, cfg.DownstreamURL.Set(server.URL))
+		cfg.DownstreamTLS = tc.tls
+		cfg.SplitQueriesBy = 24 * time.Hour
+		f, err := New(cfg)
+		require.NoError(t, err)
+
+		end := model.Now().Add(-2 * time.Hour)
+		w := doQuery(f, end.Add(-time.Hour), end, time.Minute)
+		assert.Equal(t, tc.ok, w.Code == http.StatusOK, "%s: %s", tc.name, w.Body.String())
+	}
+}
+
+func TestFrontendResumesFromCheckpoint(t *testing.T) {
+	querier := &mockQuerier{}
+	f, server := newTestFrontend(t, querier, 0)
+	defer server.Close()
+
+	end := model.Now().Add(-2 * time.Hour)
+	start := end.Add(-10 * 24 * time.Hour)
+	intervals := rangeQuery{start: start, end: end, step: time.Minute}.split(24 * time.Hour)
+
+	// Fail the query part way through.
+	querier.failing = map[string]int{intervals[5].start.String(): 1}
+	w := doQuery(f, start, end, time.Minute)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Len(t, querier.requests, 6)
+
+	// Retrying should only query from the failed interval onwards.
+	querier.requests = nil
+	w = doQuery(f, start, end, time.Minute)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Len(t, querier.requests, len(intervals)-5)
+	assert.Equal(t, intervals[5].start.String(), querier.requests[0].Get("start"))
+
+	var resp queryResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Data.Result, 1)
+	assert.Len(t, resp.Data.Result[0].Values, int(end.Sub(start)/time.Minute)+1)
+}
+
+func TestFrontendRetries(t *testing.T) {
+	querier := &mockQuerier{}
+	f, server := newTestFrontend(t, querier, 2)
+	defer server.Close()
+
+	end := model.Now().Add(-2 * time.Hour)
+	start := end.Add(-time.Hour)
+	querier.failing = map[string]int{start.String(): 2}
+	w := doQuery(f, start, end, time.Minute)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// Give up once we run out of retries.
+	start = start.Add(-time.Minute)
+	querier.failing = map[string]int{start.String(): 3}
+	w = doQuery(f, start, end, time.Minute)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestFrontendForgedOrgID(t *testing.T) {
+	querier := &mockQuerier{}
+	f, server := newTestFrontend(t, querier, 0)
+	defer server.Close()
+	authenticate, err := auth.Config{OrgIDHeaderName: "X-Tenant"}.Authenticate()
+	require.NoError(t, err)
+	handler := authenticate.Wrap(f)
+
+	// The querier only answers tenant 1, so these are answered if and only
+	// if the tenant sent on is the authenticated one, not the forged one.
+	end := model.Now().Add(-2 * time.Hour)
+	for _, path := range []string{"/api/prom/api/v1/query_range", "/api/prom/api/v1/query"} {
+		for _, tc := range []struct {
+			tenant, forged string
+			ok             bool
+		}{
+			{"1", "2", true},
+			{"2", "1", false},
+		} {
+			values := url.Values{}
+			values.Set("query", "foo")
+			values.Set("start", end.Add(-time.Hour).String())
+			values.Set("end", end.String())
+			values.Set("step", "60")
+			req := httptest.NewRequest("GET", path+"?"+values.Encode(), nil)
+			req.Header.Set("X-Tenant", tc.tenant)
+			req.Header.Set(auth.DefaultOrgIDHeaderName, tc.forged)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, tc.ok, w.Code == http.StatusOK, "%s %+v: %d %s", path, tc, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAlignToStep(t *testing.T) {
+	q := rangeQuery{start: 61000, end: 179999, step: time.Minute}.alignToStep()
+	assert.Equal(t, model.Time(60000), q.start)
+	assert.Equal(t, model.Time(120000), q.end)
+
+	q = rangeQuery{start: 60000, end: 120000, step: time.Minute}.alignToStep()
+	assert.Equal(t, model.Time(60000), q.start)
+	assert.Equal(t, model.Time(120000), q.end)
+}
+
+func TestFrontendRejectsSubMillisecondSteps(t *testing.T) {
+	f, server := newTestFrontend(t, &mockQuerier{}, 0)
+	defer server.Close()
+	f.cfg.AlignQueriesWithStep = true
+
+	req := httptest.NewRequest("GET", "/api/prom/api/v1/query_range?query=foo&start=0&end=3600&step=0.0005", nil)
+	ctx := user.Inject(context.Background(), "1")
+	user.InjectIntoHTTPRequest(ctx, req)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req.WithContext(ctx))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestFrontendAlignsQueries(t *testing.T) {
+	querier := &mockQuerier{}
+	f, server := newTestFrontend(t, querier, 0)
+	defer server.Close()
+	f.cfg.AlignQueriesWithStep = true
+	f.cfg.SplitQueriesBy = 0
+
+	// Refreshing a dashboard shifts the query, but not past the next step,
+	// so the second query is answered from the checkpoint of the first.
+	end := model.TimeFromUnix(time.Now().Add(-2*time.Hour).Unix() / 60 * 60).Add(10 * time.Second)
+	start := end.Add(-time.Hour)
+	for _, shift := range []time.Duration{0, time.Second} {
+		w := doQuery(f, start.Add(shift), end.Add(shift), time.Minute)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp queryResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Data.Result, 1)
+		for _, v := range resp.Data.Result[0].Values {
+			assert.Equal(t, model.Time(0), v.Timestamp%model.Time(time.Minute/time.Millisecond))
+		}
+	}
+	assert.Len(t, querier.requests, 1)
+}
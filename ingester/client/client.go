@@ -18,16 +18,19 @@ type ingesterClient struct {
 }
 
 // MakeIngesterClient makes a new cortex.IngesterClient
-func MakeIngesterClient(addr string, timeout time.Duration) (cortex.IngesterClient, error) {
-	conn, err := grpc.Dial(
-		addr,
+func MakeIngesterClient(addr string, timeout time.Duration, cfg Config) (cortex.IngesterClient, error) {
+	opts, err := cfg.DialOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts,
 		grpc.WithTimeout(timeout),
-		grpc.WithInsecure(),
 		grpc.WithUnaryInterceptor(grpc_middleware.ChainUnaryClient(
 			otgrpc.OpenTracingClientInterceptor(opentracing.GlobalTracer()),
 			middleware.ClientUserHeaderInterceptor,
 		)),
 	)
+	conn, err := grpc.Dial(addr, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+func compression(name string) (grpc.Compressor, grpc.Decompressor, error) {
+	switch name {
+	case "snappy":
+		return snappyCompressor{}, snappyDecompressor{}, nil
+	case "gzip":
+		return grpc.NewGZIPCompressor(), grpc.NewGZIPDecompressor(), nil
+	default:
+		return nil, nil, fmt.Errorf("unknown gRPC compression %q; expected snappy or gzip", name)
+	}
+}
+
+// snappyCompressor is a grpc.Compressor using the snappy framing format.
+type snappyCompressor struct{}
+
+func (snappyCompressor) Do(w io.Writer, p []byte) error {
+	sw := util.GetSnappyBufferedWriter(w)
+	defer util.PutSnappyBufferedWriter(sw)
+	if _, err := sw.Write(p); err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+func (snappyCompressor) Type() string {
+	return "snappy"
+}
+
+// snappyDecompressor is a grpc.Decompressor using the snappy framing format.
+type snappyDecompressor struct{}
+
+func (snappyDecompressor) Do(r io.Reader) ([]byte, error) {
+	sr := util.GetSnappyReader(r)
+	defer util.PutSnappyReader(sr)
+	return ioutil.ReadAll(sr)
+}
+
+func (snappyDecompressor) Type() string {
+	return "snappy"
+}
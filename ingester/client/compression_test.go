@@ -0,0 +1,82 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+)
+
+// labelValuesServer echoes the requested label name back as its value.
+type labelValuesServer struct {
+	cortex.IngesterServer
+}
+
+func (labelValuesServer) LabelValues(_ context.Context, req *cortex.LabelValuesRequest) (*cortex.LabelValuesResponse, error) {
+	return &cortex.LabelValuesResponse{LabelValues: []string{req.LabelName}}, nil
+}
+
+func TestCompression(t *testing.T) {
+	for _, tc := range []struct {
+		server, client    string
+		compressResponses bool
+	}{
+		{"", "", false},
+		{"snappy", "", false},
+		{"snappy", "snappy", false},
+		{"snappy", "snappy", true},
+		{"gzip", "gzip", true},
+	} {
+		opts, err := ServerConfig{GRPCCompression: tc.server, GRPCCompressResponses: tc.compressResponses}.Options()
+		require.NoError(t, err)
+		server := grpc.NewServer(opts...)
+		cortex.RegisterIngesterServer(server, labelValuesServer{})
+		listener, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		go server.Serve(listener)
+
+		c, err := MakeIngesterClient(listener.Addr().String(), time.Second, Config{GRPCCompression: tc.client})
+		require.NoError(t, err)
+		ctx := user.Inject(context.Background(), "1")
+		resp, err := c.LabelValues(ctx, &cortex.LabelValuesRequest{LabelName: "foo"})
+		require.NoError(t, err, "%+v", tc)
+		assert.Equal(t, []string{"foo"}, resp.LabelValues)
+
+		c.(*ingesterClient).Close()
+		server.Stop()
+	}
+}
+
+// Clients have to accept compressed responses before they're turned on.
+func TestCompressedResponsesNeedClientSupport(t *testing.T) {
+	opts, err := ServerConfig{GRPCCompression: "snappy", GRPCCompressResponses: true}.Options()
+	require.NoError(t, err)
+	server := grpc.NewServer(opts...)
+	cortex.RegisterIngesterServer(server, labelValuesServer{})
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	c, err := MakeIngesterClient(listener.Addr().String(), time.Second, Config{})
+	require.NoError(t, err)
+	defer c.(*ingesterClient).Close()
+	_, err = c.LabelValues(user.Inject(context.Background(), "1"), &cortex.LabelValuesRequest{LabelName: "foo"})
+	assert.Error(t, err)
+}
+
+func TestCompressionConfig(t *testing.T) {
+	_, err := Config{GRPCCompression: "lz4"}.DialOptions()
+	assert.Error(t, err)
+	_, err = ServerConfig{GRPCCompression: "lz4"}.Options()
+	assert.Error(t, err)
+	_, err = ServerConfig{GRPCCompressResponses: true}.Options()
+	assert.Error(t, err)
+}
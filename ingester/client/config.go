@@ -0,0 +1,134 @@
+package client
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// Config configures the gRPC clients of the ingesters.
+type Config struct {
+	GRPCCompression   string
+	GRPCKeepaliveTime time.Duration
+
+	TLSEnabled bool
+	TLS        util.TLSConfig
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.GRPCCompression, "ingester.client.grpc-compression", "", "Compression to use on requests to the ingesters, and to accept on their responses: snappy, gzip or empty for none. The ingesters have to accept it first, with -ingester.grpc-compression.")
+	f.DurationVar(&cfg.GRPCKeepaliveTime, "ingester.client.grpc-keepalive-time", 0, "Period of TCP keepalive probes on connections to the ingesters, so idle connections aren't dropped by load balancers. 0 for the OS default.")
+	f.BoolVar(&cfg.TLSEnabled, "ingester.client.tls-enabled", false, "Use TLS to connect to the ingesters.")
+	cfg.TLS.RegisterFlagsWithPrefix("ingester.client.", "the ingesters", f)
+}
+
+// DialOptions returns the options to dial the ingesters with: their
+// transport credentials, keepalives, and the compression of requests and
+// responses.
+func (cfg Config) DialOptions() ([]grpc.DialOption, error) {
+	var opts []grpc.DialOption
+	if cfg.GRPCKeepaliveTime > 0 {
+		opts = append(opts, grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			dialer := net.Dialer{Timeout: timeout, KeepAlive: cfg.GRPCKeepaliveTime}
+			return dialer.Dial("tcp", addr)
+		}))
+	}
+	if cfg.TLSEnabled {
+		tlsConfig, err := cfg.TLS.GetTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+
+	if cfg.GRPCCompression != "" {
+		cp, dc, err := compression(cfg.GRPCCompression)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithCompressor(cp), grpc.WithDecompressor(dc))
+	}
+	return opts, nil
+}
+
+// ServerConfig configures the ingesters' gRPC server.
+type ServerConfig struct {
+	GRPCCompression          string
+	GRPCCompressResponses    bool
+	GRPCMaxRecvMsgSize       int
+	GRPCMaxConcurrentStreams uint
+
+	TLSCertPath     string
+	TLSKeyPath      string
+	TLSClientCAPath string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *ServerConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.GRPCCompression, "ingester.grpc-compression", "", "Compression to accept on gRPC requests: snappy, gzip or empty for none. Uncompressed requests are still accepted.")
+	f.BoolVar(&cfg.GRPCCompressResponses, "ingester.grpc-compress-responses", false, "Compress gRPC responses with -ingester.grpc-compression. Every client has to accept it first, with -ingester.client.grpc-compression.")
+	f.IntVar(&cfg.GRPCMaxRecvMsgSize, "ingester.grpc-max-recv-msg-size", 4<<20, "Limit on the size of a gRPC message the ingester accepts, in bytes.")
+	f.UintVar(&cfg.GRPCMaxConcurrentStreams, "ingester.grpc-max-concurrent-streams", 0, "Limit on the number of concurrent gRPC streams on each client connection. 0 for no limit.")
+	f.StringVar(&cfg.TLSCertPath, "ingester.grpc-tls-cert-path", "", "Certificate to serve gRPC with over TLS. If empty, gRPC is served without TLS.")
+	f.StringVar(&cfg.TLSKeyPath, "ingester.grpc-tls-key-path", "", "Key of the gRPC server certificate.")
+	f.StringVar(&cfg.TLSClientCAPath, "ingester.grpc-tls-client-ca-path", "", "CA certificates to verify client certificates with. If set, gRPC clients have to present a certificate signed by one of them.")
+}
+
+// Options returns the options for an ingester's gRPC server.  Uncompressed
+// requests are accepted along with compressed ones, but clients have to
+// accept compressed responses before they're turned on.
+func (cfg ServerConfig) Options() ([]grpc.ServerOption, error) {
+	var opts []grpc.ServerOption
+	if cfg.GRPCMaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.MaxMsgSize(cfg.GRPCMaxRecvMsgSize))
+	}
+	if uint64(cfg.GRPCMaxConcurrentStreams) > math.MaxUint32 {
+		return nil, fmt.Errorf("the gRPC concurrent stream limit can't be more than %d", uint32(math.MaxUint32))
+	}
+	if cfg.GRPCMaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(uint32(cfg.GRPCMaxConcurrentStreams)))
+	}
+	if cfg.TLSCertPath != "" || cfg.TLSKeyPath != "" {
+		tlsConfig := &tls.Config{}
+		var err error
+		if tlsConfig.Certificates, err = util.LoadCertificates(cfg.TLSCertPath, cfg.TLSKeyPath); err != nil {
+			return nil, err
+		}
+		if tlsConfig.ClientCAs, err = util.LoadCertPool(cfg.TLSClientCAPath); err != nil {
+			return nil, err
+		}
+		if tlsConfig.ClientCAs != nil {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	} else if cfg.TLSClientCAPath != "" {
+		return nil, fmt.Errorf("verifying client certificates needs a server certificate")
+	}
+
+	if cfg.GRPCCompression == "" {
+		if cfg.GRPCCompressResponses {
+			return nil, fmt.Errorf("compressing responses needs a compression")
+		}
+		return opts, nil
+	}
+	cp, dc, err := compression(cfg.GRPCCompression)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, grpc.RPCDecompressor(dc))
+	if cfg.GRPCCompressResponses {
+		opts = append(opts, grpc.RPCCompressor(cp))
+	}
+	return opts, nil
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+// writeCert writes a certificate and its key signed by parent, or
+// self-signed if parent is nil, to dir.
+func writeCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return cert, key
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingester-client-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "ingester"},
+		DNSNames:     []string{"ingester"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "distributor"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	opts, err := ServerConfig{
+		TLSCertPath:     path("server.crt"),
+		TLSKeyPath:      path("server.key"),
+		TLSClientCAPath: path("ca.crt"),
+	}.Options()
+	require.NoError(t, err)
+	server := grpc.NewServer(opts...)
+	cortex.RegisterIngesterServer(server, labelValuesServer{})
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	mutual := Config{
+		TLSEnabled: true,
+		TLS: util.TLSConfig{
+			CertPath:   path("client.crt"),
+			KeyPath:    path("client.key"),
+			CAPath:     path("ca.crt"),
+			ServerName: "ingester",
+		},
+	}
+	noClientCert := mutual
+	noClientCert.TLS.CertPath, noClientCert.TLS.KeyPath = "", ""
+	wrongName := mutual
+	wrongName.TLS.ServerName = "querier"
+
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"mutual TLS", mutual, true},
+		{"no client certificate", noClientCert, false},
+		{"wrong server name", wrongName, false},
+		{"no TLS", Config{}, false},
+	} {
+		c, err := MakeIngesterClient(listener.Addr().String(), time.Second, tc.cfg)
+		require.NoError(t, err, tc.name)
+		_, err = c.LabelValues(user.Inject(context.Background(), "1"), &cortex.LabelValuesRequest{LabelName: "foo"})
+		assert.Equal(t, tc.ok, err == nil, "%s: %v", tc.name, err)
+		c.(*ingesterClient).Close()
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	_, err := Config{TLSEnabled: true, TLS: util.TLSConfig{CertPath: "client.crt"}}.DialOptions()
+	assert.Error(t, err)
+	_, err = ServerConfig{TLSClientCAPath: "ca.crt"}.Options()
+	assert.Error(t, err)
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	opts, err := ServerConfig{GRPCMaxRecvMsgSize: 1024, GRPCMaxConcurrentStreams: 10}.Options()
+	require.NoError(t, err)
+	server := grpc.NewServer(opts...)
+	cortex.RegisterIngesterServer(server, labelValuesServer{})
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	c, err := MakeIngesterClient(listener.Addr().String(), time.Second, Config{GRPCKeepaliveTime: time.Minute})
+	require.NoError(t, err)
+	defer c.(*ingesterClient).Close()
+	ctx := user.Inject(context.Background(), "1")
+	_, err = c.LabelValues(ctx, &cortex.LabelValuesRequest{LabelName: "foo"})
+	require.NoError(t, err)
+	_, err = c.LabelValues(ctx, &cortex.LabelValuesRequest{LabelName: strings.Repeat("a", 2048)})
+	assert.Error(t, err)
+}
@@ -0,0 +1,176 @@
+package ingester
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+var (
+	flushedChunkCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cortex_ingester_flushed_chunk_cache_bytes",
+		Help: "The size of the compressed flushed chunks kept to serve queries.",
+	})
+	flushedChunkCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cortex_ingester_flushed_chunk_cache_evictions_total",
+		Help: "The total number of flushed chunks evicted from the cache to keep it under its max size.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(flushedChunkCacheBytes)
+	prometheus.MustRegister(flushedChunkCacheEvictions)
+}
+
+type flushedKey struct {
+	userID string
+	fp     model.Fingerprint
+}
+
+type flushedChunk struct {
+	key       flushedKey
+	firstTime model.Time
+	lastTime  model.Time
+	encoding  chunk.Encoding
+	buf       []byte // snappy compressed
+}
+
+// flushedChunkCache keeps compressed copies of the chunks of in-memory series
+// which have already been flushed, so queries for the recent window can be
+// served by the ingester alone while only the head chunks are kept
+// uncompressed.  When full, the chunks which were flushed first are evicted.
+type flushedChunkCache struct {
+	maxBytes int
+
+	mtx    sync.Mutex
+	bytes  int
+	order  *list.List // of *flushedChunk, in the order they were added
+	series map[flushedKey][]*list.Element
+}
+
+func newFlushedChunkCache(maxBytes int) *flushedChunkCache {
+	return &flushedChunkCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		series:   map[flushedKey][]*list.Element{},
+	}
+}
+
+// add compresses and caches the chunks of a series which were just flushed.
+func (c *flushedChunkCache) add(userID string, fp model.Fingerprint, descs []*desc) error {
+	key := flushedKey{userID, fp}
+	chunks := make([]*flushedChunk, 0, len(descs))
+	buf := make([]byte, chunk.ChunkLen)
+	for _, d := range descs {
+		if err := d.C.MarshalToBuf(buf); err != nil {
+			return err
+		}
+		chunks = append(chunks, &flushedChunk{
+			key:       key,
+			firstTime: d.FirstTime,
+			lastTime:  d.LastTime,
+			encoding:  d.C.Encoding(),
+			buf:       snappy.Encode(nil, buf),
+		})
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, fc := range chunks {
+		c.series[key] = append(c.series[key], c.order.PushBack(fc))
+		c.bytes += len(fc.buf)
+	}
+	for c.bytes > c.maxBytes && c.order.Len() > 0 {
+		c.evict(c.order.Front())
+		flushedChunkCacheEvictions.Inc()
+	}
+	flushedChunkCacheBytes.Set(float64(c.bytes))
+	return nil
+}
+
+// remove drops the chunks of a series which is no longer in memory.
+func (c *flushedChunkCache) remove(userID string, fp model.Fingerprint) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	elements := append([]*list.Element(nil), c.series[flushedKey{userID, fp}]...)
+	for _, e := range elements {
+		c.evict(e)
+	}
+	flushedChunkCacheBytes.Set(float64(c.bytes))
+}
+
+// expire drops chunks whose last sample is before the given time.
+func (c *flushedChunkCache) expire(before model.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for e := c.order.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*flushedChunk).lastTime.Before(before) {
+			c.evict(e)
+		}
+		e = next
+	}
+	flushedChunkCacheBytes.Set(float64(c.bytes))
+}
+
+// evict must be called with the lock held.
+func (c *flushedChunkCache) evict(e *list.Element) {
+	fc := c.order.Remove(e).(*flushedChunk)
+	c.bytes -= len(fc.buf)
+
+	elements := c.series[fc.key]
+	for i := range elements {
+		if elements[i] == e {
+			elements = append(elements[:i], elements[i+1:]...)
+			break
+		}
+	}
+	if len(elements) == 0 {
+		delete(c.series, fc.key)
+	} else {
+		c.series[fc.key] = elements
+	}
+}
+
+// samplesForRange returns the cached samples of a series in the range.
+func (c *flushedChunkCache) samplesForRange(userID string, fp model.Fingerprint, from, through model.Time) ([]model.SamplePair, error) {
+	c.mtx.Lock()
+	var chunks []*flushedChunk
+	for _, e := range c.series[flushedKey{userID, fp}] {
+		fc := e.Value.(*flushedChunk)
+		if !fc.lastTime.Before(from) && !fc.firstTime.After(through) {
+			chunks = append(chunks, fc)
+		}
+	}
+	c.mtx.Unlock()
+
+	in := metric.Interval{
+		OldestInclusive: from,
+		NewestInclusive: through,
+	}
+	var values []model.SamplePair
+	for _, fc := range chunks {
+		buf, err := snappy.Decode(nil, fc.buf)
+		if err != nil {
+			return nil, err
+		}
+		ch, err := chunk.NewForEncoding(fc.encoding)
+		if err != nil {
+			return nil, err
+		}
+		if err := ch.UnmarshalFromBuf(buf); err != nil {
+			return nil, err
+		}
+		chValues, err := chunk.RangeValues(ch.NewIterator(), in)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, chValues...)
+	}
+	return values, nil
+}
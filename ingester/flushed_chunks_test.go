@@ -0,0 +1,119 @@
+package ingester
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+func newTestDesc(t *testing.T, from, through model.Time) *desc {
+	c := chunk.New()
+	for ts := from; ts <= through; ts++ {
+		cs, err := c.Add(model.SamplePair{Timestamp: ts, Value: model.SampleValue(ts)})
+		require.NoError(t, err)
+		require.Len(t, cs, 1)
+		c = cs[0]
+	}
+	return newDesc(c, from, through)
+}
+
+func TestFlushedChunkCache(t *testing.T) {
+	cache := newFlushedChunkCache(1 << 20)
+	require.NoError(t, cache.add("1", 1, []*desc{newTestDesc(t, 0, 9), newTestDesc(t, 10, 19)}))
+	require.NoError(t, cache.add("1", 2, []*desc{newTestDesc(t, 0, 9)}))
+
+	values, err := cache.samplesForRange("1", 1, 5, 14)
+	require.NoError(t, err)
+	require.Len(t, values, 10)
+	assert.Equal(t, model.Time(5), values[0].Timestamp)
+	assert.Equal(t, model.Time(14), values[9].Timestamp)
+
+	values, err = cache.samplesForRange("2", 1, 0, 19)
+	require.NoError(t, err)
+	assert.Empty(t, values)
+
+	// Expiring drops chunks which end before the cutoff.
+	cache.expire(10)
+	values, err = cache.samplesForRange("1", 1, 0, 19)
+	require.NoError(t, err)
+	require.Len(t, values, 10)
+	assert.Equal(t, model.Time(10), values[0].Timestamp)
+	values, err = cache.samplesForRange("1", 2, 0, 19)
+	require.NoError(t, err)
+	assert.Empty(t, values)
+
+	cache.remove("1", 1)
+	assert.Equal(t, 0, cache.bytes)
+	assert.Empty(t, cache.series)
+}
+
+func TestFlushedChunkCacheEviction(t *testing.T) {
+	cache := newFlushedChunkCache(1 << 20)
+	require.NoError(t, cache.add("1", 1, []*desc{newTestDesc(t, 0, 9)}))
+	size := cache.bytes
+
+	// Only room for two chunks; the first added is evicted.
+	cache.maxBytes = 2*size + size/2
+	require.NoError(t, cache.add("1", 2, []*desc{newTestDesc(t, 0, 9)}))
+	require.NoError(t, cache.add("1", 3, []*desc{newTestDesc(t, 0, 9)}))
+	assert.Equal(t, 2*size, cache.bytes)
+	assert.Len(t, cache.series, 2)
+	_, ok := cache.series[flushedKey{"1", 1}]
+	assert.False(t, ok)
+}
+
+func TestIngesterQueriesFlushedChunks(t *testing.T) {
+	cfg := defaultIngesterTestConfig()
+	cfg.FlushedChunkCacheSize = 1 << 20
+	cfg.FlushedChunkRetention = time.Hour
+	cfg.MaxChunkAge = time.Hour
+	store := newTestStore()
+	ing, err := New(cfg, store, newTestOverrides(t, defaultLimitsTestConfig()))
+	require.NoError(t, err)
+	defer ing.Shutdown()
+
+	userID := "1"
+	ctx := user.Inject(context.Background(), userID)
+	m := model.Metric{model.MetricNameLabel: "foo"}
+	// Recent samples, so the head chunk isn't old enough to flush.
+	base := model.Now().Add(-time.Minute)
+	push := func(from, through model.Time) {
+		samples := []model.Sample{}
+		for ts := from; ts <= through; ts++ {
+			samples = append(samples, model.Sample{Metric: m, Timestamp: base + ts, Value: model.SampleValue(ts)})
+		}
+		_, err := ing.Push(ctx, util.ToWriteRequest(samples))
+		require.NoError(t, err)
+	}
+
+	// Two chunks; flushing the series flushes all but the open head.
+	push(1, 10)
+	state, ok := ing.userStates.get(userID)
+	require.True(t, ok)
+	fp := m.FastFingerprint()
+	series, ok := state.fpToSeries.get(fp)
+	require.True(t, ok)
+	series.closeHead()
+	push(11, 20)
+	require.NoError(t, ing.flushUserSeries(userID, fp, false))
+	require.Len(t, store.chunks[userID], 1)
+	require.Len(t, series.chunkDescs, 1)
+
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	require.NoError(t, err)
+	result, err := ing.query(ctx, base, base+30, []*metric.LabelMatcher{matcher})
+	require.NoError(t, err)
+	require.Len(t, result, 1)
+	require.Len(t, result[0].Values, 20)
+	assert.Equal(t, base+1, result[0].Values[0].Timestamp)
+	assert.Equal(t, base+20, result[0].Values[19].Timestamp)
+}
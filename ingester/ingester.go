@@ -12,7 +12,6 @@ import (
 	"google.golang.org/grpc/codes"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/local/chunk"
 	"github.com/prometheus/prometheus/storage/metric"
@@ -20,9 +19,12 @@ import (
 	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex"
 	cortex_chunk "github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/events"
 	"github.com/weaveworks/cortex/ingester/client"
+	"github.com/weaveworks/cortex/limits"
 	"github.com/weaveworks/cortex/ring"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 const (
@@ -35,10 +37,6 @@ const (
 
 	// DefaultConcurrentFlush is the number of series to flush concurrently
 	DefaultConcurrentFlush = 50
-	// DefaultMaxSeriesPerUser is the maximum number of series allowed per user.
-	DefaultMaxSeriesPerUser = 5000000
-	// DefaultMaxSeriesPerMetric is the maximum number of series in one metric (of a single user).
-	DefaultMaxSeriesPerMetric = 50000
 )
 
 var (
@@ -60,12 +58,12 @@ var (
 
 	// ErrOutOfOrderSample is returned if a sample has a timestamp before the latest
 	// timestamp in the series it is appended to.
-	ErrOutOfOrderSample = fmt.Errorf("sample timestamp out of order")
+	ErrOutOfOrderSample = util.ErrOutOfOrderSample
 	// ErrDuplicateSampleForTimestamp is returned if a sample has the same
 	// timestamp as the latest sample in the series it is appended to but a
 	// different value. (Appending an identical sample is a no-op and does
 	// not cause an error.)
-	ErrDuplicateSampleForTimestamp = fmt.Errorf("sample with repeated timestamp but different value")
+	ErrDuplicateSampleForTimestamp = util.ErrDuplicateSampleTimestamp
 )
 
 // Config for an Ingester.
@@ -80,6 +78,9 @@ type Config struct {
 	JoinAfter        time.Duration
 	SearchPendingFor time.Duration
 	ClaimOnRollout   bool
+	MaxDrainDuration time.Duration
+	Zone             string
+	Host             string
 
 	// Config for chunk flushing
 	FlushCheckPeriod  time.Duration
@@ -87,6 +88,16 @@ type Config struct {
 	MaxChunkAge       time.Duration
 	ConcurrentFlushes int
 	ChunkEncoding     string
+	BlockRange        time.Duration
+
+	// Config for serving flushed chunks from memory.
+	FlushedChunkCacheSize int
+	FlushedChunkRetention time.Duration
+
+	// Config of the ingester's gRPC server, and of the client it transfers
+	// chunks to another ingester with.
+	ServerConfig client.ServerConfig
+	ClientConfig client.Config
 
 	// For testing, you can override the address and ID of this ingester
 	addr                  string
@@ -95,22 +106,45 @@ type Config struct {
 	ingesterClientFactory func(addr string, timeout time.Duration) (cortex.IngesterClient, error)
 }
 
+// RingConfig returns the config of the ring the ingester joins.
+func (cfg *Config) RingConfig() ring.Config {
+	return cfg.ringConfig
+}
+
+// GRPCServerOptions returns the options the ingester's gRPC server needs for
+// the configured compression and TLS, and to pool query responses.
+func (cfg *Config) GRPCServerOptions() ([]grpc.ServerOption, error) {
+	opts, err := cfg.ServerConfig.Options()
+	if err != nil {
+		return nil, err
+	}
+	return append(opts, grpc.CustomCodec(pooledResponseCodec{})), nil
+}
+
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	cfg.ringConfig.RegisterFlags(f)
 	cfg.userStatesConfig.RegisterFlags(f)
+	cfg.ServerConfig.RegisterFlags(f)
+	cfg.ClientConfig.RegisterFlags(f)
 
 	f.IntVar(&cfg.NumTokens, "ingester.num-tokens", 128, "Number of tokens for each ingester.")
 	f.DurationVar(&cfg.HeartbeatPeriod, "ingester.heartbeat-period", 5*time.Second, "Period at which to heartbeat to consul.")
 	f.DurationVar(&cfg.JoinAfter, "ingester.join-after", 0*time.Second, "Period to wait for a claim from another ingester; will join automatically after this.")
 	f.DurationVar(&cfg.SearchPendingFor, "ingester.search-pending-for", 30*time.Second, "Time to spend searching for a pending ingester when shutting down.")
 	f.BoolVar(&cfg.ClaimOnRollout, "ingester.claim-on-rollout", false, "Send chunks to PENDING ingesters on exit.")
+	f.DurationVar(&cfg.MaxDrainDuration, "ingester.max-drain-duration", 0, "Maximum time to spend handing off or flushing chunks on shutdown, after which the ingester unregisters anyway and the chunks left are lost. Keep it below the time the process is given to stop, e.g. the Kubernetes termination grace period. 0 for no limit.")
+	f.StringVar(&cfg.Zone, "ingester.zone", "", "Zone (e.g. availability zone) this ingester runs in.")
+	f.StringVar(&cfg.Host, "ingester.host", "", "Host (e.g. node name) this ingester runs on. If set, the ingester refuses to become ACTIVE while another ingester in the same zone is on the same host.")
 
 	f.DurationVar(&cfg.FlushCheckPeriod, "ingester.flush-period", 1*time.Minute, "Period with which to attempt to flush chunks.")
 	f.DurationVar(&cfg.MaxChunkIdle, "ingester.max-chunk-idle", 1*time.Hour, "Maximum chunk idle time before flushing.")
 	f.DurationVar(&cfg.MaxChunkAge, "ingester.max-chunk-age", 12*time.Hour, "Maximum chunk age time before flushing.")
 	f.IntVar(&cfg.ConcurrentFlushes, "ingester.concurrent-flushes", DefaultConcurrentFlush, "Number of concurrent goroutines flushing to dynamodb.")
 	f.StringVar(&cfg.ChunkEncoding, "ingester.chunk-encoding", "1", "Encoding version to use for chunks.")
+	f.DurationVar(&cfg.BlockRange, "ingester.block-range", 0, "Experimental, for -store.blocks-storage or -store.batch-chunks: flush each user's chunks together, as one object, at the end of every period of this length, rather than series by series. 0 to flush series by series.")
+	f.IntVar(&cfg.FlushedChunkCacheSize, "ingester.flushed-chunk-cache-size", 0, "Size in bytes of the cache of compressed flushed chunks used to serve queries for series still in memory. 0 to disable.")
+	f.DurationVar(&cfg.FlushedChunkRetention, "ingester.flushed-chunk-retention", 1*time.Hour, "How long after their last sample to keep flushed chunks in the cache.")
 
 	addr, err := util.GetFirstAddressOf(infName)
 	if err != nil {
@@ -132,6 +166,7 @@ type Ingester struct {
 	cfg        Config
 	chunkStore ChunkStore
 	consul     ring.ConsulClient
+	limits     *limits.Overrides
 
 	userStatesMtx sync.RWMutex
 	userStates    *userStates
@@ -160,6 +195,16 @@ type Ingester struct {
 	// One queue per flush thread.  Fingerprint is used to
 	// pick a queue.
 	flushQueues []*util.PriorityQueue
+	flushLoops  sync.WaitGroup
+	// Closed when we give up flushing on shutdown.
+	flushAbort chan struct{}
+
+	// Whether the flush queues are currently backed up; only accessed from
+	// loop(), used to record flush storm events.
+	flushStorm bool
+
+	// Only set if the flushed chunk cache is enabled.
+	flushedChunks *flushedChunkCache
 
 	ingestedSamples  prometheus.Counter
 	chunkUtilization prometheus.Histogram
@@ -176,7 +221,7 @@ type ChunkStore interface {
 }
 
 // New constructs a new Ingester.
-func New(cfg Config, chunkStore ChunkStore) (*Ingester, error) {
+func New(cfg Config, chunkStore ChunkStore, limits *limits.Overrides) (*Ingester, error) {
 	if cfg.FlushCheckPeriod == 0 {
 		cfg.FlushCheckPeriod = 1 * time.Minute
 	}
@@ -192,14 +237,14 @@ func New(cfg Config, chunkStore ChunkStore) (*Ingester, error) {
 	if cfg.userStatesConfig.RateUpdatePeriod == 0 {
 		cfg.userStatesConfig.RateUpdatePeriod = 15 * time.Second
 	}
-	if cfg.userStatesConfig.MaxSeriesPerUser <= 0 {
-		cfg.userStatesConfig.MaxSeriesPerUser = DefaultMaxSeriesPerUser
-	}
-	if cfg.userStatesConfig.MaxSeriesPerMetric <= 0 {
-		cfg.userStatesConfig.MaxSeriesPerMetric = DefaultMaxSeriesPerMetric
-	}
 	if cfg.ingesterClientFactory == nil {
-		cfg.ingesterClientFactory = client.MakeIngesterClient
+		clientConfig := cfg.ClientConfig
+		if _, err := clientConfig.DialOptions(); err != nil {
+			return nil, err
+		}
+		cfg.ingesterClientFactory = func(addr string, timeout time.Duration) (cortex.IngesterClient, error) {
+			return client.MakeIngesterClient(addr, timeout, clientConfig)
+		}
 	}
 
 	if err := chunk.DefaultEncoding.Set(cfg.ChunkEncoding); err != nil {
@@ -216,7 +261,8 @@ func New(cfg Config, chunkStore ChunkStore) (*Ingester, error) {
 		cfg:        cfg,
 		consul:     consul,
 		chunkStore: chunkStore,
-		userStates: newUserStates(&cfg.userStatesConfig),
+		limits:     limits,
+		userStates: newUserStates(limits, &cfg.userStatesConfig),
 
 		addr: fmt.Sprintf("%s:%d", cfg.addr, *cfg.ListenPort),
 		id:   cfg.id,
@@ -227,6 +273,7 @@ func New(cfg Config, chunkStore ChunkStore) (*Ingester, error) {
 		startTime: time.Now(),
 
 		flushQueues: make([]*util.PriorityQueue, cfg.ConcurrentFlushes, cfg.ConcurrentFlushes),
+		flushAbort:  make(chan struct{}),
 
 		ingestedSamples: prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "cortex_ingester_ingested_samples_total",
@@ -261,7 +308,11 @@ func New(cfg Config, chunkStore ChunkStore) (*Ingester, error) {
 		}),
 	}
 
-	i.done.Add(cfg.ConcurrentFlushes)
+	i.flushLoops.Add(cfg.ConcurrentFlushes)
+	if cfg.FlushedChunkCacheSize > 0 {
+		i.flushedChunks = newFlushedChunkCache(cfg.FlushedChunkCacheSize)
+	}
+
 	for j := 0; j < cfg.ConcurrentFlushes; j++ {
 		i.flushQueues[j] = util.NewPriorityQueue()
 		go i.flushLoop(j)
@@ -276,11 +327,18 @@ func New(cfg Config, chunkStore ChunkStore) (*Ingester, error) {
 // Push implements cortex.IngesterServer
 func (i *Ingester) Push(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
 	var lastPartialErr error
+	userID, _ := user.Extract(ctx) // ignore err, append will fail without a userID
 	samples := util.FromWriteRequest(req)
 	for j := range samples {
 		if err := i.append(ctx, &samples[j]); err != nil {
-			if err == util.ErrUserSeriesLimitExceeded || err == util.ErrMetricSeriesLimitExceeded {
-				lastPartialErr = grpc.Errorf(codes.ResourceExhausted, err.Error())
+			switch err {
+			case util.ErrUserSeriesLimitExceeded:
+				lastPartialErr = grpc.Errorf(codes.ResourceExhausted, "%v (limit: %d)", err, i.limits.MaxSeriesPerUser(userID))
+				util.Discard(userID, util.DiscardPerUserSeriesLimit, 1, lastPartialErr)
+				continue
+			case util.ErrMetricSeriesLimitExceeded:
+				lastPartialErr = grpc.Errorf(codes.ResourceExhausted, "%v (limit: %d) for metric %s", err, i.limits.MaxSeriesPerMetric(userID), samples[j].Metric[model.MetricNameLabel])
+				util.Discard(userID, util.DiscardPerMetricSeriesLimit, 1, lastPartialErr)
 				continue
 			}
 			return nil, err
@@ -291,9 +349,9 @@ func (i *Ingester) Push(ctx context.Context, req *cortex.WriteRequest) (*cortex.
 }
 
 func (i *Ingester) append(ctx context.Context, sample *model.Sample) error {
-	if err := util.ValidateSample(sample); err != nil {
-		userID, _ := user.Extract(ctx) // ignore err, userID will be empty string if err
-		log.Errorf("Error validating sample from user '%s': %v", userID, err)
+	userID, _ := user.Extract(ctx) // ignore err, userID will be empty string if err
+	if err := i.limits.ValidateSample(userID, sample); err != nil {
+		util.WithContext(ctx, log.Base()).Errorf("Error validating sample: %v", err)
 		return nil
 	}
 
@@ -323,7 +381,13 @@ func (i *Ingester) append(ctx context.Context, sample *model.Sample) error {
 	if err := series.add(model.SamplePair{
 		Value:     sample.Value,
 		Timestamp: sample.Timestamp,
-	}); err != nil {
+	}, i.limits.DuplicateSamplePolicy(userID)); err != nil {
+		switch err {
+		case ErrOutOfOrderSample:
+			util.Discard(userID, util.DiscardOutOfOrder, 1, err)
+		case ErrDuplicateSampleForTimestamp:
+			util.Discard(userID, util.DiscardDuplicateTimestamp, 1, err)
+		}
 		return err
 	}
 
@@ -346,7 +410,7 @@ func (i *Ingester) Query(ctx context.Context, req *cortex.QueryRequest) (*cortex
 		return nil, err
 	}
 
-	return util.ToQueryResponse(matrix), nil
+	return getQueryResponse(matrix), nil
 }
 
 func (i *Ingester) query(ctx context.Context, from, through model.Time, matchers []*metric.LabelMatcher) (model.Matrix, error) {
@@ -361,12 +425,20 @@ func (i *Ingester) query(ctx context.Context, from, through model.Time, matchers
 
 	queriedSamples := 0
 	result := model.Matrix{}
-	err = state.forSeriesMatching(matchers, func(_ model.Fingerprint, series *memorySeries) error {
+	err = state.forSeriesMatching(matchers, func(fp model.Fingerprint, series *memorySeries) error {
 		values, err := series.samplesForRange(from, through)
 		if err != nil {
 			return err
 		}
 
+		if i.flushedChunks != nil {
+			flushed, err := i.flushedChunks.samplesForRange(state.userID, fp, from, through)
+			if err != nil {
+				return err
+			}
+			values = util.MergeSamples(flushed, values)
+		}
+
 		result = append(result, &model.SampleStream{
 			Metric: series.metric,
 			Values: values,
@@ -445,6 +517,36 @@ func (i *Ingester) UserStats(ctx context.Context, req *cortex.UserStatsRequest)
 	}, nil
 }
 
+// DeleteUser drops all the in-memory series of the current user, without
+// flushing them.  Samples pushed afterwards start new series.
+func (i *Ingester) DeleteUser(ctx context.Context, req *cortex.DeleteUserRequest) (*cortex.DeleteUserResponse, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	i.userStatesMtx.RLock()
+	defer i.userStatesMtx.RUnlock()
+	state, ok := i.userStates.remove(userID)
+	if !ok {
+		return &cortex.DeleteUserResponse{}, nil
+	}
+
+	var numSeries uint64
+	for pair := range state.fpToSeries.iter() {
+		state.fpLocker.Lock(pair.fp)
+		i.memoryChunks.Sub(float64(len(pair.series.chunkDescs)))
+		state.removeSeries(pair.fp, pair.series.metric)
+		if i.flushedChunks != nil {
+			i.flushedChunks.remove(userID, pair.fp)
+		}
+		state.fpLocker.Unlock(pair.fp)
+		numSeries++
+	}
+	events.Record("ingester", "user_deleted", "Ingester %s dropped %d series of user %s", i.id, numSeries, userID)
+	return &cortex.DeleteUserResponse{NumSeries: numSeries}, nil
+}
+
 // Describe implements prometheus.Collector.
 func (i *Ingester) Describe(ch chan<- *prometheus.Desc) {
 	ch <- memorySeriesDesc
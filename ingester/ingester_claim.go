@@ -32,12 +32,18 @@ func init() {
 
 // TransferChunks receives all the chunks from another ingester.
 func (i *Ingester) TransferChunks(stream cortex.Ingester_TransferChunksServer) error {
+	// Refuse chunks we couldn't serve: the transfer fails, and the leaving
+	// ingester flushes them instead.
+	if err := i.checkPlacement(); err != nil {
+		return err
+	}
+
 	// Enter JOINING state (only valid from PENDING)
 	if err := i.ChangeState(ring.JOINING); err != nil {
 		return err
 	}
 
-	userStates := newUserStates(&i.cfg.userStatesConfig)
+	userStates := newUserStates(i.limits, &i.cfg.userStatesConfig)
 	fromIngesterID := ""
 
 	for {
@@ -76,40 +82,45 @@ func (i *Ingester) TransferChunks(stream cortex.Ingester_TransferChunksServer) e
 		sentChunks.Add(float64(len(descs)))
 	}
 
-	if err := stream.SendAndClose(&cortex.TransferChunksResponse{}); err != nil {
-		return err
-	}
-
 	if err := i.ClaimTokensFor(fromIngesterID); err != nil {
 		return err
 	}
 
 	i.userStatesMtx.Lock()
-	defer i.userStatesMtx.Unlock()
-
 	if err := i.ChangeState(ring.ACTIVE); err != nil {
+		i.userStatesMtx.Unlock()
 		return err
 	}
 	i.userStates = userStates
+	i.userStatesMtx.Unlock()
 
-	return nil
+	// Only acknowledge the transfer once we're ACTIVE with the chunks; until
+	// then, any error leaves the leaving ingester to flush them.
+	return stream.SendAndClose(&cortex.TransferChunksResponse{})
 }
 
-func toWireChunks(descs []*desc) ([]cortex.Chunk, error) {
-	wireChunks := make([]cortex.Chunk, 0, len(descs))
-	for _, d := range descs {
-		wireChunk := cortex.Chunk{
-			StartTimestampMs: int64(d.FirstTime),
-			EndTimestampMs:   int64(d.LastTime),
-			Encoding:         int32(d.C.Encoding()),
-			Data:             make([]byte, chunk.ChunkLen, chunk.ChunkLen),
+// toWireChunks converts descs to wire chunks, reusing wireChunks and their
+// data buffers, which may be nil.
+func toWireChunks(descs []*desc, wireChunks []cortex.Chunk) ([]cortex.Chunk, error) {
+	wireChunks = wireChunks[:0]
+	for i, d := range descs {
+		if i < cap(wireChunks) {
+			wireChunks = wireChunks[:i+1]
+		} else {
+			wireChunks = append(wireChunks, cortex.Chunk{})
 		}
+		wireChunk := &wireChunks[i]
+		wireChunk.StartTimestampMs = int64(d.FirstTime)
+		wireChunk.EndTimestampMs = int64(d.LastTime)
+		wireChunk.Encoding = int32(d.C.Encoding())
+		if cap(wireChunk.Data) < chunk.ChunkLen {
+			wireChunk.Data = make([]byte, chunk.ChunkLen)
+		}
+		wireChunk.Data = wireChunk.Data[:chunk.ChunkLen]
 
 		if err := d.C.MarshalToBuf(wireChunk.Data); err != nil {
 			return nil, err
 		}
-
-		wireChunks = append(wireChunks, wireChunk)
 	}
 	return wireChunks, nil
 }
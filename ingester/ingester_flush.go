@@ -2,23 +2,39 @@ package ingester
 
 import (
 	"fmt"
+	"hash/fnv"
 	"time"
 
 	"golang.org/x/net/context"
 
-	"github.com/prometheus/common/log"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 
 	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/events"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 const (
 	// Backoff for retrying 'immediate' flushes. Only counts for queue
 	// position, not wallclock time.
 	flushBackoff = 1 * time.Second
+
+	// If more than this many series per flush queue are waiting to be
+	// flushed after a sweep, we record a flush storm event.
+	flushStormFactor = 100
 )
 
+var ephemeralChunksDiscarded = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "cortex_ingester_ephemeral_chunks_discarded_total",
+	Help: "The total number of chunks of ephemeral series discarded instead of being flushed.",
+})
+
+func init() {
+	prometheus.MustRegister(ephemeralChunksDiscarded)
+}
+
 type flushOp struct {
 	from      model.Time
 	userID    string
@@ -41,12 +57,35 @@ func (i *Ingester) sweepUsers(immediate bool) {
 	}
 
 	for id, state := range i.userStates.cp() {
+		if i.cfg.BlockRange > 0 {
+			i.sweepUser(id, state, immediate)
+			continue
+		}
 		for pair := range state.fpToSeries.iter() {
 			state.fpLocker.Lock(pair.fp)
 			i.sweepSeries(id, pair.fp, pair.series, immediate)
 			state.fpLocker.Unlock(pair.fp)
 		}
 	}
+
+	if i.flushedChunks != nil {
+		i.flushedChunks.expire(model.Now().Add(-i.cfg.FlushedChunkRetention))
+	}
+
+	queued := 0
+	for _, flushQueue := range i.flushQueues {
+		queued += flushQueue.Length()
+	}
+	if immediate {
+		events.Record("ingester", "flush_all", "Ingester %s flushing all series, %d queued for flush", i.id, queued)
+	}
+	storm := queued > flushStormFactor*i.cfg.ConcurrentFlushes
+	if storm && !i.flushStorm {
+		events.Record("ingester", "flush_storm_started", "Ingester %s has %d series queued for flush", i.id, queued)
+	} else if !storm && i.flushStorm {
+		events.Record("ingester", "flush_storm_ended", "Ingester %s has %d series queued for flush", i.id, queued)
+	}
+	i.flushStorm = storm
 }
 
 // sweepSeries schedules a series for flushing based on a set of criteria
@@ -67,6 +106,33 @@ func (i *Ingester) sweepSeries(userID string, fp model.Fingerprint, series *memo
 	}
 }
 
+// sweepUser schedules a user's series for flushing as a block, if they have
+// chunks from before the current block range.
+func (i *Ingester) sweepUser(userID string, state *userState, immediate bool) {
+	blockStart := i.blockStart()
+	flush := false
+	for pair := range state.fpToSeries.iter() {
+		state.fpLocker.Lock(pair.fp)
+		if len(pair.series.chunkDescs) > 0 && (immediate || pair.series.firstTime().Before(blockStart)) {
+			flush = true
+		}
+		state.fpLocker.Unlock(pair.fp)
+	}
+
+	if flush {
+		h := fnv.New32a()
+		h.Write([]byte(userID))
+		flushQueueIndex := int(h.Sum32() % uint32(i.cfg.ConcurrentFlushes))
+		i.flushQueues[flushQueueIndex].Enqueue(&flushOp{0, userID, 0, immediate})
+	}
+}
+
+// blockStart is the start of the current block range.
+func (i *Ingester) blockStart() model.Time {
+	now := model.Now()
+	return now - now%model.Time(i.cfg.BlockRange/time.Millisecond)
+}
+
 func (i *Ingester) shouldFlushSeries(series *memorySeries, immediate bool) bool {
 	// Series should be scheduled for flushing if they have more than one chunk
 	if immediate || len(series.chunkDescs) > 1 {
@@ -98,7 +164,7 @@ func (i *Ingester) shouldFlushChunk(c *desc) bool {
 func (i *Ingester) flushLoop(j int) {
 	defer func() {
 		log.Debug("Ingester.flushLoop() exited")
-		i.done.Done()
+		i.flushLoops.Done()
 	}()
 
 	for {
@@ -108,16 +174,29 @@ func (i *Ingester) flushLoop(j int) {
 		}
 		op := o.(*flushOp)
 
-		err := i.flushUserSeries(op.userID, op.fp, op.immediate)
-		if err != nil {
+		for {
+			var err error
+			if i.cfg.BlockRange > 0 {
+				err = i.flushUserBlock(op.userID, op.immediate)
+			} else {
+				err = i.flushUserSeries(op.userID, op.fp, op.immediate)
+			}
+			if err == nil {
+				break
+			}
 			log.Errorf("Failed to flush user %v: %v", op.userID, err)
-		}
 
-		// If we're exiting & we failed to flush, put the failed operation
-		// back in the queue at a later point.
-		if op.immediate && err != nil {
-			op.from = op.from.Add(flushBackoff)
-			i.flushQueues[j].Enqueue(op)
+			// If we're exiting & we failed to flush, try again after a
+			// backoff, until we give up flushing.  The queue is closed by
+			// then, so the operation can't go back on it.
+			if !op.immediate {
+				break
+			}
+			select {
+			case <-time.After(flushBackoff):
+			case <-i.flushAbort:
+				return
+			}
 		}
 	}
 }
@@ -152,24 +231,130 @@ func (i *Ingester) flushUserSeries(userID string, fp model.Fingerprint, immediat
 		return nil
 	}
 
-	// flush the chunks without locking the series, as we don't want to hold the series lock for the duration of the dynamo/s3 rpcs.
-	ctx := user.Inject(context.Background(), userID)
-	err := i.flushChunks(ctx, fp, series.metric, chunks)
-	if err != nil {
-		return err
+	if i.limits.IsEphemeral(userID, series.metric) {
+		// Ephemeral series are only kept until they would be flushed.
+		ephemeralChunksDiscarded.Add(float64(len(chunks)))
+	} else {
+		// flush the chunks without locking the series, as we don't want to hold the series lock for the duration of the dynamo/s3 rpcs.
+		ctx := user.Inject(context.Background(), userID)
+		err := i.flushChunks(ctx, fp, series.metric, chunks)
+		if err != nil {
+			return err
+		}
+		if i.flushedChunks != nil {
+			if err := i.flushedChunks.add(userID, fp, chunks); err != nil {
+				log.Errorf("Failed to cache flushed chunks: %v", err)
+			}
+		}
 	}
 
-	// now remove the chunks
+	// now remove the chunks, unless the user was deleted while flushing them.
 	userState.fpLocker.Lock(fp)
+	if _, ok := userState.fpToSeries.get(fp); !ok {
+		userState.fpLocker.Unlock(fp)
+		return nil
+	}
 	series.chunkDescs = series.chunkDescs[len(chunks):]
 	i.memoryChunks.Sub(float64(len(chunks)))
 	if len(series.chunkDescs) == 0 {
 		userState.removeSeries(fp, series.metric)
+		if i.flushedChunks != nil {
+			i.flushedChunks.remove(userID, fp)
+		}
 	}
 	userState.fpLocker.Unlock(fp)
 	return nil
 }
 
+// flushUserBlock flushes every chunk of the user's series from before the
+// current block range, or every chunk if immediate, in one Put, so the
+// store writes them as a single block, or batch.
+func (i *Ingester) flushUserBlock(userID string, immediate bool) error {
+	userState, ok := i.userStates.get(userID)
+	if !ok {
+		return nil
+	}
+
+	type seriesChunks struct {
+		fp        model.Fingerprint
+		series    *memorySeries
+		chunks    []*desc
+		ephemeral bool
+	}
+	var (
+		blockStart = i.blockStart()
+		flushed    []seriesChunks
+		wireChunks []chunk.Chunk
+	)
+	for pair := range userState.fpToSeries.iter() {
+		userState.fpLocker.Lock(pair.fp)
+		chunks := pair.series.chunkDescs
+		n := 0
+		for n < len(chunks) && (immediate || chunks[n].FirstTime.Before(blockStart)) {
+			n++
+		}
+		// Samples appended from now on start a new chunk, in the next block.
+		if n > 0 && n == len(chunks) {
+			pair.series.closeHead()
+		}
+		userState.fpLocker.Unlock(pair.fp)
+		if n == 0 {
+			continue
+		}
+
+		// Ephemeral series are only kept until they would be flushed.
+		chunks = chunks[:n]
+		ephemeral := i.limits.IsEphemeral(userID, pair.series.metric)
+		flushed = append(flushed, seriesChunks{pair.fp, pair.series, chunks, ephemeral})
+		if ephemeral {
+			ephemeralChunksDiscarded.Add(float64(n))
+			continue
+		}
+		for _, chunkDesc := range chunks {
+			wireChunks = append(wireChunks, chunk.NewChunk(userID, pair.fp, pair.series.metric, chunkDesc.C, chunkDesc.FirstTime, chunkDesc.LastTime))
+		}
+	}
+
+	if len(wireChunks) > 0 {
+		ctx := user.Inject(context.Background(), userID)
+		if err := i.chunkStore.Put(ctx, wireChunks); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range flushed {
+		if !f.ephemeral {
+			if i.flushedChunks != nil {
+				if err := i.flushedChunks.add(userID, f.fp, f.chunks); err != nil {
+					log.Errorf("Failed to cache flushed chunks: %v", err)
+				}
+			}
+			for _, chunkDesc := range f.chunks {
+				i.chunkUtilization.Observe(chunkDesc.C.Utilization())
+				i.chunkLength.Observe(float64(chunkDesc.C.Len()))
+				i.chunkAge.Observe(model.Now().Sub(chunkDesc.FirstTime).Seconds())
+			}
+		}
+
+		// Remove the chunks, unless the user was deleted while flushing them.
+		userState.fpLocker.Lock(f.fp)
+		if _, ok := userState.fpToSeries.get(f.fp); !ok {
+			userState.fpLocker.Unlock(f.fp)
+			continue
+		}
+		f.series.chunkDescs = f.series.chunkDescs[len(f.chunks):]
+		i.memoryChunks.Sub(float64(len(f.chunks)))
+		if len(f.series.chunkDescs) == 0 {
+			userState.removeSeries(f.fp, f.series.metric)
+			if i.flushedChunks != nil {
+				i.flushedChunks.remove(userID, f.fp)
+			}
+		}
+		userState.fpLocker.Unlock(f.fp)
+	}
+	return nil
+}
+
 func (i *Ingester) flushChunks(ctx context.Context, fp model.Fingerprint, metric model.Metric, chunkDescs []*desc) error {
 	userID, err := user.Extract(ctx)
 	if err != nil {
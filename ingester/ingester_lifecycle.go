@@ -5,19 +5,19 @@ package ingester
 import (
 	"fmt"
 	"io"
-	"net/http"
 	"sort"
 	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 
 	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/events"
 	"github.com/weaveworks/cortex/ring"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 const (
@@ -37,39 +37,40 @@ func init() {
 	prometheus.MustRegister(consulHeartbeats)
 }
 
-// ReadinessHandler is used to indicate to k8s when the ingesters are ready for
-// the addition removal of another ingester. Returns 204 when the ingester is
-// ready, 500 otherwise.
-func (i *Ingester) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
-	if i.isReady() {
-		w.WriteHeader(http.StatusNoContent)
-	} else {
-		w.WriteHeader(http.StatusInternalServerError)
-	}
-}
-
-func (i *Ingester) isReady() bool {
-	i.readyLock.Lock()
-	defer i.readyLock.Unlock()
-
-	if i.ready {
-		return true
-	}
-
+// CheckReady returns an error until the ingester can take traffic: it must
+// be ACTIVE in the ring, which has to be readable.  The first time, it also
+// waits for every ingester in the ring to be ACTIVE and healthy, so k8s
+// doesn't add or remove another ingester before the ring has settled.
+func (i *Ingester) CheckReady(ctx context.Context) error {
 	// Ingester always take at least minReadyDuration to become ready to work
 	// around race conditions with ingesters exiting and updating the ring
 	if time.Now().Sub(i.startTime) < minReadyDuration {
-		return false
+		return fmt.Errorf("waiting for %v after startup", minReadyDuration)
 	}
 
 	ringDesc, err := i.consul.Get(ring.ConsulKey)
 	if err != nil {
-		log.Errorf("Error talking to consul: %v", err)
-		return false
+		return fmt.Errorf("error reading the ring: %v", err)
+	}
+	desc, ok := ringDesc.(*ring.Desc)
+	if !ok || desc == nil {
+		return fmt.Errorf("the ring doesn't exist yet")
+	}
+	ingesterDesc, ok := desc.Ingesters[i.id]
+	if !ok {
+		return fmt.Errorf("ingester %s isn't in the ring", i.id)
+	}
+	if ingesterDesc.State != ring.ACTIVE {
+		return fmt.Errorf("ingester %s is %v in the ring", i.id, ingesterDesc.State)
 	}
 
-	i.ready = i.ready || ringDesc.(*ring.Desc).Ready(i.cfg.ringConfig.HeartbeatTimeout)
-	return i.ready
+	i.readyLock.Lock()
+	defer i.readyLock.Unlock()
+	if !i.ready && !desc.Ready(i.cfg.ringConfig.HeartbeatTimeout) {
+		return fmt.Errorf("waiting for every ingester in the ring to be ACTIVE and healthy")
+	}
+	i.ready = true
+	return nil
 }
 
 // ChangeState of the ingester, for use off of the loop() goroutine.
@@ -110,16 +111,13 @@ func (i *Ingester) ClaimTokensFor(ingesterID string) error {
 }
 
 // Shutdown stops the ingester.  It will:
+// - mark the ingester LEAVING, and stop accepting samples.
 // - send chunks to another ingester, if it can.
 // - otherwise, flush chunks to the chunk store.
+// - give up on the chunks left after -ingester.max-drain-duration.
 // - remove config from Consul.
 // - block until we've successfully shutdown.
 func (i *Ingester) Shutdown() {
-	// This will prevent us accepting any more samples
-	i.stopLock.Lock()
-	i.stopped = true
-	i.stopLock.Unlock()
-
 	// closing i.quit triggers loop() to exit, which in turn will trigger
 	// the removal of our tokens etc
 	close(i.quit)
@@ -127,6 +125,13 @@ func (i *Ingester) Shutdown() {
 	i.done.Wait()
 }
 
+// stopIncomingRequests makes Push refuse any more samples.
+func (i *Ingester) stopIncomingRequests() {
+	i.stopLock.Lock()
+	defer i.stopLock.Unlock()
+	i.stopped = true
+}
+
 func (i *Ingester) loop() {
 	defer func() {
 		log.Infof("Ingester.loop() exited gracefully")
@@ -155,12 +160,17 @@ loop:
 	for {
 		select {
 		case <-autoJoinAfter:
-			// Will only fire once, after auto join timeout.  If we haven't entered "JOINING" state,
-			// then pick some tokens and enter ACTIVE state.
+			// Fires after auto join timeout.  If we haven't entered "JOINING" state,
+			// then pick some tokens and enter ACTIVE state.  If another ingester is
+			// still on our host, stay PENDING and try again after another timeout.
 			if i.state == ring.PENDING {
 				log.Infof("Auto-joining cluster after timeout.")
 				if err := i.autoJoin(); err != nil {
-					log.Fatalf("failed to pick tokens in consul: %v", err)
+					if _, ok := err.(ring.PlacementError); !ok {
+						log.Fatalf("Failed to auto-join consul: %v", err)
+					}
+					log.Errorf("Not auto-joining cluster: %v", err)
+					autoJoinAfter = time.After(i.cfg.JoinAfter)
 				}
 			}
 
@@ -184,25 +194,42 @@ loop:
 		}
 	}
 
-	// Mark ourselved as Leaving so no more samples are send to us.
-	i.changeState(ring.LEAVING)
+	// Mark ourselves as LEAVING so no more samples are sent to us, then
+	// refuse the ones sent before the distributors noticed.
+	if err := i.changeState(ring.LEAVING); err != nil {
+		log.Errorf("Failed to mark ingester LEAVING: %v", err)
+	}
+	i.stopIncomingRequests()
+
+	ctx := context.Background()
+	if i.cfg.MaxDrainDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, i.cfg.MaxDrainDuration)
+		defer cancel()
+	}
 
 	flushRequired := true
 	if i.cfg.ClaimOnRollout {
-		if err := i.transferChunks(); err != nil {
+		if err := i.transferChunks(ctx); err != nil {
 			log.Errorf("Failed to transfer chunks to another ingester: %v", err)
 		} else {
 			flushRequired = false
 		}
 	}
 	if flushRequired {
-		i.flushAllChunks()
+		if ctx.Err() != nil {
+			log.Errorf("Gave up draining after %v, without flushing chunks", i.cfg.MaxDrainDuration)
+			events.Record("ingester", "drain_timeout", "Ingester %s gave up draining after %v, without flushing chunks", i.id, i.cfg.MaxDrainDuration)
+		} else {
+			i.flushAllChunks()
+		}
 	}
 
-	// Close the flush queues, will wait for chunks to be flushed.
+	// Close the flush queues, and wait for the chunks on them to be flushed.
 	for _, flushQueue := range i.flushQueues {
 		flushQueue.Close()
 	}
+	i.waitForFlushes(ctx, heartbeatTicker.C)
 
 	if !i.cfg.skipUnregister {
 		if err := i.unregister(); err != nil {
@@ -212,6 +239,40 @@ loop:
 	}
 }
 
+// waitForFlushes waits for the flush loops to exit, heartbeating so our
+// chunks are still queried until we unregister, or gives up on the chunks
+// left when ctx is done.
+func (i *Ingester) waitForFlushes(ctx context.Context, heartbeat <-chan time.Time) {
+	flushed := make(chan struct{})
+	go func() {
+		i.flushLoops.Wait()
+		close(flushed)
+	}()
+
+	for {
+		select {
+		case <-flushed:
+			return
+
+		case <-heartbeat:
+			consulHeartbeats.Inc()
+			if err := i.updateConsul(); err != nil {
+				log.Errorf("Failed to write to consul, sleeping: %v", err)
+			}
+
+		case <-ctx.Done():
+			close(i.flushAbort)
+			discarded := 0
+			for _, flushQueue := range i.flushQueues {
+				discarded += flushQueue.DiscardAndClose()
+			}
+			log.Errorf("Gave up draining after %v, with %d series still queued for flushing", i.cfg.MaxDrainDuration, discarded)
+			events.Record("ingester", "drain_timeout", "Ingester %s gave up draining after %v, with %d series still queued for flushing", i.id, i.cfg.MaxDrainDuration, discarded)
+			return
+		}
+	}
+}
+
 // initRing is the first thing we do when we start. It:
 // - add an ingester entry to the ring
 // - copies out our state and tokens if they exist
@@ -228,7 +289,7 @@ func (i *Ingester) initRing() error {
 		if !ok {
 			// Either we are a new ingester, or consul must have restarted
 			log.Infof("Entry not found in ring, adding with no tokens.")
-			ringDesc.AddIngester(i.id, i.addr, []uint32{}, i.state)
+			ringDesc.AddIngester(i.id, i.addr, i.cfg.Zone, i.cfg.Host, []uint32{}, i.state)
 			return ringDesc, true, nil
 		}
 
@@ -257,9 +318,13 @@ func (i *Ingester) autoJoin() error {
 			log.Errorf("%d tokens already exist for this ingester - wasn't expecting any!", len(myTokens))
 		}
 
+		if err := ringDesc.CheckPlacement(i.id, i.cfg.Zone, i.cfg.Host, i.cfg.ringConfig.HeartbeatTimeout); err != nil {
+			return nil, false, err
+		}
+
 		newTokens := ring.GenerateTokens(i.cfg.NumTokens-len(myTokens), takenTokens)
 		i.state = ring.ACTIVE
-		ringDesc.AddIngester(i.id, i.addr, newTokens, i.state)
+		ringDesc.AddIngester(i.id, i.addr, i.cfg.Zone, i.cfg.Host, newTokens, i.state)
 
 		tokens := append(myTokens, newTokens...)
 		sort.Sort(sortableUint32(tokens))
@@ -284,11 +349,13 @@ func (i *Ingester) updateConsul() error {
 		if !ok {
 			// consul must have restarted
 			log.Infof("Found empty ring, inserting tokens!")
-			ringDesc.AddIngester(i.id, i.addr, i.tokens, i.state)
+			ringDesc.AddIngester(i.id, i.addr, i.cfg.Zone, i.cfg.Host, i.tokens, i.state)
 		} else {
 			ingesterDesc.Timestamp = time.Now().Unix()
 			ingesterDesc.State = i.state
 			ingesterDesc.Addr = i.addr
+			ingesterDesc.Zone = i.cfg.Zone
+			ingesterDesc.Host = i.cfg.Host
 			ringDesc.Ingesters[i.id] = ingesterDesc
 		}
 
@@ -307,15 +374,32 @@ func (i *Ingester) changeState(state ring.IngesterState) error {
 		return fmt.Errorf("Changing ingester state from %v -> %v is disallowed", i.state, state)
 	}
 
+	if state == ring.ACTIVE {
+		if err := i.checkPlacement(); err != nil {
+			return err
+		}
+	}
+
 	log.Infof("Changing ingester state from %v -> %v", i.state, state)
+	events.Record("ingester", "state_change", "Ingester %s changed state from %v to %v", i.id, i.state, state)
 	i.state = state
 	return i.updateConsul()
 }
 
+// checkPlacement returns an error if this ingester shares its host with
+// another healthy ingester in the ring, so mustn't become ACTIVE.
+func (i *Ingester) checkPlacement() error {
+	ringDesc, err := i.consul.Get(ring.ConsulKey)
+	if err != nil || ringDesc == nil {
+		return err
+	}
+	return ringDesc.(*ring.Desc).CheckPlacement(i.id, i.cfg.Zone, i.cfg.Host, i.cfg.ringConfig.HeartbeatTimeout)
+}
+
 // transferChunks finds an ingester in PENDING state and transfers our chunks
 // to it.
-func (i *Ingester) transferChunks() error {
-	targetIngester, err := i.findTargetIngester()
+func (i *Ingester) transferChunks(ctx context.Context) error {
+	targetIngester, err := i.findTargetIngester(ctx)
 	if err != nil {
 		return fmt.Errorf("cannot find ingester to transfer chunks to: %v", err)
 	}
@@ -327,34 +411,33 @@ func (i *Ingester) transferChunks() error {
 	}
 	defer client.(io.Closer).Close()
 
-	ctx := user.Inject(context.Background(), "-1")
-	stream, err := client.TransferChunks(ctx)
+	stream, err := client.TransferChunks(user.Inject(ctx, "-1"))
 	if err != nil {
 		return err
 	}
 
+	// Send marshals each series before returning, so one message, and its
+	// chunks' buffers, are reused for all of them.
+	tsc := cortex.TimeSeriesChunk{FromIngesterId: i.id}
 	for userID, state := range i.userStates.cp() {
+		tsc.UserId = userID
 		for pair := range state.fpToSeries.iter() {
 			state.fpLocker.Lock(pair.fp)
 
-			chunks, err := toWireChunks(pair.series.chunkDescs)
+			tsc.Chunks, err = toWireChunks(pair.series.chunkDescs, tsc.Chunks)
 			if err != nil {
 				state.fpLocker.Unlock(pair.fp)
 				return err
 			}
 
-			err = stream.Send(&cortex.TimeSeriesChunk{
-				FromIngesterId: i.id,
-				UserId:         userID,
-				Labels:         util.ToLabelPairs(pair.series.metric),
-				Chunks:         chunks,
-			})
+			tsc.Labels = util.ToLabelPairs(pair.series.metric)
+			err = stream.Send(&tsc)
 			state.fpLocker.Unlock(pair.fp)
 			if err != nil {
 				return err
 			}
 
-			sentChunks.Add(float64(len(chunks)))
+			sentChunks.Add(float64(len(tsc.Chunks)))
 		}
 	}
 
@@ -367,14 +450,18 @@ func (i *Ingester) transferChunks() error {
 }
 
 // findTargetIngester finds an ingester in PENDING state.
-func (i *Ingester) findTargetIngester() (*ring.IngesterDesc, error) {
+func (i *Ingester) findTargetIngester(ctx context.Context) (*ring.IngesterDesc, error) {
 	findIngester := func() (*ring.IngesterDesc, error) {
 		ringDesc, err := i.consul.Get(ring.ConsulKey)
 		if err != nil {
 			return nil, err
 		}
 
-		ingesters := ringDesc.(*ring.Desc).FindIngestersByState(ring.PENDING)
+		desc, ok := ringDesc.(*ring.Desc)
+		if !ok || desc == nil {
+			return nil, fmt.Errorf("the ring doesn't exist yet")
+		}
+		ingesters := desc.FindIngestersByState(ring.PENDING)
 		if len(ingesters) <= 0 {
 			return nil, fmt.Errorf("no pending ingesters")
 		}
@@ -387,7 +474,7 @@ func (i *Ingester) findTargetIngester() (*ring.IngesterDesc, error) {
 		ingester, err := findIngester()
 		if err != nil {
 			log.Errorf("Error looking for pending ingester: %v", err)
-			if time.Now().Before(deadline) {
+			if time.Now().Before(deadline) && ctx.Err() == nil {
 				time.Sleep(i.cfg.SearchPendingFor / pendingSearchIterations)
 				continue
 			} else {
@@ -1,6 +1,8 @@
 package ingester
 
 import (
+	"flag"
+	"fmt"
 	"io"
 	"reflect"
 	"runtime"
@@ -12,14 +14,16 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 
-	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/metric"
 
 	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/limits"
 	"github.com/weaveworks/cortex/ring"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 const (
@@ -49,13 +53,29 @@ func defaultIngesterTestConfig() Config {
 	}
 }
 
+func defaultLimitsTestConfig() limits.Limits {
+	var cfg limits.Limits
+	cfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+	return cfg
+}
+
+func newTestOverrides(t *testing.T, cfg limits.Limits) *limits.Overrides {
+	overrides, err := limits.NewOverrides(cfg)
+	require.NoError(t, err)
+	return overrides
+}
+
+func defaultTestOverrides(t *testing.T) *limits.Overrides {
+	return newTestOverrides(t, defaultLimitsTestConfig())
+}
+
 // TestIngesterRestart tests a restarting ingester doesn't keep adding more tokens.
 func TestIngesterRestart(t *testing.T) {
 	config := defaultIngesterTestConfig()
 	config.skipUnregister = true
 
 	{
-		ingester, err := New(config, nil)
+		ingester, err := New(config, nil, defaultTestOverrides(t))
 		require.NoError(t, err)
 		time.Sleep(100 * time.Millisecond)
 		ingester.Shutdown() // doesn't actually unregister due to skipUnregister: true
@@ -66,7 +86,7 @@ func TestIngesterRestart(t *testing.T) {
 	})
 
 	{
-		ingester, err := New(config, nil)
+		ingester, err := New(config, nil, defaultTestOverrides(t))
 		require.NoError(t, err)
 		time.Sleep(100 * time.Millisecond)
 		ingester.Shutdown() // doesn't actually unregister due to skipUnregister: true
@@ -88,7 +108,7 @@ func TestIngesterTransfer(t *testing.T) {
 	cfg1.addr = "ingester1"
 	cfg1.ClaimOnRollout = true
 	cfg1.SearchPendingFor = aLongTime
-	ing1, err := New(cfg1, nil)
+	ing1, err := New(cfg1, nil, defaultTestOverrides(t))
 	require.NoError(t, err)
 
 	poll(t, 100*time.Millisecond, ring.ACTIVE, func() interface{} {
@@ -118,7 +138,7 @@ func TestIngesterTransfer(t *testing.T) {
 	cfg2.id = "ingester2"
 	cfg2.addr = "ingester2"
 	cfg2.JoinAfter = aLongTime
-	ing2, err := New(cfg2, nil)
+	ing2, err := New(cfg2, nil, defaultTestOverrides(t))
 	require.NoError(t, err)
 
 	// Let ing2 send chunks to ing1
@@ -200,8 +220,17 @@ type ingesterTransferChunkStreamMock struct {
 	grpc.ClientStream
 }
 
+// Send marshals tsc, as gRPC does, so the sender can reuse it.
 func (s *ingesterTransferChunkStreamMock) Send(tsc *cortex.TimeSeriesChunk) error {
-	s.reqs <- tsc
+	buf, err := tsc.Marshal()
+	if err != nil {
+		return err
+	}
+	var req cortex.TimeSeriesChunk
+	if err := req.Unmarshal(buf); err != nil {
+		return err
+	}
+	s.reqs <- &req
 	return nil
 }
 
@@ -268,3 +297,112 @@ func (i ingesterClientAdapater) TransferChunks(ctx context.Context, _ ...grpc.Ca
 func (i ingesterClientAdapater) Close() error {
 	return nil
 }
+
+func TestIngesterRefusesSharedHost(t *testing.T) {
+	cfg := defaultIngesterTestConfig()
+	cfg.Zone = "zone-a"
+	cfg.Host = "node1"
+	cfg.ringConfig.HeartbeatTimeout = time.Minute
+
+	cfg1 := cfg
+	cfg1.id = "ingester1"
+	cfg1.addr = "ingester1"
+	ing1, err := New(cfg1, nil, defaultTestOverrides(t))
+	require.NoError(t, err)
+	poll(t, 100*time.Millisecond, ring.ACTIVE, func() interface{} {
+		return ing1.state
+	})
+
+	// A second ingester on the same host must not become ACTIVE.
+	cfg2 := cfg
+	cfg2.id = "ingester2"
+	cfg2.addr = "ingester2"
+	cfg2.JoinAfter = aLongTime
+	ing2, err := New(cfg2, nil, defaultTestOverrides(t))
+	require.NoError(t, err)
+	require.NoError(t, ing2.ChangeState(ring.JOINING))
+	assert.Error(t, ing2.ChangeState(ring.ACTIVE))
+
+	// Nor accept chunks from a leaving ingester, which would then be stranded.
+	cfg4 := cfg2
+	cfg4.id = "ingester4"
+	cfg4.addr = "ingester4"
+	ing4, err := New(cfg4, nil, defaultTestOverrides(t))
+	require.NoError(t, err)
+	assert.Error(t, ing4.TransferChunks(&ingesterTransferChunkStreamMock{ctx: context.Background()}))
+	assert.Equal(t, ring.PENDING, ing4.state)
+
+	// The same host name in a different zone is a different host.
+	cfg3 := cfg2
+	cfg3.id = "ingester3"
+	cfg3.addr = "ingester3"
+	cfg3.Zone = "zone-b"
+	ing3, err := New(cfg3, nil, defaultTestOverrides(t))
+	require.NoError(t, err)
+	require.NoError(t, ing3.ChangeState(ring.JOINING))
+	assert.NoError(t, ing3.ChangeState(ring.ACTIVE))
+}
+
+func TestIngesterReadiness(t *testing.T) {
+	ctx := context.Background()
+	cfg := defaultIngesterTestConfig()
+	cfg.ringConfig.HeartbeatTimeout = time.Minute
+	cfg.JoinAfter = aLongTime
+	ing, err := New(cfg, nil, defaultTestOverrides(t))
+	require.NoError(t, err)
+	defer ing.Shutdown()
+
+	// Not ready just after startup, nor while PENDING or JOINING.
+	assert.Error(t, ing.CheckReady(ctx))
+	ing.startTime = ing.startTime.Add(-minReadyDuration)
+	assert.Error(t, ing.CheckReady(ctx))
+	require.NoError(t, ing.ChangeState(ring.JOINING))
+	assert.Error(t, ing.CheckReady(ctx))
+
+	// Ready once it has joined, until it starts leaving.
+	cfg = defaultIngesterTestConfig()
+	cfg.ringConfig.HeartbeatTimeout = time.Minute
+	ing2, err := New(cfg, nil, defaultTestOverrides(t))
+	require.NoError(t, err)
+	defer ing2.Shutdown()
+	ing2.startTime = ing2.startTime.Add(-minReadyDuration)
+	poll(t, 100*time.Millisecond, nil, func() interface{} {
+		return ing2.CheckReady(ctx)
+	})
+	require.NoError(t, ing2.ChangeState(ring.LEAVING))
+	assert.Error(t, ing2.CheckReady(ctx))
+}
+
+type failingStore struct{}
+
+func (failingStore) Put(ctx context.Context, chunks []chunk.Chunk) error {
+	return fmt.Errorf("store unavailable")
+}
+
+func TestIngesterMaxDrainDuration(t *testing.T) {
+	cfg := defaultIngesterTestConfig()
+	cfg.MaxDrainDuration = 100 * time.Millisecond
+	ing, err := New(cfg, failingStore{}, defaultTestOverrides(t))
+	require.NoError(t, err)
+	ctx := user.Inject(context.Background(), userID)
+	_, err = ing.Push(ctx, util.ToWriteRequest(matrixToSamples(buildTestMatrix(10, 10, 0))))
+	require.NoError(t, err)
+
+	// The chunks can't be flushed, so we give up on them rather than retry
+	// them forever.
+	done := make(chan struct{})
+	go func() {
+		ing.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown didn't give up draining")
+	}
+	assert.Equal(t, 0, numTokens(cfg.ringConfig.ConsulConfig.Mock, "localhost"))
+
+	// Samples are refused once we're shutting down.
+	_, err = ing.Push(ctx, util.ToWriteRequest(matrixToSamples(buildTestMatrix(1, 1, 0))))
+	assert.Error(t, err)
+}
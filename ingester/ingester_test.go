@@ -5,6 +5,7 @@ import (
 	"sort"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -15,7 +16,9 @@ import (
 	"github.com/prometheus/prometheus/storage/metric"
 
 	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
 	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/limits"
 	"github.com/weaveworks/cortex/util"
 )
 
@@ -23,6 +26,7 @@ type testStore struct {
 	mtx sync.Mutex
 	// Chunks keyed by userID.
 	chunks map[string][]chunk.Chunk
+	puts   int
 }
 
 func newTestStore() *testStore {
@@ -40,6 +44,7 @@ func (s *testStore) Put(ctx context.Context, chunks []chunk.Chunk) error {
 		return err
 	}
 	s.chunks[userID] = append(s.chunks[userID], chunks...)
+	s.puts++
 	return nil
 }
 
@@ -84,7 +89,7 @@ func matrixToSamples(m model.Matrix) []model.Sample {
 func TestIngesterAppend(t *testing.T) {
 	cfg := defaultIngesterTestConfig()
 	store := newTestStore()
-	ing, err := New(cfg, store)
+	ing, err := New(cfg, store, defaultTestOverrides(t))
 	require.NoError(t, err)
 
 	userIDs := []string{"1", "2", "3"}
@@ -131,12 +136,11 @@ func TestIngesterAppend(t *testing.T) {
 
 func TestIngesterUserSeriesLimitExceeded(t *testing.T) {
 	cfg := defaultIngesterTestConfig()
-	cfg.userStatesConfig = UserStatesConfig{
-		MaxSeriesPerUser: 1,
-	}
+	limits := defaultLimitsTestConfig()
+	limits.MaxSeriesPerUser = 1
 
 	store := newTestStore()
-	ing, err := New(cfg, store)
+	ing, err := New(cfg, store, newTestOverrides(t, limits))
 	require.NoError(t, err)
 
 	userID := "1"
@@ -163,7 +167,7 @@ func TestIngesterUserSeriesLimitExceeded(t *testing.T) {
 
 	// Append to two series, expect series-exceeded error.
 	_, err = ing.Push(ctx, util.ToWriteRequest([]model.Sample{sample2, sample3}))
-	if grpc.ErrorDesc(err) != util.ErrUserSeriesLimitExceeded.Error() {
+	if grpc.ErrorDesc(err) != util.ErrUserSeriesLimitExceeded.Error()+" (limit: 1)" {
 		t.Fatalf("expected error about exceeding metrics per user, got %v", err)
 	}
 
@@ -201,12 +205,11 @@ func TestIngesterUserSeriesLimitExceeded(t *testing.T) {
 
 func TestIngesterMetricSeriesLimitExceeded(t *testing.T) {
 	cfg := defaultIngesterTestConfig()
-	cfg.userStatesConfig = UserStatesConfig{
-		MaxSeriesPerMetric: 1,
-	}
+	limits := defaultLimitsTestConfig()
+	limits.MaxSeriesPerMetric = 1
 
 	store := newTestStore()
-	ing, err := New(cfg, store)
+	ing, err := New(cfg, store, newTestOverrides(t, limits))
 	require.NoError(t, err)
 
 	userID := "1"
@@ -233,7 +236,7 @@ func TestIngesterMetricSeriesLimitExceeded(t *testing.T) {
 
 	// Append to two series, expect series-exceeded error.
 	_, err = ing.Push(ctx, util.ToWriteRequest([]model.Sample{sample2, sample3}))
-	if grpc.ErrorDesc(err) != util.ErrMetricSeriesLimitExceeded.Error() {
+	if grpc.ErrorDesc(err) != util.ErrMetricSeriesLimitExceeded.Error()+" (limit: 1) for metric testmetric" {
 		t.Fatalf("expected error about exceeding series per metric, got %v", err)
 	}
 
@@ -268,3 +271,153 @@ func TestIngesterMetricSeriesLimitExceeded(t *testing.T) {
 
 	assert.Equal(t, expected, res)
 }
+
+func TestIngesterEphemeralSeriesNotFlushed(t *testing.T) {
+	cfg := defaultIngesterTestConfig()
+	limits := defaultLimitsTestConfig()
+	limits.EphemeralSeries = []string{`{__name__="debug_requests"}`}
+
+	store := newTestStore()
+	ing, err := New(cfg, store, newTestOverrides(t, limits))
+	require.NoError(t, err)
+
+	userID := "1"
+	ctx := user.Inject(context.Background(), userID)
+	_, err = ing.Push(ctx, util.ToWriteRequest([]model.Sample{
+		{Metric: model.Metric{model.MetricNameLabel: "debug_requests", "path": "/"}, Timestamp: 1000, Value: 1},
+		{Metric: model.Metric{model.MetricNameLabel: "requests", "path": "/"}, Timestamp: 1000, Value: 2},
+	}))
+	require.NoError(t, err)
+
+	ing.Shutdown()
+	require.Len(t, store.chunks[userID], 1)
+	assert.Equal(t, model.LabelValue("requests"), store.chunks[userID][0].Metric[model.MetricNameLabel])
+}
+
+func TestIngesterDuplicateSamplePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy        string
+		expectedError error
+		expectedValue model.SampleValue
+	}{
+		{limits.DuplicateSampleReject, ErrDuplicateSampleForTimestamp, 1},
+		{limits.DuplicateSampleFirstWins, nil, 1},
+		{limits.DuplicateSampleLastWins, nil, 2},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			cfg := defaultLimitsTestConfig()
+			cfg.DuplicateSamplePolicy = tc.policy
+			ing, err := New(defaultIngesterTestConfig(), newTestStore(), newTestOverrides(t, cfg))
+			require.NoError(t, err)
+			defer ing.Shutdown()
+
+			ctx := user.Inject(context.Background(), "1")
+			m := model.Metric{model.MetricNameLabel: "foo"}
+			_, err = ing.Push(ctx, util.ToWriteRequest([]model.Sample{
+				{Metric: m, Timestamp: 1000, Value: 0},
+				{Metric: m, Timestamp: 2000, Value: 1},
+			}))
+			require.NoError(t, err)
+			_, err = ing.Push(ctx, util.ToWriteRequest([]model.Sample{
+				{Metric: m, Timestamp: 2000, Value: 2},
+			}))
+			if tc.expectedError != nil {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+			require.NoError(t, err)
+			result, err := ing.query(ctx, 0, 3000, []*metric.LabelMatcher{matcher})
+			require.NoError(t, err)
+			require.Len(t, result, 1)
+			assert.Equal(t, []model.SamplePair{
+				{Timestamp: 1000, Value: 0},
+				{Timestamp: 2000, Value: tc.expectedValue},
+			}, result[0].Values)
+
+			// Later samples still append after the replaced one.
+			_, err = ing.Push(ctx, util.ToWriteRequest([]model.Sample{
+				{Metric: m, Timestamp: 3000, Value: 3},
+			}))
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestIngesterDeleteUser(t *testing.T) {
+	cfg := defaultIngesterTestConfig()
+	store := newTestStore()
+	ing, err := New(cfg, store, defaultTestOverrides(t))
+	require.NoError(t, err)
+
+	userIDs := []string{"1", "2"}
+	testData := map[string]model.Matrix{}
+	for i, userID := range userIDs {
+		testData[userID] = buildTestMatrix(10, 100, i)
+		_, err = ing.Push(user.Inject(context.Background(), userID), util.ToWriteRequest(matrixToSamples(testData[userID])))
+		require.NoError(t, err)
+	}
+
+	resp, err := ing.DeleteUser(user.Inject(context.Background(), "1"), &cortex.DeleteUserRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), resp.NumSeries)
+
+	// Deleting them again finds nothing.
+	resp, err = ing.DeleteUser(user.Inject(context.Background(), "1"), &cortex.DeleteUserRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), resp.NumSeries)
+
+	matcher, err := metric.NewLabelMatcher(metric.RegexMatch, model.JobLabel, ".+")
+	require.NoError(t, err)
+	req, err := util.ToQueryRequest(model.Earliest, model.Latest, []*metric.LabelMatcher{matcher})
+	require.NoError(t, err)
+	for userID, expected := range map[string]model.Matrix{"1": {}, "2": testData["2"]} {
+		resp, err := ing.Query(user.Inject(context.Background(), userID), req)
+		require.NoError(t, err)
+		res := util.FromQueryResponse(resp)
+		sort.Sort(res)
+		assert.Equal(t, expected, res, userID)
+	}
+
+	// The deleted user's series aren't flushed.
+	ing.Shutdown()
+	assert.Empty(t, store.chunks["1"])
+	assert.NotEmpty(t, store.chunks["2"])
+}
+
+func TestIngesterFlushBlocks(t *testing.T) {
+	cfg := defaultIngesterTestConfig()
+	cfg.BlockRange = time.Hour
+	store := newTestStore()
+	ing, err := New(cfg, store, defaultTestOverrides(t))
+	require.NoError(t, err)
+
+	// The test matrix's samples are from long before the current block.
+	ctx := user.Inject(context.Background(), "1")
+	old := buildTestMatrix(10, 100, 0)
+	_, err = ing.Push(ctx, util.ToWriteRequest(matrixToSamples(old)))
+	require.NoError(t, err)
+	recent := model.Metric{model.MetricNameLabel: "recent"}
+	_, err = ing.Push(ctx, util.ToWriteRequest([]model.Sample{{Metric: recent, Timestamp: model.Now(), Value: 1}}))
+	require.NoError(t, err)
+
+	// Every old series is flushed in one Put, and the recent one kept.
+	require.NoError(t, ing.flushUserBlock("1", false))
+	assert.Equal(t, 1, store.puts)
+	res, err := chunk.ChunksToMatrix(store.chunks["1"])
+	require.NoError(t, err)
+	sort.Sort(res)
+	assert.Equal(t, old, res)
+	matcher, err := metric.NewLabelMatcher(metric.RegexMatch, model.MetricNameLabel, ".+")
+	require.NoError(t, err)
+	inMemory, err := ing.query(ctx, model.Earliest, model.Latest, []*metric.LabelMatcher{matcher})
+	require.NoError(t, err)
+	require.Len(t, inMemory, 1)
+	assert.Equal(t, recent, inMemory[0].Metric)
+
+	ing.Shutdown()
+	assert.Equal(t, 2, store.puts)
+	assert.Len(t, store.chunks["1"], 11)
+}
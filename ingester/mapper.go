@@ -7,9 +7,11 @@ import (
 	"sync"
 	"sync/atomic"
 
-	"github.com/prometheus/common/log"
-
 	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 const maxMappedFP = 1 << 20 // About 1M fingerprints reserved for mapping.
@@ -47,11 +49,11 @@ func newFPMapper(fpToSeries *seriesMap) *fpMapper {
 //
 // If an error is encountered, it is returned together with the unchanged raw
 // fingerprint.
-func (m *fpMapper) mapFP(fp model.Fingerprint, metric model.Metric) model.Fingerprint {
+func (m *fpMapper) mapFP(ctx context.Context, fp model.Fingerprint, metric model.Metric) model.Fingerprint {
 	// First check if we are in the reserved FP space, in which case this is
 	// automatically a collision that has to be mapped.
 	if fp <= maxMappedFP {
-		return m.maybeAddMapping(fp, metric)
+		return m.maybeAddMapping(ctx, fp, metric)
 	}
 
 	// Then check the most likely case: This fp belongs to a series that is
@@ -64,7 +66,7 @@ func (m *fpMapper) mapFP(fp model.Fingerprint, metric model.Metric) model.Finger
 			return fp
 		}
 		// Collision detected!
-		return m.maybeAddMapping(fp, metric)
+		return m.maybeAddMapping(ctx, fp, metric)
 	}
 	// Metric is not in memory. Before doing the expensive archive lookup,
 	// check if we have a mapping for this metric in place already.
@@ -89,6 +91,7 @@ func (m *fpMapper) mapFP(fp model.Fingerprint, metric model.Metric) model.Finger
 // adds it to the collisions map if not yet there. In any case, it returns the
 // truly unique fingerprint for the colliding metric.
 func (m *fpMapper) maybeAddMapping(
+	ctx context.Context,
 	fp model.Fingerprint,
 	collidingMetric model.Metric,
 ) model.Fingerprint {
@@ -105,7 +108,7 @@ func (m *fpMapper) maybeAddMapping(
 		// A new mapping has to be created.
 		mappedFP = m.nextMappedFP()
 		mappedFPs[ms] = mappedFP
-		log.Infof(
+		util.WithContext(ctx, log.Base()).Infof(
 			"Collision detected for fingerprint %v, metric %v, mapping to new fingerprint %v.",
 			fp, collidingMetric, mappedFP,
 		)
@@ -117,7 +120,7 @@ func (m *fpMapper) maybeAddMapping(
 	m.mtx.Lock()
 	m.mappings[fp] = mappedFPs
 	m.mtx.Unlock()
-	log.Infof(
+	util.WithContext(ctx, log.Base()).Infof(
 		"Collision detected for fingerprint %v, metric %v, mapping to new fingerprint %v.",
 		fp, collidingMetric, mappedFP,
 	)
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
 )
 
 var (
@@ -49,11 +50,11 @@ func TestFPMapper(t *testing.T) {
 	mapper := newFPMapper(sm)
 
 	// Everything is empty, resolving a FP should do nothing.
-	gotFP := mapper.mapFP(fp1, cm11)
+	gotFP := mapper.mapFP(context.Background(), fp1, cm11)
 	if wantFP := fp1; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp1, cm12)
+	gotFP = mapper.mapFP(context.Background(), fp1, cm12)
 	if wantFP := fp1; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
@@ -61,115 +62,115 @@ func TestFPMapper(t *testing.T) {
 	// cm11 is in sm. Adding cm11 should do nothing. Mapping cm12 should resolve
 	// the collision.
 	sm.put(fp1, &memorySeries{metric: cm11})
-	gotFP = mapper.mapFP(fp1, cm11)
+	gotFP = mapper.mapFP(context.Background(), fp1, cm11)
 	if wantFP := fp1; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp1, cm12)
+	gotFP = mapper.mapFP(context.Background(), fp1, cm12)
 	if wantFP := model.Fingerprint(1); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
 
 	// The mapped cm12 is added to sm, too. That should not change the outcome.
 	sm.put(model.Fingerprint(1), &memorySeries{metric: cm12})
-	gotFP = mapper.mapFP(fp1, cm11)
+	gotFP = mapper.mapFP(context.Background(), fp1, cm11)
 	if wantFP := fp1; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp1, cm12)
+	gotFP = mapper.mapFP(context.Background(), fp1, cm12)
 	if wantFP := model.Fingerprint(1); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
 
 	// Now map cm13, should reproducibly result in the next mapped FP.
-	gotFP = mapper.mapFP(fp1, cm13)
+	gotFP = mapper.mapFP(context.Background(), fp1, cm13)
 	if wantFP := model.Fingerprint(2); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp1, cm13)
+	gotFP = mapper.mapFP(context.Background(), fp1, cm13)
 	if wantFP := model.Fingerprint(2); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
 
 	// Add cm13 to sm. Should not change anything.
 	sm.put(model.Fingerprint(2), &memorySeries{metric: cm13})
-	gotFP = mapper.mapFP(fp1, cm11)
+	gotFP = mapper.mapFP(context.Background(), fp1, cm11)
 	if wantFP := fp1; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp1, cm12)
+	gotFP = mapper.mapFP(context.Background(), fp1, cm12)
 	if wantFP := model.Fingerprint(1); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp1, cm13)
+	gotFP = mapper.mapFP(context.Background(), fp1, cm13)
 	if wantFP := model.Fingerprint(2); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
 
 	// Now add cm21 and cm22 in the same way, checking the mapped FPs.
-	gotFP = mapper.mapFP(fp2, cm21)
+	gotFP = mapper.mapFP(context.Background(), fp2, cm21)
 	if wantFP := fp2; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
 	sm.put(fp2, &memorySeries{metric: cm21})
-	gotFP = mapper.mapFP(fp2, cm21)
+	gotFP = mapper.mapFP(context.Background(), fp2, cm21)
 	if wantFP := fp2; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp2, cm22)
+	gotFP = mapper.mapFP(context.Background(), fp2, cm22)
 	if wantFP := model.Fingerprint(3); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
 	sm.put(model.Fingerprint(3), &memorySeries{metric: cm22})
-	gotFP = mapper.mapFP(fp2, cm21)
+	gotFP = mapper.mapFP(context.Background(), fp2, cm21)
 	if wantFP := fp2; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp2, cm22)
+	gotFP = mapper.mapFP(context.Background(), fp2, cm22)
 	if wantFP := model.Fingerprint(3); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
 
 	// Map cm31, resulting in a mapping straight away.
-	gotFP = mapper.mapFP(fp3, cm31)
+	gotFP = mapper.mapFP(context.Background(), fp3, cm31)
 	if wantFP := model.Fingerprint(4); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
 	sm.put(model.Fingerprint(4), &memorySeries{metric: cm31})
 
 	// Map cm32, which is now mapped for two reasons...
-	gotFP = mapper.mapFP(fp3, cm32)
+	gotFP = mapper.mapFP(context.Background(), fp3, cm32)
 	if wantFP := model.Fingerprint(5); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
 	sm.put(model.Fingerprint(5), &memorySeries{metric: cm32})
 
 	// Now check ALL the mappings, just to be sure.
-	gotFP = mapper.mapFP(fp1, cm11)
+	gotFP = mapper.mapFP(context.Background(), fp1, cm11)
 	if wantFP := fp1; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp1, cm12)
+	gotFP = mapper.mapFP(context.Background(), fp1, cm12)
 	if wantFP := model.Fingerprint(1); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp1, cm13)
+	gotFP = mapper.mapFP(context.Background(), fp1, cm13)
 	if wantFP := model.Fingerprint(2); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp2, cm21)
+	gotFP = mapper.mapFP(context.Background(), fp2, cm21)
 	if wantFP := fp2; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp2, cm22)
+	gotFP = mapper.mapFP(context.Background(), fp2, cm22)
 	if wantFP := model.Fingerprint(3); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp3, cm31)
+	gotFP = mapper.mapFP(context.Background(), fp3, cm31)
 	if wantFP := model.Fingerprint(4); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp3, cm32)
+	gotFP = mapper.mapFP(context.Background(), fp3, cm32)
 	if wantFP := model.Fingerprint(5); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
@@ -179,31 +180,31 @@ func TestFPMapper(t *testing.T) {
 	sm.del(fp1)
 	sm.del(fp2)
 	sm.del(fp3)
-	gotFP = mapper.mapFP(fp1, cm11)
+	gotFP = mapper.mapFP(context.Background(), fp1, cm11)
 	if wantFP := fp1; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp1, cm12)
+	gotFP = mapper.mapFP(context.Background(), fp1, cm12)
 	if wantFP := model.Fingerprint(1); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp1, cm13)
+	gotFP = mapper.mapFP(context.Background(), fp1, cm13)
 	if wantFP := model.Fingerprint(2); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp2, cm21)
+	gotFP = mapper.mapFP(context.Background(), fp2, cm21)
 	if wantFP := fp2; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp2, cm22)
+	gotFP = mapper.mapFP(context.Background(), fp2, cm22)
 	if wantFP := model.Fingerprint(3); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp3, cm31)
+	gotFP = mapper.mapFP(context.Background(), fp3, cm31)
 	if wantFP := model.Fingerprint(4); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	gotFP = mapper.mapFP(fp3, cm32)
+	gotFP = mapper.mapFP(context.Background(), fp3, cm32)
 	if wantFP := model.Fingerprint(5); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
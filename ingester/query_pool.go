@@ -0,0 +1,89 @@
+package ingester
+
+import (
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/common/model"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/cortex"
+)
+
+// Query responses, and the slices of series, labels and samples in them, are
+// pooled, as big fan-out queries otherwise make lots of garbage.  The
+// ingester's gRPC server returns them to the pool once they're marshalled,
+// with pooledResponseCodec.
+var queryResponsePool = sync.Pool{
+	New: func() interface{} { return &cortex.QueryResponse{} },
+}
+
+// getQueryResponse returns a query response for the matrix, reusing a pooled
+// response's slices.
+func getQueryResponse(matrix model.Matrix) *cortex.QueryResponse {
+	resp := queryResponsePool.Get().(*cortex.QueryResponse)
+	timeseries := resp.Timeseries[:0]
+	for i, ss := range matrix {
+		if i < cap(timeseries) {
+			timeseries = timeseries[:i+1]
+		} else {
+			timeseries = append(timeseries, cortex.TimeSeries{})
+		}
+		ts := &timeseries[i]
+
+		ts.Labels = ts.Labels[:0]
+		for name, value := range ss.Metric {
+			ts.Labels = append(ts.Labels, cortex.LabelPair{
+				Name:  []byte(name),
+				Value: []byte(value),
+			})
+		}
+		ts.Samples = ts.Samples[:0]
+		for _, s := range ss.Values {
+			ts.Samples = append(ts.Samples, cortex.Sample{
+				Value:       float64(s.Value),
+				TimestampMs: int64(s.Timestamp),
+			})
+		}
+	}
+	resp.Timeseries = timeseries
+	return resp
+}
+
+// putQueryResponse returns a response from getQueryResponse to the pool; it
+// must not be used afterwards.
+func putQueryResponse(resp *cortex.QueryResponse) {
+	// Drop the label bytes, so they can be collected, but keep the slices'
+	// capacity.
+	for i := range resp.Timeseries {
+		ts := &resp.Timeseries[i]
+		for j := range ts.Labels {
+			ts.Labels[j] = cortex.LabelPair{}
+		}
+	}
+	resp.Timeseries = resp.Timeseries[:0]
+	queryResponsePool.Put(resp)
+}
+
+// pooledResponseCodec is the default protobuf codec, returning query
+// responses to the pool once they're marshalled.  Only the ingester's Query
+// returns QueryResponses, so every one it marshals came from the pool.
+type pooledResponseCodec struct{}
+
+func (pooledResponseCodec) Marshal(v interface{}) ([]byte, error) {
+	buf, err := proto.Marshal(v.(proto.Message))
+	if resp, ok := v.(*cortex.QueryResponse); ok {
+		putQueryResponse(resp)
+	}
+	return buf, err
+}
+
+func (pooledResponseCodec) Unmarshal(data []byte, v interface{}) error {
+	return proto.Unmarshal(data, v.(proto.Message))
+}
+
+func (pooledResponseCodec) String() string {
+	return "proto"
+}
+
+var _ grpc.Codec = pooledResponseCodec{}
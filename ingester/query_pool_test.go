@@ -0,0 +1,47 @@
+package ingester
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestPooledQueryResponses(t *testing.T) {
+	matrix := func(series, samples int) model.Matrix {
+		m := model.Matrix{}
+		for i := 0; i < series; i++ {
+			ss := &model.SampleStream{Metric: model.Metric{
+				model.MetricNameLabel: model.LabelValue("foo"),
+				"i":                   model.LabelValue(string(rune('a' + i))),
+			}}
+			for j := 0; j < samples; j++ {
+				ss.Values = append(ss.Values, model.SamplePair{Timestamp: model.Time(j), Value: model.SampleValue(i * j)})
+			}
+			m = append(m, ss)
+		}
+		return m
+	}
+
+	// Responses are marshalled the same, and unpack to the same matrix,
+	// whatever pooled response they reuse.
+	var codec pooledResponseCodec
+	for _, m := range []model.Matrix{matrix(3, 5), matrix(1, 2), matrix(0, 0), matrix(4, 1)} {
+		resp := getQueryResponse(m)
+		assert.Equal(t, m, util.FromQueryResponse(resp))
+
+		expected, err := util.ToQueryResponse(m).Marshal()
+		require.NoError(t, err)
+		buf, err := codec.Marshal(resp)
+		require.NoError(t, err)
+		assert.Equal(t, len(expected), len(buf))
+
+		var have cortex.QueryResponse
+		require.NoError(t, codec.Unmarshal(buf, &have))
+		assert.Equal(t, m, util.FromQueryResponse(&have))
+	}
+}
@@ -8,18 +8,30 @@ import (
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/local/chunk"
 	"github.com/prometheus/prometheus/storage/metric"
+
+	"github.com/weaveworks/cortex/limits"
 )
 
-var discardedSamples = prometheus.NewCounterVec(
-	prometheus.CounterOpts{
-		Name: "cortex_ingester_out_of_order_samples_total",
-		Help: "The total number of samples that were discarded because their timestamps were at or before the last received sample for a series.",
-	},
-	[]string{discardReasonLabel},
+var (
+	discardedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cortex_ingester_out_of_order_samples_total",
+			Help: "The total number of samples that were discarded because their timestamps were at or before the last received sample for a series.",
+		},
+		[]string{discardReasonLabel},
+	)
+	duplicateSampleConflicts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cortex_ingester_duplicate_sample_conflicts_total",
+			Help: "The total number of samples with the same timestamp but a different value to the last sample of their series, by the policy used to resolve them.",
+		},
+		[]string{"policy"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(discardedSamples)
+	prometheus.MustRegister(duplicateSampleConflicts)
 }
 
 type memorySeries struct {
@@ -48,11 +60,12 @@ func newMemorySeries(m model.Metric) *memorySeries {
 	}
 }
 
-// add adds a sample pair to the series. It returns the number of newly
-// completed chunks (which are now eligible for persistence).
+// add adds a sample pair to the series. A sample with the same timestamp
+// but a different value to the last one is resolved with the duplicate
+// sample policy.
 //
 // The caller must have locked the fingerprint of the series.
-func (s *memorySeries) add(v model.SamplePair) error {
+func (s *memorySeries) add(v model.SamplePair, duplicatePolicy string) error {
 	// Don't report "no-op appends", i.e. where timestamp and sample
 	// value are the same as for the last append, as they are a
 	// common occurrence when using client-side timestamps
@@ -63,8 +76,7 @@ func (s *memorySeries) add(v model.SamplePair) error {
 		return nil
 	}
 	if v.Timestamp == s.lastTime {
-		discardedSamples.WithLabelValues(duplicateSample).Inc()
-		return ErrDuplicateSampleForTimestamp // Caused by the caller.
+		return s.resolveDuplicate(v, duplicatePolicy)
 	}
 	if v.Timestamp < s.lastTime {
 		discardedSamples.WithLabelValues(outOfOrderTimestamp).Inc()
@@ -98,6 +110,73 @@ func (s *memorySeries) add(v model.SamplePair) error {
 		}
 	}
 
+	s.lastSampleValueSet = true
+	s.lastTime = v.Timestamp
+	s.lastSampleValue = v.Value
+	return nil
+}
+
+func (s *memorySeries) resolveDuplicate(v model.SamplePair, policy string) error {
+	switch policy {
+	case limits.DuplicateSampleFirstWins:
+		duplicateSampleConflicts.WithLabelValues(policy).Inc()
+		discardedSamples.WithLabelValues(duplicateSample).Inc()
+		return nil
+
+	case limits.DuplicateSampleLastWins:
+		// A closed head chunk may be being flushed, so can't be rewritten;
+		// keep the first value instead.
+		if s.headChunkClosed || len(s.chunkDescs) == 0 {
+			duplicateSampleConflicts.WithLabelValues(limits.DuplicateSampleFirstWins).Inc()
+			discardedSamples.WithLabelValues(duplicateSample).Inc()
+			return nil
+		}
+		duplicateSampleConflicts.WithLabelValues(policy).Inc()
+		return s.replaceLast(v)
+
+	default:
+		duplicateSampleConflicts.WithLabelValues(limits.DuplicateSampleReject).Inc()
+		discardedSamples.WithLabelValues(duplicateSample).Inc()
+		return ErrDuplicateSampleForTimestamp // Caused by the caller.
+	}
+}
+
+// replaceLast rewrites the head chunk with the value of its last sample
+// replaced.  Chunks can only be appended to, so this re-encodes the whole
+// head chunk; it should be rare.
+func (s *memorySeries) replaceLast(v model.SamplePair) error {
+	head := s.head()
+	values, err := chunk.RangeValues(head.C.NewIterator(), metric.Interval{
+		OldestInclusive: head.FirstTime,
+		NewestInclusive: head.LastTime,
+	})
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 || values[len(values)-1].Timestamp != v.Timestamp {
+		return fmt.Errorf("last sample of series not in head chunk")
+	}
+	values[len(values)-1] = v
+
+	chunks := []chunk.Chunk{chunk.New()}
+	for _, value := range values {
+		last := len(chunks) - 1
+		cs, err := chunks[last].Add(value)
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks[:last], cs...)
+	}
+
+	s.chunkDescs = s.chunkDescs[:len(s.chunkDescs)-1]
+	for _, c := range chunks {
+		lastTime, err := c.NewIterator().LastTimestamp()
+		if err != nil {
+			return err
+		}
+		s.chunkDescs = append(s.chunkDescs, newDesc(c, c.FirstTime(), lastTime))
+	}
+	s.lastSampleValue = v.Value
 	return nil
 }
 
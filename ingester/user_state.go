@@ -11,12 +11,15 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/limits"
+	"github.com/weaveworks/cortex/usage"
 	"github.com/weaveworks/cortex/util"
 )
 
 type userStates struct {
 	mtx    sync.RWMutex
 	states map[string]*userState
+	limits *limits.Overrides
 	cfg    *UserStatesConfig
 }
 
@@ -34,21 +37,18 @@ type userState struct {
 
 // UserStatesConfig configures userStates properties.
 type UserStatesConfig struct {
-	RateUpdatePeriod   time.Duration
-	MaxSeriesPerUser   int
-	MaxSeriesPerMetric int
+	RateUpdatePeriod time.Duration
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *UserStatesConfig) RegisterFlags(f *flag.FlagSet) {
 	f.DurationVar(&cfg.RateUpdatePeriod, "ingester.rate-update-period", 15*time.Second, "Period with which to update the per-user ingestion rates.")
-	f.IntVar(&cfg.MaxSeriesPerUser, "ingester.max-series-per-user", DefaultMaxSeriesPerUser, "Maximum number of active series per user.")
-	f.IntVar(&cfg.MaxSeriesPerMetric, "ingester.max-series-per-metric", DefaultMaxSeriesPerMetric, "Maximum number of active series per metric name.")
 }
 
-func newUserStates(cfg *UserStatesConfig) *userStates {
+func newUserStates(limits *limits.Overrides, cfg *UserStatesConfig) *userStates {
 	return &userStates{
 		states: map[string]*userState{},
+		limits: limits,
 		cfg:    cfg,
 	}
 }
@@ -78,8 +78,9 @@ func (us *userStates) updateRates() {
 	us.mtx.RLock()
 	defer us.mtx.RUnlock()
 
-	for _, state := range us.states {
+	for id, state := range us.states {
 		state.ingestedSamples.tick()
+		usage.Set(id, usage.ActiveSeries, float64(state.fpToSeries.length()))
 	}
 }
 
@@ -108,6 +109,15 @@ func (us *userStates) get(userID string) (*userState, bool) {
 	return state, ok
 }
 
+// remove removes the user's state, so it's dropped rather than flushed.
+func (us *userStates) remove(userID string) (*userState, bool) {
+	us.mtx.Lock()
+	defer us.mtx.Unlock()
+	state, ok := us.states[userID]
+	delete(us.states, userID)
+	return state, ok
+}
+
 func (us *userStates) getOrCreate(ctx context.Context) (*userState, error) {
 	userID, err := user.Extract(ctx)
 	if err != nil {
@@ -142,7 +152,7 @@ func (us *userStates) getOrCreateSeries(ctx context.Context, metric model.Metric
 	us.mtx.RLock()
 	state, ok = us.states[userID]
 	if ok {
-		fp, series, err = state.unlockedGet(metric, us.cfg)
+		fp, series, err = state.unlockedGet(ctx, metric, us.limits)
 		if err != nil {
 			us.mtx.RUnlock()
 			return nil, fp, nil, err
@@ -156,7 +166,7 @@ func (us *userStates) getOrCreateSeries(ctx context.Context, metric model.Metric
 	us.mtx.Lock()
 	defer us.mtx.Unlock()
 	state = us.unlockedGetOrCreate(userID)
-	fp, series, err = state.unlockedGet(metric, us.cfg)
+	fp, series, err = state.unlockedGet(ctx, metric, us.limits)
 	return state, fp, series, err
 }
 
@@ -177,10 +187,10 @@ func (us *userStates) unlockedGetOrCreate(userID string) *userState {
 	return state
 }
 
-func (u *userState) unlockedGet(metric model.Metric, cfg *UserStatesConfig) (model.Fingerprint, *memorySeries, error) {
+func (u *userState) unlockedGet(ctx context.Context, metric model.Metric, limits *limits.Overrides) (model.Fingerprint, *memorySeries, error) {
 	rawFP := metric.FastFingerprint()
 	u.fpLocker.Lock(rawFP)
-	fp := u.mapper.mapFP(rawFP, metric)
+	fp := u.mapper.mapFP(ctx, rawFP, metric)
 	if fp != rawFP {
 		u.fpLocker.Unlock(rawFP)
 		u.fpLocker.Lock(fp)
@@ -196,7 +206,7 @@ func (u *userState) unlockedGet(metric model.Metric, cfg *UserStatesConfig) (mod
 	// all proceed to add a new series. This is likely not worth addressing,
 	// as this should happen rarely (all samples from one push are added
 	// serially), and the overshoot in allowed series would be minimal.
-	if u.fpToSeries.length() >= cfg.MaxSeriesPerUser {
+	if u.fpToSeries.length() >= limits.MaxSeriesPerUser(u.userID) {
 		u.fpLocker.Unlock(fp)
 		return fp, nil, util.ErrUserSeriesLimitExceeded
 	}
@@ -207,7 +217,7 @@ func (u *userState) unlockedGet(metric model.Metric, cfg *UserStatesConfig) (mod
 		return fp, nil, err
 	}
 
-	if !u.canAddSeriesFor(metricName, cfg) {
+	if !u.canAddSeriesFor(metricName, limits) {
 		u.fpLocker.Unlock(fp)
 		return fp, nil, util.ErrMetricSeriesLimitExceeded
 	}
@@ -218,11 +228,11 @@ func (u *userState) unlockedGet(metric model.Metric, cfg *UserStatesConfig) (mod
 	return fp, series, nil
 }
 
-func (u *userState) canAddSeriesFor(metric model.LabelValue, cfg *UserStatesConfig) bool {
+func (u *userState) canAddSeriesFor(metric model.LabelValue, limits *limits.Overrides) bool {
 	u.seriesInMetricMtx.Lock()
 	defer u.seriesInMetricMtx.Unlock()
 
-	if u.seriesInMetric[metric] >= cfg.MaxSeriesPerMetric {
+	if u.seriesInMetric[metric] >= limits.MaxSeriesPerMetric(u.userID) {
 		return false
 	}
 	u.seriesInMetric[metric]++
@@ -0,0 +1,180 @@
+package limits
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// Policies for resolving samples with the same timestamp as, but a different
+// value to, the last sample of a series.
+const (
+	DuplicateSampleReject    = "reject"
+	DuplicateSampleFirstWins = "first-wins"
+	DuplicateSampleLastWins  = "last-wins"
+)
+
+// Limits describe all the limits for users; can be used to describe global
+// default limits via flags, or per-user limits via yaml config.
+type Limits struct {
+	// Distributor enforced limits.
+	IngestionRate      float64 `yaml:"ingestion_rate"`
+	IngestionBurstSize int     `yaml:"ingestion_burst_size"`
+	MaxSamplesPerPush  int     `yaml:"max_samples_per_push"`
+
+	// The number of ingesters each user's series are spread over; 0 to use
+	// all ingesters.
+	IngestionTenantShardSize int `yaml:"ingestion_tenant_shard_size"`
+
+	// The most ingesters each user's series are spread over, whatever the
+	// shard size, so small users' series and queries stay on a few
+	// ingesters; 0 for no limit.
+	MaxIngestersPerUser int `yaml:"max_ingesters_per_user"`
+
+	// Labels removed from incoming series, e.g. external labels which
+	// differ between otherwise identical Prometheus servers.  Unlike the
+	// HA tracker's replica label, samples are never deduplicated by them.
+	DropLabels util.StringListValue `yaml:"drop_labels,omitempty"`
+
+	// Relabelling applied to incoming series; only configurable per-user.
+	MetricRelabelConfigs []*config.RelabelConfig `yaml:"metric_relabel_configs,omitempty"`
+
+	// If set, only metrics named in the allowlist are accepted; metrics
+	// named in the denylist are never accepted.  Only configurable per-user.
+	MetricAllowlist []string `yaml:"metric_allowlist,omitempty"`
+	MetricDenylist  []string `yaml:"metric_denylist,omitempty"`
+
+	// Ingester enforced limits.
+	MaxSeriesPerUser      int    `yaml:"max_series_per_user"`
+	MaxSeriesPerMetric    int    `yaml:"max_series_per_metric"`
+	DuplicateSamplePolicy string `yaml:"duplicate_sample_policy"`
+	util.ValidationConfig `yaml:",inline"`
+
+	// Series matching any of these selectors are only kept in the
+	// ingesters, and never written to the chunk store; only configurable
+	// per-user.
+	EphemeralSeries []string `yaml:"ephemeral_series,omitempty"`
+
+	// Querier enforced limits.
+	MaxQueryLength    time.Duration `yaml:"max_query_length"`
+	MaxSeriesPerQuery int           `yaml:"max_series_per_query"`
+	MaxChunksPerQuery int           `yaml:"max_chunks_per_query"`
+
+	// Chunks and index entries older than this are purged, and not
+	// queried; zero keeps them until their tables are deleted.
+	RetentionPeriod time.Duration `yaml:"retention_period"`
+
+	// Alertmanager enforced limits, in notifications per second to each
+	// integration, e.g. webhook, of a user.  Limits for particular
+	// integrations are only configurable per-user.
+	NotificationRateLimit               float64            `yaml:"notification_rate_limit"`
+	NotificationBurstSize               int                `yaml:"notification_burst_size"`
+	NotificationRateLimitPerIntegration map[string]float64 `yaml:"notification_rate_limit_per_integration,omitempty"`
+
+	// Config for the per-user overrides file.
+	PerUserOverrideConfig string        `yaml:"-"`
+	PerUserOverridePeriod time.Duration `yaml:"-"`
+
+	// The limits set by a user's overrides, by name.
+	overridden []string
+
+	ephemeralMatchers []metric.LabelMatchers
+	allowedMetrics    map[model.LabelValue]struct{}
+	deniedMetrics     map[model.LabelValue]struct{}
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (l *Limits) RegisterFlags(f *flag.FlagSet) {
+	f.Float64Var(&l.IngestionRate, "distributor.ingestion-rate-limit", 25000, "Per-user ingestion rate limit in samples per second.")
+	f.IntVar(&l.IngestionBurstSize, "distributor.ingestion-burst-size", 50000, "Per-user allowed ingestion burst size (in number of samples).")
+	f.IntVar(&l.MaxSamplesPerPush, "distributor.max-samples-per-push", 0, "Per-user maximum number of samples in a single push request. 0 to disable.")
+	f.IntVar(&l.IngestionTenantShardSize, "distributor.ingestion-tenant-shard-size", 0, "The number of ingesters each user's series are sharded over, chosen deterministically per user. 0 to shard over all ingesters.")
+	f.IntVar(&l.MaxIngestersPerUser, "distributor.max-ingesters-per-user", 0, "Per-user maximum number of ingesters the user's series are spread over, capping the tenant shard size. 0 for no limit.")
+	f.Var(&l.DropLabels, "distributor.drop-label", "Label to remove from every incoming series of a user, e.g. prometheus_replica; may be given multiple times.")
+	f.IntVar(&l.MaxSeriesPerUser, "ingester.max-series-per-user", 5000000, "Maximum number of active series per user.")
+	f.IntVar(&l.MaxSeriesPerMetric, "ingester.max-series-per-metric", 50000, "Maximum number of active series per metric name.")
+	f.StringVar(&l.DuplicateSamplePolicy, "ingester.duplicate-sample-policy", DuplicateSampleReject, "How to resolve a sample with the same timestamp but a different value to the last sample of its series: reject, first-wins or last-wins.")
+	f.DurationVar(&l.MaxQueryLength, "store.max-query-length", 0, "Limit to length of chunk store queries, 0 to disable.")
+	f.IntVar(&l.MaxSeriesPerQuery, "querier.max-series-per-query", 0, "Per-user maximum number of series a query's selector may match, in the ingesters or the chunk store. 0 to disable.")
+	f.IntVar(&l.MaxChunksPerQuery, "store.max-chunks-per-query", 0, "Per-user maximum number of chunks a query may fetch from the chunk store. 0 to disable.")
+	f.DurationVar(&l.RetentionPeriod, "store.retention-period", 0, "Per-user retention period of chunks in the chunk store, after which they're purged. 0 to keep them until their tables are deleted.")
+	f.Float64Var(&l.NotificationRateLimit, "alertmanager.notification-rate-limit", 0, "Per-user rate limit of notifications sent to each integration, e.g. webhook, in notifications per second. 0 to disable.")
+	f.IntVar(&l.NotificationBurstSize, "alertmanager.notification-burst-size", 1, "Per-user allowed burst of notifications sent to each integration.")
+	f.StringVar(&l.PerUserOverrideConfig, "limits.per-user-override-config", "", "File name of per-user overrides.")
+	f.DurationVar(&l.PerUserOverridePeriod, "limits.per-user-override-period", 10*time.Second, "Period with which to reload the overrides.")
+	l.ValidationConfig.RegisterFlags(f)
+}
+
+// compile parses the ephemeral series selectors, indexes the metric allow
+// and deny lists, and checks the duplicate sample policy and dropped labels.
+func (l *Limits) compile() error {
+	switch l.DuplicateSamplePolicy {
+	case "", DuplicateSampleReject, DuplicateSampleFirstWins, DuplicateSampleLastWins:
+	default:
+		return fmt.Errorf("invalid duplicate sample policy %q", l.DuplicateSamplePolicy)
+	}
+
+	for _, name := range l.DropLabels {
+		if name == model.MetricNameLabel || !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid label to drop %q", name)
+		}
+	}
+
+	l.allowedMetrics = metricNameSet(l.MetricAllowlist)
+	l.deniedMetrics = metricNameSet(l.MetricDenylist)
+
+	l.ephemeralMatchers = nil
+	for _, selector := range l.EphemeralSeries {
+		matchers, err := promql.ParseMetricSelector(selector)
+		if err != nil {
+			return fmt.Errorf("invalid ephemeral series selector %q: %v", selector, err)
+		}
+		l.ephemeralMatchers = append(l.ephemeralMatchers, matchers)
+	}
+	return nil
+}
+
+// isEphemeral returns true if the series matches any ephemeral selector.
+func (l *Limits) isEphemeral(m model.Metric) bool {
+outer:
+	for _, matchers := range l.ephemeralMatchers {
+		for _, matcher := range matchers {
+			if !matcher.Match(m[matcher.Name]) {
+				continue outer
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func metricNameSet(names []string) map[model.LabelValue]struct{} {
+	if len(names) == 0 {
+		return nil
+	}
+	set := make(map[model.LabelValue]struct{}, len(names))
+	for _, name := range names {
+		set[model.LabelValue(name)] = struct{}{}
+	}
+	return set
+}
+
+// allowsMetric returns true if the metric name passes the allow and deny
+// lists.
+func (l *Limits) allowsMetric(name model.LabelValue) bool {
+	if _, ok := l.deniedMetrics[name]; ok {
+		return false
+	}
+	if l.allowedMetrics != nil {
+		_, ok := l.allowedMetrics[name]
+		return ok
+	}
+	return true
+}
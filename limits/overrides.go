@@ -0,0 +1,374 @@
+package limits
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/config"
+	"gopkg.in/yaml.v2"
+
+	"github.com/weaveworks/cortex/util/log"
+)
+
+var overridesReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "cortex",
+	Name:      "overrides_last_reload_successful",
+	Help:      "Whether the last overrides reload attempt was successful.",
+})
+
+func init() {
+	prometheus.MustRegister(overridesReloadSuccess)
+}
+
+// Overrides periodically fetch a set of per-user overrides, and provides
+// convenience functions for fetching the correct value.
+type Overrides struct {
+	Defaults Limits
+
+	overridesMtx sync.RWMutex
+	overrides    map[string]*Limits
+	loadedAt     time.Time
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewOverrides makes a new Overrides.  If an overrides file is configured,
+// it is loaded and then reloaded periodically until Stop is called.
+func NewOverrides(defaults Limits) (*Overrides, error) {
+	if err := defaults.compile(); err != nil {
+		return nil, err
+	}
+	o := &Overrides{
+		Defaults:  defaults,
+		overrides: map[string]*Limits{},
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if defaults.PerUserOverrideConfig == "" {
+		close(o.done)
+		return o, nil
+	}
+
+	if err := o.reload(); err != nil {
+		return nil, err
+	}
+	go o.loop()
+	return o, nil
+}
+
+// Stop background reloading of overrides.
+func (o *Overrides) Stop() {
+	close(o.quit)
+	<-o.done
+}
+
+func (o *Overrides) loop() {
+	defer close(o.done)
+
+	ticker := time.NewTicker(o.Defaults.PerUserOverridePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := o.reload(); err != nil {
+				// Keep the last good overrides.
+				log.Errorf("Error reloading overrides: %v", err)
+			}
+		case <-o.quit:
+			return
+		}
+	}
+}
+
+func (o *Overrides) reload() error {
+	overrides, err := loadOverrides(o.Defaults.PerUserOverrideConfig, o.Defaults)
+	if err != nil {
+		overridesReloadSuccess.Set(0)
+		return err
+	}
+	overridesReloadSuccess.Set(1)
+
+	o.overridesMtx.Lock()
+	defer o.overridesMtx.Unlock()
+	o.overrides = overrides
+	o.loadedAt = time.Now()
+	return nil
+}
+
+// loadOverrides reads a file of the form:
+//
+//	overrides:
+//	  tenant1:
+//	    ingestion_rate: 10000
+//	    max_series_per_user: 100000
+//	    drop_labels: [prometheus_replica]
+//	    metric_relabel_configs:
+//	    - source_labels: [__name__]
+//	      regex: go_.*
+//	      action: drop
+//	    metric_denylist: [go_goroutines, go_threads]
+//	    ephemeral_series:
+//	    - '{__name__=~"debug_.*"}'
+//
+// Any limits not specified for a tenant take their default values.
+func loadOverrides(filename string, defaults Limits) (map[string]*Limits, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Overrides map[string]yaml.MapSlice `yaml:"overrides"`
+	}
+	if err := yaml.Unmarshal(buf, &file); err != nil {
+		return nil, err
+	}
+
+	overrides := make(map[string]*Limits, len(file.Overrides))
+	for userID, values := range file.Overrides {
+		// Round trip the tenant's section so that unspecified limits keep
+		// their defaults.
+		buf, err := yaml.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		limits := defaults
+		if err := yaml.Unmarshal(buf, &limits); err != nil {
+			return nil, err
+		}
+		if err := limits.compile(); err != nil {
+			return nil, fmt.Errorf("overrides for %s: %v", userID, err)
+		}
+		limits.overridden = make([]string, 0, len(values))
+		for _, item := range values {
+			limits.overridden = append(limits.overridden, fmt.Sprint(item.Key))
+		}
+		sort.Strings(limits.overridden)
+		overrides[userID] = &limits
+	}
+	return overrides, nil
+}
+
+func (o *Overrides) getLimits(userID string) *Limits {
+	o.overridesMtx.RLock()
+	defer o.overridesMtx.RUnlock()
+	if limits, ok := o.overrides[userID]; ok {
+		return limits
+	}
+	return &o.Defaults
+}
+
+// ServeHTTP shows the limits currently in effect as YAML.  With the `user`
+// query parameter it shows the effective limits for that user, otherwise the
+// defaults and the limits of every user with overrides.
+func (o *Overrides) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var output interface{}
+	if userID := r.FormValue("user"); userID != "" {
+		output = o.getLimits(userID)
+	} else {
+		o.overridesMtx.RLock()
+		output = struct {
+			Defaults  *Limits            `yaml:"defaults"`
+			Overrides map[string]*Limits `yaml:"overrides"`
+		}{
+			Defaults:  &o.Defaults,
+			Overrides: o.overrides,
+		}
+		o.overridesMtx.RUnlock()
+	}
+
+	// The overrides are replaced, never modified, on reload so it's safe to
+	// marshal them without holding the lock.
+	writeYAML(w, output)
+}
+
+// LimitsHandler shows the effective limits of the user given by the `user`
+// query parameter as YAML, with the limits set by the user's overrides, and
+// the overrides file and when it was last loaded.
+func (o *Overrides) LimitsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.FormValue("user")
+	if userID == "" {
+		http.Error(w, "no user given", http.StatusBadRequest)
+		return
+	}
+
+	output := struct {
+		User            string   `yaml:"user"`
+		OverridesFile   string   `yaml:"overrides_file,omitempty"`
+		OverridesLoaded string   `yaml:"overrides_loaded,omitempty"`
+		Overridden      []string `yaml:"overridden"`
+		Limits          *Limits  `yaml:"limits"`
+	}{
+		User:          userID,
+		OverridesFile: o.Defaults.PerUserOverrideConfig,
+		Overridden:    []string{},
+		Limits:        &o.Defaults,
+	}
+	o.overridesMtx.RLock()
+	if limits, ok := o.overrides[userID]; ok {
+		output.Overridden = limits.overridden
+		output.Limits = limits
+	}
+	if !o.loadedAt.IsZero() {
+		output.OverridesLoaded = o.loadedAt.UTC().Format(time.RFC3339)
+	}
+	o.overridesMtx.RUnlock()
+	writeYAML(w, output)
+}
+
+func writeYAML(w http.ResponseWriter, v interface{}) {
+	buf, err := yaml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf)
+}
+
+// IngestionRate returns the limit on ingestion rate (samples per second).
+func (o *Overrides) IngestionRate(userID string) float64 {
+	return o.getLimits(userID).IngestionRate
+}
+
+// IngestionBurstSize returns the burst size for ingestion rate.
+func (o *Overrides) IngestionBurstSize(userID string) int {
+	return o.getLimits(userID).IngestionBurstSize
+}
+
+// MaxSamplesPerPush returns the maximum number of samples in a single push
+// request from the user.
+func (o *Overrides) MaxSamplesPerPush(userID string) int {
+	return o.getLimits(userID).MaxSamplesPerPush
+}
+
+// DuplicateSamplePolicy returns how to resolve samples with the same
+// timestamp but different values for the user.
+func (o *Overrides) DuplicateSamplePolicy(userID string) string {
+	return o.getLimits(userID).DuplicateSamplePolicy
+}
+
+// IngestionTenantShardSize returns the number of ingesters the user's series
+// are sharded over.
+func (o *Overrides) IngestionTenantShardSize(userID string) int {
+	return o.getLimits(userID).IngestionTenantShardSize
+}
+
+// MaxIngestersPerUser returns the most ingesters the user's series are
+// spread over.
+func (o *Overrides) MaxIngestersPerUser(userID string) int {
+	return o.getLimits(userID).MaxIngestersPerUser
+}
+
+// DropLabels returns the names of the labels removed from the user's
+// incoming series.
+func (o *Overrides) DropLabels(userID string) []string {
+	return o.getLimits(userID).DropLabels
+}
+
+// MetricRelabelConfigs returns the relabel configs applied to the user's
+// incoming series.
+func (o *Overrides) MetricRelabelConfigs(userID string) []*config.RelabelConfig {
+	return o.getLimits(userID).MetricRelabelConfigs
+}
+
+// AllowsMetric returns true if the user's allow and deny lists accept metrics
+// with the given name.
+func (o *Overrides) AllowsMetric(userID string, name model.LabelValue) bool {
+	return o.getLimits(userID).allowsMetric(name)
+}
+
+// IsEphemeral returns true if the user's series should only be kept in the
+// ingesters.
+func (o *Overrides) IsEphemeral(userID string, m model.Metric) bool {
+	return o.getLimits(userID).isEphemeral(m)
+}
+
+// MaxSeriesPerUser returns the maximum number of series a user is allowed to store.
+func (o *Overrides) MaxSeriesPerUser(userID string) int {
+	return o.getLimits(userID).MaxSeriesPerUser
+}
+
+// MaxSeriesPerMetric returns the maximum number of series allowed per metric.
+func (o *Overrides) MaxSeriesPerMetric(userID string) int {
+	return o.getLimits(userID).MaxSeriesPerMetric
+}
+
+// MaxQueryLength returns the limit of the length (in time) of a query.
+func (o *Overrides) MaxQueryLength(userID string) time.Duration {
+	return o.getLimits(userID).MaxQueryLength
+}
+
+// MaxSeriesPerQuery returns the maximum number of series a query's selector
+// may match.
+func (o *Overrides) MaxSeriesPerQuery(userID string) int {
+	return o.getLimits(userID).MaxSeriesPerQuery
+}
+
+// MaxChunksPerQuery returns the maximum number of chunks a query may fetch
+// from the chunk store.
+func (o *Overrides) MaxChunksPerQuery(userID string) int {
+	return o.getLimits(userID).MaxChunksPerQuery
+}
+
+// RetentionPeriod returns how long the user's chunks are kept in the chunk
+// store, or 0 if they're kept until their tables are deleted.
+func (o *Overrides) RetentionPeriod(userID string) time.Duration {
+	return o.getLimits(userID).RetentionPeriod
+}
+
+// MinRetentionPeriod returns the shortest retention period of any user, or 0
+// if no user has one.
+func (o *Overrides) MinRetentionPeriod() time.Duration {
+	o.overridesMtx.RLock()
+	defer o.overridesMtx.RUnlock()
+	min := o.Defaults.RetentionPeriod
+	for _, limits := range o.overrides {
+		if limits.RetentionPeriod > 0 && (min == 0 || limits.RetentionPeriod < min) {
+			min = limits.RetentionPeriod
+		}
+	}
+	return min
+}
+
+// NotificationRateLimit returns the rate limit of the user's notifications
+// to an integration, or 0 if they're unlimited.
+func (o *Overrides) NotificationRateLimit(userID, integration string) float64 {
+	limits := o.getLimits(userID)
+	if limit, ok := limits.NotificationRateLimitPerIntegration[integration]; ok {
+		return limit
+	}
+	return limits.NotificationRateLimit
+}
+
+// NotificationBurstSize returns the burst size for the user's notifications
+// to each integration.
+func (o *Overrides) NotificationBurstSize(userID string) int {
+	return o.getLimits(userID).NotificationBurstSize
+}
+
+// ValidateSample returns an err if the sample is invalid according to the
+// user's limits, and counts the sample as discarded.
+func (o *Overrides) ValidateSample(userID string, s *model.Sample) error {
+	return o.getLimits(userID).ValidateSample(userID, s)
+}
+
+// ValidateLabels returns an err if the labels of a series are invalid
+// according to the user's limits, and counts its samples as discarded.
+func (o *Overrides) ValidateLabels(userID string, metric model.Metric, samples int) error {
+	return o.getLimits(userID).ValidateLabels(userID, metric, samples)
+}
+
+// ValidateTimestamp returns an err if samples with the timestamp are invalid
+// according to the user's limits, and counts them as discarded.
+func (o *Overrides) ValidateTimestamp(userID string, ts model.Time, samples int) error {
+	return o.getLimits(userID).ValidateTimestamp(userID, ts, samples)
+}
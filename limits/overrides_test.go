@@ -0,0 +1,220 @@
+package limits
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestOverridesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overrides")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "overrides.yaml")
+
+	require.NoError(t, ioutil.WriteFile(filename, []byte(`
+overrides:
+  user1:
+    ingestion_rate: 10
+    max_series_per_user: 100
+    max_label_names_per_series: 5
+    drop_labels: [prometheus_replica, env]
+  user2:
+    max_query_length: 24h
+    retention_period: 168h
+    notification_rate_limit_per_integration:
+      webhook: 0.5
+    metric_relabel_configs:
+    - source_labels: [__name__]
+      regex: go_.*
+      action: drop
+`), 0644))
+
+	defaults := Limits{
+		IngestionRate:         1000,
+		IngestionBurstSize:    2000,
+		MaxSeriesPerUser:      3000,
+		MaxSeriesPerMetric:    4000,
+		NotificationRateLimit: 2,
+		DropLabels:            []string{"env"},
+		PerUserOverrideConfig: filename,
+		PerUserOverridePeriod: time.Hour,
+	}
+	defaults.MaxLabelNamesPerSeries = 30
+	o, err := NewOverrides(defaults)
+	require.NoError(t, err)
+	defer o.Stop()
+
+	assert.Equal(t, 10.0, o.IngestionRate("user1"))
+	assert.Equal(t, 2000, o.IngestionBurstSize("user1"))
+	assert.Equal(t, 100, o.MaxSeriesPerUser("user1"))
+	assert.Equal(t, 4000, o.MaxSeriesPerMetric("user1"))
+	assert.Equal(t, 5, o.getLimits("user1").MaxLabelNamesPerSeries)
+	assert.Equal(t, time.Duration(0), o.MaxQueryLength("user1"))
+	assert.Equal(t, []string{"prometheus_replica", "env"}, o.DropLabels("user1"))
+	assert.Equal(t, []string{"env"}, o.DropLabels("user2"))
+
+	assert.Equal(t, 1000.0, o.IngestionRate("user2"))
+	assert.Equal(t, 24*time.Hour, o.MaxQueryLength("user2"))
+	require.Len(t, o.MetricRelabelConfigs("user2"), 1)
+	assert.True(t, o.MetricRelabelConfigs("user2")[0].Regex.MatchString("go_goroutines"))
+	assert.Empty(t, o.MetricRelabelConfigs("user1"))
+	assert.Equal(t, 0.5, o.NotificationRateLimit("user2", "webhook"))
+	assert.Equal(t, 2.0, o.NotificationRateLimit("user2", "slack"))
+	assert.Equal(t, 2.0, o.NotificationRateLimit("user1", "webhook"))
+	assert.Equal(t, 168*time.Hour, o.RetentionPeriod("user2"))
+	assert.Equal(t, time.Duration(0), o.RetentionPeriod("user1"))
+	assert.Equal(t, 168*time.Hour, o.MinRetentionPeriod())
+
+	assert.Equal(t, 1000.0, o.IngestionRate("user3"))
+	assert.Equal(t, 30, o.getLimits("user3").MaxLabelNamesPerSeries)
+
+	// A bad file keeps the last good overrides.
+	require.NoError(t, ioutil.WriteFile(filename, []byte(`overrides: [`), 0644))
+	assert.Error(t, o.reload())
+	assert.Equal(t, 10.0, o.IngestionRate("user1"))
+
+	// The metric name can't be dropped.
+	require.NoError(t, ioutil.WriteFile(filename, []byte(`
+overrides:
+  user1:
+    drop_labels: [__name__]
+`), 0644))
+	assert.Error(t, o.reload())
+	assert.Equal(t, []string{"prometheus_replica", "env"}, o.DropLabels("user1"))
+
+	require.NoError(t, ioutil.WriteFile(filename, []byte(`
+overrides:
+  user2:
+    ingestion_rate: 20
+`), 0644))
+	require.NoError(t, o.reload())
+	assert.Equal(t, 1000.0, o.IngestionRate("user1"))
+	assert.Equal(t, 20.0, o.IngestionRate("user2"))
+	assert.Equal(t, time.Duration(0), o.MinRetentionPeriod())
+}
+
+func TestOverridesWithoutFile(t *testing.T) {
+	o, err := NewOverrides(Limits{IngestionRate: 1000})
+	require.NoError(t, err)
+	defer o.Stop()
+	assert.Equal(t, 1000.0, o.IngestionRate("user1"))
+}
+
+func TestOverridesHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overrides")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "overrides.yaml")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(`
+overrides:
+  user1:
+    max_query_length: 24h
+`), 0644))
+
+	o, err := NewOverrides(Limits{
+		IngestionRate:         1000,
+		PerUserOverrideConfig: filename,
+		PerUserOverridePeriod: time.Hour,
+	})
+	require.NoError(t, err)
+	defer o.Stop()
+
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/runtime_config?user=user1", nil))
+	var limits Limits
+	require.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &limits))
+	assert.Equal(t, 1000.0, limits.IngestionRate)
+	assert.Equal(t, 24*time.Hour, limits.MaxQueryLength)
+
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/runtime_config", nil))
+	var all struct {
+		Defaults  Limits            `yaml:"defaults"`
+		Overrides map[string]Limits `yaml:"overrides"`
+	}
+	require.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &all))
+	assert.Equal(t, time.Duration(0), all.Defaults.MaxQueryLength)
+	assert.Equal(t, 24*time.Hour, all.Overrides["user1"].MaxQueryLength)
+}
+
+func TestOverridesLimitsHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overrides")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "overrides.yaml")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(`
+overrides:
+  user1:
+    max_query_length: 24h
+    ingestion_rate: 1000
+`), 0644))
+
+	o, err := NewOverrides(Limits{
+		IngestionRate:         1000,
+		MaxSeriesPerUser:      3000,
+		PerUserOverrideConfig: filename,
+		PerUserOverridePeriod: time.Hour,
+	})
+	require.NoError(t, err)
+	defer o.Stop()
+
+	type effectiveLimits struct {
+		User            string   `yaml:"user"`
+		OverridesFile   string   `yaml:"overrides_file"`
+		OverridesLoaded string   `yaml:"overrides_loaded"`
+		Overridden      []string `yaml:"overridden"`
+		Limits          Limits   `yaml:"limits"`
+	}
+	get := func(userID string) effectiveLimits {
+		w := httptest.NewRecorder()
+		o.LimitsHandler(w, httptest.NewRequest("GET", "/limits?user="+userID, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var limits effectiveLimits
+		require.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &limits))
+		return limits
+	}
+
+	// Limits set in the overrides are listed even if they're the defaults.
+	limits := get("user1")
+	assert.Equal(t, "user1", limits.User)
+	assert.Equal(t, filename, limits.OverridesFile)
+	assert.NotEmpty(t, limits.OverridesLoaded)
+	assert.Equal(t, []string{"ingestion_rate", "max_query_length"}, limits.Overridden)
+	assert.Equal(t, 24*time.Hour, limits.Limits.MaxQueryLength)
+	assert.Equal(t, 3000, limits.Limits.MaxSeriesPerUser)
+
+	limits = get("user2")
+	assert.Empty(t, limits.Overridden)
+	assert.Equal(t, time.Duration(0), limits.Limits.MaxQueryLength)
+	assert.Equal(t, 1000.0, limits.Limits.IngestionRate)
+
+	w := httptest.NewRecorder()
+	o.LimitsHandler(w, httptest.NewRequest("GET", "/limits", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestOverridesEphemeralSeries(t *testing.T) {
+	o, err := NewOverrides(Limits{
+		EphemeralSeries: []string{`{__name__=~"debug_.*"}`, `{job="test", env!="prod"}`},
+	})
+	require.NoError(t, err)
+	defer o.Stop()
+
+	assert.True(t, o.IsEphemeral("user", model.Metric{model.MetricNameLabel: "debug_requests"}))
+	assert.True(t, o.IsEphemeral("user", model.Metric{model.MetricNameLabel: "up", "job": "test"}))
+	assert.False(t, o.IsEphemeral("user", model.Metric{model.MetricNameLabel: "up", "job": "test", "env": "prod"}))
+	assert.False(t, o.IsEphemeral("user", model.Metric{model.MetricNameLabel: "requests"}))
+
+	_, err = NewOverrides(Limits{EphemeralSeries: []string{`{`}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,225 @@
+package modules
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/auth"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/distributor"
+	"github.com/weaveworks/cortex/events"
+	"github.com/weaveworks/cortex/ingester"
+	"github.com/weaveworks/cortex/limits"
+	"github.com/weaveworks/cortex/querier"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/ruler"
+	"github.com/weaveworks/cortex/usage"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// Config is the config of every module.  Modules share flags, e.g. the ring
+// flags of the ring and the ingester, so setting one sets them all.
+type Config struct {
+	Target string
+
+	Server            server.Config
+	HTTPPrefix        util.PathPrefixConfig
+	Auth              auth.Config
+	Debug             util.DebugConfig
+	Tracing           util.TracingConfig
+	Ring              ring.Config
+	Distributor       distributor.Config
+	Ingester          ingester.Config
+	ChunkStore        chunk.StoreConfig
+	Storage           chunk.StorageClientConfig
+	DynamoTableClient chunk.DynamoTableClientConfig
+	TableManager      chunk.TableManagerConfig
+	Purger            chunk.PurgerConfig
+	Scrubber          chunk.ScrubberConfig
+	Admission         querier.AdmissionConfig
+	Estimator         querier.EstimatorConfig
+	Ruler             ruler.Config
+	Events            events.Config
+	Usage             usage.Config
+	Limits            limits.Limits
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	cfg.Server = server.Config{
+		MetricsNamespace: "cortex",
+		GRPCMiddleware: []grpc.UnaryServerInterceptor{
+			middleware.ServerUserHeaderInterceptor,
+		},
+	}
+	// Ingester needs to know our gRPC listen port.
+	cfg.Ingester.ListenPort = &cfg.Server.GRPCListenPort
+	// Distributors share the ring's consul config for the global ingestion
+	// rate strategy, as do rulers for sharding, and the quarantine list is
+	// kept alongside the ring.
+	cfg.Distributor.ConsulConfig = &cfg.Ring.ConsulConfig
+	cfg.Ruler.ConsulConfig = &cfg.Ring.ConsulConfig
+	cfg.ChunkStore.Quarantine.ConsulConfig = &cfg.Ring.ConsulConfig
+
+	util.RegisterSharedFlagsOn(f, &cfg.Server, &cfg.HTTPPrefix, &cfg.Auth, &cfg.Debug, &cfg.Tracing, &cfg.Ring, &cfg.Distributor, &cfg.Ingester, &cfg.ChunkStore, &cfg.Storage,
+		&cfg.DynamoTableClient, &cfg.TableManager, &cfg.Purger, &cfg.Scrubber, &cfg.Admission, &cfg.Estimator, &cfg.Ruler, &cfg.Events, &cfg.Usage, &cfg.Limits)
+	f.StringVar(&cfg.Target, "target", All, "Comma separated modules to run: "+strings.Join(moduleNames(), ", ")+".")
+}
+
+// Cortex is the modules running in this process.
+type Cortex struct {
+	cfg     Config
+	started []string
+
+	tracing      io.Closer
+	server       *server.Server
+	router       *mux.Router
+	authenticate middleware.Interface
+	readiness    *util.Readiness
+	overrides    *limits.Overrides
+	ring         *ring.Ring
+	store        *chunk.Store
+	distributor  *distributor.Distributor
+	ingester     *ingester.Ingester
+	tableManager *chunk.DynamoTableManager
+	purger       *chunk.Purger
+	scrubber     *chunk.Scrubber
+	ruler        *ruler.Ruler
+	rulerServer  *ruler.Server
+}
+
+// New starts the target modules and their dependencies, in order.
+func New(cfg Config) (*Cortex, error) {
+	targets, err := parseTarget(cfg.Target)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cortex{cfg: cfg}
+	for _, name := range startOrder(targets) {
+		log.Infof("Starting module %s", name)
+		if err := modules[name].start(c); err != nil {
+			c.Stop()
+			return nil, fmt.Errorf("error starting module %s: %v", name, err)
+		}
+		c.started = append(c.started, name)
+	}
+	return c, nil
+}
+
+// Run serves requests until the process is signalled to stop.
+func (c *Cortex) Run() {
+	c.server.Run()
+}
+
+// Stop the started modules, in the reverse of the order they started.
+func (c *Cortex) Stop() {
+	for i := len(c.started) - 1; i >= 0; i-- {
+		name := c.started[i]
+		log.Infof("Stopping module %s", name)
+		if stop := modules[name].stop; stop != nil {
+			stop(c)
+		}
+	}
+	c.started = nil
+}
+
+// parseTarget returns the modules in a comma separated target.
+func parseTarget(target string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(target, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := modules[name]; !ok {
+			return nil, fmt.Errorf("unknown module %q; expected one of %s", name, strings.Join(moduleNames(), ", "))
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no modules to run")
+	}
+	return names, nil
+}
+
+// startOrder returns the targets and their dependencies, each after its
+// dependencies.
+func startOrder(targets []string) []string {
+	var (
+		order   []string
+		visited = map[string]bool{}
+		visit   func(string)
+	)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+		for _, dep := range modules[name].deps {
+			visit(dep)
+		}
+		order = append(order, name)
+	}
+	for _, name := range targets {
+		visit(name)
+	}
+	return order
+}
+
+// includes returns whether the target runs the module.
+func includes(target []string, name string) bool {
+	for _, n := range startOrder(target) {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func moduleNames() []string {
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetSingleProcessDefaults changes the defaults of flags the user didn't
+// set when the target runs the ingester and the distributor together: the
+// ring is kept in memory, the ingester registers a local address, and
+// samples are written once.  It must be called after the flags are parsed.
+func SetSingleProcessDefaults(cfg *Config) error {
+	targets, err := parseTarget(cfg.Target)
+	if err != nil {
+		return err
+	}
+	if !includes(targets, Ingester) || !includes(targets, Distributor) {
+		return nil
+	}
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, value := range map[string]string{
+		"ring.store":                     "inmemory",
+		"ingester.addr":                  "127.0.0.1",
+		"distributor.replication-factor": "1",
+	} {
+		if set[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package modules
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/retrieval"
+	"github.com/prometheus/prometheus/web/api/v1"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/auth"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/distributor"
+	"github.com/weaveworks/cortex/events"
+	"github.com/weaveworks/cortex/ingester"
+	"github.com/weaveworks/cortex/limits"
+	"github.com/weaveworks/cortex/querier"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/ruler"
+	"github.com/weaveworks/cortex/usage"
+	"github.com/weaveworks/cortex/util"
+)
+
+// The modules that can be given as targets.
+const (
+	Server       = "server"
+	Overrides    = "overrides"
+	Ring         = "ring"
+	Store        = "store"
+	Distributor  = "distributor"
+	Ingester     = "ingester"
+	Querier      = "querier"
+	TableManager = "table-manager"
+	Ruler        = "ruler"
+	All          = "all"
+)
+
+// module is a part of Cortex that can be run in a process along with other
+// modules.  Modules start after, and stop before, the modules they depend on.
+type module struct {
+	deps  []string
+	start func(c *Cortex) error
+	stop  func(c *Cortex)
+}
+
+var modules = map[string]module{
+	Server: {
+		start: startServer,
+		stop: func(c *Cortex) {
+			c.server.Shutdown()
+			events.Stop()
+			usage.Stop()
+			c.tracing.Close()
+		},
+	},
+
+	Overrides: {
+		deps:  []string{Server},
+		start: startOverrides,
+		stop:  func(c *Cortex) { c.overrides.Stop() },
+	},
+
+	Ring: {
+		deps:  []string{Server},
+		start: startRing,
+		stop:  func(c *Cortex) { c.ring.Stop() },
+	},
+
+	Store: {
+		deps:  []string{Server},
+		start: startStore,
+		stop:  func(c *Cortex) { c.store.Stop() },
+	},
+
+	Distributor: {
+		deps:  []string{Ring, Overrides},
+		start: startDistributor,
+		stop:  func(c *Cortex) { c.distributor.Stop() },
+	},
+
+	Ingester: {
+		deps:  []string{Store, Overrides, Ring},
+		start: startIngester,
+		stop:  func(c *Cortex) { c.ingester.Shutdown() },
+	},
+
+	Querier: {
+		deps:  []string{Distributor, Store},
+		start: startQuerier,
+	},
+
+	TableManager: {
+		deps:  []string{Server, Overrides, Store},
+		start: startTableManager,
+		stop: func(c *Cortex) {
+			if c.purger != nil {
+				c.purger.Stop()
+			}
+			if c.scrubber != nil {
+				c.scrubber.Stop()
+			}
+			c.tableManager.Stop()
+		},
+	},
+
+	Ruler: {
+		deps:  []string{Distributor, Store},
+		start: startRuler,
+		stop: func(c *Cortex) {
+			c.rulerServer.Stop()
+			c.ruler.Stop()
+		},
+	},
+
+	All: {
+		deps:  []string{Distributor, Ingester, Querier, TableManager},
+		start: func(c *Cortex) error { return nil },
+	},
+}
+
+func startServer(c *Cortex) (err error) {
+	c.authenticate, err = c.cfg.Auth.Authenticate()
+	if err != nil {
+		return err
+	}
+	// Clients take the global tracer when they're created, so it's set up
+	// before any other module starts.
+	c.tracing, err = c.cfg.Tracing.InitTracing("cortex")
+	if err != nil {
+		return err
+	}
+	events.Init(c.cfg.Events)
+	if err := usage.Init(c.cfg.Usage); err != nil {
+		events.Stop()
+		c.tracing.Close()
+		return err
+	}
+	serverCfg := c.cfg.Server
+	c.cfg.Debug.Register(&serverCfg, c.cfg.Auth.Require(auth.OpsAdmin))
+	grpcOptions, err := c.cfg.Ingester.GRPCServerOptions()
+	if err != nil {
+		events.Stop()
+		usage.Stop()
+		c.tracing.Close()
+		return err
+	}
+	c.server, err = util.NewServer(serverCfg, grpcOptions...)
+	if err != nil {
+		events.Stop()
+		usage.Stop()
+		c.tracing.Close()
+		return err
+	}
+	c.router = c.cfg.HTTPPrefix.Router(c.server.HTTP)
+	c.readiness = util.NewReadiness()
+	c.readiness.Register(c.server.HTTP)
+	util.RegisterLogLevel(c.router, c.cfg.Auth.Require(auth.OpsAdmin))
+	c.router.Handle("/events", events.Handler())
+	return nil
+}
+
+func startOverrides(c *Cortex) (err error) {
+	c.overrides, err = limits.NewOverrides(c.cfg.Limits)
+	if err != nil {
+		return err
+	}
+	c.router.Handle("/runtime_config", c.overrides)
+	c.router.Handle("/limits", c.cfg.Auth.Require(auth.OpsAdmin).Wrap(http.HandlerFunc(c.overrides.LimitsHandler)))
+	return nil
+}
+
+func startRing(c *Cortex) (err error) {
+	c.ring, err = ring.New(c.cfg.Ring)
+	if err != nil {
+		return err
+	}
+	c.readiness.Add("ring", c.ring.CheckReady)
+	c.router.Handle("/ring", c.cfg.Auth.Require(auth.OpsAdmin).Wrap(c.ring))
+	c.router.Handle("/multikv", c.cfg.Auth.Require(auth.OpsAdmin).Wrap(ring.MultiKVHandler()))
+	return nil
+}
+
+func startStore(c *Cortex) error {
+	storageClient, err := chunk.NewStorageClient(c.cfg.Storage)
+	if err != nil {
+		return err
+	}
+	// Queries mustn't read tables the table manager may have deleted.
+	if c.cfg.ChunkStore.MaxLookBackPeriod == 0 {
+		c.cfg.ChunkStore.MaxLookBackPeriod = c.cfg.TableManager.RetentionPeriod
+	}
+	c.store, err = chunk.NewStore(c.cfg.ChunkStore, storageClient)
+	if err != nil {
+		return err
+	}
+	c.readiness.Add("store", c.store.CheckReady)
+	c.router.Handle("/quarantine", c.cfg.Auth.Require(auth.OpsAdmin).Wrap(http.HandlerFunc(c.store.Quarantine)))
+	c.router.Path("/index_sharding").Handler(http.HandlerFunc(c.store.IndexShardingReport))
+	return nil
+}
+
+func startDistributor(c *Cortex) (err error) {
+	c.distributor, err = distributor.New(c.cfg.Distributor, c.ring, c.overrides)
+	if err != nil {
+		return err
+	}
+	prometheus.MustRegister(c.distributor)
+	c.router.Handle("/api/prom/push", middleware.Merge(c.authenticate, c.cfg.Auth.Require(auth.Write)).Wrap(http.HandlerFunc(c.distributor.PushHandler)))
+	c.router.Handle("/api/prom/influx/write", middleware.Merge(c.authenticate, c.cfg.Auth.Require(auth.Write)).Wrap(http.HandlerFunc(c.distributor.InfluxPushHandler)))
+	c.router.Handle("/api/prom/push/json", middleware.Merge(c.authenticate, c.cfg.Auth.Require(auth.Write)).Wrap(http.HandlerFunc(c.distributor.JSONPushHandler)))
+	c.router.Handle("/api/prom/discarded_samples", middleware.Merge(c.authenticate, c.cfg.Auth.Require(auth.Read)).Wrap(http.HandlerFunc(c.distributor.DiscardsHandler)))
+	return nil
+}
+
+func startIngester(c *Cortex) (err error) {
+	c.ingester, err = ingester.New(c.cfg.Ingester, c.store, c.overrides)
+	if err != nil {
+		return err
+	}
+	prometheus.MustRegister(c.ingester)
+	cortex.RegisterIngesterServer(c.server.GRPC, c.ingester)
+	c.readiness.Add("ingester", c.ingester.CheckReady)
+	return nil
+}
+
+type dummyTargetRetriever struct{}
+
+func (r dummyTargetRetriever) Targets() []*retrieval.Target { return nil }
+
+type dummyAlertmanagerRetriever struct{}
+
+func (r dummyAlertmanagerRetriever) Alertmanagers() []string { return nil }
+
+func startQuerier(c *Cortex) error {
+	estimator, err := querier.NewEstimator(c.cfg.Estimator, c.distributor, c.store)
+	if err != nil {
+		return err
+	}
+
+	queryable := querier.NewQueryable(c.distributor, c.store, c.overrides)
+	engine := promql.NewEngine(queryable, nil)
+	api := v1.NewAPI(engine, querier.DummyStorage{Queryable: queryable}, dummyTargetRetriever{}, dummyAlertmanagerRetriever{})
+	promRouter := route.New(func(r *http.Request) (context.Context, error) {
+		return r.Context(), nil
+	}).WithPrefix(c.cfg.HTTPPrefix.Path() + "/api/prom/api/v1")
+	api.Register(promRouter)
+
+	subrouter := c.router.PathPrefix("/api/prom").Subrouter()
+	authenticate := middleware.Merge(c.authenticate, c.cfg.Auth.Require(auth.Read))
+	admission := querier.NewAdmissionController(c.cfg.Admission)
+	// Deleting series, and cancelling deletion, needs write access; listing
+	// delete requests only read.
+	deleteSeries := querier.NewDeleteSeriesHandler(c.store)
+	deletesAuth := middleware.Merge(c.authenticate, c.cfg.Auth.RequireByMethod(auth.Read, auth.Write))
+	subrouter.Path("/api/v1/admin/tsdb/delete_series").Handler(deletesAuth.Wrap(deleteSeries))
+	subrouter.Path("/api/v1/admin/tsdb/cancel_delete_request").Handler(deletesAuth.Wrap(http.HandlerFunc(deleteSeries.Cancel)))
+	subrouter.PathPrefix("/api/v1").Handler(authenticate.Wrap(admission.Wrap(querier.ClientClosedRequest.Wrap(promRouter))))
+	subrouter.Path("/estimate").Handler(authenticate.Wrap(estimator))
+	subrouter.Path("/label_values").Handler(authenticate.Wrap(querier.NewLabelValuesHandler(c.distributor, c.store)))
+	subrouter.Path("/validate_expr").Handler(authenticate.Wrap(http.HandlerFunc(c.distributor.ValidateExprHandler)))
+	subrouter.Path("/user_stats").Handler(authenticate.Wrap(http.HandlerFunc(c.distributor.UserStatsHandler)))
+	return nil
+}
+
+func startTableManager(c *Cortex) error {
+	dynamoClient, err := chunk.NewDynamoTableClient(c.cfg.DynamoTableClient)
+	if err != nil {
+		return err
+	}
+	c.tableManager, err = chunk.NewDynamoTableManager(c.cfg.TableManager, dynamoClient)
+	if err != nil {
+		return err
+	}
+	c.tableManager.Start()
+	c.router.Handle("/tables", c.cfg.Auth.Require(auth.OpsAdmin).Wrap(c.tableManager))
+
+	if c.cfg.Purger.Enabled() {
+		c.purger = chunk.NewPurger(c.cfg.Purger, c.cfg.TableManager, c.store, dynamoClient, c.overrides)
+		c.purger.Start()
+	}
+	if c.cfg.Scrubber.Interval > 0 {
+		c.scrubber = chunk.NewScrubber(c.cfg.Scrubber, c.cfg.TableManager, c.store, dynamoClient)
+		c.scrubber.Start()
+	}
+	return nil
+}
+
+func startRuler(c *Cortex) (err error) {
+	c.ruler, err = ruler.NewRuler(c.cfg.Ruler, c.distributor, c.store, c.overrides)
+	if err != nil {
+		return err
+	}
+	c.rulerServer, err = ruler.NewServer(c.cfg.Ruler, c.ruler)
+	if err != nil {
+		c.ruler.Stop()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package modules
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModuleDependencies(t *testing.T) {
+	for name, m := range modules {
+		for _, dep := range m.deps {
+			_, ok := modules[dep]
+			assert.True(t, ok, "module %s depends on unknown module %s", name, dep)
+		}
+	}
+}
+
+func TestStartOrder(t *testing.T) {
+	targets, err := parseTarget("querier, table-manager")
+	require.NoError(t, err)
+	assert.Equal(t, []string{Server, Ring, Overrides, Distributor, Store, Querier, TableManager}, startOrder(targets))
+
+	// Every module starts after its dependencies.
+	order := startOrder([]string{All, Ruler})
+	position := map[string]int{}
+	for i, name := range order {
+		position[name] = i
+	}
+	assert.Len(t, position, len(modules))
+	for name, m := range modules {
+		for _, dep := range m.deps {
+			assert.True(t, position[dep] < position[name], "%s starts before its dependency %s", name, dep)
+		}
+	}
+
+	assert.True(t, includes([]string{All}, Ingester))
+	assert.False(t, includes([]string{Querier}, Ingester))
+}
+
+func TestParseTarget(t *testing.T) {
+	_, err := parseTarget("ingester,compactor")
+	assert.Error(t, err)
+	_, err = parseTarget(" , ")
+	assert.Error(t, err)
+}
@@ -0,0 +1,253 @@
+package querier
+
+import (
+	"flag"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+var (
+	querySamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "querier_query_samples_total",
+		Help:      "The total number of samples processed by queries.",
+	}, []string{"user"})
+	queryChunkBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "querier_query_chunk_bytes_total",
+		Help:      "The total number of chunk bytes fetched from the store by queries.",
+	}, []string{"user"})
+	queuedQueries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "querier_queued_queries",
+		Help:      "The current number of queries waiting for admission.",
+	})
+	rejectedQueries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "querier_rejected_queries_total",
+		Help:      "The total number of queries rejected after waiting too long for admission.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(querySamples)
+	prometheus.MustRegister(queryChunkBytes)
+	prometheus.MustRegister(queuedQueries)
+	prometheus.MustRegister(rejectedQueries)
+}
+
+// AdmissionConfig configures query admission control.
+type AdmissionConfig struct {
+	MaxConcurrent    int
+	MaxQueueDuration time.Duration
+	CostHalfLife     time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *AdmissionConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.MaxConcurrent, "querier.max-concurrent", 0, "Maximum number of queries to execute at once. When saturated, queued queries from users with the lowest recent query cost are admitted first. 0 to disable.")
+	f.DurationVar(&cfg.MaxQueueDuration, "querier.max-queue-duration", 30*time.Second, "Maximum time a query will wait for admission before being rejected.")
+	f.DurationVar(&cfg.CostHalfLife, "querier.cost-half-life", 5*time.Minute, "Half-life of the per-user query cost used to prioritise queued queries.")
+}
+
+// AdmissionController limits the number of concurrent queries.  It tracks
+// a decaying per-user cost (the number of samples their queries have
+// processed), and once saturated admits waiting queries from the cheapest
+// users first, so heavy users are the first to be degraded.
+type AdmissionController struct {
+	cfg AdmissionConfig
+
+	mtx      sync.Mutex
+	inflight int
+	waiting  []*admissionWaiter
+	costs    map[string]*queryCost
+}
+
+type admissionWaiter struct {
+	userID   string
+	admitted chan struct{}
+}
+
+type queryCost struct {
+	value   float64
+	updated time.Time
+}
+
+// at returns the cost decayed to the given time.
+func (c *queryCost) at(now time.Time, halfLife time.Duration) float64 {
+	if halfLife <= 0 {
+		return c.value
+	}
+	return c.value * math.Pow(0.5, float64(now.Sub(c.updated))/float64(halfLife))
+}
+
+// NewAdmissionController makes a new AdmissionController.
+func NewAdmissionController(cfg AdmissionConfig) *AdmissionController {
+	return &AdmissionController{
+		cfg:   cfg,
+		costs: map[string]*queryCost{},
+	}
+}
+
+// Wrap returns a http.Handler which admits requests to next, and records
+// their cost.  It must be wrapped by middleware which authenticates the user.
+func (a *AdmissionController) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := user.Extract(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if !a.acquire(r.Context(), userID) {
+			rejectedQueries.Inc()
+			http.Error(w, "too many outstanding queries, please retry later", http.StatusServiceUnavailable)
+			return
+		}
+		defer a.release()
+
+		stats := &queryStats{}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), queryStatsKey, stats)))
+
+		samples := atomic.LoadInt64(&stats.samples)
+		querySamples.WithLabelValues(userID).Add(float64(samples))
+		queryChunkBytes.WithLabelValues(userID).Add(float64(atomic.LoadInt64(&stats.chunkBytes)))
+		a.recordCost(userID, float64(samples))
+	})
+}
+
+// acquire blocks until the query is admitted, returning false if it timed
+// out or was cancelled first.
+func (a *AdmissionController) acquire(ctx context.Context, userID string) bool {
+	if a.cfg.MaxConcurrent <= 0 {
+		return true
+	}
+
+	a.mtx.Lock()
+	if a.inflight < a.cfg.MaxConcurrent && len(a.waiting) == 0 {
+		a.inflight++
+		a.mtx.Unlock()
+		return true
+	}
+	waiter := &admissionWaiter{
+		userID:   userID,
+		admitted: make(chan struct{}),
+	}
+	a.waiting = append(a.waiting, waiter)
+	a.mtx.Unlock()
+
+	queuedQueries.Inc()
+	defer queuedQueries.Dec()
+
+	timer := time.NewTimer(a.cfg.MaxQueueDuration)
+	defer timer.Stop()
+	select {
+	case <-waiter.admitted:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for i, w := range a.waiting {
+		if w == waiter {
+			a.waiting = append(a.waiting[:i], a.waiting[i+1:]...)
+			return false
+		}
+	}
+	// We were admitted whilst giving up, so we may as well run.
+	return true
+}
+
+// release frees up the slot used by a query, admitting the waiting query
+// from the user with the lowest recent cost.
+func (a *AdmissionController) release() {
+	if a.cfg.MaxConcurrent <= 0 {
+		return
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.inflight--
+	if a.inflight >= a.cfg.MaxConcurrent || len(a.waiting) == 0 {
+		return
+	}
+
+	now := time.Now()
+	next, nextCost := 0, math.Inf(1)
+	for i, w := range a.waiting {
+		var cost float64
+		if c, ok := a.costs[w.userID]; ok {
+			cost = c.at(now, a.cfg.CostHalfLife)
+		}
+		if cost < nextCost {
+			next, nextCost = i, cost
+		}
+	}
+	waiter := a.waiting[next]
+	a.waiting = append(a.waiting[:next], a.waiting[next+1:]...)
+	a.inflight++
+	close(waiter.admitted)
+}
+
+func (a *AdmissionController) recordCost(userID string, cost float64) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	now := time.Now()
+	c, ok := a.costs[userID]
+	if !ok {
+		c = &queryCost{}
+		a.costs[userID] = c
+	}
+	c.value = c.at(now, a.cfg.CostHalfLife) + cost
+	c.updated = now
+
+	// Forget users whose cost has decayed to nothing.
+	for id, other := range a.costs {
+		if other.at(now, a.cfg.CostHalfLife) < 1 {
+			delete(a.costs, id)
+		}
+	}
+}
+
+type contextKey int
+
+const queryStatsKey contextKey = 0
+
+// queryStats accumulates the cost of a single query.
+type queryStats struct {
+	samples    int64
+	chunkBytes int64
+}
+
+func addQuerySamples(ctx context.Context, matrix model.Matrix) {
+	stats, ok := ctx.Value(queryStatsKey).(*queryStats)
+	if !ok {
+		return
+	}
+	var samples int64
+	for _, ss := range matrix {
+		samples += int64(len(ss.Values))
+	}
+	atomic.AddInt64(&stats.samples, samples)
+}
+
+func addQueryChunks(ctx context.Context, chunks int) {
+	stats, ok := ctx.Value(queryStatsKey).(*queryStats)
+	if !ok {
+		return
+	}
+	atomic.AddInt64(&stats.chunkBytes, int64(chunks*prom_chunk.ChunkLen))
+}
@@ -0,0 +1,61 @@
+package querier
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestAdmissionControllerPrefersCheapUsers(t *testing.T) {
+	a := NewAdmissionController(AdmissionConfig{
+		MaxConcurrent:    1,
+		MaxQueueDuration: time.Minute,
+		CostHalfLife:     time.Hour,
+	})
+	a.recordCost("heavy", 1e6)
+	a.recordCost("light", 10)
+
+	// Saturate the controller, then queue a query from each user.
+	assert.True(t, a.acquire(context.Background(), "other"))
+	admitted := make(chan string, 2)
+	for i, userID := range []string{"heavy", "light"} {
+		go func(userID string) {
+			if a.acquire(context.Background(), userID) {
+				admitted <- userID
+			}
+		}(userID)
+		waitForQueueLength(t, a, i+1)
+	}
+
+	a.release()
+	assert.Equal(t, "light", <-admitted)
+	a.release()
+	assert.Equal(t, "heavy", <-admitted)
+	a.release()
+}
+
+func TestAdmissionControllerTimeout(t *testing.T) {
+	a := NewAdmissionController(AdmissionConfig{
+		MaxConcurrent:    1,
+		MaxQueueDuration: 10 * time.Millisecond,
+	})
+	assert.True(t, a.acquire(context.Background(), "user"))
+	assert.False(t, a.acquire(context.Background(), "user"))
+	a.release()
+	assert.True(t, a.acquire(context.Background(), "user"))
+}
+
+func waitForQueueLength(t *testing.T, a *AdmissionController, length int) {
+	for i := 0; i < 100; i++ {
+		a.mtx.Lock()
+		waiting := len(a.waiting)
+		a.mtx.Unlock()
+		if waiting >= length {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("queue never reached length %d", length)
+}
@@ -0,0 +1,182 @@
+package querier
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+// DeleteRequestSource gives the series delete requests of the user in a
+// context.
+type DeleteRequestSource interface {
+	DeleteRequests(ctx context.Context) ([]chunk.DeleteRequest, error)
+}
+
+// DeleteRequestStore records series delete requests.
+type DeleteRequestStore interface {
+	DeleteRequestSource
+	AddDeleteRequest(ctx context.Context, start, end model.Time, selectors []string) (chunk.DeleteRequest, error)
+	GetDeleteRequest(ctx context.Context, requestID string) (chunk.DeleteRequest, error)
+	CancelDeleteRequest(ctx context.Context, requestID string) error
+}
+
+// DeleteSeriesHandler implements Prometheus'
+// /api/v1/admin/tsdb/delete_series.  Samples of the matching series are
+// filtered from query results until the purger deletes them.
+type DeleteSeriesHandler struct {
+	store DeleteRequestStore
+}
+
+// NewDeleteSeriesHandler makes a new DeleteSeriesHandler.
+func NewDeleteSeriesHandler(store DeleteRequestStore) *DeleteSeriesHandler {
+	return &DeleteSeriesHandler{store: store}
+}
+
+// ServeHTTP records a request to delete the series selected by the `match[]`
+// parameters between `start` and `end`, which defaults to now, on POST.
+// On GET it lists the user's delete requests, optionally only those with
+// the given `status`, or returns the one with the given `request_id`.  It
+// must be wrapped by middleware which authenticates the user.
+func (h *DeleteSeriesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		h.get(w, r)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeBadData(w, err)
+		return
+	}
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		writeBadData(w, fmt.Errorf("no match[] parameter provided"))
+		return
+	}
+	if _, err := chunk.ParseDeleteSelectors(selectors); err != nil {
+		writeBadData(w, err)
+		return
+	}
+
+	// Unlike Prometheus, the start is required, as the store looks up chunks
+	// bucket by bucket, so can't look them up for all time.
+	if r.FormValue("start") == "" {
+		writeBadData(w, fmt.Errorf("no start parameter provided"))
+		return
+	}
+	start, err := util.ParseTime(r.FormValue("start"))
+	if err != nil {
+		writeBadData(w, err)
+		return
+	}
+	end := model.Now()
+	if e := r.FormValue("end"); e != "" {
+		if end, err = util.ParseTime(e); err != nil {
+			writeBadData(w, err)
+			return
+		}
+	}
+	if end.Before(start) {
+		writeBadData(w, fmt.Errorf("end timestamp must not be before start time"))
+		return
+	}
+
+	if _, err := h.store.AddDeleteRequest(r.Context(), start, end, selectors); err == chunk.ErrDeletesDisabled {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *DeleteSeriesHandler) get(w http.ResponseWriter, r *http.Request) {
+	if requestID := r.FormValue("request_id"); requestID != "" {
+		req, err := h.store.GetDeleteRequest(r.Context(), requestID)
+		if err == chunk.ErrDeleteRequestNotFound || err == chunk.ErrDeletesDisabled {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		util.WriteJSONResponse(w, map[string]interface{}{
+			"status": "success",
+			"data":   req,
+		})
+		return
+	}
+
+	requests, err := h.store.DeleteRequests(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	status := r.FormValue("status")
+	result := []chunk.DeleteRequest{}
+	for _, req := range requests {
+		if status == "" || req.Status == status {
+			result = append(result, req)
+		}
+	}
+	util.WriteJSONResponse(w, map[string]interface{}{
+		"status": "success",
+		"data":   result,
+	})
+}
+
+// Cancel cancels the delete request with the given `request_id` on POST, if
+// it's still within its cancellation period.  It must be wrapped by
+// middleware which authenticates the user.
+func (h *DeleteSeriesHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	requestID := r.FormValue("request_id")
+	if requestID == "" {
+		writeBadData(w, fmt.Errorf("no request_id parameter provided"))
+		return
+	}
+	switch err := h.store.CancelDeleteRequest(r.Context(), requestID); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case chunk.ErrDeleteRequestNotFound, chunk.ErrDeletesDisabled:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case chunk.ErrDeleteRequestNotCancellable:
+		writeBadData(w, err)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// filterDeleted removes the samples of the delete requests from the series,
+// except for cancelled requests.
+func filterDeleted(ss *model.SampleStream, requests []chunk.DeleteRequest) {
+	var matching []*chunk.DeleteRequest
+	for i := range requests {
+		if requests[i].Filtered() && requests[i].Matches(ss.Metric) {
+			matching = append(matching, &requests[i])
+		}
+	}
+	if len(matching) == 0 {
+		return
+	}
+
+	values := ss.Values[:0]
+outer:
+	for _, v := range ss.Values {
+		for _, req := range matching {
+			if !v.Timestamp.Before(req.StartTime) && !v.Timestamp.After(req.EndTime) {
+				continue outer
+			}
+		}
+		values = append(values, v)
+	}
+	ss.Values = values
+}
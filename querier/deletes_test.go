@@ -0,0 +1,180 @@
+package querier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+)
+
+type mockDeleteRequestStore struct {
+	requests []chunk.DeleteRequest
+	err      error
+}
+
+func (m *mockDeleteRequestStore) DeleteRequests(ctx context.Context) ([]chunk.DeleteRequest, error) {
+	return m.requests, nil
+}
+
+func (m *mockDeleteRequestStore) AddDeleteRequest(ctx context.Context, start, end model.Time, selectors []string) (chunk.DeleteRequest, error) {
+	if m.err != nil {
+		return chunk.DeleteRequest{}, m.err
+	}
+	req := chunk.DeleteRequest{StartTime: start, EndTime: end, Selectors: selectors, Status: chunk.DeleteRequestReceived}
+	m.requests = append(m.requests, req)
+	return req, nil
+}
+
+func (m *mockDeleteRequestStore) GetDeleteRequest(ctx context.Context, requestID string) (chunk.DeleteRequest, error) {
+	for _, req := range m.requests {
+		if req.RequestID == requestID {
+			return req, nil
+		}
+	}
+	return chunk.DeleteRequest{}, chunk.ErrDeleteRequestNotFound
+}
+
+func (m *mockDeleteRequestStore) CancelDeleteRequest(ctx context.Context, requestID string) error {
+	for i, req := range m.requests {
+		if req.RequestID != requestID {
+			continue
+		}
+		if req.Status != chunk.DeleteRequestReceived {
+			return chunk.ErrDeleteRequestNotCancellable
+		}
+		m.requests[i].Status = chunk.DeleteRequestCancelled
+		return nil
+	}
+	return chunk.ErrDeleteRequestNotFound
+}
+
+func TestDeleteSeriesHandler(t *testing.T) {
+	store := &mockDeleteRequestStore{}
+	h := NewDeleteSeriesHandler(store)
+	post := func(values url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/v1/admin/tsdb/delete_series", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, values := range []url.Values{
+		{"start": {"0"}},
+		{"match[]": {"foo"}},
+		{"match[]": {`{bar="baz"}`}, "start": {"0"}},
+		{"match[]": {"foo"}, "start": {"bad"}},
+		{"match[]": {"foo"}, "start": {"0"}, "end": {"bad"}},
+		{"match[]": {"foo"}, "start": {"2"}, "end": {"1"}},
+	} {
+		assert.Equal(t, http.StatusBadRequest, post(values).Code, values.Encode())
+	}
+	assert.Empty(t, store.requests)
+
+	before := model.Now()
+	w := post(url.Values{"match[]": {"foo", `bar{baz="qux"}`}, "start": {"10"}})
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	require.Len(t, store.requests, 1)
+	assert.Equal(t, model.TimeFromUnix(10), store.requests[0].StartTime)
+	// The end defaults to now.
+	assert.False(t, store.requests[0].EndTime.Before(before))
+	assert.False(t, store.requests[0].EndTime.After(model.Now()))
+	assert.Equal(t, []string{"foo", `bar{baz="qux"}`}, store.requests[0].Selectors)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/admin/tsdb/delete_series", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"received"`)
+
+	store.err = chunk.ErrDeletesDisabled
+	assert.Equal(t, http.StatusNotFound, post(url.Values{"match[]": {"foo"}, "start": {"10"}}).Code)
+}
+
+func TestDeleteRequestStatus(t *testing.T) {
+	store := &mockDeleteRequestStore{requests: []chunk.DeleteRequest{
+		{RequestID: "a", Status: chunk.DeleteRequestReceived},
+		{RequestID: "b", Status: chunk.DeleteRequestProcessed},
+	}}
+	h := NewDeleteSeriesHandler(store)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/admin/tsdb/delete_series?"+query, nil))
+		return w
+	}
+
+	w := get("status=processed")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"request_id":"b"`)
+	assert.NotContains(t, w.Body.String(), `"request_id":"a"`)
+
+	w = get("status=cancelled")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"data":[]`)
+
+	w = get("request_id=a")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"request_id":"a",`)
+	assert.Equal(t, http.StatusNotFound, get("request_id=c").Code)
+}
+
+func TestCancelDeleteRequest(t *testing.T) {
+	store := &mockDeleteRequestStore{requests: []chunk.DeleteRequest{
+		{RequestID: "a", Status: chunk.DeleteRequestReceived},
+		{RequestID: "b", Status: chunk.DeleteRequestProcessing},
+	}}
+	h := NewDeleteSeriesHandler(store)
+	cancel := func(method, requestID string) int {
+		w := httptest.NewRecorder()
+		h.Cancel(w, httptest.NewRequest(method, "/api/v1/admin/tsdb/cancel_delete_request?request_id="+requestID, nil))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusMethodNotAllowed, cancel("GET", "a"))
+	assert.Equal(t, http.StatusBadRequest, cancel("POST", ""))
+	assert.Equal(t, http.StatusNotFound, cancel("POST", "c"))
+	assert.Equal(t, http.StatusBadRequest, cancel("POST", "b"))
+	assert.Equal(t, http.StatusNoContent, cancel("POST", "a"))
+	assert.Equal(t, chunk.DeleteRequestCancelled, store.requests[0].Status)
+	assert.Equal(t, http.StatusBadRequest, cancel("POST", "a"))
+}
+
+func TestFilterDeleted(t *testing.T) {
+	var requests []chunk.DeleteRequest
+	require.NoError(t, json.Unmarshal([]byte(`[
+		{"start_time": 2, "end_time": 3, "selectors": ["foo{bar=\"baz\"}"]},
+		{"start_time": 5, "end_time": 5, "selectors": ["bar", "foo{bar=~\"b.*\"}"]},
+		{"start_time": 1, "end_time": 6, "selectors": ["foo{bar=\"qux\"}"]},
+		{"start_time": 1, "end_time": 6, "selectors": ["foo"], "status": "cancelled"}
+	]`), &requests))
+
+	// Delete requests' times are in seconds.
+	values := func(ts ...int64) []model.SamplePair {
+		result := make([]model.SamplePair, 0, len(ts))
+		for _, t := range ts {
+			result = append(result, model.SamplePair{Timestamp: model.TimeFromUnix(t), Value: model.SampleValue(t)})
+		}
+		return result
+	}
+	ss := &model.SampleStream{
+		Metric: model.Metric{model.MetricNameLabel: "foo", "bar": "baz"},
+		Values: values(1, 2, 3, 4, 5, 6),
+	}
+	filterDeleted(ss, requests)
+	assert.Equal(t, values(1, 4, 6), ss.Values)
+
+	other := &model.SampleStream{
+		Metric: model.Metric{model.MetricNameLabel: "other"},
+		Values: values(1, 2, 3),
+	}
+	filterDeleted(other, requests)
+	assert.Equal(t, values(1, 2, 3), other.Values)
+}
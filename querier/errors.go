@@ -0,0 +1,96 @@
+package querier
+
+import (
+	"net/http"
+
+	"github.com/prometheus/prometheus/promql"
+	"github.com/weaveworks/common/middleware"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// Query errors are reported the way Prometheus' API reports them: bad
+// requests are bad_data errors (400), queries which fail are execution
+// errors (422), and queries which time out or are canceled are timeout or
+// canceled errors (503), so clients like Grafana handle them the same.
+// Queries canceled because the client went away are reported as 499s.
+const (
+	errorTimeout  = "timeout"
+	errorCanceled = "canceled"
+	errorExec     = "execution"
+	errorBadData  = "bad_data"
+
+	statusClientClosedRequest = 499
+)
+
+// translateError returns errors from queriers caused by the query's context
+// ending, or an ingester's, as promql's timeout and canceled errors, which
+// the API reports as such rather than as execution errors.
+func translateError(err error) error {
+	switch {
+	case err == context.DeadlineExceeded || grpc.Code(err) == codes.DeadlineExceeded:
+		return promql.ErrQueryTimeout("query storage")
+	case err == context.Canceled || grpc.Code(err) == codes.Canceled:
+		return promql.ErrQueryCanceled("query storage")
+	}
+	return err
+}
+
+// errorType returns the Prometheus API error type and HTTP status code of a
+// query's error.
+func errorType(r *http.Request, err error) (string, int) {
+	switch translateError(err).(type) {
+	case promql.ErrQueryTimeout:
+		return errorTimeout, http.StatusServiceUnavailable
+	case promql.ErrQueryCanceled:
+		if r.Context().Err() == context.Canceled {
+			return errorCanceled, statusClientClosedRequest
+		}
+		return errorCanceled, http.StatusServiceUnavailable
+	}
+	return errorExec, 422
+}
+
+// writeError writes a query's error to w in the Prometheus API's format.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	typ, code := errorType(r, err)
+	w.WriteHeader(code)
+	util.WriteJSONResponse(w, map[string]interface{}{
+		"status":    "error",
+		"errorType": typ,
+		"error":     err.Error(),
+	})
+}
+
+func writeBadData(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusBadRequest)
+	util.WriteJSONResponse(w, map[string]interface{}{
+		"status":    "error",
+		"errorType": errorBadData,
+		"error":     err.Error(),
+	})
+}
+
+// ClientClosedRequest is middleware for Prometheus' query API reporting
+// queries canceled because the client went away as 499s, rather than the
+// 503s the API reports them as.
+var ClientClosedRequest = middleware.Func(func(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&clientClosedResponseWriter{ResponseWriter: w, r: r}, r)
+	})
+})
+
+type clientClosedResponseWriter struct {
+	http.ResponseWriter
+	r *http.Request
+}
+
+func (w *clientClosedResponseWriter) WriteHeader(code int) {
+	if code == http.StatusServiceUnavailable && w.r.Context().Err() == context.Canceled {
+		code = statusClientClosedRequest
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
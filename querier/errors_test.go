@@ -0,0 +1,92 @@
+package querier
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+type errQuerier struct {
+	Querier
+	err error
+}
+
+func (q errQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	return nil, q.err
+}
+
+func TestQueryErrors(t *testing.T) {
+	// Errors queriers return because a query's context ended are returned
+	// by the engine as its own timeout and canceled errors, which the API
+	// reports as such.
+	for _, tc := range []struct {
+		err      error
+		expected error
+	}{
+		{fmt.Errorf("oops"), fmt.Errorf("oops")},
+		{util.SeriesLimitError{Limit: 1}, util.SeriesLimitError{Limit: 1}},
+		{context.DeadlineExceeded, promql.ErrQueryTimeout("query storage")},
+		{grpc.Errorf(codes.DeadlineExceeded, "too slow"), promql.ErrQueryTimeout("query storage")},
+		{grpc.Errorf(codes.Canceled, "canceled"), promql.ErrQueryCanceled("query storage")},
+	} {
+		engine := promql.NewEngine(Queryable{Q: MergeQuerier{Queriers: []Querier{errQuerier{err: tc.err}}}}, nil)
+		query, err := engine.NewInstantQuery("foo", model.Now())
+		require.NoError(t, err)
+		res := query.Exec(context.Background())
+		assert.Equal(t, tc.expected, res.Err)
+	}
+}
+
+func TestClientClosedRequest(t *testing.T) {
+	for _, tc := range []struct {
+		code, expected int
+		canceled       bool
+	}{
+		{http.StatusServiceUnavailable, http.StatusServiceUnavailable, false},
+		{http.StatusServiceUnavailable, statusClientClosedRequest, true},
+		{422, 422, true},
+	} {
+		handler := ClientClosedRequest.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.code)
+		}))
+		r := httptest.NewRequest("GET", "/api/v1/query?query=foo", nil)
+		if tc.canceled {
+			ctx, cancel := context.WithCancel(r.Context())
+			cancel()
+			r = r.WithContext(ctx)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, tc.expected, w.Code)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	r := httptest.NewRequest("GET", "/label_values", nil)
+	w := httptest.NewRecorder()
+	writeError(w, r, grpc.Errorf(codes.DeadlineExceeded, "too slow"))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"status":"error","errorType":"timeout","error":"rpc error: code = 4 desc = too slow"}`, w.Body.String())
+}
+
+func TestWriteErrorClientClosed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest("GET", "/label_values", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	writeError(w, r, context.Canceled)
+	assert.Equal(t, statusClientClosedRequest, w.Code)
+	assert.JSONEq(t, `{"status":"error","errorType":"canceled","error":"context canceled"}`, w.Body.String())
+}
@@ -0,0 +1,180 @@
+package querier
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+const (
+	// Rough number of samples in a chunk, assuming doubledelta encoding of
+	// regularly scraped series.
+	estimatedSamplesPerChunk = 300
+
+	// Queries fetching more chunks than these are expected to be slow.
+	mediumQueryChunks = 10000
+	slowQueryChunks   = 100000
+)
+
+// EstimatorConfig configures query cost estimation.
+type EstimatorConfig struct {
+	ScrapeInterval time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *EstimatorConfig) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.ScrapeInterval, "querier.estimate-scrape-interval", 15*time.Second, "Scrape interval assumed when estimating the number of samples a query will read.")
+}
+
+// Validate returns an error if the config can't be used.
+func (cfg *EstimatorConfig) Validate() error {
+	if cfg.ScrapeInterval <= 0 {
+		return fmt.Errorf("-querier.estimate-scrape-interval must be positive, got %v", cfg.ScrapeInterval)
+	}
+	return nil
+}
+
+// IndexLookupCounter counts the index lookups the chunk store would make for
+// a query, without making them.
+type IndexLookupCounter interface {
+	IndexLookups(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) (int, error)
+}
+
+// Estimator estimates the cost of a query without executing it.
+type Estimator struct {
+	cfg         EstimatorConfig
+	distributor Querier
+	store       IndexLookupCounter
+}
+
+// NewEstimator makes a new Estimator.
+func NewEstimator(cfg EstimatorConfig, distributor Querier, store IndexLookupCounter) (*Estimator, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &Estimator{
+		cfg:         cfg,
+		distributor: distributor,
+		store:       store,
+	}, nil
+}
+
+// Estimate is the estimated cost of a query.  The number of series is taken
+// from the ingesters, so will be an underestimate for series which are no
+// longer being written.
+type Estimate struct {
+	IndexLookups int    `json:"indexLookups"`
+	Series       int    `json:"series"`
+	Chunks       int    `json:"chunks"`
+	Samples      int    `json:"samples"`
+	LatencyClass string `json:"latencyClass"`
+}
+
+// ServeHTTP estimates the cost of the query in the `query` parameter, either
+// at the instant given by `time`, or over the range given by `start`, `end`.
+// It must be wrapped by middleware which authenticates the user.
+func (e *Estimator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	expr, err := promql.ParseExpr(r.FormValue("query"))
+	if err != nil {
+		writeBadData(w, err)
+		return
+	}
+
+	var start, end model.Time
+	if r.FormValue("start") != "" || r.FormValue("end") != "" {
+		if start, err = util.ParseTime(r.FormValue("start")); err != nil {
+			writeBadData(w, err)
+			return
+		}
+		if end, err = util.ParseTime(r.FormValue("end")); err != nil {
+			writeBadData(w, err)
+			return
+		}
+		if end.Before(start) {
+			writeBadData(w, fmt.Errorf("end timestamp must not be before start time"))
+			return
+		}
+	} else {
+		start = model.Now()
+		if t := r.FormValue("time"); t != "" {
+			if start, err = util.ParseTime(t); err != nil {
+				writeBadData(w, err)
+				return
+			}
+		}
+		end = start
+	}
+
+	estimate, err := e.Estimate(r.Context(), expr, start, end)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	util.WriteJSONResponse(w, map[string]interface{}{
+		"status": "success",
+		"data":   estimate,
+	})
+}
+
+// Estimate the cost of evaluating expr between start and end.
+func (e *Estimator) Estimate(ctx context.Context, expr promql.Expr, start, end model.Time) (Estimate, error) {
+	var (
+		estimate Estimate
+		err      error
+	)
+	promql.Inspect(expr, func(node promql.Node) bool {
+		if err != nil {
+			return false
+		}
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			err = e.estimateSelector(ctx, &estimate, start, end, n.Offset, promql.StalenessDelta, n.LabelMatchers)
+		case *promql.MatrixSelector:
+			err = e.estimateSelector(ctx, &estimate, start, end, n.Offset, n.Range, n.LabelMatchers)
+		}
+		return true
+	})
+	if err != nil {
+		return Estimate{}, err
+	}
+
+	switch {
+	case estimate.Chunks >= slowQueryChunks:
+		estimate.LatencyClass = "slow"
+	case estimate.Chunks >= mediumQueryChunks:
+		estimate.LatencyClass = "medium"
+	default:
+		estimate.LatencyClass = "fast"
+	}
+	return estimate, nil
+}
+
+func (e *Estimator) estimateSelector(ctx context.Context, estimate *Estimate, start, end model.Time, offset, lookback time.Duration, matchers metric.LabelMatchers) error {
+	from, through := start.Add(-offset-lookback), end.Add(-offset)
+
+	lookups, err := e.store.IndexLookups(ctx, from, through, matchers...)
+	if err != nil {
+		return err
+	}
+	metrics, err := e.distributor.MetricsForLabelMatchers(ctx, from, through, matchers)
+	if err != nil {
+		return err
+	}
+
+	samplesPerSeries := int(through.Sub(from)/e.cfg.ScrapeInterval) + 1
+	chunksPerSeries := (samplesPerSeries + estimatedSamplesPerChunk - 1) / estimatedSamplesPerChunk
+
+	estimate.IndexLookups += lookups
+	estimate.Series += len(metrics)
+	estimate.Chunks += len(metrics) * chunksPerSeries
+	estimate.Samples += len(metrics) * samplesPerSeries
+	return nil
+}
@@ -0,0 +1,109 @@
+package querier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type mockDistributor struct {
+	series int
+}
+
+func (m mockDistributor) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	return nil, nil
+}
+
+func (m mockDistributor) LabelValuesForLabelName(context.Context, model.LabelName) (model.LabelValues, error) {
+	return nil, nil
+}
+
+func (m mockDistributor) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	return make([]metric.Metric, m.series), nil
+}
+
+type mockIndexLookupCounter struct {
+	ranges [][2]model.Time
+}
+
+func (m *mockIndexLookupCounter) IndexLookups(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) (int, error) {
+	m.ranges = append(m.ranges, [2]model.Time{from, through})
+	return len(matchers), nil
+}
+
+func TestEstimator(t *testing.T) {
+	store := &mockIndexLookupCounter{}
+	e, err := NewEstimator(EstimatorConfig{ScrapeInterval: 15 * time.Second}, mockDistributor{series: 10}, store)
+	require.NoError(t, err)
+
+	values := url.Values{}
+	values.Set("query", `rate(foo{bar="baz"}[5m]) / bar offset 1h`)
+	values.Set("start", "3600")
+	values.Set("end", "7200")
+	req := httptest.NewRequest("GET", "/estimate?"+values.Encode(), nil)
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp struct {
+		Data Estimate `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, Estimate{
+		IndexLookups: 3,
+		Series:       20,
+		Chunks:       20,
+		Samples:      20 * (65*60/15 + 1),
+		LatencyClass: "fast",
+	}, resp.Data)
+
+	// The offset and range of each selector are taken into account.
+	assert.Equal(t, [][2]model.Time{
+		{model.TimeFromUnix(3600 - 5*60), model.TimeFromUnix(7200)},
+		{model.TimeFromUnix(0 - 5*60), model.TimeFromUnix(3600)},
+	}, store.ranges)
+}
+
+func TestEstimatorLatencyClass(t *testing.T) {
+	e, err := NewEstimator(EstimatorConfig{ScrapeInterval: 15 * time.Second}, mockDistributor{series: 1000}, &mockIndexLookupCounter{})
+	require.NoError(t, err)
+	expr, err := promql.ParseExpr("foo")
+	require.NoError(t, err)
+
+	estimate, err := e.Estimate(context.Background(), expr, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "fast", estimate.LatencyClass)
+
+	estimate, err = e.Estimate(context.Background(), expr, 0, model.TimeFromUnix(90*24*60*60))
+	require.NoError(t, err)
+	assert.Equal(t, "slow", estimate.LatencyClass)
+}
+
+func TestEstimatorInvalidQuery(t *testing.T) {
+	e, err := NewEstimator(EstimatorConfig{ScrapeInterval: 15 * time.Second}, mockDistributor{}, &mockIndexLookupCounter{})
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/estimate?query=foo%7B", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestEstimatorValidation(t *testing.T) {
+	_, err := NewEstimator(EstimatorConfig{}, mockDistributor{}, &mockIndexLookupCounter{})
+	assert.Error(t, err)
+
+	e, err := NewEstimator(EstimatorConfig{ScrapeInterval: 15 * time.Second}, mockDistributor{}, &mockIndexLookupCounter{})
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/estimate?query=foo&start=7200&end=3600", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,110 @@
+package querier
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// LabelValuesReader reads the values of a metric's label from the index.
+type LabelValuesReader interface {
+	LabelValuesForMetricName(ctx context.Context, from, through model.Time, metricName model.LabelValue, labelName model.LabelName) (model.LabelValues, error)
+}
+
+// LabelValuesHandler serves the values of a label for a single metric,
+// combining those in the chunk store with those still in the ingesters.
+type LabelValuesHandler struct {
+	distributor Querier
+	store       LabelValuesReader
+}
+
+// NewLabelValuesHandler makes a new LabelValuesHandler.
+func NewLabelValuesHandler(distributor Querier, store LabelValuesReader) *LabelValuesHandler {
+	return &LabelValuesHandler{
+		distributor: distributor,
+		store:       store,
+	}
+}
+
+// ServeHTTP returns the values of the label in the `label` parameter for the
+// metric in the `metric` parameter, between `start` and `end`.  The range
+// defaults to the last day.  It must be wrapped by middleware which
+// authenticates the user.
+func (h *LabelValuesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	metricName := model.LabelValue(r.FormValue("metric"))
+	labelName := model.LabelName(r.FormValue("label"))
+	if metricName == "" || !labelName.IsValid() {
+		writeBadData(w, fmt.Errorf("a metric and valid label name are required"))
+		return
+	}
+
+	var (
+		end = model.Now()
+		err error
+	)
+	if e := r.FormValue("end"); e != "" {
+		if end, err = util.ParseTime(e); err != nil {
+			writeBadData(w, err)
+			return
+		}
+	}
+	start := end.Add(-24 * time.Hour)
+	if s := r.FormValue("start"); s != "" {
+		if start, err = util.ParseTime(s); err != nil {
+			writeBadData(w, err)
+			return
+		}
+	}
+
+	values, err := h.LabelValues(r.Context(), start, end, metricName, labelName)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	util.WriteJSONResponse(w, map[string]interface{}{
+		"status": "success",
+		"data":   values,
+	})
+}
+
+// LabelValues returns the sorted values of labelName for series of the metric
+// between from and through.
+func (h *LabelValuesHandler) LabelValues(ctx context.Context, from, through model.Time, metricName model.LabelValue, labelName model.LabelName) (model.LabelValues, error) {
+	values, err := h.store.LabelValuesForMetricName(ctx, from, through, metricName, labelName)
+	if err != nil {
+		return nil, err
+	}
+
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, metricName)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err := h.distributor.MetricsForLabelMatchers(ctx, from, through, metric.LabelMatchers{matcher})
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[model.LabelValue]struct{}, len(values))
+	for _, v := range values {
+		seen[v] = struct{}{}
+	}
+	for _, m := range metrics {
+		v, ok := m.Metric[labelName]
+		if !ok {
+			continue
+		}
+		if _, ok := seen[v]; !ok {
+			seen[v] = struct{}{}
+			values = append(values, v)
+		}
+	}
+	sort.Sort(values)
+	return values, nil
+}
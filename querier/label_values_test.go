@@ -0,0 +1,63 @@
+package querier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type mockLabelValuesReader struct {
+	values model.LabelValues
+}
+
+func (m mockLabelValuesReader) LabelValuesForMetricName(ctx context.Context, from, through model.Time, metricName model.LabelValue, labelName model.LabelName) (model.LabelValues, error) {
+	return append(model.LabelValues{}, m.values...), nil
+}
+
+type mockMetricsDistributor struct {
+	mockDistributor
+	metrics []model.Metric
+}
+
+func (m mockMetricsDistributor) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	result := make([]metric.Metric, 0, len(m.metrics))
+	for _, m := range m.metrics {
+		result = append(result, metric.Metric{Metric: m})
+	}
+	return result, nil
+}
+
+func TestLabelValuesHandler(t *testing.T) {
+	h := NewLabelValuesHandler(mockMetricsDistributor{
+		metrics: []model.Metric{
+			{model.MetricNameLabel: "foo", "bar": "baz"},
+			{model.MetricNameLabel: "foo", "bar": "new"},
+			{model.MetricNameLabel: "foo"},
+		},
+	}, mockLabelValuesReader{values: model.LabelValues{"baz", "old"}})
+
+	values := url.Values{}
+	values.Set("metric", "foo")
+	values.Set("label", "bar")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/label_values?"+values.Encode(), nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp struct {
+		Data model.LabelValues `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, model.LabelValues{"baz", "new", "old"}, resp.Data)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/label_values?label=bar", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -4,15 +4,18 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/storage/local"
 	"github.com/prometheus/prometheus/storage/metric"
 	"golang.org/x/net/context"
 
+	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/limits"
+	"github.com/weaveworks/cortex/usage"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 // ChunkStore is the interface we need to get chunks
@@ -21,23 +24,27 @@ type ChunkStore interface {
 }
 
 // NewEngine creates a new promql.Engine for cortex.
-func NewEngine(distributor Querier, chunkStore ChunkStore) *promql.Engine {
-	queryable := NewQueryable(distributor, chunkStore)
+func NewEngine(distributor Querier, chunkStore ChunkStore, limits *limits.Overrides) *promql.Engine {
+	queryable := NewQueryable(distributor, chunkStore, limits)
 	return promql.NewEngine(queryable, nil)
 }
 
 // NewQueryable creates a new Queryable for cortex.
-func NewQueryable(distributor Querier, chunkStore ChunkStore) Queryable {
-	return Queryable{
-		Q: MergeQuerier{
-			Queriers: []Querier{
-				distributor,
-				&ChunkQuerier{
-					Store: chunkStore,
-				},
+func NewQueryable(distributor Querier, chunkStore ChunkStore, limits *limits.Overrides) Queryable {
+	mq := MergeQuerier{
+		Queriers: []Querier{
+			distributor,
+			&ChunkQuerier{
+				Store:  chunkStore,
+				Limits: limits,
 			},
 		},
+		Limits: limits,
 	}
+	if deletes, ok := chunkStore.(DeleteRequestSource); ok {
+		mq.Deletes = deletes
+	}
+	return Queryable{Q: mq}
 }
 
 // A Querier allows querying all samples in a given time range that match a set
@@ -50,17 +57,42 @@ type Querier interface {
 
 // A ChunkQuerier is a Querier that fetches samples from a ChunkStore.
 type ChunkQuerier struct {
-	Store ChunkStore
+	Store  ChunkStore
+	Limits *limits.Overrides
 }
 
 // Query implements Querier and transforms a list of chunks into sample
 // matrices.
 func (q *ChunkQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if maxQueryLength := q.Limits.MaxQueryLength(userID); maxQueryLength > 0 && to.Sub(from) > maxQueryLength {
+		return nil, fmt.Errorf("invalid query, length > limit (%s > %s)", to.Sub(from), maxQueryLength)
+	}
+	// Chunks past the user's retention period may have been partly purged,
+	// so they're never queried.
+	if retention := q.Limits.RetentionPeriod(userID); retention > 0 {
+		if cutoff := model.Now().Add(-retention); from.Before(cutoff) {
+			from = cutoff
+		}
+		if to.Before(from) {
+			return nil, nil
+		}
+	}
+
 	// Get chunks for all matching series from ChunkStore.
 	chunks, err := q.Store.Get(ctx, from, to, matchers...)
 	if err != nil {
 		return nil, err
 	}
+	addQueryChunks(ctx, len(chunks))
+	queried := 0
+	for _, c := range chunks {
+		queried += c.EncodedSize
+	}
+	usage.Add(userID, usage.BytesQueried, float64(queried))
 
 	return chunk.ChunksToMatrix(chunks)
 }
@@ -90,11 +122,28 @@ func (q Queryable) Querier() (local.Querier, error) {
 // cortex.Queriers for the same query.
 type MergeQuerier struct {
 	Queriers []Querier
+
+	// If set, samples of series delete requests are filtered from the
+	// results.
+	Deletes DeleteRequestSource
+
+	// If set, queries' selectors may only match up to the user's
+	// MaxSeriesPerQuery series, and fetch up to MaxChunksPerQuery chunks.
+	Limits *limits.Overrides
 }
 
 // QueryRange fetches series for a given time range and label matchers from multiple
 // promql.Queriers and returns the merged results as a map of series iterators.
 func (qm MergeQuerier) QueryRange(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	if qm.Limits != nil {
+		userID, err := user.Extract(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ctx = util.WithSeriesLimit(ctx, qm.Limits.MaxSeriesPerQuery(userID))
+		ctx = util.WithChunkLimit(ctx, qm.Limits.MaxChunksPerQuery(userID))
+	}
+
 	// Fetch samples from all queriers in parallel
 	matrices := make(chan model.Matrix)
 	errors := make(chan error)
@@ -118,6 +167,7 @@ func (qm MergeQuerier) QueryRange(ctx context.Context, from, to model.Time, matc
 			lastErr = err
 
 		case matrix := <-matrices:
+			addQuerySamples(ctx, matrix)
 			for _, ss := range matrix {
 				fp := ss.Metric.Fingerprint()
 				if it, ok := fpToIt[fp]; !ok {
@@ -129,11 +179,28 @@ func (qm MergeQuerier) QueryRange(ctx context.Context, from, to model.Time, matc
 					ssIt.ss.Values = util.MergeSamples(ssIt.ss.Values, ss.Values)
 				}
 			}
+			// Each querier's series are limited, but they may be different
+			// series.
+			if lastErr == nil {
+				lastErr = util.CheckSeriesLimit(ctx, len(fpToIt))
+			}
 		}
 	}
 	if lastErr != nil {
-		log.Errorf("Error in MergeQuerier.QueryRange: %v", lastErr)
-		return nil, lastErr
+		util.WithContext(ctx, log.Base()).Errorf("Error in MergeQuerier.QueryRange: %v", lastErr)
+		return nil, translateError(lastErr)
+	}
+
+	if qm.Deletes != nil {
+		requests, err := qm.Deletes.DeleteRequests(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(requests) > 0 {
+			for _, it := range fpToIt {
+				filterDeleted(it.(sampleStreamIterator).ss, requests)
+			}
+		}
 	}
 
 	iterators := make([]local.SeriesIterator, 0, len(fpToIt))
@@ -161,7 +228,7 @@ func (qm MergeQuerier) MetricsForLabelMatchers(ctx context.Context, from, throug
 	for _, q := range qm.Queriers {
 		ms, err := q.MetricsForLabelMatchers(ctx, from, through, matcherSets...)
 		if err != nil {
-			return nil, err
+			return nil, translateError(err)
 		}
 		for _, m := range ms {
 			metrics[m.Metric.Fingerprint()] = m
@@ -187,7 +254,7 @@ func (qm MergeQuerier) LabelValuesForLabelName(ctx context.Context, name model.L
 	for _, q := range qm.Queriers {
 		vals, err := q.LabelValuesForLabelName(ctx, name)
 		if err != nil {
-			return nil, err
+			return nil, translateError(err)
 		}
 		for _, v := range vals {
 			valueSet[v] = struct{}{}
@@ -0,0 +1,63 @@
+package querier
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/limits"
+	"github.com/weaveworks/cortex/util"
+)
+
+// mockQuerier returns a series for each of its metrics.
+type mockQuerier struct {
+	Querier
+	metrics []model.Metric
+}
+
+func (m mockQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	if err := util.CheckSeriesLimit(ctx, len(m.metrics)); err != nil {
+		return nil, err
+	}
+	result := model.Matrix{}
+	for _, m := range m.metrics {
+		result = append(result, &model.SampleStream{Metric: m, Values: []model.SamplePair{{Timestamp: from, Value: 1}}})
+	}
+	return result, nil
+}
+
+func TestMergeQuerierSeriesLimit(t *testing.T) {
+	series := func(names ...model.LabelValue) []model.Metric {
+		var result []model.Metric
+		for _, name := range names {
+			result = append(result, model.Metric{model.MetricNameLabel: "foo", "name": name})
+		}
+		return result
+	}
+	overrides, err := limits.NewOverrides(limits.Limits{MaxSeriesPerQuery: 3})
+	require.NoError(t, err)
+	defer overrides.Stop()
+	ctx := user.Inject(context.Background(), "1")
+
+	for _, tc := range []struct {
+		ingesters, store []model.Metric
+		err              error
+	}{
+		// Series in both the ingesters and the store are only counted once.
+		{series("a", "b", "c"), series("a", "b", "c"), nil},
+		{series("a", "b"), series("c", "d"), util.SeriesLimitError{Limit: 3}},
+		{series("a", "b", "c", "d"), nil, util.SeriesLimitError{Limit: 3}},
+	} {
+		qm := MergeQuerier{
+			Queriers: []Querier{mockQuerier{metrics: tc.ingesters}, mockQuerier{metrics: tc.store}},
+			Limits:   overrides,
+		}
+		_, err := qm.QueryRange(ctx, 0, 1)
+		assert.Equal(t, tc.err, err)
+	}
+}
@@ -0,0 +1,180 @@
+package querytee
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/prometheus/common/model"
+)
+
+// Results of comparing responses.
+const (
+	match          = "match"
+	statusMismatch = "status_mismatch"
+	resultMismatch = "result_mismatch"
+)
+
+type apiResponse struct {
+	Status string          `json:"status"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type queryData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// compare the responses of the two backends, returning whether they match,
+// and how they differ if they don't.  Errors with the same status match, as
+// their messages may legitimately differ.
+func compare(primary, secondary backendResponse, tolerance float64) (string, error) {
+	if primary.status != secondary.status {
+		return statusMismatch, fmt.Errorf("status codes differ: %d and %d", primary.status, secondary.status)
+	}
+	if primary.status/100 != 2 {
+		return match, nil
+	}
+
+	var p, s apiResponse
+	if json.Unmarshal(primary.body, &p) != nil || json.Unmarshal(secondary.body, &s) != nil {
+		if !bytes.Equal(primary.body, secondary.body) {
+			return resultMismatch, fmt.Errorf("bodies differ")
+		}
+		return match, nil
+	}
+	if p.Status != s.Status {
+		return resultMismatch, fmt.Errorf("statuses differ: %s and %s", p.Status, s.Status)
+	}
+
+	var pd, sd queryData
+	if json.Unmarshal(p.Data, &pd) == nil && json.Unmarshal(s.Data, &sd) == nil && pd.ResultType != "" {
+		if err := compareQueryData(pd, sd, tolerance); err != nil {
+			return resultMismatch, err
+		}
+		return match, nil
+	}
+
+	// Other APIs, e.g. label values, are compared as JSON.
+	var pv, sv interface{}
+	if err := json.Unmarshal(p.Data, &pv); err != nil {
+		return resultMismatch, err
+	}
+	if err := json.Unmarshal(s.Data, &sv); err != nil {
+		return resultMismatch, err
+	}
+	if !reflect.DeepEqual(pv, sv) {
+		return resultMismatch, fmt.Errorf("data differs")
+	}
+	return match, nil
+}
+
+func compareQueryData(p, s queryData, tolerance float64) error {
+	if p.ResultType != s.ResultType {
+		return fmt.Errorf("result types differ: %s and %s", p.ResultType, s.ResultType)
+	}
+	switch p.ResultType {
+	case model.ValMatrix.String():
+		var pm, sm model.Matrix
+		if err := unmarshalBoth(p.Result, s.Result, &pm, &sm); err != nil {
+			return err
+		}
+		return compareMatrices(pm, sm, tolerance)
+
+	case model.ValVector.String():
+		var pv, sv model.Vector
+		if err := unmarshalBoth(p.Result, s.Result, &pv, &sv); err != nil {
+			return err
+		}
+		return compareVectors(pv, sv, tolerance)
+
+	case model.ValScalar.String():
+		var ps, ss model.Scalar
+		if err := unmarshalBoth(p.Result, s.Result, &ps, &ss); err != nil {
+			return err
+		}
+		return compareSamples(model.SamplePair{Timestamp: ps.Timestamp, Value: ps.Value}, model.SamplePair{Timestamp: ss.Timestamp, Value: ss.Value}, tolerance)
+
+	default:
+		if !bytes.Equal(p.Result, s.Result) {
+			return fmt.Errorf("results differ")
+		}
+		return nil
+	}
+}
+
+func unmarshalBoth(p, s json.RawMessage, pv, sv interface{}) error {
+	if err := json.Unmarshal(p, pv); err != nil {
+		return err
+	}
+	return json.Unmarshal(s, sv)
+}
+
+func compareMatrices(p, s model.Matrix, tolerance float64) error {
+	if len(p) != len(s) {
+		return fmt.Errorf("number of series differs: %d and %d", len(p), len(s))
+	}
+	streams := make(map[model.Fingerprint]*model.SampleStream, len(s))
+	for _, ss := range s {
+		streams[ss.Metric.Fingerprint()] = ss
+	}
+	for _, ps := range p {
+		ss, ok := streams[ps.Metric.Fingerprint()]
+		if !ok {
+			return fmt.Errorf("series %s missing from secondary", ps.Metric)
+		}
+		if len(ps.Values) != len(ss.Values) {
+			return fmt.Errorf("number of samples of %s differs: %d and %d", ps.Metric, len(ps.Values), len(ss.Values))
+		}
+		for i := range ps.Values {
+			if err := compareSamples(ps.Values[i], ss.Values[i], tolerance); err != nil {
+				return fmt.Errorf("%s: %v", ps.Metric, err)
+			}
+		}
+	}
+	return nil
+}
+
+func compareVectors(p, s model.Vector, tolerance float64) error {
+	if len(p) != len(s) {
+		return fmt.Errorf("number of series differs: %d and %d", len(p), len(s))
+	}
+	samples := make(map[model.Fingerprint]*model.Sample, len(s))
+	for _, ss := range s {
+		samples[ss.Metric.Fingerprint()] = ss
+	}
+	for _, ps := range p {
+		ss, ok := samples[ps.Metric.Fingerprint()]
+		if !ok {
+			return fmt.Errorf("series %s missing from secondary", ps.Metric)
+		}
+		if err := compareSamples(model.SamplePair{Timestamp: ps.Timestamp, Value: ps.Value}, model.SamplePair{Timestamp: ss.Timestamp, Value: ss.Value}, tolerance); err != nil {
+			return fmt.Errorf("%s: %v", ps.Metric, err)
+		}
+	}
+	return nil
+}
+
+func compareSamples(p, s model.SamplePair, tolerance float64) error {
+	if p.Timestamp != s.Timestamp {
+		return fmt.Errorf("sample timestamps differ: %v and %v", p.Timestamp, s.Timestamp)
+	}
+	if !sameValue(float64(p.Value), float64(s.Value), tolerance) {
+		return fmt.Errorf("sample values at %v differ: %v and %v", p.Timestamp, p.Value, s.Value)
+	}
+	return nil
+}
+
+// sameValue returns whether the values are equal, within the relative
+// tolerance.  NaNs are equal to each other.
+func sameValue(p, s, tolerance float64) bool {
+	if math.IsNaN(p) || math.IsNaN(s) {
+		return math.IsNaN(p) && math.IsNaN(s)
+	}
+	if p == s {
+		return true
+	}
+	return math.Abs(p-s) <= tolerance*math.Max(math.Abs(p), math.Abs(s))
+}
@@ -0,0 +1,171 @@
+package querytee
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// Names of the backends, as used in metrics.
+const (
+	primary   = "primary"
+	secondary = "secondary"
+)
+
+var (
+	backendRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "query_tee_backend_request_duration_seconds",
+		Help:      "Time spent on queries to each backend.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "status_code"})
+	comparisons = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "query_tee_comparisons_total",
+		Help:      "Number of responses from the two backends compared, by whether they matched, or why they didn't.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(backendRequestDuration)
+	prometheus.MustRegister(comparisons)
+}
+
+// Config for a Proxy.
+type Config struct {
+	Primary        util.URLValue
+	Secondary      util.URLValue
+	RequestTimeout time.Duration
+	ValueTolerance float64
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.Var(&cfg.Primary, "query-tee.primary", "URL of the Cortex whose responses are returned, e.g. http://querier/.")
+	f.Var(&cfg.Secondary, "query-tee.secondary", "URL of the Cortex queries are also sent to, whose responses are compared to the primary's.")
+	f.DurationVar(&cfg.RequestTimeout, "query-tee.request-timeout", 1*time.Minute, "Timeout for queries to each backend.")
+	f.Float64Var(&cfg.ValueTolerance, "query-tee.value-tolerance", 0.000001, "Relative difference allowed between sample values of the two backends, to tolerate floating point error.")
+}
+
+// Proxy sends queries to two Cortex backends, returning the primary's
+// response and comparing it to the secondary's, to check changes like
+// schema migrations or new releases against live traffic.
+type Proxy struct {
+	cfg    Config
+	client *http.Client
+	wait   sync.WaitGroup
+}
+
+// New makes a new Proxy.
+func New(cfg Config) (*Proxy, error) {
+	if cfg.Primary.URL == nil || cfg.Secondary.URL == nil {
+		return nil, fmt.Errorf("both a primary and secondary backend must be configured")
+	}
+	return &Proxy{
+		cfg:    cfg,
+		client: &http.Client{Transport: util.TracedTransport{}},
+	}, nil
+}
+
+// Stop waits for outstanding comparisons.
+func (p *Proxy) Stop() {
+	p.wait.Wait()
+}
+
+type backendResponse struct {
+	status int
+	header http.Header
+	body   []byte
+	err    error
+}
+
+// ServeHTTP implements http.Handler.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Instant queries default to the backends' own time, which would differ.
+	if strings.HasSuffix(r.URL.Path, "/query") && r.Form.Get("time") == "" {
+		r.Form.Set("time", strconv.FormatFloat(float64(time.Now().UnixNano())/1e9, 'f', 3, 64))
+	}
+
+	// The secondary query outlives the request, so it can be compared after
+	// the primary's response has been returned.
+	secondaryResponse := make(chan backendResponse, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.RequestTimeout)
+	p.wait.Add(1)
+	go func() {
+		defer cancel()
+		secondaryResponse <- p.query(ctx, r, secondary, p.cfg.Secondary.URL.String())
+	}()
+
+	primaryCtx, primaryCancel := context.WithTimeout(r.Context(), p.cfg.RequestTimeout)
+	defer primaryCancel()
+	primaryResponse := p.query(primaryCtx, r, primary, p.cfg.Primary.URL.String())
+	go func() {
+		defer p.wait.Done()
+		p.compare(r, primaryResponse, <-secondaryResponse)
+	}()
+
+	if primaryResponse.err != nil {
+		http.Error(w, primaryResponse.err.Error(), http.StatusBadGateway)
+		return
+	}
+	for k, vs := range primaryResponse.header {
+		w.Header()[k] = vs
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(primaryResponse.status)
+	w.Write(primaryResponse.body)
+}
+
+func (p *Proxy) query(ctx context.Context, r *http.Request, backend, backendURL string) backendResponse {
+	req, err := http.NewRequest("GET", strings.TrimRight(backendURL, "/")+r.URL.Path+"?"+r.Form.Encode(), nil)
+	if err != nil {
+		return backendResponse{err: err}
+	}
+	for k, vs := range r.Header {
+		req.Header[k] = vs
+	}
+	req.Header.Del("Content-Type")
+	req.Header.Del("Content-Length")
+
+	start := time.Now()
+	resp, err := ctxhttp.Do(ctx, p.client, req)
+	if err != nil {
+		backendRequestDuration.WithLabelValues(backend, "error").Observe(time.Since(start).Seconds())
+		return backendResponse{err: err}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	backendRequestDuration.WithLabelValues(backend, strconv.Itoa(resp.StatusCode)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return backendResponse{err: err}
+	}
+	return backendResponse{status: resp.StatusCode, header: resp.Header, body: body}
+}
+
+func (p *Proxy) compare(r *http.Request, primaryResponse, secondaryResponse backendResponse) {
+	if primaryResponse.err != nil || secondaryResponse.err != nil {
+		comparisons.WithLabelValues("failed").Inc()
+		return
+	}
+	result, err := compare(primaryResponse, secondaryResponse, p.cfg.ValueTolerance)
+	comparisons.WithLabelValues(result).Inc()
+	if err != nil {
+		log.Warnf("Responses to %s?%s differ: %v", r.URL.Path, r.Form.Encode(), err)
+	}
+}
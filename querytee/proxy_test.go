@@ -0,0 +1,123 @@
+package querytee
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func matrixResponse(t *testing.T, matrix model.Matrix) []byte {
+	buf, err := json.Marshal(map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"resultType": model.ValMatrix.String(),
+			"result":     matrix,
+		},
+	})
+	require.NoError(t, err)
+	return buf
+}
+
+func TestProxy(t *testing.T) {
+	var secondaryRequests []*http.Request
+	newBackend := func(name string, requests *[]*http.Request) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, r.ParseForm())
+			if requests != nil {
+				*requests = append(*requests, r)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"status":"success","data":%q}`, name)
+		}))
+	}
+	primaryServer := newBackend("primary", nil)
+	defer primaryServer.Close()
+	secondaryServer := newBackend("secondary", &secondaryRequests)
+	defer secondaryServer.Close()
+
+	var cfg Config
+	require.NoError(t, cfg.Primary.Set(primaryServer.URL))
+	require.NoError(t, cfg.Secondary.Set(secondaryServer.URL))
+	cfg.RequestTimeout = time.Minute
+	p, err := New(cfg)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("POST", "/api/prom/api/v1/query", strings.NewReader(url.Values{"query": {"up"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Scope-OrgID", "1")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	p.Stop()
+
+	// The primary's response is returned.
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	body, err := ioutil.ReadAll(w.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"status":"success","data":"primary"}`, string(body))
+
+	// Both backends are asked for the same instant.
+	require.Len(t, secondaryRequests, 1)
+	assert.Equal(t, "/api/prom/api/v1/query", secondaryRequests[0].URL.Path)
+	assert.Equal(t, "up", secondaryRequests[0].Form.Get("query"))
+	assert.NotEmpty(t, secondaryRequests[0].Form.Get("time"))
+	assert.Equal(t, "1", secondaryRequests[0].Header.Get("X-Scope-OrgID"))
+
+	// The secondary being down doesn't affect responses.
+	secondaryServer.Close()
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/api/prom/api/v1/query_range?query=up", nil))
+	p.Stop()
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestCompare(t *testing.T) {
+	metric := model.Metric{model.MetricNameLabel: "up"}
+	other := model.Metric{model.MetricNameLabel: "up", "job": "foo"}
+	matrix := func(values ...model.SampleValue) model.Matrix {
+		var pairs []model.SamplePair
+		for i, v := range values {
+			pairs = append(pairs, model.SamplePair{Timestamp: model.Time(i * 1000), Value: v})
+		}
+		return model.Matrix{
+			{Metric: metric, Values: pairs},
+			{Metric: other, Values: pairs},
+		}
+	}
+	ok := func(body []byte) backendResponse {
+		return backendResponse{status: http.StatusOK, body: body}
+	}
+
+	for i, tc := range []struct {
+		primary, secondary backendResponse
+		expected           string
+	}{
+		{ok(matrixResponse(t, matrix(1, 2))), ok(matrixResponse(t, matrix(1, 2))), match},
+		{ok(matrixResponse(t, matrix(1, 2))), ok(matrixResponse(t, model.Matrix{matrix(1, 2)[1], matrix(1, 2)[0]})), match},
+		{ok(matrixResponse(t, matrix(1, 2))), ok(matrixResponse(t, matrix(1, 2.0000000001))), match},
+		{ok(matrixResponse(t, matrix(1, model.SampleValue(math.NaN())))), ok(matrixResponse(t, matrix(1, model.SampleValue(math.NaN())))), match},
+		{ok(matrixResponse(t, matrix(1, 2))), ok(matrixResponse(t, matrix(1, 3))), resultMismatch},
+		{ok(matrixResponse(t, matrix(1, 2))), ok(matrixResponse(t, matrix(1))), resultMismatch},
+		{ok(matrixResponse(t, matrix(1, 2))), ok(matrixResponse(t, matrix(1, 2)[:1])), resultMismatch},
+		{ok(matrixResponse(t, matrix(1, 2))), ok([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`)), resultMismatch},
+		{ok([]byte(`{"status":"success","data":["a","b"]}`)), ok([]byte(`{"status":"success","data": ["a", "b"]}`)), match},
+		{ok([]byte(`{"status":"success","data":["a","b"]}`)), ok([]byte(`{"status":"success","data":["a"]}`)), resultMismatch},
+		{ok(matrixResponse(t, matrix(1, 2))), backendResponse{status: http.StatusInternalServerError}, statusMismatch},
+		{backendResponse{status: http.StatusBadRequest, body: []byte("a")}, backendResponse{status: http.StatusBadRequest, body: []byte("b")}, match},
+	} {
+		result, err := compare(tc.primary, tc.secondary, 0.000001)
+		assert.Equal(t, tc.expected, result, "%d: %v", i, err)
+		assert.Equal(t, tc.expected == match, err == nil, "%d", i)
+	}
+}
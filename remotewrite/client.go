@@ -0,0 +1,124 @@
+package remotewrite
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+// Config for a remote write Client and Queue.
+type Config struct {
+	URL     util.URLValue
+	Timeout time.Duration
+
+	QueueCapacity     int
+	MaxShards         int
+	MaxSamplesPerSend int
+	BatchSendDeadline time.Duration
+	MaxRetries        int
+	MinBackoff        time.Duration
+	MaxBackoff        time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	cfg.RegisterFlagsWithPrefix("remote-write.", f)
+}
+
+// RegisterFlagsWithPrefix adds the flags required to config this to the
+// given FlagSet, with each flag name prefixed, so multiple remote write
+// configs can be registered on the same FlagSet.
+func (cfg *Config) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
+	f.Var(&cfg.URL, prefix+"url", "URL to send samples to, e.g. the push endpoint of a Cortex cluster.")
+	f.DurationVar(&cfg.Timeout, prefix+"timeout", 30*time.Second, "Timeout for each remote write request.")
+	f.IntVar(&cfg.QueueCapacity, prefix+"queue-capacity", 10000, "Number of series buffered per shard before samples are dropped.")
+	f.IntVar(&cfg.MaxShards, prefix+"max-shards", 10, "Number of shards, each sending batches concurrently.")
+	f.IntVar(&cfg.MaxSamplesPerSend, prefix+"max-samples-per-send", 100, "Maximum number of samples per remote write request.")
+	f.DurationVar(&cfg.BatchSendDeadline, prefix+"batch-send-deadline", 5*time.Second, "Maximum time samples wait in a shard before being sent.")
+	f.IntVar(&cfg.MaxRetries, prefix+"max-retries", 10, "Maximum number of times to retry a failed remote write request.")
+	f.DurationVar(&cfg.MinBackoff, prefix+"min-backoff", 30*time.Millisecond, "Initial backoff between retries.")
+	f.DurationVar(&cfg.MaxBackoff, prefix+"max-backoff", 5*time.Second, "Maximum backoff between retries.")
+}
+
+// Client sends batches of series to a remote write endpoint.
+type Client struct {
+	cfg    Config
+	client *http.Client
+}
+
+// NewClient makes a new Client.
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.URL.URL == nil {
+		return nil, fmt.Errorf("no remote write URL configured")
+	}
+	return &Client{
+		cfg:    cfg,
+		client: http.DefaultClient,
+	}, nil
+}
+
+// Store sends a single write request.  If the context carries a user ID, the
+// request is sent on behalf of that user.
+func (c *Client) Store(ctx context.Context, req *cortex.WriteRequest) error {
+	pooled := util.GetBuffer()
+	defer util.PutBuffer(pooled)
+	data, err := util.MarshalToBuffer(pooled, req)
+	if err != nil {
+		return err
+	}
+	buf := bytes.Buffer{}
+	sw := util.GetSnappyWriter(&buf)
+	_, err = sw.Write(data)
+	util.PutSnappyWriter(sw)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", c.cfg.URL.String(), &buf)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Add("Content-Encoding", "snappy")
+	if _, err := user.Extract(ctx); err == nil {
+		if err := user.InjectIntoHTTPRequest(ctx, httpReq); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+	resp, err := ctxhttp.Do(ctx, c.client, httpReq)
+	if err != nil {
+		return recoverableError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(body))
+	// Requests which were rejected as invalid will be rejected again, but
+	// rate limited ones may succeed later.
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err}
+	}
+	return err
+}
+
+// recoverableError is returned for failures which may succeed when retried.
+type recoverableError struct {
+	error
+}
@@ -0,0 +1,217 @@
+package remotewrite
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+var (
+	samplesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "remote_write_samples_total",
+		Help:      "The total number of samples handled by each remote write queue, by result (sent, failed or dropped).",
+	}, []string{"queue", "result"})
+	retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "remote_write_retries_total",
+		Help:      "The total number of remote write requests retried.",
+	}, []string{"queue"})
+	sendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "remote_write_send_duration_seconds",
+		Help:      "Time spent sending each batch of samples, including retries.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"queue"})
+	pendingSeries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "remote_write_pending_series",
+		Help:      "The number of series waiting to be sent by each remote write queue.",
+	}, []string{"queue"})
+)
+
+func init() {
+	prometheus.MustRegister(samplesTotal)
+	prometheus.MustRegister(retriesTotal)
+	prometheus.MustRegister(sendDuration)
+	prometheus.MustRegister(pendingSeries)
+}
+
+// storer is implemented by Client.
+type storer interface {
+	Store(ctx context.Context, req *cortex.WriteRequest) error
+}
+
+// Queue batches series and sends them to a remote write endpoint.  Series are
+// sharded by user and labels, so samples for a series are sent in order, and
+// each shard sends its batches concurrently with the others.  Appending never
+// blocks: if a shard is full, samples are dropped.
+type Queue struct {
+	name   string
+	cfg    Config
+	client storer
+	shards []chan queueEntry
+	wg     sync.WaitGroup
+}
+
+type queueEntry struct {
+	userID string
+	series cortex.TimeSeries
+}
+
+// NewQueue makes a new Queue sending to the configured URL.  The name
+// identifies the queue in metrics.
+func NewQueue(name string, cfg Config) (*Queue, error) {
+	client, err := NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newQueue(name, cfg, client), nil
+}
+
+func newQueue(name string, cfg Config, client storer) *Queue {
+	if cfg.MaxShards < 1 {
+		cfg.MaxShards = 1
+	}
+	if cfg.MaxSamplesPerSend < 1 {
+		cfg.MaxSamplesPerSend = 1
+	}
+	if cfg.BatchSendDeadline <= 0 {
+		cfg.BatchSendDeadline = 5 * time.Second
+	}
+	q := &Queue{
+		name:   name,
+		cfg:    cfg,
+		client: client,
+		shards: make([]chan queueEntry, cfg.MaxShards),
+	}
+	for i := range q.shards {
+		q.shards[i] = make(chan queueEntry, cfg.QueueCapacity)
+		q.wg.Add(1)
+		go q.runShard(q.shards[i])
+	}
+	return q
+}
+
+// Append queues series to be sent on behalf of userID.  It returns false if
+// any were dropped because their shard was full.
+func (q *Queue) Append(userID string, series []cortex.TimeSeries) bool {
+	ok := true
+	for _, ts := range series {
+		shard := q.shards[shardFor(userID, ts.Labels, len(q.shards))]
+		select {
+		case shard <- queueEntry{userID: userID, series: ts}:
+			pendingSeries.WithLabelValues(q.name).Inc()
+		default:
+			samplesTotal.WithLabelValues(q.name, "dropped").Add(float64(len(ts.Samples)))
+			ok = false
+		}
+	}
+	return ok
+}
+
+// Stop the Queue, sending any queued series first.  Append must not be
+// called after Stop.
+func (q *Queue) Stop() {
+	for _, shard := range q.shards {
+		close(shard)
+	}
+	q.wg.Wait()
+}
+
+func shardFor(userID string, labels []cortex.LabelPair, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	for _, pair := range labels {
+		h.Write(pair.Name)
+		h.Write([]byte{0})
+		h.Write(pair.Value)
+		h.Write([]byte{0})
+	}
+	return int(h.Sum32() % uint32(shards))
+}
+
+func (q *Queue) runShard(entries <-chan queueEntry) {
+	defer q.wg.Done()
+
+	var (
+		pending        = map[string][]cortex.TimeSeries{}
+		pendingSamples = map[string]int{}
+		ticker         = time.NewTicker(q.cfg.BatchSendDeadline)
+	)
+	defer ticker.Stop()
+
+	flush := func(userID string) {
+		series := pending[userID]
+		delete(pending, userID)
+		delete(pendingSamples, userID)
+		pendingSeries.WithLabelValues(q.name).Sub(float64(len(series)))
+		q.send(userID, series)
+	}
+
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				for userID := range pending {
+					flush(userID)
+				}
+				return
+			}
+			pending[entry.userID] = append(pending[entry.userID], entry.series)
+			pendingSamples[entry.userID] += len(entry.series.Samples)
+			if pendingSamples[entry.userID] >= q.cfg.MaxSamplesPerSend {
+				flush(entry.userID)
+			}
+
+		case <-ticker.C:
+			for userID := range pending {
+				flush(userID)
+			}
+		}
+	}
+}
+
+// send a batch of series, retrying recoverable failures with backoff.
+func (q *Queue) send(userID string, series []cortex.TimeSeries) {
+	var numSamples int
+	for _, ts := range series {
+		numSamples += len(ts.Samples)
+	}
+
+	start := time.Now()
+	defer func() {
+		sendDuration.WithLabelValues(q.name).Observe(time.Since(start).Seconds())
+	}()
+
+	ctx := user.Inject(context.Background(), userID)
+	req := &cortex.WriteRequest{Timeseries: series}
+	backoff := q.cfg.MinBackoff
+	for tries := 0; ; tries++ {
+		err := q.client.Store(ctx, req)
+		if err == nil {
+			samplesTotal.WithLabelValues(q.name, "sent").Add(float64(numSamples))
+			return
+		}
+		if _, ok := err.(recoverableError); !ok || tries >= q.cfg.MaxRetries {
+			log.Errorf("Error sending %d samples for %s to %s: %v", numSamples, userID, q.name, err)
+			samplesTotal.WithLabelValues(q.name, "failed").Add(float64(numSamples))
+			return
+		}
+
+		log.Warnf("Error sending samples for %s to %s, retrying in %v: %v", userID, q.name, backoff, err)
+		retriesTotal.WithLabelValues(q.name).Inc()
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > q.cfg.MaxBackoff {
+			backoff = q.cfg.MaxBackoff
+		}
+	}
+}
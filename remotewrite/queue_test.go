@@ -0,0 +1,157 @@
+package remotewrite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+)
+
+// mockEndpoint records the requests it receives, failing the first failures
+// of them with status.
+type mockEndpoint struct {
+	sync.Mutex
+	requests []*cortex.WriteRequest
+	users    []string
+	failures int
+	status   int
+}
+
+func (m *mockEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+	if m.failures > 0 {
+		m.failures--
+		http.Error(w, "failed", m.status)
+		return
+	}
+
+	buf, err := ioutil.ReadAll(snappy.NewReader(r.Body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req cortex.WriteRequest
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	userID, _, _ := user.ExtractFromHTTPRequest(r)
+	m.requests = append(m.requests, &req)
+	m.users = append(m.users, userID)
+}
+
+func (m *mockEndpoint) samples() int {
+	m.Lock()
+	defer m.Unlock()
+	n := 0
+	for _, req := range m.requests {
+		for _, ts := range req.Timeseries {
+			n += len(ts.Samples)
+		}
+	}
+	return n
+}
+
+func newTestConfig(t *testing.T, url string) Config {
+	var cfg Config
+	require.NoError(t, cfg.URL.Set(url))
+	cfg.Timeout = time.Second
+	cfg.QueueCapacity = 1000
+	cfg.MaxShards = 1
+	cfg.MaxSamplesPerSend = 100
+	cfg.BatchSendDeadline = time.Hour
+	cfg.MaxRetries = 3
+	cfg.MinBackoff = time.Millisecond
+	cfg.MaxBackoff = 10 * time.Millisecond
+	return cfg
+}
+
+func makeSeries(n int) []cortex.TimeSeries {
+	var series []cortex.TimeSeries
+	for i := 0; i < n; i++ {
+		series = append(series, cortex.TimeSeries{
+			Labels: []cortex.LabelPair{
+				{Name: []byte("__name__"), Value: []byte("foo")},
+				{Name: []byte("i"), Value: []byte(fmt.Sprintf("%d", i))},
+			},
+			Samples: []cortex.Sample{{Value: float64(i), TimestampMs: int64(i)}},
+		})
+	}
+	return series
+}
+
+func TestClientStore(t *testing.T) {
+	endpoint := &mockEndpoint{}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+
+	client, err := NewClient(newTestConfig(t, server.URL))
+	require.NoError(t, err)
+
+	ctx := user.Inject(context.Background(), "1")
+	require.NoError(t, client.Store(ctx, &cortex.WriteRequest{Timeseries: makeSeries(3)}))
+	assert.Equal(t, []string{"1"}, endpoint.users)
+	assert.Equal(t, 3, endpoint.samples())
+
+	endpoint.failures, endpoint.status = 1, http.StatusBadRequest
+	err = client.Store(ctx, &cortex.WriteRequest{})
+	require.Error(t, err)
+	assert.IsType(t, fmt.Errorf(""), err)
+
+	endpoint.failures, endpoint.status = 1, http.StatusServiceUnavailable
+	err = client.Store(ctx, &cortex.WriteRequest{})
+	assert.IsType(t, recoverableError{}, err)
+}
+
+func TestQueueBatchesAndRetries(t *testing.T) {
+	endpoint := &mockEndpoint{failures: 2, status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+
+	q, err := NewQueue("test", newTestConfig(t, server.URL))
+	require.NoError(t, err)
+	require.True(t, q.Append("1", makeSeries(250)))
+	require.True(t, q.Append("2", makeSeries(10)))
+	q.Stop()
+
+	assert.Equal(t, 260, endpoint.samples())
+	for i, req := range endpoint.requests {
+		assert.True(t, len(req.Timeseries) <= 100, "request %d", i)
+	}
+	assert.Contains(t, endpoint.users, "1")
+	assert.Contains(t, endpoint.users, "2")
+}
+
+func TestQueueDropsWhenFull(t *testing.T) {
+	// Block the shard on a request which won't complete until we let it.
+	blocked := make(chan struct{})
+	cfg := newTestConfig(t, "http://localhost")
+	cfg.QueueCapacity = 10
+	cfg.MaxSamplesPerSend = 1
+	q := newQueue("test", cfg, storerFunc(func(context.Context, *cortex.WriteRequest) error {
+		<-blocked
+		return nil
+	}))
+	assert.False(t, q.Append("1", makeSeries(20)))
+	close(blocked)
+	q.Stop()
+}
+
+type storerFunc func(context.Context, *cortex.WriteRequest) error
+
+func (f storerFunc) Store(ctx context.Context, req *cortex.WriteRequest) error {
+	return f(ctx, req)
+}
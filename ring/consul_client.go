@@ -3,12 +3,15 @@ package ring
 import (
 	"flag"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/snappy"
 	consul "github.com/hashicorp/consul/api"
-	"github.com/prometheus/common/log"
+
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 const (
@@ -17,16 +20,32 @@ const (
 
 // ConsulConfig to create a ConsulClient
 type ConsulConfig struct {
-	Host   string
-	Prefix string
+	Store    string
+	Host     string
+	Prefix   string
+	ACLToken string
+
+	TLSEnabled bool
+	TLS        util.TLSConfig
+
+	Gossip GossipConfig
+	Etcd   EtcdConfig
+	Multi  MultiConfig
 
 	Mock ConsulClient
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *ConsulConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Store, "ring.store", consulStore, "Backend storing the ring: consul, etcd, gossip to exchange it directly between Cortex processes, multi to mirror writes between two of them, or inmemory to keep it in this process only.")
 	f.StringVar(&cfg.Host, "consul.hostname", "localhost:8500", "Hostname and port of Consul.")
 	f.StringVar(&cfg.Prefix, "consul.prefix", "collectors/", "Prefix for keys in Consul.")
+	f.StringVar(&cfg.ACLToken, "consul.acl-token", "", "ACL token to send with requests to Consul.")
+	f.BoolVar(&cfg.TLSEnabled, "consul.tls-enabled", false, "Talk to Consul over HTTPS.")
+	cfg.TLS.RegisterFlagsWithPrefix("consul.", "Consul", f)
+	cfg.Gossip.RegisterFlags(f)
+	cfg.Etcd.RegisterFlags(f)
+	cfg.Multi.RegisterFlags(f)
 }
 
 // ConsulClient is a high-level client for Consul, that exposes operations
@@ -61,21 +80,31 @@ type consulClient struct {
 	codec Codec
 }
 
+// codecUser is implemented by kv stores which decode values, to merge them.
+type codecUser interface {
+	useCodec(key string, codec Codec)
+}
+
+// useCodec tells the store, if it decodes values, how key's value is
+// encoded.
+func (c *consulClient) useCodec(key string) {
+	if u, ok := c.kv.(codecUser); ok {
+		u.useCodec(key, c.codec)
+	}
+}
+
 // NewConsulClient returns a new ConsulClient.
 func NewConsulClient(cfg ConsulConfig, codec Codec) (ConsulClient, error) {
 	if cfg.Mock != nil {
 		return cfg.Mock, nil
 	}
 
-	client, err := consul.NewClient(&consul.Config{
-		Address: cfg.Host,
-		Scheme:  "http",
-	})
+	kv, err := newKV(cfg, cfg.Store)
 	if err != nil {
 		return nil, err
 	}
 	var c ConsulClient = &consulClient{
-		kv:    client.KV(),
+		kv:    kv,
 		codec: codec,
 	}
 	if cfg.Prefix != "" {
@@ -84,6 +113,56 @@ func NewConsulClient(cfg ConsulConfig, codec Codec) (ConsulClient, error) {
 	return c, nil
 }
 
+func (cfg ConsulConfig) consulAPIConfig() (*consul.Config, error) {
+	config := &consul.Config{
+		Address: cfg.Host,
+		Scheme:  "http",
+		Token:   cfg.ACLToken,
+	}
+	if !cfg.TLSEnabled {
+		return config, nil
+	}
+
+	tlsConfig, err := cfg.TLS.GetTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.Scheme = "https"
+	config.HttpClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	return config, nil
+}
+
+// newKV makes the named store.
+func newKV(cfg ConsulConfig, store string) (kv, error) {
+	switch store {
+	case consulStore, "":
+		config, err := cfg.consulAPIConfig()
+		if err != nil {
+			return nil, err
+		}
+		client, err := consul.NewClient(config)
+		if err != nil {
+			return nil, err
+		}
+		return client.KV(), nil
+	case etcdStore:
+		return newEtcdKV(cfg.Etcd)
+	case gossipStore:
+		return processGossipKV(cfg.Gossip)
+	case multiStore:
+		return newMultiKV(cfg)
+	case inmemoryStore:
+		return processInMemoryKV(), nil
+	default:
+		return nil, fmt.Errorf("unknown ring store: %q", store)
+	}
+}
+
 var (
 	queryOptions = &consul.QueryOptions{
 		RequireConsistent: true,
@@ -124,6 +203,7 @@ func (p ProtoCodec) Encode(msg interface{}) ([]byte, error) {
 // CAS atomically modifies a value in a callback.
 // If value doesn't exist you'll get nil as an argument to your callback.
 func (c *consulClient) CAS(key string, f CASCallback) error {
+	c.useCodec(key)
 	var (
 		index   = uint64(0)
 		retries = 10
@@ -278,6 +358,7 @@ func (c *consulClient) WatchPrefix(prefix string, done <-chan struct{}, f func(s
 // into. Values in Consul are assumed to be JSON. This function blocks until
 // the done channel is closed.
 func (c *consulClient) WatchKey(key string, done <-chan struct{}, f func(interface{}) bool) {
+	c.useCodec(key)
 	var (
 		backoff = newBackoff(done)
 		index   = uint64(0)
@@ -321,6 +402,7 @@ func (c *consulClient) WatchKey(key string, done <-chan struct{}, f func(interfa
 }
 
 func (c *consulClient) PutBytes(key string, buf []byte) error {
+	c.useCodec(key)
 	_, err := c.kv.Put(&consul.KVPair{
 		Key:   key,
 		Value: buf,
@@ -329,9 +411,12 @@ func (c *consulClient) PutBytes(key string, buf []byte) error {
 }
 
 func (c *consulClient) Get(key string) (interface{}, error) {
+	c.useCodec(key)
 	kvp, _, err := c.kv.Get(key, &consul.QueryOptions{})
 	if err != nil {
 		return nil, err
+	} else if kvp == nil {
+		return nil, nil
 	}
 	return c.codec.Decode(kvp.Value)
 }
@@ -0,0 +1,90 @@
+package ring
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestConsulACLTokenAndTLS(t *testing.T) {
+	codec := ProtoCodec{Factory: ProtoDescFactory}
+	value, err := codec.Encode(NewDesc())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("X-Consul-Token")
+		w.Header().Set("X-Consul-Index", "1")
+		json.NewEncoder(w).Encode([]consul.KVPair{{Key: "ring", Value: value, ModifyIndex: 1}})
+	}))
+	defer server.Close()
+
+	client, err := NewConsulClient(ConsulConfig{
+		Host:       strings.TrimPrefix(server.URL, "https://"),
+		ACLToken:   "secret",
+		TLSEnabled: true,
+		TLS:        util.TLSConfig{InsecureSkipVerify: true},
+	}, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get("ring"); err != nil {
+		t.Fatal(err)
+	}
+	if token != "secret" {
+		t.Fatalf("expected the ACL token to be sent, got %q", token)
+	}
+
+	// Without skipping verification, the test server's certificate is
+	// rejected.
+	client, err = NewConsulClient(ConsulConfig{
+		Host:       strings.TrimPrefix(server.URL, "https://"),
+		TLSEnabled: true,
+	}, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get("ring"); err == nil {
+		t.Fatal("expected an error verifying the server's certificate")
+	}
+
+	if _, err := NewConsulClient(ConsulConfig{TLSEnabled: true, TLS: util.TLSConfig{CertPath: "cert.pem"}}, codec); err == nil {
+		t.Fatal("expected an error for a certificate without a key")
+	}
+}
+
+func TestInMemoryStoreIsShared(t *testing.T) {
+	cfg := ConsulConfig{Store: inmemoryStore}
+	codec := ProtoCodec{Factory: ProtoDescFactory}
+	a, err := NewConsulClient(cfg, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewConsulClient(cfg, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.CAS(ConsulKey, func(in interface{}) (interface{}, bool, error) {
+		desc := NewDesc()
+		desc.AddIngester("1", "addr-1", "", "", nil, ACTIVE)
+		return desc, true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := b.Get(ConsulKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(value.(*Desc).Ingesters); n != 1 {
+		t.Fatalf("expected 1 ingester, got %d", n)
+	}
+}
@@ -0,0 +1,349 @@
+package ring
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+const (
+	etcdStore = "etcd"
+
+	// How often blocking reads poll etcd for changes.
+	etcdPollInterval = 1 * time.Second
+)
+
+// EtcdConfig configures the etcd KV store.  etcd is accessed through its v3
+// JSON gateway, which every etcd server serves on its client port.
+type EtcdConfig struct {
+	Endpoints string
+	Timeout   time.Duration
+	Username  string
+	Password  string
+
+	TLS util.TLSConfig
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *EtcdConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Endpoints, "etcd.endpoints", "http://localhost:2379", "Comma separated URLs of etcd servers. Use https:// URLs for TLS.")
+	f.DurationVar(&cfg.Timeout, "etcd.timeout", 10*time.Second, "Timeout for requests to etcd.")
+	f.StringVar(&cfg.Username, "etcd.username", "", "Username to authenticate to etcd with. Empty disables authentication.")
+	f.StringVar(&cfg.Password, "etcd.password", "", "Password to authenticate to etcd with.")
+	cfg.TLS.RegisterFlagsWithPrefix("etcd.", "etcd", f)
+}
+
+// etcdKV implements the kv interface on etcd.  Consul indexes map to etcd
+// mod revisions, and blocking reads poll.
+type etcdKV struct {
+	cfg       EtcdConfig
+	endpoints []string
+	client    *http.Client
+
+	mtx   sync.Mutex
+	token string
+}
+
+func newEtcdKV(cfg EtcdConfig) (*etcdKV, error) {
+	var endpoints []string
+	for _, endpoint := range strings.Split(cfg.Endpoints, ",") {
+		endpoint = strings.TrimRight(strings.TrimSpace(endpoint), "/")
+		if endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no etcd endpoints configured")
+	}
+	tlsConfig, err := cfg.TLS.GetTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &etcdKV{
+		cfg:       cfg,
+		endpoints: endpoints,
+		client: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcdKeyValue struct {
+	Key            []byte `json:"key"`
+	Value          []byte `json:"value"`
+	CreateRevision int64  `json:"create_revision,string"`
+	ModRevision    int64  `json:"mod_revision,string"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader     `json:"header"`
+	KVs    []etcdKeyValue `json:"kvs"`
+}
+
+type etcdPutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdCompare struct {
+	Target      string `json:"target"`
+	Result      string `json:"result"`
+	Key         []byte `json:"key"`
+	ModRevision int64  `json:"mod_revision,string"`
+}
+
+type etcdRequestOp struct {
+	RequestPut *etcdPutRequest `json:"request_put,omitempty"`
+}
+
+type etcdTxnRequest struct {
+	Compare []etcdCompare   `json:"compare"`
+	Success []etcdRequestOp `json:"success"`
+}
+
+type etcdTxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+type etcdAuthRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type etcdAuthResponse struct {
+	Token string `json:"token"`
+}
+
+type etcdError struct {
+	status  int
+	Message string `json:"message"`
+	Err     string `json:"error"`
+}
+
+func (e etcdError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = e.Err
+	}
+	return fmt.Sprintf("etcd returned %d: %s", e.status, msg)
+}
+
+// call makes a request to the gateway, trying each endpoint in turn, and
+// authenticating first if required.
+func (e *etcdKV) call(path string, req, resp interface{}) error {
+	err := e.callWithToken(path, req, resp)
+	if err, ok := err.(etcdError); ok && err.status == http.StatusUnauthorized && e.cfg.Username != "" {
+		// The token has expired; get a new one.
+		e.mtx.Lock()
+		e.token = ""
+		e.mtx.Unlock()
+		return e.callWithToken(path, req, resp)
+	}
+	return err
+}
+
+func (e *etcdKV) callWithToken(path string, req, resp interface{}) error {
+	token, err := e.authenticate()
+	if err != nil {
+		return err
+	}
+	return e.post(path, token, req, resp)
+}
+
+func (e *etcdKV) authenticate() (string, error) {
+	if e.cfg.Username == "" {
+		return "", nil
+	}
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.token != "" {
+		return e.token, nil
+	}
+	var resp etcdAuthResponse
+	if err := e.post("/v3/auth/authenticate", "", etcdAuthRequest{Name: e.cfg.Username, Password: e.cfg.Password}, &resp); err != nil {
+		return "", err
+	}
+	e.token = resp.Token
+	return e.token, nil
+}
+
+func (e *etcdKV) post(path, token string, req, resp interface{}) error {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, endpoint := range e.endpoints {
+		httpReq, err := http.NewRequest("POST", endpoint+path, bytes.NewReader(buf))
+		if err != nil {
+			return err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			httpReq.Header.Set("Authorization", token)
+		}
+		httpResp, err := e.client.Do(httpReq)
+		if err != nil {
+			// Try the next endpoint.
+			lastErr = err
+			continue
+		}
+		err = decodeEtcdResponse(httpResp, resp)
+		httpResp.Body.Close()
+		return err
+	}
+	return lastErr
+}
+
+func decodeEtcdResponse(httpResp *http.Response, resp interface{}) error {
+	if httpResp.StatusCode != http.StatusOK {
+		etcdErr := etcdError{status: httpResp.StatusCode}
+		json.NewDecoder(httpResp.Body).Decode(&etcdErr)
+		return etcdErr
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+func (e *etcdKV) rangeKeys(key, rangeEnd []byte) (etcdRangeResponse, error) {
+	var resp etcdRangeResponse
+	err := e.call("/v3/kv/range", etcdRangeRequest{Key: key, RangeEnd: rangeEnd}, &resp)
+	return resp, err
+}
+
+// prefixEnd returns the end of the range of keys with the given prefix.
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// All keys after the prefix.
+	return []byte{0}
+}
+
+func toKVPair(kv etcdKeyValue) *consul.KVPair {
+	return &consul.KVPair{
+		Key:         string(kv.Key),
+		Value:       kv.Value,
+		CreateIndex: uint64(kv.CreateRevision),
+		ModifyIndex: uint64(kv.ModRevision),
+	}
+}
+
+// poll calls f until it returns an index after the query's wait index, or
+// the query's wait time passes.  The index of a missing key is 0.
+func poll(q *consul.QueryOptions, f func() (uint64, error)) (uint64, error) {
+	var deadline time.Time
+	if q != nil && q.WaitTime > 0 {
+		deadline = time.Now().Add(q.WaitTime)
+	}
+	for {
+		index, err := f()
+		if err != nil {
+			return 0, err
+		}
+		if q == nil || index > q.WaitIndex || !time.Now().Add(etcdPollInterval).Before(deadline) {
+			if q != nil && index < q.WaitIndex {
+				index = q.WaitIndex
+			}
+			return index, nil
+		}
+		time.Sleep(etcdPollInterval)
+	}
+}
+
+// Get implements kv.
+func (e *etcdKV) Get(key string, q *consul.QueryOptions) (*consul.KVPair, *consul.QueryMeta, error) {
+	var result *consul.KVPair
+	index, err := poll(q, func() (uint64, error) {
+		resp, err := e.rangeKeys([]byte(key), nil)
+		if err != nil || len(resp.KVs) == 0 {
+			result = nil
+			return 0, err
+		}
+		result = toKVPair(resp.KVs[0])
+		return result.ModifyIndex, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, &consul.QueryMeta{LastIndex: index}, nil
+}
+
+// List implements kv.
+func (e *etcdKV) List(prefix string, q *consul.QueryOptions) (consul.KVPairs, *consul.QueryMeta, error) {
+	var result consul.KVPairs
+	index, err := poll(q, func() (uint64, error) {
+		key := []byte(prefix)
+		if prefix == "" {
+			// etcd requires a key; "\x00" to "\x00" is all keys.
+			key = []byte{0}
+		}
+		resp, err := e.rangeKeys(key, prefixEnd(prefix))
+		if err != nil {
+			return 0, err
+		}
+		result = make(consul.KVPairs, 0, len(resp.KVs))
+		var index uint64
+		for _, kv := range resp.KVs {
+			kvp := toKVPair(kv)
+			if kvp.ModifyIndex > index {
+				index = kvp.ModifyIndex
+			}
+			result = append(result, kvp)
+		}
+		return index, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, &consul.QueryMeta{LastIndex: index}, nil
+}
+
+// Put implements kv.
+func (e *etcdKV) Put(p *consul.KVPair, q *consul.WriteOptions) (*consul.WriteMeta, error) {
+	var resp struct{}
+	return nil, e.call("/v3/kv/put", etcdPutRequest{Key: []byte(p.Key), Value: p.Value}, &resp)
+}
+
+// CAS implements kv.  As with Consul, a modify index of 0 only succeeds if
+// the key doesn't exist, as etcd compares missing keys' revisions as 0.
+func (e *etcdKV) CAS(p *consul.KVPair, q *consul.WriteOptions) (bool, *consul.WriteMeta, error) {
+	var resp etcdTxnResponse
+	err := e.call("/v3/kv/txn", etcdTxnRequest{
+		Compare: []etcdCompare{{
+			Target:      "MOD",
+			Result:      "EQUAL",
+			Key:         []byte(p.Key),
+			ModRevision: int64(p.ModifyIndex),
+		}},
+		Success: []etcdRequestOp{{
+			RequestPut: &etcdPutRequest{Key: []byte(p.Key), Value: p.Value},
+		}},
+	}, &resp)
+	if err != nil {
+		return false, nil, err
+	}
+	return resp.Succeeded, nil, nil
+}
@@ -0,0 +1,177 @@
+package ring
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeEtcd implements the parts of etcd's v3 JSON gateway the etcd KV uses.
+type fakeEtcd struct {
+	mtx      sync.Mutex
+	revision int64
+	kvs      map[string]etcdKeyValue
+	password string
+	tokens   map[string]bool
+	logins   int
+}
+
+func newFakeEtcd(password string) *fakeEtcd {
+	return &fakeEtcd{
+		kvs:      map[string]etcdKeyValue{},
+		password: password,
+		tokens:   map[string]bool{},
+	}
+}
+
+func (f *fakeEtcd) put(key, value []byte) {
+	f.revision++
+	kv, ok := f.kvs[string(key)]
+	if !ok {
+		kv = etcdKeyValue{Key: key, CreateRevision: f.revision}
+	}
+	kv.Value = value
+	kv.ModRevision = f.revision
+	f.kvs[string(key)] = kv
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if r.URL.Path == "/v3/auth/authenticate" {
+		var req etcdAuthRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Password != f.password {
+			http.Error(w, `{"error":"authentication failed"}`, http.StatusBadRequest)
+			return
+		}
+		f.logins++
+		token := strings.Repeat("t", f.logins)
+		f.tokens[token] = true
+		json.NewEncoder(w).Encode(etcdAuthResponse{Token: token})
+		return
+	}
+	if f.password != "" && !f.tokens[r.Header.Get("Authorization")] {
+		http.Error(w, `{"error":"invalid auth token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var req etcdRangeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		resp := etcdRangeResponse{Header: etcdHeader{Revision: f.revision}}
+		for key, kv := range f.kvs {
+			if key == string(req.Key) || (req.RangeEnd != nil && key >= string(req.Key) && (string(req.RangeEnd) == "\x00" || key < string(req.RangeEnd))) {
+				resp.KVs = append(resp.KVs, kv)
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	case "/v3/kv/put":
+		var req etcdPutRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		f.put(req.Key, req.Value)
+		w.Write([]byte(`{}`))
+	case "/v3/kv/txn":
+		var req etcdTxnRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		succeeded := true
+		for _, c := range req.Compare {
+			if f.kvs[string(c.Key)].ModRevision != c.ModRevision {
+				succeeded = false
+			}
+		}
+		if succeeded {
+			for _, op := range req.Success {
+				f.put(op.RequestPut.Key, op.RequestPut.Value)
+			}
+		}
+		json.NewEncoder(w).Encode(etcdTxnResponse{Succeeded: succeeded})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestEtcdKV(t *testing.T) {
+	etcd := newFakeEtcd("secret")
+	server := httptest.NewServer(etcd)
+	defer server.Close()
+
+	client, err := NewConsulClient(ConsulConfig{
+		Store: etcdStore,
+		// The first endpoint is down.
+		Etcd: EtcdConfig{Endpoints: "http://127.0.0.1:1," + server.URL, Username: "root", Password: "secret"},
+	}, ProtoCodec{Factory: ProtoDescFactory})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addIngester := func(id string) {
+		err := client.CAS(ConsulKey, func(in interface{}) (interface{}, bool, error) {
+			desc, ok := in.(*Desc)
+			if !ok || desc == nil {
+				desc = NewDesc()
+			}
+			desc.AddIngester(id, "addr-"+id, "", "", nil, ACTIVE)
+			return desc, true, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	addIngester("1")
+	addIngester("2")
+
+	value, err := client.Get(ConsulKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(value.(*Desc).Ingesters); n != 2 {
+		t.Fatalf("expected 2 ingesters, got %d", n)
+	}
+
+	// A CAS based on a stale revision fails.
+	kv := client.(*consulClient).kv
+	kvp, _, err := kv.Get(ConsulKey, queryOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := *kvp
+	addIngester("3")
+	if ok, _, err := kv.CAS(&stale, nil); err != nil || ok {
+		t.Fatalf("expected stale CAS to fail, got %v, %v", ok, err)
+	}
+
+	// Expired tokens are renewed.
+	etcd.mtx.Lock()
+	etcd.tokens = map[string]bool{}
+	etcd.mtx.Unlock()
+	pairs, _, err := kv.List("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 1 || pairs[0].Key != ConsulKey {
+		t.Fatalf("unexpected list result %v", pairs)
+	}
+	if etcd.logins != 2 {
+		t.Fatalf("expected 2 logins, got %d", etcd.logins)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for prefix, expected := range map[string]string{
+		"":          "\x00",
+		"abc":       "abd",
+		"ab\xff":    "ac",
+		"\xff\xff":  "\x00",
+		"collector": "collectos",
+	} {
+		if got := string(prefixEnd(prefix)); got != expected {
+			t.Errorf("prefixEnd(%q) = %q, expected %q", prefix, got, expected)
+		}
+	}
+}
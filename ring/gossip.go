@@ -0,0 +1,420 @@
+package ring
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/weaveworks/cortex/util/log"
+)
+
+const (
+	consulStore = "consul"
+	gossipStore = "gossip"
+
+	// gossipPath is the HTTP path gossip is exchanged on.
+	gossipPath = "/gossip"
+)
+
+var gossipRounds = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cortex_gossip_rounds_total",
+	Help: "The total number of gossip rounds with a peer, by result.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(gossipRounds)
+}
+
+// GossipConfig configures the gossip KV store, an alternative to Consul in
+// which every process keeps a copy of all the values, and periodically
+// exchanges them with a random peer.
+type GossipConfig struct {
+	ListenAddr   string
+	Peers        string
+	Interval     time.Duration
+	Timeout      time.Duration
+	TombstoneTTL time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *GossipConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.ListenAddr, "gossip.listen-address", ":7946", "Address to serve gossip on, for peers only: it's separate from the HTTP server so it can be firewalled off from everything else.")
+	f.StringVar(&cfg.Peers, "gossip.peers", "", "Comma separated host:port addresses of peers' -gossip.listen-address to gossip with. Host names are resolved on each round, so a name resolving to all peers (e.g. a headless Kubernetes service) can be used.")
+	f.DurationVar(&cfg.Interval, "gossip.interval", 1*time.Second, "How often to exchange values with a random peer.")
+	f.DurationVar(&cfg.Timeout, "gossip.timeout", 5*time.Second, "Timeout for exchanging values with a peer.")
+	f.DurationVar(&cfg.TombstoneTTL, "gossip.tombstone-ttl", 1*time.Hour, "How long to remember ingesters were removed from the ring, so peers which haven't heard yet don't add them back. Peers out of touch for longer can bring back removed ingesters, as unhealthy.")
+}
+
+// gossipVersion orders writes of a key: the highest version wins, and ties
+// between concurrent writes on different nodes are broken by node name.
+type gossipVersion struct {
+	Version uint64 `json:"version"`
+	Node    string `json:"node"`
+}
+
+func (v gossipVersion) after(other gossipVersion) bool {
+	if v.Version != other.Version {
+		return v.Version > other.Version
+	}
+	return v.Node > other.Node
+}
+
+type gossipEntry struct {
+	gossipVersion
+	Value []byte `json:"value"`
+
+	// Removed has the Unix times ingesters were removed from a ring at, so
+	// merges don't bring them back.
+	Removed map[string]int64 `json:"removed,omitempty"`
+}
+
+// gossipKV implements the kv interface on top of a local in-memory store,
+// versioning each write with a Lamport clock so values converge between
+// peers.  CAS is only atomic locally, so rings written concurrently on
+// different nodes are merged ingester by ingester; for other values the last
+// writer wins.
+type gossipKV struct {
+	*memoryKV
+	cfg    GossipConfig
+	node   string
+	client *http.Client
+
+	mtx      sync.Mutex
+	clock    uint64
+	versions map[string]gossipVersion
+	codecs   map[string]Codec
+	removed  map[string]map[string]int64
+}
+
+var process struct {
+	once   sync.Once
+	gossip *gossipKV
+	err    error
+}
+
+// processGossipKV returns the gossip KV store shared by all the clients in
+// this process, as there is only one address to gossip on.
+func processGossipKV(cfg GossipConfig) (*gossipKV, error) {
+	process.once.Do(func() {
+		g := newGossipKV(cfg)
+		lis, err := net.Listen("tcp", cfg.ListenAddr)
+		if err != nil {
+			process.err = fmt.Errorf("error listening for gossip: %v", err)
+			return
+		}
+		mux := http.NewServeMux()
+		mux.Handle(gossipPath, g)
+		go func() {
+			log.Fatal(http.Serve(lis, mux))
+		}()
+		go g.loop()
+		process.gossip = g
+	})
+	return process.gossip, process.err
+}
+
+func newGossipKV(cfg GossipConfig) *gossipKV {
+	node, err := os.Hostname()
+	if err != nil {
+		node = fmt.Sprintf("node-%d", rand.Int63())
+	}
+	return &gossipKV{
+		memoryKV: newMemoryKV(),
+		cfg:      cfg,
+		node:     node,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		versions: map[string]gossipVersion{},
+		codecs:   map[string]Codec{},
+		removed:  map[string]map[string]int64{},
+	}
+}
+
+// useCodec implements codecUser, so rings can be merged.
+func (g *gossipKV) useCodec(key string, codec Codec) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.codecs[key] = codec
+}
+
+// Put implements kv.
+func (g *gossipKV) Put(p *consul.KVPair, q *consul.WriteOptions) (*consul.WriteMeta, error) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	old := g.value(p.Key)
+	meta, err := g.memoryKV.Put(p, q)
+	if err == nil {
+		g.noteRemovals(p.Key, old, p.Value)
+		g.bump(p.Key)
+	}
+	return meta, err
+}
+
+// CAS implements kv.
+func (g *gossipKV) CAS(p *consul.KVPair, q *consul.WriteOptions) (bool, *consul.WriteMeta, error) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	old := g.value(p.Key)
+	ok, meta, err := g.memoryKV.CAS(p, q)
+	if ok && err == nil {
+		g.noteRemovals(p.Key, old, p.Value)
+		g.bump(p.Key)
+	}
+	return ok, meta, err
+}
+
+// bump must be called with the lock held.
+func (g *gossipKV) bump(key string) {
+	g.clock++
+	g.versions[key] = gossipVersion{Version: g.clock, Node: g.node}
+}
+
+// value returns the local value of key, or nil.
+func (g *gossipKV) value(key string) []byte {
+	g.memoryKV.mtx.Lock()
+	defer g.memoryKV.mtx.Unlock()
+	if kvp, ok := g.memoryKV.kvps[key]; ok {
+		return kvp.Value
+	}
+	return nil
+}
+
+// decodeRing decodes a value of key, if it's a ring.  Must be called with the
+// lock held.
+func (g *gossipKV) decodeRing(key string, value []byte) (*Desc, bool) {
+	codec, ok := g.codecs[key]
+	if !ok || value == nil {
+		return nil, false
+	}
+	out, err := codec.Decode(value)
+	if err != nil {
+		return nil, false
+	}
+	desc, ok := out.(*Desc)
+	return desc, ok && desc != nil
+}
+
+// noteRemovals records the ingesters a local write removed from a ring.
+// Must be called with the lock held.
+func (g *gossipKV) noteRemovals(key string, old, new []byte) {
+	before, ok := g.decodeRing(key, old)
+	if !ok {
+		return
+	}
+	after, ok := g.decodeRing(key, new)
+	if !ok {
+		return
+	}
+	now := time.Now().Unix()
+	for id := range before.Ingesters {
+		if _, ok := after.Ingesters[id]; !ok {
+			if g.removed[key] == nil {
+				g.removed[key] = map[string]int64{}
+			}
+			g.removed[key][id] = now
+		}
+	}
+}
+
+// mergeRemovals adds a peer's removals of ingesters from key's ring to ours,
+// and forgets those older than the tombstone TTL.  Must be called with the
+// lock held.
+func (g *gossipKV) mergeRemovals(key string, remote map[string]int64) map[string]int64 {
+	removed := g.removed[key]
+	if removed == nil {
+		removed = map[string]int64{}
+	}
+	for id, t := range remote {
+		if t > removed[id] {
+			removed[id] = t
+		}
+	}
+	expired := time.Now().Add(-g.cfg.TombstoneTTL).Unix()
+	for id, t := range removed {
+		if t < expired {
+			delete(removed, id)
+		}
+	}
+	g.removed[key] = removed
+	return removed
+}
+
+// state returns all the local values and their versions.
+func (g *gossipKV) state() map[string]gossipEntry {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.memoryKV.mtx.Lock()
+	defer g.memoryKV.mtx.Unlock()
+
+	result := make(map[string]gossipEntry, len(g.versions))
+	for key, version := range g.versions {
+		if kvp, ok := g.memoryKV.kvps[key]; ok {
+			removed := make(map[string]int64, len(g.removed[key]))
+			for id, t := range g.removed[key] {
+				removed[id] = t
+			}
+			result[key] = gossipEntry{gossipVersion: version, Value: kvp.Value, Removed: removed}
+		}
+	}
+	return result
+}
+
+// merge stores the values from a peer: rings are merged with ours, other
+// values replace ours if they're newer.
+func (g *gossipKV) merge(remote map[string]gossipEntry) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for key, entry := range remote {
+		if entry.Version > g.clock {
+			g.clock = entry.Version
+		}
+		removed := g.mergeRemovals(key, entry.Removed)
+		local, ok := g.versions[key]
+		if ok && g.mergeRing(key, entry, local, removed) {
+			continue
+		}
+		if ok && !entry.after(local) {
+			continue
+		}
+		if _, err := g.memoryKV.Put(&consul.KVPair{Key: key, Value: entry.Value}, nil); err != nil {
+			log.Errorf("Error storing gossiped value for %s: %v", key, err)
+			continue
+		}
+		g.versions[key] = entry.gossipVersion
+	}
+}
+
+// mergeRing merges a peer's ring into ours, returning false if key's values
+// aren't rings.  A merge which makes ours different from both is a new
+// version.  Must be called with the lock held.
+func (g *gossipKV) mergeRing(key string, entry gossipEntry, local gossipVersion, removed map[string]int64) bool {
+	value := g.value(key)
+	ours, ok := g.decodeRing(key, value)
+	if !ok {
+		return false
+	}
+	theirs, ok := g.decodeRing(key, entry.Value)
+	if !ok {
+		return false
+	}
+	merged, _ := g.decodeRing(key, value)
+	merged.merge(theirs, removed)
+
+	switch {
+	case merged.Equal(theirs) && entry.after(local):
+		if _, err := g.memoryKV.Put(&consul.KVPair{Key: key, Value: entry.Value}, nil); err != nil {
+			log.Errorf("Error storing gossiped value for %s: %v", key, err)
+			return true
+		}
+		g.versions[key] = entry.gossipVersion
+	case merged.Equal(ours):
+	default:
+		buf, err := g.codecs[key].Encode(merged)
+		if err != nil {
+			log.Errorf("Error encoding merged value for %s: %v", key, err)
+			return true
+		}
+		if _, err := g.memoryKV.Put(&consul.KVPair{Key: key, Value: buf}, nil); err != nil {
+			log.Errorf("Error storing merged value for %s: %v", key, err)
+			return true
+		}
+		g.bump(key)
+	}
+	return true
+}
+
+// ServeHTTP merges the values pushed by a peer, and replies with ours.
+func (g *gossipKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "gossip must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	var remote map[string]gossipEntry
+	if err := json.NewDecoder(r.Body).Decode(&remote); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.merge(remote)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(g.state()); err != nil {
+		log.Errorf("Error writing gossip response: %v", err)
+	}
+}
+
+func (g *gossipKV) loop() {
+	for range time.Tick(g.cfg.Interval) {
+		addr, err := g.randomPeer()
+		if err != nil {
+			log.Warnf("Error finding gossip peer: %v", err)
+			gossipRounds.WithLabelValues("error").Inc()
+			continue
+		}
+		if addr == "" {
+			continue
+		}
+		if err := g.exchange(addr); err != nil {
+			log.Warnf("Error gossiping with %s: %v", addr, err)
+			gossipRounds.WithLabelValues("error").Inc()
+			continue
+		}
+		gossipRounds.WithLabelValues("success").Inc()
+	}
+}
+
+// randomPeer resolves the configured peers and picks one of their addresses.
+func (g *gossipKV) randomPeer() (string, error) {
+	var addrs []string
+	for _, peer := range strings.Split(g.cfg.Peers, ",") {
+		peer = strings.TrimSpace(peer)
+		if peer == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(peer)
+		if err != nil {
+			return "", err
+		}
+		ips, err := net.LookupHost(host)
+		if err != nil {
+			return "", err
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+	if len(addrs) == 0 {
+		return "", nil
+	}
+	return addrs[rand.Intn(len(addrs))], nil
+}
+
+// exchange pushes our values to a peer and merges the peer's values.
+func (g *gossipKV) exchange(addr string) error {
+	buf, err := json.Marshal(g.state())
+	if err != nil {
+		return err
+	}
+	resp, err := g.client.Post(fmt.Sprintf("http://%s%s", addr, gossipPath), "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var remote map[string]gossipEntry
+	if err := json.NewDecoder(resp.Body).Decode(&remote); err != nil {
+		return err
+	}
+	g.merge(remote)
+	return nil
+}
@@ -0,0 +1,153 @@
+package ring
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestGossipConverges(t *testing.T) {
+	cfg := GossipConfig{Interval: time.Second, Timeout: time.Second, TombstoneTTL: time.Hour}
+	codec := ProtoCodec{Factory: ProtoDescFactory}
+	a, b := newGossipKV(cfg), newGossipKV(cfg)
+	a.node, b.node = "a", "b"
+	clientA := &consulClient{kv: a, codec: codec}
+	clientB := &consulClient{kv: b, codec: codec}
+
+	server := httptest.NewServer(b)
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	addIngester := func(c ConsulClient, id string) {
+		err := c.CAS(ConsulKey, func(in interface{}) (interface{}, bool, error) {
+			desc, ok := in.(*Desc)
+			if !ok || desc == nil {
+				desc = NewDesc()
+			}
+			desc.AddIngester(id, "addr-"+id, "", "", nil, ACTIVE)
+			return desc, true, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ingesters := func(c ConsulClient) map[string]struct{} {
+		value, err := c.Get(ConsulKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := map[string]struct{}{}
+		for id := range value.(*Desc).Ingesters {
+			result[id] = struct{}{}
+		}
+		return result
+	}
+
+	// A's write reaches B.
+	addIngester(clientA, "1")
+	if err := a.exchange(addr); err != nil {
+		t.Fatal(err)
+	}
+	if got := ingesters(clientB); len(got) != 1 {
+		t.Fatalf("expected B to have A's ingester, got %v", got)
+	}
+
+	// B builds on it, and its later write wins on both.
+	addIngester(clientB, "2")
+	if err := a.exchange(addr); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []ConsulClient{clientA, clientB} {
+		if got := ingesters(c); len(got) != 2 {
+			t.Fatalf("expected both ingesters, got %v", got)
+		}
+	}
+
+	// Stale values from a peer don't overwrite newer local ones.
+	stale := a.state()
+	addIngester(clientB, "3")
+	b.merge(stale)
+	if got := ingesters(clientB); len(got) != 3 {
+		t.Fatalf("stale gossip overwrote newer value: %v", got)
+	}
+
+	// Concurrent writes on both are merged, on both.
+	addIngester(clientA, "4")
+	addIngester(clientB, "5")
+	for i := 0; i < 2; i++ {
+		if err := a.exchange(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []ConsulClient{clientA, clientB} {
+		if got := ingesters(c); len(got) != 5 {
+			t.Fatalf("expected all 5 ingesters, got %v", got)
+		}
+	}
+
+	// Removed ingesters aren't brought back by peers which still have them.
+	stale = b.state()
+	err := clientA.CAS(ConsulKey, func(in interface{}) (interface{}, bool, error) {
+		desc := in.(*Desc)
+		desc.RemoveIngester("1")
+		return desc, true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.merge(stale)
+	if err := a.exchange(addr); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []ConsulClient{clientA, clientB} {
+		if got := ingesters(c); len(got) != 4 {
+			t.Fatalf("expected removed ingester to stay removed, got %v", got)
+		}
+	}
+}
+
+func TestDescMerge(t *testing.T) {
+	a, b := NewDesc(), NewDesc()
+	a.AddIngester("1", "addr-1", "", "", []uint32{1, 2}, ACTIVE)
+	b.AddIngester("2", "addr-2", "", "", []uint32{3}, ACTIVE)
+	a.Ingesters["1"].Timestamp, b.Ingesters["2"].Timestamp = 10, 10
+	b.AddIngester("1", "addr-1", "", "", []uint32{4}, LEAVING)
+	b.Ingesters["1"].Timestamp = 11
+
+	ab, ba := proto.Clone(a).(*Desc), proto.Clone(b).(*Desc)
+	ab.merge(b, nil)
+	ba.merge(a, nil)
+	if !ab.Equal(ba) {
+		t.Fatalf("merges differ: %v, %v", ab, ba)
+	}
+	if ab.Ingesters["1"].State != LEAVING {
+		t.Errorf("expected the later heartbeat of ingester 1, got %v", ab.Ingesters["1"])
+	}
+	if mine, _ := ab.TokensFor("1"); len(mine) != 1 || mine[0] != 4 {
+		t.Errorf("expected ingester 1's tokens from its later heartbeat, got %v", mine)
+	}
+
+	ab.merge(a, map[string]int64{"2": 10})
+	if _, ok := ab.Ingesters["2"]; ok {
+		t.Errorf("expected removed ingester to be dropped, got %v", ab)
+	}
+}
+
+func TestGossipVersionOrder(t *testing.T) {
+	for _, tc := range []struct {
+		a, b  gossipVersion
+		after bool
+	}{
+		{gossipVersion{2, "a"}, gossipVersion{1, "b"}, true},
+		{gossipVersion{1, "b"}, gossipVersion{2, "a"}, false},
+		{gossipVersion{1, "b"}, gossipVersion{1, "a"}, true},
+		{gossipVersion{1, "a"}, gossipVersion{1, "a"}, false},
+	} {
+		if got := tc.a.after(tc.b); got != tc.after {
+			t.Errorf("%v after %v: expected %v, got %v", tc.a, tc.b, tc.after, got)
+		}
+	}
+}
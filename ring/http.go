@@ -9,7 +9,9 @@ import (
 	"time"
 
 	"github.com/golang/protobuf/proto"
-	"github.com/prometheus/common/log"
+
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 const tpl = `
@@ -30,7 +32,10 @@ const tpl = `
 						<th>Ingester</th>
 						<th>State</th>
 						<th>Address</th>
+						<th>Zone</th>
+						<th>Host</th>
 						<th>Last Heartbeat</th>
+						<th>Heartbeat Age</th>
 						<th>Tokens</th>
 						<th>Ownership</th>
 						<th>Actions</th>
@@ -42,14 +47,18 @@ const tpl = `
 						<td>{{ .ID }}</td>
 						<td>{{ .State }}</td>
 						<td>{{ .Address }}</td>
+						<td>{{ .Zone }}</td>
+						<td>{{ .Host }}</td>
 						<td>{{ .Timestamp }}</td>
+						<td>{{ .HeartbeatAge }}</td>
 						<td>{{ .Tokens }}</td>
 						<td>{{ .Ownership }}%</td>
-						<td><button name="forget" value="{{ .ID }}" type="submit">Forget</button></td>
+						<td>{{ if .Forgettable }}<button name="forget" value="{{ .ID }}" type="submit" onclick="return confirm('Forget ingester ' + {{ .ID }} + '? Its tokens will be removed from the ring.')">Forget</button>{{ end }}</td>
 					</tr>
 					{{ end }}
 				</tbody>
 			</table>
+			<p>Also available as <a href="?format=json">JSON</a>.</p>
 			<pre>{{ .Ring }}</pre>
 		</form>
 	</body>
@@ -65,31 +74,114 @@ func init() {
 	}
 }
 
-func (r *Ring) forget(id string) error {
+// IngesterStatus is the status of an ingester in the ring, as shown on the
+// ring status page.
+type IngesterStatus struct {
+	ID                  string    `json:"id"`
+	State               string    `json:"state"`
+	Address             string    `json:"address"`
+	Zone                string    `json:"zone,omitempty"`
+	Host                string    `json:"host,omitempty"`
+	Timestamp           time.Time `json:"timestamp"`
+	HeartbeatAgeSeconds float64   `json:"heartbeat_age_seconds"`
+	Tokens              uint32    `json:"tokens"`
+	Ownership           float64   `json:"ownership_percent"`
+}
+
+// HeartbeatAge is the time since the ingester last heartbeated, to the second.
+func (s IngesterStatus) HeartbeatAge() time.Duration {
+	return time.Duration(s.HeartbeatAgeSeconds) * time.Second
+}
+
+// Forgettable is whether the ingester can be forgotten without forcing it.
+func (s IngesterStatus) Forgettable() bool {
+	return s.State == unhealthy
+}
+
+var (
+	errIngesterNotFound = fmt.Errorf("ingester not found in the ring")
+	errIngesterHealthy  = fmt.Errorf("ingester is still heartbeating; only unhealthy ingesters can be forgotten without force=true")
+)
+
+// forget removes the ingester and its tokens from the ring.  Unless forced,
+// it has to have stopped heartbeating, so a live ingester isn't forgotten by
+// mistake.
+func (r *Ring) forget(id string, force bool) error {
 	unregister := func(in interface{}) (out interface{}, retry bool, err error) {
 		if in == nil {
 			return nil, false, fmt.Errorf("found empty ring when trying to unregister")
 		}
 
 		ringDesc := in.(*Desc)
+		ing, ok := ringDesc.Ingesters[id]
+		if !ok {
+			return nil, false, errIngesterNotFound
+		}
+		if !force && time.Now().Sub(time.Unix(ing.Timestamp, 0)) <= r.heartbeatTimeout {
+			return nil, false, errIngesterHealthy
+		}
 		ringDesc.RemoveIngester(id)
 		return ringDesc, true, nil
 	}
-	return r.consul.CAS(ConsulKey, unregister)
+	return r.consul.CAS(r.key, unregister)
 }
 
 func (r *Ring) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.Method == http.MethodPost {
 		ingesterID := req.FormValue("forget")
-		if err := r.forget(ingesterID); err != nil {
-			log.Errorf("Error forgetting ingester: %v", err)
+		if err := r.forget(ingesterID, req.FormValue("force") == "true"); err != nil {
+			log.Errorf("Error forgetting ingester %s: %v", ingesterID, err)
+			switch err {
+			case errIngesterNotFound:
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case errIngesterHealthy:
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		log.Infof("Forgot ingester %s", ingesterID)
+
+		if req.FormValue("format") == "json" {
+			w.WriteHeader(http.StatusNoContent)
+			return
 		}
 
 		// Implement PRG pattern to prevent double-POST and work with CSRF middleware.
 		// https://en.wikipedia.org/wiki/Post/Redirect/Get
 		http.Redirect(w, req, req.RequestURI, http.StatusFound)
+		return
+	}
+
+	now := time.Now()
+	ingesters, ring := r.status(now)
+
+	if req.FormValue("format") == "json" {
+		util.WriteJSONResponse(w, struct {
+			Now       time.Time        `json:"now"`
+			Ingesters []IngesterStatus `json:"ingesters"`
+		}{now, ingesters})
+		return
 	}
 
+	if err := tmpl.Execute(w, struct {
+		Ingesters []IngesterStatus
+		Now       time.Time
+		Ring      string
+	}{
+		Ingesters: ingesters,
+		Now:       now,
+		Ring:      ring,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// status returns the status of each ingester, sorted by ID, and the ring
+// as text.
+func (r *Ring) status(now time.Time) ([]IngesterStatus, string) {
 	r.mtx.RLock()
 	defer r.mtx.RUnlock()
 
@@ -99,8 +191,7 @@ func (r *Ring) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	sort.Strings(ingesterIDs)
 
-	now := time.Now()
-	ingesters := []interface{}{}
+	ingesters := []IngesterStatus{}
 	tokens, owned := countTokens(r.ringDesc.Tokens)
 	for _, id := range ingesterIDs {
 		ing := r.ringDesc.Ingesters[id]
@@ -110,30 +201,17 @@ func (r *Ring) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			state = unhealthy
 		}
 
-		ingesters = append(ingesters, struct {
-			ID, State, Address, Timestamp string
-			Tokens                        uint32
-			Ownership                     float64
-		}{
-			ID:        id,
-			State:     state,
-			Address:   ing.Addr,
-			Timestamp: timestamp.String(),
-			Tokens:    tokens[id],
-			Ownership: (float64(owned[id]) / float64(math.MaxUint32)) * 100,
+		ingesters = append(ingesters, IngesterStatus{
+			ID:                  id,
+			State:               state,
+			Address:             ing.Addr,
+			Zone:                ing.Zone,
+			Host:                ing.Host,
+			Timestamp:           timestamp,
+			HeartbeatAgeSeconds: math.Floor(now.Sub(timestamp).Seconds()),
+			Tokens:              tokens[id],
+			Ownership:           (float64(owned[id]) / float64(math.MaxUint32)) * 100,
 		})
 	}
-
-	if err := tmpl.Execute(w, struct {
-		Ingesters []interface{}
-		Now       time.Time
-		Ring      string
-	}{
-		Ingesters: ingesters,
-		Now:       time.Now(),
-		Ring:      proto.MarshalTextString(r.ringDesc),
-	}); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	return ingesters, proto.MarshalTextString(r.ringDesc)
 }
@@ -0,0 +1,90 @@
+package ring
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRingStatus(t *testing.T) {
+	desc := NewDesc()
+	desc.AddIngester("a", "addr-a", "", "", []uint32{100, math.MaxUint32 / 2}, ACTIVE)
+	desc.AddIngester("b", "addr-b", "", "", []uint32{math.MaxUint32 / 4}, ACTIVE)
+	desc.Ingesters["b"].Timestamp = time.Now().Add(-10 * time.Minute).Unix()
+	r := Ring{ringDesc: desc, heartbeatTimeout: time.Minute}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/ring?format=json", nil))
+	var status struct {
+		Ingesters []IngesterStatus `json:"ingesters"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Ingesters) != 2 {
+		t.Fatalf("expected 2 ingesters, got %v", status.Ingesters)
+	}
+	a, b := status.Ingesters[0], status.Ingesters[1]
+	if a.ID != "a" || a.State != ACTIVE.String() || a.Tokens != 2 || a.HeartbeatAgeSeconds > 1 {
+		t.Fatalf("unexpected status %+v", a)
+	}
+	if b.ID != "b" || b.State != unhealthy || b.HeartbeatAgeSeconds < 599 || b.HeartbeatAgeSeconds > 601 {
+		t.Fatalf("unexpected status %+v", b)
+	}
+	if total := a.Ownership + b.Ownership; math.Abs(total-100) > 0.01 {
+		t.Fatalf("expected ownership to add up to 100%%, got %f", total)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/ring", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "Heartbeat Age") || !strings.Contains(body, "10m0s") {
+		t.Fatalf("unexpected page %s", body)
+	}
+}
+
+func TestRingForget(t *testing.T) {
+	client := NewInMemoryConsulClient(ProtoCodec{Factory: ProtoDescFactory})
+	err := client.CAS(ConsulKey, func(in interface{}) (interface{}, bool, error) {
+		desc := NewDesc()
+		desc.AddIngester("live", "addr-live", "", "", []uint32{1}, ACTIVE)
+		desc.AddIngester("dead", "addr-dead", "", "", []uint32{2}, ACTIVE)
+		desc.Ingesters["dead"].Timestamp = time.Now().Add(-time.Hour).Unix()
+		return desc, true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Ring{consul: client, key: ConsulKey, heartbeatTimeout: time.Minute}
+
+	forget := func(query string) int {
+		req := httptest.NewRequest("POST", "/ring?format=json&"+query, nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for _, tc := range []struct {
+		query    string
+		expected int
+	}{
+		{"forget=unknown", http.StatusNotFound},
+		{"forget=live", http.StatusConflict},
+		{"forget=dead", http.StatusNoContent},
+		{"forget=live&force=true", http.StatusNoContent},
+	} {
+		if code := forget(tc.query); code != tc.expected {
+			t.Fatalf("%s: expected status %d, got %d", tc.query, tc.expected, code)
+		}
+	}
+
+	value, err := client.Get(ConsulKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc := value.(*Desc); len(desc.Ingesters) != 0 || len(desc.Tokens) != 0 {
+		t.Fatalf("expected an empty ring, got %v", desc)
+	}
+}
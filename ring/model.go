@@ -1,6 +1,7 @@
 package ring
 
 import (
+	"fmt"
 	"sort"
 	"time"
 
@@ -27,7 +28,7 @@ func NewDesc() *Desc {
 }
 
 // AddIngester adds the given ingester to the ring.
-func (d *Desc) AddIngester(id, addr string, tokens []uint32, state IngesterState) {
+func (d *Desc) AddIngester(id, addr, zone, host string, tokens []uint32, state IngesterState) {
 	if d.Ingesters == nil {
 		d.Ingesters = map[string]*IngesterDesc{}
 	}
@@ -35,6 +36,8 @@ func (d *Desc) AddIngester(id, addr string, tokens []uint32, state IngesterState
 		Addr:      addr,
 		Timestamp: time.Now().Unix(),
 		State:     state,
+		Zone:      zone,
+		Host:      host,
 	}
 
 	for _, token := range tokens {
@@ -96,6 +99,38 @@ func (d *Desc) Ready(heartbeatTimeout time.Duration) bool {
 	return len(d.Tokens) > 0
 }
 
+// PlacementError is returned by CheckPlacement when an ingester would share
+// its host with another.
+type PlacementError struct {
+	ID, OtherID, Zone, Host string
+}
+
+func (e PlacementError) Error() string {
+	return fmt.Sprintf("ingester %s is on the same host (zone %q, host %q) as ingester %s; refusing to become ACTIVE as replicas could be lost together", e.ID, e.Zone, e.Host, e.OtherID)
+}
+
+// CheckPlacement returns a PlacementError if an ingester in the given zone
+// and host would share that host with another healthy ingester in the ring.
+// Replicas are placed on distinct ingesters, not distinct hosts, so two
+// ingesters on the same host could hold every replica of some series.
+// Ingesters which are leaving, or haven't heartbeated within the timeout,
+// e.g. the one being replaced on that host, don't count.
+func (d *Desc) CheckPlacement(id, zone, host string, heartbeatTimeout time.Duration) error {
+	if host == "" {
+		return nil
+	}
+	now := time.Now()
+	for otherID, ing := range d.Ingesters {
+		if otherID == id || ing.State == LEAVING || now.Sub(time.Unix(ing.Timestamp, 0)) > heartbeatTimeout {
+			continue
+		}
+		if ing.Zone == zone && ing.Host == host {
+			return PlacementError{ID: id, OtherID: otherID, Zone: zone, Host: host}
+		}
+	}
+	return nil
+}
+
 // TokensFor partitions the tokens into those for the given ID, and those for others.
 func (d *Desc) TokensFor(id string) (tokens, other []uint32) {
 	var takenTokens, myTokens []uint32
@@ -107,3 +142,69 @@ func (d *Desc) TokensFor(id string) (tokens, other []uint32) {
 	}
 	return myTokens, takenTokens
 }
+
+// merge merges other, a version of the ring written concurrently with d,
+// into d.  Each ingester, and the tokens it owns, come from the version it
+// heartbeat last in; a token owned by different ingesters in each version
+// goes to the one which heartbeat last.  Ingesters removed since their last
+// heartbeat, as of the Unix times in removed, are dropped.  The result
+// doesn't depend on which of the versions is d.
+func (d *Desc) merge(other *Desc, removed map[string]int64) {
+	if d.Ingesters == nil {
+		d.Ingesters = map[string]*IngesterDesc{}
+	}
+	mine, theirs := d.tokensByIngester(), other.tokensByIngester()
+	tokens := map[string][]uint32{}
+	for id := range d.Ingesters {
+		tokens[id] = mine[id]
+	}
+	for id, ing := range other.Ingesters {
+		if local, ok := d.Ingesters[id]; !ok || newerIngester(ing, theirs[id], local, mine[id]) {
+			d.Ingesters[id] = ing
+			tokens[id] = theirs[id]
+		}
+	}
+	for id, ing := range d.Ingesters {
+		if t, ok := removed[id]; ok && ing.Timestamp <= t {
+			delete(d.Ingesters, id)
+			delete(tokens, id)
+		}
+	}
+
+	owners := map[uint32]string{}
+	for id, ts := range tokens {
+		for _, token := range ts {
+			owner, ok := owners[token]
+			if !ok || d.Ingesters[id].Timestamp > d.Ingesters[owner].Timestamp ||
+				(d.Ingesters[id].Timestamp == d.Ingesters[owner].Timestamp && id > owner) {
+				owners[token] = id
+			}
+		}
+	}
+	d.Tokens = make([]*TokenDesc, 0, len(owners))
+	for token, id := range owners {
+		d.Tokens = append(d.Tokens, &TokenDesc{Token: token, Ingester: id})
+	}
+	sort.Sort(ByToken(d.Tokens))
+}
+
+func (d *Desc) tokensByIngester() map[string][]uint32 {
+	result := map[string][]uint32{}
+	for _, token := range d.Tokens {
+		result[token.Ingester] = append(result[token.Ingester], token.Token)
+	}
+	return result
+}
+
+// newerIngester is true if a, owning aTokens, is a later heartbeat of an
+// ingester than b, owning bTokens.  Ties are broken on the descriptors'
+// contents, so all processes merge the same way.
+func newerIngester(a *IngesterDesc, aTokens []uint32, b *IngesterDesc, bTokens []uint32) bool {
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp > b.Timestamp
+	}
+	if a.String() != b.String() {
+		return a.String() > b.String()
+	}
+	return fmt.Sprint(aTokens) > fmt.Sprint(bTokens)
+}
@@ -0,0 +1,303 @@
+package ring
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+const (
+	multiStore = "multi"
+
+	// Indexes returned by the multi store are tagged with the number of
+	// times the primary has been switched in their top bits, so indexes from
+	// the previous primary are never mistaken for the current one's.
+	multiEpochShift = 48
+	multiIndexMask  = 1<<multiEpochShift - 1
+)
+
+var (
+	multiMirrorWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cortex_multikv_mirror_writes_total",
+		Help: "The total number of writes mirrored to the secondary KV store, by result.",
+	}, []string{"result"})
+	multiPrimaryStore = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cortex_multikv_primary_store",
+		Help: "Whether each KV store is the primary of the multi KV store.",
+	}, []string{"store"})
+)
+
+func init() {
+	prometheus.MustRegister(multiMirrorWrites)
+	prometheus.MustRegister(multiPrimaryStore)
+}
+
+// MultiConfig configures the multi KV store, which reads and writes a
+// primary store and mirrors writes to a secondary store, so the ring can be
+// migrated between stores without downtime: mirror to the new store, switch
+// primaries at runtime on every process, then move to the new store alone.
+type MultiConfig struct {
+	Primary       string
+	Secondary     string
+	MirrorEnabled bool
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *MultiConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Primary, "multi.primary", "", "Primary store of the multi KV store: consul, etcd or gossip.")
+	f.StringVar(&cfg.Secondary, "multi.secondary", "", "Secondary store of the multi KV store: consul, etcd or gossip.")
+	f.BoolVar(&cfg.MirrorEnabled, "multi.mirror-enabled", true, "Mirror writes to the secondary store of the multi KV store.")
+}
+
+// multiKV implements the kv interface on top of two other stores.
+type multiKV struct {
+	mtx       sync.RWMutex
+	stores    [2]kv
+	names     [2]string
+	primary   int
+	epoch     uint64
+	mirroring bool
+}
+
+// All the multi KV stores in this process, so they can be switched together.
+var multiKVs struct {
+	sync.Mutex
+	stores []*multiKV
+}
+
+func newMultiKV(cfg ConsulConfig) (*multiKV, error) {
+	if cfg.Multi.Primary == cfg.Multi.Secondary {
+		return nil, fmt.Errorf("the multi store needs different primary and secondary stores, got %q", cfg.Multi.Primary)
+	}
+	m := &multiKV{
+		names:     [2]string{cfg.Multi.Primary, cfg.Multi.Secondary},
+		mirroring: cfg.Multi.MirrorEnabled,
+	}
+	for i, store := range m.names {
+		if store == multiStore {
+			return nil, fmt.Errorf("the multi store can't be nested")
+		}
+		var err error
+		if m.stores[i], err = newKV(cfg, store); err != nil {
+			return nil, err
+		}
+	}
+	m.updateMetrics()
+
+	multiKVs.Lock()
+	defer multiKVs.Unlock()
+	multiKVs.stores = append(multiKVs.stores, m)
+	return m, nil
+}
+
+func (m *multiKV) current() (primary, secondary kv, epoch uint64, mirroring bool) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.stores[m.primary], m.stores[1-m.primary], m.epoch, m.mirroring
+}
+
+// setPrimary switches to the named store, and sets whether writes are
+// mirrored to the other.
+func (m *multiKV) setPrimary(name string, mirroring bool) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	primary := -1
+	for i := range m.names {
+		if m.names[i] == name {
+			primary = i
+		}
+	}
+	if primary < 0 {
+		return fmt.Errorf("unknown store %q; expected %s or %s", name, m.names[0], m.names[1])
+	}
+	if primary != m.primary {
+		log.Infof("Switching primary KV store from %s to %s", m.names[m.primary], name)
+		m.primary = primary
+		m.epoch++
+	}
+	m.mirroring = mirroring
+	m.updateMetricsLocked()
+	return nil
+}
+
+func (m *multiKV) updateMetrics() {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	m.updateMetricsLocked()
+}
+
+func (m *multiKV) updateMetricsLocked() {
+	for i, name := range m.names {
+		value := 0.0
+		if i == m.primary {
+			value = 1
+		}
+		multiPrimaryStore.WithLabelValues(name).Set(value)
+	}
+}
+
+func tagIndex(epoch, index uint64) uint64 {
+	if index == 0 {
+		return 0
+	}
+	return epoch<<multiEpochShift | index&multiIndexMask
+}
+
+// untagIndex returns the primary's index, and whether it's from the current
+// primary.
+func untagIndex(epoch, index uint64) (uint64, bool) {
+	if index == 0 {
+		return 0, true
+	}
+	if index>>multiEpochShift != epoch {
+		return 0, false
+	}
+	return index & multiIndexMask, true
+}
+
+func tagPair(epoch uint64, kvp *consul.KVPair) *consul.KVPair {
+	if kvp == nil {
+		return nil
+	}
+	result := *kvp
+	result.CreateIndex = tagIndex(epoch, kvp.CreateIndex)
+	result.ModifyIndex = tagIndex(epoch, kvp.ModifyIndex)
+	return &result
+}
+
+// queryOptions translates a query to the current primary.  A wait index from
+// a previous primary makes it return straight away, with the new index.
+func (m *multiKV) queryOptions(epoch uint64, q *consul.QueryOptions) *consul.QueryOptions {
+	if q == nil {
+		return nil
+	}
+	result := *q
+	result.WaitIndex, _ = untagIndex(epoch, q.WaitIndex)
+	return &result
+}
+
+func (m *multiKV) mirror(secondary kv, p *consul.KVPair) {
+	if _, err := secondary.Put(&consul.KVPair{Key: p.Key, Value: p.Value}, nil); err != nil {
+		log.Warnf("Error mirroring %s to the secondary KV store: %v", p.Key, err)
+		multiMirrorWrites.WithLabelValues("error").Inc()
+		return
+	}
+	multiMirrorWrites.WithLabelValues("success").Inc()
+}
+
+// useCodec passes the codec of key on to both stores.
+func (m *multiKV) useCodec(key string, codec Codec) {
+	for _, store := range m.stores {
+		if u, ok := store.(codecUser); ok {
+			u.useCodec(key, codec)
+		}
+	}
+}
+
+// Get implements kv.
+func (m *multiKV) Get(key string, q *consul.QueryOptions) (*consul.KVPair, *consul.QueryMeta, error) {
+	primary, _, epoch, _ := m.current()
+	kvp, meta, err := primary.Get(key, m.queryOptions(epoch, q))
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta != nil {
+		result := *meta
+		result.LastIndex = tagIndex(epoch, meta.LastIndex)
+		meta = &result
+	}
+	return tagPair(epoch, kvp), meta, nil
+}
+
+// List implements kv.
+func (m *multiKV) List(prefix string, q *consul.QueryOptions) (consul.KVPairs, *consul.QueryMeta, error) {
+	primary, _, epoch, _ := m.current()
+	kvps, meta, err := primary.List(prefix, m.queryOptions(epoch, q))
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta != nil {
+		result := *meta
+		result.LastIndex = tagIndex(epoch, meta.LastIndex)
+		meta = &result
+	}
+	result := make(consul.KVPairs, 0, len(kvps))
+	for _, kvp := range kvps {
+		result = append(result, tagPair(epoch, kvp))
+	}
+	return result, meta, nil
+}
+
+// Put implements kv.
+func (m *multiKV) Put(p *consul.KVPair, q *consul.WriteOptions) (*consul.WriteMeta, error) {
+	primary, secondary, _, mirroring := m.current()
+	meta, err := primary.Put(p, q)
+	if err == nil && mirroring {
+		m.mirror(secondary, p)
+	}
+	return meta, err
+}
+
+// CAS implements kv.  A CAS based on a read from a previous primary fails,
+// so the caller reads the value again from the current one.
+func (m *multiKV) CAS(p *consul.KVPair, q *consul.WriteOptions) (bool, *consul.WriteMeta, error) {
+	primary, secondary, epoch, mirroring := m.current()
+	index, ok := untagIndex(epoch, p.ModifyIndex)
+	if !ok {
+		return false, nil, nil
+	}
+	untagged := *p
+	untagged.ModifyIndex = index
+	ok, meta, err := primary.CAS(&untagged, q)
+	if ok && err == nil && mirroring {
+		m.mirror(secondary, p)
+	}
+	return ok, meta, err
+}
+
+// MultiKVHandler shows the primary store of this process' multi KV stores
+// on GET, and on POST switches them to the store in the "primary" form
+// value, mirroring writes to the other unless "mirror" is false.
+func MultiKVHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		multiKVs.Lock()
+		stores := append([]*multiKV(nil), multiKVs.stores...)
+		multiKVs.Unlock()
+		if len(stores) == 0 {
+			http.Error(w, "the multi KV store is not in use", http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+		case "POST":
+			mirroring := r.FormValue("mirror") != "false"
+			for _, m := range stores {
+				if err := m.setPrimary(r.FormValue("primary"), mirroring); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		m := stores[0]
+		m.mtx.RLock()
+		status := struct {
+			Primary   string `json:"primary"`
+			Secondary string `json:"secondary"`
+			Mirroring bool   `json:"mirroring"`
+		}{m.names[m.primary], m.names[1-m.primary], m.mirroring}
+		m.mtx.RUnlock()
+		util.WriteJSONResponse(w, status)
+	})
+}
@@ -0,0 +1,125 @@
+package ring
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+func newTestMultiKV() (*multiKV, *memoryKV, *memoryKV) {
+	a, b := newMemoryKV(), newMemoryKV()
+	m := &multiKV{
+		stores:    [2]kv{a, b},
+		names:     [2]string{"a", "b"},
+		mirroring: true,
+	}
+	return m, a, b
+}
+
+func TestMultiKV(t *testing.T) {
+	m, a, b := newTestMultiKV()
+	client := &consulClient{kv: m, codec: ProtoCodec{Factory: ProtoDescFactory}}
+
+	addIngester := func(id string) {
+		err := client.CAS(ConsulKey, func(in interface{}) (interface{}, bool, error) {
+			desc, ok := in.(*Desc)
+			if !ok || desc == nil {
+				desc = NewDesc()
+			}
+			desc.AddIngester(id, "addr-"+id, "", "", nil, ACTIVE)
+			return desc, true, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ingesters := func(kv kv) int {
+		c := &consulClient{kv: kv, codec: client.codec}
+		value, err := c.Get(ConsulKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(value.(*Desc).Ingesters)
+	}
+
+	// Writes are mirrored to the secondary.
+	addIngester("1")
+	if n := ingesters(b); n != 1 {
+		t.Fatalf("expected the write to be mirrored, got %d ingesters", n)
+	}
+	kvp, meta, err := m.Get(ConsulKey, &consul.QueryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// After switching, reads and writes go to the new primary, and writes
+	// are mirrored back to the old one.
+	if err := m.setPrimary("b", true); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, err := m.CAS(kvp, nil); ok || err != nil {
+		t.Fatalf("expected a CAS based on the old primary to fail, got %v, %v", ok, err)
+	}
+	addIngester("2")
+	if n := ingesters(a); n != 2 {
+		t.Fatalf("expected the write to be mirrored back, got %d ingesters", n)
+	}
+
+	// A watch from the old primary returns straight away.
+	start := time.Now()
+	_, newMeta, err := m.Get(ConsulKey, &consul.QueryOptions{WaitIndex: meta.LastIndex, WaitTime: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second || newMeta.LastIndex == meta.LastIndex {
+		t.Fatalf("expected a new index straight away, got %d after %v", newMeta.LastIndex, time.Since(start))
+	}
+
+	// Without mirroring, only the primary is written.
+	if err := m.setPrimary("b", false); err != nil {
+		t.Fatal(err)
+	}
+	addIngester("3")
+	if n := ingesters(a); n != 2 {
+		t.Fatalf("expected no mirroring, got %d ingesters", n)
+	}
+	if n := ingesters(m); n != 3 {
+		t.Fatalf("expected 3 ingesters, got %d", n)
+	}
+}
+
+func TestMultiKVHandler(t *testing.T) {
+	m, _, _ := newTestMultiKV()
+	multiKVs.Lock()
+	multiKVs.stores = []*multiKV{m}
+	multiKVs.Unlock()
+	defer func() {
+		multiKVs.Lock()
+		multiKVs.stores = nil
+		multiKVs.Unlock()
+	}()
+
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/multikv", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		MultiKVHandler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := post(url.Values{"primary": {"c"}}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown store to be rejected, got %d", rec.Code)
+	}
+	rec := post(url.Values{"primary": {"b"}, "mirror": {"false"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if body := rec.Body.String(); !strings.Contains(body, `"primary":"b"`) || !strings.Contains(body, `"mirroring":false`) {
+		t.Fatalf("unexpected response %s", body)
+	}
+}
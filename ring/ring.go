@@ -5,13 +5,17 @@ package ring
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"math"
 	"sort"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/events"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 const (
@@ -43,7 +47,8 @@ var ErrEmptyRing = errors.New("empty circle")
 type Config struct {
 	ConsulConfig
 
-	HeartbeatTimeout time.Duration
+	HeartbeatTimeout     time.Duration
+	ZoneAwarenessEnabled bool
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -51,17 +56,38 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	cfg.ConsulConfig.RegisterFlags(f)
 
 	f.DurationVar(&cfg.HeartbeatTimeout, "ring.heartbeat-timeout", time.Minute, "The heartbeat timeout after which ingesters are skipped for reads/writes.")
+	f.BoolVar(&cfg.ZoneAwarenessEnabled, "ring.zone-awareness-enabled", false, "Place the replicas of each key on ingesters in distinct zones. There must be at least as many zones as the replication factor.")
+}
+
+// ReadRing is the read interface to a ring, or to a shuffle shard of one.
+type ReadRing interface {
+	Get(key uint32, n int, op Operation) ([]*IngesterDesc, error)
+	BatchGet(keys []uint32, n int, op Operation) ([][]*IngesterDesc, error)
+	GetAll() []*IngesterDesc
+	ShuffleShard(identifier string, size int) ReadRing
+	ShuffleShardWithLookback(identifier string, size int, lookback time.Duration) (ReadRing, bool)
 }
 
 // Ring holds the information about the members of the consistent hash circle.
 type Ring struct {
 	consul           ConsulClient
+	key              string
 	quit, done       chan struct{}
 	heartbeatTimeout time.Duration
+	zoneAwareness    bool
 
 	mtx      sync.RWMutex
 	ringDesc *Desc
 
+	// Shuffle shards of the current ringDesc, by identifier and size.
+	shardsMtx sync.Mutex
+	shards    map[shardKey]*Ring
+
+	// Whether each ingester can be in shuffle shards, and when that last
+	// changed, as seen by this Ring.  Guarded by mtx.
+	shardable map[string]bool
+	changed   map[string]time.Time
+
 	ingesterOwnershipDesc *prometheus.Desc
 	numIngestersDesc      *prometheus.Desc
 	numTokensDesc         *prometheus.Desc
@@ -69,6 +95,12 @@ type Ring struct {
 
 // New creates a new Ring
 func New(cfg Config) (*Ring, error) {
+	return NewForKey(cfg, ConsulKey)
+}
+
+// NewForKey creates a Ring of the members registered under the given key,
+// for rings of components other than the ingesters.
+func NewForKey(cfg Config, key string) (*Ring, error) {
 	codec := ProtoCodec{Factory: ProtoDescFactory}
 	consul, err := NewConsulClient(cfg.ConsulConfig, codec)
 	if err != nil {
@@ -76,7 +108,9 @@ func New(cfg Config) (*Ring, error) {
 	}
 	r := &Ring{
 		consul:           consul,
+		key:              key,
 		heartbeatTimeout: cfg.HeartbeatTimeout,
+		zoneAwareness:    cfg.ZoneAwarenessEnabled,
 		quit:             make(chan struct{}),
 		done:             make(chan struct{}),
 		ringDesc:         &Desc{},
@@ -108,7 +142,7 @@ func (r *Ring) Stop() {
 
 func (r *Ring) loop() {
 	defer close(r.done)
-	r.consul.WatchKey(ConsulKey, r.quit, func(value interface{}) bool {
+	r.consul.WatchKey(r.key, r.quit, func(value interface{}) bool {
 		if value == nil {
 			log.Infof("Ring doesn't exist in consul yet.")
 			return true
@@ -117,11 +151,49 @@ func (r *Ring) loop() {
 		ringDesc := value.(*Desc)
 		r.mtx.Lock()
 		defer r.mtx.Unlock()
+		recordRingChanges(r.ringDesc, ringDesc)
 		r.ringDesc = ringDesc
+		r.recordShardableChanges(time.Now())
+
+		r.shardsMtx.Lock()
+		r.shards = nil
+		r.shardsMtx.Unlock()
 		return true
 	})
 }
 
+// CheckReady returns an error if the KV store holding the ring can't be
+// read, or the ring has no tokens to route to yet.
+func (r *Ring) CheckReady(ctx context.Context) error {
+	if _, err := r.consul.Get(r.key); err != nil {
+		return fmt.Errorf("error reading the ring: %v", err)
+	}
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if len(r.ringDesc.Tokens) == 0 {
+		return fmt.Errorf("the ring has no tokens yet")
+	}
+	return nil
+}
+
+// recordRingChanges records an event for each ingester which has joined,
+// left or changed state between two versions of the ring.
+func recordRingChanges(old, new *Desc) {
+	for id, ing := range new.Ingesters {
+		oldIng, ok := old.Ingesters[id]
+		if !ok {
+			events.Record("ring", "ingester_added", "Ingester %s (%s) added to ring in state %v", id, ing.Addr, ing.State)
+		} else if oldIng.State != ing.State {
+			events.Record("ring", "ingester_state_change", "Ingester %s (%s) changed state from %v to %v", id, ing.Addr, oldIng.State, ing.State)
+		}
+	}
+	for id, ing := range old.Ingesters {
+		if _, ok := new.Ingesters[id]; !ok {
+			events.Record("ring", "ingester_removed", "Ingester %s (%s) removed from ring", id, ing.Addr)
+		}
+	}
+}
+
 // Get returns n (or more) ingesters which form the replicas for the given key.
 func (r *Ring) Get(key uint32, n int, op Operation) ([]*IngesterDesc, error) {
 	r.mtx.RLock()
@@ -153,6 +225,7 @@ func (r *Ring) getInternal(key uint32, n int, op Operation) ([]*IngesterDesc, er
 
 	ingesters := make([]*IngesterDesc, 0, n)
 	distinctHosts := map[string]struct{}{}
+	distinctZones := map[string]struct{}{}
 	start := r.search(key)
 	iterations := 0
 	for i := start; len(distinctHosts) < n && iterations < len(r.ringDesc.Tokens); i++ {
@@ -165,24 +238,39 @@ func (r *Ring) getInternal(key uint32, n int, op Operation) ([]*IngesterDesc, er
 		if _, ok := distinctHosts[token.Ingester]; ok {
 			continue
 		}
-		distinctHosts[token.Ingester] = struct{}{}
 		ingester := r.ringDesc.Ingesters[token.Ingester]
 
+		// With zone awareness we also want the replicas in distinct zones, so
+		// skip ingesters in a zone we already have a replica in.  Ingesters
+		// without a zone aren't constrained.
+		if r.zoneAwareness && ingester.Zone != "" {
+			if _, ok := distinctZones[ingester.Zone]; ok {
+				continue
+			}
+		}
+		distinctHosts[token.Ingester] = struct{}{}
+
 		// Ingesters that are not ACTIVE do not count to the replication limit. We do
 		// not want to Write to them because they are about to go away, but we do
 		// want to write the extra replica somewhere.  So we increase the size of the
 		// set of replicas for the key.  This means we have to also increase the
-		// size of the replica set for read, but we can read from Leaving ingesters,
-		// so don't skip it in this case.
+		// size of the replica set for read, so reads include both the Leaving
+		// ingester and the one which took its writes.
 		if op == Write && ingester.State != ACTIVE {
 			n++
 			continue
-		} else if op == Read && (ingester.State != ACTIVE && ingester.State != LEAVING) {
+		} else if op == Read && ingester.State != ACTIVE {
 			n++
+			if ingester.State == LEAVING {
+				ingesters = append(ingesters, ingester)
+			}
 			continue
 		}
 
 		ingesters = append(ingesters, ingester)
+		if r.zoneAwareness && ingester.Zone != "" {
+			distinctZones[ingester.Zone] = struct{}{}
+		}
 	}
 	return ingesters, nil
 }
@@ -2,7 +2,10 @@ package ring
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
 	"testing"
+	"time"
 )
 
 const (
@@ -17,7 +20,7 @@ func BenchmarkRing(b *testing.B) {
 	for i := 0; i < numIngester; i++ {
 		tokens := GenerateTokens(numTokens, takenTokens)
 		takenTokens = append(takenTokens, tokens...)
-		desc.AddIngester(fmt.Sprintf("%d", i), fmt.Sprintf("ingester%d", i), tokens, ACTIVE)
+		desc.AddIngester(fmt.Sprintf("%d", i), fmt.Sprintf("ingester%d", i), "", "", tokens, ACTIVE)
 	}
 
 	consul := NewMockConsulClient()
@@ -43,3 +46,223 @@ func BenchmarkRing(b *testing.B) {
 		r.BatchGet(keys, 3, Write)
 	}
 }
+
+func TestCheckPlacement(t *testing.T) {
+	desc := NewDesc()
+	desc.AddIngester("a", "addr-a", "zone-a", "node1", nil, ACTIVE)
+	desc.AddIngester("b", "addr-b", "zone-a", "node2", nil, LEAVING)
+	desc.AddIngester("d", "addr-d", "zone-a", "node3", nil, ACTIVE)
+	desc.Ingesters["d"].Timestamp = time.Now().Add(-2 * time.Minute).Unix()
+
+	for i, tc := range []struct {
+		id, zone, host string
+		ok             bool
+	}{
+		{"a", "zone-a", "node1", true},
+		{"c", "zone-a", "node1", false},
+		{"c", "zone-b", "node1", true},
+		{"c", "zone-a", "node2", true},
+		{"c", "zone-a", "node3", true},
+		{"c", "zone-a", "", true},
+	} {
+		err := desc.CheckPlacement(tc.id, tc.zone, tc.host, time.Minute)
+		if tc.ok && err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+		} else if !tc.ok {
+			if _, ok := err.(PlacementError); !ok {
+				t.Errorf("case %d: expected a PlacementError, got %v", i, err)
+			}
+		}
+	}
+}
+
+func TestGetZoneAware(t *testing.T) {
+	// Two ingesters per zone; without zone awareness the tokens below place
+	// the first two replicas of every key in the same zone.
+	desc := NewDesc()
+	desc.AddIngester("a1", "addr-a1", "zone-a", "", []uint32{10, 50}, ACTIVE)
+	desc.AddIngester("a2", "addr-a2", "zone-a", "", []uint32{20, 60}, ACTIVE)
+	desc.AddIngester("b1", "addr-b1", "zone-b", "", []uint32{30, 70}, ACTIVE)
+	desc.AddIngester("b2", "addr-b2", "zone-b", "", []uint32{31, 71}, ACTIVE)
+	desc.AddIngester("c1", "addr-c1", "zone-c", "", []uint32{40, 80}, ACTIVE)
+	desc.AddIngester("c2", "addr-c2", "zone-c", "", []uint32{41, 81}, LEAVING)
+
+	zones := func(ingesters []*IngesterDesc) map[string]int {
+		result := map[string]int{}
+		for _, ing := range ingesters {
+			result[ing.Zone]++
+		}
+		return result
+	}
+
+	r := Ring{ringDesc: desc}
+	ingesters, err := r.Get(5, 3, Write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if z := zones(ingesters); z["zone-a"] != 2 {
+		t.Fatalf("expected zone unaware ring to place two replicas in zone-a, got %v", z)
+	}
+
+	r.zoneAwareness = true
+	for _, key := range []uint32{0, 15, 25, 35, 45, 55, 65, 75, 85} {
+		for _, op := range []Operation{Read, Write} {
+			ingesters, err := r.Get(key, 3, op)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Reads may also include the LEAVING ingester, on top of the
+			// replicas.
+			active := []*IngesterDesc{}
+			for _, ing := range ingesters {
+				if ing.State == ACTIVE {
+					active = append(active, ing)
+				}
+			}
+			z := zones(active)
+			if len(active) != 3 || len(z) != 3 {
+				t.Errorf("key %d, op %v: expected 3 replicas in 3 zones, got %v", key, op, z)
+			}
+		}
+	}
+}
+
+func TestShuffleShard(t *testing.T) {
+	desc := NewDesc()
+	takenTokens := []uint32{}
+	for i := 0; i < 20; i++ {
+		tokens := GenerateTokens(16, takenTokens)
+		takenTokens = append(takenTokens, tokens...)
+		desc.AddIngester(fmt.Sprintf("ing%d", i), fmt.Sprintf("addr%d", i), "", "", tokens, ACTIVE)
+	}
+	r := Ring{ringDesc: desc, heartbeatTimeout: time.Minute}
+
+	ids := func(ingesters []*IngesterDesc) map[string]struct{} {
+		result := map[string]struct{}{}
+		for _, ing := range ingesters {
+			result[ing.Addr] = struct{}{}
+		}
+		return result
+	}
+
+	shard := r.ShuffleShard("user1", 4)
+	inShard := ids(shard.GetAll())
+	if len(inShard) != 4 {
+		t.Fatalf("expected 4 ingesters in shard, got %d", len(inShard))
+	}
+	for _, key := range GenerateTokens(100, nil) {
+		ingesters, err := shard.Get(key, 3, Write)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for addr := range ids(ingesters) {
+			if _, ok := inShard[addr]; !ok {
+				t.Fatalf("key %d placed on %s, outside the shard", key, addr)
+			}
+		}
+	}
+
+	// Shards are deterministic, even once the cache is dropped.
+	r.shards = nil
+	if again := ids(r.ShuffleShard("user1", 4).GetAll()); !reflect.DeepEqual(inShard, again) {
+		t.Fatalf("shard changed: %v vs %v", inShard, again)
+	}
+
+	// Removing an ingester outside the shard doesn't change it.
+	for id, ing := range desc.Ingesters {
+		if _, ok := inShard[ing.Addr]; !ok {
+			desc.RemoveIngester(id)
+			break
+		}
+	}
+	r.shards = nil
+	if again := ids(r.ShuffleShard("user1", 4).GetAll()); !reflect.DeepEqual(inShard, again) {
+		t.Fatalf("shard changed: %v vs %v", inShard, again)
+	}
+
+	if r.ShuffleShard("user1", 0) != ReadRing(&r) || r.ShuffleShard("user1", 100) != ReadRing(&r) {
+		t.Fatal("expected the whole ring")
+	}
+}
+
+func TestShuffleShardSkipsUnhealthyAndLooksBack(t *testing.T) {
+	desc := NewDesc()
+	for i := 0; i < 10; i++ {
+		desc.AddIngester(fmt.Sprintf("ing%d", i), fmt.Sprintf("addr%d", i), "", "", GenerateTokens(16, nil), ACTIVE)
+	}
+	r := Ring{ringDesc: desc, heartbeatTimeout: time.Minute}
+	r.recordShardableChanges(time.Now())
+	ranked := rankIngesters(desc, "user1")
+
+	check := func(name string, rr ReadRing, expected ...string) {
+		members := []string{}
+		for id := range rr.(*Ring).ringDesc.Ingesters {
+			members = append(members, id)
+		}
+		sort.Strings(members)
+		expected = append([]string(nil), expected...)
+		sort.Strings(expected)
+		if !reflect.DeepEqual(expected, members) {
+			t.Fatalf("%s: expected %v, got %v", name, expected, members)
+		}
+	}
+	checkLookback := func(name string, lookback time.Duration, expectChanged bool, expected ...string) {
+		shard, changed := r.ShuffleShardWithLookback("user1", 3, lookback)
+		if changed != expectChanged {
+			t.Fatalf("%s: expected changed %v", name, expectChanged)
+		}
+		check(name, shard, expected...)
+	}
+
+	check("initial", r.ShuffleShard("user1", 3), ranked[:3]...)
+	checkLookback("initial", time.Hour, false, ranked[:3]...)
+
+	// An unhealthy ingester, and one which isn't ACTIVE, are replaced by the
+	// next ones, but are still queried.
+	desc.Ingesters[ranked[0]].Timestamp = time.Now().Add(-time.Hour).Unix()
+	desc.Ingesters[ranked[1]].State = LEAVING
+	r.recordShardableChanges(time.Now())
+	r.shards = nil
+	check("unhealthy", r.ShuffleShard("user1", 3), ranked[2:5]...)
+	checkLookback("unhealthy", time.Hour, true, ranked[:5]...)
+
+	// Once they're healthy again the shard is back to them, but the
+	// ingesters which replaced them are still queried for the lookback.
+	desc.Ingesters[ranked[0]].Timestamp = time.Now().Unix()
+	desc.Ingesters[ranked[1]].State = ACTIVE
+	r.recordShardableChanges(time.Now())
+	r.shards = nil
+	check("recovered", r.ShuffleShard("user1", 3), ranked[:3]...)
+	checkLookback("recovered", time.Hour, true, ranked[:5]...)
+	checkLookback("after lookback", 0, false, ranked[:3]...)
+}
+
+func TestGetReadIncludesLeavingAndReplacement(t *testing.T) {
+	desc := NewDesc()
+	desc.AddIngester("a", "addr-a", "", "", []uint32{10}, ACTIVE)
+	desc.AddIngester("b", "addr-b", "", "", []uint32{20}, LEAVING)
+	desc.AddIngester("c", "addr-c", "", "", []uint32{30}, ACTIVE)
+	desc.AddIngester("d", "addr-d", "", "", []uint32{40}, ACTIVE)
+	r := Ring{ringDesc: desc}
+
+	addrs := func(op Operation) []string {
+		ingesters, err := r.Get(5, 2, op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := []string{}
+		for _, ing := range ingesters {
+			result = append(result, ing.Addr)
+		}
+		return result
+	}
+
+	// Writes skip the LEAVING ingester; reads must include both it and the
+	// ingester which took its writes.
+	if got := addrs(Write); !reflect.DeepEqual(got, []string{"addr-a", "addr-c"}) {
+		t.Errorf("unexpected write set %v", got)
+	}
+	if got := addrs(Read); !reflect.DeepEqual(got, []string{"addr-a", "addr-b", "addr-c"}) {
+		t.Errorf("unexpected read set %v", got)
+	}
+}
@@ -0,0 +1,178 @@
+package ring
+
+import (
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+type shardKey struct {
+	identifier string
+	size       int
+}
+
+// ShuffleShard returns a ring made of a subset of size of the ingesters,
+// chosen deterministically from the identifier (e.g. a user ID), so that
+// a misbehaving user only affects the ingesters in its shard.  Ingesters are
+// picked by rendezvous hashing, so an ingester joining or leaving only
+// moves the shards which include it.  Only ACTIVE, healthy ingesters are
+// picked; while one isn't, the next in its shards' order takes its place.
+// If size is zero, or not smaller than the ring, the whole ring is returned.
+func (r *Ring) ShuffleShard(identifier string, size int) ReadRing {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if size <= 0 || r.ringDesc == nil || size >= len(r.ringDesc.Ingesters) {
+		return r
+	}
+
+	key := shardKey{identifier, size}
+	r.shardsMtx.Lock()
+	defer r.shardsMtx.Unlock()
+	if shard, ok := r.shards[key]; ok {
+		return shard
+	}
+
+	now := time.Now()
+	members := map[string]struct{}{}
+	for _, id := range rankIngesters(r.ringDesc, identifier) {
+		if len(members) == size {
+			break
+		}
+		if r.isShardable(r.ringDesc.Ingesters[id], now) {
+			members[id] = struct{}{}
+		}
+	}
+	shard := r.shardRing(members)
+	if r.shards == nil {
+		r.shards = map[shardKey]*Ring{}
+	}
+	r.shards[key] = shard
+	return shard
+}
+
+// ShuffleShardWithLookback returns a ring of the ingesters which may hold
+// series written to the identifier's shuffle shard in the lookback period,
+// for queries, and whether that differs from the current shard.  If no
+// ingester which is, or could have been, in the shard has joined, left, or
+// become healthy or unhealthy in the period, it's the current shard.
+// Otherwise it also has the ingesters which changed, and enough of the
+// following ingesters to cover those which did.  As series are placed by
+// token within the shard, a changed shard should be queried as a whole.
+//
+// Changes are only known from when this Ring started watching.
+func (r *Ring) ShuffleShardWithLookback(identifier string, size int, lookback time.Duration) (ReadRing, bool) {
+	shard := r.ShuffleShard(identifier, size)
+	if shard == ReadRing(r) {
+		return r, false
+	}
+
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	now := time.Now()
+	cutoff := now.Add(-lookback)
+	recent := func(id string) bool {
+		changed, ok := r.changed[id]
+		return ok && changed.After(cutoff)
+	}
+
+	// Ingesters which changed count towards the shard only if they've been
+	// in it throughout the period.
+	members := map[string]struct{}{}
+	stable, changed := 0, false
+	for _, id := range rankIngesters(r.ringDesc, identifier) {
+		if stable == size {
+			break
+		}
+		shardable := r.isShardable(r.ringDesc.Ingesters[id], now)
+		if recent(id) {
+			members[id] = struct{}{}
+			changed = true
+		} else if shardable {
+			members[id] = struct{}{}
+			stable++
+		}
+	}
+	if !changed {
+		return shard, false
+	}
+	return r.shardRing(members), true
+}
+
+// isShardable returns true if the ingester can be picked for shuffle
+// shards.
+func (r *Ring) isShardable(ingester *IngesterDesc, now time.Time) bool {
+	return ingester.State == ACTIVE && now.Sub(time.Unix(ingester.Timestamp, 0)) <= r.heartbeatTimeout
+}
+
+// recordShardableChanges notes the ingesters which joined, left, or became
+// shardable or not since the ring was last updated.  The first version of
+// the ring seen has no changes.  NB must be called with mtx held.
+func (r *Ring) recordShardableChanges(now time.Time) {
+	first := r.shardable == nil
+	if first {
+		r.shardable = map[string]bool{}
+		r.changed = map[string]time.Time{}
+	}
+	for id, ingester := range r.ringDesc.Ingesters {
+		shardable := r.isShardable(ingester, now)
+		if was, ok := r.shardable[id]; !first && (!ok || was != shardable) {
+			r.changed[id] = now
+		}
+		r.shardable[id] = shardable
+	}
+	for id := range r.shardable {
+		if _, ok := r.ringDesc.Ingesters[id]; !ok {
+			delete(r.shardable, id)
+			delete(r.changed, id)
+		}
+	}
+}
+
+// shardRing returns a Ring of the given members of the ring and their
+// tokens.  NB must be called with mtx held.
+func (r *Ring) shardRing(members map[string]struct{}) *Ring {
+	desc := &Desc{Ingesters: map[string]*IngesterDesc{}}
+	for id := range members {
+		desc.Ingesters[id] = r.ringDesc.Ingesters[id]
+	}
+	for _, token := range r.ringDesc.Tokens {
+		if _, ok := members[token.Ingester]; ok {
+			desc.Tokens = append(desc.Tokens, token)
+		}
+	}
+	return &Ring{
+		heartbeatTimeout: r.heartbeatTimeout,
+		zoneAwareness:    r.zoneAwareness,
+		ringDesc:         desc,
+	}
+}
+
+// rankIngesters returns the IDs of the ingesters in the order they're
+// picked for the identifier's shards: by the hash of the identifier and
+// ingester ID.
+func rankIngesters(desc *Desc, identifier string) []string {
+	type scored struct {
+		id    string
+		score uint64
+	}
+	ingesters := make([]scored, 0, len(desc.Ingesters))
+	for id := range desc.Ingesters {
+		h := fnv.New64a()
+		h.Write([]byte(identifier))
+		h.Write([]byte{0})
+		h.Write([]byte(id))
+		ingesters = append(ingesters, scored{id, h.Sum64()})
+	}
+	sort.Slice(ingesters, func(i, j int) bool {
+		if ingesters[i].score != ingesters[j].score {
+			return ingesters[i].score < ingesters[j].score
+		}
+		return ingesters[i].id < ingesters[j].id
+	})
+
+	ids := make([]string, 0, len(ingesters))
+	for _, ing := range ingesters {
+		ids = append(ids, ing.id)
+	}
+	return ids
+}
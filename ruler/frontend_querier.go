@@ -0,0 +1,181 @@
+package ruler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/auth"
+	"github.com/weaveworks/cortex/util"
+)
+
+// ruleQueryLabel is the label of the selector which, in frontend mode,
+// replaces each rule's expression.  Its value is the expression.
+const ruleQueryLabel = "__cortex_rule_query__"
+
+// frontendExpr replaces a rule's expression with a selector which
+// frontendQuerier answers by sending the whole expression to the
+// query-frontend.  The rules manager only evaluates rules with a
+// promql.Engine, which would otherwise fetch each selector's raw samples.
+func frontendExpr(expr promql.Expr) promql.Expr {
+	return &promql.VectorSelector{
+		LabelMatchers: metric.LabelMatchers{{
+			Type:  metric.Equal,
+			Name:  ruleQueryLabel,
+			Value: model.LabelValue(expr.String()),
+		}},
+	}
+}
+
+// frontendQuerier is a querier.Querier which evaluates rules' expressions
+// through the query-frontend's Prometheus HTTP API, so rule evaluation is
+// subject to the same per-tenant query limits, and caching, as any other
+// query.
+type frontendQuerier struct {
+	url    *url.URL
+	client *http.Client
+}
+
+func newFrontendQuerier(u *url.URL, timeout time.Duration) *frontendQuerier {
+	return &frontendQuerier{
+		url:    u,
+		client: &http.Client{Timeout: timeout, Transport: util.TracedTransport{}},
+	}
+}
+
+// Query implements querier.Querier.  It only answers the selectors made by
+// frontendExpr, with the result of an instant query of the rule's
+// expression at to.
+func (q *frontendQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	if len(matchers) != 1 || matchers[0].Name != ruleQueryLabel || matchers[0].Type != metric.Equal {
+		return nil, fmt.Errorf("only rules' expressions can be sent to the query-frontend")
+	}
+	values := url.Values{}
+	values.Set("query", string(matchers[0].Value))
+	values.Set("time", to.String())
+
+	var data struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	}
+	if err := q.get(ctx, "/query", values, &data); err != nil {
+		return nil, err
+	}
+	switch data.ResultType {
+	case model.ValVector.String():
+		var vector model.Vector
+		if err := json.Unmarshal(data.Result, &vector); err != nil {
+			return nil, err
+		}
+		matrix := make(model.Matrix, 0, len(vector))
+		for _, s := range vector {
+			matrix = append(matrix, &model.SampleStream{
+				Metric: s.Metric,
+				Values: []model.SamplePair{{Timestamp: to, Value: s.Value}},
+			})
+		}
+		return matrix, nil
+	case model.ValScalar.String():
+		var scalar model.Scalar
+		if err := json.Unmarshal(data.Result, &scalar); err != nil {
+			return nil, err
+		}
+		return model.Matrix{{
+			Metric: model.Metric{},
+			Values: []model.SamplePair{{Timestamp: to, Value: scalar.Value}},
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unexpected result type %q", data.ResultType)
+	}
+}
+
+// LabelValuesForLabelName implements querier.Querier.
+func (q *frontendQuerier) LabelValuesForLabelName(ctx context.Context, ln model.LabelName) (model.LabelValues, error) {
+	var values model.LabelValues
+	if err := q.get(ctx, "/label/"+string(ln)+"/values", nil, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// MetricsForLabelMatchers implements querier.Querier.
+func (q *frontendQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	values := url.Values{}
+	for _, matchers := range matcherSets {
+		values.Add("match[]", selector(matchers))
+	}
+	values.Set("start", from.String())
+	values.Set("end", through.String())
+
+	var series []model.Metric
+	if err := q.get(ctx, "/series", values, &series); err != nil {
+		return nil, err
+	}
+	result := make([]metric.Metric, 0, len(series))
+	for _, m := range series {
+		result = append(result, metric.Metric{Metric: m})
+	}
+	return result, nil
+}
+
+// get sends a request for the user in ctx to the Prometheus API endpoint
+// at path, and decodes the data of the response into data.
+func (q *frontendQuerier) get(ctx context.Context, path string, values url.Values, data interface{}) error {
+	u := *q.url
+	u.Path = strings.TrimRight(u.Path, "/") + "/api/prom/api/v1" + path
+	u.RawQuery = values.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if err := user.InjectIntoHTTPRequest(ctx, req); err != nil {
+		return err
+	}
+	auth.InjectScopes(req, auth.Read)
+
+	resp, err := ctxhttp.Do(ctx, q.client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("query-frontend returned HTTP status %d: %s", resp.StatusCode, body)
+	}
+
+	var response struct {
+		Status string          `json:"status"`
+		Data   json.RawMessage `json:"data"`
+		Error  string          `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return err
+	}
+	if response.Status != "success" {
+		return fmt.Errorf("query-frontend returned an error: %s", response.Error)
+	}
+	return json.Unmarshal(response.Data, data)
+}
+
+// selector returns the PromQL vector selector for matchers.
+func selector(matchers []*metric.LabelMatcher) string {
+	parts := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		parts = append(parts, m.String())
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
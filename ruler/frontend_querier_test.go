@@ -0,0 +1,111 @@
+package ruler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/querier"
+)
+
+func TestFrontendQuerierEvaluatesRules(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[
+			{"metric":{"bar":"baz"},"value":[130,"2.5"]}
+		]}}`))
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL + "/prefix/")
+	require.NoError(t, err)
+	engine := promql.NewEngine(querier.Queryable{
+		Q: querier.MergeQuerier{
+			Queriers: []querier.Querier{newFrontendQuerier(u, time.Second)},
+		},
+	}, nil)
+
+	expr, err := promql.ParseExpr(`sum by (bar) (rate(foo{bar=~"b.*"}[5m]))`)
+	require.NoError(t, err)
+	rule := rules.NewRecordingRule("bar:foo:rate5m", frontendExpr(expr), model.LabelSet{"rule": "1"})
+
+	ctx := user.Inject(context.Background(), "user1")
+	vector, err := rule.Eval(ctx, model.TimeFromUnix(130), engine, "")
+	require.NoError(t, err)
+
+	assert.Equal(t, "/prefix/api/prom/api/v1/query", got.URL.Path)
+	assert.Equal(t, expr.String(), got.URL.Query().Get("query"))
+	assert.Equal(t, "130", got.URL.Query().Get("time"))
+	assert.Equal(t, "user1", got.Header.Get("X-Scope-OrgID"))
+	assert.Equal(t, model.Vector{{
+		Metric:    model.Metric{model.MetricNameLabel: "bar:foo:rate5m", "bar": "baz", "rule": "1"},
+		Value:     2.5,
+		Timestamp: model.TimeFromUnix(130),
+	}}, vector)
+}
+
+func TestFrontendQuerierRejectsSelectors(t *testing.T) {
+	u, err := url.Parse("http://frontend")
+	require.NoError(t, err)
+	q := newFrontendQuerier(u, time.Second)
+
+	nameMatcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	require.NoError(t, err)
+	ctx := user.Inject(context.Background(), "user1")
+	_, err = q.Query(ctx, model.TimeFromUnix(100), model.TimeFromUnix(130), nameMatcher)
+	assert.Error(t, err)
+}
+
+func TestFrontendQuerierErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"http error", http.StatusTooManyRequests, "too many outstanding requests"},
+		{"query error", http.StatusOK, `{"status":"error","error":"query timed out"}`},
+		{"wrong result type", http.StatusOK, `{"status":"success","data":{"resultType":"matrix","result":[]}}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			u, err := url.Parse(server.URL)
+			require.NoError(t, err)
+			q := newFrontendQuerier(u, time.Second)
+
+			ctx := user.Inject(context.Background(), "user1")
+			_, err = q.Query(ctx, model.TimeFromUnix(100), model.TimeFromUnix(130), ruleMatcher(t))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestFrontendQuerierNoUser(t *testing.T) {
+	u, err := url.Parse("http://frontend")
+	require.NoError(t, err)
+	q := newFrontendQuerier(u, time.Second)
+	_, err = q.Query(context.Background(), model.TimeFromUnix(100), model.TimeFromUnix(130), ruleMatcher(t))
+	assert.Error(t, err)
+}
+
+func ruleMatcher(t *testing.T) *metric.LabelMatcher {
+	expr, err := promql.ParseExpr("up")
+	require.NoError(t, err)
+	return frontendExpr(expr).(*promql.VectorSelector).LabelMatchers[0]
+}
@@ -0,0 +1,196 @@
+package ruler
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/weaveworks/cortex/chunk"
+	configs "github.com/weaveworks/cortex/configs/client"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// ObjectStoreConfig configures loading rules from object storage instead of
+// the configs service.
+type ObjectStoreConfig struct {
+	S3               util.URLValue
+	S3Endpoint       string
+	S3ForcePathStyle bool
+	SyncInterval     time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *ObjectStoreConfig) RegisterFlags(f *flag.FlagSet) {
+	f.Var(&cfg.S3, "ruler.storage.s3.url", "S3 URL, with escaped Key and Secret encoded, of the bucket and prefix to load rules from instead of the configs service, e.g. s3://key:secret@us-east-1/bucket/rules. Each tenant's rules files are the objects under <prefix>/<tenant>/.")
+	f.StringVar(&cfg.S3Endpoint, "ruler.storage.s3.endpoint", "", "S3 endpoint to use instead of the one deduced from the URL's region, e.g. https://storage.googleapis.com for GCS.")
+	f.BoolVar(&cfg.S3ForcePathStyle, "ruler.storage.s3.force-path-style", false, "Put the bucket name in the path rather than the host name of S3 requests, as needed by some S3 compatible stores.")
+	f.DurationVar(&cfg.SyncInterval, "ruler.storage.sync-interval", time.Minute, "How often to reload rules from object storage.")
+}
+
+// objectStore loads each tenant's rules from the objects under their prefix
+// in a bucket.  It's polled like the configs service, but only returns the
+// tenants whose objects changed since the last poll.
+type objectStore struct {
+	s3     s3iface.S3API
+	bucket string
+	prefix string
+
+	// The version of each tenant's objects the last time they were loaded,
+	// and the ID given to the last config returned.
+	versions map[string]string
+	latestID configs.ConfigID
+}
+
+func newObjectStore(cfg ObjectStoreConfig) (*objectStore, error) {
+	client, err := chunk.S3ClientFromURL(cfg.S3.URL, cfg.S3Endpoint, cfg.S3ForcePathStyle)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(strings.Trim(cfg.S3.URL.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("no bucket specified in %s", cfg.S3.URL)
+	}
+	var prefix string
+	if len(parts) > 1 {
+		prefix = parts[1] + "/"
+	}
+	return &objectStore{
+		s3:       client,
+		bucket:   parts[0],
+		prefix:   prefix,
+		versions: map[string]string{},
+	}, nil
+}
+
+// GetConfigs returns the configs of the tenants whose rules have changed
+// since the last call, as the configs service does for since.  A tenant
+// whose objects were all deleted gets a config with no rules.
+func (o *objectStore) GetConfigs(since configs.ConfigID) (*configs.CortexConfigsResponse, error) {
+	objects := map[string][]*s3.Object{}
+	err := o.s3.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(o.bucket),
+		Prefix: aws.String(o.prefix),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			parts := strings.SplitN(strings.TrimPrefix(*obj.Key, o.prefix), "/", 2)
+			if len(parts) != 2 || parts[1] == "" || strings.HasSuffix(parts[1], "/") {
+				continue
+			}
+			objects[parts[0]] = append(objects[parts[0]], obj)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &configs.CortexConfigsResponse{Configs: map[string]configs.CortexConfigView{}}
+	for userID, objs := range objects {
+		version := objectsVersion(objs)
+		if o.versions[userID] == version {
+			continue
+		}
+		cfg, err := o.load(userID, objs)
+		if err != nil {
+			// Try again on the next poll.
+			log.Warnf("Error loading rules for %s from object storage: %v", userID, err)
+			continue
+		}
+		o.latestID++
+		result.Configs[userID] = configs.CortexConfigView{ConfigID: o.latestID, Config: cfg}
+		o.versions[userID] = version
+	}
+	for userID := range o.versions {
+		if _, ok := objects[userID]; !ok {
+			o.latestID++
+			result.Configs[userID] = configs.CortexConfigView{ConfigID: o.latestID}
+			delete(o.versions, userID)
+		}
+	}
+	return result, nil
+}
+
+func (o *objectStore) load(userID string, objs []*s3.Object) (configs.CortexConfig, error) {
+	cfg := configs.CortexConfig{RulesFiles: map[string]string{}}
+	for _, obj := range objs {
+		resp, err := o.s3.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(o.bucket),
+			Key:    obj.Key,
+		})
+		if err != nil {
+			return cfg, err
+		}
+		buf, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return cfg, err
+		}
+		cfg.RulesFiles[strings.TrimPrefix(*obj.Key, o.prefix+userID+"/")] = string(buf)
+	}
+	return cfg, nil
+}
+
+// objectsVersion identifies the contents of a tenant's objects, so we only
+// load them again when they change.
+func objectsVersion(objs []*s3.Object) string {
+	versions := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		versions = append(versions, *obj.Key+"@"+aws.StringValue(obj.ETag))
+	}
+	sort.Strings(versions)
+	return strings.Join(versions, ",")
+}
+
+// DeleteRules deletes all the objects holding the tenant's rules from the
+// object storage in cfg, returning how many there were.
+func DeleteRules(cfg ObjectStoreConfig, userID string) (int, error) {
+	o, err := newObjectStore(cfg)
+	if err != nil {
+		return 0, err
+	}
+	return o.deleteUser(userID)
+}
+
+func (o *objectStore) deleteUser(userID string) (int, error) {
+	n := 0
+	var deleteErr error
+	err := o.s3.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(o.bucket),
+		Prefix: aws.String(o.prefix + userID + "/"),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		if len(page.Contents) == 0 {
+			return true
+		}
+		// Pages have at most 1000 objects, as many as can be deleted at once.
+		objects := make([]*s3.ObjectIdentifier, 0, len(page.Contents))
+		for _, obj := range page.Contents {
+			objects = append(objects, &s3.ObjectIdentifier{Key: obj.Key})
+		}
+		resp, err := o.s3.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(o.bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			deleteErr = err
+			return false
+		}
+		if len(resp.Errors) > 0 {
+			deleteErr = fmt.Errorf("error deleting %s: %s", aws.StringValue(resp.Errors[0].Key), aws.StringValue(resp.Errors[0].Message))
+			return false
+		}
+		n += len(objects)
+		return true
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, deleteErr
+}
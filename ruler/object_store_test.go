@@ -0,0 +1,113 @@
+package ruler
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockS3 is a bucket whose objects' ETags are their contents.
+type mockS3 struct {
+	s3iface.S3API
+	objects map[string]string
+}
+
+func (m *mockS3) ListObjectsPages(input *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool) error {
+	page := &s3.ListObjectsOutput{}
+	for key, contents := range m.objects {
+		if strings.HasPrefix(key, *input.Prefix) {
+			page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key), ETag: aws.String(contents)})
+		}
+	}
+	fn(page, true)
+	return nil
+}
+
+func (m *mockS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	contents, ok := m.objects[*input.Key]
+	if !ok {
+		return nil, fmt.Errorf("no such key %s", *input.Key)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewBufferString(contents))}, nil
+}
+
+func (m *mockS3) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	for _, obj := range input.Delete.Objects {
+		delete(m.objects, *obj.Key)
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+func TestObjectStore(t *testing.T) {
+	bucket := &mockS3{objects: map[string]string{
+		"rules/1/recording.rules":   `job:up:sum = sum(up) by (job)`,
+		"rules/1/alerts/down.rules": `ALERT Down IF up == 0`,
+		"rules/2/recording.rules":   `up:count = count(up)`,
+		"other/3/recording.rules":   `up:count = count(up)`,
+	}}
+	o := &objectStore{s3: bucket, bucket: "bucket", prefix: "rules/", versions: map[string]string{}}
+
+	resp, err := o.GetConfigs(0)
+	require.NoError(t, err)
+	require.Len(t, resp.Configs, 2)
+	assert.Equal(t, map[string]string{
+		"recording.rules":   `job:up:sum = sum(up) by (job)`,
+		"alerts/down.rules": `ALERT Down IF up == 0`,
+	}, resp.Configs["1"].Config.RulesFiles)
+	rules, err := resp.Configs["1"].Config.GetRules()
+	require.NoError(t, err)
+	assert.Len(t, rules, 2)
+
+	// Only changed tenants are returned, with later IDs.
+	latest := resp.GetLatestConfigID()
+	resp, err = o.GetConfigs(latest)
+	require.NoError(t, err)
+	assert.Empty(t, resp.Configs)
+
+	bucket.objects["rules/2/recording.rules"] = `up:sum = sum(up)`
+	resp, err = o.GetConfigs(latest)
+	require.NoError(t, err)
+	require.Len(t, resp.Configs, 1)
+	assert.Equal(t, `up:sum = sum(up)`, resp.Configs["2"].Config.RulesFiles["recording.rules"])
+	assert.True(t, resp.Configs["2"].ConfigID > latest)
+
+	// A tenant with no objects left has no rules.
+	delete(bucket.objects, "rules/1/recording.rules")
+	delete(bucket.objects, "rules/1/alerts/down.rules")
+	resp, err = o.GetConfigs(resp.GetLatestConfigID())
+	require.NoError(t, err)
+	require.Contains(t, resp.Configs, "1")
+	rules, err = resp.Configs["1"].Config.GetRules()
+	require.NoError(t, err)
+	assert.Empty(t, rules)
+}
+
+func TestObjectStoreDeleteUser(t *testing.T) {
+	bucket := &mockS3{objects: map[string]string{
+		"rules/1/recording.rules":   `job:up:sum = sum(up) by (job)`,
+		"rules/1/alerts/down.rules": `ALERT Down IF up == 0`,
+		"rules/10/recording.rules":  `up:count = count(up)`,
+		"other/1/recording.rules":   `up:count = count(up)`,
+	}}
+	o := &objectStore{s3: bucket, bucket: "bucket", prefix: "rules/", versions: map[string]string{}}
+
+	n, err := o.deleteUser("1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, map[string]string{
+		"rules/10/recording.rules": `up:count = count(up)`,
+		"other/1/recording.rules":  `up:count = count(up)`,
+	}, bucket.objects)
+
+	n, err = o.deleteUser("1")
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
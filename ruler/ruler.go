@@ -5,11 +5,12 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/config"
 	"github.com/prometheus/prometheus/notifier"
@@ -19,11 +20,15 @@ import (
 	"golang.org/x/net/context/ctxhttp"
 
 	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/auth"
 	"github.com/weaveworks/cortex/chunk"
 	configs "github.com/weaveworks/cortex/configs/client"
 	"github.com/weaveworks/cortex/distributor"
+	"github.com/weaveworks/cortex/limits"
 	"github.com/weaveworks/cortex/querier"
+	"github.com/weaveworks/cortex/ring"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 var (
@@ -54,6 +59,10 @@ func init() {
 type Config struct {
 	ConfigsAPIURL util.URLValue
 
+	// Loads rules from object storage instead of the configs service, if
+	// its URL is set.
+	ObjectStore ObjectStoreConfig
+
 	// HTTP timeout duration for requests made to the Weave Cloud configs
 	// service.
 	ClientTimeout time.Duration
@@ -63,35 +72,62 @@ type Config struct {
 	// in order to navigate Prometheus's code paths.
 	ExternalURL util.URLValue
 
+	// Sends rule evaluation queries to the query-frontend instead of the
+	// ingesters and chunk store, if its URL is set.
+	FrontendURL     util.URLValue
+	FrontendTimeout time.Duration
+
 	// How frequently to evaluate rules by default.
 	EvaluationInterval time.Duration
 	NumWorkers         int
 
 	// URL of the Alertmanager to send notifications to.
 	AlertmanagerURL string
+	// Send notifications to every address the URL's host resolves to.
+	AlertmanagerDiscovery       bool
+	AlertmanagerRefreshInterval time.Duration
 	// Capacity of the queue for notifications to be sent to the Alertmanager.
 	NotificationQueueCapacity int
 	// HTTP timeout duration when sending notifications to the Alertmanager.
 	NotificationTimeout time.Duration
+
+	// Shard users' rules between the rulers, which register in a ring.
+	EnableSharding   bool
+	ConsulConfig     *ring.ConsulConfig
+	HeartbeatPeriod  time.Duration
+	HeartbeatTimeout time.Duration
+	NumTokens        int
+	ID               string
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	cfg.ExternalURL.URL, _ = url.Parse("") // Must be non-nil
 	f.Var(&cfg.ConfigsAPIURL, "ruler.configs.url", "URL of configs API server.")
+	cfg.ObjectStore.RegisterFlags(f)
 	f.Var(&cfg.ExternalURL, "ruler.external.url", "URL of alerts return path.")
+	f.Var(&cfg.FrontendURL, "ruler.frontend.url", "URL of the query-frontend, including its -http.prefix, if any, to send rule evaluation queries to instead of querying the ingesters and chunk store directly.")
+	f.DurationVar(&cfg.FrontendTimeout, "ruler.frontend.timeout", time.Minute, "Timeout for queries sent to the query-frontend.")
 	f.DurationVar(&cfg.EvaluationInterval, "ruler.evaluation-interval", 15*time.Second, "How frequently to evaluate rules")
 	f.DurationVar(&cfg.ClientTimeout, "ruler.client-timeout", 5*time.Second, "Timeout for requests to Weave Cloud configs service.")
 	f.IntVar(&cfg.NumWorkers, "ruler.num-workers", 1, "Number of rule evaluator worker routines in this process")
 	f.StringVar(&cfg.AlertmanagerURL, "ruler.alertmanager-url", "", "URL of the Alertmanager to send notifications to.")
+	f.BoolVar(&cfg.AlertmanagerDiscovery, "ruler.alertmanager-discovery", false, "Resolve the host of -ruler.alertmanager-url in DNS, and send notifications to every address it resolves to, e.g. each replica of a highly available Alertmanager behind a headless service.")
+	f.DurationVar(&cfg.AlertmanagerRefreshInterval, "ruler.alertmanager-refresh-interval", time.Minute, "How often to resolve the Alertmanager URL's host again, when -ruler.alertmanager-discovery is set.")
 	f.IntVar(&cfg.NotificationQueueCapacity, "ruler.notification-queue-capacity", 10000, "Capacity of the queue for notifications to be sent to the Alertmanager.")
 	f.DurationVar(&cfg.NotificationTimeout, "ruler.notification-timeout", 10*time.Second, "HTTP timeout duration when sending notifications to the Alertmanager.")
+	f.BoolVar(&cfg.EnableSharding, "ruler.enable-sharding", false, "Register in a ring of rulers in consul, and only evaluate the rules of the users whose IDs hash to this ruler's tokens.")
+	f.DurationVar(&cfg.HeartbeatPeriod, "ruler.heartbeat-period", 5*time.Second, "Period at which to heartbeat to the rulers' ring.")
+	f.DurationVar(&cfg.HeartbeatTimeout, "ruler.heartbeat-timeout", time.Minute, "The heartbeat timeout after which a ruler is removed from the ring, and its users' rules move to other rulers.")
+	f.IntVar(&cfg.NumTokens, "ruler.num-tokens", 128, "Number of tokens for each ruler in the ring.")
+	f.StringVar(&cfg.ID, "ruler.id", "", "ID to register in the rulers' ring. Defaults to the hostname.")
 }
 
 // Ruler evaluates rules.
 type Ruler struct {
 	engine        *promql.Engine
 	pusher        Pusher
+	mapExpr       func(promql.Expr) promql.Expr
 	alertURL      *url.URL
 	notifierCfg   *config.Config
 	queueCapacity int
@@ -101,15 +137,29 @@ type Ruler struct {
 	notifiers    map[string]*notifier.Notifier
 }
 
-// NewRuler creates a new ruler from a distributor and chunk store.
-func NewRuler(cfg Config, d *distributor.Distributor, c *chunk.Store) (*Ruler, error) {
+// NewRuler creates a new ruler from a distributor and chunk store.  If a
+// query-frontend URL is configured, each rule's expression is sent to it as
+// a query instead, and the chunk store isn't used.  Either way, results are
+// written through the distributor, which applies the tenant's limits.
+func NewRuler(cfg Config, d *distributor.Distributor, c *chunk.Store, overrides *limits.Overrides) (*Ruler, error) {
 	ncfg, err := buildNotifierConfig(&cfg)
 	if err != nil {
 		return nil, err
 	}
+	engine := querier.NewEngine(d, c, overrides)
+	var mapExpr func(promql.Expr) promql.Expr
+	if cfg.FrontendURL.URL != nil {
+		engine = promql.NewEngine(querier.Queryable{
+			Q: querier.MergeQuerier{
+				Queriers: []querier.Querier{newFrontendQuerier(cfg.FrontendURL.URL, cfg.FrontendTimeout)},
+			},
+		}, nil)
+		mapExpr = frontendExpr
+	}
 	return &Ruler{
-		engine:        querier.NewEngine(d, c),
+		engine:        engine,
 		pusher:        d,
+		mapExpr:       mapExpr,
 		alertURL:      cfg.ExternalURL.URL,
 		notifierCfg:   ncfg,
 		queueCapacity: cfg.NotificationQueueCapacity,
@@ -128,22 +178,42 @@ func buildNotifierConfig(rulerConfig *Config) (*config.Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	amConfig := &config.AlertmanagerConfig{
-		Scheme:     u.Scheme,
-		PathPrefix: u.Path,
-		Timeout:    rulerConfig.NotificationTimeout,
-		ServiceDiscoveryConfig: config.ServiceDiscoveryConfig{
-			StaticConfigs: []*config.TargetGroup{
-				{
-					Targets: []model.LabelSet{
-						{
-							model.AddressLabel: model.LabelValue(u.Host),
-						},
+	sdConfig := config.ServiceDiscoveryConfig{
+		StaticConfigs: []*config.TargetGroup{
+			{
+				Targets: []model.LabelSet{
+					{
+						model.AddressLabel: model.LabelValue(u.Host),
 					},
 				},
 			},
 		},
 	}
+	if rulerConfig.AlertmanagerDiscovery {
+		port := 80
+		if u.Scheme == "https" {
+			port = 443
+		}
+		if p := u.Port(); p != "" {
+			if port, err = strconv.Atoi(p); err != nil {
+				return nil, fmt.Errorf("invalid port in Alertmanager URL %s: %v", u, err)
+			}
+		}
+		sdConfig = config.ServiceDiscoveryConfig{
+			DNSSDConfigs: []*config.DNSSDConfig{{
+				Names:           []string{u.Hostname()},
+				RefreshInterval: model.Duration(rulerConfig.AlertmanagerRefreshInterval),
+				Type:            "A",
+				Port:            port,
+			}},
+		}
+	}
+	amConfig := &config.AlertmanagerConfig{
+		Scheme:                 u.Scheme,
+		PathPrefix:             u.Path,
+		Timeout:                rulerConfig.NotificationTimeout,
+		ServiceDiscoveryConfig: sdConfig,
+	}
 
 	promConfig := &config.Config{
 		AlertingConfig: config.AlertingConfig{
@@ -206,6 +276,7 @@ func (r *Ruler) getOrCreateNotifier(userID string) (*notifier.Notifier, error) {
 			if err := user.InjectIntoHTTPRequest(ctx, req); err != nil {
 				return nil, err
 			}
+			auth.InjectScopes(req, auth.RulesAdmin)
 			return ctxhttp.Do(ctx, client, req)
 		},
 	})
@@ -252,26 +323,53 @@ func (r *Ruler) Stop() {
 // Server is a rules server.
 type Server struct {
 	scheduler *scheduler
+	sharder   *sharder
 	workers   []worker
 }
 
 // NewServer makes a new rule processing server.
 func NewServer(cfg Config, ruler *Ruler) (*Server, error) {
-	c := configs.RulesAPI{
-		URL:     cfg.ConfigsAPIURL.URL,
-		Timeout: cfg.ClientTimeout,
-	}
-	// TODO: Separate configuration for polling interval.
-	s := newScheduler(c, cfg.EvaluationInterval, cfg.EvaluationInterval)
 	if cfg.NumWorkers <= 0 {
 		return nil, fmt.Errorf("must have at least 1 worker, got %d", cfg.NumWorkers)
 	}
+	var s scheduler
+	if cfg.ObjectStore.S3.URL != nil {
+		o, err := newObjectStore(cfg.ObjectStore)
+		if err != nil {
+			return nil, err
+		}
+		s = newScheduler(o, cfg.EvaluationInterval, cfg.ObjectStore.SyncInterval)
+	} else {
+		c := &configs.RulesAPI{
+			URL:     cfg.ConfigsAPIURL.URL,
+			Timeout: cfg.ClientTimeout,
+		}
+		// TODO: Separate configuration for polling interval.
+		s = newScheduler(c, cfg.EvaluationInterval, cfg.EvaluationInterval)
+	}
+	s.mapExpr = ruler.mapExpr
+	var sh *sharder
+	if cfg.EnableSharding {
+		if cfg.ConsulConfig == nil {
+			return nil, fmt.Errorf("sharding rulers requires consul")
+		}
+		var err error
+		if cfg.ID == "" {
+			if cfg.ID, err = os.Hostname(); err != nil {
+				return nil, fmt.Errorf("failed to get hostname: %v", err)
+			}
+		}
+		if sh, err = newSharder(cfg); err != nil {
+			return nil, err
+		}
+	}
 	workers := make([]worker, cfg.NumWorkers)
 	for i := 0; i < cfg.NumWorkers; i++ {
-		workers[i] = newWorker(&s, ruler)
+		workers[i] = newWorker(&s, sh, ruler)
 	}
 	srv := Server{
 		scheduler: &s,
+		sharder:   sh,
 		workers:   workers,
 	}
 	go srv.run()
@@ -293,6 +391,9 @@ func (s *Server) Stop() {
 		w.Stop()
 	}
 	s.scheduler.Stop()
+	if s.sharder != nil {
+		s.sharder.Stop()
+	}
 }
 
 // Worker does a thing until it's told to stop.
@@ -303,15 +404,17 @@ type Worker interface {
 
 type worker struct {
 	scheduler *scheduler
+	sharder   *sharder
 	ruler     *Ruler
 
 	done       chan struct{}
 	terminated chan struct{}
 }
 
-func newWorker(scheduler *scheduler, ruler *Ruler) worker {
+func newWorker(scheduler *scheduler, sharder *sharder, ruler *Ruler) worker {
 	return worker{
 		scheduler:  scheduler,
+		sharder:    sharder,
 		ruler:      ruler,
 		done:       make(chan struct{}),
 		terminated: make(chan struct{}),
@@ -334,9 +437,13 @@ func (w *worker) Run() {
 			log.Debugf("Queue closed and empty. Terminating worker.")
 			return
 		}
-		log.Debugf("Processing %v", item)
-		ctx := user.Inject(context.Background(), item.userID)
-		w.ruler.Evaluate(ctx, item.rules)
+		// Items owned by other rulers stay scheduled here too, so they're
+		// picked up if their ruler goes away.
+		if w.sharder == nil || w.sharder.owns(item.userID) {
+			log.Debugf("Processing %v", item)
+			ctx := user.Inject(context.Background(), item.userID)
+			w.ruler.Evaluate(ctx, item.rules)
+		}
 		w.scheduler.workItemDone(*item)
 		log.Debugf("%v handed back to queue", item)
 	}
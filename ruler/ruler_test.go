@@ -6,9 +6,12 @@ import (
 	"net/http/httptest"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/config"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/weaveworks/common/user"
 )
 
@@ -21,7 +24,7 @@ func newTestRuler(t *testing.T, alertmanagerURL string) *Ruler {
 
 	// TODO: Populate distributor and chunk store arguments to enable
 	// other kinds of tests.
-	ruler, err := NewRuler(cfg, nil, nil)
+	ruler, err := NewRuler(cfg, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -52,3 +55,32 @@ func TestNotifierSendsUserIDHeader(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestNotifierConfigDiscovery(t *testing.T) {
+	for _, tc := range []struct {
+		url  string
+		name string
+		port int
+	}{
+		{"http://alertmanager.default.svc.cluster.local/api/prom/alertmanager/", "alertmanager.default.svc.cluster.local", 80},
+		{"https://alertmanager:9094/", "alertmanager", 9094},
+		{"https://alertmanager/", "alertmanager", 443},
+	} {
+		cfg := Config{
+			AlertmanagerURL:             tc.url,
+			AlertmanagerDiscovery:       true,
+			AlertmanagerRefreshInterval: time.Minute,
+		}
+		ncfg, err := buildNotifierConfig(&cfg)
+		require.NoError(t, err)
+		require.Len(t, ncfg.AlertingConfig.AlertmanagerConfigs, 1)
+		sdConfig := ncfg.AlertingConfig.AlertmanagerConfigs[0].ServiceDiscoveryConfig
+		assert.Empty(t, sdConfig.StaticConfigs)
+		assert.Equal(t, []*config.DNSSDConfig{{
+			Names:           []string{tc.name},
+			RefreshInterval: model.Duration(time.Minute),
+			Type:            "A",
+			Port:            tc.port,
+		}}, sdConfig.DNSSDConfigs)
+	}
+}
@@ -8,11 +8,12 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
+	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/rules"
 
 	"github.com/weaveworks/common/instrument"
 	configs "github.com/weaveworks/cortex/configs/client"
+	"github.com/weaveworks/cortex/util/log"
 )
 
 const (
@@ -61,8 +62,14 @@ func (w workItem) Defer(interval time.Duration) workItem {
 	return workItem{w.userID, w.rules, w.scheduled.Add(interval)}
 }
 
+// configsSource is polled for the configs that changed since a ConfigID,
+// e.g. the configs service.
+type configsSource interface {
+	GetConfigs(since configs.ConfigID) (*configs.CortexConfigsResponse, error)
+}
+
 type scheduler struct {
-	configsAPI         configs.RulesAPI
+	configsAPI         configsSource
 	evaluationInterval time.Duration
 	q                  *SchedulingQueue
 
@@ -71,6 +78,9 @@ type scheduler struct {
 
 	pollInterval time.Duration
 
+	// mapExpr, if set, replaces the expression of each rule.
+	mapExpr func(promql.Expr) promql.Expr
+
 	latestConfig configs.ConfigID
 	latestMutex  sync.RWMutex
 
@@ -79,7 +89,7 @@ type scheduler struct {
 }
 
 // newScheduler makes a new scheduler.
-func newScheduler(configsAPI configs.RulesAPI, evaluationInterval, pollInterval time.Duration) scheduler {
+func newScheduler(configsAPI configsSource, evaluationInterval, pollInterval time.Duration) scheduler {
 	return scheduler{
 		configsAPI:         configsAPI,
 		evaluationInterval: evaluationInterval,
@@ -171,7 +181,7 @@ func (s *scheduler) addNewConfigs(now time.Time, cfgs map[string]configs.CortexC
 	// TODO: instrument how many configs we have, both valid & invalid.
 	log.Debugf("Adding %d configurations", len(cfgs))
 	for userID, config := range cfgs {
-		rules, err := config.Config.GetRules()
+		rules, err := config.Config.GetMappedRules(s.mapExpr)
 		if err != nil {
 			// XXX: This means that if a user has a working configuration and
 			// they submit a broken one, we'll keep processing the last known
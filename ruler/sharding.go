@@ -0,0 +1,136 @@
+package ruler
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// rulersConsulKey is the key under which rulers register their tokens, when
+// sharding is enabled.
+const rulersConsulKey = "rulers"
+
+// sharder registers this ruler in the rulers' ring, and says which users'
+// rules it should evaluate: those whose user ID hashes to one of its tokens.
+// A ruler which stops heartbeating is removed from the ring by the others,
+// and its users move to them.
+type sharder struct {
+	cfg    Config
+	consul ring.ConsulClient
+	ring   *ring.Ring
+
+	quit, done chan struct{}
+}
+
+func newSharder(cfg Config) (*sharder, error) {
+	if cfg.HeartbeatPeriod <= 0 {
+		return nil, fmt.Errorf("-ruler.heartbeat-period must be positive, got %v", cfg.HeartbeatPeriod)
+	}
+	ringConfig := ring.Config{
+		ConsulConfig:     *cfg.ConsulConfig,
+		HeartbeatTimeout: cfg.HeartbeatTimeout,
+	}
+	r, err := ring.NewForKey(ringConfig, rulersConsulKey)
+	if err != nil {
+		return nil, err
+	}
+	consul, err := ring.NewConsulClient(*cfg.ConsulConfig, ring.ProtoCodec{Factory: ring.ProtoDescFactory})
+	if err != nil {
+		r.Stop()
+		return nil, err
+	}
+	s := &sharder{
+		cfg:    cfg,
+		consul: consul,
+		ring:   r,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	s.heartbeat()
+	go s.loop()
+	return s, nil
+}
+
+func (s *sharder) loop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.cfg.HeartbeatPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.heartbeat()
+		case <-s.quit:
+			s.unregister()
+			return
+		}
+	}
+}
+
+// Stop removes this ruler from the ring.
+func (s *sharder) Stop() {
+	close(s.quit)
+	<-s.done
+	s.ring.Stop()
+}
+
+// heartbeat updates our entry in the ring, taking tokens the first time, and
+// removes rulers which haven't heartbeated recently.
+func (s *sharder) heartbeat() {
+	err := s.consul.CAS(rulersConsulKey, func(in interface{}) (out interface{}, retry bool, err error) {
+		var desc *ring.Desc
+		if in == nil {
+			desc = ring.NewDesc()
+		} else {
+			desc = in.(*ring.Desc)
+		}
+
+		now := time.Now()
+		for id, ruler := range desc.Ingesters {
+			if id != s.cfg.ID && now.Sub(time.Unix(ruler.Timestamp, 0)) > s.cfg.HeartbeatTimeout {
+				desc.RemoveIngester(id)
+			}
+		}
+
+		tokens, other := desc.TokensFor(s.cfg.ID)
+		if len(tokens) == 0 {
+			tokens = ring.GenerateTokens(s.cfg.NumTokens, other)
+		}
+		// Rulers aren't sent requests, so they register their ID as their
+		// address, to recognise themselves in the ring.
+		desc.RemoveIngester(s.cfg.ID)
+		desc.AddIngester(s.cfg.ID, s.cfg.ID, "", "", tokens, ring.ACTIVE)
+		return desc, true, nil
+	})
+	if err != nil {
+		log.Errorf("Failed to heartbeat to the rulers' ring: %v", err)
+	}
+}
+
+func (s *sharder) unregister() {
+	if err := s.consul.CAS(rulersConsulKey, func(in interface{}) (out interface{}, retry bool, err error) {
+		if in == nil {
+			return ring.NewDesc(), false, nil
+		}
+		desc := in.(*ring.Desc)
+		desc.RemoveIngester(s.cfg.ID)
+		return desc, true, nil
+	}); err != nil {
+		log.Errorf("Failed to unregister from the rulers' ring: %v", err)
+	}
+}
+
+// owns returns whether this ruler should evaluate the user's rules.  While
+// the ring can't be read, no ruler does, rather than every ruler.
+func (s *sharder) owns(userID string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	rulers, err := s.ring.Get(h.Sum32(), 1, ring.Read)
+	if err != nil {
+		log.Warnf("Error finding the ruler for %s: %v", userID, err)
+		return false
+	}
+	return len(rulers) > 0 && rulers[0].Addr == s.cfg.ID
+}
@@ -0,0 +1,77 @@
+package ruler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex/ring"
+)
+
+func TestSharding(t *testing.T) {
+	consul := ring.ConsulConfig{
+		Mock: ring.NewInMemoryConsulClient(ring.ProtoCodec{Factory: ring.ProtoDescFactory}),
+	}
+	newTestSharder := func(id string) *sharder {
+		s, err := newSharder(Config{
+			ConsulConfig:     &consul,
+			HeartbeatPeriod:  10 * time.Millisecond,
+			HeartbeatTimeout: time.Minute,
+			NumTokens:        16,
+			ID:               id,
+		})
+		require.NoError(t, err)
+		return s
+	}
+	// owners returns how many of the sharders own each user, once they all
+	// see the same number of rulers.
+	owners := func(want int, sharders ...*sharder) map[string]int {
+		deadline := time.Now().Add(5 * time.Second)
+		for _, s := range sharders {
+			for len(s.ring.GetAll()) != want && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			require.Len(t, s.ring.GetAll(), want)
+		}
+		result := map[string]int{}
+		for i := 0; i < 100; i++ {
+			userID := fmt.Sprintf("user%d", i)
+			for _, s := range sharders {
+				if s.owns(userID) {
+					result[userID]++
+				}
+			}
+		}
+		return result
+	}
+
+	a, b := newTestSharder("a"), newTestSharder("b")
+	defer b.Stop()
+	counts := map[int]int{}
+	for _, n := range owners(2, a, b) {
+		counts[n]++
+	}
+	// Every user is owned by exactly one ruler.
+	assert.Equal(t, map[int]int{1: 100}, counts)
+
+	// When a ruler leaves, the others take over its users.
+	a.Stop()
+	counts = map[int]int{}
+	for _, n := range owners(1, b) {
+		counts[n]++
+	}
+	assert.Equal(t, map[int]int{1: 100}, counts)
+}
+
+func TestShardingHeartbeatPeriod(t *testing.T) {
+	_, err := newSharder(Config{
+		ConsulConfig: &ring.ConsulConfig{
+			Mock: ring.NewInMemoryConsulClient(ring.ProtoCodec{Factory: ring.ProtoDescFactory}),
+		},
+		ID: "ruler",
+	})
+	assert.Error(t, err)
+}
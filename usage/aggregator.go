@@ -0,0 +1,343 @@
+package usage
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+var usageTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "usage_total",
+	Help:      "The total usage of each tenant reported to the aggregator, by kind.  Active series are in series-seconds.",
+}, []string{"user", "kind"})
+
+func init() {
+	prometheus.MustRegister(usageTotal)
+}
+
+// AggregatorConfig configures the Aggregator.
+type AggregatorConfig struct {
+	Period            time.Duration
+	Retention         time.Duration
+	File              string
+	TokenFile         string
+	ReplicationFactor int
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *AggregatorConfig) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.Period, "usage.period", 1*time.Hour, "Period by which usage is aggregated and exported.")
+	f.DurationVar(&cfg.Retention, "usage.retention", 31*24*time.Hour, "How long to keep aggregated usage for.")
+	f.StringVar(&cfg.File, "usage.file", "", "File to keep aggregated usage in across restarts. If empty, it's only kept in memory.")
+	f.StringVar(&cfg.TokenFile, "usage.token-file", "", "File with the token reporters must send as a bearer token.")
+	f.IntVar(&cfg.ReplicationFactor, "usage.replication-factor", 3, "The number of ingesters each series is written to. Every ingester reports active series and chunks stored, so they're divided by this.")
+}
+
+// replicated are the kinds of usage reported by every ingester a series is
+// replicated to.
+var replicated = map[string]bool{ActiveSeries: true, ChunksStored: true}
+
+// aggregatorState is the usage an Aggregator keeps in its file.
+type aggregatorState struct {
+	// Usage by the start of the period, in Unix seconds, then tenant and
+	// kind.  Active series are in series-seconds.
+	Periods map[int64]map[string]map[string]float64 `json:"periods"`
+	// The time of the latest report accepted from each reporter.
+	Reporters map[string]time.Time `json:"reporters"`
+}
+
+// Aggregator sums the usage reported by Cortex components per tenant and
+// period, for chargeback.
+type Aggregator struct {
+	cfg   AggregatorConfig
+	token string
+
+	mtx   sync.Mutex
+	state aggregatorState
+	dirty bool
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewAggregator makes a new Aggregator, loading the usage in its file, if
+// it has one.
+func NewAggregator(cfg AggregatorConfig) (*Aggregator, error) {
+	if cfg.Period <= 0 {
+		return nil, fmt.Errorf("usage period must be positive")
+	}
+	if cfg.ReplicationFactor <= 0 {
+		return nil, fmt.Errorf("usage replication factor must be positive")
+	}
+	token, err := readToken(cfg.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	a := &Aggregator{
+		cfg:   cfg,
+		token: token,
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if cfg.File != "" {
+		buf, err := ioutil.ReadFile(cfg.File)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(buf, &a.state); err != nil {
+				return nil, fmt.Errorf("error reading %s: %v", cfg.File, err)
+			}
+		}
+	}
+	if a.state.Periods == nil {
+		a.state.Periods = map[int64]map[string]map[string]float64{}
+	}
+	if a.state.Reporters == nil {
+		a.state.Reporters = map[string]time.Time{}
+	}
+	go a.loop()
+	return a, nil
+}
+
+// Stop the Aggregator, saving its usage.
+func (a *Aggregator) Stop() {
+	close(a.quit)
+	<-a.done
+}
+
+func (a *Aggregator) loop() {
+	defer close(a.done)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.expire()
+			if err := a.save(); err != nil {
+				log.Errorf("Error saving usage: %v", err)
+			}
+		case <-a.quit:
+			if err := a.save(); err != nil {
+				log.Errorf("Error saving usage: %v", err)
+			}
+			return
+		}
+	}
+}
+
+func (a *Aggregator) expire() {
+	cutoff := mtime.Now().Add(-a.cfg.Retention)
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for start := range a.state.Periods {
+		if start < cutoff.Unix() {
+			delete(a.state.Periods, start)
+			a.dirty = true
+		}
+	}
+	// Older reports would be for expired periods anyway.
+	for reporter, last := range a.state.Reporters {
+		if last.Before(cutoff) {
+			delete(a.state.Reporters, reporter)
+			a.dirty = true
+		}
+	}
+}
+
+// save writes the usage to the file, via a temporary file so it's never
+// left half written.
+func (a *Aggregator) save() error {
+	if a.cfg.File == "" {
+		return nil
+	}
+	a.mtx.Lock()
+	if !a.dirty {
+		a.mtx.Unlock()
+		return nil
+	}
+	buf, err := json.Marshal(a.state)
+	a.dirty = false
+	a.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := a.cfg.File + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.cfg.File)
+}
+
+// add the usage in a report to the period it was made in, unless the
+// report, or a later one from the same reporter, was added already.
+func (a *Aggregator) add(report Report) {
+	period := int64(a.cfg.Period / time.Second)
+	start := report.Time.Unix() - report.Time.Unix()%period
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if last, ok := a.state.Reporters[report.Reporter]; ok && !report.Time.After(last) {
+		return
+	}
+	a.state.Reporters[report.Reporter] = report.Time
+	tenants, ok := a.state.Periods[start]
+	if !ok {
+		tenants = map[string]map[string]float64{}
+		a.state.Periods[start] = tenants
+	}
+	for userID, usage := range report.Usage {
+		totals, ok := tenants[userID]
+		if !ok {
+			totals = map[string]float64{}
+			tenants[userID] = totals
+		}
+		for kind, value := range usage {
+			if kind == ActiveSeries {
+				value *= report.Interval
+			}
+			if replicated[kind] {
+				value /= float64(a.cfg.ReplicationFactor)
+			}
+			totals[kind] += value
+			usageTotal.WithLabelValues(userID, kind).Add(value)
+		}
+	}
+	a.dirty = true
+}
+
+// ServeReport adds a Report POSTed as JSON, with the aggregator's token as
+// a bearer token.
+func (a *Aggregator) ServeReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		http.Error(w, "invalid usage token", http.StatusUnauthorized)
+		return
+	}
+	var report Report
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if report.Reporter == "" {
+		http.Error(w, "report has no reporter", http.StatusBadRequest)
+		return
+	}
+	a.add(report)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Period is the usage of a tenant in a period.  Active series are the
+// average over the period.
+type Period struct {
+	Start  time.Time          `json:"start"`
+	End    time.Time          `json:"end"`
+	Tenant string             `json:"tenant"`
+	Usage  map[string]float64 `json:"usage"`
+}
+
+// Export returns the usage of each tenant, or just the given one, in the
+// periods starting from from until through.
+func (a *Aggregator) Export(from, through time.Time, tenant string) []Period {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	result := []Period{}
+	for start, tenants := range a.state.Periods {
+		startTime := time.Unix(start, 0).UTC()
+		if startTime.Before(from) || !startTime.Before(through) {
+			continue
+		}
+		for userID, totals := range tenants {
+			if tenant != "" && userID != tenant {
+				continue
+			}
+			usage := make(map[string]float64, len(totals))
+			for kind, value := range totals {
+				if kind == ActiveSeries {
+					value /= a.cfg.Period.Seconds()
+				}
+				usage[kind] = value
+			}
+			result = append(result, Period{
+				Start:  startTime,
+				End:    startTime.Add(a.cfg.Period),
+				Tenant: userID,
+				Usage:  usage,
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Start.Equal(result[j].Start) {
+			return result[i].Start.Before(result[j].Start)
+		}
+		return result[i].Tenant < result[j].Tenant
+	})
+	return result
+}
+
+// ServeExport returns the usage of each tenant per period, from `start`
+// until `end` (defaulting to the retention period until now), optionally
+// only of `tenant`, as JSON, or CSV if `format=csv`.
+func (a *Aggregator) ServeExport(w http.ResponseWriter, r *http.Request) {
+	now := mtime.Now()
+	from, through := now.Add(-a.cfg.Retention), now
+	if s := r.FormValue("start"); s != "" {
+		t, err := util.ParseTime(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = t.Time()
+	}
+	if s := r.FormValue("end"); s != "" {
+		t, err := util.ParseTime(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		through = t.Time()
+	}
+	periods := a.Export(from, through, r.FormValue("tenant"))
+
+	switch format := r.FormValue("format"); format {
+	case "", "json":
+		util.WriteJSONResponse(w, periods)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		cw.Write(append([]string{"start", "end", "tenant"}, Kinds...))
+		for _, p := range periods {
+			row := []string{p.Start.Format(time.RFC3339), p.End.Format(time.RFC3339), p.Tenant}
+			for _, kind := range Kinds {
+				row = append(row, strconv.FormatFloat(p.Usage[kind], 'f', -1, 64))
+			}
+			cw.Write(row)
+		}
+		cw.Flush()
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,294 @@
+package usage
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// Kinds of usage.  Active series is a gauge, the rest are counters.
+const (
+	SamplesIngested = "samples_ingested"
+	ActiveSeries    = "active_series"
+	ChunksStored    = "chunks_stored"
+	BytesQueried    = "bytes_queried"
+)
+
+// Kinds lists the kinds of usage, in the order they're exported.
+var Kinds = []string{SamplesIngested, ActiveSeries, ChunksStored, BytesQueried}
+
+var reportFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "usage_report_failures_total",
+	Help:      "The total number of usage reports that failed to be sent to the aggregator.",
+})
+
+func init() {
+	prometheus.MustRegister(reportFailures)
+}
+
+// maxPendingReports is how many reports a Reporter keeps trying to send
+// while the aggregator is unavailable, before dropping the oldest.
+const maxPendingReports = 100
+
+// Report is the usage of each tenant, by kind, since the reporter's last
+// report.  Gauges are their latest value, and apply for the whole interval.
+// A reporter's reports are identified by their time, so resending one
+// doesn't count it twice.
+type Report struct {
+	Reporter string                        `json:"reporter"`
+	Time     time.Time                     `json:"time"`
+	Interval float64                       `json:"interval_seconds"`
+	Usage    map[string]map[string]float64 `json:"usage"`
+}
+
+// Config configures the usage reporter.
+type Config struct {
+	URL            util.URLValue
+	ReportInterval time.Duration
+	ReportTimeout  time.Duration
+	TokenFile      string
+	ID             string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.Var(&cfg.URL, "usage.url", "If set, report per-tenant usage to the usage aggregator at this URL, e.g. http://usage/.")
+	f.DurationVar(&cfg.ReportInterval, "usage.report-interval", 1*time.Minute, "Period with which to report usage.")
+	f.DurationVar(&cfg.ReportTimeout, "usage.report-timeout", 10*time.Second, "Timeout for reporting usage.")
+	f.StringVar(&cfg.TokenFile, "usage.token-file", "", "File with the token the usage aggregator authenticates reports with. Required with -usage.url.")
+	f.StringVar(&cfg.ID, "usage.reporter-id", "", "ID of this process in its usage reports, unique among reporters. Defaults to the hostname and PID.")
+}
+
+// readToken reads the token authenticating usage reports from a file.
+func readToken(filename string) (string, error) {
+	if filename == "" {
+		return "", fmt.Errorf("no usage token file configured")
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(buf))
+	if token == "" {
+		return "", fmt.Errorf("empty usage token in %s", filename)
+	}
+	return token, nil
+}
+
+// Reporter accumulates the usage of tenants, and periodically reports it to
+// the aggregator.  Usage is only accumulated if there's an aggregator.
+type Reporter struct {
+	cfg   Config
+	token string
+
+	// Reports not yet accepted by the aggregator, oldest first.  Only used
+	// by report.
+	pending []Report
+
+	mtx        sync.Mutex
+	usage      map[string]map[string]float64
+	lastReport time.Time
+	quit       chan struct{} // nil if there is no aggregator, or once stopped.
+
+	done chan struct{}
+}
+
+// NewReporter makes a new Reporter.
+func NewReporter(cfg Config) (*Reporter, error) {
+	r := &Reporter{
+		cfg:        cfg,
+		usage:      map[string]map[string]float64{},
+		lastReport: time.Now(),
+	}
+	if cfg.URL.URL != nil {
+		token, err := readToken(cfg.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		r.token = token
+		if r.cfg.ID == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, err
+			}
+			r.cfg.ID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+		}
+		r.quit = make(chan struct{})
+		r.done = make(chan struct{})
+		go r.loop(r.quit)
+	}
+	return r, nil
+}
+
+// Stop the Reporter, sending a final report.
+func (r *Reporter) Stop() {
+	r.mtx.Lock()
+	quit := r.quit
+	r.quit = nil
+	r.mtx.Unlock()
+
+	if quit != nil {
+		close(quit)
+		<-r.done
+	}
+}
+
+// Add value to a counter kind of usage of a tenant.
+func (r *Reporter) Add(userID, kind string, value float64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.quit == nil {
+		return
+	}
+	r.tenant(userID)[kind] += value
+}
+
+// Set a gauge kind of usage of a tenant.  Gauges are reset after every
+// report, so must be set more often than reports are made.
+func (r *Reporter) Set(userID, kind string, value float64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.quit == nil {
+		return
+	}
+	r.tenant(userID)[kind] = value
+}
+
+func (r *Reporter) tenant(userID string) map[string]float64 {
+	usage, ok := r.usage[userID]
+	if !ok {
+		usage = map[string]float64{}
+		r.usage[userID] = usage
+	}
+	return usage
+}
+
+func (r *Reporter) loop(quit <-chan struct{}) {
+	defer close(r.done)
+	ticker := time.NewTicker(r.cfg.ReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.report()
+		case <-quit:
+			r.report()
+			return
+		}
+	}
+}
+
+// report sends the usage since the last report, after any earlier reports
+// the aggregator hasn't accepted.  Failed reports are sent again unchanged,
+// so the aggregator can tell if it had accepted them already.
+func (r *Reporter) report() {
+	now := time.Now()
+	r.mtx.Lock()
+	report := Report{
+		Reporter: r.cfg.ID,
+		Time:     now,
+		Interval: now.Sub(r.lastReport).Seconds(),
+		Usage:    r.usage,
+	}
+	r.usage = map[string]map[string]float64{}
+	r.lastReport = now
+	r.mtx.Unlock()
+	if len(report.Usage) > 0 {
+		r.pending = append(r.pending, report)
+	}
+	if dropped := len(r.pending) - maxPendingReports; dropped > 0 {
+		log.Warnf("Dropping %d unsent usage reports", dropped)
+		r.pending = r.pending[dropped:]
+	}
+
+	for len(r.pending) > 0 {
+		if err := r.send(r.pending[0]); err != nil {
+			reportFailures.Inc()
+			log.Warnf("Error reporting usage: %v", err)
+			return
+		}
+		r.pending = r.pending[1:]
+	}
+}
+
+func (r *Reporter) send(report Report) error {
+	buf, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.ReportTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", strings.TrimRight(r.cfg.URL.String(), "/")+"/api/usage/report", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+r.token)
+	resp, err := ctxhttp.Do(ctx, http.DefaultClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("aggregator returned HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+var (
+	defaultMtx sync.RWMutex
+	// defaultReporter has no aggregator, so ignores usage until Init.
+	defaultReporter = &Reporter{usage: map[string]map[string]float64{}}
+)
+
+// Init replaces the process-wide Reporter with one built from cfg.
+func Init(cfg Config) error {
+	reporter, err := NewReporter(cfg)
+	if err != nil {
+		return err
+	}
+	defaultMtx.Lock()
+	old := defaultReporter
+	defaultReporter = reporter
+	defaultMtx.Unlock()
+	old.Stop()
+	return nil
+}
+
+// Stop the process-wide Reporter.
+func Stop() {
+	defaultMtx.RLock()
+	defer defaultMtx.RUnlock()
+	defaultReporter.Stop()
+}
+
+// Add value to a counter kind of usage of a tenant on the process-wide
+// Reporter.
+func Add(userID, kind string, value float64) {
+	defaultMtx.RLock()
+	defer defaultMtx.RUnlock()
+	defaultReporter.Add(userID, kind, value)
+}
+
+// Set a gauge kind of usage of a tenant on the process-wide Reporter.
+func Set(userID, kind string, value float64) {
+	defaultMtx.RLock()
+	defer defaultMtx.RUnlock()
+	defaultReporter.Set(userID, kind, value)
+}
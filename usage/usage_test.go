@@ -0,0 +1,112 @@
+package usage
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/common/mtime"
+)
+
+func TestUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600))
+	cfg := AggregatorConfig{Period: time.Hour, Retention: 24 * time.Hour, File: filepath.Join(dir, "usage.json"), TokenFile: tokenFile, ReplicationFactor: 3}
+	aggregator, err := NewAggregator(cfg)
+	require.NoError(t, err)
+
+	// failing fails reports, after the aggregator accepted them if lost is
+	// set.
+	failing, lost := true, false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/usage/report", r.URL.Path)
+		if failing && !lost {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		rec := httptest.NewRecorder()
+		aggregator.ServeReport(rec, r)
+		if failing {
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+		w.WriteHeader(rec.Code)
+	}))
+	defer server.Close()
+
+	var reporterCfg Config
+	require.NoError(t, reporterCfg.URL.Set(server.URL+"/"))
+	reporterCfg.ReportInterval = time.Hour
+	reporterCfg.ReportTimeout = time.Second
+	reporterCfg.TokenFile = tokenFile
+	reporter, err := NewReporter(reporterCfg)
+	require.NoError(t, err)
+	reporter.Add("1", SamplesIngested, 10)
+	reporter.Add("1", BytesQueried, 1024)
+	reporter.Set("1", ActiveSeries, 300)
+
+	// Reports are kept until they're accepted, and not counted twice if the
+	// aggregator accepted them without the reporter knowing.
+	reporter.report()
+	lost = true
+	reporter.report()
+	failing = false
+	reporter.Add("1", SamplesIngested, 5)
+	reporter.Add("2", ChunksStored, 9)
+	reporter.Set("1", ActiveSeries, 300)
+	reporter.lastReport = time.Now().Add(-time.Minute)
+	reporter.Stop()
+	assert.Empty(t, reporter.pending)
+
+	// Usage isn't accumulated once the reporter stops.
+	reporter.Add("1", SamplesIngested, 5)
+	assert.Empty(t, reporter.usage)
+
+	now := mtime.Now()
+	periods := aggregator.Export(now.Add(-2*time.Hour), now.Add(time.Hour), "")
+	require.Len(t, periods, 2)
+	assert.Equal(t, "1", periods[0].Tenant)
+	assert.Equal(t, 15.0, periods[0].Usage[SamplesIngested])
+	assert.Equal(t, 1024.0, periods[0].Usage[BytesQueried])
+	// 300 series, on 3 ingesters each, for a minute of the hour.
+	assert.InDelta(t, 100.0/60, periods[0].Usage[ActiveSeries], 0.01)
+	assert.Equal(t, "2", periods[1].Tenant)
+	assert.Equal(t, 3.0, periods[1].Usage[ChunksStored])
+	assert.Equal(t, periods[0].Start.Add(time.Hour), periods[0].End)
+	assert.Len(t, aggregator.Export(now.Add(-2*time.Hour), now.Add(time.Hour), "2"), 1)
+
+	w := httptest.NewRecorder()
+	aggregator.ServeExport(w, httptest.NewRequest("GET", "/api/usage/export?format=csv&tenant=2", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, "start,end,tenant,samples_ingested,active_series,chunks_stored,bytes_queried", lines[0])
+	assert.True(t, strings.HasSuffix(lines[1], ",2,0,0,3,0"), lines[1])
+
+	w = httptest.NewRecorder()
+	aggregator.ServeExport(w, httptest.NewRequest("GET", "/api/usage/export?format=xml", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Usage is kept across restarts.
+	aggregator.Stop()
+	aggregator, err = NewAggregator(cfg)
+	require.NoError(t, err)
+	defer aggregator.Stop()
+	assert.Equal(t, periods, aggregator.Export(now.Add(-2*time.Hour), now.Add(time.Hour), ""))
+
+	// Reports need the token.
+	w = httptest.NewRecorder()
+	aggregator.ServeReport(w, httptest.NewRequest("POST", "/api/usage/report", strings.NewReader(`{"reporter": "a"}`)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,110 @@
+package util
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/weaveworks/cortex/util/log"
+)
+
+const configFileFlag = "config.file"
+
+// ParseFlags parses the command line flags, with defaults taken from the
+// YAML file given by -config.file.  The file mirrors the flag names, split
+// into sections on "."; eg
+//
+//	distributor:
+//	  replication-factor: 3
+//
+// sets -distributor.replication-factor.  Flags given on the command line
+// take precedence over the file.
+func ParseFlags() {
+	if err := parseFlags(flag.CommandLine, os.Args[1:]); err != nil {
+		log.Fatalf("Error parsing flags: %v", err)
+	}
+}
+
+func parseFlags(f *flag.FlagSet, args []string) error {
+	configFile := f.String(configFileFlag, "", "YAML file to load flag values from; flags given on the command line take precedence.")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if *configFile == "" {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(buf, &config); err != nil {
+		return err
+	}
+	values := map[string][]string{}
+	if err := flattenConfig("", config, values); err != nil {
+		return err
+	}
+
+	set := map[string]bool{}
+	f.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+
+	// Sort the names so errors are reported deterministically.
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if f.Lookup(name) == nil || name == configFileFlag {
+			return fmt.Errorf("%s: unknown flag %q", *configFile, name)
+		}
+		if set[name] {
+			continue
+		}
+		for _, value := range values[name] {
+			if err := f.Set(name, value); err != nil {
+				return fmt.Errorf("%s: invalid value %q for flag %q: %v", *configFile, value, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// flattenConfig turns nested YAML sections into flag names and values.
+// Lists give a flag multiple times.
+func flattenConfig(prefix string, config map[string]interface{}, values map[string][]string) error {
+	for key, value := range config {
+		name := key
+		if prefix != "" {
+			name = prefix + "." + key
+		}
+
+		switch v := value.(type) {
+		case map[interface{}]interface{}:
+			section := make(map[string]interface{}, len(v))
+			for k, sv := range v {
+				section[fmt.Sprint(k)] = sv
+			}
+			if err := flattenConfig(name, section, values); err != nil {
+				return err
+			}
+		case []interface{}:
+			for _, item := range v {
+				values[name] = append(values[name], fmt.Sprint(item))
+			}
+		case nil:
+			return fmt.Errorf("no value for flag %q", name)
+		default:
+			values[name] = append(values[name], fmt.Sprint(v))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "config")
+	require.NoError(t, err)
+	_, err = f.WriteString(contents)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	return f.Name()
+}
+
+func TestParseFlagsConfigFile(t *testing.T) {
+	filename := writeConfigFile(t, `
+distributor:
+  replication-factor: 5
+  remote-timeout: 10s
+ingester.max-chunk-idle: 1h
+federation:
+  cluster:
+    - eu=http://eu
+    - us=http://us
+`)
+	defer os.Remove(filename)
+
+	var (
+		replicationFactor int
+		remoteTimeout     time.Duration
+		maxChunkIdle      time.Duration
+		clusters          StringListValue
+	)
+	f := flag.NewFlagSet("test", flag.ContinueOnError)
+	f.IntVar(&replicationFactor, "distributor.replication-factor", 3, "")
+	f.DurationVar(&remoteTimeout, "distributor.remote-timeout", 2*time.Second, "")
+	f.DurationVar(&maxChunkIdle, "ingester.max-chunk-idle", time.Minute, "")
+	f.Var(&clusters, "federation.cluster", "")
+
+	err := parseFlags(f, []string{"-config.file", filename, "-distributor.remote-timeout=1s"})
+	require.NoError(t, err)
+	assert.Equal(t, 5, replicationFactor)
+	assert.Equal(t, time.Second, remoteTimeout, "command line should take precedence")
+	assert.Equal(t, time.Hour, maxChunkIdle)
+	assert.Equal(t, StringListValue{"eu=http://eu", "us=http://us"}, clusters)
+}
+
+func TestParseFlagsConfigFileErrors(t *testing.T) {
+	for _, contents := range []string{
+		"distributor:\n  replication-facter: 5\n",
+		"distributor:\n  replication-factor: five\n",
+		"distributor: [",
+	} {
+		filename := writeConfigFile(t, contents)
+		defer os.Remove(filename)
+
+		var replicationFactor int
+		f := flag.NewFlagSet("test", flag.ContinueOnError)
+		f.IntVar(&replicationFactor, "distributor.replication-factor", 3, "")
+		assert.Error(t, parseFlags(f, []string{"-config.file", filename}), contents)
+	}
+}
@@ -0,0 +1,101 @@
+package util
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// DebugConfig configures the profiling and runtime debugging endpoints.
+type DebugConfig struct {
+	Enabled bool
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *DebugConfig) RegisterFlags(f *flag.FlagSet) {
+	f.BoolVar(&cfg.Enabled, "debug.enabled", false, "Serve pprof profiles on /debug/pprof, and run a garbage collection or dump the heap on a POST to /debug/gc or /debug/heapdump.")
+}
+
+// Register the debug endpoints, wrapped in m, on servers made with serverCfg,
+// if they're enabled.  The vendored server routes /debug/pprof to the
+// default mux's pprof handlers, unauthenticated, ahead of any routes added
+// later, so the endpoints are served by a separate router in middleware in
+// front of the server's router, which hides those handlers when disabled.
+func (cfg DebugConfig) Register(serverCfg *server.Config, m middleware.Interface) {
+	serverCfg.HTTPMiddleware = append(serverCfg.HTTPMiddleware, cfg.middleware(m))
+}
+
+func (cfg DebugConfig) middleware(m middleware.Interface) middleware.Interface {
+	router := mux.NewRouter()
+	if cfg.Enabled {
+		router.Handle("/debug/pprof/cmdline", m.Wrap(http.HandlerFunc(pprof.Cmdline)))
+		router.Handle("/debug/pprof/profile", m.Wrap(http.HandlerFunc(pprof.Profile)))
+		router.Handle("/debug/pprof/symbol", m.Wrap(http.HandlerFunc(pprof.Symbol)))
+		router.Handle("/debug/pprof/trace", m.Wrap(http.HandlerFunc(pprof.Trace)))
+		// Index serves the named profiles, e.g. /debug/pprof/heap, too.
+		router.PathPrefix("/debug/pprof/").Handler(m.Wrap(http.HandlerFunc(pprof.Index)))
+		router.Handle("/debug/gc", m.Wrap(http.HandlerFunc(gcHandler))).Methods("POST")
+		router.Handle("/debug/heapdump", m.Wrap(http.HandlerFunc(heapDumpHandler))).Methods("POST")
+	}
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/debug/") {
+				router.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+// gcHandler runs a garbage collection, returns as much memory to the OS as
+// it can, and reports the heap before and after.
+func gcHandler(w http.ResponseWriter, r *http.Request) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	debug.FreeOSMemory()
+	runtime.ReadMemStats(&after)
+	log.Infof("Garbage collection requested: heap in use %d -> %d bytes", before.HeapInuse, after.HeapInuse)
+	WriteJSONResponse(w, map[string]uint64{
+		"heap_inuse_bytes_before":    before.HeapInuse,
+		"heap_inuse_bytes_after":     after.HeapInuse,
+		"heap_released_bytes_before": before.HeapReleased,
+		"heap_released_bytes_after":  after.HeapReleased,
+	})
+}
+
+// heapDumpHandler writes a heap dump, in the format of
+// runtime/debug.WriteHeapDump, to the response.  The world is stopped
+// while the dump is written.
+func heapDumpHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := ioutil.TempFile("", "heapdump")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	log.Infof("Heap dump requested, writing it to %s", f.Name())
+	debug.WriteHeapDump(f.Fd())
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "heapdump"))
+	io.Copy(w, f)
+}
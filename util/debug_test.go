@@ -0,0 +1,64 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/server"
+)
+
+func TestDebugEndpoints(t *testing.T) {
+	noop := middleware.Func(func(next http.Handler) http.Handler { return next })
+	serve := func(cfg DebugConfig, method, path string) *httptest.ResponseRecorder {
+		// Like the vendored server's router, which serves the default mux's
+		// pprof handlers.
+		router := mux.NewRouter()
+		router.PathPrefix("/debug/pprof").Handler(http.DefaultServeMux)
+		router.Handle("/other", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		var serverCfg server.Config
+		cfg.Register(&serverCfg, noop)
+		w := httptest.NewRecorder()
+		middleware.Merge(serverCfg.HTTPMiddleware...).Wrap(router).ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	// Nothing is served unless enabled.
+	assert.Equal(t, http.StatusNotFound, serve(DebugConfig{}, "GET", "/debug/pprof/").Code)
+	assert.Equal(t, http.StatusNotFound, serve(DebugConfig{}, "GET", "/debug/pprof/heap").Code)
+	assert.Equal(t, http.StatusNotFound, serve(DebugConfig{}, "POST", "/debug/gc").Code)
+	assert.Equal(t, http.StatusOK, serve(DebugConfig{}, "GET", "/other").Code)
+
+	// The endpoints are wrapped in the middleware.
+	forbidden := middleware.Func(func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusForbidden) })
+	})
+	router := mux.NewRouter()
+	router.PathPrefix("/debug/pprof").Handler(http.DefaultServeMux)
+	var serverCfg server.Config
+	DebugConfig{Enabled: true}.Register(&serverCfg, forbidden)
+	w := httptest.NewRecorder()
+	middleware.Merge(serverCfg.HTTPMiddleware...).Wrap(router).ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/heap", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	enabled := DebugConfig{Enabled: true}
+	assert.Equal(t, http.StatusOK, serve(enabled, "GET", "/debug/pprof/").Code)
+	assert.Equal(t, http.StatusOK, serve(enabled, "GET", "/debug/pprof/heap").Code)
+	assert.NotEqual(t, http.StatusOK, serve(enabled, "GET", "/debug/gc").Code)
+
+	w = serve(enabled, "POST", "/debug/gc")
+	require.Equal(t, http.StatusOK, w.Code)
+	var stats map[string]uint64
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Contains(t, stats, "heap_inuse_bytes_after")
+
+	w = serve(enabled, "POST", "/debug/heapdump")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotZero(t, w.Body.Len())
+}
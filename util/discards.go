@@ -0,0 +1,104 @@
+package util
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reasons for discarding samples on the write path, besides failing
+// validation.
+const (
+	DiscardRateLimited          = "rate_limited"
+	DiscardTooManySamples       = "too_many_samples"
+	DiscardMetricNotAllowed     = "metric_not_allowed"
+	DiscardRelabelled           = "dropped_by_relabelling"
+	DiscardPerUserSeriesLimit   = "per_user_series_limit"
+	DiscardPerMetricSeriesLimit = "per_metric_series_limit"
+	DiscardOutOfOrder           = "sample_out_of_order"
+	DiscardDuplicateTimestamp   = "duplicate_sample_for_timestamp"
+)
+
+// recentDiscardsWindow is how long discards are remembered for.
+const recentDiscardsWindow = time.Hour
+
+// RecentDiscards remembers why each user's samples were recently discarded
+// by this process.
+var RecentDiscards = NewDiscardTracker(recentDiscardsWindow)
+
+// Discard counts samples of a user as discarded for a reason, in
+// DiscardedSamples and RecentDiscards.
+func Discard(userID, reason string, samples int, err error) {
+	DiscardedSamples.WithLabelValues(reason, userID).Add(float64(samples))
+	RecentDiscards.Record(userID, reason, samples, err)
+}
+
+// DiscardSummary is why, and how many, samples of a user were discarded
+// recently.
+type DiscardSummary struct {
+	Reason    string    `json:"reason"`
+	Samples   int       `json:"samples"`
+	Since     time.Time `json:"since"`
+	LastSeen  time.Time `json:"last_seen"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// DiscardTracker keeps a DiscardSummary per user and reason, starting a
+// reason's summary afresh if it wasn't seen for a window.
+type DiscardTracker struct {
+	window time.Duration
+	now    func() time.Time
+
+	mtx   sync.Mutex
+	users map[string]map[string]*DiscardSummary
+}
+
+// NewDiscardTracker makes a new DiscardTracker.
+func NewDiscardTracker(window time.Duration) *DiscardTracker {
+	return &DiscardTracker{
+		window: window,
+		now:    time.Now,
+		users:  map[string]map[string]*DiscardSummary{},
+	}
+}
+
+// Record that samples of a user were discarded, with the error they were
+// discarded with, if any.
+func (t *DiscardTracker) Record(userID, reason string, samples int, err error) {
+	now := t.now()
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	reasons, ok := t.users[userID]
+	if !ok {
+		reasons = map[string]*DiscardSummary{}
+		t.users[userID] = reasons
+	}
+	summary, ok := reasons[reason]
+	if !ok || now.Sub(summary.LastSeen) > t.window {
+		summary = &DiscardSummary{Reason: reason, Since: now}
+		reasons[reason] = summary
+	}
+	summary.Samples += samples
+	summary.LastSeen = now
+	if err != nil {
+		summary.LastError = err.Error()
+	}
+}
+
+// Recent returns the reasons a user's samples were discarded within the
+// window, by reason.
+func (t *DiscardTracker) Recent(userID string) []DiscardSummary {
+	now := t.now()
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	result := []DiscardSummary{}
+	for _, summary := range t.users[userID] {
+		if now.Sub(summary.LastSeen) <= t.window {
+			result = append(result, *summary)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Reason < result[j].Reason })
+	return result
+}
@@ -0,0 +1,34 @@
+package util
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscardTracker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tracker := NewDiscardTracker(time.Hour)
+	tracker.now = func() time.Time { return now }
+
+	tracker.Record("user", DiscardRateLimited, 10, errors.New("first"))
+	tracker.Record("other", DiscardOutOfOrder, 1, nil)
+	now = now.Add(30 * time.Minute)
+	tracker.Record("user", DiscardRateLimited, 5, errors.New("second"))
+	tracker.Record("user", DiscardMetricNotAllowed, 2, nil)
+	assert.Equal(t, []DiscardSummary{
+		{Reason: DiscardMetricNotAllowed, Samples: 2, Since: now, LastSeen: now},
+		{Reason: DiscardRateLimited, Samples: 15, Since: now.Add(-30 * time.Minute), LastSeen: now, LastError: "second"},
+	}, tracker.Recent("user"))
+
+	// Reasons not seen for the window are forgotten, and start afresh.
+	now = now.Add(61 * time.Minute)
+	assert.Empty(t, tracker.Recent("user"))
+	tracker.Record("user", DiscardRateLimited, 1, nil)
+	assert.Equal(t, []DiscardSummary{
+		{Reason: DiscardRateLimited, Samples: 1, Since: now, LastSeen: now},
+	}, tracker.Recent("user"))
+	assert.Empty(t, tracker.Recent("nobody"))
+}
@@ -11,4 +11,8 @@ const (
 	ErrMetricSeriesLimitExceeded = errors.Error("per-metric series limit exceeded")
 	ErrLabelNameTooLong          = errors.Error("label name too long")
 	ErrLabelValueTooLong         = errors.Error("label value too long")
+	ErrTooManyLabels             = errors.Error("sample has too many labels")
+	ErrSampleTooOld              = errors.Error("sample is older than the maximum sample age")
+	ErrOutOfOrderSample          = errors.Error("sample timestamp out of order")
+	ErrDuplicateSampleTimestamp  = errors.Error("sample with repeated timestamp but different value")
 )
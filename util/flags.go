@@ -3,6 +3,7 @@ package util
 import (
 	"flag"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/prometheus/common/model"
@@ -22,6 +23,80 @@ func RegisterFlags(rs ...Registerer) {
 	}
 }
 
+// RegisterSharedFlags registers flags with the provided Registerers, like
+// RegisterFlags, except a flag registered by more than one of them sets all
+// of their values.  It's for running several components, which share some
+// flags, in one process.
+func RegisterSharedFlags(rs ...Registerer) {
+	RegisterSharedFlagsOn(flag.CommandLine, rs...)
+}
+
+// RegisterSharedFlagsOn is RegisterSharedFlags on the given FlagSet.
+func RegisterSharedFlagsOn(fs *flag.FlagSet, rs ...Registerer) {
+	shared := map[string]*sharedValue{}
+	for _, r := range rs {
+		own := flag.NewFlagSet("", flag.PanicOnError)
+		r.RegisterFlags(own)
+		own.VisitAll(func(f *flag.Flag) {
+			if v, ok := shared[f.Name]; ok {
+				v.values = append(v.values, f.Value)
+				return
+			}
+			v := &sharedValue{values: []flag.Value{f.Value}}
+			shared[f.Name] = v
+			fs.Var(v, f.Name, f.Usage)
+		})
+	}
+}
+
+// sharedValue is a flag.Value setting several values.
+type sharedValue struct {
+	values []flag.Value
+}
+
+// String implements flag.Value
+func (v *sharedValue) String() string {
+	if v == nil || len(v.values) == 0 {
+		return ""
+	}
+	return v.values[0].String()
+}
+
+// Set implements flag.Value
+func (v *sharedValue) Set(s string) error {
+	for _, value := range v.values {
+		if err := value.Set(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsBoolFlag lets boolean flags be given without a value.
+func (v *sharedValue) IsBoolFlag() bool {
+	b, ok := v.values[0].(interface {
+		IsBoolFlag() bool
+	})
+	return ok && b.IsBoolFlag()
+}
+
+// PrefixedRegisterer registers the flags of a Registerer with a prefix, so a
+// process can be given two of the same config, e.g. for a source and a
+// destination.
+type PrefixedRegisterer struct {
+	Prefix string
+	Registerer
+}
+
+// RegisterFlags implements Registerer.
+func (p PrefixedRegisterer) RegisterFlags(f *flag.FlagSet) {
+	own := flag.NewFlagSet("", flag.PanicOnError)
+	p.Registerer.RegisterFlags(own)
+	own.VisitAll(func(fl *flag.Flag) {
+		f.Var(fl.Value, p.Prefix+fl.Name, fl.Usage)
+	})
+}
+
 // DayValue is a model.Time that can be used as a flag.
 // NB it only parses days!
 type DayValue struct {
@@ -80,3 +155,18 @@ func (v *URLValue) Set(s string) error {
 	v.URL = u
 	return nil
 }
+
+// StringListValue is a list of strings that can be used as a flag, by giving
+// the flag multiple times.
+type StringListValue []string
+
+// String implements flag.Value
+func (v StringListValue) String() string {
+	return strings.Join(v, ",")
+}
+
+// Set implements flag.Value
+func (v *StringListValue) Set(s string) error {
+	*v = append(*v, s)
+	return nil
+}
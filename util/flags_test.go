@@ -0,0 +1,58 @@
+package util
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConfig struct {
+	Period  time.Duration
+	Enabled bool
+	Name    string
+}
+
+func (cfg *testConfig) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.Period, "test.period", time.Minute, "")
+	f.BoolVar(&cfg.Enabled, "test.enabled", false, "")
+}
+
+type otherTestConfig struct {
+	testConfig
+}
+
+func (cfg *otherTestConfig) RegisterFlags(f *flag.FlagSet) {
+	cfg.testConfig.RegisterFlags(f)
+	f.StringVar(&cfg.Name, "test.name", "other", "")
+}
+
+func TestRegisterSharedFlags(t *testing.T) {
+	defer func(commandLine *flag.FlagSet) { flag.CommandLine = commandLine }(flag.CommandLine)
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+
+	var a testConfig
+	var b otherTestConfig
+	RegisterSharedFlags(&a, &b)
+	assert.Equal(t, "1m0s", flag.Lookup("test.period").DefValue)
+	assert.Equal(t, "other", b.Name)
+
+	require.NoError(t, flag.CommandLine.Parse([]string{"-test.period=5m", "-test.enabled", "-test.name=b"}))
+	assert.Equal(t, testConfig{Period: 5 * time.Minute, Enabled: true}, a)
+	assert.Equal(t, testConfig{Period: 5 * time.Minute, Enabled: true, Name: "b"}, b.testConfig)
+}
+
+func TestPrefixedRegisterer(t *testing.T) {
+	f := flag.NewFlagSet("test", flag.ContinueOnError)
+	var a, b testConfig
+	PrefixedRegisterer{"a.", &a}.RegisterFlags(f)
+	PrefixedRegisterer{"b.", &b}.RegisterFlags(f)
+	assert.Equal(t, "1m0s", f.Lookup("a.test.period").DefValue)
+	assert.Nil(t, f.Lookup("test.period"))
+
+	require.NoError(t, f.Parse([]string{"-a.test.period=5m", "-b.test.enabled"}))
+	assert.Equal(t, testConfig{Period: 5 * time.Minute}, a)
+	assert.Equal(t, testConfig{Period: time.Minute, Enabled: true}, b)
+}
@@ -0,0 +1,114 @@
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+// Checks which take longer than this fail, so a hung dependency doesn't
+// hang the probe.
+const readinessTimeout = 5 * time.Second
+
+// ReadinessCheck returns an error if what it checks isn't ready to serve.
+type ReadinessCheck func(ctx context.Context) error
+
+// Readiness serves the readiness of a process: it's ready when all of its
+// checks pass.
+type Readiness struct {
+	timeout time.Duration
+
+	mtx    sync.Mutex
+	names  []string
+	checks map[string]ReadinessCheck
+}
+
+// NewReadiness makes a new Readiness, with no checks.
+func NewReadiness() *Readiness {
+	return &Readiness{
+		timeout: readinessTimeout,
+		checks:  map[string]ReadinessCheck{},
+	}
+}
+
+// Register serves readiness on /ready, and liveness on /healthz.
+func (r *Readiness) Register(router *mux.Router) {
+	router.Handle("/ready", r)
+	router.HandleFunc("/healthz", HealthzHandler)
+}
+
+// Add a check, replacing any check with the same name.
+func (r *Readiness) Add(name string, check ReadinessCheck) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.checks[name]; !ok {
+		r.names = append(r.names, name)
+	}
+	r.checks[name] = check
+}
+
+// Check runs the checks concurrently, and returns the error of each check,
+// nil if it passed, in the order they were added.
+func (r *Readiness) Check(ctx context.Context) ([]string, []error) {
+	r.mtx.Lock()
+	names := append([]string(nil), r.names...)
+	checks := make([]ReadinessCheck, 0, len(names))
+	for _, name := range names {
+		checks = append(checks, r.checks[name])
+	}
+	r.mtx.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check ReadinessCheck) {
+			defer wg.Done()
+			done := make(chan error, 1)
+			go func() {
+				done <- check(ctx)
+			}()
+			select {
+			case errs[i] = <-done:
+			case <-ctx.Done():
+				errs[i] = fmt.Errorf("timed out after %s", r.timeout)
+			}
+		}(i, check)
+	}
+	wg.Wait()
+	return names, errs
+}
+
+// ServeHTTP responds 200 if every check passes, and 503 otherwise, with
+// the result of each check.
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	names, errs := r.Check(req.Context())
+	status, body := http.StatusOK, ""
+	for i, name := range names {
+		result := "ok"
+		if errs[i] != nil {
+			status, result = http.StatusServiceUnavailable, errs[i].Error()
+		}
+		body += fmt.Sprintf("%s: %s\n", name, result)
+	}
+	if len(names) == 0 {
+		body = "ready\n"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, body)
+}
+
+// HealthzHandler responds 200 as long as the process can serve HTTP.  It
+// checks nothing else, so dependencies being down don't get a process
+// restarted.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "ok\n")
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestReadiness(t *testing.T) {
+	r := NewReadiness()
+	router := mux.NewRouter()
+	r.Register(router)
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.String()
+	}
+
+	code, body := get("/ready")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready\n", body)
+
+	var ringErr error
+	r.Add("ring", func(context.Context) error { return ringErr })
+	r.Add("store", func(context.Context) error { return nil })
+	code, body = get("/ready")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ring: ok\nstore: ok\n", body)
+
+	ringErr = fmt.Errorf("the ring has no tokens yet")
+	code, body = get("/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "ring: the ring has no tokens yet\nstore: ok\n", body)
+
+	// Liveness doesn't depend on the checks.
+	code, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestReadinessTimeout(t *testing.T) {
+	r := NewReadiness()
+	r.timeout = 10 * time.Millisecond
+	block := make(chan struct{})
+	defer close(block)
+	r.Add("hung", func(context.Context) error {
+		<-block
+		return nil
+	})
+	_, errs := r.Check(context.Background())
+	assert.Error(t, errs[0])
+}
@@ -2,9 +2,43 @@ package util
 
 import (
 	"encoding/json"
+	"flag"
 	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
 )
 
+// PathPrefixConfig configures a path prefix for all the HTTP API endpoints,
+// so Cortex can be served behind a shared ingress path.
+type PathPrefixConfig struct {
+	Prefix string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *PathPrefixConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Prefix, "http.prefix", "", "Path prefix of the HTTP API endpoints, e.g. /cortex. /metrics, /debug, /ready and /healthz aren't prefixed.")
+}
+
+// Path returns the prefix, with a leading slash and no trailing slash, or
+// "" for no prefix.
+func (cfg PathPrefixConfig) Path() string {
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// Router returns a router for the endpoints under the prefix.
+func (cfg PathPrefixConfig) Router(r *mux.Router) *mux.Router {
+	prefix := cfg.Path()
+	if prefix == "" {
+		return r
+	}
+	return r.PathPrefix(prefix).Subrouter()
+}
+
 // WriteJSONResponse writes some JSON as a HTTP response.
 func WriteJSONResponse(w http.ResponseWriter, v interface{}) {
 	data, err := json.Marshal(v)
@@ -0,0 +1,50 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, path string
+	}{
+		{"", ""},
+		{"/", ""},
+		{"cortex", "/cortex"},
+		{"/cortex/", "/cortex"},
+		{"/shared/cortex", "/shared/cortex"},
+	} {
+		assert.Equal(t, tc.path, PathPrefixConfig{Prefix: tc.prefix}.Path(), tc.prefix)
+	}
+}
+
+func TestPathPrefixRouter(t *testing.T) {
+	for _, tc := range []struct {
+		prefix string
+		paths  map[string]int
+	}{
+		{"", map[string]int{
+			"/api/prom/push":        http.StatusOK,
+			"/cortex/api/prom/push": http.StatusNotFound,
+		}},
+		{"/cortex/", map[string]int{
+			"/api/prom/push":        http.StatusNotFound,
+			"/cortex/api/prom/push": http.StatusOK,
+			"/metrics":              http.StatusOK,
+		}},
+	} {
+		r := mux.NewRouter()
+		r.HandleFunc("/metrics", func(http.ResponseWriter, *http.Request) {})
+		PathPrefixConfig{Prefix: tc.prefix}.Router(r).HandleFunc("/api/prom/push", func(http.ResponseWriter, *http.Request) {})
+		for path, code := range tc.paths {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			assert.Equal(t, code, w.Code, "%q: %s", tc.prefix, path)
+		}
+	}
+}
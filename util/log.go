@@ -0,0 +1,127 @@
+package util
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	opentracing "github.com/opentracing/opentracing-go"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// logFormat wraps the -log.format flag so it also takes "json", for logs
+// our log pipeline can parse.
+var logFormat = &logFormatValue{format: "logger:stderr"}
+
+func init() {
+	if f := flag.CommandLine.Lookup("log.format"); f != nil {
+		logFormat.Value = f.Value
+		f.Value = logFormat
+		f.Usage = `Set the log format: "json", for a JSON object per line with level, ts, component, tenant and traceID fields, or the log target and format, e.g. "logger:syslog?appname=bob&local=7".`
+	}
+}
+
+type logFormatValue struct {
+	flag.Value
+	format string
+}
+
+func (l *logFormatValue) String() string {
+	return l.format
+}
+
+// Set the format of Cortex's logger, the logrus one the server middleware
+// logs with, and the prometheus one vendored libraries log with.  For "json",
+// vendored libraries log logrus' JSON objects, which have no component.
+func (l *logFormatValue) Set(format string) error {
+	if format != "json" {
+		if err := l.Value.Set(format); err != nil {
+			return err
+		}
+		if err := log.SetFormat(format); err != nil {
+			return err
+		}
+		l.format = format
+		return nil
+	}
+	if err := l.Value.Set("logger:stderr?json=true"); err != nil {
+		return err
+	}
+	formatter := jsonFormatter{component: filepath.Base(os.Args[0])}
+	log.SetFormatter(formatter)
+	log.SetOutput(os.Stderr)
+	logrus.SetFormatter(formatter)
+	logrus.SetOutput(os.Stderr)
+	l.format = format
+	return nil
+}
+
+// jsonFormatter formats log entries as a JSON object per line.  Entries
+// without a component field are given the name of the binary.
+type jsonFormatter struct {
+	component string
+}
+
+func (f jsonFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	data := make(logrus.Fields, len(entry.Data)+4)
+	for k, v := range entry.Data {
+		if err, ok := v.(error); ok {
+			// encoding/json would give {} for most errors.
+			v = err.Error()
+		}
+		data[k] = v
+	}
+	if _, ok := data["component"]; !ok {
+		data["component"] = f.component
+	}
+	data["level"] = entry.Level.String()
+	data["ts"] = entry.Time.UTC().Format(time.RFC3339Nano)
+	data["msg"] = entry.Message
+
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal log entry: %v", err)
+	}
+	return append(buf, '\n'), nil
+}
+
+// WithContext returns a Logger that adds the tenant and trace ID of ctx, if
+// it has them, to what's logged.
+func WithContext(ctx context.Context, l log.Logger) log.Logger {
+	if userID, err := user.Extract(ctx); err == nil {
+		l = l.With("tenant", userID)
+	}
+	if traceID := traceID(ctx); traceID != "" {
+		l = l.With("traceID", traceID)
+	}
+	return l
+}
+
+// traceID returns the ID of the trace of the span in ctx.  OpenTracing
+// doesn't expose trace IDs, so it's read from the span's propagation headers,
+// for Zipkin and Jaeger tracers.
+func traceID(ctx context.Context) string {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return ""
+	}
+	carrier := opentracing.TextMapCarrier{}
+	if err := span.Tracer().Inject(span.Context(), opentracing.TextMap, carrier); err != nil {
+		return ""
+	}
+	if id, ok := carrier["x-b3-traceid"]; ok {
+		return id
+	}
+	if state, ok := carrier["uber-trace-id"]; ok {
+		return strings.SplitN(state, ":", 2)[0]
+	}
+	return ""
+}
@@ -0,0 +1,378 @@
+// Package log has the API of github.com/prometheus/common/log, but logs with
+// a logrus logger of Cortex's own, so Cortex can change its level, format and
+// target while it logs.  Vendored libraries still log with
+// github.com/prometheus/common/log.
+package log
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/common/log"
+)
+
+// Logger is the interface for loggers used in Cortex.  It's the one of
+// github.com/prometheus/common/log, so the same loggers can be passed to
+// vendored libraries.
+type Logger = log.Logger
+
+// output is the formatter of origLogger.  logrus reads a logger's Formatter,
+// Out and Level without locking, so they're never changed after init;
+// instead output formats and writes entries, under its lock, with a
+// formatter and writer which can be swapped.  Formatters which write entries
+// themselves, e.g. to syslog, return no bytes.
+type output struct {
+	mtx       sync.Mutex
+	formatter logrus.Formatter
+	out       io.Writer
+}
+
+func (o *output) Format(entry *logrus.Entry) ([]byte, error) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	serialized, err := o.formatter.Format(entry)
+	if err != nil || serialized == nil {
+		return nil, err
+	}
+	if _, err := o.out.Write(serialized); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+var (
+	level = uint32(logrus.InfoLevel)
+	std   = &output{
+		formatter: &logrus.TextFormatter{},
+		out:       os.Stderr,
+	}
+	origLogger = &logrus.Logger{
+		Out:       ioutil.Discard,
+		Formatter: std,
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	baseLogger = logger{entry: logrus.NewEntry(origLogger)}
+)
+
+// SetLevel sets the level of the default Logger.
+func SetLevel(l logrus.Level) {
+	atomic.StoreUint32(&level, uint32(l))
+}
+
+// SetFormatter sets the formatter of the default Logger.
+func SetFormatter(formatter logrus.Formatter) {
+	std.mtx.Lock()
+	defer std.mtx.Unlock()
+	std.formatter = formatter
+}
+
+// SetOutput sets where the default Logger writes to.
+func SetOutput(out io.Writer) {
+	std.mtx.Lock()
+	defer std.mtx.Unlock()
+	std.out = out
+}
+
+func enabled(l logrus.Level) bool {
+	return l <= logrus.Level(atomic.LoadUint32(&level))
+}
+
+type logger struct {
+	entry *logrus.Entry
+}
+
+// Base returns the default Logger.
+func Base() Logger {
+	return baseLogger
+}
+
+// NewLogger returns a new Logger logging to out, at the level of the default
+// Logger.
+func NewLogger(w io.Writer) Logger {
+	l := logrus.New()
+	l.Out = w
+	l.Level = logrus.DebugLevel
+	return logger{entry: logrus.NewEntry(l)}
+}
+
+// NewNopLogger returns a logger that discards all log messages.
+func NewNopLogger() Logger {
+	return NewLogger(ioutil.Discard)
+}
+
+// With adds a field to the logger.
+func (l logger) With(key string, value interface{}) Logger {
+	return logger{l.entry.WithField(key, value)}
+}
+
+// Debug logs a message at level Debug.
+func (l logger) Debug(args ...interface{}) {
+	if enabled(logrus.DebugLevel) {
+		l.sourced().Debug(args...)
+	}
+}
+
+// Debugln logs a message at level Debug.
+func (l logger) Debugln(args ...interface{}) {
+	if enabled(logrus.DebugLevel) {
+		l.sourced().Debugln(args...)
+	}
+}
+
+// Debugf logs a message at level Debug.
+func (l logger) Debugf(format string, args ...interface{}) {
+	if enabled(logrus.DebugLevel) {
+		l.sourced().Debugf(format, args...)
+	}
+}
+
+// Info logs a message at level Info.
+func (l logger) Info(args ...interface{}) {
+	if enabled(logrus.InfoLevel) {
+		l.sourced().Info(args...)
+	}
+}
+
+// Infoln logs a message at level Info.
+func (l logger) Infoln(args ...interface{}) {
+	if enabled(logrus.InfoLevel) {
+		l.sourced().Infoln(args...)
+	}
+}
+
+// Infof logs a message at level Info.
+func (l logger) Infof(format string, args ...interface{}) {
+	if enabled(logrus.InfoLevel) {
+		l.sourced().Infof(format, args...)
+	}
+}
+
+// Warn logs a message at level Warn.
+func (l logger) Warn(args ...interface{}) {
+	if enabled(logrus.WarnLevel) {
+		l.sourced().Warn(args...)
+	}
+}
+
+// Warnln logs a message at level Warn.
+func (l logger) Warnln(args ...interface{}) {
+	if enabled(logrus.WarnLevel) {
+		l.sourced().Warnln(args...)
+	}
+}
+
+// Warnf logs a message at level Warn.
+func (l logger) Warnf(format string, args ...interface{}) {
+	if enabled(logrus.WarnLevel) {
+		l.sourced().Warnf(format, args...)
+	}
+}
+
+// Error logs a message at level Error.
+func (l logger) Error(args ...interface{}) {
+	if enabled(logrus.ErrorLevel) {
+		l.sourced().Error(args...)
+	}
+}
+
+// Errorln logs a message at level Error.
+func (l logger) Errorln(args ...interface{}) {
+	if enabled(logrus.ErrorLevel) {
+		l.sourced().Errorln(args...)
+	}
+}
+
+// Errorf logs a message at level Error.
+func (l logger) Errorf(format string, args ...interface{}) {
+	if enabled(logrus.ErrorLevel) {
+		l.sourced().Errorf(format, args...)
+	}
+}
+
+// Fatal logs a message at level Fatal, and exits.
+func (l logger) Fatal(args ...interface{}) {
+	l.sourced().Fatal(args...)
+}
+
+// Fatalln logs a message at level Fatal, and exits.
+func (l logger) Fatalln(args ...interface{}) {
+	l.sourced().Fatalln(args...)
+}
+
+// Fatalf logs a message at level Fatal, and exits.
+func (l logger) Fatalf(format string, args ...interface{}) {
+	l.sourced().Fatalf(format, args...)
+}
+
+// sourced adds a source field to the logger that contains
+// the file name and line where the logging happened.
+func (l logger) sourced() *logrus.Entry {
+	return l.entry.WithField("source", source(3))
+}
+
+func source(skip int) string {
+	_, file, line, ok := runtime.Caller(skip)
+	if !ok {
+		file = "<???>"
+		line = 1
+	} else {
+		slash := strings.LastIndex(file, "/")
+		file = file[slash+1:]
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+// With adds a field to the default Logger.
+func With(key string, value interface{}) Logger {
+	return baseLogger.With(key, value)
+}
+
+// Debug logs a message at level Debug on the default Logger.
+func Debug(args ...interface{}) {
+	if enabled(logrus.DebugLevel) {
+		baseLogger.sourced().Debug(args...)
+	}
+}
+
+// Debugln logs a message at level Debug on the default Logger.
+func Debugln(args ...interface{}) {
+	if enabled(logrus.DebugLevel) {
+		baseLogger.sourced().Debugln(args...)
+	}
+}
+
+// Debugf logs a message at level Debug on the default Logger.
+func Debugf(format string, args ...interface{}) {
+	if enabled(logrus.DebugLevel) {
+		baseLogger.sourced().Debugf(format, args...)
+	}
+}
+
+// Info logs a message at level Info on the default Logger.
+func Info(args ...interface{}) {
+	if enabled(logrus.InfoLevel) {
+		baseLogger.sourced().Info(args...)
+	}
+}
+
+// Infoln logs a message at level Info on the default Logger.
+func Infoln(args ...interface{}) {
+	if enabled(logrus.InfoLevel) {
+		baseLogger.sourced().Infoln(args...)
+	}
+}
+
+// Infof logs a message at level Info on the default Logger.
+func Infof(format string, args ...interface{}) {
+	if enabled(logrus.InfoLevel) {
+		baseLogger.sourced().Infof(format, args...)
+	}
+}
+
+// Warn logs a message at level Warn on the default Logger.
+func Warn(args ...interface{}) {
+	if enabled(logrus.WarnLevel) {
+		baseLogger.sourced().Warn(args...)
+	}
+}
+
+// Warnln logs a message at level Warn on the default Logger.
+func Warnln(args ...interface{}) {
+	if enabled(logrus.WarnLevel) {
+		baseLogger.sourced().Warnln(args...)
+	}
+}
+
+// Warnf logs a message at level Warn on the default Logger.
+func Warnf(format string, args ...interface{}) {
+	if enabled(logrus.WarnLevel) {
+		baseLogger.sourced().Warnf(format, args...)
+	}
+}
+
+// Error logs a message at level Error on the default Logger.
+func Error(args ...interface{}) {
+	if enabled(logrus.ErrorLevel) {
+		baseLogger.sourced().Error(args...)
+	}
+}
+
+// Errorln logs a message at level Error on the default Logger.
+func Errorln(args ...interface{}) {
+	if enabled(logrus.ErrorLevel) {
+		baseLogger.sourced().Errorln(args...)
+	}
+}
+
+// Errorf logs a message at level Error on the default Logger.
+func Errorf(format string, args ...interface{}) {
+	if enabled(logrus.ErrorLevel) {
+		baseLogger.sourced().Errorf(format, args...)
+	}
+}
+
+// Fatal logs a message at level Fatal on the default Logger, and exits.
+func Fatal(args ...interface{}) {
+	baseLogger.sourced().Fatal(args...)
+}
+
+// Fatalln logs a message at level Fatal on the default Logger, and exits.
+func Fatalln(args ...interface{}) {
+	baseLogger.sourced().Fatalln(args...)
+}
+
+// Fatalf logs a message at level Fatal on the default Logger, and exits.
+func Fatalf(format string, args ...interface{}) {
+	baseLogger.sourced().Fatalf(format, args...)
+}
+
+// newSyslogFormatter is nil if the target architecture does not support
+// syslog.
+var newSyslogFormatter func(appname, facility string, wrap logrus.Formatter) (logrus.Formatter, error)
+
+// SetFormat sets the target and format of the default Logger from a
+// -log.format URL, e.g. "logger:syslog?appname=bob&local=7" or
+// "logger:stdout?json=true".
+func SetFormat(format string) error {
+	u, err := url.Parse(format)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "logger" {
+		return fmt.Errorf("invalid scheme %s", u.Scheme)
+	}
+	var formatter logrus.Formatter = &logrus.TextFormatter{}
+	if u.Query().Get("json") == "true" {
+		formatter = &logrus.JSONFormatter{}
+	}
+
+	switch u.Opaque {
+	case "syslog":
+		if newSyslogFormatter == nil {
+			return fmt.Errorf("system does not support syslog")
+		}
+		formatter, err = newSyslogFormatter(u.Query().Get("appname"), u.Query().Get("local"), formatter)
+		if err != nil {
+			return err
+		}
+		SetFormatter(formatter)
+	case "stdout":
+		SetFormatter(formatter)
+		SetOutput(os.Stdout)
+	case "stderr":
+		SetFormatter(formatter)
+		SetOutput(os.Stderr)
+	default:
+		return fmt.Errorf("unsupported logger %q", u.Opaque)
+	}
+	return nil
+}
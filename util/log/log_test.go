@@ -0,0 +1,53 @@
+package log
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultLogger(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stderr)
+	defer SetLevel(logrus.InfoLevel)
+
+	Debugf("hidden")
+	Infof("shown %d", 1)
+	assert.NotContains(t, buf.String(), "hidden")
+	assert.Contains(t, buf.String(), "shown 1")
+	assert.Contains(t, buf.String(), "source=\"log_test.go:")
+
+	SetLevel(logrus.DebugLevel)
+	With("tenant", "1").Debug("now shown")
+	assert.Contains(t, buf.String(), "now shown")
+	assert.Contains(t, buf.String(), "tenant=1")
+}
+
+func TestSetFormatterWhileLogging(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stderr)
+	defer SetFormatter(&logrus.TextFormatter{})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			Infof("line %d", i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			SetFormatter(&logrus.JSONFormatter{})
+		}
+	}()
+	wg.Wait()
+	assert.Contains(t, buf.String(), "line 99")
+}
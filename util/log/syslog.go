@@ -0,0 +1,62 @@
+// +build !windows,!nacl,!plan9
+
+package log
+
+import (
+	"fmt"
+	"log/syslog"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func init() {
+	newSyslogFormatter = func(appname, facility string, wrap logrus.Formatter) (logrus.Formatter, error) {
+		if appname == "" {
+			return nil, fmt.Errorf("missing appname parameter")
+		}
+		if facility == "" {
+			return nil, fmt.Errorf("missing local parameter")
+		}
+		if len(facility) != 1 || facility[0] < '0' || facility[0] > '7' {
+			return nil, fmt.Errorf("invalid local(%s) for syslog", facility)
+		}
+		out, err := syslog.New(syslog.LOG_LOCAL0+syslog.Priority(facility[0]-'0')<<3, appname)
+		if err != nil {
+			return nil, fmt.Errorf("can't connect logger to syslog: %v", err)
+		}
+		return &syslogFormatter{wrap: wrap, out: out}, nil
+	}
+}
+
+var ceeTag = []byte("@cee:")
+
+// syslogFormatter sends entries to syslog, at their level, rather than
+// returning them.
+type syslogFormatter struct {
+	wrap logrus.Formatter
+	out  *syslog.Writer
+}
+
+func (s *syslogFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	data, err := s.wrap.Format(e)
+	if err != nil {
+		return nil, err
+	}
+	line := string(append(ceeTag, data...))
+
+	switch e.Level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		err = s.out.Crit(line)
+	case logrus.ErrorLevel:
+		err = s.out.Err(line)
+	case logrus.WarnLevel:
+		err = s.out.Warning(line)
+	case logrus.InfoLevel:
+		err = s.out.Info(line)
+	case logrus.DebugLevel:
+		err = s.out.Debug(line)
+	default:
+		err = s.out.Notice(line)
+	}
+	return nil, err
+}
@@ -0,0 +1,124 @@
+package util
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+// logLevel wraps the -log.level flag, which can't report the level it was
+// set to, so the level can be read and changed at runtime.
+var logLevel = &logLevelValue{level: "info"}
+
+func init() {
+	if f := flag.CommandLine.Lookup("log.level"); f != nil {
+		logLevel.Value = f.Value
+		f.Value = logLevel
+	}
+}
+
+type logLevelValue struct {
+	flag.Value
+
+	mtx    sync.Mutex
+	level  string
+	revert *time.Timer
+}
+
+func (l *logLevelValue) String() string {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.level
+}
+
+// Set the level of Cortex's logger, the logrus one the server middleware
+// logs with, and the prometheus one vendored libraries log with.
+func (l *logLevelValue) Set(level string) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.set(level)
+}
+
+func (l *logLevelValue) set(level string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	if l.Value != nil {
+		if err := l.Value.Set(level); err != nil {
+			return err
+		}
+	}
+	log.SetLevel(lvl)
+	logrus.SetLevel(lvl)
+	l.level = level
+	return nil
+}
+
+// setFor sets the level, and if d is non-zero, restores the current one
+// after d.
+func (l *logLevelValue) setFor(level string, d time.Duration) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	previous := l.level
+	if err := l.set(level); err != nil {
+		return err
+	}
+	if l.revert != nil {
+		l.revert.Stop()
+		l.revert = nil
+	}
+	if d > 0 {
+		l.revert = time.AfterFunc(d, func() {
+			l.mtx.Lock()
+			defer l.mtx.Unlock()
+			log.Infof("Restoring log level %s", previous)
+			l.set(previous)
+			l.revert = nil
+		})
+	}
+	return nil
+}
+
+// RegisterLogLevel serves LogLevelHandler on /log_level, wrapped in m.
+func RegisterLogLevel(router *mux.Router, m middleware.Interface) {
+	router.Handle("/log_level", m.Wrap(http.HandlerFunc(LogLevelHandler))).Methods("GET", "POST")
+}
+
+// LogLevelHandler reports the log level on a GET, and changes it on a POST
+// with a level of debug, info, warn or error.  If duration is given too,
+// e.g. 10m, the previous level is restored after it.
+func LogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		level := r.FormValue("level")
+		var d time.Duration
+		if s := r.FormValue("duration"); s != "" {
+			var err error
+			if d, err = time.ParseDuration(s); err != nil {
+				http.Error(w, fmt.Sprintf("invalid duration: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		switch level {
+		case "debug", "info", "warn", "error":
+		default:
+			http.Error(w, fmt.Sprintf("invalid level %q, must be debug, info, warn or error", level), http.StatusBadRequest)
+			return
+		}
+		if err := logLevel.setFor(level, d); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("Log level set to %s", level)
+	}
+	WriteJSONResponse(w, map[string]string{"level": logLevel.String()})
+}
@@ -0,0 +1,63 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/common/middleware"
+)
+
+func TestLogLevelHandler(t *testing.T) {
+	noop := middleware.Func(func(next http.Handler) http.Handler { return next })
+	router := mux.NewRouter()
+	RegisterLogLevel(router, noop)
+	do := func(method string, form url.Values) (int, string) {
+		r := httptest.NewRequest(method, "/log_level", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		var resp map[string]string
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		}
+		return w.Code, resp["level"]
+	}
+	defer logLevel.Set("info")
+
+	code, level := do("GET", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "info", level)
+
+	code, level = do("POST", url.Values{"level": {"debug"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "debug", level)
+	assert.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+
+	code, _ = do("POST", url.Values{"level": {"verbose"}})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do("POST", url.Values{"level": {"warn"}, "duration": {"soon"}})
+	assert.Equal(t, http.StatusBadRequest, code)
+	_, level = do("GET", nil)
+	assert.Equal(t, "debug", level)
+
+	// With a duration, the previous level comes back.
+	code, level = do("POST", url.Values{"level": {"warn"}, "duration": {"10ms"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "warn", level)
+	deadline := time.Now().Add(time.Second)
+	for level != "debug" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		_, level = do("GET", nil)
+	}
+	assert.Equal(t, "debug", level)
+}
@@ -0,0 +1,60 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	opentracing "github.com/opentracing/opentracing-go"
+	zipkin "github.com/openzipkin/zipkin-go-opentracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util/log"
+)
+
+func TestJSONFormatter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter = jsonFormatter{component: "ingester"}
+
+	logger.WithField("err", fmt.Errorf("boom")).Warn("flush failed")
+	logger.WithField("component", "nflog").Info("gc")
+
+	dec := json.NewDecoder(&buf)
+	var entry map[string]string
+	require.NoError(t, dec.Decode(&entry))
+	assert.Equal(t, "warning", entry["level"])
+	assert.Equal(t, "ingester", entry["component"])
+	assert.Equal(t, "flush failed", entry["msg"])
+	assert.Equal(t, "boom", entry["err"])
+	assert.NotEmpty(t, entry["ts"])
+
+	require.NoError(t, dec.Decode(&entry))
+	assert.Equal(t, "nflog", entry["component"])
+}
+
+func TestWithContext(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.NewLogger(&buf)
+
+	WithContext(context.Background(), logger).Info("no context")
+	assert.NotContains(t, buf.String(), "tenant")
+
+	tracer, err := zipkin.NewTracer(zipkin.NewInMemoryRecorder())
+	require.NoError(t, err)
+	span := tracer.StartSpan("test")
+	defer span.Finish()
+	ctx := opentracing.ContextWithSpan(user.Inject(context.Background(), "1"), span)
+	traceID := span.Context().(zipkin.SpanContext).TraceID.ToHex()
+
+	buf.Reset()
+	WithContext(ctx, logger).Info("in a request")
+	assert.Contains(t, buf.String(), "tenant=1")
+	assert.Contains(t, buf.String(), "traceID="+traceID)
+}
@@ -0,0 +1,104 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// Pools of the buffers, snappy writers and snappy readers used to encode and
+// decode chunks and requests, which would otherwise account for much of the
+// garbage on the write and read paths.  Snappy writers and readers each
+// allocate ~140KB of buffers.
+var (
+	bufferPool = sync.Pool{
+		New: func() interface{} { return &bytes.Buffer{} },
+	}
+	snappyWriterPool = sync.Pool{
+		New: func() interface{} { return snappy.NewWriter(nil) },
+	}
+	snappyBufferedWriterPool = sync.Pool{
+		New: func() interface{} { return snappy.NewBufferedWriter(nil) },
+	}
+	snappyReaderPool = sync.Pool{
+		New: func() interface{} { return snappy.NewReader(nil) },
+	}
+)
+
+// GetBuffer returns an empty buffer from the pool.
+func GetBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// PutBuffer returns a buffer to the pool; it must not be used, nor its bytes,
+// afterwards.
+func PutBuffer(buf *bytes.Buffer) {
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// GetSnappyWriter returns an unbuffered snappy writer, as made by
+// snappy.NewWriter, writing to w.
+func GetSnappyWriter(w io.Writer) *snappy.Writer {
+	sw := snappyWriterPool.Get().(*snappy.Writer)
+	sw.Reset(w)
+	return sw
+}
+
+// PutSnappyWriter returns a writer from GetSnappyWriter to the pool.
+func PutSnappyWriter(sw *snappy.Writer) {
+	sw.Reset(nil)
+	snappyWriterPool.Put(sw)
+}
+
+// GetSnappyBufferedWriter returns a buffered snappy writer, as made by
+// snappy.NewBufferedWriter, writing to w.  It must be closed before being
+// returned to the pool.
+func GetSnappyBufferedWriter(w io.Writer) *snappy.Writer {
+	sw := snappyBufferedWriterPool.Get().(*snappy.Writer)
+	sw.Reset(w)
+	return sw
+}
+
+// PutSnappyBufferedWriter returns a writer from GetSnappyBufferedWriter to
+// the pool.
+func PutSnappyBufferedWriter(sw *snappy.Writer) {
+	sw.Reset(nil)
+	snappyBufferedWriterPool.Put(sw)
+}
+
+// GetSnappyReader returns a snappy reader reading from r.
+func GetSnappyReader(r io.Reader) *snappy.Reader {
+	sr := snappyReaderPool.Get().(*snappy.Reader)
+	sr.Reset(r)
+	return sr
+}
+
+// PutSnappyReader returns a reader from GetSnappyReader to the pool.
+func PutSnappyReader(sr *snappy.Reader) {
+	sr.Reset(nil)
+	snappyReaderPool.Put(sr)
+}
+
+// sizedMarshaler is a generated protobuf message.
+type sizedMarshaler interface {
+	Size() int
+	MarshalTo([]byte) (int, error)
+}
+
+// MarshalToBuffer marshals m into the spare capacity of buf, typically from
+// GetBuffer, growing it if needed, and returns the marshalled bytes, which
+// are only valid until buf is reused.
+func MarshalToBuffer(buf *bytes.Buffer, m sizedMarshaler) ([]byte, error) {
+	size := m.Size()
+	buf.Reset()
+	buf.Grow(size)
+	data := buf.Bytes()[:size]
+	n, err := m.MarshalTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
@@ -0,0 +1,58 @@
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util/wire"
+)
+
+func TestSnappyPools(t *testing.T) {
+	// Pooled writers and readers start a new stream each time they're reused.
+	for _, buffered := range []bool{false, true} {
+		for i := 0; i < 3; i++ {
+			var buf bytes.Buffer
+			var err error
+			if buffered {
+				w := GetSnappyBufferedWriter(&buf)
+				_, err = w.Write([]byte("hello"))
+				require.NoError(t, err)
+				require.NoError(t, w.Close())
+				PutSnappyBufferedWriter(w)
+			} else {
+				w := GetSnappyWriter(&buf)
+				_, err = w.Write([]byte("hello"))
+				require.NoError(t, err)
+				PutSnappyWriter(w)
+			}
+
+			r := GetSnappyReader(&buf)
+			out, err := ioutil.ReadAll(r)
+			PutSnappyReader(r)
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(out))
+		}
+	}
+}
+
+func TestMarshalToBuffer(t *testing.T) {
+	req := &cortex.WriteRequest{Timeseries: []cortex.TimeSeries{{
+		Labels:  []cortex.LabelPair{{Name: wire.Bytes("__name__"), Value: wire.Bytes("foo")}},
+		Samples: []cortex.Sample{{Value: 1, TimestampMs: 2}},
+	}}}
+	expected, err := proto.Marshal(req)
+	require.NoError(t, err)
+
+	buf := GetBuffer()
+	defer PutBuffer(buf)
+	buf.WriteString("leftovers")
+	data, err := MarshalToBuffer(buf, req)
+	require.NoError(t, err)
+	assert.Equal(t, expected, data)
+}
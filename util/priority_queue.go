@@ -66,6 +66,19 @@ func (pq *PriorityQueue) Close() {
 	pq.cond.Broadcast()
 }
 
+// DiscardAndClose closes the queue and discards the operations on it,
+// returning how many were discarded.
+func (pq *PriorityQueue) DiscardAndClose() int {
+	pq.lock.Lock()
+	defer pq.lock.Unlock()
+	discarded := len(pq.queue)
+	pq.queue = queue{}
+	pq.hit = map[string]struct{}{}
+	pq.closed = true
+	pq.cond.Broadcast()
+	return discarded
+}
+
 // Enqueue adds an operation to the queue in priority order. If the operation
 // is already on the queue, it will be ignored.
 func (pq *PriorityQueue) Enqueue(op Op) {
@@ -89,3 +89,12 @@ func TestPriorityQueueWait(t *testing.T) {
 		t.Fatal("Close didn't unblock Dequeue.")
 	}
 }
+
+func TestPriorityQueueDiscardAndClose(t *testing.T) {
+	queue := NewPriorityQueue()
+	queue.Enqueue(simpleItem(1))
+	queue.Enqueue(simpleItem(2))
+
+	assert.Equal(t, 2, queue.DiscardAndClose())
+	assert.Nil(t, queue.Dequeue(), "Expect nil dequeue")
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+type (
+	seriesLimitKey struct{}
+	chunkLimitKey  struct{}
+)
+
+// WithSeriesLimit returns a context limiting the number of series a query
+// made with it may fetch; 0 for no limit.
+func WithSeriesLimit(ctx context.Context, limit int) context.Context {
+	if limit <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, seriesLimitKey{}, limit)
+}
+
+// CheckSeriesLimit returns a SeriesLimitError if series is more than the
+// context's series limit.
+func CheckSeriesLimit(ctx context.Context, series int) error {
+	if limit, ok := ctx.Value(seriesLimitKey{}).(int); ok && series > limit {
+		return SeriesLimitError{Limit: limit}
+	}
+	return nil
+}
+
+// SeriesLimitError is returned by queries which would fetch more series than
+// the user's limit.
+type SeriesLimitError struct {
+	Limit int
+}
+
+func (e SeriesLimitError) Error() string {
+	return fmt.Sprintf("query matches more than the limit of %d series; use more specific label matchers", e.Limit)
+}
+
+// WithChunkLimit returns a context limiting the number of chunks a query made
+// with it may fetch from the chunk store; 0 for no limit.
+func WithChunkLimit(ctx context.Context, limit int) context.Context {
+	if limit <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, chunkLimitKey{}, limit)
+}
+
+// CheckChunkLimit returns a ChunkLimitError if chunks is more than the
+// context's chunk limit.
+func CheckChunkLimit(ctx context.Context, chunks int) error {
+	if limit, ok := ctx.Value(chunkLimitKey{}).(int); ok && chunks > limit {
+		return ChunkLimitError{Chunks: chunks, Limit: limit}
+	}
+	return nil
+}
+
+// ChunkLimitError is returned by queries which would fetch more chunks from
+// the chunk store than the user's limit.
+type ChunkLimitError struct {
+	Chunks, Limit int
+}
+
+func (e ChunkLimitError) Error() string {
+	return fmt.Sprintf("query would fetch %d chunks, more than the limit of %d; use more specific label matchers or a shorter time range", e.Chunks, e.Limit)
+}
@@ -0,0 +1,45 @@
+package util
+
+import (
+	"github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
+	"github.com/mwitkow/go-grpc-middleware"
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/server"
+)
+
+// NewServer makes a server.Server whose gRPC server also has the given
+// options, e.g. a codec or transport credentials, which server.Config has no
+// way to pass.
+func NewServer(cfg server.Config, grpcOptions ...grpc.ServerOption) (*server.Server, error) {
+	s, err := server.New(cfg)
+	if err != nil || len(grpcOptions) == 0 {
+		return s, err
+	}
+
+	// The gRPC server made by server.New isn't serving yet, so it's replaced
+	// with one with the same interceptors, which report to the request
+	// duration histogram server.New registered.
+	collector, err := prometheus.RegisterOrGet(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: cfg.MetricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time (in seconds) spent serving HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status_code", "ws"}))
+	if err != nil {
+		return nil, err
+	}
+	interceptors := append([]grpc.UnaryServerInterceptor{
+		middleware.ServerLoggingInterceptor,
+		middleware.ServerInstrumentInterceptor(collector.(*prometheus.HistogramVec)),
+		otgrpc.OpenTracingServerInterceptor(opentracing.GlobalTracer()),
+	}, cfg.GRPCMiddleware...)
+	s.GRPC.Stop()
+	s.GRPC = grpc.NewServer(append([]grpc.ServerOption{
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(interceptors...)),
+	}, grpcOptions...)...)
+	return s, nil
+}
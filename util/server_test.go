@@ -0,0 +1,17 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/server"
+)
+
+func TestNewServerGRPCOptions(t *testing.T) {
+	s, err := NewServer(server.Config{MetricsNamespace: "test"}, grpc.MaxConcurrentStreams(10))
+	require.NoError(t, err)
+	defer s.Shutdown()
+	require.NotNil(t, s.GRPC)
+}
@@ -0,0 +1,78 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig configures the TLS of a client: the certificate it presents, and
+// how it verifies the server's.
+type TLSConfig struct {
+	CertPath           string
+	KeyPath            string
+	CAPath             string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// RegisterFlagsWithPrefix adds the flags required to config this to the given
+// FlagSet, named after prefix, with help about connecting to target, e.g.
+// "the ingesters".
+func (cfg *TLSConfig) RegisterFlagsWithPrefix(prefix, target string, f *flag.FlagSet) {
+	f.StringVar(&cfg.CertPath, prefix+"tls-cert-path", "", "Client certificate to present to "+target+".")
+	f.StringVar(&cfg.KeyPath, prefix+"tls-key-path", "", "Key of the client certificate to present to "+target+".")
+	f.StringVar(&cfg.CAPath, prefix+"tls-ca-path", "", "CA certificates to verify the certificates of "+target+" with, instead of the system's.")
+	f.StringVar(&cfg.ServerName, prefix+"tls-server-name", "", "Name to verify the certificates of "+target+" against, instead of their address.")
+	f.BoolVar(&cfg.InsecureSkipVerify, prefix+"tls-insecure-skip-verify", false, "Skip verifying the certificates of "+target+".")
+}
+
+// GetTLSConfig returns the tls.Config to connect with.
+func (cfg TLSConfig) GetTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	var err error
+	if tlsConfig.Certificates, err = LoadCertificates(cfg.CertPath, cfg.KeyPath); err != nil {
+		return nil, err
+	}
+	if tlsConfig.RootCAs, err = LoadCertPool(cfg.CAPath); err != nil {
+		return nil, err
+	}
+	return tlsConfig, nil
+}
+
+// LoadCertificates loads the certificate and key at the given paths, if
+// they're set; both or neither have to be.
+func LoadCertificates(certPath, keyPath string) ([]tls.Certificate, error) {
+	if certPath == "" && keyPath == "" {
+		return nil, nil
+	}
+	if certPath == "" || keyPath == "" {
+		return nil, fmt.Errorf("a TLS certificate needs both a certificate and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return []tls.Certificate{cert}, nil
+}
+
+// LoadCertPool loads the PEM certificates at path, if it's set.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
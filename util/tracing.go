@@ -0,0 +1,210 @@
+package util
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/openzipkin/zipkin-go-opentracing"
+)
+
+// The sampler types supported.
+const (
+	SamplerConst         = "const"
+	SamplerProbabilistic = "probabilistic"
+)
+
+// TracingConfig configures where a component sends its traces, and which
+// traces it samples.
+type TracingConfig struct {
+	CollectorURL string
+	ServiceName  string
+	SamplerType  string
+	SamplerParam float64
+	Tags         string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *TracingConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.CollectorURL, "tracing.collector-url", "", "URL of the Zipkin HTTP collector to send traces to, e.g. http://zipkin:9411/api/v1/spans. If unset, traces are only kept in memory, and the other tracing flags are ignored.")
+	f.StringVar(&cfg.ServiceName, "tracing.service-name", "", "Service name traces are reported with. Defaults to the component's name.")
+	f.StringVar(&cfg.SamplerType, "tracing.sampler-type", SamplerConst, "How traces started by this component are sampled: "+SamplerConst+", sampling all traces if -tracing.sampler-param is non-zero and none otherwise, or "+SamplerProbabilistic+", sampling that fraction of traces. Traces started upstream keep their own sampling decision.")
+	f.Float64Var(&cfg.SamplerParam, "tracing.sampler-param", 1, "Parameter of the sampler; see -tracing.sampler-type.")
+	f.StringVar(&cfg.Tags, "tracing.tags", "", "Comma separated key=value tags to add to every span, e.g. cluster=prod,zone=a.")
+}
+
+// InitTracing installs the global tracer for component, if a collector is
+// configured.  It must be called before the server and clients are created,
+// as they take the global tracer when they are.  The returned Closer flushes
+// buffered spans.
+func (cfg TracingConfig) InitTracing(component string) (io.Closer, error) {
+	if cfg.CollectorURL == "" {
+		return nopCloser{}, nil
+	}
+
+	var sampler zipkintracer.Sampler
+	switch cfg.SamplerType {
+	case SamplerConst:
+		rate := 0.0
+		if cfg.SamplerParam != 0 {
+			rate = 1
+		}
+		sampler = zipkintracer.NewBoundarySampler(rate, 0)
+	case SamplerProbabilistic:
+		if cfg.SamplerParam < 0 || cfg.SamplerParam > 1 {
+			return nil, fmt.Errorf("-tracing.sampler-param must be between 0 and 1 for the %s sampler", SamplerProbabilistic)
+		}
+		// The same salt everywhere makes the same decision for a trace ID in
+		// every component.
+		sampler = zipkintracer.NewBoundarySampler(cfg.SamplerParam, 0)
+	default:
+		return nil, fmt.Errorf("unknown -tracing.sampler-type %q, choose one of: %s, %s", cfg.SamplerType, SamplerConst, SamplerProbabilistic)
+	}
+	tags, err := parseTracingTags(cfg.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = component
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	collector, err := zipkintracer.NewHTTPCollector(cfg.CollectorURL)
+	if err != nil {
+		return nil, err
+	}
+	recorder := zipkintracer.NewRecorder(collector, false, hostname, serviceName)
+	tracer, err := zipkintracer.NewTracer(recorder, zipkintracer.WithSampler(sampler), zipkintracer.TrimUnsampledSpans(true))
+	if err != nil {
+		collector.Close()
+		return nil, err
+	}
+	if len(tags) > 0 {
+		tracer = taggedTracer{Tracer: tracer, tags: tags}
+	}
+	opentracing.InitGlobalTracer(tracer)
+	return collector, nil
+}
+
+func parseTracingTags(s string) (opentracing.Tags, error) {
+	tags := opentracing.Tags{}
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid tracing tag %q, expected key=value", tag)
+		}
+		tags[parts[0]] = parts[1]
+	}
+	return tags, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// taggedTracer adds tags to every span it starts.  Its spans return it as
+// their Tracer, so spans started from them are tagged too.
+type taggedTracer struct {
+	opentracing.Tracer
+	tags opentracing.Tags
+}
+
+func (t taggedTracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	sp := t.Tracer.StartSpan(operationName, append([]opentracing.StartSpanOption{t.tags}, opts...)...)
+	return taggedSpan{Span: sp, tracer: t}
+}
+
+type taggedSpan struct {
+	opentracing.Span
+	tracer taggedTracer
+}
+
+func (s taggedSpan) Tracer() opentracing.Tracer {
+	return s.tracer
+}
+
+func (s taggedSpan) SetOperationName(operationName string) opentracing.Span {
+	s.Span.SetOperationName(operationName)
+	return s
+}
+
+func (s taggedSpan) SetTag(key string, value interface{}) opentracing.Span {
+	s.Span.SetTag(key, value)
+	return s
+}
+
+func (s taggedSpan) SetBaggageItem(restrictedKey, value string) opentracing.Span {
+	s.Span.SetBaggageItem(restrictedKey, value)
+	return s
+}
+
+// TracedTransport wraps an http.RoundTripper, sending requests under a child
+// of the span in their context, so the servers they're sent to continue its
+// trace.  Any trace headers copied from an incoming request are replaced.
+// The child span finishes when the response body is closed.
+type TracedTransport struct {
+	http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t TracedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	parent := opentracing.SpanFromContext(req.Context())
+	if parent == nil {
+		return rt.RoundTrip(req)
+	}
+	sp := parent.Tracer().StartSpan("HTTP "+req.Method, opentracing.ChildOf(parent.Context()), ext.SpanKindRPCClient)
+	ext.HTTPMethod.Set(sp, req.Method)
+	ext.HTTPUrl.Set(sp, req.URL.String())
+
+	// RoundTrippers mustn't modify the request.
+	traced := new(http.Request)
+	*traced = *req
+	traced.Header = make(http.Header, len(req.Header))
+	for k, vs := range req.Header {
+		traced.Header[k] = vs
+	}
+	if err := sp.Tracer().Inject(sp.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(traced.Header)); err != nil {
+		sp.LogKV("event", "error injecting trace headers", "error", err.Error())
+	}
+	resp, err := rt.RoundTrip(traced)
+	if err != nil {
+		ext.Error.Set(sp, true)
+		sp.Finish()
+		return resp, err
+	}
+	ext.HTTPStatusCode.Set(sp, uint16(resp.StatusCode))
+	resp.Body = &tracedBody{ReadCloser: resp.Body, sp: sp}
+	return resp, nil
+}
+
+// tracedBody finishes the span of a request when its response body is
+// closed, so the span covers reading it.
+type tracedBody struct {
+	io.ReadCloser
+	sp   opentracing.Span
+	once sync.Once
+}
+
+func (b *tracedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.sp.Finish)
+	return err
+}
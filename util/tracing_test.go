@@ -0,0 +1,90 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestTracedTransport(t *testing.T) {
+	tracer := mocktracer.New()
+	var received mocktracer.MockSpanContext
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sc, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received = sc.(mocktracer.MockSpanContext)
+	}))
+	defer server.Close()
+
+	parent := tracer.StartSpan("parent")
+	req, err := http.NewRequest("GET", server.URL, nil)
+	require.NoError(t, err)
+	// Trace headers copied from an incoming request.
+	req.Header.Set("Mockpfx-Ids-Traceid", "1000")
+	req.Header.Set("Mockpfx-Ids-Spanid", "1000")
+	req = req.WithContext(opentracing.ContextWithSpan(context.Background(), parent))
+
+	client := &http.Client{Transport: TracedTransport{}}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	// The span covers reading the body.
+	assert.Len(t, tracer.FinishedSpans(), 0)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1000", req.Header.Get("Mockpfx-Ids-Traceid"))
+
+	spans := tracer.FinishedSpans()
+	require.Len(t, spans, 1)
+	parentContext := parent.Context().(mocktracer.MockSpanContext)
+	assert.Equal(t, parentContext.SpanID, spans[0].ParentID)
+	assert.Equal(t, uint16(http.StatusOK), spans[0].Tag("http.status_code"))
+	assert.Equal(t, parentContext.TraceID, received.TraceID)
+	assert.Equal(t, spans[0].SpanContext.SpanID, received.SpanID)
+}
+
+func TestTaggedTracer(t *testing.T) {
+	tags, err := parseTracingTags("cluster=prod, zone=a=b,")
+	require.NoError(t, err)
+	assert.Equal(t, opentracing.Tags{"cluster": "prod", "zone": "a=b"}, tags)
+
+	tracer := mocktracer.New()
+	tagged := taggedTracer{Tracer: tracer, tags: tags}
+	tagged.StartSpan("span", opentracing.Tag{Key: "zone", Value: "c"}).Finish()
+	spans := tracer.FinishedSpans()
+	require.Len(t, spans, 1)
+	// Tags given when the span is started win.
+	assert.Equal(t, map[string]interface{}{"cluster": "prod", "zone": "c"}, spans[0].Tags())
+
+	// Spans started from its spans are tagged too.
+	tracer.Reset()
+	parent := tagged.StartSpan("parent")
+	parent.Tracer().StartSpan("child", opentracing.ChildOf(parent.Context())).Finish()
+	spans = tracer.FinishedSpans()
+	require.Len(t, spans, 1)
+	assert.Equal(t, map[string]interface{}{"cluster": "prod", "zone": "a=b"}, spans[0].Tags())
+
+	for _, s := range []string{"cluster", "=prod"} {
+		_, err := parseTracingTags(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestInitTracingErrors(t *testing.T) {
+	for _, cfg := range []TracingConfig{
+		{CollectorURL: "http://zipkin", SamplerType: "ratelimiting", SamplerParam: 1},
+		{CollectorURL: "http://zipkin", SamplerType: SamplerProbabilistic, SamplerParam: 2},
+		{CollectorURL: "http://zipkin", SamplerType: SamplerConst, Tags: "cluster"},
+	} {
+		_, err := cfg.InitTracing("test")
+		assert.Error(t, err, "%+v", cfg)
+	}
+}
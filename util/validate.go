@@ -1,39 +1,117 @@
 package util
 
 import (
+	"flag"
 	"regexp"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 )
 
+const (
+	discardReasonLabel = "reason"
+
+	// Reasons for discarding samples which fail validation.
+	missingMetricName      = "missing_metric_name"
+	invalidMetricName      = "metric_name_invalid"
+	invalidLabel           = "label_invalid"
+	labelNameTooLong       = "label_name_too_long"
+	labelValueTooLong      = "label_value_too_long"
+	maxLabelNamesPerSeries = "max_label_names_per_series"
+	greaterThanMaxAge      = "greater_than_max_sample_age"
+)
+
 var (
-	validLabelRE        = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
-	validMetricNameRE   = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
-	maxLabelNameLength  = 1024
-	maxLabelValueLength = 4096
+	validLabelRE      = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	validMetricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+	// DiscardedSamples is a metric of the number of discarded samples, by reason.
+	DiscardedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cortex_discarded_samples_total",
+			Help: "The total number of samples that were discarded.",
+		},
+		[]string{discardReasonLabel, "user"},
+	)
 )
 
-// ValidateSample returns an err if the sample is invalid
-func ValidateSample(s *model.Sample) error {
-	metricName, ok := s.Metric[model.MetricNameLabel]
+func init() {
+	prometheus.MustRegister(DiscardedSamples)
+}
+
+// ValidationConfig configures the limits samples are validated against.
+type ValidationConfig struct {
+	MaxLabelNameLength     int `yaml:"max_label_name_length"`
+	MaxLabelValueLength    int `yaml:"max_label_value_length"`
+	MaxLabelNamesPerSeries int `yaml:"max_label_names_per_series"`
+
+	RejectOldSamples       bool          `yaml:"reject_old_samples"`
+	RejectOldSamplesMaxAge time.Duration `yaml:"reject_old_samples_max_age"`
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *ValidationConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.MaxLabelNameLength, "validation.max-length-label-name", 1024, "Maximum length accepted for label names.")
+	f.IntVar(&cfg.MaxLabelValueLength, "validation.max-length-label-value", 4096, "Maximum length accepted for label values.")
+	f.IntVar(&cfg.MaxLabelNamesPerSeries, "validation.max-label-names-per-series", 30, "Maximum number of label names per series.")
+	f.BoolVar(&cfg.RejectOldSamples, "validation.reject-old-samples", false, "Reject samples older than -validation.reject-old-samples.max-age.")
+	f.DurationVar(&cfg.RejectOldSamplesMaxAge, "validation.reject-old-samples.max-age", 14*24*time.Hour, "Maximum age of accepted samples, if -validation.reject-old-samples is set.")
+}
+
+// ValidateSample returns an err if the sample is invalid, and counts the
+// sample as discarded for the given user.
+func (cfg *ValidationConfig) ValidateSample(userID string, s *model.Sample) error {
+	if err := cfg.ValidateLabels(userID, s.Metric, 1); err != nil {
+		return err
+	}
+	return cfg.ValidateTimestamp(userID, s.Timestamp, 1)
+}
+
+// ValidateLabels returns an err if the labels of a series are invalid, and
+// counts the series' samples as discarded for the given user.
+func (cfg *ValidationConfig) ValidateLabels(userID string, metric model.Metric, samples int) error {
+	reason, err := cfg.validateLabels(metric)
+	if err != nil {
+		Discard(userID, reason, samples, err)
+	}
+	return err
+}
+
+// ValidateTimestamp returns an err if samples with the timestamp are
+// invalid, and counts them as discarded for the given user.
+func (cfg *ValidationConfig) ValidateTimestamp(userID string, ts model.Time, samples int) error {
+	if cfg.RejectOldSamples && ts.Before(model.Now().Add(-cfg.RejectOldSamplesMaxAge)) {
+		Discard(userID, greaterThanMaxAge, samples, ErrSampleTooOld)
+		return ErrSampleTooOld
+	}
+	return nil
+}
+
+func (cfg *ValidationConfig) validateLabels(metric model.Metric) (string, error) {
+	metricName, ok := metric[model.MetricNameLabel]
 	if !ok {
-		return ErrMissingMetricName
+		return missingMetricName, ErrMissingMetricName
 	}
 
 	if !validMetricNameRE.MatchString(string(metricName)) {
-		return ErrInvalidMetricName
+		return invalidMetricName, ErrInvalidMetricName
 	}
 
-	for k, v := range s.Metric {
+	if cfg.MaxLabelNamesPerSeries > 0 && len(metric) > cfg.MaxLabelNamesPerSeries {
+		return maxLabelNamesPerSeries, ErrTooManyLabels
+	}
+
+	for k, v := range metric {
 		if !validLabelRE.MatchString(string(k)) {
-			return ErrInvalidLabel
+			return invalidLabel, ErrInvalidLabel
 		}
-		if len(k) > maxLabelNameLength {
-			return ErrLabelNameTooLong
+		if cfg.MaxLabelNameLength > 0 && len(k) > cfg.MaxLabelNameLength {
+			return labelNameTooLong, ErrLabelNameTooLong
 		}
-		if len(v) > maxLabelValueLength {
-			return ErrLabelValueTooLong
+		if cfg.MaxLabelValueLength > 0 && len(v) > cfg.MaxLabelValueLength {
+			return labelValueTooLong, ErrLabelValueTooLong
 		}
 	}
-	return nil
+	return "", nil
 }
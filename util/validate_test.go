@@ -2,6 +2,7 @@ package util
 
 import (
 	"testing"
+	"time"
 
 	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/assert"
@@ -16,10 +17,38 @@ func TestValidate(t *testing.T) {
 		{map[model.LabelName]model.LabelValue{model.MetricNameLabel: " "}, ErrInvalidMetricName},
 		{map[model.LabelName]model.LabelValue{model.MetricNameLabel: "valid", "foo ": "bar"}, ErrInvalidLabel},
 		{map[model.LabelName]model.LabelValue{model.MetricNameLabel: "valid"}, nil},
+		{map[model.LabelName]model.LabelValue{model.MetricNameLabel: "valid", "foo": "bar", "bar": "baz"}, ErrTooManyLabels},
+		{map[model.LabelName]model.LabelValue{model.MetricNameLabel: "valid", "foo_bar_baz": "bar"}, ErrLabelNameTooLong},
+		{map[model.LabelName]model.LabelValue{model.MetricNameLabel: "valid", "foo": "bar_baz_qux"}, ErrLabelValueTooLong},
 	} {
-		err := ValidateSample(&model.Sample{
+		cfg := ValidationConfig{
+			MaxLabelNameLength:     10,
+			MaxLabelValueLength:    10,
+			MaxLabelNamesPerSeries: 2,
+		}
+		err := cfg.ValidateSample("user", &model.Sample{
 			Metric: c.metric,
 		})
 		assert.Equal(t, c.err, err, "wrong error")
 	}
 }
+
+func TestValidateOldSamples(t *testing.T) {
+	cfg := ValidationConfig{RejectOldSamples: true, RejectOldSamplesMaxAge: time.Hour}
+	metric := model.Metric{model.MetricNameLabel: "valid"}
+	assert.Equal(t, ErrSampleTooOld, cfg.ValidateSample("user", &model.Sample{Metric: metric, Timestamp: model.Now().Add(-2 * time.Hour)}))
+	assert.NoError(t, cfg.ValidateSample("user", &model.Sample{Metric: metric, Timestamp: model.Now().Add(-time.Minute)}))
+
+	cfg.RejectOldSamples = false
+	assert.NoError(t, cfg.ValidateSample("user", &model.Sample{Metric: metric, Timestamp: model.Now().Add(-2 * time.Hour)}))
+}
+
+func TestValidateLabelsCountsSeriesSamples(t *testing.T) {
+	cfg := ValidationConfig{}
+	assert.Equal(t, ErrMissingMetricName, cfg.ValidateLabels("labels", model.Metric{}, 3))
+	recent := RecentDiscards.Recent("labels")
+	if assert.Len(t, recent, 1) {
+		assert.Equal(t, missingMetricName, recent[0].Reason)
+		assert.Equal(t, 3, recent[0].Samples)
+	}
+}